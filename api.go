@@ -2,6 +2,7 @@ package docker
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/auth"
@@ -18,9 +19,15 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const APIVERSION = 1.4
+
+// The oldest version of the API the daemon serves, with the requests and
+// the responses of that version
+const MINAPIVERSION = 1.0
+
 const DEFAULTHTTPHOST = "127.0.0.1"
 const DEFAULTHTTPPORT = 4243
 const DEFAULTUNIXSOCKET = "/var/run/docker.sock"
@@ -64,6 +71,8 @@ func httpError(w http.ResponseWriter, err error) {
 		statusCode = http.StatusNotAcceptable
 	} else if strings.HasPrefix(err.Error(), "Wrong login/password") {
 		statusCode = http.StatusUnauthorized
+	} else if strings.HasPrefix(err.Error(), "Forbidden") {
+		statusCode = http.StatusForbidden
 	} else if strings.Contains(err.Error(), "hasn't been activated") {
 		statusCode = http.StatusForbidden
 	}
@@ -119,6 +128,8 @@ func postAuth(srv *Server, version float64, w http.ResponseWriter, r *http.Reque
 
 func getVersion(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	m := srv.DockerVersion()
+	m.APIVersion = formatAPIVersion(APIVERSION)
+	m.MinAPIVersion = formatAPIVersion(MINAPIVERSION)
 	b, err := json.Marshal(m)
 	if err != nil {
 		return err
@@ -139,6 +150,57 @@ func postContainersKill(srv *Server, version float64, w http.ResponseWriter, r *
 	return nil
 }
 
+func postContainersRename(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.ContainerRename(vars["name"], r.Form.Get("name")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postContainersUpdate(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	update := &UpdateConfig{}
+	if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.ContainerUpdate(vars["name"], update); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postContainersPause(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.ContainerPause(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postContainersUnpause(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.ContainerUnpause(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func getContainersExport(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
@@ -152,6 +214,40 @@ func getContainersExport(srv *Server, version float64, w http.ResponseWriter, r
 	return nil
 }
 
+func getContainersLogs(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	config := &LogsConfig{}
+	var err error
+	if config.Stdout, err = getBoolParam(r.Form.Get("stdout")); err != nil {
+		return err
+	}
+	if config.Stderr, err = getBoolParam(r.Form.Get("stderr")); err != nil {
+		return err
+	}
+	if config.Timestamps, err = getBoolParam(r.Form.Get("timestamps")); err != nil {
+		return err
+	}
+	if config.Since, err = parseLogsTime(r.Form.Get("since")); err != nil {
+		return err
+	}
+	if config.Until, err = parseLogsTime(r.Form.Get("until")); err != nil {
+		return err
+	}
+	if config.Tail, err = parseLogsTail(r.Form.Get("tail")); err != nil {
+		return err
+	}
+	if !config.Stdout && !config.Stderr {
+		return fmt.Errorf("Bad parameter: select stdout, stderr or both")
+	}
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	return srv.ContainerLogs(vars["name"], config, w)
+}
+
 func getImagesJSON(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
@@ -162,8 +258,12 @@ func getImagesJSON(srv *Server, version float64, w http.ResponseWriter, r *http.
 		return err
 	}
 	filter := r.Form.Get("filter")
+	filters, err := parseImageFilters(r.Form.Get("filters"))
+	if err != nil {
+		return err
+	}
 
-	outs, err := srv.Images(all, filter)
+	outs, err := srv.Images(all, filter, filters)
 	if err != nil {
 		return err
 	}
@@ -192,6 +292,26 @@ func getInfo(srv *Server, version float64, w http.ResponseWriter, r *http.Reques
 	return nil
 }
 
+func getSystemDF(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	verbose, err := getBoolParam(r.Form.Get("verbose"))
+	if err != nil {
+		return err
+	}
+	df, err := srv.SystemDF(verbose)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(df)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
 func getEvents(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	sendEvent := func(wf *utils.WriteFlusher, event *utils.JSONMessage) error {
 		b, err := json.Marshal(event)
@@ -200,11 +320,7 @@ func getEvents(srv *Server, version float64, w http.ResponseWriter, r *http.Requ
 		}
 		_, err = wf.Write(b)
 		if err != nil {
-			// On error, evict the listener
 			utils.Debugf("%s", err)
-			srv.Lock()
-			delete(srv.listeners, r.RemoteAddr)
-			srv.Unlock()
 			return err
 		}
 		return nil
@@ -213,31 +329,49 @@ func getEvents(srv *Server, version float64, w http.ResponseWriter, r *http.Requ
 	if err := parseForm(r); err != nil {
 		return err
 	}
-	listener := make(chan utils.JSONMessage)
-	srv.Lock()
-	srv.listeners[r.RemoteAddr] = listener
-	srv.Unlock()
 	since, err := strconv.ParseInt(r.Form.Get("since"), 10, 0)
 	if err != nil {
 		since = 0
 	}
-	w.Header().Set("Content-Type", "application/json")
-	wf := utils.NewWriteFlusher(w)
+	var until int64
+	if value := r.Form.Get("until"); value != "" {
+		if until, err = strconv.ParseInt(value, 10, 0); err != nil {
+			return fmt.Errorf("Bad parameter: invalid until %s", value)
+		}
+	}
+	filters, err := parseEventFilters(r.Form.Get("filters"))
+	if err != nil {
+		return err
+	}
+	srv.resolveEventFilters(filters)
+
+	// Listen before taking the past events, none is lost or sent twice. The
+	// events LogEvent sends while the previous ones are written are
+	// buffered, it drops them once the buffer is full.
+	// The unix socket clients have no address, each request has its id
+	listener := make(chan utils.JSONMessage, eventsLimit)
+	srv.Lock()
+	srv.listenerID++
+	id := strconv.Itoa(srv.listenerID)
+	srv.listeners[id] = listener
+	var past []utils.JSONMessage
 	if since != 0 {
 		// If since, send previous events that happened after the timestamp
-		for _, event := range srv.events {
-			if event.Time >= since {
-				err := sendEvent(wf, &event)
-				if err != nil && err.Error() == "JSON error" {
-					continue
-				}
-				if err != nil {
-					return err
-				}
-			}
-		}
+		past = srv.pastEvents(since, until)
 	}
-	for event := range listener {
+	srv.Unlock()
+	defer func() {
+		srv.Lock()
+		delete(srv.listeners, id)
+		srv.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	wf := utils.NewWriteFlusher(w)
+	for _, event := range past {
+		if !filters.match(&event) {
+			continue
+		}
 		err := sendEvent(wf, &event)
 		if err != nil && err.Error() == "JSON error" {
 			continue
@@ -246,7 +380,33 @@ func getEvents(srv *Server, version float64, w http.ResponseWriter, r *http.Requ
 			return err
 		}
 	}
-	return nil
+
+	// If until, stream the events up to until
+	var end <-chan time.Time
+	if until != 0 {
+		now := time.Now()
+		if until < now.Unix() {
+			return nil
+		}
+		end = time.After(time.Unix(until+1, 0).Sub(now))
+	}
+	for {
+		select {
+		case event := <-listener:
+			if !filters.match(&event) {
+				continue
+			}
+			err := sendEvent(wf, &event)
+			if err != nil && err.Error() == "JSON error" {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		case <-end:
+			return nil
+		}
+	}
 }
 
 func getImagesHistory(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
@@ -258,6 +418,12 @@ func getImagesHistory(srv *Server, version float64, w http.ResponseWriter, r *ht
 	if err != nil {
 		return err
 	}
+	// The clients before 1.4 show the id as it is: a name, or a short id
+	if version < 1.4 {
+		for i := range outs {
+			outs[i].ID = srv.runtime.repositories.ImageName(utils.TruncateID(outs[i].ID))
+		}
+	}
 	b, err := json.Marshal(outs)
 	if err != nil {
 		return err
@@ -283,6 +449,178 @@ func getContainersChanges(srv *Server, version float64, w http.ResponseWriter, r
 	return nil
 }
 
+func getContainersPortsStats(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	stats, err := srv.ContainerPortStats(name)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+// Stream a sample of the resources used by the container every second, until
+// the container stops or the client disconnects. With stream=0, only one.
+func getContainersStats(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	stream := true
+	if r.Form.Get("stream") != "" {
+		var err error
+		if stream, err = getBoolParam(r.Form.Get("stream")); err != nil {
+			return err
+		}
+	}
+
+	// The CPU percentage needs two samples
+	previous, err := srv.ContainerStats(name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	wf := utils.NewWriteFlusher(w)
+	encoder := json.NewEncoder(wf)
+	for first := true; ; first = false {
+		time.Sleep(time.Second)
+		stats, err := srv.ContainerStats(name)
+		if err != nil {
+			if first {
+				return err
+			}
+			utils.Debugf("End of the stats of %s: %s", name, err)
+			return nil
+		}
+		stats.PreCPU = previous.CPU
+		if err := encoder.Encode(stats); err != nil {
+			utils.Debugf("%s", err)
+			return nil
+		}
+		if !stream {
+			return nil
+		}
+		previous = stats
+	}
+}
+
+func postContainersPorts(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	port, err := srv.ContainerPublishPort(name, r.Form.Get("port"))
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(port)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, b)
+	return nil
+}
+
+func deleteContainersPorts(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.ContainerUnpublishPort(vars["name"], vars["spec"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func getNetworksJSON(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	networks, err := srv.Networks()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(networks)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+func getNetworksByName(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	network, err := srv.NetworkInspect(name)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(network)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+func getVolumesJSON(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	filters, err := parseVolumeFilters(r.Form.Get("filters"))
+	if err != nil {
+		return err
+	}
+	// Before the filters, dangling=1 was the only one
+	dangling, err := getBoolParam(r.Form.Get("dangling"))
+	if err != nil {
+		return err
+	}
+	if dangling {
+		filters["dangling"] = []string{"true"}
+	}
+	volumes, err := srv.Volumes(filters)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(volumes)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+func getVolumesByName(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	volume, err := srv.VolumeInspect(name)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
 func getContainersTop(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if version < 1.4 {
 		return fmt.Errorf("top was improved a lot since 1.3, Please upgrade your docker client.")
@@ -357,6 +695,45 @@ func postImagesTag(srv *Server, version float64, w http.ResponseWriter, r *http.
 	return nil
 }
 
+func getImagesGet(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := srv.ImageSave(vars["name"], w); err != nil {
+		utils.Debugf("%s", err)
+		return err
+	}
+	return nil
+}
+
+func postImagesLoad(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := srv.ImageLoad(r.Body); err != nil {
+		return err
+	}
+	return nil
+}
+
+func postImagesSquash(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	id, err := srv.ImageSquash(vars["name"], r.Form.Get("parent"), r.Form.Get("repo"), r.Form.Get("tag"))
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&APIID{id})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, b)
+	return nil
+}
+
 func postCommit(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
@@ -370,7 +747,7 @@ func postCommit(srv *Server, version float64, w http.ResponseWriter, r *http.Req
 	container := r.Form.Get("container")
 	author := r.Form.Get("author")
 	comment := r.Form.Get("comment")
-	id, err := srv.ContainerCommit(container, repo, tag, author, comment, config)
+	id, err := srv.ContainerCommit(container, repo, tag, author, comment, config, r.Form["changes"])
 	if err != nil {
 		return err
 	}
@@ -399,7 +776,16 @@ func postImagesCreate(srv *Server, version float64, w http.ResponseWriter, r *ht
 	}
 	sf := utils.NewStreamFormatter(version > 1.0)
 	if image != "" { //pull
-		if err := srv.ImagePull(image, tag, w, sf, &auth.AuthConfig{}, version > 1.3); err != nil {
+		lazy, err := getBoolParam(r.Form.Get("lazy"))
+		if err != nil {
+			return err
+		}
+		// The credentials of the registry, none for the clients before
+		authConfig := &auth.AuthConfig{}
+		if err := json.NewDecoder(r.Body).Decode(authConfig); err != nil && err != io.EOF {
+			return fmt.Errorf("Invalid auth config: %s", err)
+		}
+		if err := srv.ImagePull(image, tag, w, sf, authConfig, version > 1.3, lazy); err != nil {
 			if sf.Used() {
 				w.Write(sf.FormatError(err))
 				return nil
@@ -407,7 +793,14 @@ func postImagesCreate(srv *Server, version float64, w http.ResponseWriter, r *ht
 			return err
 		}
 	} else { //import
-		if err := srv.ImageImport(src, repo, tag, r.Body, w, sf); err != nil {
+		var config *Config
+		if changes := r.Form["changes"]; len(changes) > 0 {
+			config = &Config{}
+			if err := applyChanges(config, changes); err != nil {
+				return fmt.Errorf("Bad parameter: %s", err)
+			}
+		}
+		if err := srv.ImageImport(src, repo, tag, config, r.Body, w, sf); err != nil {
 			if sf.Used() {
 				w.Write(sf.FormatError(err))
 				return nil
@@ -423,67 +816,168 @@ func getImagesSearch(srv *Server, version float64, w http.ResponseWriter, r *htt
 		return err
 	}
 
-	term := r.Form.Get("term")
-	outs, err := srv.ImagesSearch(term)
+	filters, err := parseSearchFilters(r.Form.Get("filters"))
 	if err != nil {
 		return err
 	}
-	b, err := json.Marshal(outs)
+	limit := 0
+	if value := r.Form.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("Bad parameter: invalid limit %s", value)
+		}
+	}
+	outs, err := srv.ImagesSearch(r.Form.Get("term"), limit, filters)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	if version < 1.4 {
+		// The results before the stars, official and automated columns
+		type apiSearch struct {
+			Name        string
+			Description string
+		}
+		old := make([]apiSearch, 0, len(outs))
+		for _, out := range outs {
+			old = append(old, apiSearch{Name: out.Name, Description: out.Description})
+		}
+		b, err = json.Marshal(old)
+	} else {
+		b, err = json.Marshal(outs)
+	}
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+func postImagesInsert(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+
+	url := r.Form.Get("url")
+	path := r.Form.Get("path")
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	if version > 1.0 {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	sf := utils.NewStreamFormatter(version > 1.0)
+	imgID, err := srv.ImageInsert(name, url, path, w, sf)
+	if err != nil {
+		if sf.Used() {
+			w.Write(sf.FormatError(err))
+			return nil
+		}
+	}
+	b, err := json.Marshal(&APIID{ID: imgID})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+func postImagesPush(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	authConfig := &auth.AuthConfig{}
+	if err := json.NewDecoder(r.Body).Decode(authConfig); err != nil {
+		return err
+	}
+	if err := parseForm(r); err != nil {
+		return err
+	}
+
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	if version > 1.0 {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	sf := utils.NewStreamFormatter(version > 1.0)
+	if err := srv.ImagePush(name, w, sf, authConfig); err != nil {
+		if sf.Used() {
+			w.Write(sf.FormatError(err))
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func getManifestsByName(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	list, err := srv.ManifestListInspect(vars["name"])
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+func postManifestsCreate(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	amend, err := getBoolParam(r.Form.Get("amend"))
+	if err != nil {
+		return err
+	}
+	list, err := srv.ManifestListCreate(r.Form.Get("name"), r.Form["manifest"], amend)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(list)
 	if err != nil {
 		return err
 	}
+	w.WriteHeader(http.StatusCreated)
 	writeJSON(w, b)
 	return nil
 }
 
-func postImagesInsert(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+func postManifestsAnnotate(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
 	}
-
-	url := r.Form.Get("url")
-	path := r.Form.Get("path")
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
 	}
-	name := vars["name"]
-	if version > 1.0 {
-		w.Header().Set("Content-Type", "application/json")
-	}
-	sf := utils.NewStreamFormatter(version > 1.0)
-	imgID, err := srv.ImageInsert(name, url, path, w, sf)
-	if err != nil {
-		if sf.Used() {
-			w.Write(sf.FormatError(err))
-			return nil
-		}
-	}
-	b, err := json.Marshal(&APIID{ID: imgID})
-	if err != nil {
+	if err := srv.ManifestListAnnotate(vars["name"], r.Form.Get("manifest"), r.Form.Get("arch"), r.Form.Get("os"), r.Form.Get("variant")); err != nil {
 		return err
 	}
-	writeJSON(w, b)
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
-func postImagesPush(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+func postManifestsPush(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	authConfig := &auth.AuthConfig{}
-	if err := json.NewDecoder(r.Body).Decode(authConfig); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(authConfig); err != nil && err != io.EOF {
 		return err
 	}
 	if err := parseForm(r); err != nil {
 		return err
 	}
-
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
 	}
-	name := vars["name"]
-	if version > 1.0 {
-		w.Header().Set("Content-Type", "application/json")
+	purge, err := getBoolParam(r.Form.Get("purge"))
+	if err != nil {
+		return err
 	}
-	sf := utils.NewStreamFormatter(version > 1.0)
-	if err := srv.ImagePush(name, w, sf, authConfig); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	sf := utils.NewStreamFormatter(true)
+	if err := srv.ManifestListPush(vars["name"], w, sf, authConfig, purge); err != nil {
 		if sf.Used() {
 			w.Write(sf.FormatError(err))
 			return nil
@@ -497,7 +991,8 @@ func postContainersCreate(srv *Server, version float64, w http.ResponseWriter, r
 	config := &Config{}
 	out := &APIRun{}
 
-	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+	params := &APICreate{Config: config}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
 		return err
 	}
 
@@ -506,12 +1001,18 @@ func postContainersCreate(srv *Server, version float64, w http.ResponseWriter, r
 		return err
 	}
 
-	if len(config.Dns) == 0 && len(srv.runtime.Dns) == 0 && utils.CheckLocalDns(resolvConf) {
+	if len(config.Dns) == 0 && len(srv.runtime.Dns) == 0 && srv.runtime.dnsServer(config.Network) == nil && utils.CheckLocalDns(resolvConf) {
 		out.Warnings = append(out.Warnings, fmt.Sprintf("Docker detected local DNS server on resolv.conf. Using default external servers: %v", defaultDns))
 		config.Dns = defaultDns
 	}
 
-	id, err := srv.ContainerCreate(config)
+	// ContainerCreate discards them as well, without the warnings
+	for _, warning := range discardMemoryLimits(srv.runtime.capabilities, config) {
+		log.Printf("WARNING: %s\n", warning)
+		out.Warnings = append(out.Warnings, warning)
+	}
+
+	id, err := srv.ContainerCreate(config, params.HostConfig)
 	if err != nil {
 		return err
 	}
@@ -526,6 +1027,11 @@ func postContainersCreate(srv *Server, version float64, w http.ResponseWriter, r
 		out.Warnings = append(out.Warnings, "Your kernel does not support memory swap capabilities. Limitation discarded.")
 	}
 
+	if (config.CpuPeriod != 0 || config.CpuQuota != 0) && !srv.runtime.capabilities.CpuCfsQuota {
+		log.Println("WARNING: Your kernel does not support CPU CFS quota. Limitation discarded.")
+		out.Warnings = append(out.Warnings, "Your kernel does not support CPU CFS quota. Limitation discarded.")
+	}
+
 	if !srv.runtime.capabilities.IPv4Forwarding {
 		log.Println("Warning: IPv4 forwarding is disabled.")
 		out.Warnings = append(out.Warnings, "IPv4 forwarding is disabled.")
@@ -540,13 +1046,73 @@ func postContainersCreate(srv *Server, version float64, w http.ResponseWriter, r
 	return nil
 }
 
+func postNetworksCreate(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	// subnet and bridge are shortcuts for the options of the bridge driver
+	options := make(map[string]string)
+	for _, key := range []string{"subnet", "bridge"} {
+		if value := r.Form.Get(key); value != "" {
+			options[key] = value
+		}
+	}
+	for _, opt := range r.Form["opt"] {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Bad parameter: invalid option %s, expected key=value", opt)
+		}
+		options[parts[0]] = parts[1]
+	}
+	network, err := srv.NetworkCreate(r.Form.Get("name"), r.Form.Get("driver"), options)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(network)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, b)
+	return nil
+}
+
+func postVolumesCreate(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	var options map[string]string
+	for _, opt := range r.Form["opt"] {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Bad parameter: invalid option %s, expected key=value", opt)
+		}
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[parts[0]] = parts[1]
+	}
+	volume, err := srv.VolumeCreate(r.Form.Get("name"), r.Form.Get("driver"), options)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, b)
+	return nil
+}
+
 func postContainersRestart(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
 	}
 	t, err := strconv.Atoi(r.Form.Get("t"))
 	if err != nil || t < 0 {
-		t = 10
+		// The stop timeout of the container
+		t = -1
 	}
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
@@ -607,6 +1173,71 @@ func deleteImages(srv *Server, version float64, w http.ResponseWriter, r *http.R
 	return nil
 }
 
+func postNetworksConnect(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	if err := srv.NetworkConnect(name, r.Form.Get("container"), r.Form["alias"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func deleteNetworks(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	if err := srv.NetworkDelete(name); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postImagesPrune(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	pruned, err := srv.ImagesPrune()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(pruned)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+func postVolumesPrune(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	pruned, err := srv.VolumesPrune()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(pruned)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
+func deleteVolumes(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+	if err := srv.VolumeDelete(name); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func postContainersStart(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	hostConfig := &HostConfig{}
 
@@ -636,7 +1267,8 @@ func postContainersStop(srv *Server, version float64, w http.ResponseWriter, r *
 	}
 	t, err := strconv.Atoi(r.Form.Get("t"))
 	if err != nil || t < 0 {
-		t = 10
+		// The stop timeout of the container
+		t = -1
 	}
 
 	if vars == nil {
@@ -652,15 +1284,18 @@ func postContainersStop(srv *Server, version float64, w http.ResponseWriter, r *
 }
 
 func postContainersWait(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
 	}
 	name := vars["name"]
-	status, err := srv.ContainerWait(name)
+	apiWait, err := srv.ContainerWait(name, r.Form.Get("condition"))
 	if err != nil {
 		return err
 	}
-	b, err := json.Marshal(&APIWait{StatusCode: status})
+	b, err := json.Marshal(apiWait)
 	if err != nil {
 		return err
 	}
@@ -714,15 +1349,99 @@ func postContainersAttach(srv *Server, version float64, w http.ResponseWriter, r
 	if err != nil {
 		return err
 	}
+	multiplex, err := getBoolParam(r.Form.Get("multiplex"))
+	if err != nil {
+		return err
+	}
+	var detachKeys []byte
+	if value := r.Form.Get("detachKeys"); value != "" {
+		if detachKeys, err = utils.ParseDetachKeys(value); err != nil {
+			return err
+		}
+	}
 
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
 	}
 	name := vars["name"]
 
-	if _, err := srv.ContainerInspect(name); err != nil {
+	container, err := srv.ContainerInspect(name)
+	if err != nil {
+		return err
+	}
+
+	in, out, err := hijackServer(w)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tcpc, ok := in.(*net.TCPConn); ok {
+			tcpc.CloseWrite()
+		} else {
+			in.Close()
+		}
+	}()
+	defer func() {
+		if tcpc, ok := out.(*net.TCPConn); ok {
+			tcpc.CloseWrite()
+		} else if closer, ok := out.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+
+	// With a tty, there is only one stream
+	var outStream, errStream io.Writer = out, out
+	if multiplex && !container.Config.Tty {
+		fmt.Fprintf(out, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.multiplexed-stream\r\n\r\n")
+		outStream, errStream = utils.NewStdWriter(out, utils.Stdout), utils.NewStdWriter(out, utils.Stderr)
+	} else {
+		fmt.Fprintf(out, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+	}
+	if err := srv.ContainerAttach(name, logs, stream, stdin, stdout, stderr, detachKeys, in, outStream, errStream); err != nil {
+		fmt.Fprintf(errStream, "Error: %s\n", err)
+	}
+	return nil
+}
+
+func postContainersExec(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	config := &ExecConfig{}
+	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	id, err := srv.ContainerExecCreate(vars["name"], config)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&APIID{ID: id})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, b)
+	return nil
+}
+
+func postExecStart(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+
+	e, err := srv.ExecInspect(name)
+	if err != nil {
 		return err
 	}
+	// Detached
+	if !e.Config.AttachStdin && !e.Config.AttachStdout && !e.Config.AttachStderr {
+		if err := srv.ExecStart(name, nil, nil); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
 
 	in, out, err := hijackServer(w)
 	if err != nil {
@@ -744,12 +1463,46 @@ func postContainersAttach(srv *Server, version float64, w http.ResponseWriter, r
 	}()
 
 	fmt.Fprintf(out, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
-	if err := srv.ContainerAttach(name, logs, stream, stdin, stdout, stderr, in, out); err != nil {
+	if err := srv.ExecStart(name, in, out); err != nil {
 		fmt.Fprintf(out, "Error: %s\n", err)
 	}
 	return nil
 }
 
+func postExecResize(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	height, err := strconv.Atoi(r.Form.Get("h"))
+	if err != nil {
+		return err
+	}
+	width, err := strconv.Atoi(r.Form.Get("w"))
+	if err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	return srv.ExecResize(vars["name"], height, width)
+}
+
+func getExecByID(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	e, err := srv.ExecInspect(vars["name"])
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, b)
+	return nil
+}
+
 func wsContainersAttach(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 
 	if err := parseForm(r); err != nil {
@@ -775,6 +1528,12 @@ func wsContainersAttach(srv *Server, version float64, w http.ResponseWriter, r *
 	if err != nil {
 		return err
 	}
+	var detachKeys []byte
+	if value := r.Form.Get("detachKeys"); value != "" {
+		if detachKeys, err = utils.ParseDetachKeys(value); err != nil {
+			return err
+		}
+	}
 
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
@@ -788,7 +1547,7 @@ func wsContainersAttach(srv *Server, version float64, w http.ResponseWriter, r *
 	h := websocket.Handler(func(ws *websocket.Conn) {
 		defer ws.Close()
 
-		if err := srv.ContainerAttach(name, logs, stream, stdin, stdout, stderr, ws, ws); err != nil {
+		if err := srv.ContainerAttach(name, logs, stream, stdin, stdout, stderr, detachKeys, ws, ws, ws); err != nil {
 			utils.Debugf("Error: %s", err)
 		}
 	})
@@ -825,7 +1584,20 @@ func getImagesByName(srv *Server, version float64, w http.ResponseWriter, r *htt
 	if err != nil {
 		return err
 	}
-	b, err := json.Marshal(image)
+	// The image alone before its RepoDigests
+	if version < 1.4 {
+		b, err := json.Marshal(image)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, b)
+		return nil
+	}
+	b, err := json.Marshal(&APIImageInspect{
+		Image:        image,
+		RepoDigests:  srv.runtime.repositories.RepoDigests(image.ID),
+		Materialized: srv.runtime.graph.Materialized(image.ID),
+	})
 	if err != nil {
 		return err
 	}
@@ -864,6 +1636,8 @@ func postBuild(srv *Server, version float64, w http.ResponseWriter, r *http.Requ
 	repoName := r.FormValue("t")
 	rawSuppressOutput := r.FormValue("q")
 	rawNoCache := r.FormValue("nocache")
+	rawJSON := r.FormValue("json")
+	rawSquash := r.FormValue("squash")
 	repoName, tag := utils.ParseRepositoryTag(repoName)
 
 	var context io.Reader
@@ -914,15 +1688,38 @@ func postBuild(srv *Server, version float64, w http.ResponseWriter, r *http.Requ
 	if err != nil {
 		return err
 	}
+	buildArgs := make(map[string]string)
+	if raw := r.FormValue("buildargs"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &buildArgs); err != nil {
+			return fmt.Errorf("Bad parameter: invalid buildargs %s: %s", raw, err)
+		}
+	}
+
+	jsonOutput, err := getBoolParam(rawJSON)
+	if err != nil {
+		return err
+	}
+	squash, err := getBoolParam(rawSquash)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	sf := utils.NewStreamFormatter(jsonOutput)
 
-	b := NewBuildFile(srv, utils.NewWriteFlusher(w), !suppressOutput, !noCache)
+	b := NewBuildFile(srv, utils.NewWriteFlusher(w), sf, !suppressOutput, !noCache, squash, buildArgs)
 	id, err := b.Build(context)
 	if err != nil {
+		if jsonOutput {
+			w.Write(sf.FormatError(err))
+			return nil
+		}
 		fmt.Fprintf(w, "Error build: %s\n", err)
 		return err
 	}
 	if repoName != "" {
-		srv.runtime.repositories.Set(repoName, tag, id, false)
+		srv.runtime.repositories.Set(repoName, tag, id, true)
 	}
 	return nil
 }
@@ -989,9 +1786,22 @@ func makeHttpHandler(srv *Server, logging bool, localMethod string, localRoute s
 		if srv.enableCors {
 			writeCorsHeaders(w, r)
 		}
+		// The clients call the version of the API they share with the
+		// daemon, the older one of the two
+		w.Header().Set("Api-Version", formatAPIVersion(APIVERSION))
+
+		if version > APIVERSION {
+			http.Error(w, fmt.Sprintf("client is newer than server (client API version: %s, server API version: %s)", formatAPIVersion(version), formatAPIVersion(APIVERSION)), http.StatusBadRequest)
+			return
+		}
+		if version < MINAPIVERSION {
+			http.Error(w, fmt.Sprintf("client is too old (client API version: %s, minimum API version: %s)", formatAPIVersion(version), formatAPIVersion(MINAPIVERSION)), http.StatusBadRequest)
+			return
+		}
 
-		if version == 0 || version > APIVERSION {
-			w.WriteHeader(http.StatusNotFound)
+		if err := authorizeAPIAccess(r, localMethod, localRoute); err != nil {
+			log.Printf("%s %s: %s", r.Method, r.RequestURI, err)
+			httpError(w, err)
 			return
 		}
 
@@ -1002,38 +1812,60 @@ func makeHttpHandler(srv *Server, logging bool, localMethod string, localRoute s
 	}
 }
 
+func formatAPIVersion(version float64) string {
+	return strconv.FormatFloat(version, 'f', -1, 64)
+}
+
 func createRouter(srv *Server, logging bool) (*mux.Router, error) {
 	r := mux.NewRouter()
 
 	m := map[string]map[string]HttpApiFunc{
 		"GET": {
-			"/events":                         getEvents,
-			"/info":                           getInfo,
-			"/version":                        getVersion,
-			"/images/json":                    getImagesJSON,
-			"/images/viz":                     getImagesViz,
-			"/images/search":                  getImagesSearch,
-			"/images/{name:.*}/history":       getImagesHistory,
-			"/images/{name:.*}/json":          getImagesByName,
-			"/containers/ps":                  getContainersJSON,
-			"/containers/json":                getContainersJSON,
-			"/containers/{name:.*}/export":    getContainersExport,
-			"/containers/{name:.*}/changes":   getContainersChanges,
-			"/containers/{name:.*}/json":      getContainersByName,
-			"/containers/{name:.*}/top":       getContainersTop,
-			"/containers/{name:.*}/attach/ws": wsContainersAttach,
+			"/events":                           getEvents,
+			"/info":                             getInfo,
+			"/system/df":                        getSystemDF,
+			"/version":                          getVersion,
+			"/images/json":                      getImagesJSON,
+			"/images/viz":                       getImagesViz,
+			"/images/search":                    getImagesSearch,
+			"/images/{name:.*}/history":         getImagesHistory,
+			"/images/{name:.*}/json":            getImagesByName,
+			"/images/{name:.*}/get":             getImagesGet,
+			"/containers/ps":                    getContainersJSON,
+			"/containers/json":                  getContainersJSON,
+			"/containers/{name:.*}/export":      getContainersExport,
+			"/containers/{name:.*}/changes":     getContainersChanges,
+			"/containers/{name:.*}/json":        getContainersByName,
+			"/containers/{name:.*}/top":         getContainersTop,
+			"/containers/{name:.*}/logs":        getContainersLogs,
+			"/containers/{name:.*}/ports/stats": getContainersPortsStats,
+			"/containers/{name:[^/]+}/stats":    getContainersStats,
+			"/containers/{name:.*}/attach/ws":   wsContainersAttach,
+			"/exec/{name:.*}/json":              getExecByID,
+			"/manifests/{name:.*}/json":         getManifestsByName,
+			"/networks/json":                    getNetworksJSON,
+			"/networks/{name:.*}/json":          getNetworksByName,
+			"/volumes/json":                     getVolumesJSON,
+			"/volumes/{name:.*}/json":           getVolumesByName,
 		},
 		"POST": {
 			"/auth":                         postAuth,
 			"/commit":                       postCommit,
 			"/build":                        postBuild,
 			"/images/create":                postImagesCreate,
+			"/images/load":                  postImagesLoad,
+			"/images/prune":                 postImagesPrune,
 			"/images/{name:.*}/insert":      postImagesInsert,
 			"/images/{name:.*}/push":        postImagesPush,
 			"/images/{name:.*}/tag":         postImagesTag,
+			"/images/{name:.*}/squash":      postImagesSquash,
 			"/images/getCache":              postImagesGetCache,
 			"/containers/create":            postContainersCreate,
 			"/containers/{name:.*}/kill":    postContainersKill,
+			"/containers/{name:.*}/pause":   postContainersPause,
+			"/containers/{name:.*}/unpause": postContainersUnpause,
+			"/containers/{name:.*}/rename":  postContainersRename,
+			"/containers/{name:.*}/update":  postContainersUpdate,
 			"/containers/{name:.*}/restart": postContainersRestart,
 			"/containers/{name:.*}/start":   postContainersStart,
 			"/containers/{name:.*}/stop":    postContainersStop,
@@ -1041,10 +1873,25 @@ func createRouter(srv *Server, logging bool) (*mux.Router, error) {
 			"/containers/{name:.*}/resize":  postContainersResize,
 			"/containers/{name:.*}/attach":  postContainersAttach,
 			"/containers/{name:.*}/copy":    postContainersCopy,
+			"/containers/{name:.*}/ports":   postContainersPorts,
+			"/containers/{name:.*}/exec":    postContainersExec,
+			"/exec/{name:.*}/start":         postExecStart,
+			"/exec/{name:.*}/resize":        postExecResize,
+			"/manifests/create":             postManifestsCreate,
+			"/manifests/{name:.*}/annotate": postManifestsAnnotate,
+			"/manifests/{name:.*}/push":     postManifestsPush,
+			"/networks/create":              postNetworksCreate,
+			"/networks/{name:.*}/connect":   postNetworksConnect,
+			"/volumes/create":               postVolumesCreate,
+			"/volumes/prune":                postVolumesPrune,
 		},
 		"DELETE": {
-			"/containers/{name:.*}": deleteContainers,
-			"/images/{name:.*}":     deleteImages,
+			// The ids of the containers have no '/', unlike the port specs
+			"/containers/{name:[^/]+}":                 deleteContainers,
+			"/containers/{name:[^/]+}/ports/{spec:.*}": deleteContainersPorts,
+			"/images/{name:.*}":                        deleteImages,
+			"/networks/{name:.*}":                      deleteNetworks,
+			"/volumes/{name:.*}":                       deleteVolumes,
 		},
 		"OPTIONS": {
 			"": optionsHandler,
@@ -1075,7 +1922,8 @@ func createRouter(srv *Server, logging bool) (*mux.Router, error) {
 	return r, nil
 }
 
-func ListenAndServe(proto, addr string, srv *Server, logging bool) error {
+// Serve the remote API on addr, with TLS on tcp if tlsConfig isn't nil
+func ListenAndServe(proto, addr string, srv *Server, logging bool, tlsConfig *tls.Config) error {
 	log.Printf("Listening for HTTP on %s (%s)\n", addr, proto)
 
 	r, err := createRouter(srv, logging)
@@ -1086,8 +1934,17 @@ func ListenAndServe(proto, addr string, srv *Server, logging bool) error {
 	if e != nil {
 		return e
 	}
+	if proto == "tcp" && tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
 	if proto == "unix" {
-		if err := os.Chmod(addr, 0660); err != nil {
+		// With -api-access, the credentials of the clients restrict the
+		// API instead of the mode of the socket
+		mode := os.FileMode(0660)
+		if len(APIAccessRules) > 0 {
+			mode = 0666
+		}
+		if err := os.Chmod(addr, mode); err != nil {
 			return err
 		}
 
@@ -1107,6 +1964,6 @@ func ListenAndServe(proto, addr string, srv *Server, logging bool) error {
 			}
 		}
 	}
-	httpSrv := http.Server{Addr: addr, Handler: r}
+	httpSrv := http.Server{Addr: addr, Handler: r, ConnContext: peerCredentialsContext}
 	return httpSrv.Serve(l)
 }
@@ -0,0 +1,136 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The rules of -api-access, restricting the API on the unix socket to some
+// users and groups. Without them, anyone who can open the socket has a
+// read-write access; root always has.
+var APIAccessRules []*APIAccessRule
+
+// The access of a user, or of the members of a group, to the API
+type APIAccessRule struct {
+	Group bool // A rule of a group, otherwise of a user
+	ID    int
+	Write bool // A read-write access, otherwise read-only
+}
+
+// The credentials of the process at the other end of a unix socket
+type PeerCredentials struct {
+	Pid  int
+	Uid  int
+	Gids []int // Its primary group and its supplementary ones
+}
+
+// The routes the clients with a read-only access can call besides the GET
+// ones, which all are but the attach of the websocket
+var readOnlyRoutes = map[string]string{
+	"/containers/{name:.*}/wait": "POST",
+	"":                           "OPTIONS",
+}
+
+// Parse user:NAME|UID or group:NAME|GID, followed by =ro for a read-only
+// access or =rw (the default) for a read-write one
+func ParseAPIAccessRule(spec string) (*APIAccessRule, error) {
+	rule := &APIAccessRule{Write: true}
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "ro":
+			rule.Write = false
+		case "rw":
+		default:
+			return nil, fmt.Errorf("Invalid API access %s: the access is ro or rw", spec)
+		}
+	}
+	kindName := strings.SplitN(parts[0], ":", 2)
+	if len(kindName) != 2 || kindName[1] == "" {
+		return nil, fmt.Errorf("Invalid API access %s (user:NAME|UID or group:NAME|GID[=ro|rw])", spec)
+	}
+	file := "/etc/passwd"
+	switch kindName[0] {
+	case "user":
+	case "group":
+		rule.Group = true
+		file = "/etc/group"
+	default:
+		return nil, fmt.Errorf("Invalid API access %s: %s isn't user or group", spec, kindName[0])
+	}
+	id, _, err := lookupID(file, kindName[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid API access %s: %s", spec, err)
+	}
+	rule.ID = id
+	return rule, nil
+}
+
+// Whether the peer can call the API, and whether it can call the routes
+// which aren't read-only
+func apiAccess(rules []*APIAccessRule, cred *PeerCredentials) (allowed, write bool) {
+	if cred == nil {
+		return false, false
+	}
+	if len(rules) == 0 || cred.Uid == 0 {
+		return true, true
+	}
+	for _, rule := range rules {
+		matches := !rule.Group && rule.ID == cred.Uid
+		for _, gid := range cred.Gids {
+			matches = matches || (rule.Group && rule.ID == gid)
+		}
+		if matches {
+			allowed = true
+			write = write || rule.Write
+		}
+	}
+	return allowed, write
+}
+
+func isReadOnlyRoute(method, route string) bool {
+	if method == "GET" {
+		return route != "/containers/{name:.*}/attach/ws"
+	}
+	return readOnlyRoutes[route] == method
+}
+
+type peerCredentialsKey struct{}
+
+// Keep the credentials of the peers of the unix sockets in the context of
+// their requests, nil if they are unknown
+func peerCredentialsContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := peerCredentials(unixConn)
+	if err != nil {
+		utils.Debugf("Unable to get the credentials of the peer: %s", err)
+	}
+	return context.WithValue(ctx, peerCredentialsKey{}, cred)
+}
+
+// Refuse the calls of the clients of the unix socket which APIAccessRules
+// don't allow to call route. The other sockets aren't restricted.
+func authorizeAPIAccess(r *http.Request, method, route string) error {
+	cred, unix := r.Context().Value(peerCredentialsKey{}).(*PeerCredentials)
+	if !unix || len(APIAccessRules) == 0 {
+		return nil
+	}
+	allowed, write := apiAccess(APIAccessRules, cred)
+	if !allowed {
+		if cred == nil {
+			return fmt.Errorf("Forbidden: the credentials of the client are unknown")
+		}
+		return fmt.Errorf("Forbidden: the uid %d has no access to the API", cred.Uid)
+	}
+	if !write && !isReadOnlyRoute(method, route) {
+		return fmt.Errorf("Forbidden: the uid %d has a read-only access to the API", cred.Uid)
+	}
+	return nil
+}
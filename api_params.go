@@ -5,6 +5,7 @@ type APIHistory struct {
 	Tags      []string `json:",omitempty"`
 	Created   int64
 	CreatedBy string `json:",omitempty"`
+	Size      int64  // Size of the layer of the image, in bytes
 }
 
 type APIImages struct {
@@ -20,6 +21,7 @@ type APIInfo struct {
 	Debug              bool
 	Containers         int
 	Images             int
+	Driver             string `json:",omitempty"`
 	NFd                int    `json:",omitempty"`
 	NGoroutines        int    `json:",omitempty"`
 	MemoryLimit        bool   `json:",omitempty"`
@@ -55,12 +57,22 @@ type APIContainers struct {
 type APISearch struct {
 	Name        string
 	Description string
+	StarCount   int
+	IsOfficial  bool
+	IsAutomated bool
 }
 
 type APIID struct {
 	ID string `json:"Id"`
 }
 
+// The body of POST /containers/create: the config of the container, and the
+// host config whose StorageOpt applies when it's created
+type APICreate struct {
+	*Config
+	HostConfig *HostConfig `json:",omitempty"`
+}
+
 type APIRun struct {
 	ID       string   `json:"Id"`
 	Warnings []string `json:",omitempty"`
@@ -70,20 +82,47 @@ type APIPort struct {
 	Port string
 }
 
+type APIPortMapping struct {
+	PrivatePort int
+	PublicPort  int
+	Type        string
+}
+
+type APIPortStats struct {
+	PrivatePort int
+	PublicPort  int
+	Type        string
+	ProxyStats
+}
+
+// The version of the daemon, with the newest and the oldest versions of
+// the API it serves
 type APIVersion struct {
-	Version   string
-	GitCommit string `json:",omitempty"`
-	GoVersion string `json:",omitempty"`
+	Version       string
+	GitCommit     string `json:",omitempty"`
+	GoVersion     string `json:",omitempty"`
+	APIVersion    string `json:"ApiVersion,omitempty"`
+	MinAPIVersion string `json:"MinApiVersion,omitempty"`
 }
 
 type APIWait struct {
 	StatusCode int
+	ExitSignal int  // The signal which killed the process, 0 if it exited on its own
+	OOMKilled  bool // Whether it ran out of memory
 }
 
 type APIAuth struct {
 	Status string
 }
 
+// The image with the repo@digest names referring to it, and whether its
+// layers are all stored, false if it was pulled lazily and wasn't used yet
+type APIImageInspect struct {
+	*Image
+	RepoDigests  []string
+	Materialized bool
+}
+
 type APIImageConfig struct {
 	ID string `json:"Id"`
 	*Config
@@ -93,3 +132,61 @@ type APICopy struct {
 	Resource string
 	HostPath string
 }
+
+type APINetwork struct {
+	Name       string
+	Driver     string
+	Bridge     string
+	Subnet     string   `json:",omitempty"`
+	Gateway    string   `json:",omitempty"`
+	Containers []string `json:",omitempty"`
+}
+
+type APIVolume struct {
+	Name       string
+	Mountpoint string // Empty if its driver only makes it available while it's mounted
+	Driver     string
+	Created    int64
+	Anonymous  bool     `json:",omitempty"` // Created by docker for a container, named by its ID
+	Size       int64    `json:",omitempty"` // The usage of its data, only when inspected
+	Containers []string `json:",omitempty"`
+}
+
+type APIDiskUsage struct {
+	Type        string // Images, Containers, Local Volumes or Build Cache
+	Total       int
+	Active      int   // The ones a container uses, or the running containers
+	Size        int64 // The bytes used on the disk
+	Reclaimable int64 // The bytes of the inactive ones
+}
+
+type APIDiskUsageObject struct {
+	Type   string // Image, Container, Volume or Build Cache
+	ID     string `json:"Id"`
+	Name   string `json:",omitempty"`
+	Size   int64
+	Active bool
+}
+
+type APISystemDF struct {
+	Usage   []APIDiskUsage
+	Objects []APIDiskUsageObject `json:",omitempty"` // Only in verbose mode
+}
+
+type APIImagesPrune struct {
+	ImagesDeleted  []string
+	SpaceReclaimed int64 // The bytes of the layers of the images removed
+}
+
+type APIVolumesPrune struct {
+	VolumesDeleted []string
+	SpaceReclaimed int64 // The bytes of the data of the volumes removed
+}
+
+type APIExec struct {
+	ID        string `json:"Id"`
+	Container string
+	Running   bool
+	ExitCode  int
+	Config    *ExecConfig
+}
@@ -4,14 +4,28 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"github.com/dotcloud/docker/utils"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -60,6 +74,256 @@ func TestGetVersion(t *testing.T) {
 	if v.Version != VERSION {
 		t.Errorf("Expected version %s, %s found", VERSION, v.Version)
 	}
+	if v.APIVersion != formatAPIVersion(APIVERSION) || v.MinAPIVersion != formatAPIVersion(MINAPIVERSION) {
+		t.Errorf("Expected the API versions %g and %g, %s and %s found", APIVERSION, MINAPIVERSION, v.APIVersion, v.MinAPIVersion)
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+	router, err := createRouter(srv, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRecorder()
+		router.ServeHTTP(r, req)
+		return r
+	}
+
+	for _, path := range []string{"/version", "/v1.0/version", fmt.Sprintf("/v%g/version", APIVERSION)} {
+		r := get(path)
+		if r.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, %d found", path, r.Code)
+		}
+		if version := r.Header().Get("Api-Version"); version != formatAPIVersion(APIVERSION) {
+			t.Fatalf("Expected the header Api-Version %g for %s, %s found", APIVERSION, path, version)
+		}
+	}
+	if r := get("/v9.9/version"); r.Code != http.StatusBadRequest || !strings.Contains(r.Body.String(), "client is newer than server") {
+		t.Fatalf("Expected a newer client to be refused, %d %s found", r.Code, r.Body)
+	}
+
+	// The clients before 1.4 get the image alone
+	for version, expected := range map[string]bool{"1.3": false, "1.4": true} {
+		r := get("/v" + version + "/images/" + unitTestImageID + "/json")
+		if r.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for the image with the API %s, %d found", version, r.Code)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(r.Body.Bytes(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := fields["RepoDigests"]; exists != expected {
+			t.Fatalf("Unexpected RepoDigests of the image with the API %s: %v", version, fields)
+		}
+	}
+}
+
+// Write the certificate name, signed by parent or self-signed, and its key
+// in dir
+func mkTestCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+"-cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+	router, err := createRouter(srv, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "docker-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := mkTestCert(t, dir, "ca", 1, nil, nil)
+	mkTestCert(t, dir, "daemon", 2, ca, caKey)
+	mkTestCert(t, dir, "client", 3, ca, caKey)
+	mkTestCert(t, dir, "other", 4, nil, nil)
+	options := func(name string, verify bool) *TLSOptions {
+		return &TLSOptions{
+			CACert: path.Join(dir, "ca-cert.pem"),
+			Cert:   path.Join(dir, name+"-cert.pem"),
+			Key:    path.Join(dir, name+"-key.pem"),
+			Verify: verify,
+		}
+	}
+
+	serverConfig, err := ServerTLSConfig(options("daemon", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := httptest.NewUnstartedServer(router)
+	daemon.TLS = serverConfig
+	daemon.StartTLS()
+	defer daemon.Close()
+
+	version := func(name string, verify bool) error {
+		clientConfig, err := ClientTLSConfig(options(name, verify))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli := NewDockerCli(nil, ioutil.Discard, ioutil.Discard, "tcp", daemon.Listener.Addr().String())
+		cli.tlsConfig = clientConfig
+		_, _, err = cli.call("GET", "/version", nil)
+		return err
+	}
+	if err := version("client", true); err != nil {
+		t.Fatalf("Expected the client certificate signed by the CA to be accepted: %s", err)
+	}
+	if err := version("client", false); err != nil {
+		t.Fatalf("Expected the client to accept the daemon without -tlsverify: %s", err)
+	}
+	if err := version("none", true); err == nil {
+		t.Fatal("Expected the client without certificate to be refused")
+	}
+	if err := version("other", false); err == nil {
+		t.Fatal("Expected the client certificate of another CA to be refused")
+	}
+}
+
+func TestAPIAccess(t *testing.T) {
+	for spec, expected := range map[string]APIAccessRule{
+		"user:root":     {Group: false, ID: 0, Write: true},
+		"group:1000=ro": {Group: true, ID: 1000, Write: false},
+		"user:1001=rw":  {Group: false, ID: 1001, Write: true},
+	} {
+		rule, err := ParseAPIAccessRule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *rule != expected {
+			t.Fatalf("Expected %v for %s, %v found", expected, spec, *rule)
+		}
+	}
+	for _, spec := range []string{"root", "uid:0", "user:", "user:0=rx", "group:nosuchgroup"} {
+		if _, err := ParseAPIAccessRule(spec); err == nil {
+			t.Fatalf("Expected %s to be invalid", spec)
+		}
+	}
+
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+	router, err := createRouter(srv, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	APIAccessRules = []*APIAccessRule{{Group: true, ID: 1000}, {ID: 1001, Write: true}}
+	defer func() { APIAccessRules = nil }()
+
+	call := func(method, path string, cred *PeerCredentials) int {
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred != nil {
+			req = req.WithContext(context.WithValue(req.Context(), peerCredentialsKey{}, cred))
+		}
+		r := httptest.NewRecorder()
+		router.ServeHTTP(r, req)
+		return r.Code
+	}
+	reader := &PeerCredentials{Uid: 1002, Gids: []int{1002, 1000}}
+	writer := &PeerCredentials{Uid: 1001, Gids: []int{1001}}
+	other := &PeerCredentials{Uid: 1003, Gids: []int{1003}}
+	if code := call("GET", "/version", reader); code != http.StatusOK {
+		t.Fatalf("Expected the group 1000 to read, %d found", code)
+	}
+	if code := call("POST", "/containers/nosuchcontainer/kill", reader); code != http.StatusForbidden {
+		t.Fatalf("Expected the group 1000 not to write, %d found", code)
+	}
+	if code := call("POST", "/containers/nosuchcontainer/kill", writer); code != http.StatusNotFound {
+		t.Fatalf("Expected the user 1001 to write, %d found", code)
+	}
+	if code := call("GET", "/version", other); code != http.StatusForbidden {
+		t.Fatalf("Expected the user 1003 to be refused, %d found", code)
+	}
+	if code := call("POST", "/containers/nosuchcontainer/kill", &PeerCredentials{Uid: 0, Gids: []int{0}}); code != http.StatusNotFound {
+		t.Fatalf("Expected root to write, %d found", code)
+	}
+	// The tcp sockets aren't restricted
+	if code := call("POST", "/containers/nosuchcontainer/kill", nil); code != http.StatusNotFound {
+		t.Fatalf("Expected the clients of tcp to write, %d found", code)
+	}
+
+	// The credentials of a process connected to a unix socket
+	dir, err := ioutil.TempDir("", "docker-peercred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", path.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("unix", path.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cred, err := peerCredentials(conn.(*net.UnixConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Pid != os.Getpid() || cred.Uid != os.Getuid() || cred.Gids[0] != os.Getgid() {
+		t.Fatalf("Expected the credentials of the test, %v found", cred)
+	}
 }
 
 func TestGetInfo(t *testing.T) {
@@ -127,6 +391,131 @@ func TestGetEvents(t *testing.T) {
 
 }
 
+func TestGetEventsSameAddr(t *testing.T) {
+	runtime := mkRuntime(t)
+	srv := &Server{
+		runtime:   runtime,
+		events:    make([]utils.JSONMessage, 0, 64),
+		listeners: make(map[string]chan utils.JSONMessage),
+	}
+
+	// The clients of the unix socket all have the same address
+	until := strconv.FormatInt(time.Now().Unix()+1, 10)
+	recorders := make(chan *httptest.ResponseRecorder, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			req, err := http.NewRequest("GET", "/events?until="+until, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = "@"
+			r := httptest.NewRecorder()
+			if err := getEvents(srv, APIVERSION, r, req, nil); err != nil {
+				t.Fatal(err)
+			}
+			recorders <- r
+		}()
+	}
+	setTimeout(t, "The listeners weren't added", time.Second, func() {
+		for {
+			srv.Lock()
+			count := len(srv.listeners)
+			srv.Unlock()
+			if count == 2 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	srv.LogEvent("start", "4fa6e0f0c678", "base:latest")
+	for i := 0; i < 2; i++ {
+		r := <-recorders
+		var jm utils.JSONMessage
+		if err := json.NewDecoder(r.Body).Decode(&jm); err != nil {
+			t.Fatalf("Expected each listener to get the event: %s", err)
+		}
+		if jm.ID != "4fa6e0f0c678" {
+			t.Fatalf("Unexpected event %v", jm)
+		}
+	}
+	if len(srv.listeners) != 0 {
+		t.Fatalf("Expected the listeners to be removed, found %d", len(srv.listeners))
+	}
+}
+
+func TestGetEventsFilters(t *testing.T) {
+	runtime := mkRuntime(t)
+	srv := &Server{
+		runtime:   runtime,
+		events:    make([]utils.JSONMessage, 0, 64),
+		listeners: make(map[string]chan utils.JSONMessage),
+	}
+
+	srv.LogEvent("start", "4fa6e0f0c678", "base:latest")
+	srv.LogEvent("die", "4fa6e0f0c678", "base:latest")
+	srv.LogEvent("start", "dfdf82bd3881", "ubuntu:12.04")
+	srv.LogEvent("untag", "b750fe79269d", "")
+
+	events := func(query string) []utils.JSONMessage {
+		req, err := http.NewRequest("GET", "/events?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRecorder()
+		// The until of the past returns right after the past events
+		if err := getEvents(srv, APIVERSION, r, req, nil); err != nil {
+			t.Fatal(err)
+		}
+		var events []utils.JSONMessage
+		dec := json.NewDecoder(r.Body)
+		for {
+			var jm utils.JSONMessage
+			if err := dec.Decode(&jm); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, jm)
+		}
+		return events
+	}
+
+	until := strconv.FormatInt(time.Now().Unix()-1, 10)
+	if found := events("since=1&until=" + until); len(found) != 0 {
+		t.Fatalf("Expected no event before %s, found %v", until, found)
+	}
+	until = strconv.FormatInt(time.Now().Unix(), 10)
+	if found := events("since=1&until=" + until); len(found) != 4 {
+		t.Fatalf("Expected 4 events, found %v", found)
+	}
+	for filters, expected := range map[string][]string{
+		`{"event":["start"]}`:                        {"4fa6e0f0c678", "dfdf82bd3881"},
+		`{"container":["4fa6e0f0c678"]}`:             {"4fa6e0f0c678", "4fa6e0f0c678"},
+		`{"image":["ubuntu"]}`:                       {"dfdf82bd3881"},
+		`{"image":["base:latest","b750fe79269d"]}`:   {"4fa6e0f0c678", "4fa6e0f0c678", "b750fe79269d"},
+		`{"event":["start"],"image":["base"]}`:       {"4fa6e0f0c678"},
+		`{"event":["die"],"container":["dfdf82bd"]}`: {},
+	} {
+		found := events("since=1&until=" + until + "&filters=" + url.QueryEscape(filters))
+		if len(found) != len(expected) {
+			t.Fatalf("Expected %d events with the filters %s, found %v", len(expected), filters, found)
+		}
+		for i, jm := range found {
+			if jm.ID != expected[i] {
+				t.Fatalf("Expected the event %d of the filters %s to be of %s, found %s", i, filters, expected[i], jm.ID)
+			}
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/events?filters="+url.QueryEscape(`{"name":["foo"]}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getEvents(srv, APIVERSION, httptest.NewRecorder(), req, nil); err == nil {
+		t.Fatalf("An invalid filter should fail")
+	}
+}
+
 func TestGetImagesJSON(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -135,7 +524,7 @@ func TestGetImagesJSON(t *testing.T) {
 
 	// all=0
 
-	initialImages, err := srv.Images(false, "")
+	initialImages, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -175,7 +564,7 @@ func TestGetImagesJSON(t *testing.T) {
 
 	// all=1
 
-	initialImages, err = srv.Images(true, "")
+	initialImages, err = srv.Images(true, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -293,6 +682,21 @@ func TestGetImagesHistory(t *testing.T) {
 	if len(history) != 1 {
 		t.Errorf("Expected 1 line, %d found", len(history))
 	}
+	if history[0].ID != unitTestImageID || history[0].Size <= 0 {
+		t.Errorf("Expected the layer %s with its size, %s of %d bytes found", unitTestImageID, history[0].ID, history[0].Size)
+	}
+
+	// The short id for the clients before 1.4
+	r = httptest.NewRecorder()
+	if err := getImagesHistory(srv, 1.3, r, nil, map[string]string{"name": unitTestImageName}); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(r.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].ID != utils.TruncateID(unitTestImageID) {
+		t.Errorf("Expected the short id %s, %v found", utils.TruncateID(unitTestImageID), history)
+	}
 }
 
 func TestGetImagesByName(t *testing.T) {
@@ -448,21 +852,16 @@ func TestGetContainersChanges(t *testing.T) {
 	}
 }
 
-func TestGetContainersTop(t *testing.T) {
-	runtime, err := newTestRuntime()
-	if err != nil {
-		t.Fatal(err)
-	}
+func TestGetContainersStats(t *testing.T) {
+	runtime := mkRuntime(t)
 	defer nuke(runtime)
 
 	srv := &Server{runtime: runtime}
 
-	builder := NewBuilder(runtime)
-
-	container, err := builder.Create(
+	container, err := NewBuilder(runtime).Create(
 		&Config{
 			Image:     GetTestImage(runtime).ID,
-			Cmd:       []string{"/bin/sh", "-c", "cat"},
+			Cmd:       []string{"cat"},
 			OpenStdin: true,
 		},
 	)
@@ -470,78 +869,262 @@ func TestGetContainersTop(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer runtime.Destroy(container)
-	defer func() {
-		// Make sure the process dies before destroying runtime
-		container.stdin.Close()
-		container.WaitTimeout(2 * time.Second)
-	}()
 
-	hostConfig := &HostConfig{}
-	if err := container.Start(hostConfig); err != nil {
+	req, err := http.NewRequest("GET", "/containers/"+container.ID+"/stats?stream=0", nil)
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	setTimeout(t, "Waiting for the container to be started timed out", 10*time.Second, func() {
-		for {
-			if container.State.Running {
-				break
-			}
-			time.Sleep(10 * time.Millisecond)
-		}
-	})
-
-	if !container.State.Running {
-		t.Fatalf("Container should be running")
+	r := httptest.NewRecorder()
+	if err := getContainersStats(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err == nil {
+		t.Fatal("Expected an error for a stopped container")
 	}
 
-	// Make sure sh spawn up cat
-	setTimeout(t, "read/write assertion timed out", 2*time.Second, func() {
-		in, _ := container.StdinPipe()
-		out, _ := container.StdoutPipe()
-		if err := assertPipe("hello\n", "hello", out, in, 15); err != nil {
-			t.Fatal(err)
-		}
-	})
-
-	r := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/"+container.ID+"/top?ps_args=u", bytes.NewReader([]byte{}))
-	if err != nil {
+	hostConfig := &HostConfig{}
+	if err := container.Start(hostConfig); err != nil {
 		t.Fatal(err)
 	}
-	if err := getContainersTop(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+	defer container.Kill()
+
+	r = httptest.NewRecorder()
+	if err := getContainersStats(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
 		t.Fatal(err)
 	}
-	procs := APITop{}
-	if err := json.Unmarshal(r.Body.Bytes(), &procs); err != nil {
+	stats := &ContainerStats{}
+	if err := json.Unmarshal(r.Body.Bytes(), stats); err != nil {
 		t.Fatal(err)
 	}
-
-	if len(procs.Titles) != 11 {
-		t.Fatalf("Expected 11 titles, found %d.", len(procs.Titles))
-	}
-	if procs.Titles[0] != "USER" || procs.Titles[10] != "COMMAND" {
-		t.Fatalf("Expected Titles[0] to be USER and Titles[10] to be COMMAND, found %s and %s.", procs.Titles[0], procs.Titles[10])
-	}
-
-	if len(procs.Processes) != 2 {
-		t.Fatalf("Expected 2 processes, found %d.", len(procs.Processes))
-	}
-	if procs.Processes[0][10] != "/bin/sh" && procs.Processes[0][10] != "cat" {
-		t.Fatalf("Expected `cat` or `/bin/sh`, found %s.", procs.Processes[0][10])
+	if stats.Memory.Usage == 0 || len(stats.CPU.PercpuUsage) == 0 || stats.CPU.SystemUsage <= stats.PreCPU.SystemUsage {
+		t.Fatalf("Unexpected stats: %#v", stats)
 	}
-	if procs.Processes[1][10] != "/bin/sh" && procs.Processes[1][10] != "cat" {
-		t.Fatalf("Expected `cat` or `/bin/sh`, found %s.", procs.Processes[1][10])
+	if _, exists := stats.Networks["eth0"]; !exists {
+		t.Fatalf("The stats of eth0 are missing: %v", stats.Networks)
 	}
 }
 
-func TestGetContainersByName(t *testing.T) {
+func TestGetContainersPortsStats(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
 
 	srv := &Server{runtime: runtime}
 
-	builder := NewBuilder(runtime)
-
+	container, err := NewBuilder(runtime).Create(
+		&Config{
+			Image:     GetTestImage(runtime).ID,
+			Cmd:       []string{"cat"},
+			OpenStdin: true,
+			PortSpecs: []string{"80", "53/udp"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	hostConfig := &HostConfig{}
+	if err := container.Start(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	r := httptest.NewRecorder()
+	if err := getContainersPortsStats(srv, APIVERSION, r, nil, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	stats := []APIPortStats{}
+	if err := json.Unmarshal(r.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected stats for 2 ports, found %d", len(stats))
+	}
+	for _, port := range stats {
+		if port.PublicPort == 0 || port.TotalAccepted != 0 {
+			t.Fatalf("Unexpected stats for %v/%v: %#v", port.Type, port.PrivatePort, port)
+		}
+	}
+
+	r = httptest.NewRecorder()
+	if err := getContainersPortsStats(srv, APIVERSION, r, nil, map[string]string{"name": "nonexistent"}); err == nil {
+		t.Fatalf("Expected an error for a non existent container")
+	}
+}
+
+func TestPostContainersPorts(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, err := NewBuilder(runtime).Create(
+		&Config{
+			Image:     GetTestImage(runtime).ID,
+			Cmd:       []string{"cat"},
+			OpenStdin: true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	req, err := http.NewRequest("POST", "/containers/"+container.ID+"/ports?port=53/udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The container isn't running
+	if err := postContainersPorts(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": container.ID}); err == nil {
+		t.Fatalf("Expected an error for a stopped container")
+	}
+
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	r := httptest.NewRecorder()
+	if err := postContainersPorts(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusCreated {
+		t.Fatalf("%d Created expected, received %d\n", http.StatusCreated, r.Code)
+	}
+	port := &APIPortMapping{}
+	if err := json.Unmarshal(r.Body.Bytes(), port); err != nil {
+		t.Fatal(err)
+	}
+	if port.PrivatePort != 53 || port.Type != "udp" || port.PublicPort == 0 {
+		t.Fatalf("Unexpected port mapping: %#v", port)
+	}
+	if container.NetworkSettings.PortMapping["Udp"]["53"] != strconv.Itoa(port.PublicPort) {
+		t.Fatalf("The port mapping of the container wasn't updated: %v", container.NetworkSettings.PortMapping)
+	}
+	if len(container.Config.PortSpecs) != 1 || container.Config.PortSpecs[0] != "53/udp" {
+		t.Fatalf("Unexpected port specs: %v", container.Config.PortSpecs)
+	}
+	// Already published
+	if err := postContainersPorts(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": container.ID}); err == nil {
+		t.Fatalf("Publishing the same port twice should fail")
+	}
+
+	r = httptest.NewRecorder()
+	if err := deleteContainersPorts(srv, APIVERSION, r, nil, map[string]string{"name": container.ID, "spec": "53/udp"}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusNoContent {
+		t.Fatalf("%d NO CONTENT expected, received %d\n", http.StatusNoContent, r.Code)
+	}
+	if _, exists := container.NetworkSettings.PortMapping["Udp"]["53"]; exists || len(container.Config.PortSpecs) != 0 {
+		t.Fatalf("The port is still published")
+	}
+	if err := deleteContainersPorts(srv, APIVERSION, httptest.NewRecorder(), nil, map[string]string{"name": container.ID, "spec": "53/udp"}); err == nil {
+		t.Fatalf("Expected an error for a port which isn't published")
+	}
+}
+
+func TestGetContainersTop(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	builder := NewBuilder(runtime)
+
+	container, err := builder.Create(
+		&Config{
+			Image:     GetTestImage(runtime).ID,
+			Cmd:       []string{"/bin/sh", "-c", "cat"},
+			OpenStdin: true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	defer func() {
+		// Make sure the process dies before destroying runtime
+		container.stdin.Close()
+		container.WaitTimeout(2 * time.Second)
+	}()
+
+	hostConfig := &HostConfig{}
+	if err := container.Start(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	setTimeout(t, "Waiting for the container to be started timed out", 10*time.Second, func() {
+		for {
+			if container.State.Running {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	if !container.State.Running {
+		t.Fatalf("Container should be running")
+	}
+
+	// Make sure sh spawn up cat
+	setTimeout(t, "read/write assertion timed out", 2*time.Second, func() {
+		in, _ := container.StdinPipe()
+		out, _ := container.StdoutPipe()
+		if err := assertPipe("hello\n", "hello", out, in, 15); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	r := httptest.NewRecorder()
+	// ps runs on the host: without x, it would only list the processes with a tty
+	req, err := http.NewRequest("GET", "/"+container.ID+"/top?ps_args=aux", bytes.NewReader([]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getContainersTop(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	procs := APITop{}
+	if err := json.Unmarshal(r.Body.Bytes(), &procs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(procs.Titles) != 11 {
+		t.Fatalf("Expected 11 titles, found %d.", len(procs.Titles))
+	}
+	if procs.Titles[0] != "USER" || procs.Titles[10] != "COMMAND" {
+		t.Fatalf("Expected Titles[0] to be USER and Titles[10] to be COMMAND, found %s and %s.", procs.Titles[0], procs.Titles[10])
+	}
+
+	if len(procs.Processes) != 2 {
+		t.Fatalf("Expected 2 processes, found %d.", len(procs.Processes))
+	}
+	if procs.Processes[0][10] != "/bin/sh" && procs.Processes[0][10] != "cat" {
+		t.Fatalf("Expected `cat` or `/bin/sh`, found %s.", procs.Processes[0][10])
+	}
+	if procs.Processes[1][10] != "/bin/sh" && procs.Processes[1][10] != "cat" {
+		t.Fatalf("Expected `cat` or `/bin/sh`, found %s.", procs.Processes[1][10])
+	}
+
+	// The processes of the container are found by their PID
+	req, err = http.NewRequest("GET", "/"+container.ID+"/top?ps_args=-eo+comm", bytes.NewReader([]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getContainersTop(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": container.ID}); err == nil {
+		t.Fatalf("Listing the processes without a PID column should fail")
+	}
+}
+
+func TestGetContainersByName(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	builder := NewBuilder(runtime)
+
 	// Create a container and remove a file
 	container, err := builder.Create(
 		&Config{
@@ -655,13 +1238,17 @@ func TestPostContainersCreate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := os.Stat(path.Join(container.rwPath(), "test")); err != nil {
-		if os.IsNotExist(err) {
-			utils.Debugf("Err: %s", err)
-			t.Fatalf("The test file has not been created")
-		}
+	changes, err := container.Changes()
+	if err != nil {
 		t.Fatal(err)
 	}
+	created := false
+	for _, change := range changes {
+		created = created || (change.Path == "/test" && change.Kind == ChangeAdd)
+	}
+	if !created {
+		t.Fatalf("The test file has not been created")
+	}
 }
 
 func TestPostContainersKill(t *testing.T) {
@@ -882,7 +1469,11 @@ func TestPostContainersWait(t *testing.T) {
 
 	setTimeout(t, "Wait timed out", 3*time.Second, func() {
 		r := httptest.NewRecorder()
-		if err := postContainersWait(srv, APIVERSION, r, nil, map[string]string{"name": container.ID}); err != nil {
+		req, err := http.NewRequest("POST", "/containers/"+container.ID+"/wait", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := postContainersWait(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
 			t.Fatal(err)
 		}
 		apiWait := &APIWait{}
@@ -892,6 +1483,9 @@ func TestPostContainersWait(t *testing.T) {
 		if apiWait.StatusCode != 0 {
 			t.Fatalf("Non zero exit code for sleep: %d\n", apiWait.StatusCode)
 		}
+		if apiWait.ExitSignal != 0 || apiWait.OOMKilled {
+			t.Fatalf("sleep should have exited on its own: %v", apiWait)
+		}
 	})
 
 	if container.State.Running {
@@ -899,6 +1493,82 @@ func TestPostContainersWait(t *testing.T) {
 	}
 }
 
+func TestPostContainersWaitCondition(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, err := NewBuilder(runtime).Create(
+		&Config{
+			Image: GetTestImage(runtime).ID,
+			Cmd:   []string{"sh", "-c", "exit 3"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(condition string) chan int {
+		status := make(chan int)
+		go func() {
+			r := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/containers/"+container.ID+"/wait?condition="+condition, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := postContainersWait(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+				t.Error(err)
+				return
+			}
+			apiWait := &APIWait{}
+			if err := json.Unmarshal(r.Body.Bytes(), apiWait); err != nil {
+				t.Error(err)
+				return
+			}
+			status <- apiWait.StatusCode
+		}()
+		return status
+	}
+
+	// The container isn't running yet: wait for its first exit
+	nextExit := wait("next-exit")
+	removed := wait("removed")
+	time.Sleep(100 * time.Millisecond)
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	setTimeout(t, "Wait for the next exit timed out", 3*time.Second, func() {
+		if status := <-nextExit; status != 3 {
+			t.Fatalf("Unexpected exit code: %d", status)
+		}
+	})
+
+	select {
+	case <-removed:
+		t.Fatal("Wait for the removal returned before the container was removed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/containers/"+container.ID+"/wait?condition=forever", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := postContainersWait(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err == nil {
+		t.Fatal("Expected an error for an invalid condition")
+	}
+	if err := runtime.Destroy(container); err != nil {
+		t.Fatal(err)
+	}
+	setTimeout(t, "Wait for the removal timed out", 3*time.Second, func() {
+		if status := <-removed; status != 3 {
+			t.Fatalf("Unexpected exit code: %d", status)
+		}
+	})
+}
+
 func TestPostContainersAttach(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -1026,8 +1696,469 @@ func TestDeleteContainers(t *testing.T) {
 		t.Fatalf("The container as not been deleted")
 	}
 
-	if _, err := os.Stat(path.Join(container.rwPath(), "test")); err == nil {
-		t.Fatalf("The test file has not been deleted")
+	if runtime.graph.driver.Exists(container.ID) {
+		t.Fatalf("The layer of the container has not been deleted")
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	req, err := http.NewRequest("POST", "/networks/create?name=testnet&subnet=10.234.0.0/24", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	if err := postNetworksCreate(srv, APIVERSION, r, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusCreated {
+		t.Fatalf("%d Created expected, received %d\n", http.StatusCreated, r.Code)
+	}
+	network := &APINetwork{}
+	if err := json.Unmarshal(r.Body.Bytes(), network); err != nil {
+		t.Fatal(err)
+	}
+	if network.Subnet != "10.234.0.0/24" || network.Gateway != "10.234.0.1" || network.Bridge != "br-testnet" {
+		t.Fatalf("Unexpected network: %#v", network)
+	}
+	if err := postNetworksCreate(srv, APIVERSION, httptest.NewRecorder(), req, nil); err == nil {
+		t.Fatalf("Creating the same network twice should fail")
+	}
+
+	r = httptest.NewRecorder()
+	if err := getNetworksJSON(srv, APIVERSION, r, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	networks := []APINetwork{}
+	if err := json.Unmarshal(r.Body.Bytes(), &networks); err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 || networks[0].Name != DefaultNetworkName || networks[1].Name != "testnet" {
+		t.Fatalf("Unexpected networks: %#v", networks)
+	}
+
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:     GetTestImage(runtime).ID,
+		Cmd:       []string{"cat"},
+		OpenStdin: true,
+		Network:   "testnet",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR(network.Subnet)
+	if !subnet.Contains(net.ParseIP(container.NetworkSettings.IPAddress)) || container.NetworkSettings.Bridge != "br-testnet" {
+		t.Fatalf("The container is not attached to the network: %#v", container.NetworkSettings)
+	}
+
+	r = httptest.NewRecorder()
+	if err := getNetworksByName(srv, APIVERSION, r, nil, map[string]string{"name": "testnet"}); err != nil {
+		t.Fatal(err)
+	}
+	network = &APINetwork{}
+	if err := json.Unmarshal(r.Body.Bytes(), network); err != nil {
+		t.Fatal(err)
+	}
+	if len(network.Containers) != 1 || network.Containers[0] != container.ID {
+		t.Fatalf("Expected %s to be attached to the network, got %v", container.ID, network.Containers)
+	}
+
+	if err := deleteNetworks(srv, APIVERSION, httptest.NewRecorder(), nil, map[string]string{"name": "testnet"}); err == nil {
+		t.Fatalf("Deleting a network still in use should fail")
+	}
+	if err := runtime.Destroy(container); err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRecorder()
+	if err := deleteNetworks(srv, APIVERSION, r, nil, map[string]string{"name": "testnet"}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusNoContent {
+		t.Fatalf("%d NO CONTENT expected, received %d\n", http.StatusNoContent, r.Code)
+	}
+	if err := deleteNetworks(srv, APIVERSION, httptest.NewRecorder(), nil, map[string]string{"name": DefaultNetworkName}); err == nil {
+		t.Fatalf("Deleting the default network should fail")
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	req, err := http.NewRequest("POST", "/volumes/create?name=testvol", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	if err := postVolumesCreate(srv, APIVERSION, r, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusCreated {
+		t.Fatalf("%d Created expected, received %d\n", http.StatusCreated, r.Code)
+	}
+	volume := &APIVolume{}
+	if err := json.Unmarshal(r.Body.Bytes(), volume); err != nil {
+		t.Fatal(err)
+	}
+	if volume.Name != "testvol" || volume.Driver != DefaultVolumeDriver || volume.Anonymous {
+		t.Fatalf("Unexpected volume: %#v", volume)
+	}
+	if err := postVolumesCreate(srv, APIVERSION, httptest.NewRecorder(), req, nil); err == nil {
+		t.Fatalf("Creating the same volume twice should fail")
+	}
+	if err := ioutil.WriteFile(path.Join(volume.Mountpoint, "data"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:   GetTestImage(runtime).ID,
+		Cmd:     []string{"true"},
+		Volumes: map[string]struct{}{"/data": {}, "/tmp/anonymous": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{Binds: []string{"testvol:/data"}}); err != nil {
+		t.Fatal(err)
+	}
+	container.Wait()
+	if container.Volumes["/data"] != volume.Mountpoint {
+		t.Fatalf("Expected the volume testvol on /data, got %s", container.Volumes["/data"])
+	}
+
+	r = httptest.NewRecorder()
+	if err := getVolumesByName(srv, APIVERSION, r, nil, map[string]string{"name": "testvol"}); err != nil {
+		t.Fatal(err)
+	}
+	volume = &APIVolume{}
+	if err := json.Unmarshal(r.Body.Bytes(), volume); err != nil {
+		t.Fatal(err)
+	}
+	if len(volume.Containers) != 1 || volume.Containers[0] != container.ID {
+		t.Fatalf("Expected %s to use the volume, got %v", container.ID, volume.Containers)
+	}
+	if volume.Size < 5 {
+		t.Fatalf("Expected the size of the data of the volume, got %d", volume.Size)
+	}
+
+	req, err = http.NewRequest("GET", "/volumes/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRecorder()
+	if err := getVolumesJSON(srv, APIVERSION, r, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	volumes := []APIVolume{}
+	if err := json.Unmarshal(r.Body.Bytes(), &volumes); err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, v := range volumes {
+		if (v.Name == "testvol" && !v.Anonymous) || (v.Anonymous && v.Mountpoint == container.Volumes["/tmp/anonymous"]) {
+			found++
+		}
+	}
+	if found != 2 || volumes[0].Name != "testvol" {
+		t.Fatalf("Expected testvol and the volume of /tmp/anonymous, got %#v", volumes)
+	}
+
+	if err := deleteVolumes(srv, APIVERSION, httptest.NewRecorder(), nil, map[string]string{"name": "testvol"}); err == nil {
+		t.Fatalf("Deleting a volume still in use should fail")
+	}
+	if err := srv.ContainerDestroy(container.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The named volume outlives the container, unused
+	req, err = http.NewRequest("GET", "/volumes/json?dangling=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRecorder()
+	if err := getVolumesJSON(srv, APIVERSION, r, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	volumes = []APIVolume{}
+	if err := json.Unmarshal(r.Body.Bytes(), &volumes); err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) == 0 || volumes[0].Name != "testvol" {
+		t.Fatalf("Expected the dangling volume testvol, got %#v", volumes)
+	}
+	for _, v := range volumes {
+		if v.Anonymous && len(v.Containers) > 0 {
+			t.Fatalf("Unexpected volume in use: %#v", v)
+		}
+	}
+
+	r = httptest.NewRecorder()
+	if err := deleteVolumes(srv, APIVERSION, r, nil, map[string]string{"name": "testvol"}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusNoContent {
+		t.Fatalf("%d NO CONTENT expected, received %d\n", http.StatusNoContent, r.Code)
+	}
+	if _, err := os.Stat(volume.Mountpoint); !os.IsNotExist(err) {
+		t.Fatalf("The data of the volume should be removed, got %v", err)
+	}
+	if err := deleteVolumes(srv, APIVERSION, httptest.NewRecorder(), nil, map[string]string{"name": "testvol"}); err == nil {
+		t.Fatalf("Deleting a volume which doesn't exist should fail")
+	}
+}
+
+func TestVolumesPrune(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	unused, err := srv.VolumeCreate("unused", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(unused.Mountpoint, "data"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.VolumeCreate("used", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:   GetTestImage(runtime).ID,
+		Cmd:     []string{"true"},
+		Volumes: map[string]struct{}{"/data": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{Binds: []string{"used:/data"}}); err != nil {
+		t.Fatal(err)
+	}
+	container.Wait()
+
+	req, err := http.NewRequest("GET", "/volumes/json?filters="+url.QueryEscape(`{"dangling":["true"],"name":["u"]}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	if err := getVolumesJSON(srv, APIVERSION, r, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	volumes := []APIVolume{}
+	if err := json.Unmarshal(r.Body.Bytes(), &volumes); err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0].Name != "unused" {
+		t.Fatalf("Expected the dangling volume unused, got %#v", volumes)
+	}
+	req, err = http.NewRequest("GET", "/volumes/json?filters="+url.QueryEscape(`{"dangling":["maybe"]}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getVolumesJSON(srv, APIVERSION, httptest.NewRecorder(), req, nil); err == nil {
+		t.Fatalf("An invalid dangling filter should fail")
+	}
+
+	r = httptest.NewRecorder()
+	if err := postVolumesPrune(srv, APIVERSION, r, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	pruned := &APIVolumesPrune{}
+	if err := json.Unmarshal(r.Body.Bytes(), pruned); err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned.VolumesDeleted) != 1 || pruned.VolumesDeleted[0] != "unused" || pruned.SpaceReclaimed < 5 {
+		t.Fatalf("Expected the volume unused to be pruned, got %#v", pruned)
+	}
+	if _, err := srv.VolumeInspect("used"); err != nil {
+		t.Fatalf("The volume of the container should be kept: %s", err)
+	}
+	if _, err := srv.VolumeInspect("unused"); err == nil {
+		t.Fatalf("The volume unused should be removed")
+	}
+}
+
+func TestPostNetworksConnect(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:     GetTestImage(runtime).ID,
+		Cmd:       []string{"cat"},
+		OpenStdin: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/networks/"+DefaultNetworkName+"/connect?container="+container.ID+"&alias=db&alias=cache", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	if err := postNetworksConnect(srv, APIVERSION, r, req, map[string]string{"name": DefaultNetworkName}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusNoContent {
+		t.Fatalf("%d NO CONTENT expected, received %d\n", http.StatusNoContent, r.Code)
+	}
+	for _, alias := range []string{"db", "cache"} {
+		if ip := runtime.lookupContainer(DefaultNetworkName, alias); ip == nil || ip.String() != container.NetworkSettings.IPAddress {
+			t.Fatalf("%s should resolve to %s, got %v", alias, container.NetworkSettings.IPAddress, ip)
+		}
+	}
+	// The same alias twice
+	if err := postNetworksConnect(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": DefaultNetworkName}); err == nil {
+		t.Fatalf("Reusing an alias of the network should fail")
+	}
+	if err := postNetworksConnect(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": "nonexistent"}); err == nil {
+		t.Fatalf("Connecting to an unknown network should fail")
+	}
+}
+
+func TestPostNetworksConnectRunning(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	for name, subnet := range map[string]string{"backend": "10.235.0.0/24", "broken": "10.236.0.0/24"} {
+		if err := runtime.CreateNetwork(name, "", map[string]string{"subnet": subnet}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:     GetTestImage(runtime).ID,
+		Cmd:       []string{"cat"},
+		OpenStdin: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := lxcInitPid(container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The address of eth0 in the network namespace of the container
+	address := func() string {
+		output, err := exec.Command("nsenter", "-t", strconv.Itoa(pid), "-n", "ip", "-4", "-o", "addr", "show", "eth0").CombinedOutput()
+		if err != nil {
+			t.Fatalf("eth0 should exist in the container: %s (%s)", err, output)
+		}
+		return string(output)
+	}
+
+	connect := func(name string) error {
+		req, err := http.NewRequest("POST", "/networks/"+name+"/connect?container="+container.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return postNetworksConnect(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": name})
+	}
+	if err := connect("backend"); err != nil {
+		t.Fatal(err)
+	}
+	addr := container.NetworkSettings.IPAddress
+	if !strings.HasPrefix(addr, "10.235.0.") || !strings.Contains(address(), " "+addr+"/") {
+		t.Fatalf("Expected the container to be moved to backend, its address is %s", addr)
+	}
+
+	// The container stays on backend if it can't be moved
+	if _, err := ip("link", "del", "br-broken"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect("broken"); err == nil {
+		t.Fatal("Connecting to a network without bridge should fail")
+	}
+	if container.Config.Network != "backend" || container.NetworkSettings.IPAddress != addr || !strings.Contains(address(), " "+addr+"/") {
+		t.Fatalf("Expected the container to be put back on backend with %s", addr)
+	}
+}
+
+func TestPostContainersRename(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:     GetTestImage(runtime).ID,
+		Cmd:       []string{"cat"},
+		OpenStdin: true,
+		Hostname:  "web",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	client, err := NewBuilder(runtime).Create(&Config{
+		Image:       GetTestImage(runtime).ID,
+		Cmd:         []string{"cat"},
+		IngressFrom: []string{"web"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(client)
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/containers/"+container.ID+"/rename?name=frontend", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	if err := postContainersRename(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Code != http.StatusNoContent {
+		t.Fatalf("%d NO CONTENT expected, received %d\n", http.StatusNoContent, r.Code)
+	}
+	if container.Config.Hostname != "frontend" {
+		t.Fatalf("Unexpected hostname: %s", container.Config.Hostname)
+	}
+	if ip := runtime.lookupContainer(DefaultNetworkName, "frontend"); ip == nil || ip.String() != container.NetworkSettings.IPAddress {
+		t.Fatalf("frontend should resolve to %s, got %v", container.NetworkSettings.IPAddress, ip)
+	}
+	if ip := runtime.lookupContainer(DefaultNetworkName, "web"); ip != nil {
+		t.Fatalf("The old name shouldn't resolve, got %s", ip)
+	}
+	if len(client.Config.IngressFrom) != 1 || client.Config.IngressFrom[0] != "frontend" {
+		t.Fatalf("The -ingress-from of the other containers should be renamed: %v", client.Config.IngressFrom)
+	}
+
+	// The name of another container, and an invalid name
+	for _, name := range []string{"frontend", "bad%20name"} {
+		req, err := http.NewRequest("POST", "/containers/"+client.ID+"/rename?name="+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := postContainersRename(srv, APIVERSION, httptest.NewRecorder(), req, map[string]string{"name": client.ID}); err == nil {
+			t.Fatalf("Renaming the container to %s should fail", name)
+		}
 	}
 }
 
@@ -1098,7 +2229,7 @@ func TestDeleteImages(t *testing.T) {
 
 	srv := &Server{runtime: runtime}
 
-	initialImages, err := srv.Images(false, "")
+	initialImages, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1107,7 +2238,7 @@ func TestDeleteImages(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err := srv.Images(false, "")
+	images, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1146,7 +2277,7 @@ func TestDeleteImages(t *testing.T) {
 	if len(outs) != 1 {
 		t.Fatalf("Expected %d event (untagged), got %d", 1, len(outs))
 	}
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
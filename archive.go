@@ -2,7 +2,11 @@ package docker
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
 	"io"
@@ -11,6 +15,8 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type Archive io.Reader
@@ -96,6 +102,19 @@ func TarFilter(path string, compression Compression, filter []string) (io.Reader
 	return CmdStream(exec.Command(args[0], args[1:]...))
 }
 
+// TarWithExcludes creates an archive from the directory at `path` like Tar,
+// without the files whose relative paths match one of the shell patterns of
+// `excludes`, nor the contents of the matching directories. A `*` doesn't
+// match the `/` of the paths.
+func TarWithExcludes(path string, compression Compression, excludes []string) (io.Reader, error) {
+	args := []string{"tar", "--numeric-owner", "-f", "-", "-C", path, "--anchored", "--no-wildcards-match-slash"}
+	for _, e := range excludes {
+		args = append(args, "--exclude=./"+e)
+	}
+	args = append(args, "-c"+compression.Flag(), ".")
+	return CmdStream(exec.Command(args[0], args[1:]...))
+}
+
 // Untar reads a stream of bytes from `archive`, parses it as a tar archive,
 // and unpacks it into the directory at `path`.
 // The archive may be compressed with one of the following algorithms:
@@ -275,9 +294,13 @@ func NewTempArchive(src Archive, dir string) (*TempArchive, error) {
 		return nil, err
 	}
 	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return nil, err
 	}
 	if _, err := f.Seek(0, 0); err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return nil, err
 	}
 	st, err := f.Stat()
@@ -300,3 +323,122 @@ func (archive *TempArchive) Read(data []byte) (int, error) {
 	}
 	return n, err
 }
+
+// LayerDigest computes the digest of the content of a tar archive: the
+// sha256 of the sorted sha256 of its entries, of their normalized name, of
+// their header without the owner names nor the mtime of the directories, and
+// of their data. It doesn't depend on the order of the entries nor on the tar
+// which wrote them, so the layer archived again on another host keeps it. The
+// archive may be gzipped.
+func LayerDigest(archive io.Reader) (string, error) {
+	buf := bufio.NewReader(archive)
+	var reader io.Reader = buf
+	if magic, err := buf.Peek(3); err == nil && DetectCompression(magic) == Gzip {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	// The size and the sha256 of the data of the regular files, by name
+	type fileData struct {
+		size int64
+		sum  string
+	}
+	files := make(map[string]fileData)
+	var sums []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		name := strings.Trim(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		typeflag, size, linkname, mtime := hdr.Typeflag, hdr.Size, hdr.Linkname, hdr.ModTime.Unix()
+		if typeflag == tar.TypeRegA {
+			typeflag = tar.TypeReg
+		} else if typeflag == tar.TypeDir {
+			mtime = 0
+		}
+		var data string
+		// Which name of a file is the hard link depends on the order of the
+		// entries, they are all regular files
+		if target, exists := files[strings.Trim(path.Clean("/"+linkname), "/")]; typeflag == tar.TypeLink && exists {
+			typeflag, size, linkname, data = tar.TypeReg, target.size, "", target.sum
+		} else {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return "", err
+			}
+			data = hex.EncodeToString(h.Sum(nil))
+			if typeflag == tar.TypeReg {
+				files[name] = fileData{size, data}
+			}
+		}
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\x00%c\x00%o\x00%d\x00%d\x00%d\x00%d\x00%s\x00%d\x00%d\x00%s", name, typeflag, hdr.Mode&07777, hdr.Uid, hdr.Gid, size, mtime, linkname, hdr.Devmajor, hdr.Devminor, data)
+		sums = append(sums, hex.EncodeToString(h.Sum(nil)))
+	}
+	sort.Strings(sums)
+	h := sha256.New()
+	for _, sum := range sums {
+		io.WriteString(h, sum)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// A DigestingArchive computes the LayerDigest of the archive read through it
+type DigestingArchive struct {
+	io.Reader
+	pipe   *io.PipeWriter
+	digest chan digestResult
+}
+
+type digestResult struct {
+	digest string
+	err    error
+}
+
+func NewDigestingArchive(archive Archive) *DigestingArchive {
+	r, w := io.Pipe()
+	digest := make(chan digestResult, 1)
+	go func() {
+		sum, err := LayerDigest(r)
+		// What follows the end of the archive is read too
+		io.Copy(ioutil.Discard, r)
+		digest <- digestResult{sum, err}
+	}()
+	return &DigestingArchive{Reader: io.TeeReader(archive, w), pipe: w, digest: digest}
+}
+
+// Digest reads what's left of the archive and returns its LayerDigest
+func (archive *DigestingArchive) Digest() (string, error) {
+	if _, err := io.Copy(ioutil.Discard, archive.Reader); err != nil {
+		archive.pipe.CloseWithError(err)
+		<-archive.digest
+		return "", err
+	}
+	archive.pipe.Close()
+	result := <-archive.digest
+	return result.digest, result.err
+}
+
+// Close archive if it can be, e.g. the one of TarLayer which keeps its layer
+// until it's read to its end or closed
+func closeArchive(archive Archive) error {
+	if closer, ok := archive.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Close stops the digest of an archive which isn't read to its end
+func (archive *DigestingArchive) Close() error {
+	return archive.pipe.CloseWithError(io.ErrUnexpectedEOF)
+}
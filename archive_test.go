@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"archive/tar"
 	"bytes"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -116,3 +118,94 @@ func TestTarUntar(t *testing.T) {
 		}
 	}
 }
+
+func TestTarWithExcludes(t *testing.T) {
+	origin, err := ioutil.TempDir("", "docker-test-tar-excludes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	for _, dir := range []string{".git", "sub"} {
+		if err := os.MkdirAll(path.Join(origin, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"Dockerfile", ".git/HEAD", "foo.log", "sub/bar.log"} {
+		if err := ioutil.WriteFile(path.Join(origin, file), []byte("hello world"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive, err := TarWithExcludes(origin, Uncompressed, []string{".git", "*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "docker-test-tar-excludes-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := Untar(archive, tmp); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"Dockerfile", "sub/bar.log"} {
+		if _, err := os.Stat(path.Join(tmp, file)); err != nil {
+			t.Fatalf("%s should be in the archive: %s", file, err)
+		}
+	}
+	for _, file := range []string{".git", "foo.log"} {
+		if _, err := os.Stat(path.Join(tmp, file)); !os.IsNotExist(err) {
+			t.Fatalf("%s should not be in the archive", file)
+		}
+	}
+}
+
+func TestIDMappingsArchive(t *testing.T) {
+	src, err := ioutil.TempDir("", "docker-test-userns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	mappings := &IDMappings{Uids: []IDMap{{0, 100000, 65536}}, Gids: []IDMap{{0, 200000, 65536}}}
+	if err := ioutil.WriteFile(path.Join(src, "foo"), []byte("hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(path.Join(src, "foo"), 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(src, "foo"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := mappings.chownLayer(src); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(path.Join(src, "foo")); err != nil {
+		t.Fatal(err)
+	} else if st := stat.Sys().(*syscall.Stat_t); st.Uid != 101000 || st.Gid != 201000 || stat.Mode()&os.ModeSetuid == 0 {
+		t.Fatalf("Expected foo to be owned by 101000:201000 and setuid, got %d:%d %s", st.Uid, st.Gid, stat.Mode())
+	}
+	archive, err := Tar(src, Uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(mappings.containerArchive(archive))
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path.Base(hdr.Name) == "foo" {
+			found = true
+			if hdr.Uid != 1000 || hdr.Gid != 1000 {
+				t.Fatalf("Expected foo to be owned by 1000:1000 in the archive, got %d:%d", hdr.Uid, hdr.Gid)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("foo is missing in the archive")
+	}
+}
@@ -33,8 +33,11 @@ type AuthConfig struct {
 }
 
 type ConfigFile struct {
-	Configs  map[string]AuthConfig `json:"configs,omitempty"`
-	rootPath string
+	Configs map[string]AuthConfig `json:"configs,omitempty"`
+	// The credential helper keeping the passwords, the credsStore of the
+	// file. They're in the file without one.
+	CredsStore string
+	rootPath   string
 }
 
 func IndexServerAddress() string {
@@ -83,7 +86,8 @@ func LoadConfig(rootPath string) (*ConfigFile, error) {
 		return &configFile, err
 	}
 
-	if err := json.Unmarshal(b, &configFile.Configs); err != nil {
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(b, &entries); err != nil {
 		arr := strings.Split(string(b), "\n")
 		if len(arr) < 2 {
 			return nil, fmt.Errorf("The Auth config file is empty")
@@ -98,33 +102,86 @@ func LoadConfig(rootPath string) (*ConfigFile, error) {
 		authConfig.Email = origEmail[1]
 		configFile.Configs[IndexServerAddress()] = authConfig
 	} else {
-		for k, authConfig := range configFile.Configs {
-			authConfig.Username, authConfig.Password, err = decodeAuth(authConfig.Auth)
-			if err != nil {
+		for k, entry := range entries {
+			if k == "credsStore" {
+				if err := json.Unmarshal(entry, &configFile.CredsStore); err != nil {
+					return nil, fmt.Errorf("Invalid credsStore in %s: %s", confFile, err)
+				}
+				continue
+			}
+			authConfig := AuthConfig{}
+			if err := json.Unmarshal(entry, &authConfig); err != nil {
 				return nil, err
 			}
-			authConfig.Auth = ""
+			// The password of a credential helper is only read when needed
+			if authConfig.Auth != "" {
+				authConfig.Username, authConfig.Password, err = decodeAuth(authConfig.Auth)
+				if err != nil {
+					return nil, err
+				}
+				authConfig.Auth = ""
+			}
 			configFile.Configs[k] = authConfig
 		}
 	}
 	return &configFile, nil
 }
 
-// save the auth config
+// ResolveAuthConfig returns the credentials of the server, with the password
+// the credential helper keeps
+func (configFile *ConfigFile) ResolveAuthConfig(server string) (AuthConfig, error) {
+	authConfig := configFile.Configs[server]
+	if configFile.CredsStore != "" && authConfig.Password == "" {
+		username, password, err := getCredentials(configFile.CredsStore, server)
+		if err != nil {
+			return authConfig, err
+		}
+		if username != "" {
+			authConfig.Username = username
+		}
+		authConfig.Password = password
+	}
+	return authConfig, nil
+}
+
+// Erase the credentials of the server, the ones of the credential helper
+// included
+func (configFile *ConfigFile) Erase(server string) error {
+	delete(configFile.Configs, server)
+	if configFile.CredsStore != "" {
+		return eraseCredentials(configFile.CredsStore, server)
+	}
+	return nil
+}
+
+// save the auth config, the passwords go to the credential helper if there
+// is one
 func SaveConfig(configFile *ConfigFile) error {
 	confFile := path.Join(configFile.rootPath, CONFIGFILE)
-	if len(configFile.Configs) == 0 {
+	if len(configFile.Configs) == 0 && configFile.CredsStore == "" {
 		os.Remove(confFile)
 		return nil
 	}
 
-	configs := make(map[string]AuthConfig, len(configFile.Configs))
+	configs := make(map[string]interface{}, len(configFile.Configs)+1)
+	if configFile.CredsStore != "" {
+		configs["credsStore"] = configFile.CredsStore
+	}
 	for k, authConfig := range configFile.Configs {
 		authCopy := authConfig
 
-		authCopy.Auth = encodeAuth(&authCopy)
-		authCopy.Username = ""
-		authCopy.Password = ""
+		if configFile.CredsStore != "" {
+			if authCopy.Password != "" {
+				if err := storeCredentials(configFile.CredsStore, k, authCopy); err != nil {
+					return err
+				}
+			}
+			authCopy.Password = ""
+		} else {
+			authCopy.Auth = encodeAuth(&authCopy)
+			authCopy.Username = ""
+			authCopy.Password = ""
+		}
 
 		configs[k] = authCopy
 	}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"io/ioutil"
 	"os"
+	"path"
 	"strings"
 	"testing"
 )
@@ -110,3 +111,70 @@ func TestSameAuthDataPostSave(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCredentialHelper(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// A helper keeping the credentials of a single server in a file
+	helper := `#!/bin/sh
+stored="$(dirname "$0")/stored"
+case "$1" in
+store) cat > "$stored" ;;
+get) cat "$stored" 2>/dev/null || { echo "credentials not found in native keychain"; exit 1; } ;;
+erase) rm -f "$stored" ;;
+esac
+`
+	if err := ioutil.WriteFile(path.Join(root, "docker-credential-test"), []byte(helper), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", root+":"+os.Getenv("PATH"))
+
+	configFile := &ConfigFile{
+		rootPath:   root,
+		Configs:    make(map[string]AuthConfig, 1),
+		CredsStore: "test",
+	}
+	configFile.Configs["testIndex"] = AuthConfig{
+		Username: "docker-user",
+		Password: "docker-pass",
+		Email:    "docker@docker.io",
+	}
+	if err := SaveConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(root, CONFIGFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "docker-pass") || strings.Contains(string(data), encodeAuth(&AuthConfig{Username: "docker-user", Password: "docker-pass"})) {
+		t.Fatalf("The password shouldn't be in the config file: %s", data)
+	}
+
+	loaded, err := LoadConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.CredsStore != "test" {
+		t.Fatalf("Expected the credential helper test, not %s", loaded.CredsStore)
+	}
+	authConfig, err := loaded.ResolveAuthConfig("testIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authConfig.Username != "docker-user" || authConfig.Password != "docker-pass" || authConfig.Email != "docker@docker.io" {
+		t.Fatalf("Unexpected credentials %#v", authConfig)
+	}
+
+	if err := loaded.Erase("testIndex"); err != nil {
+		t.Fatal(err)
+	}
+	if authConfig, err := loaded.ResolveAuthConfig("testIndex"); err != nil {
+		t.Fatal(err)
+	} else if authConfig.Password != "" {
+		t.Fatal("The erased password shouldn't be found")
+	}
+}
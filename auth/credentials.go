@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The credential helper NAME is the program docker-credential-NAME, which
+// keeps the passwords of the registries (e.g: in the keychain of the OS)
+// instead of ~/.dockercfg. It's run with the action as argument: store reads
+// {"ServerURL": ..., "Username": ..., "Secret": ...}, get reads the server
+// url and writes {"Username": ..., "Secret": ...}, erase reads the server url.
+// It exits with a non-zero status and the error on stdout if it fails.
+const credentialHelperPrefix = "docker-credential-"
+
+// The message of the helpers which don't have the credentials of a server
+const errCredentialsNotFound = "credentials not found in native keychain"
+
+type helperCredentials struct {
+	ServerURL string `json:",omitempty"`
+	Username  string
+	Secret    string
+}
+
+func credentialHelper(helper, action string, input []byte) ([]byte, error) {
+	cmd := exec.Command(credentialHelperPrefix+helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return nil, fmt.Errorf("Credential helper %s: %s", helper, message)
+		}
+		return nil, fmt.Errorf("Credential helper %s: %s", helper, err)
+	}
+	return output, nil
+}
+
+// Store the credentials of server with helper
+func storeCredentials(helper, server string, authConfig AuthConfig) error {
+	input, err := json.Marshal(&helperCredentials{
+		ServerURL: server,
+		Username:  authConfig.Username,
+		Secret:    authConfig.Password,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = credentialHelper(helper, "store", input)
+	return err
+}
+
+// Get the credentials of server from helper, empty if it has none
+func getCredentials(helper, server string) (username, password string, err error) {
+	output, err := credentialHelper(helper, "get", []byte(server))
+	if err != nil {
+		if strings.Contains(err.Error(), errCredentialsNotFound) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	var credentials helperCredentials
+	if err := json.Unmarshal(output, &credentials); err != nil {
+		return "", "", fmt.Errorf("Credential helper %s: invalid credentials: %s", helper, err)
+	}
+	return credentials.Username, credentials.Secret, nil
+}
+
+// Erase the credentials of server from helper
+func eraseCredentials(helper, server string) error {
+	if _, err := credentialHelper(helper, "erase", []byte(server)); err != nil && !strings.Contains(err.Error(), errCredentialsNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package docker
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A limit of the I/O of a container on a block device of the host, in bytes
+// or in operations per second
+type ThrottleDevice struct {
+	Path string
+	Rate uint64
+}
+
+// A line of the blkio cgroup of a container: the throttle file
+// (e.g. throttle.read_bps_device) and the block device it limits
+type BlkioThrottle struct {
+	File  string
+	Major int64
+	Minor int64
+	Rate  uint64
+}
+
+// Parse the path:rate of -device-read-bps and -device-write-bps (e.g.
+// /dev/sda:10mb, in b, kb, mb or gb per second), or of -device-read-iops and
+// -device-write-iops (e.g. /dev/sda:1000) if not bytes
+func parseThrottleDevice(spec string, bytes bool) (ThrottleDevice, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return ThrottleDevice{}, fmt.Errorf("Invalid device rate: %s (path:rate)", spec)
+	}
+	var rate uint64
+	var err error
+	if bytes {
+		rate, err = parseBlkioRate(spec[i+1:])
+	} else {
+		rate, err = strconv.ParseUint(spec[i+1:], 10, 64)
+	}
+	if err != nil {
+		return ThrottleDevice{}, fmt.Errorf("Invalid device rate: %s (path:rate)", spec)
+	}
+	device := ThrottleDevice{Path: spec[:i], Rate: rate}
+	return device, validateThrottleDevices([]ThrottleDevice{device})
+}
+
+// Parse a number of bytes, followed by b, k(b), m(b) or g(b)
+func parseBlkioRate(rate string) (uint64, error) {
+	number := strings.TrimSuffix(strings.ToLower(rate), "b")
+	multiplier := uint64(1)
+	for i, suffix := range []string{"k", "m", "g"} {
+		if strings.HasSuffix(number, suffix) {
+			number = strings.TrimSuffix(number, suffix)
+			multiplier = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	value, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
+
+func validateThrottleDevices(devices []ThrottleDevice) error {
+	for _, device := range devices {
+		if !path.IsAbs(device.Path) {
+			return fmt.Errorf("Bad parameter: invalid device %s, the path must be absolute", device.Path)
+		}
+		if device.Rate == 0 {
+			return fmt.Errorf("Bad parameter: invalid rate 0 of the device %s", device.Path)
+		}
+	}
+	return nil
+}
+
+// The -blkio-weight and the device rates of a host config: the weight is
+// between 10 and 1000, 0 for the default one
+func validateBlkio(hostConfig *HostConfig) error {
+	if hostConfig.BlkioWeight != 0 && (hostConfig.BlkioWeight < 10 || hostConfig.BlkioWeight > 1000) {
+		return fmt.Errorf("Bad parameter: invalid blkio weight %d (10 to 1000)", hostConfig.BlkioWeight)
+	}
+	for _, devices := range [][]ThrottleDevice{hostConfig.BlkioDeviceReadBps, hostConfig.BlkioDeviceWriteBps,
+		hostConfig.BlkioDeviceReadIOps, hostConfig.BlkioDeviceWriteIOps} {
+		if err := validateThrottleDevices(devices); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The throttles of the blkio cgroup of the device rates of a host config,
+// with the numbers of their block devices found on the host
+func findBlkioThrottles(hostConfig *HostConfig) ([]BlkioThrottle, error) {
+	var throttles []BlkioThrottle
+	for _, limit := range []struct {
+		file    string
+		devices []ThrottleDevice
+	}{
+		{"throttle.read_bps_device", hostConfig.BlkioDeviceReadBps},
+		{"throttle.write_bps_device", hostConfig.BlkioDeviceWriteBps},
+		{"throttle.read_iops_device", hostConfig.BlkioDeviceReadIOps},
+		{"throttle.write_iops_device", hostConfig.BlkioDeviceWriteIOps},
+	} {
+		for _, device := range limit.devices {
+			nodes, err := deviceNodes(path.Clean(device.Path), "/", "")
+			if err != nil {
+				return nil, err
+			}
+			if len(nodes) != 1 || nodes[0].Type != "b" {
+				return nil, fmt.Errorf("Bad parameter: %s is not a block device", device.Path)
+			}
+			throttles = append(throttles, BlkioThrottle{File: limit.file, Major: nodes[0].Major, Minor: nodes[0].Minor, Rate: device.Rate})
+		}
+	}
+	return throttles, nil
+}
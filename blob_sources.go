@@ -0,0 +1,75 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// A BlobSource is a repository of a registry speaking the v2 protocol which
+// has the layer of an image as the blob BlobSum. The pulls and the pushes of
+// an image record them in <graph>/<id>/blobsources: a push to a registry
+// mounts the blob from one of its repositories instead of uploading the
+// layer again.
+type BlobSource struct {
+	BlobSum    string
+	Endpoint   string
+	Repository string
+}
+
+// The sources kept for an image, the most recent ones
+const maxBlobSources = 10
+
+func blobSourcesPath(root string) string {
+	return path.Join(root, "blobsources")
+}
+
+// BlobSources returns the repositories known to have the layer of the image
+// id, the most recent first
+func (graph *Graph) BlobSources(id string) ([]*BlobSource, error) {
+	graph.blobSourcesLock.Lock()
+	defer graph.blobSourcesLock.Unlock()
+	return graph.loadBlobSources(id)
+}
+
+func (graph *Graph) loadBlobSources(id string) ([]*BlobSource, error) {
+	jsonData, err := ioutil.ReadFile(blobSourcesPath(graph.imageRoot(id)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sources []*BlobSource
+	if err := json.Unmarshal(jsonData, &sources); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// AddBlobSource records that the repository of source has the layer of the
+// image id
+func (graph *Graph) AddBlobSource(id string, source *BlobSource) error {
+	graph.blobSourcesLock.Lock()
+	defer graph.blobSourcesLock.Unlock()
+	sources, err := graph.loadBlobSources(id)
+	if err != nil {
+		return err
+	}
+	recorded := []*BlobSource{source}
+	for _, s := range sources {
+		if *s != *source && len(recorded) < maxBlobSources {
+			recorded = append(recorded, s)
+		}
+	}
+	jsonData, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+	root := graph.imageRoot(id)
+	tmp := path.Join(root, ".blobsources")
+	if err := ioutil.WriteFile(tmp, jsonData, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, blobSourcesPath(root))
+}
@@ -28,6 +28,12 @@ func NewBuilder(runtime *Runtime) *Builder {
 }
 
 func (builder *Builder) Create(config *Config) (*Container, error) {
+	return builder.create(config, nil)
+}
+
+// Create the container of config, its filesystem with the storage options
+// of hostConfig if not nil
+func (builder *Builder) create(config *Config, hostConfig *HostConfig) (*Container, error) {
 	// Lookup image
 	img, err := builder.repositories.LookupImage(config.Image)
 	if err != nil {
@@ -44,6 +50,23 @@ func (builder *Builder) Create(config *Config) (*Container, error) {
 		return nil, fmt.Errorf("No command specified")
 	}
 
+	if err := validateNetworkOptions(config); err != nil {
+		return nil, err
+	}
+
+	if id := getNetworkContainer(config); id != "" {
+		shared := builder.runtime.Get(id)
+		if shared == nil {
+			return nil, fmt.Errorf("No such container: %s", id)
+		}
+		if getNetworkContainer(shared.Config) != "" {
+			return nil, fmt.Errorf("Bad parameter: %s shares the network of another container", id)
+		}
+		config.Network = networkContainerPrefix + shared.ID
+	} else if config.Network != "" && !builder.runtime.NetworkExists(config.Network) {
+		return nil, fmt.Errorf("No such network: %s", config.Network)
+	}
+
 	// Generate id
 	id := GenerateID()
 	// Generate default hostname
@@ -81,13 +104,24 @@ func (builder *Builder) Create(config *Config) (*Container, error) {
 	if err := os.Mkdir(container.root, 0700); err != nil {
 		return nil, err
 	}
+	var storageOpt map[string]string
+	if hostConfig != nil {
+		storageOpt = hostConfig.StorageOpt
+	}
+	if err := builder.runtime.createRootfs(container, storageOpt); err != nil {
+		return nil, err
+	}
+	// Registered, the container keeps its layers
+	defer builder.runtime.graph.layers.Release(container.ID)
 
 	resolvConf, err := utils.GetResolvConf()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(config.Dns) == 0 && len(builder.runtime.Dns) == 0 && utils.CheckLocalDns(resolvConf) {
+	// The DNS server of the network can forward to a local server, the
+	// containers can't
+	if len(config.Dns) == 0 && len(builder.runtime.Dns) == 0 && builder.runtime.dnsServer(config.Network) == nil && utils.CheckLocalDns(resolvConf) {
 		//"WARNING: Docker detected local DNS server on resolv.conf. Using default external servers: %v", defaultDns
 		builder.runtime.Dns = defaultDns
 	}
@@ -119,6 +153,12 @@ func (builder *Builder) Create(config *Config) (*Container, error) {
 	if err := container.ToDisk(); err != nil {
 		return nil, err
 	}
+	// What the starts without host config show
+	if len(storageOpt) > 0 {
+		if err := container.SaveHostConfig(&HostConfig{StorageOpt: storageOpt}); err != nil {
+			return nil, err
+		}
+	}
 	// Step 3: register the container
 	if err := builder.runtime.Register(container); err != nil {
 		return nil, err
@@ -2,6 +2,8 @@ package docker
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
@@ -10,9 +12,13 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type BuildFile interface {
@@ -33,10 +39,45 @@ type buildFile struct {
 	verbose      bool
 	utilizeCache bool
 
+	// Whether the layers of the build are squashed into one, on top of the
+	// image of the FROM of the last stage
+	squash    bool
+	baseImage string
+
+	// The values of docker build -build-arg, and the NAME=VALUE of the ARGs
+	// declared so far. The ones without a value aren't set.
+	buildArgs    map[string]string
+	args         []string
+	declaredArgs map[string]struct{}
+
+	// The images of the stages before the current one, in the order of
+	// their FROM, and the indexes of the ones named with FROM ... AS
+	stages     []string
+	stageNames map[string]int
+
 	tmpContainers map[string]struct{}
 	tmpImages     map[string]struct{}
 
+	// Whether the layer of the last step was cached
+	cached bool
+
+	// The output is written as the messages of sf to rawOut
+	out    io.Writer
+	rawOut io.Writer
+	sf     *utils.StreamFormatter
+}
+
+// Writes the output of a build as the messages of its stream formatter
+type buildWriter struct {
 	out io.Writer
+	sf  *utils.StreamFormatter
+}
+
+func (w *buildWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(w.sf.FormatStream(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
 func (b *buildFile) clearTmp(containers, images map[string]struct{}) {
@@ -51,30 +92,93 @@ func (b *buildFile) clearTmp(containers, images map[string]struct{}) {
 	}
 }
 
-func (b *buildFile) CmdFrom(name string) error {
-	image, err := b.runtime.repositories.LookupImage(name)
-	if err != nil {
-		if b.runtime.graph.IsNotExist(err) {
-			remote, tag := utils.ParseRepositoryTag(name)
-			if err := b.srv.ImagePull(remote, tag, b.out, utils.NewStreamFormatter(false), nil, true); err != nil {
-				return err
-			}
-			image, err = b.runtime.repositories.LookupImage(name)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
+// FROM IMAGE [AS NAME]: each FROM starts a new stage of the build, from
+// an image or a previous stage. Only the last stage is the built image.
+func (b *buildFile) CmdFrom(args string) error {
+	parts := strings.Fields(args)
+	if len(parts) != 1 && (len(parts) != 3 || strings.ToLower(parts[1]) != "as") {
+		return fmt.Errorf("Invalid FROM format")
+	}
+	name := parts[0]
+	if b.image != "" {
+		b.stages = append(b.stages, b.image)
+	}
+	if len(parts) == 3 {
+		stage := parts[2]
+		if _, exists := b.stageNames[stage]; exists {
+			return fmt.Errorf("Duplicate name of stage: %s", stage)
+		}
+		if _, err := strconv.Atoi(stage); err == nil {
+			return fmt.Errorf("Invalid name of stage: %s", stage)
 		}
+		b.stageNames[stage] = len(b.stages)
+	}
+
+	var image *Image
+	var err error
+	if i, exists := b.stageNames[name]; exists && i < len(b.stages) {
+		image, err = b.runtime.graph.Get(b.stages[i])
+	} else {
+		image, err = b.lookupImage(name)
+	}
+	if err != nil {
+		return err
 	}
 	b.image = image.ID
+	b.baseImage = image.ID
+	b.maintainer = ""
+	b.args = nil
 	b.config = &Config{}
 	if b.config.Env == nil || len(b.config.Env) == 0 {
 		b.config.Env = append(b.config.Env, "HOME=/", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
 	}
+	if image.Config != nil {
+		b.config.Shell = image.Config.Shell
+		return b.runTriggers(image.Config.OnBuild)
+	}
+	return nil
+}
+
+// Run the ONBUILD instructions of the image of FROM
+func (b *buildFile) runTriggers(triggers []string) error {
+	if len(triggers) == 0 {
+		return nil
+	}
+	fmt.Fprintf(b.out, "# Executing %d build triggers\n", len(triggers))
+	for _, trigger := range triggers {
+		tmp := strings.SplitN(trigger, " ", 2)
+		if len(tmp) != 2 {
+			return fmt.Errorf("Invalid trigger format: %s", trigger)
+		}
+		method, exists := b.instruction(tmp[0])
+		if !exists {
+			return fmt.Errorf("Unknown instruction of a trigger: %s", tmp[0])
+		}
+		fmt.Fprintf(b.out, "Trigger %s\n", trigger)
+		ret := method.Func.Call([]reflect.Value{reflect.ValueOf(b), reflect.ValueOf(tmp[1])})[0].Interface()
+		if ret != nil {
+			return ret.(error)
+		}
+	}
 	return nil
 }
 
+// The image name, pulled if it doesn't exist
+func (b *buildFile) lookupImage(name string) (*Image, error) {
+	image, err := b.runtime.repositories.LookupImage(name)
+	if err != nil {
+		if b.runtime.graph.IsNotExist(err) {
+			remote, tag := utils.ParseRepositoryTag(name)
+			if err := b.srv.ImagePull(remote, tag, b.rawOut, b.sf, nil, true, false); err != nil {
+				return nil, err
+			}
+			return b.runtime.repositories.LookupImage(name)
+		}
+		return nil, err
+	}
+	return image, nil
+}
+
 func (b *buildFile) CmdMaintainer(name string) error {
 	b.maintainer = name
 	return b.commit("", b.config.Cmd, fmt.Sprintf("MAINTAINER %s", name))
@@ -84,7 +188,7 @@ func (b *buildFile) CmdRun(args string) error {
 	if b.image == "" {
 		return fmt.Errorf("Please provide a source image with `from` prior to run")
 	}
-	config, _, _, err := ParseRun([]string{b.image, "/bin/sh", "-c", args}, nil)
+	config, _, _, err := ParseRun(append(append([]string{b.image}, b.shell()...), args), nil)
 	if err != nil {
 		return err
 	}
@@ -95,6 +199,19 @@ func (b *buildFile) CmdRun(args string) error {
 
 	defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
 
+	// The args are in the environment of the command, and so in its cache,
+	// but not in the one of the image. ENV takes precedence.
+	env := b.config.Env
+	runArgs := make(map[string]struct{})
+	b.config.Env = append([]string{}, env...)
+	for _, arg := range b.args {
+		if b.FindEnvKey(strings.SplitN(arg, "=", 2)[0]) < 0 {
+			b.config.Env = append(b.config.Env, arg)
+			runArgs[arg] = struct{}{}
+		}
+	}
+	defer func() { b.config.Env = env }()
+
 	utils.Debugf("Command to be executed: %v", b.config.Cmd)
 
 	if b.utilizeCache {
@@ -104,6 +221,7 @@ func (b *buildFile) CmdRun(args string) error {
 			fmt.Fprintf(b.out, " ---> Using cache\n")
 			utils.Debugf("[BUILDER] Use cached version")
 			b.image = cache.ID
+			b.cached = true
 			return nil
 		} else {
 			utils.Debugf("[BUILDER] Cache miss")
@@ -114,6 +232,19 @@ func (b *buildFile) CmdRun(args string) error {
 	if err != nil {
 		return err
 	}
+	// The container keeps the args in its config, the image doesn't. The
+	// environment of the base image was merged in it.
+	if container := b.runtime.Get(cid); container != nil {
+		runConfig := *b.config
+		container.Config = &runConfig
+	}
+	env = nil
+	for _, e := range b.config.Env {
+		if _, exists := runArgs[e]; !exists {
+			env = append(env, e)
+		}
+	}
+	b.config.Env = env
 	if err := b.commit(cid, cmd, "run"); err != nil {
 		return err
 	}
@@ -121,6 +252,14 @@ func (b *buildFile) CmdRun(args string) error {
 	return nil
 }
 
+// The shell of the instructions in the shell form, set with SHELL
+func (b *buildFile) shell() []string {
+	if len(b.config.Shell) == 0 {
+		return []string{"/bin/sh", "-c"}
+	}
+	return b.config.Shell
+}
+
 func (b *buildFile) FindEnvKey(key string) int {
 	for k, envVar := range b.config.Env {
 		envParts := strings.SplitN(envVar, "=", 2)
@@ -141,7 +280,8 @@ func (b *buildFile) ReplaceEnvMatches(value string) (string, error) {
 		match = match[strings.Index(match, "$"):]
 		matchKey := strings.Trim(match, "${}")
 
-		for _, envVar := range b.config.Env {
+		// The variables of ENV take precedence over the args
+		for _, envVar := range append(append([]string{}, b.config.Env...), b.args...) {
 			envParts := strings.SplitN(envVar, "=", 2)
 			envKey := envParts[0]
 			envValue := envParts[1]
@@ -178,11 +318,118 @@ func (b *buildFile) CmdEnv(args string) error {
 	return b.commit("", b.config.Cmd, fmt.Sprintf("ENV %s", replacedVar))
 }
 
+// ARG NAME[=DEFAULT]: a variable the instructions after it can use, its
+// value given with docker build -build-arg. Unlike ENV, it's not in the
+// environment of the containers of the image.
+func (b *buildFile) CmdArg(args string) error {
+	parts := strings.SplitN(args, "=", 2)
+	name := parts[0]
+	if name == "" || strings.ContainsAny(name, " \t$") {
+		return fmt.Errorf("Invalid ARG format")
+	}
+	b.declaredArgs[name] = struct{}{}
+
+	value, exists := b.buildArgs[name]
+	if !exists && len(parts) == 2 {
+		value, exists = parts[1], true
+	}
+	for i, arg := range b.args {
+		if strings.SplitN(arg, "=", 2)[0] == name {
+			b.args = append(b.args[:i], b.args[i+1:]...)
+			break
+		}
+	}
+	if exists {
+		b.args = append(b.args, fmt.Sprintf("%s=%s", name, value))
+	}
+	return b.commit("", b.config.Cmd, fmt.Sprintf("ARG %s", args))
+}
+
+// LABEL KEY=VALUE [KEY=VALUE...]: metadata of the image, the values in
+// double quotes when they have spaces
+func (b *buildFile) CmdLabel(args string) error {
+	pairs, err := splitQuoted(args)
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return fmt.Errorf("LABEL requires at least one KEY=VALUE")
+	}
+	// The labels may be the ones of the base image
+	labels := make(map[string]string)
+	for k, v := range b.config.Labels {
+		labels[k] = v
+	}
+	// The comment, and so the cache, has the substituted values
+	var substituted []string
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Invalid LABEL format: %s", pair)
+		}
+		value, err := b.ReplaceEnvMatches(parts[1])
+		if err != nil {
+			return err
+		}
+		labels[parts[0]] = value
+		substituted = append(substituted, fmt.Sprintf("%s=%q", parts[0], value))
+	}
+	b.config.Labels = labels
+	return b.commit("", b.config.Cmd, fmt.Sprintf("LABEL %s", strings.Join(substituted, " ")))
+}
+
+// Split args on the spaces outside of double quotes, removing the quotes
+func splitQuoted(args string) ([]string, error) {
+	var (
+		words  []string
+		word   []rune
+		inWord bool
+		quoted bool
+		escape bool
+	)
+	for _, c := range args {
+		switch {
+		case escape:
+			word = append(word, c)
+			escape = false
+		case c == '\\':
+			escape, inWord = true, true
+		case c == '"':
+			quoted, inWord = !quoted, true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = nil, false
+			}
+		default:
+			word, inWord = append(word, c), true
+		}
+	}
+	if quoted || escape {
+		return nil, fmt.Errorf("Unterminated quote in %s", args)
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// SHELL ["executable", "parameters"]: the shell of RUN, CMD and
+// ENTRYPOINT in the shell form
+func (b *buildFile) CmdShell(args string) error {
+	var shell []string
+	if err := json.Unmarshal([]byte(args), &shell); err != nil || len(shell) == 0 {
+		return fmt.Errorf("SHELL requires the JSON form, e.g. [\"/bin/bash\", \"-c\"]")
+	}
+	b.config.Shell = shell
+	return b.commit("", b.config.Cmd, fmt.Sprintf("SHELL %v", shell))
+}
+
 func (b *buildFile) CmdCmd(args string) error {
 	var cmd []string
 	if err := json.Unmarshal([]byte(args), &cmd); err != nil {
-		utils.Debugf("Error unmarshalling: %s, setting cmd to /bin/sh -c", err)
-		cmd = []string{"/bin/sh", "-c", args}
+		utils.Debugf("Error unmarshalling: %s, setting cmd to %v", err, b.shell())
+		cmd = append(append([]string{}, b.shell()...), args)
 	}
 	if err := b.commit("", cmd, fmt.Sprintf("CMD %v", cmd)); err != nil {
 		return err
@@ -202,7 +449,96 @@ func (b *buildFile) CmdInsert(args string) error {
 }
 
 func (b *buildFile) CmdCopy(args string) error {
-	return fmt.Errorf("COPY has been deprecated. Please use ADD instead")
+	options, args, err := parseContextOptions(args, "COPY", "from", "chown")
+	if err != nil {
+		return err
+	}
+	if stage, exists := options["from"]; exists {
+		return b.copyFromStage(stage, options["chown"], args)
+	}
+	return b.runContextCommand(args, options, false, false, "COPY")
+}
+
+// The --NAME=VALUE options before the arguments of ADD and COPY, among the
+// allowed ones, and the arguments
+func parseContextOptions(args, cmdName string, allowed ...string) (map[string]string, string, error) {
+	options := make(map[string]string)
+	for strings.HasPrefix(args, "--") {
+		parts := strings.SplitN(args, " ", 2)
+		if len(parts) != 2 {
+			return nil, "", fmt.Errorf("Invalid %s format", cmdName)
+		}
+		option := strings.SplitN(parts[0][2:], "=", 2)
+		valid := false
+		for _, name := range allowed {
+			if option[0] == name {
+				valid = true
+			}
+		}
+		if len(option) != 2 || option[1] == "" || !valid {
+			return nil, "", fmt.Errorf("Invalid %s option: %s", cmdName, parts[0])
+		}
+		options[option[0]] = option[1]
+		args = strings.TrimLeft(parts[1], " \t")
+	}
+	return options, args, nil
+}
+
+// The owner of the files of ADD and COPY --chown, with the ids of the host
+type fileOwner struct {
+	uid, gid int
+}
+
+// The owner of --chown=USER[:GROUP], by the names of the passwd and group of
+// the container or by ids. Without a group, it's the one of the user.
+func (b *buildFile) lookupOwner(container *Container, chown string) (*fileOwner, error) {
+	parts := strings.SplitN(chown, ":", 2)
+	uid, primary, err := lookupID(path.Join(container.RootfsPath(), "etc/passwd"), parts[0])
+	if err != nil {
+		return nil, err
+	}
+	group := primary
+	if len(parts) == 2 {
+		group = parts[1]
+	}
+	gid, _, err := lookupID(path.Join(container.RootfsPath(), "etc/group"), group)
+	if err != nil {
+		return nil, err
+	}
+	if m := b.runtime.idMappings; m != nil {
+		if uid, err = hostID(m.Uids, uid); err != nil {
+			return nil, err
+		}
+		if gid, err = hostID(m.Gids, gid); err != nil {
+			return nil, err
+		}
+	}
+	return &fileOwner{uid: uid, gid: gid}, nil
+}
+
+// The id of name in a passwd or group file, e.g. of a container, and the
+// fourth field of its line: the group of a user. A number is an id, even
+// if the file doesn't have it.
+func lookupID(file, name string) (int, string, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, name, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return -1, "", fmt.Errorf("Unable to find %s: %s", name, err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return -1, "", fmt.Errorf("Invalid id of %s in %s: %s", name, path.Base(file), fields[2])
+		}
+		return id, fields[3], nil
+	}
+	return -1, "", fmt.Errorf("Unable to find %s in %s", name, path.Base(file))
 }
 
 func (b *buildFile) CmdEntrypoint(args string) error {
@@ -212,7 +548,7 @@ func (b *buildFile) CmdEntrypoint(args string) error {
 
 	var entrypoint []string
 	if err := json.Unmarshal([]byte(args), &entrypoint); err != nil {
-		b.config.Entrypoint = []string{"/bin/sh", "-c", args}
+		b.config.Entrypoint = append(append([]string{}, b.shell()...), args)
 	} else {
 		b.config.Entrypoint = entrypoint
 	}
@@ -222,6 +558,43 @@ func (b *buildFile) CmdEntrypoint(args string) error {
 	return nil
 }
 
+func (b *buildFile) CmdHealthcheck(args string) error {
+	healthcheck, err := parseHealthcheck(args)
+	if err != nil {
+		return err
+	}
+	b.config.Healthcheck = healthcheck
+	return b.commit("", b.config.Cmd, fmt.Sprintf("HEALTHCHECK %s", args))
+}
+
+func (b *buildFile) CmdStopsignal(args string) error {
+	if _, err := parseSignal(args); err != nil {
+		return err
+	}
+	b.config.StopSignal = args
+	return b.commit("", b.config.Cmd, fmt.Sprintf("STOPSIGNAL %s", args))
+}
+
+// ONBUILD INSTRUCTION ARGUMENTS: an instruction the builds FROM the image
+// run, before their own ones
+func (b *buildFile) CmdOnbuild(args string) error {
+	tmp := strings.SplitN(args, " ", 2)
+	if len(tmp) != 2 {
+		return fmt.Errorf("Invalid ONBUILD format")
+	}
+	instruction := strings.ToUpper(tmp[0])
+	switch instruction {
+	case "ONBUILD", "FROM", "MAINTAINER":
+		return fmt.Errorf("%s isn't allowed as an ONBUILD trigger", instruction)
+	}
+	if _, exists := b.instruction(instruction); !exists {
+		return fmt.Errorf("Unknown instruction of ONBUILD: %s", instruction)
+	}
+	trigger := instruction + " " + strings.Trim(tmp[1], " \t")
+	b.config.OnBuild = append(b.config.OnBuild, trigger)
+	return b.commit("", b.config.Cmd, fmt.Sprintf("ONBUILD %s", trigger))
+}
+
 func (b *buildFile) CmdWorkdir(workdir string) error {
 	b.config.WorkingDir = workdir
 	return b.commit("", b.config.Cmd, fmt.Sprintf("WORKDIR %v", workdir))
@@ -248,13 +621,29 @@ func (b *buildFile) CmdVolume(args string) error {
 	return nil
 }
 
-func (b *buildFile) addRemote(container *Container, orig, dest string) error {
+// Download the file of an ADD of a URL in a temporary file, with the
+// checksum of its contents
+func (b *buildFile) downloadRemote(orig string) (string, string, error) {
 	file, err := utils.Download(orig, ioutil.Discard)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	defer file.Body.Close()
 
+	tmp, err := ioutil.TempFile("", "docker-build-remote")
+	if err != nil {
+		return "", "", err
+	}
+	defer tmp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), file.Body); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (b *buildFile) addRemote(container *Container, orig, downloaded, dest string, owner *fileOwner) error {
 	// If the destination is a directory, figure out the filename.
 	if strings.HasSuffix(dest, "/") {
 		u, err := url.Parse(orig)
@@ -273,48 +662,161 @@ func (b *buildFile) addRemote(container *Container, orig, dest string) error {
 		dest = dest + filename
 	}
 
-	return container.Inject(file.Body, dest)
+	file, err := os.Open(downloaded)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := container.Inject(file, dest); err != nil {
+		return err
+	}
+	if owner != nil {
+		return os.Lchown(path.Join(container.RootfsPath(), dest), owner.uid, owner.gid)
+	}
+	return nil
 }
 
-func (b *buildFile) addContext(container *Container, orig, dest string) error {
+// The path of orig in the context, which ADD and COPY can't leave
+func (b *buildFile) contextPath(orig string) (string, error) {
 	origPath := path.Join(b.context, orig)
-	destPath := path.Join(container.RootfsPath(), dest)
+	if !strings.HasPrefix(origPath, b.context) {
+		return "", fmt.Errorf("Forbidden path: %s", origPath)
+	}
+	return origPath, nil
+}
+
+// A checksum of the files ADD and COPY copy from orig in the context:
+// their paths, modes and contents
+func (b *buildFile) contextChecksum(orig string) (string, error) {
+	origPath, err := b.contextPath(orig)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	err = filepath.Walk(origPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(origPath, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, info.Mode())
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		} else if info.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(h, "%d\x00", info.Size())
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (b *buildFile) addContext(container *Container, orig, dest string, decompress bool, owner *fileOwner) error {
+	origPath, err := b.contextPath(orig)
+	if err != nil {
+		return err
+	}
+	return b.addPath(container, origPath, dest, decompress, owner)
+}
+
+// Copy origPath on the host to dest in the container, unpacking it if it's
+// an archive and decompress is set. The files copied are given to owner,
+// unless it's nil, not the ones unpacked.
+func (b *buildFile) addPath(container *Container, origPath, dest string, decompress bool, owner *fileOwner) error {
+	// The symlinks of the container resolve in it, not on the host
+	destPath, err := utils.FollowSymlinkInScope(path.Join(container.RootfsPath(), dest), container.RootfsPath())
+	if err != nil {
+		return err
+	}
 	// Preserve the trailing '/'
 	if strings.HasSuffix(dest, "/") {
 		destPath = destPath + "/"
 	}
-	if !strings.HasPrefix(origPath, b.context) {
-		return fmt.Errorf("Forbidden path: %s", origPath)
-	}
 	fi, err := os.Stat(origPath)
 	if err != nil {
 		return err
 	}
 	if fi.IsDir() {
+		_, err := os.Stat(destPath)
+		created := os.IsNotExist(err)
 		if err := CopyWithTar(origPath, destPath); err != nil {
 			return err
 		}
-		// First try to unpack the source as an archive
-	} else if err := UntarPath(origPath, destPath); err != nil {
-		utils.Debugf("Couldn't untar %s to %s: %s", origPath, destPath, err)
-		// If that fails, just copy it as a regular file
-		if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
-			return err
+		if owner == nil {
+			return nil
 		}
-		if err := CopyWithTar(origPath, destPath); err != nil {
-			return err
+		// The directory of dest is only given to owner if it's new
+		return filepath.Walk(origPath, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(origPath, p)
+			if err != nil {
+				return err
+			}
+			if rel == "." && !created {
+				return nil
+			}
+			return os.Lchown(path.Join(destPath, rel), owner.uid, owner.gid)
+		})
+	}
+	// First try to unpack the source as an archive
+	if decompress {
+		err := UntarPath(origPath, destPath)
+		if err == nil {
+			return nil
 		}
+		utils.Debugf("Couldn't untar %s to %s: %s", origPath, destPath, err)
 	}
-	return nil
+	// If that fails, just copy it as a regular file
+	if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	if err := CopyWithTar(origPath, destPath); err != nil {
+		return err
+	}
+	if owner == nil {
+		return nil
+	}
+	if strings.HasSuffix(destPath, "/") {
+		destPath = path.Join(destPath, filepath.Base(origPath))
+	}
+	return os.Lchown(destPath, owner.uid, owner.gid)
 }
 
 func (b *buildFile) CmdAdd(args string) error {
+	options, args, err := parseContextOptions(args, "ADD", "chown", "checksum")
+	if err != nil {
+		return err
+	}
+	return b.runContextCommand(args, options, true, true, "ADD")
+}
+
+// ADD or COPY: COPY only copies files of the context, without unpacking
+// their archives
+func (b *buildFile) runContextCommand(args string, options map[string]string, allowRemote, decompress bool, cmdName string) error {
 	if b.context == "" {
-		return fmt.Errorf("No context given. Impossible to use ADD")
+		return fmt.Errorf("No context given. Impossible to use %s", cmdName)
 	}
 	tmp := strings.SplitN(args, " ", 2)
 	if len(tmp) != 2 {
-		return fmt.Errorf("Invalid ADD format")
+		return fmt.Errorf("Invalid %s format", cmdName)
 	}
 
 	orig, err := b.ReplaceEnvMatches(strings.Trim(tmp[0], " \t"))
@@ -327,10 +829,55 @@ func (b *buildFile) CmdAdd(args string) error {
 		return err
 	}
 
-	cmd := b.config.Cmd
-	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) ADD %s in %s", orig, dest)}
+	remote := utils.IsURL(orig)
+	if remote && !allowRemote {
+		return fmt.Errorf("%s can't download %s. Please use ADD instead", cmdName, orig)
+	}
+	checksum, verify := options["checksum"]
+	if verify && !remote {
+		return fmt.Errorf("%s --checksum only verifies URLs", cmdName)
+	}
+	if verify && !strings.HasPrefix(checksum, "sha256:") {
+		checksum = "sha256:" + checksum
+	}
+	var sum, downloaded string
+	if remote {
+		if downloaded, sum, err = b.downloadRemote(orig); err != nil {
+			return err
+		}
+		defer os.Remove(downloaded)
+		if verify && sum != checksum {
+			return fmt.Errorf("Checksum mismatch of %s: expected %s, got %s", orig, checksum, sum)
+		}
+	} else if sum, err = b.contextChecksum(orig); err != nil {
+		return err
+	}
+	chown, changeOwner := options["chown"]
+	if changeOwner {
+		cmdName += " --chown=" + chown
+	}
 
+	cmd := b.config.Cmd
+	// The checksum of the files is part of the command, the cached layer
+	// isn't used once they change
+	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) %s %s (%s) in %s", cmdName, orig, sum, dest)}
 	b.config.Image = b.image
+
+	if b.utilizeCache {
+		if cache, err := b.srv.ImageGetCached(b.image, b.config); err != nil {
+			return err
+		} else if cache != nil {
+			fmt.Fprintf(b.out, " ---> Using cache\n")
+			utils.Debugf("[BUILDER] Use cached version")
+			b.image = cache.ID
+			b.cached = true
+			b.config.Cmd = cmd
+			return nil
+		} else {
+			utils.Debugf("[BUILDER] Cache miss")
+		}
+	}
+
 	// Create the container and start it
 	container, err := b.builder.Create(b.config)
 	if err != nil {
@@ -343,23 +890,143 @@ func (b *buildFile) CmdAdd(args string) error {
 	}
 	defer container.Unmount()
 
-	if utils.IsURL(orig) {
-		if err := b.addRemote(container, orig, dest); err != nil {
+	var owner *fileOwner
+	if changeOwner {
+		if owner, err = b.lookupOwner(container, chown); err != nil {
+			return err
+		}
+	}
+	if remote {
+		if err := b.addRemote(container, orig, downloaded, dest, owner); err != nil {
 			return err
 		}
 	} else {
-		if err := b.addContext(container, orig, dest); err != nil {
+		if err := b.addContext(container, orig, dest, decompress, owner); err != nil {
 			return err
 		}
 	}
 
-	if err := b.commit(container.ID, cmd, fmt.Sprintf("ADD %s in %s", orig, dest)); err != nil {
+	if err := b.commit(container.ID, cmd, fmt.Sprintf("%s %s in %s", cmdName, orig, dest)); err != nil {
 		return err
 	}
 	b.config.Cmd = cmd
 	return nil
 }
 
+// The image of the stage of COPY --from: its name with FROM ... AS, its
+// index or another image
+func (b *buildFile) stageImage(stage string) (string, error) {
+	i, exists := b.stageNames[stage]
+	if !exists {
+		if n, err := strconv.Atoi(stage); err == nil {
+			i, exists = n, true
+		}
+	}
+	if exists {
+		if i < 0 || i >= len(b.stages) {
+			return "", fmt.Errorf("Invalid stage %s: COPY --from can only use the stages before the current one", stage)
+		}
+		return b.stages[i], nil
+	}
+	image, err := b.lookupImage(stage)
+	if err != nil {
+		return "", err
+	}
+	return image.ID, nil
+}
+
+// COPY --from=STAGE: copies files of the image of a previous stage instead
+// of the context. It's cached by the ID of the image, which is the same as
+// long as the stage is.
+func (b *buildFile) copyFromStage(stage, chown, args string) error {
+	tmp := strings.SplitN(args, " ", 2)
+	if len(tmp) != 2 {
+		return fmt.Errorf("Invalid COPY format")
+	}
+	orig, err := b.ReplaceEnvMatches(strings.Trim(tmp[0], " \t"))
+	if err != nil {
+		return err
+	}
+	dest, err := b.ReplaceEnvMatches(strings.Trim(tmp[1], " \t"))
+	if err != nil {
+		return err
+	}
+	id, err := b.stageImage(stage)
+	if err != nil {
+		return err
+	}
+	image, err := b.runtime.graph.Get(id)
+	if err != nil {
+		return err
+	}
+
+	cmdName := "COPY"
+	if chown != "" {
+		cmdName += " --chown=" + chown
+	}
+	cmd := b.config.Cmd
+	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) %s --from=%s %s in %s", cmdName, id, orig, dest)}
+	b.config.Image = b.image
+	defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
+
+	if b.utilizeCache {
+		if cache, err := b.srv.ImageGetCached(b.image, b.config); err != nil {
+			return err
+		} else if cache != nil {
+			fmt.Fprintf(b.out, " ---> Using cache\n")
+			utils.Debugf("[BUILDER] Use cached version")
+			b.image = cache.ID
+			b.cached = true
+			return nil
+		} else {
+			utils.Debugf("[BUILDER] Cache miss")
+		}
+	}
+
+	// Mount the image of the stage through a layer of its own, its changes
+	// are discarded
+	driver, layer := b.runtime.graph.driver, GenerateID()
+	if err := b.runtime.graph.layers.Create(layer, image.ID); err != nil {
+		return err
+	}
+	defer b.runtime.graph.layers.Release(layer)
+	root, err := driver.Get(layer)
+	if err != nil {
+		return err
+	}
+	defer driver.Put(layer)
+	origPath := path.Join(root, orig)
+	if !strings.HasPrefix(origPath, root) {
+		return fmt.Errorf("Forbidden path: %s", orig)
+	}
+	// The symlinks of the image resolve in it, not on the host
+	if origPath, err = utils.FollowSymlinkInScope(origPath, root); err != nil {
+		return err
+	}
+
+	container, err := b.builder.Create(b.config)
+	if err != nil {
+		return err
+	}
+	b.tmpContainers[container.ID] = struct{}{}
+
+	if err := container.EnsureMounted(); err != nil {
+		return err
+	}
+	defer container.Unmount()
+
+	var owner *fileOwner
+	if chown != "" {
+		if owner, err = b.lookupOwner(container, chown); err != nil {
+			return err
+		}
+	}
+	if err := b.addPath(container, origPath, dest, false, owner); err != nil {
+		return err
+	}
+	return b.commit(container.ID, cmd, fmt.Sprintf("%s --from=%s %s in %s", cmdName, stage, orig, dest))
+}
+
 func (b *buildFile) run() (string, error) {
 	if b.image == "" {
 		return "", fmt.Errorf("Please provide a source image with `from` prior to run")
@@ -385,7 +1052,7 @@ func (b *buildFile) run() (string, error) {
 	}
 
 	if b.verbose {
-		err = <-c.Attach(nil, nil, b.out, b.out)
+		err = <-c.Attach(nil, nil, b.out, b.out, nil)
 		if err != nil {
 			return "", err
 		}
@@ -417,6 +1084,7 @@ func (b *buildFile) commit(id string, autoCmd []string, comment string) error {
 				fmt.Fprintf(b.out, " ---> Using cache\n")
 				utils.Debugf("[BUILDER] Use cached version")
 				b.image = cache.ID
+				b.cached = true
 				return nil
 			} else {
 				utils.Debugf("[BUILDER] Cache miss")
@@ -451,9 +1119,18 @@ func (b *buildFile) commit(id string, autoCmd []string, comment string) error {
 	}
 	b.tmpImages[image.ID] = struct{}{}
 	b.image = image.ID
+	b.cached = false
 	return nil
 }
 
+// The method of the instruction of the Dockerfile
+func (b *buildFile) instruction(name string) (reflect.Method, bool) {
+	if len(name) == 0 {
+		return reflect.Method{}, false
+	}
+	return reflect.TypeOf(b).MethodByName("Cmd" + strings.ToUpper(name[:1]) + strings.ToLower(name[1:]))
+}
+
 func (b *buildFile) Build(context io.Reader) (string, error) {
 	// FIXME: @creack any reason for using /tmp instead of ""?
 	// FIXME: @creack "name" is a terrible variable name
@@ -494,7 +1171,7 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 		instruction := strings.ToLower(strings.Trim(tmp[0], " "))
 		arguments := strings.Trim(tmp[1], " ")
 
-		method, exists := reflect.TypeOf(b).MethodByName("Cmd" + strings.ToUpper(instruction[:1]) + strings.ToLower(instruction[1:]))
+		method, exists := b.instruction(instruction)
 		if !exists {
 			fmt.Fprintf(b.out, "# Skipping unknown instruction %s\n", strings.ToUpper(instruction))
 			continue
@@ -503,12 +1180,43 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 		stepN += 1
 		fmt.Fprintf(b.out, "Step %d : %s %s\n", stepN, strings.ToUpper(instruction), arguments)
 
+		start := time.Now()
+		b.cached = false
 		ret := method.Func.Call([]reflect.Value{reflect.ValueOf(b), reflect.ValueOf(arguments)})[0].Interface()
 		if ret != nil {
 			return "", ret.(error)
 		}
 
 		fmt.Fprintf(b.out, " ---> %v\n", utils.TruncateID(b.image))
+		b.rawOut.Write(b.sf.FormatBuildStep(&utils.JSONBuildStep{
+			Index:       stepN,
+			Instruction: strings.ToUpper(instruction) + " " + arguments,
+			Cached:      b.cached,
+			Duration:    time.Since(start).Seconds(),
+			Image:       b.image,
+		}))
+	}
+	var unused []string
+	for name := range b.buildArgs {
+		if _, exists := b.declaredArgs[name]; !exists {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		fmt.Fprintf(b.out, "[Warning] The build-args %s were not used: the Dockerfile has no ARG of them\n", strings.Join(unused, ", "))
+	}
+	if b.squash && b.image != "" && b.image != b.baseImage {
+		img, err := b.runtime.graph.Get(b.image)
+		if err != nil {
+			return "", err
+		}
+		squashed, err := b.runtime.graph.Squash(img, b.baseImage, fmt.Sprintf("squashed from %s", img.ID))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(b.out, "Squashed %s into %s\n", utils.TruncateID(b.image), utils.TruncateID(squashed.ID))
+		b.image = squashed.ID
 	}
 	if b.image != "" {
 		fmt.Fprintf(b.out, "Successfully built %s\n", utils.TruncateID(b.image))
@@ -517,16 +1225,84 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 	return "", fmt.Errorf("An error occurred during the build\n")
 }
 
-func NewBuildFile(srv *Server, out io.Writer, verbose, utilizeCache bool) BuildFile {
+// Apply the Dockerfile instructions of docker commit and docker import
+// -change to the config of the image: CMD, ENTRYPOINT, ENV, EXPOSE or LABEL
+func applyChanges(config *Config, changes []string) error {
+	for _, change := range changes {
+		tmp := strings.SplitN(strings.TrimSpace(change), " ", 2)
+		if len(tmp) != 2 {
+			return fmt.Errorf("Invalid change format: %s", change)
+		}
+		args := strings.Trim(tmp[1], " \t")
+		switch strings.ToUpper(tmp[0]) {
+		case "CMD", "ENTRYPOINT":
+			var cmd []string
+			if err := json.Unmarshal([]byte(args), &cmd); err != nil {
+				cmd = []string{"/bin/sh", "-c", args}
+			}
+			if strings.ToUpper(tmp[0]) == "CMD" {
+				config.Cmd = cmd
+			} else {
+				config.Entrypoint = cmd
+			}
+		case "ENV":
+			parts := strings.SplitN(args, " ", 2)
+			if len(parts) != 2 {
+				parts = strings.SplitN(args, "=", 2)
+			}
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid ENV format: %s", change)
+			}
+			key, value := parts[0], strings.Trim(parts[1], " \t")
+			replaced := false
+			for i, env := range config.Env {
+				if strings.SplitN(env, "=", 2)[0] == key {
+					config.Env[i], replaced = key+"="+value, true
+				}
+			}
+			if !replaced {
+				config.Env = append(config.Env, key+"="+value)
+			}
+		case "EXPOSE":
+			config.PortSpecs = append(config.PortSpecs, strings.Fields(args)...)
+		case "LABEL":
+			pairs, err := splitQuoted(args)
+			if err != nil {
+				return err
+			}
+			if config.Labels == nil {
+				config.Labels = make(map[string]string)
+			}
+			for _, pair := range pairs {
+				parts := strings.SplitN(pair, "=", 2)
+				if len(parts) != 2 || parts[0] == "" {
+					return fmt.Errorf("Invalid LABEL format: %s", pair)
+				}
+				config.Labels[parts[0]] = parts[1]
+			}
+		default:
+			return fmt.Errorf("%s can't be changed in the config of an image", strings.ToUpper(tmp[0]))
+		}
+	}
+	return nil
+}
+
+func NewBuildFile(srv *Server, out io.Writer, sf *utils.StreamFormatter, verbose, utilizeCache, squash bool, buildArgs map[string]string) BuildFile {
 	return &buildFile{
 		builder:       NewBuilder(srv.runtime),
 		runtime:       srv.runtime,
 		srv:           srv,
 		config:        &Config{},
-		out:           out,
+		out:           &buildWriter{out: out, sf: sf},
+		rawOut:        out,
+		sf:            sf,
 		tmpContainers: make(map[string]struct{}),
 		tmpImages:     make(map[string]struct{}),
 		verbose:       verbose,
 		utilizeCache:  utilizeCache,
+		squash:        squash,
+		buildArgs:     buildArgs,
+		declaredArgs:  make(map[string]struct{}),
+		stageNames:    make(map[string]int),
 	}
 }
@@ -1,13 +1,16 @@
 package docker
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"github.com/dotcloud/docker/utils"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 // mkTestContext generates a build context from the contents of the provided dockerfile.
@@ -87,6 +90,23 @@ run [ "$(cat /somewheeeere/over/the/rainbooow/ga)" = "bu" ]
 	{
 		`
 from {IMAGE}
+copy f /abc
+run [ "$(cat /abc)" = "hello" ]
+copy f /x/y/d/
+run [ "$(cat /x/y/d/f)" = "hello" ]
+copy d /somewhere
+run [ "$(cat /somewhere/ga)" = "bu" ]
+`,
+		[][2]string{
+			{"f", "hello"},
+			{"d/ga", "bu"},
+		},
+		nil,
+	},
+
+	{
+		`
+from {IMAGE}
 add http://{SERVERADDR}/x /a/b/c
 run [ "$(cat /a/b/c)" = "hello" ]
 add http://{SERVERADDR}/x?foo=bar /
@@ -200,6 +220,10 @@ func TestBuild(t *testing.T) {
 }
 
 func buildImage(context testContextTemplate, t *testing.T, srv *Server, useCache bool) *Image {
+	return buildImageWithArgs(context, t, srv, useCache, nil)
+}
+
+func buildImageWithArgs(context testContextTemplate, t *testing.T, srv *Server, useCache bool, buildArgs map[string]string) *Image {
 	if srv == nil {
 		runtime, err := newTestRuntime()
 		if err != nil {
@@ -226,10 +250,10 @@ func buildImage(context testContextTemplate, t *testing.T, srv *Server, useCache
 	}
 	port := httpServer.URL[idx+1:]
 
-	ip := srv.runtime.networkManager.bridgeNetwork.IP
+	ip := srv.runtime.networkDriver.(*bridgeDriver).networks[DefaultNetworkName].bridgeNetwork.IP
 	dockerfile := constructDockerfile(context.dockerfile, ip, port)
 
-	buildfile := NewBuildFile(srv, ioutil.Discard, false, useCache)
+	buildfile := NewBuildFile(srv, ioutil.Discard, utils.NewStreamFormatter(false), false, useCache, false, buildArgs)
 	id, err := buildfile.Build(mkTestContext(dockerfile, context.files, t))
 	if err != nil {
 		t.Fatal(err)
@@ -328,6 +352,55 @@ func TestBuildEntrypoint(t *testing.T) {
 	}
 }
 
+func TestBuildHealthcheck(t *testing.T) {
+	img := buildImage(testContextTemplate{`
+        from {IMAGE}
+        healthcheck --interval=5s --retries=2 CMD test -e /tmp/healthy
+        `,
+		nil, nil}, t, nil, true)
+
+	healthcheck := img.Config.Healthcheck
+	if healthcheck == nil {
+		t.Fatal("The image has no health check")
+	}
+	if healthcheck.Interval != 5*time.Second || healthcheck.Timeout != 0 || healthcheck.Retries != 2 {
+		t.Fatalf("Unexpected health check: %v", healthcheck)
+	}
+	if len(healthcheck.Test) != 3 || healthcheck.Test[2] != "test -e /tmp/healthy" {
+		t.Fatalf("Unexpected health check command: %v", healthcheck.Test)
+	}
+}
+
+func TestBuildStopSignal(t *testing.T) {
+	img := buildImage(testContextTemplate{`
+        from {IMAGE}
+        stopsignal SIGQUIT
+        `,
+		nil, nil}, t, nil, true)
+
+	if img.Config.StopSignal != "SIGQUIT" {
+		t.Fatalf("Unexpected stop signal: %s", img.Config.StopSignal)
+	}
+}
+
+func TestParseHealthcheck(t *testing.T) {
+	healthcheck, err := parseHealthcheck(`--timeout=3s CMD ["curl", "-f", "http://localhost/"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if healthcheck.Timeout != 3*time.Second || len(healthcheck.Test) != 3 || healthcheck.Test[0] != "curl" {
+		t.Fatalf("Unexpected health check: %v", healthcheck)
+	}
+	if healthcheck, err := parseHealthcheck("NONE"); err != nil || len(healthcheck.Test) != 0 {
+		t.Fatalf("NONE should disable the health check: %v, %v", healthcheck, err)
+	}
+	for _, args := range []string{"true", "--interval=5s", "--interval=5 CMD true", "--retries=0 CMD true", "--port=80 CMD true", "CMD []"} {
+		if _, err := parseHealthcheck(args); err == nil {
+			t.Fatalf("Expected an error for HEALTHCHECK %s", args)
+		}
+	}
+}
+
 // testing #1405 - config.Cmd does not get cleaned up if
 // utilizing cache
 func TestBuildEntrypointRunCleanup(t *testing.T) {
@@ -424,6 +497,309 @@ func TestBuildImageWithoutCache(t *testing.T) {
 	}
 }
 
+func TestBuildAddWithCache(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	template := testContextTemplate{`
+        from {IMAGE}
+        add foo /foo
+        `,
+		[][2]string{{"foo", "hello"}}, nil}
+
+	img := buildImage(template, t, srv, true)
+	imageId := img.ID
+
+	img = buildImage(template, t, srv, true)
+	if imageId != img.ID {
+		t.Fatalf("Image ids should match: %s != %s", imageId, img.ID)
+	}
+
+	template.files = [][2]string{{"foo", "world"}}
+	img = buildImage(template, t, srv, true)
+	if imageId == img.ID {
+		t.Fatalf("The ADD of a changed file should not be cached: %s == %s", imageId, img.ID)
+	}
+
+	template.dockerfile = `
+        from {IMAGE}
+        copy foo /foo
+        `
+	img = buildImage(template, t, srv, true)
+	imageId = img.ID
+	img = buildImage(template, t, srv, true)
+	if imageId != img.ID {
+		t.Fatalf("Image ids should match: %s != %s", imageId, img.ID)
+	}
+}
+
+func TestBuildArg(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	img := buildImageWithArgs(testContextTemplate{`
+        from {IMAGE}
+        arg VERSION=1.0
+        arg DIR=/default
+        arg UNSET
+        run [ "$VERSION" = "1.2" ]
+        run [ "$DIR" = "/default" ]
+        run [ -z "$UNSET" ]
+        add foo /$VERSION
+        run [ "$(cat /1.2)" = "hello" ]
+        env VERSION 2.0
+        run [ "$VERSION" = "2.0" ]
+        `,
+		[][2]string{{"foo", "hello"}}, nil}, t, srv, true, map[string]string{"VERSION": "1.2"})
+	for _, env := range img.Config.Env {
+		if strings.HasPrefix(env, "DIR=") {
+			t.Fatalf("The args should not be in the environment of the image: %v", img.Config.Env)
+		}
+	}
+
+	template := testContextTemplate{`
+        from {IMAGE}
+        expose 80
+        arg VERSION
+        run echo $VERSION
+        `,
+		nil, nil}
+	img = buildImageWithArgs(template, t, srv, true, map[string]string{"VERSION": "1.2"})
+	imageId, parentId := img.ID, img.Parent
+
+	img = buildImageWithArgs(template, t, srv, true, map[string]string{"VERSION": "1.2"})
+	if imageId != img.ID {
+		t.Fatalf("Image ids should match: %s != %s", imageId, img.ID)
+	}
+	img = buildImageWithArgs(template, t, srv, true, map[string]string{"VERSION": "1.3"})
+	if imageId == img.ID {
+		t.Fatalf("The RUN of a changed arg should not be cached: %s == %s", imageId, img.ID)
+	}
+	if parentId != img.Parent {
+		t.Fatalf("The ARG should be cached: %s != %s", parentId, img.Parent)
+	}
+
+	// The LABEL of a changed arg isn't cached either
+	template = testContextTemplate{`
+        from {IMAGE}
+        arg VERSION
+        label version=$VERSION
+        `,
+		nil, nil}
+	img = buildImageWithArgs(template, t, srv, true, map[string]string{"VERSION": "1.2"})
+	imageId = img.ID
+	img = buildImageWithArgs(template, t, srv, true, map[string]string{"VERSION": "1.3"})
+	if imageId == img.ID || img.Config.Labels["version"] != "1.3" {
+		t.Fatalf("The LABEL of a changed arg should not be cached: %s == %s, labels %v", imageId, img.ID, img.Config.Labels)
+	}
+}
+
+func TestBuildMultiStage(t *testing.T) {
+	img := buildImage(testContextTemplate{`
+        from {IMAGE} as builder
+        maintainer builder
+        env BUILT 1
+        run mkdir -p /build && echo hello > /build/out && ln -s /build /abs
+        from {IMAGE}
+        copy --from=builder /build/out /out
+        copy --from=0 /build /build
+        copy --from=builder /abs/out /abs-out
+        run [ "$(cat /out)" = "hello" ]
+        run [ "$(cat /abs-out)" = "hello" ]
+        run [ "$(cat /build/out)" = "hello" ]
+        `,
+		nil, nil}, t, nil, true)
+
+	if img.Author != "" {
+		t.Fatalf("The maintainer of a previous stage should not be in the image: %s", img.Author)
+	}
+	for _, env := range img.Config.Env {
+		if strings.HasPrefix(env, "BUILT=") {
+			t.Fatalf("The environment of a previous stage should not be in the image: %v", img.Config.Env)
+		}
+	}
+}
+
+func TestBuildOnBuild(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	parent := buildImage(testContextTemplate{`
+        from {IMAGE}
+        onbuild add foo /foo
+        onbuild run echo triggered > /triggered
+        `,
+		nil, nil}, t, srv, true)
+	if len(parent.Config.OnBuild) != 2 || parent.Config.OnBuild[0] != "ADD foo /foo" {
+		t.Fatalf("Unexpected triggers of the image: %v", parent.Config.OnBuild)
+	}
+
+	img := buildImage(testContextTemplate{fmt.Sprintf(`
+        from %s
+        run [ "$(cat /foo)" = "hello" ]
+        run [ "$(cat /triggered)" = "triggered" ]
+        `, parent.ID),
+		[][2]string{{"foo", "hello"}}, nil}, t, srv, true)
+	if len(img.Config.OnBuild) != 0 {
+		t.Fatalf("The triggers should not be inherited: %v", img.Config.OnBuild)
+	}
+
+	b := &buildFile{config: &Config{}}
+	if err := b.CmdOnbuild(" run echo"); err == nil {
+		t.Fatalf("An ONBUILD without an instruction should fail")
+	}
+}
+
+func TestBuildLabel(t *testing.T) {
+	img := buildImage(testContextTemplate{`
+        from {IMAGE}
+        env VERSION 1.0
+        label vendor=docker "description"="A test image" version=$VERSION
+        label vendor=dotcloud
+        `,
+		nil, nil}, t, nil, true)
+
+	expected := map[string]string{"vendor": "dotcloud", "description": "A test image", "version": "1.0"}
+	if len(img.Config.Labels) != len(expected) {
+		t.Fatalf("Unexpected labels: %v", img.Config.Labels)
+	}
+	for k, v := range expected {
+		if img.Config.Labels[k] != v {
+			t.Fatalf("Label %s should be %s: %v", k, v, img.Config.Labels)
+		}
+	}
+}
+
+func TestBuildShell(t *testing.T) {
+	img := buildImage(testContextTemplate{`
+        from {IMAGE}
+        shell ["/bin/sh", "-ec"]
+        run true
+        cmd echo hello
+        `,
+		nil, nil}, t, nil, true)
+
+	if len(img.Config.Cmd) != 3 || img.Config.Cmd[1] != "-ec" || img.Config.Cmd[2] != "echo hello" {
+		t.Fatalf("The CMD should use the SHELL: %v", img.Config.Cmd)
+	}
+	if len(img.Config.Shell) != 2 || img.Config.Shell[1] != "-ec" {
+		t.Fatalf("The SHELL should be in the image: %v", img.Config.Shell)
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	words, err := splitQuoted(`a=b  "c d"=e f="g \"h\""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a=b", "c d=e", `f=g "h"`}
+	if len(words) != len(expected) {
+		t.Fatalf("Unexpected words: %v", words)
+	}
+	for i := range expected {
+		if words[i] != expected[i] {
+			t.Fatalf("Expected %s, got %s", expected[i], words[i])
+		}
+	}
+	if _, err := splitQuoted(`a="b`); err == nil {
+		t.Fatalf("An unterminated quote should fail")
+	}
+}
+
+func TestBuildChown(t *testing.T) {
+	sum := sha256.Sum256([]byte("world!"))
+	buildImage(testContextTemplate{fmt.Sprintf(`
+        from {IMAGE}
+        run echo app:x:1234:1235::/:/bin/sh >> /etc/passwd
+        copy --chown=1000:1001 foo /foo
+        copy --chown=app dir /dir
+        add --chown=app:1001 --checksum=sha256:%x http://{SERVERADDR}/baz /baz
+        run [ "$(stat -c %%u:%%g /foo)" = "1000:1001" ]
+        run [ "$(stat -c %%u:%%g /dir /dir/bar)" = "$(printf '1234:1235\n1234:1235')" ]
+        run [ "$(stat -c %%u:%%g /baz)" = "1234:1001" ]
+        `, sum),
+		[][2]string{{"foo", "hello"}, {"dir/bar", "hello"}},
+		[][2]string{{"/baz", "world!"}}}, t, nil, true)
+}
+
+func TestParseContextOptions(t *testing.T) {
+	options, args, err := parseContextOptions("--chown=app:app --checksum=sha256:abc  foo /bar", "ADD", "chown", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args != "foo /bar" || options["chown"] != "app:app" || options["checksum"] != "sha256:abc" {
+		t.Fatalf("Unexpected options %v and arguments %s", options, args)
+	}
+	for _, invalid := range []string{"--from=0 foo /bar", "--chown foo /bar", "--chown="} {
+		if _, _, err := parseContextOptions(invalid, "ADD", "chown", "checksum"); err == nil {
+			t.Fatalf("%s should be invalid", invalid)
+		}
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	config := &Config{Env: []string{"FOO=bar"}}
+	changes := []string{
+		`CMD ["/bin/app", "-v"]`,
+		"entrypoint /bin/run",
+		"ENV FOO baz",
+		"ENV PATH=/bin",
+		"EXPOSE 80 443",
+		`LABEL version=1.0 "description"="An app"`,
+	}
+	if err := applyChanges(config, changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Cmd) != 2 || config.Cmd[0] != "/bin/app" {
+		t.Fatalf("Unexpected cmd: %v", config.Cmd)
+	}
+	if len(config.Entrypoint) != 3 || config.Entrypoint[2] != "/bin/run" {
+		t.Fatalf("Unexpected entrypoint: %v", config.Entrypoint)
+	}
+	if len(config.Env) != 2 || config.Env[0] != "FOO=baz" || config.Env[1] != "PATH=/bin" {
+		t.Fatalf("Unexpected env: %v", config.Env)
+	}
+	if len(config.PortSpecs) != 2 || config.PortSpecs[1] != "443" {
+		t.Fatalf("Unexpected ports: %v", config.PortSpecs)
+	}
+	if config.Labels["version"] != "1.0" || config.Labels["description"] != "An app" {
+		t.Fatalf("Unexpected labels: %v", config.Labels)
+	}
+
+	for _, invalid := range []string{"RUN make", "ENV FOO", "CMD"} {
+		if err := applyChanges(&Config{}, []string{invalid}); err == nil {
+			t.Fatalf("%s should be invalid", invalid)
+		}
+	}
+}
+
 func TestForbiddenContextPath(t *testing.T) {
 	runtime, err := newTestRuntime()
 	if err != nil {
@@ -456,10 +832,10 @@ func TestForbiddenContextPath(t *testing.T) {
 	}
 	port := httpServer.URL[idx+1:]
 
-	ip := srv.runtime.networkManager.bridgeNetwork.IP
+	ip := srv.runtime.networkDriver.(*bridgeDriver).networks[DefaultNetworkName].bridgeNetwork.IP
 	dockerfile := constructDockerfile(context.dockerfile, ip, port)
 
-	buildfile := NewBuildFile(srv, ioutil.Discard, false, true)
+	buildfile := NewBuildFile(srv, ioutil.Discard, utils.NewStreamFormatter(false), false, true, false, nil)
 	_, err = buildfile.Build(mkTestContext(dockerfile, context.files, t))
 
 	if err == nil {
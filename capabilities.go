@@ -0,0 +1,86 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The Linux capabilities, as lxc.cap.drop names them (the ones of the
+// kernels after 3.0, wake_alarm and block_suspend, are unknown to lxc 0.8)
+var allCapabilities = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill",
+	"setgid", "setuid", "setpcap", "linux_immutable", "net_bind_service",
+	"net_broadcast", "net_admin", "net_raw", "ipc_lock", "ipc_owner",
+	"sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct",
+	"sys_admin", "sys_boot", "sys_nice", "sys_resource", "sys_time",
+	"sys_tty_config", "mknod", "lease", "audit_write", "audit_control",
+	"setfcap", "mac_override", "mac_admin", "syslog",
+}
+
+// The capabilities the containers which aren't privileged don't have,
+// unless they are added: the ones of the administration of the host
+var defaultCapDrop = []string{
+	"audit_control", "audit_write", "mac_admin", "mac_override", "mknod",
+	"setfcap", "setpcap", "sys_admin", "sys_boot", "sys_module", "sys_nice",
+	"sys_pacct", "sys_rawio", "sys_resource", "sys_time", "sys_tty_config",
+}
+
+// The name of a capability of -cap-add and -cap-drop: chown, CHOWN or
+// CAP_CHOWN, or all
+func normalizeCapability(name string) string {
+	return strings.TrimPrefix(strings.ToLower(name), "cap_")
+}
+
+func validateCapabilities(capabilities []string) error {
+	for _, name := range capabilities {
+		capability := normalizeCapability(name)
+		if capability == "all" {
+			continue
+		}
+		valid := false
+		for _, known := range allCapabilities {
+			if capability == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Bad parameter: invalid capability %s", name)
+		}
+	}
+	return nil
+}
+
+// The capabilities a container drops: the default ones (none if
+// privileged) and capDrop, but not capAdd. "all" drops or adds every one.
+func droppedCapabilities(privileged bool, capAdd, capDrop []string) []string {
+	dropped := make(map[string]bool)
+	if !privileged {
+		for _, capability := range defaultCapDrop {
+			dropped[capability] = true
+		}
+	}
+	for _, name := range capDrop {
+		if capability := normalizeCapability(name); capability == "all" {
+			for _, capability := range allCapabilities {
+				dropped[capability] = true
+			}
+		} else {
+			dropped[capability] = true
+		}
+	}
+	for _, name := range capAdd {
+		if capability := normalizeCapability(name); capability == "all" {
+			dropped = make(map[string]bool)
+		} else {
+			delete(dropped, capability)
+		}
+	}
+	capabilities := make([]string, 0, len(dropped))
+	for capability := range dropped {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
@@ -0,0 +1,225 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The -cgroup-parent of a host config: a cgroup under the root of the
+// hierarchies (e.g. /docker-workers), or the name of a systemd slice
+// (e.g. workers.slice)
+func validateCgroupParent(parent string) error {
+	if parent == "" {
+		return nil
+	}
+	if strings.ContainsAny(parent, " \t\n") || path.Clean("/"+parent) == "/" {
+		return fmt.Errorf("Bad parameter: invalid cgroup parent %q", parent)
+	}
+	for _, part := range strings.Split(parent, "/") {
+		if part == ".." {
+			return fmt.Errorf("Bad parameter: the cgroup parent %s is not under the root of the hierarchies", parent)
+		}
+	}
+	if strings.HasSuffix(parent, ".slice") && !strings.Contains(parent, "/") {
+		if strings.HasPrefix(parent, "-") || strings.Contains(parent, "--") || strings.HasSuffix(parent, "-.slice") {
+			return fmt.Errorf("Bad parameter: invalid systemd slice %s", parent)
+		}
+	}
+	return nil
+}
+
+// The cgroup of a valid cgroup parent, relative to the root of the
+// hierarchies. systemd nests the slices by the dashes of their names:
+// a-b.slice is a.slice/a-b.slice.
+func cgroupParentPath(parent string) string {
+	if parent == "" {
+		return ""
+	}
+	if !strings.HasSuffix(parent, ".slice") || strings.Contains(parent, "/") {
+		return strings.TrimPrefix(path.Clean("/"+parent), "/")
+	}
+	var dirs []string
+	name := strings.TrimSuffix(parent, ".slice")
+	for i := range name {
+		if name[i] == '-' {
+			dirs = append(dirs, name[:i]+".slice")
+		}
+	}
+	return path.Join(append(dirs, parent)...)
+}
+
+// The mountpoints of the cgroup hierarchies of the host
+func cgroupHierarchies() ([]string, error) {
+	output, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	var mountpoints []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.Split(line, " ")
+		if len(parts) == 6 && parts[2] == "cgroup" && !seen[parts[1]] {
+			seen[parts[1]] = true
+			mountpoints = append(mountpoints, parts[1])
+		}
+	}
+	return mountpoints, nil
+}
+
+// The lxc.cgroup.* settings of an lxc config, e.g. memory.limit_in_bytes,
+// in their order
+func lxcCgroupSettings(config []byte) [][2]string {
+	var settings [][2]string
+	for _, line := range strings.Split(string(config), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) == 2 && strings.HasPrefix(key, "lxc.cgroup.") {
+			settings = append(settings, [2]string{strings.TrimPrefix(key, "lxc.cgroup."), strings.TrimSpace(parts[1])})
+		}
+	}
+	return settings
+}
+
+// Create the cgroups of a container under its cgroup parent, with the
+// settings of its lxc config: lxc only creates them there from 2.1 on, with
+// lxc.cgroup.dir, so the daemon moves the container into them once started.
+// The parent is created if it doesn't exist.
+func createCgroups(parent, id string, settings [][2]string) error {
+	mountpoints, err := cgroupHierarchies()
+	if err != nil {
+		return err
+	}
+	for _, mountpoint := range mountpoints {
+		dir := mountpoint
+		for _, name := range strings.Split(path.Join(parent, id), "/") {
+			above := dir
+			dir = path.Join(dir, name)
+			if err := os.Mkdir(dir, 0755); os.IsExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			// The tasks of a cpuset cgroup can't join it until it has cpus
+			// and mems
+			for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+				if value, err := ioutil.ReadFile(path.Join(above, file)); err == nil {
+					if err := ioutil.WriteFile(path.Join(dir, file), value, 0644); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	for _, setting := range settings {
+		if err := setCgroup(parent, id, setting[0], setting[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set key, e.g. memory.limit_in_bytes, in the cgroup of a container under its
+// cgroup parent
+func setCgroup(parent, id, key, value string) error {
+	dir, err := cgroupPath(strings.SplitN(key, ".", 2)[0], parent, id)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, key), []byte(value), 0644); err != nil {
+		return fmt.Errorf("Unable to set %s of the container %s: %s", key, id, err)
+	}
+	return nil
+}
+
+// Move the process pid, with all its threads, into the cgroups of a
+// container under its cgroup parent, in all the hierarchies
+func joinCgroups(parent, id string, pid int) error {
+	mountpoints, err := cgroupHierarchies()
+	if err != nil {
+		return err
+	}
+	for _, mountpoint := range mountpoints {
+		procs := path.Join(mountpoint, parent, id, "cgroup.procs")
+		if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("Unable to move the container %s into its cgroup under %s: %s", id, parent, err)
+		}
+	}
+	return nil
+}
+
+// The command name with args, run in the cgroups of a container under its
+// cgroup parent: a shell joins them before it execs the command, so that it
+// can't fork before
+func cgroupCommand(parent, id, name string, args ...string) (*exec.Cmd, error) {
+	mountpoints, err := cgroupHierarchies()
+	if err != nil {
+		return nil, err
+	}
+	script := `n=$1; shift; while [ "$n" -gt 0 ]; do echo $$ > "$1" || exit 1; shift; n=$((n-1)); done; exec "$@"`
+	params := []string{"-c", script, "sh", strconv.Itoa(len(mountpoints))}
+	for _, mountpoint := range mountpoints {
+		params = append(params, path.Join(mountpoint, parent, id, "cgroup.procs"))
+	}
+	params = append(params, name)
+	return exec.Command("sh", append(params, args...)...), nil
+}
+
+// Freeze or thaw (state FROZEN or THAWED) the processes of a container under
+// its cgroup parent with its freezer cgroup, and wait for them to be
+func freezeCgroup(parent, id, state string) error {
+	if err := setCgroup(parent, id, "freezer.state", state); err != nil {
+		return err
+	}
+	dir, err := cgroupPath("freezer", parent, id)
+	if err != nil {
+		return err
+	}
+	// FREEZING until all the processes are frozen
+	for i := 0; i < 100; i++ {
+		current, err := ioutil.ReadFile(path.Join(dir, "freezer.state"))
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(current)) == state {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("The processes of the container %s were not %s in time", id, strings.ToLower(state))
+}
+
+// Remove the cgroups of a container under its cgroup parent, once it exited.
+// The parent is kept.
+func removeCgroups(parent, id string) error {
+	mountpoints, err := cgroupHierarchies()
+	if err != nil {
+		return err
+	}
+	for _, mountpoint := range mountpoints {
+		if err := os.Remove(path.Join(mountpoint, parent, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether all the cgroups of /proc/self/cgroup are cgroup, the one of a
+// container under its cgroup parent. The unified hierarchy isn't used.
+func inCgroup(procCgroup, cgroup string) bool {
+	for _, line := range strings.Split(strings.TrimSpace(procCgroup), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || parts[0] == "0" {
+			continue
+		}
+		if !strings.HasSuffix(parts[2], "/"+cgroup) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,10 +1,13 @@
 package docker
 
 import (
+	"archive/tar"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 type ChangeType int
@@ -104,3 +107,137 @@ func Changes(layers []string, rw string) ([]Change, error) {
 	}
 	return changes, nil
 }
+
+// ChangesDirs returns the changes of the directory newDir to the directory
+// oldDir, everything in newDir being added if oldDir is empty. The files
+// are compared by their metadata, like the ones of a copy made with cp -a.
+func ChangesDirs(newDir, oldDir string) ([]Change, error) {
+	var changes []Change
+	err := filepath.Walk(newDir, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(newDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		change := Change{Path: filepath.Join("/", rel), Kind: ChangeAdd}
+		if oldDir != "" {
+			if old, err := os.Lstat(filepath.Join(oldDir, rel)); err == nil {
+				if sameFile(f, old) {
+					return nil
+				}
+				change.Kind = ChangeModify
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil || oldDir == "" {
+		return changes, err
+	}
+	err = filepath.Walk(oldDir, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(oldDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(newDir, rel)); os.IsNotExist(err) {
+			changes = append(changes, Change{Path: filepath.Join("/", rel), Kind: ChangeDelete})
+			// The deletion of the directory covers its files
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	return changes, err
+}
+
+func sameFile(f1, f2 os.FileInfo) bool {
+	if f1.Mode() != f2.Mode() || !f1.ModTime().Equal(f2.ModTime()) {
+		return false
+	}
+	st1, ok1 := f1.Sys().(*syscall.Stat_t)
+	st2, ok2 := f2.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 && (st1.Uid != st2.Uid || st1.Gid != st2.Gid || st1.Rdev != st2.Rdev) {
+		return false
+	}
+	// The size of a directory doesn't tell whether its files changed
+	return f1.IsDir() || f1.Size() == f2.Size()
+}
+
+// ExportChanges returns an uncompressed tar archive of the changes of the
+// directory dir, with an aufs whiteout for each file deleted.
+func ExportChanges(dir string, changes []Change) Archive {
+	r, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		for _, change := range changes {
+			if err := exportChange(tw, dir, change); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.CloseWithError(tw.Close())
+	}()
+	return r
+}
+
+func exportChange(tw *tar.Writer, dir string, change Change) error {
+	name := strings.TrimPrefix(change.Path, "/")
+	if change.Kind == ChangeDelete {
+		return tw.WriteHeader(&tar.Header{
+			Name:     filepath.Join(filepath.Dir(name), ".wh."+filepath.Base(name)),
+			Mode:     0600,
+			Typeflag: tar.TypeReg,
+		})
+	}
+	p := filepath.Join(dir, name)
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -2,7 +2,9 @@ package docker
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -21,6 +23,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -38,8 +41,11 @@ func (cli *DockerCli) getMethod(name string) (reflect.Method, bool) {
 	return reflect.TypeOf(cli).MethodByName(methodName)
 }
 
-func ParseCommands(proto, addr string, args ...string) error {
+// Run the command of args, connecting to the daemon with TLS on tcp if
+// tlsConfig isn't nil
+func ParseCommands(proto, addr string, tlsConfig *tls.Config, args ...string) error {
 	cli := NewDockerCli(os.Stdin, os.Stdout, os.Stderr, proto, addr)
+	cli.tlsConfig = tlsConfig
 
 	if len(args) > 0 {
 		method, exists := cli.getMethod(args[0])
@@ -80,8 +86,10 @@ func (cli *DockerCli) CmdHelp(args ...string) error {
 		{"cp", "Copy files/folders from the containers filesystem to the host path"},
 		{"diff", "Inspect changes on a container's filesystem"},
 		{"events", "Get real time events from the server"},
+		{"exec", "Run a command in a running container"},
 		{"export", "Stream the contents of a container as a tar archive"},
 		{"history", "Show the history of an image"},
+		{"image", "Manage the images"},
 		{"images", "List images"},
 		{"import", "Create a new filesystem image from the contents of a tarball"},
 		{"info", "Display system-wide information"},
@@ -89,21 +97,33 @@ func (cli *DockerCli) CmdHelp(args ...string) error {
 		{"inspect", "Return low-level information on a container"},
 		{"kill", "Kill a running container"},
 		{"login", "Register or Login to the docker registry server"},
+		{"load", "Load an image from a tar archive"},
 		{"logs", "Fetch the logs of a container"},
+		{"manifest", "Manage the manifest lists of multi-platform images"},
+		{"network", "Manage the networks containers are attached to"},
+		{"pause", "Pause all the processes of a running container"},
 		{"port", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT"},
 		{"top", "Lookup the running processes of a container"},
+		{"unpause", "Unpause the processes of a paused container"},
+		{"update", "Update the resources of one or more containers"},
 		{"ps", "List containers"},
 		{"pull", "Pull an image or a repository from the docker registry server"},
 		{"push", "Push an image or a repository to the docker registry server"},
+		{"rename", "Rename a container"},
 		{"restart", "Restart a running container"},
 		{"rm", "Remove one or more containers"},
 		{"rmi", "Remove one or more images"},
 		{"run", "Run a command in a new container"},
+		{"save", "Save an image to a tar archive"},
 		{"search", "Search for an image in the docker index"},
+		{"squash", "Squash the layers of an image into one"},
 		{"start", "Start a stopped container"},
+		{"stats", "Display a live stream of the resource usage of containers"},
 		{"stop", "Stop a running container"},
+		{"system", "Show the disk usage of docker"},
 		{"tag", "Tag an image into a repository"},
 		{"version", "Show the docker version information"},
+		{"volume", "Manage the volumes"},
 		{"wait", "Block until a container stops, then print its exit code"},
 	} {
 		help += fmt.Sprintf("    %-10.10s%s\n", command[0], command[1])
@@ -157,11 +177,46 @@ func mkBuildContext(dockerfile string, files [][2]string) (Archive, error) {
 	return buf, nil
 }
 
+// The patterns of the .dockerignore of the context at dir, of the files
+// not to send to the daemon. One per line, the ones starting with # are
+// comments.
+func readDockerignore(dir string) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var excludes []string
+	for _, line := range strings.Split(string(content), "\n") {
+		pattern := strings.TrimSpace(line)
+		if pattern == "" || pattern[0] == '#' {
+			continue
+		}
+		pattern = strings.TrimLeft(filepath.Clean(pattern), "/")
+		if pattern == "." || pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern in .dockerignore: %s", line)
+		}
+		// The daemon can't build without it
+		if match, _ := filepath.Match(pattern, "Dockerfile"); match {
+			return nil, fmt.Errorf("The pattern %s of .dockerignore can't exclude the Dockerfile", line)
+		}
+		excludes = append(excludes, pattern)
+	}
+	return excludes, nil
+}
+
 func (cli *DockerCli) CmdBuild(args ...string) error {
 	cmd := Subcmd("build", "[OPTIONS] PATH | URL | -", "Build a new container image from the source code at PATH")
 	tag := cmd.String("t", "", "Repository name (and optionally a tag) to be applied to the resulting image in case of success")
 	suppressOutput := cmd.Bool("q", false, "Suppress verbose build output")
 	noCache := cmd.Bool("no-cache", false, "Do not use cache when building the image")
+	squash := cmd.Bool("squash", false, "Squash the layers of the build into one")
+	var flBuildArgs ListOpts
+	cmd.Var(&flBuildArgs, "build-arg", "Set a value of an ARG of the Dockerfile (e.g. -build-arg HTTP_PROXY=http://proxy:3128)")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -170,6 +225,17 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 		return nil
 	}
 
+	buildArgs := make(map[string]string)
+	for _, arg := range flBuildArgs {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) == 2 {
+			buildArgs[parts[0]] = parts[1]
+		} else {
+			// Without a value, it's the one of the environment of the client
+			buildArgs[parts[0]] = os.Getenv(parts[0])
+		}
+	}
+
 	var (
 		context  Archive
 		isRemote bool
@@ -190,7 +256,14 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 		if _, err := os.Stat(cmd.Arg(0)); err != nil {
 			return err
 		}
-		context, err = Tar(cmd.Arg(0), Uncompressed)
+		excludes, err := readDockerignore(cmd.Arg(0))
+		if err != nil {
+			return err
+		}
+		context, err = TarWithExcludes(cmd.Arg(0), Uncompressed, excludes)
+		if err != nil {
+			return err
+		}
 	}
 	var body io.Reader
 	// Setup an upload progress bar
@@ -212,14 +285,25 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 	if *noCache {
 		v.Set("nocache", "1")
 	}
-	req, err := http.NewRequest("POST", fmt.Sprintf("/v%g/build?%s", APIVERSION, v.Encode()), body)
+	if *squash {
+		v.Set("squash", "1")
+	}
+	v.Set("json", "1")
+	if len(buildArgs) > 0 {
+		buf, err := json.Marshal(buildArgs)
+		if err != nil {
+			return err
+		}
+		v.Set("buildargs", string(buf))
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("/v%g/build?%s", cli.apiVersion(), v.Encode()), body)
 	if err != nil {
 		return err
 	}
 	if context != nil {
 		req.Header.Set("Content-Type", "application/tar")
 	}
-	dial, err := net.Dial(cli.proto, cli.addr)
+	dial, err := cli.dial()
 	if err != nil {
 		return err
 	}
@@ -242,7 +326,10 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 		return fmt.Errorf("Error: %s", body)
 	}
 
-	// Output the result
+	// Output the result, the daemons without the JSON stream send text
+	if matchesContentType(resp.Header.Get("Content-Type"), "application/json") {
+		return utils.DisplayJSONMessagesStream(resp.Body, cli.out)
+	}
 	if _, err := io.Copy(cli.out, resp.Body); err != nil {
 		return err
 	}
@@ -298,10 +385,14 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 	flUsername := cmd.String("u", "", "username")
 	flPassword := cmd.String("p", "", "password")
 	flEmail := cmd.String("e", "", "email")
+	flCredentialHelper := cmd.String("credential-helper", "", "Keep the password with the credential helper docker-credential-NAME (e.g. osxkeychain) instead of ~/.dockercfg")
 	err := cmd.Parse(args)
 	if err != nil {
 		return nil
 	}
+	if *flCredentialHelper != "" {
+		cli.configFile.CredsStore = *flCredentialHelper
+	}
 
 	var oldState *term.State
 	if *flUsername == "" || *flPassword == "" || *flEmail == "" {
@@ -326,9 +417,9 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 		}
 	}
 
-	authconfig, ok := cli.configFile.Configs[auth.IndexServerAddress()]
-	if !ok {
-		authconfig = auth.AuthConfig{}
+	authconfig, err := cli.configFile.ResolveAuthConfig(auth.IndexServerAddress())
+	if err != nil {
+		fmt.Fprintf(cli.err, "WARNING: %s\n", err)
 	}
 
 	if *flUsername == "" {
@@ -372,9 +463,11 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 	authconfig.Email = email
 	cli.configFile.Configs[auth.IndexServerAddress()] = authconfig
 
-	body, statusCode, err := cli.call("POST", "/auth", cli.configFile.Configs[auth.IndexServerAddress()])
+	body, statusCode, err := cli.call("POST", "/auth", authconfig)
 	if statusCode == 401 {
-		delete(cli.configFile.Configs, auth.IndexServerAddress())
+		if err := cli.configFile.Erase(auth.IndexServerAddress()); err != nil {
+			fmt.Fprintf(cli.err, "WARNING: %s\n", err)
+		}
 		auth.SaveConfig(cli.configFile)
 		return err
 	}
@@ -388,7 +481,12 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 		cli.configFile, _ = auth.LoadConfig(os.Getenv("HOME"))
 		return err
 	}
-	auth.SaveConfig(cli.configFile)
+	if err := auth.SaveConfig(cli.configFile); err != nil {
+		return err
+	}
+	if cli.configFile.CredsStore == "" {
+		fmt.Fprintf(cli.err, "WARNING: The password is stored unencrypted in ~/%s, use -credential-helper to keep it in a credential helper\n", auth.CONFIGFILE)
+	}
 	if out2.Status != "" {
 		fmt.Fprintf(cli.out, "%s\n", out2.Status)
 	}
@@ -397,7 +495,8 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 
 // 'docker wait': block until a container stops
 func (cli *DockerCli) CmdWait(args ...string) error {
-	cmd := Subcmd("wait", "CONTAINER [CONTAINER...]", "Block until a container stops, then print its exit code.")
+	cmd := Subcmd("wait", "[OPTIONS] CONTAINER [CONTAINER...]", "Block until a container stops, then print its exit code.")
+	condition := cmd.String("condition", "not-running", "Wait until the container is not running, exits next (after being started if it's stopped) or is removed: not-running, next-exit or removed")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -405,8 +504,10 @@ func (cli *DockerCli) CmdWait(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	v := url.Values{}
+	v.Set("condition", *condition)
 	for _, name := range cmd.Args() {
-		body, _, err := cli.call("POST", "/containers/"+name+"/wait", nil)
+		body, _, err := cli.call("POST", "/containers/"+name+"/wait?"+v.Encode(), nil)
 		if err != nil {
 			fmt.Fprintf(cli.err, "%s", err)
 		} else {
@@ -445,7 +546,11 @@ func (cli *DockerCli) CmdVersion(args ...string) error {
 		return err
 	}
 	fmt.Fprintf(cli.out, "Client version: %s\n", VERSION)
+	fmt.Fprintf(cli.out, "Client API version: %g\n", APIVERSION)
 	fmt.Fprintf(cli.out, "Server version: %s\n", out.Version)
+	if out.APIVersion != "" {
+		fmt.Fprintf(cli.out, "Server API version: %s (minimum %s)\n", out.APIVersion, out.MinAPIVersion)
+	}
 	if out.GitCommit != "" {
 		fmt.Fprintf(cli.out, "Git commit: %s\n", out.GitCommit)
 	}
@@ -487,6 +592,9 @@ func (cli *DockerCli) CmdInfo(args ...string) error {
 
 	fmt.Fprintf(cli.out, "Containers: %d\n", out.Containers)
 	fmt.Fprintf(cli.out, "Images: %d\n", out.Images)
+	if out.Driver != "" {
+		fmt.Fprintf(cli.out, "Storage Driver: %s\n", out.Driver)
+	}
 	if out.Debug || os.Getenv("DEBUG") != "" {
 		fmt.Fprintf(cli.out, "Debug mode (server): %v\n", out.Debug)
 		fmt.Fprintf(cli.out, "Debug mode (client): %v\n", os.Getenv("DEBUG") != "")
@@ -518,7 +626,7 @@ func (cli *DockerCli) CmdInfo(args ...string) error {
 
 func (cli *DockerCli) CmdStop(args ...string) error {
 	cmd := Subcmd("stop", "[OPTIONS] CONTAINER [CONTAINER...]", "Stop a running container")
-	nSeconds := cmd.Int("t", 10, "Number of seconds to wait for the container to stop before killing it.")
+	nSeconds := cmd.Int("t", -1, "Number of seconds to wait for the container to stop before killing it (default: the stop timeout of the container, 10 unless set by docker run -stop-timeout).")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -528,7 +636,9 @@ func (cli *DockerCli) CmdStop(args ...string) error {
 	}
 
 	v := url.Values{}
-	v.Set("t", strconv.Itoa(*nSeconds))
+	if *nSeconds >= 0 {
+		v.Set("t", strconv.Itoa(*nSeconds))
+	}
 
 	for _, name := range cmd.Args() {
 		_, _, err := cli.call("POST", "/containers/"+name+"/stop?"+v.Encode(), nil)
@@ -543,7 +653,7 @@ func (cli *DockerCli) CmdStop(args ...string) error {
 
 func (cli *DockerCli) CmdRestart(args ...string) error {
 	cmd := Subcmd("restart", "[OPTIONS] CONTAINER [CONTAINER...]", "Restart a running container")
-	nSeconds := cmd.Int("t", 10, "Number of seconds to try to stop for before killing the container. Once killed it will then be restarted. Default=10")
+	nSeconds := cmd.Int("t", -1, "Number of seconds to try to stop for before killing the container. Once killed it will then be restarted. Default: the stop timeout of the container")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -553,7 +663,9 @@ func (cli *DockerCli) CmdRestart(args ...string) error {
 	}
 
 	v := url.Values{}
-	v.Set("t", strconv.Itoa(*nSeconds))
+	if *nSeconds >= 0 {
+		v.Set("t", strconv.Itoa(*nSeconds))
+	}
 
 	for _, name := range cmd.Args() {
 		_, _, err := cli.call("POST", "/containers/"+name+"/restart?"+v.Encode(), nil)
@@ -624,7 +736,7 @@ func (cli *DockerCli) CmdInspect(args ...string) error {
 }
 
 func (cli *DockerCli) CmdTop(args ...string) error {
-	cmd := Subcmd("top", "CONTAINER", "Lookup the running processes of a container")
+	cmd := Subcmd("top", "CONTAINER [ps OPTIONS]", "Lookup the running processes of a container")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -655,6 +767,490 @@ func (cli *DockerCli) CmdTop(args ...string) error {
 	return nil
 }
 
+// 'docker manifest create|annotate|inspect|push' manages the manifest lists
+// of the images built for several platforms
+func (cli *DockerCli) CmdManifest(args ...string) error {
+	cmd := Subcmd("manifest", "create|annotate|inspect|push [OPTIONS] MANIFEST_LIST [MANIFEST...]", "Manage the manifest lists of multi-platform images")
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return cli.manifestCreate(args[1:]...)
+		case "annotate":
+			return cli.manifestAnnotate(args[1:]...)
+		case "inspect":
+			return cli.manifestInspect(args[1:]...)
+		case "push":
+			return cli.manifestPush(args[1:]...)
+		}
+	}
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	cmd.Usage()
+	return nil
+}
+
+func (cli *DockerCli) manifestCreate(args ...string) error {
+	cmd := Subcmd("manifest create", "[OPTIONS] MANIFEST_LIST MANIFEST [MANIFEST...]", "Create a manifest list of images of its repository pushed for other platforms")
+	amend := cmd.Bool("amend", false, "Add the images to an existing manifest list")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 2 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("name", cmd.Arg(0))
+	for _, manifest := range cmd.Args()[1:] {
+		v.Add("manifest", manifest)
+	}
+	if *amend {
+		v.Set("amend", "1")
+	}
+	body, _, err := cli.call("POST", "/manifests/create?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	list := &ManifestList{}
+	if err := json.Unmarshal(body, list); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s\n", list.Name)
+	return nil
+}
+
+func (cli *DockerCli) manifestAnnotate(args ...string) error {
+	cmd := Subcmd("manifest annotate", "[OPTIONS] MANIFEST_LIST MANIFEST", "Set the platform of an image of a manifest list")
+	arch := cmd.String("arch", "", "Architecture of the image (e.g. arm64)")
+	os := cmd.String("os", "", "Operating system of the image (e.g. linux)")
+	variant := cmd.String("variant", "", "Variant of the architecture of the image (e.g. v7)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("manifest", cmd.Arg(1))
+	v.Set("arch", *arch)
+	v.Set("os", *os)
+	v.Set("variant", *variant)
+	if _, _, err := cli.call("POST", "/manifests/"+cmd.Arg(0)+"/annotate?"+v.Encode(), nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) manifestInspect(args ...string) error {
+	cmd := Subcmd("manifest inspect", "MANIFEST_LIST", "Return the images of a manifest list and their platform")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	obj, _, err := cli.call("GET", "/manifests/"+cmd.Arg(0)+"/json", nil)
+	if err != nil {
+		return err
+	}
+	indented := new(bytes.Buffer)
+	if err := json.Indent(indented, obj, "", "    "); err != nil {
+		return err
+	}
+	_, err = io.Copy(cli.out, indented)
+	return err
+}
+
+func (cli *DockerCli) manifestPush(args ...string) error {
+	cmd := Subcmd("manifest push", "[OPTIONS] MANIFEST_LIST", "Push a manifest list to its registry")
+	purge := cmd.Bool("purge", false, "Remove the local manifest list once it's pushed")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	if *purge {
+		v.Set("purge", "1")
+	}
+	// The credentials of the registry of the list, none of the index
+	authConfig, err := cli.registryAuthConfig(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if authConfig.Username != "" || authConfig.Password != "" {
+		buf, err := json.Marshal(authConfig)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewBuffer(buf)
+	}
+	return cli.stream("POST", "/manifests/"+cmd.Arg(0)+"/push?"+v.Encode(), body, cli.out)
+}
+
+// 'docker network create|ls|rm|inspect' manages the networks containers
+// can be attached to with 'docker run -net'
+func (cli *DockerCli) CmdNetwork(args ...string) error {
+	cmd := Subcmd("network", "create|ls|rm|inspect|connect [OPTIONS] [NETWORK...]", "Manage the networks")
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return cli.networkCreate(args[1:]...)
+		case "ls":
+			return cli.networkList(args[1:]...)
+		case "rm":
+			return cli.networkRemove(args[1:]...)
+		case "inspect":
+			return cli.networkInspect(args[1:]...)
+		case "connect":
+			return cli.networkConnect(args[1:]...)
+		}
+	}
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	cmd.Usage()
+	return nil
+}
+
+func (cli *DockerCli) networkCreate(args ...string) error {
+	cmd := Subcmd("network create", "[OPTIONS] NETWORK", "Create a network")
+	driver := cmd.String("driver", "", "Driver of the network: bridge or macvlan")
+	subnet := cmd.String("subnet", "", "Subnet of the network in CIDR format (e.g. 10.5.0.0/24)")
+	bridge := cmd.String("bridge", "", "Bridge interface to use, created if it doesn't exist")
+	var opts ListOpts
+	cmd.Var(&opts, "o", "Set a driver specific option (e.g. -o parent=eth0)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("name", cmd.Arg(0))
+	v.Set("driver", *driver)
+	v.Set("subnet", *subnet)
+	v.Set("bridge", *bridge)
+	for _, opt := range opts {
+		v.Add("opt", opt)
+	}
+	if _, _, err := cli.call("POST", "/networks/create?"+v.Encode(), nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s\n", cmd.Arg(0))
+	return nil
+}
+
+func (cli *DockerCli) networkConnect(args ...string) error {
+	cmd := Subcmd("network connect", "[OPTIONS] NETWORK CONTAINER", "Connect a container to a network, a running one can only get new aliases on its network")
+	var aliases ListOpts
+	cmd.Var(&aliases, "alias", "Add an alias of the container in the DNS of the network")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("container", cmd.Arg(1))
+	for _, alias := range aliases {
+		v.Add("alias", alias)
+	}
+	if _, _, err := cli.call("POST", "/networks/"+cmd.Arg(0)+"/connect?"+v.Encode(), nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) networkList(args ...string) error {
+	cmd := Subcmd("network ls", "[OPTIONS]", "List networks")
+	quiet := cmd.Bool("q", false, "only show names")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	body, _, err := cli.call("GET", "/networks/json", nil)
+	if err != nil {
+		return err
+	}
+	var outs []APINetwork
+	if err := json.Unmarshal(body, &outs); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintln(w, "NAME\tDRIVER\tBRIDGE\tSUBNET\tCONTAINERS")
+	}
+	for _, out := range outs {
+		if *quiet {
+			fmt.Fprintln(w, out.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", out.Name, out.Driver, out.Bridge, out.Subnet, len(out.Containers))
+	}
+	w.Flush()
+	return nil
+}
+
+func (cli *DockerCli) networkRemove(args ...string) error {
+	cmd := Subcmd("network rm", "NETWORK [NETWORK...]", "Remove one or more networks")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	for _, name := range cmd.Args() {
+		if _, _, err := cli.call("DELETE", "/networks/"+name, nil); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return nil
+}
+
+func (cli *DockerCli) networkInspect(args ...string) error {
+	cmd := Subcmd("network inspect", "NETWORK [NETWORK...]", "Return low-level information on a network")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	fmt.Fprintf(cli.out, "[")
+	for i, name := range cmd.Args() {
+		if i > 0 {
+			fmt.Fprintf(cli.out, ",")
+		}
+		obj, _, err := cli.call("GET", "/networks/"+name+"/json", nil)
+		if err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			continue
+		}
+		indented := new(bytes.Buffer)
+		if err := json.Indent(indented, obj, "", "    "); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			continue
+		}
+		if _, err := io.Copy(cli.out, indented); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		}
+	}
+	fmt.Fprintf(cli.out, "]")
+	return nil
+}
+
+func (cli *DockerCli) CmdVolume(args ...string) error {
+	cmd := Subcmd("volume", "create|ls|rm|inspect|prune [OPTIONS] [VOLUME...]", "Manage the volumes")
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return cli.volumeCreate(args[1:]...)
+		case "ls":
+			return cli.volumeList(args[1:]...)
+		case "rm":
+			return cli.volumeRemove(args[1:]...)
+		case "inspect":
+			return cli.volumeInspect(args[1:]...)
+		case "prune":
+			return cli.volumePrune(args[1:]...)
+		}
+	}
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	cmd.Usage()
+	return nil
+}
+
+func (cli *DockerCli) volumeCreate(args ...string) error {
+	cmd := Subcmd("volume create", "[OPTIONS]", "Create a volume, to mount with -v VOLUME:/path")
+	name := cmd.String("name", "", "Name of the volume, a random one if empty")
+	driver := cmd.String("driver", "", "Volume driver of the volume (local by default)")
+	var opts ListOpts
+	cmd.Var(&opts, "o", "Set a driver specific option")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("name", *name)
+	v.Set("driver", *driver)
+	for _, opt := range opts {
+		v.Add("opt", opt)
+	}
+	body, _, err := cli.call("POST", "/volumes/create?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	out := &APIVolume{}
+	if err := json.Unmarshal(body, out); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s\n", out.Name)
+	return nil
+}
+
+func (cli *DockerCli) volumeList(args ...string) error {
+	cmd := Subcmd("volume ls", "[OPTIONS]", "List volumes")
+	quiet := cmd.Bool("q", false, "only show names")
+	dangling := cmd.Bool("dangling", false, "only show the volumes no container uses, like -filter dangling=true")
+	noTrunc := cmd.Bool("notrunc", false, "Don't truncate the IDs of the volumes created for the containers")
+	var flFilters ListOpts
+	cmd.Var(&flFilters, "filter", "Only show the volumes matching the filter: dangling=true|false, driver=NAME or name=PREFIX")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	filters := VolumeFilters{}
+	if *dangling {
+		filters["dangling"] = []string{"true"}
+	}
+	for _, filter := range flFilters {
+		parts := strings.SplitN(filter, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid filter: %s (NAME=VALUE)", filter)
+		}
+		filters[parts[0]] = append(filters[parts[0]], parts[1])
+	}
+	v := url.Values{}
+	if len(filters) > 0 {
+		b, err := json.Marshal(filters)
+		if err != nil {
+			return err
+		}
+		v.Set("filters", string(b))
+	}
+	body, _, err := cli.call("GET", "/volumes/json?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var outs []APIVolume
+	if err := json.Unmarshal(body, &outs); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintln(w, "NAME\tDRIVER\tCREATED\tCONTAINERS\tMOUNTPOINT")
+	}
+	for _, out := range outs {
+		if *quiet {
+			fmt.Fprintln(w, out.Name)
+			continue
+		}
+		name := out.Name
+		if out.Anonymous && !*noTrunc {
+			name = utils.TruncateID(name)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s ago\t%d\t%s\n", name, out.Driver, utils.HumanDuration(time.Now().Sub(time.Unix(out.Created, 0))), len(out.Containers), out.Mountpoint)
+	}
+	w.Flush()
+	return nil
+}
+
+func (cli *DockerCli) volumeRemove(args ...string) error {
+	cmd := Subcmd("volume rm", "VOLUME [VOLUME...]", "Remove one or more volumes no container uses")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	for _, name := range cmd.Args() {
+		if _, _, err := cli.call("DELETE", "/volumes/"+name, nil); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return nil
+}
+
+func (cli *DockerCli) volumePrune(args ...string) error {
+	cmd := Subcmd("volume prune", "[OPTIONS]", "Remove all the volumes no container uses")
+	force := cmd.Bool("f", false, "Don't ask for confirmation")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	if !*force {
+		fmt.Fprintf(cli.out, "This removes all the volumes no container uses, and their data. Continue? [y/N] ")
+		answer, _ := bufio.NewReader(cli.in).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return nil
+		}
+	}
+	body, _, err := cli.call("POST", "/volumes/prune", nil)
+	if err != nil {
+		return err
+	}
+	out := &APIVolumesPrune{}
+	if err := json.Unmarshal(body, out); err != nil {
+		return err
+	}
+	for _, name := range out.VolumesDeleted {
+		fmt.Fprintf(cli.out, "%s\n", name)
+	}
+	fmt.Fprintf(cli.out, "Reclaimed %s\n", utils.HumanSize(out.SpaceReclaimed))
+	return nil
+}
+
+func (cli *DockerCli) volumeInspect(args ...string) error {
+	cmd := Subcmd("volume inspect", "VOLUME [VOLUME...]", "Return low-level information on a volume, with the size of its data")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	fmt.Fprintf(cli.out, "[")
+	for i, name := range cmd.Args() {
+		if i > 0 {
+			fmt.Fprintf(cli.out, ",")
+		}
+		obj, _, err := cli.call("GET", "/volumes/"+name+"/json", nil)
+		if err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			continue
+		}
+		indented := new(bytes.Buffer)
+		if err := json.Indent(indented, obj, "", "    "); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			continue
+		}
+		if _, err := io.Copy(cli.out, indented); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		}
+	}
+	fmt.Fprintf(cli.out, "]")
+	return nil
+}
+
 func (cli *DockerCli) CmdPort(args ...string) error {
 	cmd := Subcmd("port", "CONTAINER PRIVATE_PORT", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT")
 	if err := cmd.Parse(args); err != nil {
@@ -724,7 +1320,8 @@ func (cli *DockerCli) CmdRmi(args ...string) error {
 }
 
 func (cli *DockerCli) CmdHistory(args ...string) error {
-	cmd := Subcmd("history", "IMAGE", "Show the history of an image")
+	cmd := Subcmd("history", "[OPTIONS] IMAGE", "Show the history of an image")
+	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -744,13 +1341,19 @@ func (cli *DockerCli) CmdHistory(args ...string) error {
 		return err
 	}
 	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
-	fmt.Fprintln(w, "ID\tCREATED\tCREATED BY")
+	fmt.Fprintln(w, "ID\tCREATED\tCREATED BY\tSIZE")
 
 	for _, out := range outs {
+		createdBy := out.CreatedBy
 		if out.Tags != nil {
 			out.ID = out.Tags[0]
+		} else if !*noTrunc {
+			out.ID = utils.TruncateID(out.ID)
 		}
-		fmt.Fprintf(w, "%s \t%s ago\t%s\n", out.ID, utils.HumanDuration(time.Now().Sub(time.Unix(out.Created, 0))), out.CreatedBy)
+		if !*noTrunc && len(createdBy) > 45 {
+			createdBy = createdBy[:42] + "..."
+		}
+		fmt.Fprintf(w, "%s \t%s ago\t%s\t%s\n", out.ID, utils.HumanDuration(time.Now().Sub(time.Unix(out.Created, 0))), createdBy, utils.HumanSize(out.Size))
 	}
 	w.Flush()
 	return nil
@@ -803,8 +1406,99 @@ func (cli *DockerCli) CmdKill(args ...string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdPause(args ...string) error {
+	cmd := Subcmd("pause", "CONTAINER [CONTAINER...]", "Pause all the processes of a running container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	for _, name := range cmd.Args() {
+		if _, _, err := cli.call("POST", "/containers/"+name+"/pause", nil); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdUnpause(args ...string) error {
+	cmd := Subcmd("unpause", "CONTAINER [CONTAINER...]", "Unpause the processes of a paused container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	for _, name := range cmd.Args() {
+		if _, _, err := cli.call("POST", "/containers/"+name+"/unpause", nil); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdRename(args ...string) error {
+	cmd := Subcmd("rename", "CONTAINER NAME", "Rename a container: change its hostname, the name it's known by on its network")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+
+	v := url.Values{}
+	v.Set("name", cmd.Arg(1))
+	if _, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/rename?"+v.Encode(), nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdUpdate(args ...string) error {
+	cmd := Subcmd("update", "[OPTIONS] CONTAINER [CONTAINER...]", "Update the resources of one or more containers, running ones included")
+	flMemory := cmd.Int64("m", 0, "Memory limit (in bytes)")
+	flCpuShares := cmd.Int64("c", 0, "CPU shares (relative weight)")
+	flCpuset := cmd.String("cpuset-cpus", "", "CPUs the container can run on (e.g. 0-3 or 0,2)")
+	cmd.StringVar(flCpuset, "cpuset", "", "Deprecated, use -cpuset-cpus")
+	flCpusetMems := cmd.String("cpuset-mems", "", "Memory nodes (NUMA) the container can allocate on (e.g. 0-1)")
+	flCpuPeriod := cmd.Int64("cpu-period", 0, "Period of the CPU quota, in microseconds")
+	flCpuQuota := cmd.Int64("cpu-quota", 0, "CPU time the container can use in each period, in microseconds (-1 for no quota)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	update := &UpdateConfig{Memory: *flMemory, CpuShares: *flCpuShares, Cpuset: *flCpuset, CpusetMems: *flCpusetMems, CpuPeriod: *flCpuPeriod, CpuQuota: *flCpuQuota}
+	if *update == (UpdateConfig{}) {
+		return fmt.Errorf("Nothing to update, use -m, -c, -cpuset-cpus, -cpuset-mems, -cpu-period or -cpu-quota")
+	}
+
+	for _, name := range cmd.Args() {
+		if _, _, err := cli.call("POST", "/containers/"+name+"/update", update); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return nil
+}
+
 func (cli *DockerCli) CmdImport(args ...string) error {
-	cmd := Subcmd("import", "URL|- [REPOSITORY [TAG]]", "Create a new filesystem image from the contents of a tarball(.tar, .tar.gz, .tgz, .bzip, .tar.xz, .txz).")
+	cmd := Subcmd("import", "[OPTIONS] URL|- [REPOSITORY [TAG]]", "Create a new filesystem image from the contents of a tarball(.tar, .tar.gz, .tgz, .bzip, .tar.xz, .txz).")
+	var flChanges ListOpts
+	cmd.Var(&flChanges, "change", "Apply a Dockerfile instruction to the config of the image: CMD, ENTRYPOINT, ENV, EXPOSE or LABEL")
 
 	if err := cmd.Parse(args); err != nil {
 		return nil
@@ -818,6 +1512,9 @@ func (cli *DockerCli) CmdImport(args ...string) error {
 	v.Set("repo", repository)
 	v.Set("tag", tag)
 	v.Set("fromSrc", src)
+	for _, change := range flChanges {
+		v.Add("changes", change)
+	}
 
 	err := cli.stream("POST", "/images/create?"+v.Encode(), cli.in, cli.out)
 	if err != nil {
@@ -826,6 +1523,38 @@ func (cli *DockerCli) CmdImport(args ...string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdSave(args ...string) error {
+	cmd := Subcmd("save", "IMAGE", "Save an image with its parents and tags to a tar archive (streamed to stdout)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	if err := cli.stream("GET", "/images/"+cmd.Arg(0)+"/get", nil, cli.out); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdLoad(args ...string) error {
+	cmd := Subcmd("load", "", "Load an image with its parents and tags from a tar archive on stdin")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
+	}
+
+	if err := cli.stream("POST", "/images/load", cli.in, cli.out); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (cli *DockerCli) CmdPush(args ...string) error {
 	cmd := Subcmd("push", "NAME", "Push an image or a repository to the registry")
 	if err := cmd.Parse(args); err != nil {
@@ -848,7 +1577,11 @@ func (cli *DockerCli) CmdPush(args ...string) error {
 
 	v := url.Values{}
 	push := func() error {
-		buf, err := json.Marshal(cli.configFile.Configs[auth.IndexServerAddress()])
+		authConfig, err := cli.configFile.ResolveAuthConfig(auth.IndexServerAddress())
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(authConfig)
 		if err != nil {
 			return err
 		}
@@ -862,38 +1595,182 @@ func (cli *DockerCli) CmdPush(args ...string) error {
 			if err := cli.CmdLogin(""); err != nil {
 				return err
 			}
-			return push()
+			return push()
+		}
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdPull(args ...string) error {
+	cmd := Subcmd("pull", "NAME", "Pull an image or a repository from the registry")
+	tag := cmd.String("t", "", "Download tagged image in repository")
+	lazy := cmd.Bool("lazy", false, "Defer the download of the layers of the image until it's first used, from a v2 registry")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	remote, parsedTag := utils.ParseRepositoryTag(cmd.Arg(0))
+	if *tag == "" {
+		*tag = parsedTag
+	}
+
+	v := url.Values{}
+	v.Set("fromImage", remote)
+	v.Set("tag", *tag)
+	if *lazy {
+		v.Set("lazy", "1")
+	}
+
+	// The credentials of the registry of the image let the daemon pull the
+	// private repositories, none are sent without them
+	authConfig, err := cli.registryAuthConfig(remote)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if authConfig.Username != "" || authConfig.Password != "" {
+		buf, err := json.Marshal(authConfig)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewBuffer(buf)
+	}
+	if err := cli.stream("POST", "/images/create?"+v.Encode(), body, cli.out); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// The credentials of the registry of the repository name: the ones of the
+// index unless it starts with the hostname of a registry, kept under the
+// hostname or under its endpoint
+func (cli *DockerCli) registryAuthConfig(name string) (auth.AuthConfig, error) {
+	nameParts := strings.SplitN(name, "/", 2)
+	if len(nameParts) == 1 || (!strings.Contains(nameParts[0], ".") && !strings.Contains(nameParts[0], ":") && nameParts[0] != "localhost") {
+		return cli.configFile.ResolveAuthConfig(auth.IndexServerAddress())
+	}
+	hostname := nameParts[0]
+	servers := []string{"https://" + hostname + "/v1/", "http://" + hostname + "/v1/", "https://" + hostname, hostname}
+	for _, server := range servers {
+		if _, exists := cli.configFile.Configs[server]; exists {
+			return cli.configFile.ResolveAuthConfig(server)
+		}
+	}
+	// The credential helper may have them without the config file
+	return cli.configFile.ResolveAuthConfig(hostname)
+}
+
+func (cli *DockerCli) CmdSystem(args ...string) error {
+	cmd := Subcmd("system", "df [OPTIONS]", "Show the disk usage of docker")
+	if len(args) > 0 {
+		switch args[0] {
+		case "df":
+			return cli.systemDF(args[1:]...)
+		}
+	}
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	cmd.Usage()
+	return nil
+}
+
+func (cli *DockerCli) systemDF(args ...string) error {
+	cmd := Subcmd("system df", "[OPTIONS]", "Show the disk usage of the images, containers, volumes and build cache")
+	verbose := cmd.Bool("v", false, "Show the disk usage of each of them")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	if *verbose {
+		v.Set("verbose", "1")
+	}
+	body, _, err := cli.call("GET", "/system/df?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	out := &APISystemDF{}
+	if err := json.Unmarshal(body, out); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE")
+	for _, usage := range out.Usage {
+		reclaimable := utils.HumanSize(usage.Reclaimable)
+		if usage.Size > 0 {
+			reclaimable += fmt.Sprintf(" (%d%%)", usage.Reclaimable*100/usage.Size)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", usage.Type, usage.Total, usage.Active, utils.HumanSize(usage.Size), reclaimable)
+	}
+	if *verbose {
+		fmt.Fprintln(w, "\nTYPE\tID\tNAME\tSIZE\tACTIVE")
+		for _, object := range out.Objects {
+			id := object.ID
+			if object.Type != "Volume" {
+				id = utils.TruncateID(id)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", object.Type, id, object.Name, utils.HumanSize(object.Size), object.Active)
 		}
-		return err
 	}
+	w.Flush()
 	return nil
 }
 
-func (cli *DockerCli) CmdPull(args ...string) error {
-	cmd := Subcmd("pull", "NAME", "Pull an image or a repository from the registry")
-	tag := cmd.String("t", "", "Download tagged image in repository")
+func (cli *DockerCli) CmdImage(args ...string) error {
+	cmd := Subcmd("image", "prune [OPTIONS]", "Manage the images")
+	if len(args) > 0 {
+		switch args[0] {
+		case "prune":
+			return cli.imagePrune(args[1:]...)
+		}
+	}
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
+	cmd.Usage()
+	return nil
+}
 
-	if cmd.NArg() != 1 {
+func (cli *DockerCli) imagePrune(args ...string) error {
+	cmd := Subcmd("image prune", "[OPTIONS]", "Remove the images no tag or container references")
+	force := cmd.Bool("f", false, "Don't ask for confirmation")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
 		cmd.Usage()
 		return nil
 	}
-
-	remote, parsedTag := utils.ParseRepositoryTag(cmd.Arg(0))
-	if *tag == "" {
-		*tag = parsedTag
+	if !*force {
+		fmt.Fprintf(cli.out, "This removes all the dangling images no container uses. Continue? [y/N] ")
+		answer, _ := bufio.NewReader(cli.in).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return nil
+		}
 	}
-
-	v := url.Values{}
-	v.Set("fromImage", remote)
-	v.Set("tag", *tag)
-
-	if err := cli.stream("POST", "/images/create?"+v.Encode(), nil, cli.out); err != nil {
+	body, _, err := cli.call("POST", "/images/prune", nil)
+	if err != nil {
 		return err
 	}
-
+	out := &APIImagesPrune{}
+	if err := json.Unmarshal(body, out); err != nil {
+		return err
+	}
+	for _, id := range out.ImagesDeleted {
+		fmt.Fprintf(cli.out, "Deleted: %s\n", utils.TruncateID(id))
+	}
+	fmt.Fprintf(cli.out, "Reclaimed %s\n", utils.HumanSize(out.SpaceReclaimed))
 	return nil
 }
 
@@ -903,6 +1780,8 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 	all := cmd.Bool("a", false, "show all images")
 	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
 	flViz := cmd.Bool("viz", false, "output graph in graphviz format")
+	var flFilters ListOpts
+	cmd.Var(&flFilters, "filter", "Only show the images matching the filter: dangling=true|false")
 
 	if err := cmd.Parse(args); err != nil {
 		return nil
@@ -911,6 +1790,14 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	filters := ImageFilters{}
+	for _, filter := range flFilters {
+		parts := strings.SplitN(filter, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid filter: %s (NAME=VALUE)", filter)
+		}
+		filters[parts[0]] = append(filters[parts[0]], parts[1])
+	}
 
 	if *flViz {
 		body, _, err := cli.call("GET", "/images/viz", false)
@@ -926,6 +1813,13 @@ func (cli *DockerCli) CmdImages(args ...string) error {
 		if *all {
 			v.Set("all", "1")
 		}
+		if len(filters) > 0 {
+			b, err := json.Marshal(filters)
+			if err != nil {
+				return err
+			}
+			v.Set("filters", string(b))
+		}
 
 		body, _, err := cli.call("GET", "/images/json?"+v.Encode(), nil)
 		if err != nil {
@@ -1070,6 +1964,8 @@ func (cli *DockerCli) CmdCommit(args ...string) error {
 	flComment := cmd.String("m", "", "Commit message")
 	flAuthor := cmd.String("author", "", "Author (eg. \"John Hannibal Smith <hannibal@a-team.com>\"")
 	flConfig := cmd.String("run", "", "Config automatically applied when the image is run. "+`(ex: {"Cmd": ["cat", "/world"], "PortSpecs": ["22"]}')`)
+	var flChanges ListOpts
+	cmd.Var(&flChanges, "change", "Apply a Dockerfile instruction to the config of the image: CMD, ENTRYPOINT, ENV, EXPOSE or LABEL")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1085,6 +1981,9 @@ func (cli *DockerCli) CmdCommit(args ...string) error {
 	v.Set("tag", tag)
 	v.Set("comment", *flComment)
 	v.Set("author", *flAuthor)
+	for _, change := range flChanges {
+		v.Add("changes", change)
+	}
 	var config *Config
 	if *flConfig != "" {
 		config = &Config{}
@@ -1110,6 +2009,9 @@ func (cli *DockerCli) CmdCommit(args ...string) error {
 func (cli *DockerCli) CmdEvents(args ...string) error {
 	cmd := Subcmd("events", "[OPTIONS]", "Get real time events from the server")
 	since := cmd.String("since", "", "Show events previously created (used for polling).")
+	until := cmd.String("until", "", "Stop streaming the events after this timestamp.")
+	var flFilters ListOpts
+	cmd.Var(&flFilters, "filter", "Only show the events matching the filter: event=start, container=NAME or image=NAME")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1123,6 +2025,24 @@ func (cli *DockerCli) CmdEvents(args ...string) error {
 	if *since != "" {
 		v.Set("since", *since)
 	}
+	if *until != "" {
+		v.Set("until", *until)
+	}
+	if len(flFilters) > 0 {
+		filters := EventFilters{}
+		for _, filter := range flFilters {
+			parts := strings.SplitN(filter, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid filter: %s (NAME=VALUE)", filter)
+			}
+			filters[parts[0]] = append(filters[parts[0]], parts[1])
+		}
+		b, err := json.Marshal(filters)
+		if err != nil {
+			return err
+		}
+		v.Set("filters", string(b))
+	}
 
 	if err := cli.stream("GET", "/events?"+v.Encode(), nil, cli.out); err != nil {
 		return err
@@ -1130,6 +2050,108 @@ func (cli *DockerCli) CmdEvents(args ...string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdStats(args ...string) error {
+	cmd := Subcmd("stats", "[OPTIONS] CONTAINER [CONTAINER...]", "Display a live stream of the resource usage of containers")
+	noStream := cmd.Bool("no-stream", false, "Print the first sample and exit")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	var lock sync.Mutex
+	samples := make(map[string]*ContainerStats)
+	done := make(chan string)
+	v := url.Values{}
+	v.Set("stream", strconv.FormatBool(!*noStream))
+	for _, name := range cmd.Args() {
+		go func(name string) {
+			defer func() { done <- name }()
+			body, _, err := cli.openStream("GET", "/containers/"+name+"/stats?"+v.Encode(), nil)
+			if err != nil {
+				fmt.Fprintf(cli.err, "%s: %s\n", name, err)
+				return
+			}
+			defer body.Close()
+			decoder := json.NewDecoder(body)
+			for {
+				stats := &ContainerStats{}
+				if err := decoder.Decode(stats); err != nil {
+					if err != io.EOF {
+						fmt.Fprintf(cli.err, "%s: %s\n", name, err)
+					}
+					return
+				}
+				lock.Lock()
+				samples[name] = stats
+				lock.Unlock()
+			}
+		}(name)
+	}
+
+	display := func(names []string) {
+		w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+		fmt.Fprint(w, "CONTAINER\tCPU %\tMEM USAGE / LIMIT\tMEM %\tNET I/O\tBLOCK I/O\n")
+		lock.Lock()
+		for _, name := range names {
+			stats, exists := samples[name]
+			if !exists {
+				continue
+			}
+			var rx, tx uint64
+			for _, network := range stats.Networks {
+				rx += network.RxBytes
+				tx += network.TxBytes
+			}
+			memPercent := 0.0
+			if stats.Memory.Limit > 0 {
+				memPercent = float64(stats.Memory.Usage) / float64(stats.Memory.Limit) * 100
+			}
+			fmt.Fprintf(w, "%s\t%.2f%%\t%s / %s\t%.2f%%\t%s / %s\t%s / %s\n", name, stats.CPUPercent(),
+				utils.HumanSize(int64(stats.Memory.Usage)), utils.HumanSize(int64(stats.Memory.Limit)), memPercent,
+				utils.HumanSize(int64(rx)), utils.HumanSize(int64(tx)),
+				utils.HumanSize(int64(stats.Blkio.ReadBytes)), utils.HumanSize(int64(stats.Blkio.WriteBytes)))
+		}
+		lock.Unlock()
+		w.Flush()
+	}
+
+	// The containers still streaming their stats, in the order they were given
+	running := cmd.Args()
+	for len(running) > 0 {
+		select {
+		case name := <-done:
+			for i, n := range running {
+				if n == name {
+					running = append(running[:i], running[i+1:]...)
+					break
+				}
+			}
+			if *noStream {
+				continue
+			}
+			lock.Lock()
+			delete(samples, name)
+			lock.Unlock()
+		case <-time.After(time.Second):
+			if *noStream {
+				continue
+			}
+		}
+		if cli.isTerminal {
+			// Clear the screen
+			fmt.Fprint(cli.out, "\033[2J\033[H")
+		}
+		display(running)
+	}
+	if *noStream {
+		display(cmd.Args())
+	}
+	return nil
+}
+
 func (cli *DockerCli) CmdExport(args ...string) error {
 	cmd := Subcmd("export", "CONTAINER", "Export the contents of a filesystem as a tar archive")
 	if err := cmd.Parse(args); err != nil {
@@ -1174,7 +2196,11 @@ func (cli *DockerCli) CmdDiff(args ...string) error {
 }
 
 func (cli *DockerCli) CmdLogs(args ...string) error {
-	cmd := Subcmd("logs", "CONTAINER", "Fetch the logs of a container")
+	cmd := Subcmd("logs", "[OPTIONS] CONTAINER", "Fetch the logs of a container")
+	since := cmd.String("since", "", "Show the logs written from a unix timestamp or a RFC3339 date")
+	until := cmd.String("until", "", "Show the logs written up to a unix timestamp or a RFC3339 date")
+	tail := cmd.String("tail", "all", "Show the last lines of the logs")
+	timestamps := cmd.Bool("t", false, "Show the time each line was written")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1183,14 +2209,30 @@ func (cli *DockerCli) CmdLogs(args ...string) error {
 		return nil
 	}
 
-	if err := cli.hijack("POST", "/containers/"+cmd.Arg(0)+"/attach?logs=1&stdout=1&stderr=1", false, nil, cli.out); err != nil {
+	v := url.Values{}
+	v.Set("stdout", "1")
+	v.Set("stderr", "1")
+	if *since != "" {
+		v.Set("since", *since)
+	}
+	if *until != "" {
+		v.Set("until", *until)
+	}
+	if *tail != "all" {
+		v.Set("tail", *tail)
+	}
+	if *timestamps {
+		v.Set("timestamps", "1")
+	}
+	if err := cli.stream("GET", "/containers/"+cmd.Arg(0)+"/logs?"+v.Encode(), nil, cli.out); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (cli *DockerCli) CmdAttach(args ...string) error {
-	cmd := Subcmd("attach", "CONTAINER", "Attach to a running container")
+	cmd := Subcmd("attach", "[OPTIONS] CONTAINER", "Attach to a running container")
+	flDetachKeys := cmd.String("detach-keys", "", "Override the key sequence to detach from a container with a tty ("+utils.DefaultDetachKeys+" by default)")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1198,6 +2240,10 @@ func (cli *DockerCli) CmdAttach(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	detachKeys, err := cli.detachKeys(*flDetachKeys)
+	if err != nil {
+		return err
+	}
 
 	body, _, err := cli.call("GET", "/containers/"+cmd.Arg(0)+"/json", nil)
 	if err != nil {
@@ -1215,7 +2261,7 @@ func (cli *DockerCli) CmdAttach(args ...string) error {
 	}
 
 	if container.Config.Tty {
-		if err := cli.monitorTtySize(cmd.Arg(0)); err != nil {
+		if err := cli.monitorTtySize("/containers/" + cmd.Arg(0)); err != nil {
 			return err
 		}
 	}
@@ -1225,16 +2271,103 @@ func (cli *DockerCli) CmdAttach(args ...string) error {
 	v.Set("stdin", "1")
 	v.Set("stdout", "1")
 	v.Set("stderr", "1")
+	if detachKeys != "" {
+		v.Set("detachKeys", detachKeys)
+	}
+
+	// Without a tty, stdout and stderr are multiplexed to be told apart
+	var stderr io.Writer
+	if !container.Config.Tty {
+		v.Set("multiplex", "1")
+		stderr = cli.err
+	}
+
+	if err := cli.hijack("POST", "/containers/"+cmd.Arg(0)+"/attach?"+v.Encode(), container.Config.Tty, cli.in, cli.out, stderr); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdExec(args ...string) error {
+	cmd := Subcmd("exec", "[OPTIONS] CONTAINER COMMAND [ARG...]", "Run a command in a running container")
+	flStdin := cmd.Bool("i", false, "Attach stdin")
+	flTty := cmd.Bool("t", false, "Allocate a pseudo-tty")
+	flDetach := cmd.Bool("d", false, "Detached mode: Run the command in the background")
+	flUser := cmd.String("u", "", "Username or UID, the user of the container by default")
+	flWorkingDir := cmd.String("w", "", "Working directory, the one of the container by default")
+	var flEnv ListOpts
+	cmd.Var(&flEnv, "e", "Set environment variables")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 2 {
+		cmd.Usage()
+		return nil
+	}
+	if *flDetach && *flStdin {
+		return fmt.Errorf("Conflicting options: -i and -d")
+	}
+
+	config := &ExecConfig{
+		User:         *flUser,
+		Tty:          *flTty,
+		AttachStdin:  *flStdin,
+		AttachStdout: !*flDetach,
+		AttachStderr: !*flDetach,
+		Env:          flEnv,
+		WorkingDir:   *flWorkingDir,
+		Cmd:          cmd.Args()[1:],
+	}
+	body, _, err := cli.call("POST", "/containers/"+cmd.Arg(0)+"/exec", config)
+	if err != nil {
+		return err
+	}
+	apiID := &APIID{}
+	if err := json.Unmarshal(body, apiID); err != nil {
+		return err
+	}
 
-	if err := cli.hijack("POST", "/containers/"+cmd.Arg(0)+"/attach?"+v.Encode(), container.Config.Tty, cli.in, cli.out); err != nil {
+	if *flDetach {
+		if _, _, err := cli.call("POST", "/exec/"+apiID.ID+"/start", nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(cli.out, "%s\n", apiID.ID)
+		return nil
+	}
+
+	if config.Tty {
+		if err := cli.monitorTtySize("/exec/" + apiID.ID); err != nil {
+			utils.Debugf("Error monitoring TTY size: %s\n", err)
+		}
+	}
+	var in io.ReadCloser
+	if config.AttachStdin {
+		in = cli.in
+	}
+	if err := cli.hijack("POST", "/exec/"+apiID.ID+"/start", config.Tty, in, cli.out, nil); err != nil {
 		return err
 	}
+
+	body, _, err = cli.call("GET", "/exec/"+apiID.ID+"/json", nil)
+	if err != nil {
+		return err
+	}
+	e := &APIExec{}
+	if err := json.Unmarshal(body, e); err != nil {
+		return err
+	}
+	if e.ExitCode != 0 {
+		return fmt.Errorf("The command exited with status %d", e.ExitCode)
+	}
 	return nil
 }
 
 func (cli *DockerCli) CmdSearch(args ...string) error {
-	cmd := Subcmd("search", "NAME", "Search the docker index for images")
+	cmd := Subcmd("search", "[OPTIONS] NAME", "Search the docker index for images")
 	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
+	limit := cmd.Int("limit", DefaultSearchLimit, fmt.Sprintf("Show at most this many results (up to %d)", MaxSearchLimit))
+	var flFilters ListOpts
+	cmd.Var(&flFilters, "filter", "Only show the images matching the filter: is-official=true|false, is-automated=true|false or stars=MIN")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1242,9 +2375,25 @@ func (cli *DockerCli) CmdSearch(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	filters := SearchFilters{}
+	for _, filter := range flFilters {
+		parts := strings.SplitN(filter, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid filter: %s (NAME=VALUE)", filter)
+		}
+		filters[parts[0]] = append(filters[parts[0]], parts[1])
+	}
 
 	v := url.Values{}
 	v.Set("term", cmd.Arg(0))
+	v.Set("limit", strconv.Itoa(*limit))
+	if len(filters) > 0 {
+		b, err := json.Marshal(filters)
+		if err != nil {
+			return err
+		}
+		v.Set("filters", string(b))
+	}
 	body, _, err := cli.call("GET", "/images/search?"+v.Encode(), nil)
 	if err != nil {
 		return err
@@ -1256,13 +2405,16 @@ func (cli *DockerCli) CmdSearch(args ...string) error {
 		return err
 	}
 	fmt.Fprintf(cli.out, "Found %d results matching your query (\"%s\")\n", len(outs), cmd.Arg(0))
-	w := tabwriter.NewWriter(cli.out, 33, 1, 3, ' ', 0)
-	fmt.Fprintf(w, "NAME\tDESCRIPTION\n")
+	w := tabwriter.NewWriter(cli.out, 10, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "NAME\tDESCRIPTION\tSTARS\tOFFICIAL\tAUTOMATED\n")
 	_, width := cli.getTtySize()
 	if width == 0 {
 		width = 45
 	} else {
-		width = width - 33 //remote the first column
+		width = width - 33 - 30 //remove the name, stars, official and automated columns
+	}
+	if width < 20 {
+		width = 20
 	}
 	for _, out := range outs {
 		desc := strings.Replace(out.Description, "\n", " ", -1)
@@ -1270,7 +2422,14 @@ func (cli *DockerCli) CmdSearch(args ...string) error {
 		if !*noTrunc && len(desc) > width {
 			desc = utils.Trunc(desc, width-3) + "..."
 		}
-		fmt.Fprintf(w, "%s\t%s\n", out.Name, desc)
+		official, automated := "", ""
+		if out.IsOfficial {
+			official = "[OK]"
+		}
+		if out.IsAutomated {
+			automated = "[OK]"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", out.Name, desc, out.StarCount, official, automated)
 	}
 	w.Flush()
 	return nil
@@ -1349,21 +2508,54 @@ func (opts PathOpts) Set(val string) error {
 	return nil
 }
 
-func (cli *DockerCli) CmdTag(args ...string) error {
-	cmd := Subcmd("tag", "[OPTIONS] IMAGE REPOSITORY [TAG]", "Tag an image into a repository")
-	force := cmd.Bool("f", false, "Force")
+func (cli *DockerCli) CmdSquash(args ...string) error {
+	cmd := Subcmd("squash", "[OPTIONS] IMAGE [REPOSITORY [TAG]]", "Squash the layers of an image into one")
+	flParent := cmd.String("parent", "", "Only squash the layers above this parent of the image")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	if cmd.NArg() != 2 && cmd.NArg() != 3 {
+	if cmd.NArg() < 1 || cmd.NArg() > 3 {
 		cmd.Usage()
 		return nil
 	}
 
 	v := url.Values{}
+	v.Set("parent", *flParent)
 	v.Set("repo", cmd.Arg(1))
+	v.Set("tag", cmd.Arg(2))
+	body, _, err := cli.call("POST", "/images/"+cmd.Arg(0)+"/squash?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	apiID := &APIID{}
+	if err := json.Unmarshal(body, apiID); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s\n", apiID.ID)
+	return nil
+}
+
+func (cli *DockerCli) CmdTag(args ...string) error {
+	cmd := Subcmd("tag", "[OPTIONS] IMAGE REPOSITORY[:TAG]", "Tag an image into a repository")
+	force := cmd.Bool("f", false, "Force, move the tag if it's already set to another image")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 && cmd.NArg() != 3 {
+		cmd.Usage()
+		return nil
+	}
+
+	// The tag can also be given separately: docker tag IMAGE REPOSITORY TAG
+	repository, tag := utils.ParseRepositoryTag(cmd.Arg(1))
 	if cmd.NArg() == 3 {
-		v.Set("tag", cmd.Arg(2))
+		tag = cmd.Arg(2)
+	}
+	v := url.Values{}
+	v.Set("repo", repository)
+	if tag != "" {
+		v.Set("tag", tag)
 	}
 
 	if *force {
@@ -1385,6 +2577,10 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 		cmd.Usage()
 		return nil
 	}
+	detachKeys, err := cli.detachKeys(cmd.Lookup("detach-keys").Value.String())
+	if err != nil {
+		return err
+	}
 
 	var containerIDFile *os.File
 	if len(hostConfig.ContainerIDFile) > 0 {
@@ -1399,7 +2595,11 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 	}
 
 	//create the container
-	body, statusCode, err := cli.call("POST", "/containers/create", config)
+	create := &APICreate{Config: config}
+	if len(hostConfig.StorageOpt) > 0 {
+		create.HostConfig = &HostConfig{StorageOpt: hostConfig.StorageOpt}
+	}
+	body, statusCode, err := cli.call("POST", "/containers/create", create)
 	//if image not found try to pull it
 	if statusCode == 404 {
 		_, tag := utils.ParseRepositoryTag(config.Image)
@@ -1417,7 +2617,7 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 		if err != nil {
 			return err
 		}
-		body, _, err = cli.call("POST", "/containers/create", config)
+		body, _, err = cli.call("POST", "/containers/create", create)
 		if err != nil {
 			return err
 		}
@@ -1459,7 +2659,7 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 
 	if config.AttachStdin || config.AttachStdout || config.AttachStderr {
 		if config.Tty {
-			if err := cli.monitorTtySize(runResult.ID); err != nil {
+			if err := cli.monitorTtySize("/containers/" + runResult.ID); err != nil {
 				utils.Debugf("Error monitoring TTY size: %s\n", err)
 			}
 		}
@@ -1477,6 +2677,14 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 		if config.AttachStderr {
 			v.Set("stderr", "1")
 		}
+		if detachKeys != "" {
+			v.Set("detachKeys", detachKeys)
+		}
+		var stderr io.Writer
+		if !config.Tty {
+			v.Set("multiplex", "1")
+			stderr = cli.err
+		}
 
 		signals := make(chan os.Signal, 1)
 		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
@@ -1489,7 +2697,7 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 			}
 		}()
 
-		if err := cli.hijack("POST", "/containers/"+runResult.ID+"/attach?"+v.Encode(), config.Tty, cli.in, cli.out); err != nil {
+		if err := cli.hijack("POST", "/containers/"+runResult.ID+"/attach?"+v.Encode(), config.Tty, cli.in, cli.out, stderr); err != nil {
 			utils.Debugf("Error hijack: %s", err)
 			return err
 		}
@@ -1532,6 +2740,39 @@ func (cli *DockerCli) CmdCp(args ...string) error {
 	return nil
 }
 
+// The version of the API the client calls: its own, or the one of the
+// daemon if it's older. The daemon sends it in the Api-Version header of
+// the responses, the ones before don't and get the version of the client.
+func (cli *DockerCli) apiVersion() float64 {
+	if cli.version != 0 {
+		return cli.version
+	}
+	req, err := http.NewRequest("GET", "/version", nil)
+	if err != nil {
+		return APIVERSION
+	}
+	req.Header.Set("User-Agent", "Docker-Client/"+VERSION)
+	req.Host = cli.addr
+	dial, err := cli.dial()
+	if err != nil {
+		// The request which follows reports the error
+		return APIVERSION
+	}
+	clientconn := httputil.NewClientConn(dial, nil)
+	defer clientconn.Close()
+	resp, err := clientconn.Do(req)
+	if err != nil {
+		return APIVERSION
+	}
+	resp.Body.Close()
+	cli.version = APIVERSION
+	if version, err := strconv.ParseFloat(resp.Header.Get("Api-Version"), 64); err == nil && version < APIVERSION {
+		utils.Debugf("Calling the version %g of the API of the daemon", version)
+		cli.version = version
+	}
+	return cli.version
+}
+
 func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int, error) {
 	var params io.Reader
 	if data != nil {
@@ -1542,7 +2783,7 @@ func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int,
 		params = bytes.NewBuffer(buf)
 	}
 
-	req, err := http.NewRequest(method, fmt.Sprintf("/v%g%s", APIVERSION, path), params)
+	req, err := http.NewRequest(method, fmt.Sprintf("/v%g%s", cli.apiVersion(), path), params)
 	if err != nil {
 		return nil, -1, err
 	}
@@ -1553,7 +2794,7 @@ func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int,
 	} else if method == "POST" {
 		req.Header.Set("Content-Type", "plain/text")
 	}
-	dial, err := net.Dial(cli.proto, cli.addr)
+	dial, err := cli.dial()
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
 			return nil, -1, fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
@@ -1584,60 +2825,85 @@ func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int,
 }
 
 func (cli *DockerCli) stream(method, path string, in io.Reader, out io.Writer) error {
+	body, contentType, err := cli.openStream(method, path, in)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if matchesContentType(contentType, "application/json") {
+		return utils.DisplayJSONMessagesStream(body, out)
+	} else {
+		if _, err := io.Copy(out, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A response body which also closes the connection it's read from
+type streamBody struct {
+	io.ReadCloser
+	conn *httputil.ClientConn
+}
+
+func (body *streamBody) Close() error {
+	body.ReadCloser.Close()
+	return body.conn.Close()
+}
+
+// Send a request and return the body of the response, as it's received, and
+// its content type. The body must be closed.
+func (cli *DockerCli) openStream(method, path string, in io.Reader) (io.ReadCloser, string, error) {
 	if (method == "POST" || method == "PUT") && in == nil {
 		in = bytes.NewReader([]byte{})
 	}
-	req, err := http.NewRequest(method, fmt.Sprintf("/v%g%s", APIVERSION, path), in)
+	req, err := http.NewRequest(method, fmt.Sprintf("/v%g%s", cli.apiVersion(), path), in)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 	req.Header.Set("User-Agent", "Docker-Client/"+VERSION)
 	req.Host = cli.addr
 	if method == "POST" {
 		req.Header.Set("Content-Type", "plain/text")
 	}
-	dial, err := net.Dial(cli.proto, cli.addr)
+	dial, err := cli.dial()
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
-			return fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
+			return nil, "", fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
 		}
-		return err
+		return nil, "", err
 	}
 	clientconn := httputil.NewClientConn(dial, nil)
 	resp, err := clientconn.Do(req)
-	defer clientconn.Close()
 	if err != nil {
+		clientconn.Close()
 		if strings.Contains(err.Error(), "connection refused") {
-			return fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
+			return nil, "", fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
 		}
-		return err
+		return nil, "", err
 	}
-	defer resp.Body.Close()
+	body := &streamBody{resp.Body, clientconn}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		body, err := ioutil.ReadAll(resp.Body)
+		defer body.Close()
+		data, err := ioutil.ReadAll(body)
 		if err != nil {
-			return err
-		}
-		if len(body) == 0 {
-			return fmt.Errorf("Error :%s", http.StatusText(resp.StatusCode))
+			return nil, "", err
 		}
-		return fmt.Errorf("Error: %s", body)
-	}
-
-	if matchesContentType(resp.Header.Get("Content-Type"), "application/json") {
-		return utils.DisplayJSONMessagesStream(resp.Body, out)
-	} else {
-		if _, err := io.Copy(out, resp.Body); err != nil {
-			return err
+		if len(data) == 0 {
+			return nil, "", fmt.Errorf("Error :%s", http.StatusText(resp.StatusCode))
 		}
+		return nil, "", fmt.Errorf("Error: %s", data)
 	}
-	return nil
+	return body, resp.Header.Get("Content-Type"), nil
 }
 
-func (cli *DockerCli) hijack(method, path string, setRawTerminal bool, in io.ReadCloser, out io.Writer) error {
+// Hijack the connection of the request: copy in to it and what it receives
+// to out, or, with stderr, demultiplex it to out and stderr.
+func (cli *DockerCli) hijack(method, path string, setRawTerminal bool, in io.ReadCloser, out, stderr io.Writer) error {
 
-	req, err := http.NewRequest(method, fmt.Sprintf("/v%g%s", APIVERSION, path), nil)
+	req, err := http.NewRequest(method, fmt.Sprintf("/v%g%s", cli.apiVersion(), path), nil)
 	if err != nil {
 		return err
 	}
@@ -1645,7 +2911,7 @@ func (cli *DockerCli) hijack(method, path string, setRawTerminal bool, in io.Rea
 	req.Header.Set("Content-Type", "plain/text")
 	req.Host = cli.addr
 
-	dial, err := net.Dial(cli.proto, cli.addr)
+	dial, err := cli.dial()
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
 			return fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
@@ -1662,7 +2928,12 @@ func (cli *DockerCli) hijack(method, path string, setRawTerminal bool, in io.Rea
 	defer rwc.Close()
 
 	receiveStdout := utils.Go(func() error {
-		_, err := io.Copy(out, br)
+		var err error
+		if stderr != nil {
+			_, err = utils.StdCopy(out, stderr, br)
+		} else {
+			_, err = io.Copy(out, br)
+		}
 		utils.Debugf("[hijack] End of stdout")
 		return err
 	})
@@ -1680,7 +2951,11 @@ func (cli *DockerCli) hijack(method, path string, setRawTerminal bool, in io.Rea
 			io.Copy(rwc, in)
 			utils.Debugf("[hijack] End of stdin")
 		}
-		if tcpc, ok := rwc.(*net.TCPConn); ok {
+		if tlsc, ok := rwc.(*tls.Conn); ok {
+			if err := tlsc.CloseWrite(); err != nil {
+				utils.Debugf("Couldn't send EOF: %s\n", err)
+			}
+		} else if tcpc, ok := rwc.(*net.TCPConn); ok {
 			if err := tcpc.CloseWrite(); err != nil {
 				utils.Debugf("Couldn't send EOF: %s\n", err)
 			}
@@ -1722,7 +2997,9 @@ func (cli *DockerCli) getTtySize() (int, int) {
 	return int(ws.Height), int(ws.Width)
 }
 
-func (cli *DockerCli) resizeTty(id string) {
+// Resize the tty of the container or of the exec at path (e.g:
+// /containers/ID) to the size of the terminal
+func (cli *DockerCli) resizeTty(path string) {
 	height, width := cli.getTtySize()
 	if height == 0 && width == 0 {
 		return
@@ -1730,22 +3007,22 @@ func (cli *DockerCli) resizeTty(id string) {
 	v := url.Values{}
 	v.Set("h", strconv.Itoa(height))
 	v.Set("w", strconv.Itoa(width))
-	if _, _, err := cli.call("POST", "/containers/"+id+"/resize?"+v.Encode(), nil); err != nil {
+	if _, _, err := cli.call("POST", path+"/resize?"+v.Encode(), nil); err != nil {
 		utils.Debugf("Error resize: %s", err)
 	}
 }
 
-func (cli *DockerCli) monitorTtySize(id string) error {
+func (cli *DockerCli) monitorTtySize(path string) error {
 	if !cli.isTerminal {
 		return fmt.Errorf("Impossible to monitor size on non-tty")
 	}
-	cli.resizeTty(id)
+	cli.resizeTty(path)
 
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGWINCH)
 	go func() {
 		for _ = range sigchan {
-			cli.resizeTty(id)
+			cli.resizeTty(path)
 		}
 	}()
 	return nil
@@ -1782,25 +3059,86 @@ func NewDockerCli(in io.ReadCloser, out, err io.Writer, proto, addr string) *Doc
 	if e != nil {
 		fmt.Fprintf(err, "WARNING: %s\n", e)
 	}
+	clientConfig, e := LoadClientConfig(os.Getenv("HOME"))
+	if e != nil {
+		fmt.Fprintf(err, "WARNING: %s\n", e)
+	}
 	return &DockerCli{
-		proto:      proto,
-		addr:       addr,
-		configFile: configFile,
-		in:         in,
-		out:        out,
-		err:        err,
-		isTerminal: isTerminal,
-		terminalFd: terminalFd,
+		proto:        proto,
+		addr:         addr,
+		configFile:   configFile,
+		clientConfig: clientConfig,
+		in:           in,
+		out:          out,
+		err:          err,
+		isTerminal:   isTerminal,
+		terminalFd:   terminalFd,
+	}
+}
+
+// Where the configuration of the client is, in the home directory
+const CLIENTCONFIGFILE = ".docker/config.json"
+
+// The configuration of the client, such as:
+// {"detachKeys": "ctrl-x,ctrl-y"}
+type ClientConfig struct {
+	DetachKeys string `json:"detachKeys,omitempty"` // The detach keys of attach and run, unless -detach-keys is given
+}
+
+// Load the configuration of the client, empty if there is none
+func LoadClientConfig(rootPath string) (*ClientConfig, error) {
+	config := &ClientConfig{}
+	confFile := filepath.Join(rootPath, CLIENTCONFIGFILE)
+	b, err := ioutil.ReadFile(confFile)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(b, config); err != nil {
+		return &ClientConfig{}, fmt.Errorf("Invalid client config %s: %s", confFile, err)
+	}
+	if config.DetachKeys != "" {
+		if _, err := utils.ParseDetachKeys(config.DetachKeys); err != nil {
+			return &ClientConfig{}, fmt.Errorf("Invalid client config %s: %s", confFile, err)
+		}
 	}
+	return config, nil
 }
 
 type DockerCli struct {
-	proto      string
-	addr       string
-	configFile *auth.ConfigFile
-	in         io.ReadCloser
-	out        io.Writer
-	err        io.Writer
-	isTerminal bool
-	terminalFd uintptr
+	proto        string
+	addr         string
+	configFile   *auth.ConfigFile
+	clientConfig *ClientConfig
+	in           io.ReadCloser
+	out          io.Writer
+	err          io.Writer
+	isTerminal   bool
+	terminalFd   uintptr
+	version      float64 // The version of the API to call, 0 until it's negotiated
+	// The TLS config of the connections on tcp, nil without TLS
+	tlsConfig *tls.Config
+}
+
+// Connect to the daemon, with TLS on tcp if the client has a TLS config
+func (cli *DockerCli) dial() (net.Conn, error) {
+	if cli.proto == "tcp" && cli.tlsConfig != nil {
+		return tls.Dial(cli.proto, cli.addr, cli.tlsConfig)
+	}
+	return net.Dial(cli.proto, cli.addr)
+}
+
+// The detach keys of attach and run: the ones given, or else the ones of the
+// client config. The server detaches with utils.DefaultDetachKeys if empty.
+func (cli *DockerCli) detachKeys(keys string) (string, error) {
+	if keys == "" && cli.clientConfig != nil {
+		keys = cli.clientConfig.DetachKeys
+	}
+	if keys != "" {
+		if _, err := utils.ParseDetachKeys(keys); err != nil {
+			return "", err
+		}
+	}
+	return keys, nil
 }
@@ -3,6 +3,7 @@ package docker
 import (
 	"bufio"
 	"fmt"
+	"github.com/dotcloud/docker/auth"
 	"github.com/dotcloud/docker/utils"
 	"io"
 	"io/ioutil"
@@ -441,3 +442,26 @@ func TestAttachDisconnect(t *testing.T) {
 	cStdin.Close()
 	container.Wait()
 }
+
+func TestRegistryAuthConfig(t *testing.T) {
+	cli := &DockerCli{configFile: &auth.ConfigFile{Configs: map[string]auth.AuthConfig{
+		auth.IndexServerAddress():          {Username: "index"},
+		"https://registry.example.com/v1/": {Username: "registry"},
+		"localhost:5000":                   {Username: "local"},
+	}}}
+	for name, username := range map[string]string{
+		"busybox":                      "index",
+		"foo/bar":                      "index",
+		"registry.example.com/foo/bar": "registry",
+		"localhost:5000/foo":           "local",
+		"other.example.com/foo":        "",
+	} {
+		authConfig, err := cli.registryAuthConfig(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authConfig.Username != username {
+			t.Fatalf("Expected the credentials of %q for %s, got %q", username, name, authConfig.Username)
+		}
+	}
+}
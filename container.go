@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -11,19 +12,25 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type Container struct {
-	root string
+	root   string
+	basefs string // The path the graph driver mounted the filesystem on
 
 	ID string
 
@@ -39,8 +46,9 @@ type Container struct {
 	network         *NetworkInterface
 	NetworkSettings *NetworkSettings
 
-	SysInitPath    string
-	ResolvConfPath string
+	SysInitPath        string
+	ResolvConfPath     string
+	SeccompProfilePath string `json:",omitempty"` // The seccomp profile of its processes, none if empty
 
 	cmd       *exec.Cmd
 	stdout    *utils.WriteBroadcaster
@@ -48,6 +56,7 @@ type Container struct {
 	stdin     io.ReadCloser
 	stdinPipe io.WriteCloser
 	ptyMaster io.Closer
+	logDriver LogDriver // Gets stdout and stderr while the container runs
 
 	runtime *Runtime
 
@@ -56,14 +65,94 @@ type Container struct {
 	// Store rw/ro in a separate structure to preserve reverse-compatibility on-disk.
 	// Easier than migrating older container configs :)
 	VolumesRW map[string]bool
+	// The names of the named volumes of Volumes, by path in the container
+	NamedVolumes map[string]string `json:",omitempty"`
+	// The named volumes mounted for the running process, once per mount:
+	// they are unmounted when it stops
+	MountedVolumes []string `json:",omitempty"`
+	// The options of the tmpfs mounted in the container, by path, from the
+	// host config it started with
+	Tmpfs map[string]string `json:",omitempty"`
+	// Whether its root filesystem is mounted read-only, from the host
+	// config it started with
+	ReadonlyRootfs bool
+	// The devices of the host it can use, from the host config it started
+	// with
+	Devices []*Device `json:",omitempty"`
+	// The capabilities it gets or loses, from the host config it started
+	// with
+	CapAdd  []string `json:",omitempty"`
+	CapDrop []string `json:",omitempty"`
+	// The AppArmor profile and the SELinux labels of its processes and of
+	// the files of its volumes, from the host config it started with
+	AppArmorProfile string `json:",omitempty"`
+	ProcessLabel    string `json:",omitempty"`
+	MountLabel      string `json:",omitempty"`
+	// The uids and gids of its user namespace, none without -userns-remap
+	// or with -userns host
+	IDMappings *IDMappings `json:",omitempty"`
+	// The PID and IPC namespaces it joins, host or container:ID, and the
+	// /dev/shm of its IPC namespace, from the host config it started with
+	PidMode string `json:",omitempty"`
+	IpcMode string `json:",omitempty"`
+	ShmPath string `json:",omitempty"`
+	// The resource limits of its processes, the ones of the host config it
+	// started with and the defaults of the daemon
+	Ulimits []*Ulimit `json:",omitempty"`
+	// The cgroup its cgroups are under, relative to the root of the
+	// hierarchies, from the -cgroup-parent of the host config it started with
+	CgroupParent string `json:",omitempty"`
+	// The blkio weight and throttles of its block I/O, from the host config
+	// it started with
+	BlkioWeight    uint16          `json:",omitempty"`
+	BlkioThrottles []BlkioThrottle `json:",omitempty"`
+	// Whether the kernel leaves its processes alone when it's out of memory,
+	// and the oom_score_adj of its process, from the host config it started
+	// with
+	OomKillDisable bool `json:",omitempty"`
+	OomScoreAdj    int  `json:",omitempty"`
+	// The device plugins of its device requests, and the mounts and the
+	// environment they gave it when it started (the device nodes are in
+	// Devices)
+	DevicePlugins []string      `json:",omitempty"`
+	DeviceMounts  []DeviceMount `json:",omitempty"`
+	DeviceEnv     []string      `json:",omitempty"`
+	// The tmpfs bound on its /dev, with its devices there, and the files
+	// created in its root filesystem for its other devices, removed when it
+	// stops
+	DevPath     string   `json:",omitempty"`
+	DeviceStubs []string `json:",omitempty"`
+
+	// Notified by the monitor of the next exit of the process, for docker
+	// wait -condition next-exit
+	exitWaiters []chan int
+	waitersLock sync.Mutex
+	// Closed when the container is destroyed
+	removed chan struct{}
+	// Set by the destroy removing it, under the removingLock of the runtime
+	removing bool
+
+	// The restarts by the restart policy since the last docker start
+	RestartCount  int
+	restartPolicy RestartPolicy
+	restartDelay  time.Duration
+	autoRemove    bool
+	// The OOM kills in the container since it started, updated atomically
+	oomKills int32
+	// Set by docker stop and docker kill, so the container isn't restarted
+	stopRequested bool
 }
 
 type Config struct {
 	Hostname        string
 	User            string
-	Memory          int64 // Memory limit (in bytes)
-	MemorySwap      int64 // Total memory usage (memory + swap); set `-1' to disable swap
-	CpuShares       int64 // CPU shares (relative weight vs. other containers)
+	Memory          int64  // Memory limit (in bytes)
+	MemorySwap      int64  // Total memory usage (memory + swap); set `-1' to disable swap
+	CpuShares       int64  // CPU shares (relative weight vs. other containers)
+	Cpuset          string // CPUs the container can run on (e.g. 0-3 or 0,2), all of them if empty
+	CpusetMems      string // Memory nodes (NUMA) the container can allocate on (e.g. 0-1), all of them if empty
+	CpuPeriod       int64  // The period of the CFS quota, in microseconds (100000 by default)
+	CpuQuota        int64  // The CPU time the container can use in each period, in microseconds; 0 or -1 for no quota
 	AttachStdin     bool
 	AttachStdout    bool
 	AttachStderr    bool
@@ -80,18 +169,188 @@ type Config struct {
 	WorkingDir      string
 	Entrypoint      []string
 	NetworkDisabled bool
+	Network         string   // Name of the network to attach the container to, the default one if empty, or container:ID
+	NetworkAliases  []string // Extra names of the container in the DNS of its network
+	IPAddress       string   // Address of the container on its network, picked by the network if empty
+	Mtu             int      // MTU of the network interface of the container, 1500 if 0
+	Sysctls         []string // net.* kernel parameters to set in the container, as key=value
+	IngressPolicy   string   // "allow" or "deny" the traffic from the other containers of its network, the policy of the network if empty
+	IngressFrom     []string // Names of the containers of its network allowed to reach the container whatever the policies
+	Healthcheck     *HealthConfig
+	StopSignal      string            // Signal docker stop sends to the process of the container (e.g. SIGQUIT), SIGTERM if empty
+	StopTimeout     int               // Seconds docker stop waits for the container to exit before killing it, 10 if 0
+	OnBuild         []string          // Instructions of the Dockerfile the builds FROM the image run first, not inherited by their images
+	Labels          map[string]string // Metadata of the image and its containers
+	Shell           []string          // The shell of the instructions of the Dockerfile in the shell form, /bin/sh -c if empty
 	Privileged      bool
+
+	// The memory the container gets back first when the host falls short
+	// (the soft limit, Memory by default), the limit of the memory the kernel
+	// allocates for it, and how much it swaps (0 to 100, the one of the host
+	// if nil)
+	MemoryReservation int64
+	KernelMemory      int64
+	MemorySwappiness  *int64 `json:",omitempty"`
 }
 
 type HostConfig struct {
 	Binds           []string
 	ContainerIDFile string
+
+	NetRateEgress  int64 // Bandwidth the container can send, in bytes per second
+	NetRateIngress int64 // Bandwidth the container can receive, in bytes per second
+
+	DnsSearch  []string // Search domains of the resolv.conf of the container, the ones of the host by default, "." for none
+	DnsOptions []string // Options of the resolv.conf of the container (e.g. ndots:2), the ones of the host by default
+
+	RestartPolicy RestartPolicy // Whether the daemon restarts the container when it exits
+	AutoRemove    bool          // Remove the container and the volumes docker created for it when it exits
+	LogConfig     LogConfig     // Where the output of the container goes, in its json log by default
+	VolumeDriver  string        // The volume driver of the named volumes the container creates, local if empty
+
+	Tmpfs          map[string]string // The options of the tmpfs to mount in the container (e.g. size=64m), by path
+	ReadonlyRootfs bool              // Mount the root filesystem of the container read-only, with a tmpfs on /tmp and /run
+	Devices        []DeviceMapping   // The devices of the host the container can use
+	CapAdd         []string          // The capabilities the container gets, on top of the default ones (e.g. NET_ADMIN, or ALL)
+	CapDrop        []string          // The capabilities the container loses, unless CapAdd gives them
+	SecurityOpt    []string          // seccomp=<the JSON of a profile> or seccomp=unconfined (the default profile if not privileged otherwise), apparmor=PROFILE, label=user:USER (or role:, type:, level:) or label=disable
+	UsernsMode     string            // host runs the container without the user namespace of -userns-remap
+	PidMode        string            // host or container:ID, the PID namespace the container joins instead of its own one
+	IpcMode        string            // host or container:ID, the IPC namespace (and /dev/shm) the container joins instead of its own one
+	Ulimits        []*Ulimit         // The resource limits of the processes of the container, on top of the -default-ulimit of the daemon
+	CgroupParent   string            // The cgroup the cgroups of the container are under (e.g. /docker-workers or a systemd slice like workers.slice), the one of lxc if empty
+	StorageOpt     map[string]string `json:",omitempty"` // Options of the writable layer of the container for the graph driver, size=10g limits its filesystem to 10g. Only used when the container is created.
+
+	BlkioWeight          uint16           // The weight of the block I/O of the container against the other ones, 10 to 1000 (0 for the default one)
+	BlkioDeviceReadBps   []ThrottleDevice // The bytes per second the container can read from block devices
+	BlkioDeviceWriteBps  []ThrottleDevice // The bytes per second the container can write to block devices
+	BlkioDeviceReadIOps  []ThrottleDevice // The read operations per second the container can do on block devices
+	BlkioDeviceWriteIOps []ThrottleDevice // The write operations per second the container can do on block devices
+	OomKillDisable       bool             // The kernel doesn't kill the processes of the container when they are out of memory, they wait
+	OomScoreAdj          int              // How readily the kernel kills the processes of the container when the host is out of memory, -1000 to 1000
+	DeviceRequests       []DeviceRequest  // The devices (e.g. GPUs) the device plugins give the container, with what it needs to use them
+}
+
+// Whether the host config is empty, as in the starts which reuse the one
+// the container was started with. ContainerIDFile is the client's.
+func (hostConfig *HostConfig) isZero() bool {
+	config := *hostConfig
+	config.ContainerIDFile = ""
+	return isZeroValue(reflect.ValueOf(config))
+}
+
+// Whether v is the zero value of its type, with the empty slices and maps
+// as nil
+func isZeroValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !isZeroValue(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// Check the options of the host config
+func (hostConfig *HostConfig) validate() error {
+	if err := validateDnsOptions(hostConfig); err != nil {
+		return err
+	}
+	if err := validateRestartPolicy(hostConfig.RestartPolicy); err != nil {
+		return err
+	}
+	if err := validateLogConfig(hostConfig.LogConfig); err != nil {
+		return err
+	}
+	if err := validateVolumeDriver(hostConfig.VolumeDriver); err != nil {
+		return err
+	}
+	if err := validateTmpfsMounts(hostConfig.Tmpfs); err != nil {
+		return err
+	}
+	if err := validateDevices(hostConfig.Devices); err != nil {
+		return err
+	}
+	if err := validateCapabilities(hostConfig.CapAdd); err != nil {
+		return err
+	}
+	if err := validateCapabilities(hostConfig.CapDrop); err != nil {
+		return err
+	}
+	if _, err := parseSecurityOpt(hostConfig.SecurityOpt); err != nil {
+		return err
+	}
+	if err := validateUsernsMode(hostConfig.UsernsMode); err != nil {
+		return err
+	}
+	if err := validateNamespaceMode("pid", hostConfig.PidMode); err != nil {
+		return err
+	}
+	if err := validateNamespaceMode("ipc", hostConfig.IpcMode); err != nil {
+		return err
+	}
+	if err := validateUlimits(hostConfig.Ulimits); err != nil {
+		return err
+	}
+	if err := validateCgroupParent(hostConfig.CgroupParent); err != nil {
+		return err
+	}
+	if err := validateBlkio(hostConfig); err != nil {
+		return err
+	}
+	if err := validateOomScoreAdj(hostConfig.OomScoreAdj); err != nil {
+		return err
+	}
+	if err := validateDeviceRequests(hostConfig.DeviceRequests); err != nil {
+		return err
+	}
+	if hostConfig.AutoRemove && hostConfig.RestartPolicy.Name != "" && hostConfig.RestartPolicy.Name != "no" {
+		return fmt.Errorf("Bad parameter: a container can't be removed on exit and restarted with the %s policy", hostConfig.RestartPolicy.Name)
+	}
+	return nil
+}
+
+// The resources docker update changes, the zero values are left unchanged
+type UpdateConfig struct {
+	Memory     int64
+	CpuShares  int64
+	Cpuset     string
+	CpusetMems string
+	CpuPeriod  int64
+	CpuQuota   int64 // -1 removes the quota
 }
 
 type BindMap struct {
 	SrcPath string
 	DstPath string
 	Mode    string
+	Volume  string // The named volume mounted on SrcPath, if any
+	Relabel string // z or Z, SrcPath is relabeled for the container
+}
+
+// Parse the mode of a bind: rw or ro, and z or Z to relabel its source
+// (e.g. ro,Z)
+func parseBindMode(spec string) (string, string, error) {
+	mode, relabel := "", ""
+	for _, option := range strings.Split(spec, ",") {
+		switch {
+		case (strings.ToLower(option) == "rw" || strings.ToLower(option) == "ro") && mode == "":
+			mode = strings.ToLower(option)
+		case (option == "z" || option == "Z") && relabel == "":
+			relabel = option
+		default:
+			return "", "", fmt.Errorf("Invalid bind mode: %s (rw or ro, z or Z)", spec)
+		}
+	}
+	if mode == "" {
+		mode = "rw"
+	}
+	return mode, relabel, nil
 }
 
 var (
@@ -114,9 +373,58 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	flStdin := cmd.Bool("i", false, "Keep stdin open even if not attached")
 	flTty := cmd.Bool("t", false, "Allocate a pseudo-tty")
 	flMemory := cmd.Int64("m", 0, "Memory limit (in bytes)")
+	flMemorySwap := cmd.Int64("memory-swap", 0, "Total memory limit, memory + swap (in bytes, -1 for no swap limit, twice the memory limit by default)")
+	flMemoryReservation := cmd.Int64("memory-reservation", 0, "Memory soft limit, which the container gets back first when the host is short on memory (in bytes)")
+	flKernelMemory := cmd.Int64("kernel-memory", 0, "Kernel memory limit (in bytes)")
+	flMemorySwappiness := cmd.Int64("memory-swappiness", -1, "How much the memory of the container is swapped, 0 to 100 (the swappiness of the host by default)")
 	flContainerIDFile := cmd.String("cidfile", "", "Write the container ID to the file")
 	flNetwork := cmd.Bool("n", true, "Enable networking for this container")
+	flNetworkName := cmd.String("net", "", "Connect the container to a network (see 'docker network'), or to the network of another container with container:ID")
+	var flNetworkAliases ListOpts
+	cmd.Var(&flNetworkAliases, "net-alias", "Add an alias of the container in the DNS of its network")
+	flIPAddress := cmd.String("ip", "", "Give the container a fixed IPv4 address on its network (e.g. 172.17.0.42)")
+	flMtu := cmd.Int("mtu", 0, "Set the MTU of the network interface of the container (default 1500)")
+	var flSysctls ListOpts
+	cmd.Var(&flSysctls, "sysctl", "Set a net.* kernel parameter in the container (e.g. net.ipv4.ip_forward=1)")
+	flIngressPolicy := cmd.String("ingress", "", "Allow or deny the traffic from the other containers of the network (default: the policy of the network)")
+	var flIngressFrom ListOpts
+	cmd.Var(&flIngressFrom, "ingress-from", "Let a container of the network reach this one whatever the policies")
+	flStopSignal := cmd.String("stop-signal", "", "Signal docker stop sends to the container (default SIGTERM)")
+	flStopTimeout := cmd.Int("stop-timeout", 0, "Seconds docker stop waits for the container to exit before killing it (default 10)")
+	flAutoRemove := cmd.Bool("rm", false, "Remove the container (and the volumes docker created for it) when it exits, even if docker run was interrupted")
+	flRestart := cmd.String("restart", "no", "Restart the container when it exits: no, on-failure[:max] (with a non zero status, at most max times in a row) or always")
+	flVolumeDriver := cmd.String("volume-driver", "", "Volume driver of the named volumes the container creates (local by default)")
+	var flStorageOpt ListOpts
+	cmd.Var(&flStorageOpt, "storage-opt", "Set a storage option of the container, size=SIZE limits its filesystem (e.g. size=10g, with the btrfs, devicemapper and zfs storage drivers)")
+	flLogDriver := cmd.String("log-driver", "", "Send the output of the container to a log driver: json-file (the default, read by docker logs), syslog, gelf or none")
+	var flLogOptions ListOpts
+	cmd.Var(&flLogOptions, "log-opt", "Set an option of the log driver (e.g. syslog-address=udp://10.0.0.1:514)")
+	flNetRate := cmd.String("net-rate", "", "Cap the bandwidth of the container, egress[:ingress] (e.g. 10mbit or 10mbit:100mbit)")
 	flPrivileged := cmd.Bool("privileged", false, "Give extended privileges to this container")
+	var flDevices ListOpts
+	cmd.Var(&flDevices, "device", "Give a device of the host to the container, host[:container[:permissions]] (e.g. /dev/snd:/dev/snd:rwm)")
+	var flCapAdd ListOpts
+	cmd.Var(&flCapAdd, "cap-add", "Give a Linux capability to the container (e.g. NET_ADMIN, or ALL)")
+	var flCapDrop ListOpts
+	cmd.Var(&flCapDrop, "cap-drop", "Drop a Linux capability of the container (e.g. CHOWN, or ALL)")
+	var flSecurityOpt ListOpts
+	cmd.Var(&flSecurityOpt, "security-opt", "Set a security option: seccomp=profile.json (a seccomp profile) or seccomp=unconfined, apparmor=PROFILE, label=user:USER, label=role:ROLE, label=type:TYPE, label=level:LEVEL or label=disable")
+	flReadonlyRootfs := cmd.Bool("read-only", false, "Mount the root filesystem of the container read-only, with a tmpfs on /tmp and /run")
+	flPidMode := cmd.String("pid", "", "Join the PID namespace of the host or of a container, host or container:ID")
+	flIpcMode := cmd.String("ipc", "", "Join the IPC namespace (and /dev/shm) of the host or of a container, host or container:ID")
+	var flUlimits ListOpts
+	cmd.Var(&flUlimits, "ulimit", "Set a resource limit of the processes of the container, name=soft[:hard] (e.g. nofile=65535:65535)")
+	flBlkioWeight := cmd.Int("blkio-weight", 0, "Block I/O weight of the container against the other ones, 10 to 1000")
+	var flDeviceReadBps, flDeviceWriteBps, flDeviceReadIOps, flDeviceWriteIOps ListOpts
+	cmd.Var(&flDeviceReadBps, "device-read-bps", "Limit the bytes per second the container reads from a block device, path:rate (e.g. /dev/sda:10mb)")
+	cmd.Var(&flDeviceWriteBps, "device-write-bps", "Limit the bytes per second the container writes to a block device, path:rate (e.g. /dev/sda:10mb)")
+	cmd.Var(&flDeviceReadIOps, "device-read-iops", "Limit the read operations per second of the container on a block device, path:rate (e.g. /dev/sda:1000)")
+	cmd.Var(&flDeviceWriteIOps, "device-write-iops", "Limit the write operations per second of the container on a block device, path:rate (e.g. /dev/sda:1000)")
+	flGpus := cmd.String("gpus", "", "Give GPUs to the container: all, a count, or options like device=0,1 and capabilities=compute,utility")
+	flOomKillDisable := cmd.Bool("oom-kill-disable", false, "Don't let the kernel kill the processes of the container when it's out of memory (use with -m)")
+	flOomScoreAdj := cmd.Int("oom-score-adj", 0, "Adjust the OOM score of the container, -1000 (never killed) to 1000 (killed first)")
+	flCgroupParent := cmd.String("cgroup-parent", "", "Put the cgroups of the container under a cgroup (e.g. /docker-workers) or a systemd slice (e.g. workers.slice)")
+	flUsernsMode := cmd.String("userns", "", "Set the user namespace mode of the container: host runs it without the user namespace of the daemon (-userns-remap)")
 
 	if capabilities != nil && *flMemory > 0 && !capabilities.MemoryLimit {
 		//fmt.Fprintf(stdout, "WARNING: Your kernel does not support memory limit capabilities. Limitation discarded.\n")
@@ -124,6 +432,11 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	}
 
 	flCpuShares := cmd.Int64("c", 0, "CPU shares (relative weight)")
+	flCpuset := cmd.String("cpuset-cpus", "", "CPUs the container can run on (e.g. 0-3 or 0,2)")
+	cmd.StringVar(flCpuset, "cpuset", "", "Deprecated, use -cpuset-cpus")
+	flCpusetMems := cmd.String("cpuset-mems", "", "Memory nodes (NUMA) the container can allocate on (e.g. 0-1)")
+	flCpuPeriod := cmd.Int64("cpu-period", 0, "Period of the CPU quota, in microseconds (100000 by default)")
+	flCpuQuota := cmd.Int64("cpu-quota", 0, "CPU time the container can use in each period, in microseconds (e.g. 50000 for half a CPU)")
 
 	var flPorts ListOpts
 	cmd.Var(&flPorts, "p", "Expose a container's port to the host (use 'docker port' to see the actual mapping)")
@@ -133,22 +446,69 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 
 	var flDns ListOpts
 	cmd.Var(&flDns, "dns", "Set custom dns servers")
+	var flDnsSearch ListOpts
+	cmd.Var(&flDnsSearch, "dns-search", "Set custom dns search domains (use . for none)")
+	var flDnsOptions ListOpts
+	cmd.Var(&flDnsOptions, "dns-opt", "Set a resolv.conf option (e.g. ndots:2)")
 
 	flVolumes := NewPathOpts()
-	cmd.Var(flVolumes, "v", "Bind mount a volume (e.g. from the host: -v /host:/container, from docker: -v /container)")
+	cmd.Var(flVolumes, "v", "Bind mount a volume (e.g. from the host: -v /host:/container, from docker: -v /container, a named volume: -v name:/container)")
+
+	var flTmpfs ListOpts
+	cmd.Var(&flTmpfs, "tmpfs", "Mount a tmpfs in the container, path[:options] (e.g. /run:size=64m,mode=1777)")
 
 	flVolumesFrom := cmd.String("volumes-from", "", "Mount volumes from the specified container")
 	flEntrypoint := cmd.String("entrypoint", "", "Overwrite the default entrypoint of the image")
+	// Only the client uses it, with Lookup
+	flDetachKeys := cmd.String("detach-keys", "", "Override the key sequence to detach from a container with a tty ("+utils.DefaultDetachKeys+" by default)")
 
 	if err := cmd.Parse(args); err != nil {
 		return nil, nil, cmd, err
 	}
+	if *flDetachKeys != "" {
+		if _, err := utils.ParseDetachKeys(*flDetachKeys); err != nil {
+			return nil, nil, cmd, err
+		}
+	}
 	if *flDetach && len(flAttach) > 0 {
 		return nil, nil, cmd, fmt.Errorf("Conflicting options: -a and -d")
 	}
 	if *flWorkingDir != "" && !path.IsAbs(*flWorkingDir) {
 		return nil, nil, cmd, ErrInvaidWorikingDirectory
 	}
+	if *flCpuset != "" && !validCpuset.MatchString(*flCpuset) {
+		return nil, nil, cmd, fmt.Errorf("Invalid cpuset: %s", *flCpuset)
+	}
+	if *flCpusetMems != "" && !validCpuset.MatchString(*flCpusetMems) {
+		return nil, nil, cmd, fmt.Errorf("Invalid cpuset mems: %s", *flCpusetMems)
+	}
+	if err := validateCpuQuota(*flCpuPeriod, *flCpuQuota); err != nil {
+		return nil, nil, cmd, err
+	}
+	if capabilities != nil && (*flCpuPeriod != 0 || *flCpuQuota != 0) && !capabilities.CpuCfsQuota {
+		*flCpuPeriod, *flCpuQuota = 0, 0
+	}
+	if *flAutoRemove && *flRestart != "no" {
+		return nil, nil, cmd, fmt.Errorf("Conflicting options: -rm and -restart")
+	}
+	if *flStopSignal != "" {
+		if _, err := parseSignal(*flStopSignal); err != nil {
+			return nil, nil, cmd, err
+		}
+	}
+	if *flStopTimeout < 0 {
+		return nil, nil, cmd, fmt.Errorf("Invalid stop timeout: %d", *flStopTimeout)
+	}
+	storageOpt, err := parseStorageOptions(flStorageOpt)
+	if err != nil {
+		return nil, nil, cmd, err
+	}
+	if _, err := containerLayerSize(storageOpt); err != nil {
+		return nil, nil, cmd, err
+	}
+	if strings.HasPrefix(*flNetworkName, networkContainerPrefix) && len(flPorts) > 0 {
+		return nil, nil, cmd, fmt.Errorf("Conflicting options: -p and -net=%s", *flNetworkName)
+	}
 	// If neither -d or -a are set, attach to everything by default
 	if len(flAttach) == 0 && !*flDetach {
 		if !*flDetach {
@@ -193,9 +553,21 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 		User:            *flUser,
 		Tty:             *flTty,
 		NetworkDisabled: !*flNetwork,
+		Network:         *flNetworkName,
+		NetworkAliases:  flNetworkAliases,
+		IPAddress:       *flIPAddress,
+		Mtu:             *flMtu,
+		Sysctls:         flSysctls,
+		IngressPolicy:   *flIngressPolicy,
+		IngressFrom:     flIngressFrom,
 		OpenStdin:       *flStdin,
 		Memory:          *flMemory,
+		MemorySwap:      *flMemorySwap,
 		CpuShares:       *flCpuShares,
+		Cpuset:          *flCpuset,
+		CpusetMems:      *flCpusetMems,
+		CpuPeriod:       *flCpuPeriod,
+		CpuQuota:        *flCpuQuota,
 		AttachStdin:     flAttach.Get("stdin"),
 		AttachStdout:    flAttach.Get("stdout"),
 		AttachStderr:    flAttach.Get("stderr"),
@@ -208,10 +580,152 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 		Entrypoint:      entrypoint,
 		Privileged:      *flPrivileged,
 		WorkingDir:      *flWorkingDir,
+		StopSignal:      *flStopSignal,
+		StopTimeout:     *flStopTimeout,
+
+		MemoryReservation: *flMemoryReservation,
+		KernelMemory:      *flKernelMemory,
+	}
+	if *flMemorySwappiness != -1 {
+		config.MemorySwappiness = flMemorySwappiness
+	}
+	if err := validateMemory(config); err != nil {
+		return nil, nil, cmd, err
+	}
+	if capabilities != nil {
+		discardMemoryLimits(capabilities, config)
+	}
+	if err := validateNetworkOptions(config); err != nil {
+		return nil, nil, cmd, err
+	}
+	restartPolicy, err := parseRestartPolicy(*flRestart)
+	if err != nil {
+		return nil, nil, cmd, err
+	}
+	logOptions, err := parseLogOptions(flLogOptions)
+	if err != nil {
+		return nil, nil, cmd, err
+	}
+	logConfig := LogConfig{Type: *flLogDriver, Config: logOptions}
+	if err := validateLogConfig(logConfig); err != nil {
+		return nil, nil, cmd, err
+	}
+	if err := validateVolumeDriver(*flVolumeDriver); err != nil {
+		return nil, nil, cmd, err
+	}
+	var tmpfs map[string]string
+	for _, spec := range flTmpfs {
+		dst, options, err := parseTmpfs(spec)
+		if err != nil {
+			return nil, nil, cmd, err
+		}
+		if tmpfs == nil {
+			tmpfs = make(map[string]string)
+		}
+		tmpfs[dst] = options
+	}
+	if err := validateCapabilities(flCapAdd); err != nil {
+		return nil, nil, cmd, err
+	}
+	if err := validateCapabilities(flCapDrop); err != nil {
+		return nil, nil, cmd, err
+	}
+	securityOpt, err := readSecurityOpt(flSecurityOpt)
+	if err != nil {
+		return nil, nil, cmd, err
+	}
+	if err := validateUsernsMode(*flUsernsMode); err != nil {
+		return nil, nil, cmd, err
+	}
+	if err := validateNamespaceMode("pid", *flPidMode); err != nil {
+		return nil, nil, cmd, err
+	}
+	if err := validateNamespaceMode("ipc", *flIpcMode); err != nil {
+		return nil, nil, cmd, err
+	}
+	if err := validateCgroupParent(*flCgroupParent); err != nil {
+		return nil, nil, cmd, err
+	}
+	var ulimits []*Ulimit
+	for _, spec := range flUlimits {
+		ulimit, err := parseUlimit(spec)
+		if err != nil {
+			return nil, nil, cmd, err
+		}
+		ulimits = append(ulimits, ulimit)
+	}
+	if *flBlkioWeight < 0 || *flBlkioWeight > 1000 {
+		return nil, nil, cmd, fmt.Errorf("Invalid blkio weight: %d (10 to 1000)", *flBlkioWeight)
+	}
+	var throttleDevices [4][]ThrottleDevice
+	for i, specs := range []ListOpts{flDeviceReadBps, flDeviceWriteBps, flDeviceReadIOps, flDeviceWriteIOps} {
+		for _, spec := range specs {
+			device, err := parseThrottleDevice(spec, i < 2)
+			if err != nil {
+				return nil, nil, cmd, err
+			}
+			throttleDevices[i] = append(throttleDevices[i], device)
+		}
+	}
+	var devices []DeviceMapping
+	for _, spec := range flDevices {
+		device, err := parseDevice(spec)
+		if err != nil {
+			return nil, nil, cmd, err
+		}
+		devices = append(devices, device)
 	}
 	hostConfig := &HostConfig{
 		Binds:           binds,
 		ContainerIDFile: *flContainerIDFile,
+		DnsSearch:       flDnsSearch,
+		DnsOptions:      flDnsOptions,
+		RestartPolicy:   restartPolicy,
+		AutoRemove:      *flAutoRemove,
+		LogConfig:       logConfig,
+		VolumeDriver:    *flVolumeDriver,
+		Tmpfs:           tmpfs,
+		ReadonlyRootfs:  *flReadonlyRootfs,
+		Devices:         devices,
+		CapAdd:          flCapAdd,
+		CapDrop:         flCapDrop,
+		SecurityOpt:     securityOpt,
+		UsernsMode:      *flUsernsMode,
+		PidMode:         *flPidMode,
+		IpcMode:         *flIpcMode,
+		Ulimits:         ulimits,
+		CgroupParent:    *flCgroupParent,
+		StorageOpt:      storageOpt,
+
+		BlkioWeight:          uint16(*flBlkioWeight),
+		BlkioDeviceReadBps:   throttleDevices[0],
+		BlkioDeviceWriteBps:  throttleDevices[1],
+		BlkioDeviceReadIOps:  throttleDevices[2],
+		BlkioDeviceWriteIOps: throttleDevices[3],
+		OomKillDisable:       *flOomKillDisable,
+		OomScoreAdj:          *flOomScoreAdj,
+	}
+	if err := validateOomScoreAdj(hostConfig.OomScoreAdj); err != nil {
+		return nil, nil, cmd, err
+	}
+	if *flGpus != "" {
+		request, err := parseGpus(*flGpus)
+		if err != nil {
+			return nil, nil, cmd, err
+		}
+		hostConfig.DeviceRequests = []DeviceRequest{request}
+	}
+	if err := validateBlkio(hostConfig); err != nil {
+		return nil, nil, cmd, err
+	}
+	if err := validateDnsOptions(hostConfig); err != nil {
+		return nil, nil, cmd, err
+	}
+	if *flNetRate != "" {
+		var err error
+		if hostConfig.NetRateEgress, hostConfig.NetRateIngress, err = parseNetRate(*flNetRate); err != nil {
+			return nil, nil, cmd, err
+		}
 	}
 
 	if capabilities != nil && *flMemory > 0 && !capabilities.SwapLimit {
@@ -226,14 +740,128 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	return config, hostConfig, cmd, nil
 }
 
+// The signals by name, for docker stop
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// Parse a signal given by its name, with or without SIG (e.g. SIGQUIT or
+// QUIT), or by its number
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("Invalid signal: %s", s)
+		}
+		return syscall.Signal(n), nil
+	}
+	signal, exists := signals[strings.TrimPrefix(strings.ToUpper(s), "SIG")]
+	if !exists {
+		return 0, fmt.Errorf("Invalid signal: %s", s)
+	}
+	return signal, nil
+}
+
+// A list of CPUs and ranges of CPUs, as cpuset.cpus takes them (and the
+// memory nodes of cpuset.mems)
+var validCpuset = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// The CFS bandwidth of a container: the kernel takes periods from 1ms to 1s,
+// and quotas of at least 1ms (-1 for none)
+func validateCpuQuota(period, quota int64) error {
+	if period != 0 && (period < 1000 || period > 1000000) {
+		return fmt.Errorf("Bad parameter: invalid CPU period %d (1000 to 1000000 microseconds)", period)
+	}
+	if quota != 0 && quota != -1 && quota < 1000 {
+		return fmt.Errorf("Bad parameter: invalid CPU quota %d (at least 1000 microseconds, or -1)", quota)
+	}
+	return nil
+}
+
+// Only the parameters of the network namespace can be set: the others are
+// shared with the host
+var validSysctl = regexp.MustCompile(`^net(\.[a-zA-Z0-9_-]+)+$`)
+
+// Split a key=value kernel parameter and check it can be set in a container
+func parseSysctl(sysctl string) (string, string, error) {
+	parts := strings.SplitN(sysctl, "=", 2)
+	if len(parts) != 2 || !validSysctl.MatchString(parts[0]) {
+		return "", "", fmt.Errorf("Bad parameter: invalid sysctl %s, expected net.*=value", sysctl)
+	}
+	return parts[0], parts[1], nil
+}
+
+func validateNetworkOptions(config *Config) error {
+	if strings.HasPrefix(config.Network, networkContainerPrefix) {
+		if getNetworkContainer(config) == "" {
+			return fmt.Errorf("Bad parameter: invalid network %s, expected container:ID", config.Network)
+		}
+		// The network is set up by the other container
+		if config.NetworkDisabled || config.IPAddress != "" || len(config.NetworkAliases) > 0 || config.Mtu != 0 || len(config.Sysctls) > 0 ||
+			config.IngressPolicy != "" || len(config.IngressFrom) > 0 {
+			return fmt.Errorf("Bad parameter: the network options of the container can't be set with -net=%s", config.Network)
+		}
+	}
+	if config.IPAddress != "" {
+		if ip := net.ParseIP(config.IPAddress); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("Bad parameter: invalid IPv4 address %s", config.IPAddress)
+		}
+		if config.NetworkDisabled {
+			return fmt.Errorf("Bad parameter: a fixed IP address needs networking")
+		}
+	}
+	if config.Mtu != 0 && (config.Mtu < 68 || config.Mtu > 65535) {
+		return fmt.Errorf("Bad parameter: invalid MTU %d", config.Mtu)
+	}
+	for _, sysctl := range config.Sysctls {
+		if _, _, err := parseSysctl(sysctl); err != nil {
+			return err
+		}
+	}
+	if config.IngressPolicy != "" && config.IngressPolicy != "allow" && config.IngressPolicy != "deny" {
+		return fmt.Errorf("Bad parameter: invalid ingress policy %s, expected allow or deny", config.IngressPolicy)
+	}
+	for _, name := range config.IngressFrom {
+		if !validNetworkName.MatchString(name) {
+			return fmt.Errorf("Bad parameter: invalid container name %q", name)
+		}
+	}
+	return nil
+}
+
+// The search domains and the options end up on a line of resolv.conf
+func validateDnsOptions(hostConfig *HostConfig) error {
+	for _, domain := range hostConfig.DnsSearch {
+		if domain == "" || strings.ContainsAny(domain, " \t\n") || (domain == "." && len(hostConfig.DnsSearch) > 1) {
+			return fmt.Errorf("Bad parameter: invalid dns search domain %q", domain)
+		}
+	}
+	for _, option := range hostConfig.DnsOptions {
+		if option == "" || strings.ContainsAny(option, " \t\n") {
+			return fmt.Errorf("Bad parameter: invalid dns option %q", option)
+		}
+	}
+	return nil
+}
+
 type PortMapping map[string]string
 
 type NetworkSettings struct {
 	IPAddress   string
 	IPPrefixLen int
 	Gateway     string
-	Bridge      string
+	Bridge      string // The interface the container is linked to: a bridge, or the parent of its macvlan
+	MacvlanMode string `json:",omitempty"`
 	PortMapping map[string]PortMapping
+
+	HostInterface string `json:",omitempty"` // The host side of the veth of the container, when lxc must name it
 }
 
 // String returns a human-readable description of the port mapping defined in the settings
@@ -245,18 +873,24 @@ func (settings *NetworkSettings) PortMappingHuman() string {
 	for private, public := range settings.PortMapping["Udp"] {
 		mapping = append(mapping, fmt.Sprintf("%s->%s/udp", public, private))
 	}
+	for private, public := range settings.PortMapping["Sctp"] {
+		mapping = append(mapping, fmt.Sprintf("%s->%s/sctp", public, private))
+	}
 	sort.Strings(mapping)
 	return strings.Join(mapping, ", ")
 }
 
 // Inject the io.Reader at the given path. Note: do not close the reader
 func (container *Container) Inject(file io.Reader, pth string) error {
+	if err := container.EnsureMounted(); err != nil {
+		return err
+	}
 	// Make sure the directory exists
-	if err := os.MkdirAll(path.Join(container.rwPath(), path.Dir(pth)), 0755); err != nil {
+	if err := os.MkdirAll(path.Join(container.RootfsPath(), path.Dir(pth)), 0755); err != nil {
 		return err
 	}
 	// FIXME: Handle permissions/already existing dest
-	dest, err := os.Create(path.Join(container.rwPath(), pth))
+	dest, err := os.Create(path.Join(container.RootfsPath(), pth))
 	if err != nil {
 		return err
 	}
@@ -315,6 +949,122 @@ func (container *Container) SaveHostConfig(hostConfig *HostConfig) (err error) {
 	return ioutil.WriteFile(container.hostConfigPath(), data, 0666)
 }
 
+// Write the seccomp profile of the container, docker-init applies it to its
+// processes. The privileged containers have none unless one is given.
+func (container *Container) setupSeccomp(options *securityOptions) error {
+	container.SeccompProfilePath = ""
+	seccomp := options.seccomp
+	var (
+		profile *SeccompProfile
+		err     error
+	)
+	switch {
+	case seccomp == seccompUnconfined || (seccomp == "" && container.Config.Privileged):
+		return nil
+	case seccomp == "":
+		profile = defaultSeccompProfile(container.DroppedCapabilities())
+	default:
+		if profile, err = parseSeccompProfile([]byte(seccomp)); err != nil {
+			return err
+		}
+	}
+	if !container.runtime.capabilities.Seccomp {
+		if seccomp == "" {
+			log.Printf("WARNING: Your kernel does not support seccomp. The processes of %s can make any syscall", container.ID)
+			return nil
+		}
+		return fmt.Errorf("Impossible to apply the seccomp profile of %s, your kernel does not support seccomp", container.ID)
+	}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(container.seccompProfilePath(), data, 0644); err != nil {
+		return err
+	}
+	container.SeccompProfilePath = container.seccompProfilePath()
+	return nil
+}
+
+// Set the AppArmor profile and the SELinux labels of the container. The
+// privileged containers have no labels unless some are given. A container
+// keeps its MCS level when it restarts, the files of its volumes have it.
+func (container *Container) setupLabels(options *securityOptions) error {
+	container.AppArmorProfile = options.apparmor
+	if container.AppArmorProfile != "" && !container.runtime.capabilities.AppArmor {
+		return fmt.Errorf("Impossible to apply the AppArmor profile %s to %s, AppArmor is not enabled on the host", container.AppArmorProfile, container.ID)
+	}
+	level := labelLevel(container.MountLabel)
+	container.ProcessLabel, container.MountLabel = "", ""
+	if options.labelDisabled || (len(options.label) == 0 && container.Config.Privileged) {
+		return nil
+	}
+	if !container.runtime.capabilities.SELinux {
+		if len(options.label) > 0 {
+			return fmt.Errorf("Impossible to apply the SELinux labels to %s, SELinux is not enabled on the host", container.ID)
+		}
+		return nil
+	}
+	if level == "" {
+		used := make(map[string]bool)
+		for _, c := range container.runtime.List() {
+			used[labelLevel(c.MountLabel)] = true
+		}
+		var err error
+		if level, err = newMCSLevel(used); err != nil {
+			return err
+		}
+	}
+	parts := map[string]string{"level": level}
+	for part, value := range options.label {
+		parts[part] = value
+	}
+	container.ProcessLabel = setLabelParts(defaultProcessLabel, parts)
+	// The files keep their role and type, the one the processes can use
+	mountParts := map[string]string{"level": parts["level"]}
+	if user, exists := parts["user"]; exists {
+		mountParts["user"] = user
+	}
+	container.MountLabel = setLabelParts(defaultMountLabel, mountParts)
+	return nil
+}
+
+// Set the user namespace of the container, the one of the -userns-remap of
+// the daemon unless its host config opts out. Its root is an unprivileged
+// user of the host, which owns the directory and the root filesystem of
+// the container.
+func (container *Container) setupUserns(hostConfig *HostConfig) error {
+	container.IDMappings = nil
+	if container.runtime.idMappings == nil || hostConfig.UsernsMode == "host" {
+		return nil
+	}
+	if container.Config.Privileged {
+		return fmt.Errorf("Bad parameter: a privileged container can't run in the user namespace of the daemon, use -userns host")
+	}
+	uid, gid := container.runtime.idMappings.RootPair()
+	for _, dir := range []string{container.root, container.RootfsPath()} {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	container.IDMappings = container.runtime.idMappings
+	return nil
+}
+
+// The options of a tmpfs of the container, labeled like its volumes
+func (container *Container) tmpfsOptions(options string) string {
+	options = tmpfsMountOptions(options)
+	if container.MountLabel != "" {
+		options += fmt.Sprintf(",context=\"%s\"", container.MountLabel)
+	}
+	return options
+}
+
+// The capabilities lxc drops when it starts the container
+func (container *Container) DroppedCapabilities() []string {
+	return droppedCapabilities(container.Config.Privileged, container.CapAdd, container.CapDrop)
+}
+
 func (container *Container) generateLXCConfig() error {
 	fo, err := os.Create(container.lxcConfigPath())
 	if err != nil {
@@ -380,7 +1130,9 @@ func (container *Container) start() error {
 	return container.cmd.Start()
 }
 
-func (container *Container) Attach(stdin io.ReadCloser, stdinCloser io.Closer, stdout io.Writer, stderr io.Writer) chan error {
+// Attach the streams to the container. With a tty, reading detachKeys
+// (utils.DefaultDetachKeys if nil) on stdin detaches from it.
+func (container *Container) Attach(stdin io.ReadCloser, stdinCloser io.Closer, stdout io.Writer, stderr io.Writer, detachKeys []byte) chan error {
 	var cStdout, cStderr io.ReadCloser
 
 	var nJobs int
@@ -405,7 +1157,7 @@ func (container *Container) Attach(stdin io.ReadCloser, stdinCloser io.Closer, s
 					}
 				}
 				if container.Config.Tty {
-					_, err = utils.CopyEscapable(cStdin, stdin)
+					_, err = utils.CopyEscapable(cStdin, stdin, detachKeys)
 				} else {
 					_, err = io.Copy(cStdin, stdin)
 				}
@@ -519,10 +1271,21 @@ func (container *Container) Attach(stdin io.ReadCloser, stdinCloser io.Closer, s
 func (container *Container) Start(hostConfig *HostConfig) error {
 	container.State.Lock()
 	defer container.State.Unlock()
+	container.stopRequested = false
+	container.RestartCount = 0
+	container.restartDelay = 0
+	return container.startLocked(hostConfig)
+}
 
-	if len(hostConfig.Binds) == 0 {
+// Start the container, its state is locked
+func (container *Container) startLocked(hostConfig *HostConfig) (err error) {
+	if hostConfig.isZero() {
 		hostConfig, _ = container.ReadHostConfig()
+	} else if err := hostConfig.validate(); err != nil {
+		return err
 	}
+	container.restartPolicy = hostConfig.RestartPolicy
+	container.autoRemove = hostConfig.AutoRemove
 
 	if container.State.Running {
 		return fmt.Errorf("The container %s is already running.", container.ID)
@@ -530,11 +1293,23 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 	if err := container.EnsureMounted(); err != nil {
 		return err
 	}
-	if container.runtime.networkManager.disabled {
-		container.Config.NetworkDisabled = true
-	} else {
-		if err := container.allocateNetwork(); err != nil {
-			return err
+	if err := container.setupUserns(hostConfig); err != nil {
+		return err
+	}
+	if err := container.setupNamespaces(hostConfig); err != nil {
+		return err
+	}
+	if err := container.allocateNetwork(nil); err != nil {
+		return err
+	}
+	if err := container.setupResolvConf(hostConfig); err != nil {
+		return err
+	}
+	if hostConfig.NetRateEgress > 0 || hostConfig.NetRateIngress > 0 {
+		if container.network == nil || container.NetworkSettings.MacvlanMode != "" {
+			log.Printf("WARNING: The bandwidth of %s isn't capped, it has no veth", container.ID)
+		} else {
+			container.NetworkSettings.HostInterface = "veth" + container.ID[:11]
 		}
 	}
 
@@ -547,11 +1322,39 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 		log.Printf("WARNING: Your kernel does not support swap limit capabilities. Limitation discarded.\n")
 		container.Config.MemorySwap = -1
 	}
+	if (container.Config.CpuPeriod != 0 || container.Config.CpuQuota != 0) && !container.runtime.capabilities.CpuCfsQuota {
+		log.Printf("WARNING: Your kernel does not support CPU CFS quota. Limitation discarded.\n")
+		container.Config.CpuPeriod, container.Config.CpuQuota = 0, 0
+	}
+	for _, warning := range discardMemoryLimits(container.runtime.capabilities, container.Config) {
+		log.Printf("WARNING: %s\n", warning)
+	}
 
 	if !container.runtime.capabilities.IPv4Forwarding {
 		log.Printf("WARNING: IPv4 forwarding is disabled. Networking will not work")
 	}
 
+	// The labels come first, the binds are relabeled with them
+	securityOpt, err := parseSecurityOpt(hostConfig.SecurityOpt)
+	if err != nil {
+		return err
+	}
+	if err := container.setupLabels(securityOpt); err != nil {
+		return err
+	}
+
+	// The named volumes mounted are unmounted again if it doesn't start, and
+	// its devices removed
+	var mountedVolumes []string
+	defer func() {
+		if err != nil {
+			for _, name := range mountedVolumes {
+				container.runtime.unmountVolume(name, container.ID)
+			}
+			container.cleanupDevices()
+		}
+	}()
+
 	// Create the requested bind mounts
 	binds := make(map[string]BindMap)
 	// Define illegal container destinations
@@ -559,7 +1362,7 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 
 	for _, bind := range hostConfig.Binds {
 		// FIXME: factorize bind parsing in parseBind
-		var src, dst, mode string
+		var src, dst, mode, relabelMode string
 		arr := strings.Split(bind, ":")
 		if len(arr) == 2 {
 			src = arr[0]
@@ -568,10 +1371,24 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 		} else if len(arr) == 3 {
 			src = arr[0]
 			dst = arr[1]
-			mode = arr[2]
+			if mode, relabelMode, err = parseBindMode(arr[2]); err != nil {
+				return err
+			}
 		} else {
 			return fmt.Errorf("Invalid bind specification: %s", bind)
 		}
+		// Not a path of the host, the name of a volume: it's mounted
+		// again each time the container starts
+		var volume string
+		if !path.IsAbs(src) {
+			volume = src
+			mountpoint, err := container.runtime.mountVolume(volume, hostConfig.VolumeDriver, container.ID)
+			if err != nil {
+				return err
+			}
+			mountedVolumes = append(mountedVolumes, volume)
+			src = mountpoint
+		}
 
 		// Bail if trying to mount to an illegal destination
 		for _, illegal := range illegalDsts {
@@ -580,10 +1397,16 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 			}
 		}
 
+		if err := relabel(src, container.MountLabel, relabelMode); err != nil {
+			return err
+		}
+
 		bindMap := BindMap{
 			SrcPath: src,
 			DstPath: dst,
 			Mode:    mode,
+			Volume:  volume,
+			Relabel: relabelMode,
 		}
 		binds[path.Clean(dst)] = bindMap
 	}
@@ -593,8 +1416,22 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 		container.VolumesRW = make(map[string]bool)
 	}
 
-	// Apply volumes from another container if requested
-	if container.Config.VolumesFrom != "" {
+	// The named volumes of -volumes-from are mounted again, the ones of the
+	// binds were with them
+	for volPath, name := range container.NamedVolumes {
+		if _, exists := binds[volPath]; exists {
+			continue
+		}
+		mountpoint, err := container.runtime.mountVolume(name, "", container.ID)
+		if err != nil {
+			return err
+		}
+		mountedVolumes = append(mountedVolumes, name)
+		container.Volumes[volPath] = mountpoint
+	}
+
+	// Apply volumes from another container if requested
+	if container.Config.VolumesFrom != "" {
 		c := container.runtime.Get(container.Config.VolumesFrom)
 		if c == nil {
 			return fmt.Errorf("Container %s not found. Impossible to mount its volumes", container.ID)
@@ -610,29 +1447,52 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 			if isRW, exists := c.VolumesRW[volPath]; exists {
 				container.VolumesRW[volPath] = isRW
 			}
+			// The container mounts the named volumes too
+			if name := c.NamedVolumes[volPath]; name != "" {
+				mountpoint, err := container.runtime.mountVolume(name, "", container.ID)
+				if err != nil {
+					return err
+				}
+				mountedVolumes = append(mountedVolumes, name)
+				container.Volumes[volPath] = mountpoint
+				if container.NamedVolumes == nil {
+					container.NamedVolumes = make(map[string]string)
+				}
+				container.NamedVolumes[volPath] = name
+			}
 		}
 	}
 
 	// Create the requested volumes if they don't exist
 	for volPath := range container.Config.Volumes {
 		volPath = path.Clean(volPath)
-		// Skip existing volumes
+		// Skip existing volumes, but the named volumes may be mounted
+		// elsewhere
 		if _, exists := container.Volumes[volPath]; exists {
+			if bindMap, exists := binds[volPath]; exists && bindMap.Volume != "" && container.NamedVolumes[volPath] == bindMap.Volume {
+				container.Volumes[volPath] = bindMap.SrcPath
+			}
 			continue
 		}
 		// If an external bind is defined for this volume, use that as a source
 		if bindMap, exists := binds[volPath]; exists {
 			container.Volumes[volPath] = bindMap.SrcPath
-			if strings.ToLower(bindMap.Mode) == "rw" {
+			if bindMap.Mode == "rw" {
 				container.VolumesRW[volPath] = true
 			}
+			if bindMap.Volume != "" {
+				if container.NamedVolumes == nil {
+					container.NamedVolumes = make(map[string]string)
+				}
+				container.NamedVolumes[volPath] = bindMap.Volume
+			}
 			// Otherwise create an directory in $ROOT/volumes/ and use that
 		} else {
 			c, err := container.runtime.volumes.Create(nil, container, "", "", nil)
 			if err != nil {
 				return err
 			}
-			srcPath, err := c.layer()
+			srcPath, err := container.runtime.volumes.driver.Get(c.ID)
 			if err != nil {
 				return err
 			}
@@ -645,54 +1505,131 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 		}
 	}
 
+	// The tmpfs are mounted by lxc, like the volumes
+	container.Tmpfs = make(map[string]string)
+	for dst, options := range hostConfig.Tmpfs {
+		dst = path.Clean(dst)
+		if _, exists := container.Volumes[dst]; exists {
+			return fmt.Errorf("Conflict: %s is both a volume and a tmpfs", dst)
+		}
+		if err := os.MkdirAll(path.Join(container.RootfsPath(), dst), 0755); err != nil {
+			return err
+		}
+		container.Tmpfs[dst] = container.tmpfsOptions(options)
+	}
+	// The processes can still write their temporary files in a read-only
+	// container, unless volumes or other tmpfs are mounted there
+	container.ReadonlyRootfs = hostConfig.ReadonlyRootfs
+	if container.ReadonlyRootfs {
+		for _, dst := range readonlyRootfsTmpfs {
+			if _, exists := container.Volumes[dst]; exists {
+				continue
+			}
+			if _, exists := container.Tmpfs[dst]; exists {
+				continue
+			}
+			if err := os.MkdirAll(path.Join(container.RootfsPath(), dst), 0755); err != nil {
+				return err
+			}
+			container.Tmpfs[dst] = container.tmpfsOptions("mode=1777")
+		}
+	}
+
+	// The device plugins give their devices along the ones of -device
+	injection, err := container.injectDevices(hostConfig.DeviceRequests)
+	if err != nil {
+		return err
+	}
+	container.DeviceMounts = injection.Mounts
+	container.DeviceEnv = injection.Env
+
+	// The nodes of the devices are created again each time, the ones of
+	// the host may have changed
+	devices, err := findDevices(append(append([]DeviceMapping{}, hostConfig.Devices...), injection.Devices...))
+	if err != nil {
+		return err
+	}
+	if err := container.setupDevices(devices, injection.Mounts); err != nil {
+		return err
+	}
+	container.Devices = devices
+	container.CapAdd = hostConfig.CapAdd
+	container.CapDrop = hostConfig.CapDrop
+	container.Ulimits = mergeUlimits(container.runtime.ulimits, hostConfig.Ulimits)
+	container.CgroupParent = cgroupParentPath(hostConfig.CgroupParent)
+	// The numbers of the block devices are found again each time, like the
+	// nodes of the devices
+	throttles, err := findBlkioThrottles(hostConfig)
+	if err != nil {
+		return err
+	}
+	container.BlkioWeight = hostConfig.BlkioWeight
+	container.BlkioThrottles = throttles
+	container.OomKillDisable = hostConfig.OomKillDisable
+	if container.OomKillDisable && !container.runtime.capabilities.MemoryLimit {
+		log.Printf("WARNING: Your kernel does not support memory limit capabilities. OOM kill disable discarded.\n")
+		container.OomKillDisable = false
+	} else if container.OomKillDisable && container.Config.Memory == 0 {
+		log.Printf("WARNING: %s: The OOM killer is disabled without a memory limit, the host may run out of memory.\n", container.ID)
+	}
+	container.OomScoreAdj = hostConfig.OomScoreAdj
+	if err := container.setupSeccomp(securityOpt); err != nil {
+		return err
+	}
+
 	if err := container.generateLXCConfig(); err != nil {
 		return err
 	}
+	if container.CgroupParent != "" {
+		config, err := ioutil.ReadFile(container.lxcConfigPath())
+		if err != nil {
+			return err
+		}
+		if err := createCgroups(container.CgroupParent, container.ID, lxcCgroupSettings(config)); err != nil {
+			return err
+		}
+	}
 
 	params := []string{
 		"-n", container.ID,
 		"-f", container.lxcConfigPath(),
+	}
+	if id := getNetworkContainer(container.Config); id != "" {
+		params = append(params, "--share-net", id)
+	}
+	if ns := sharedNamespace(container.PidMode); ns != "" {
+		params = append(params, "--share-pid", ns)
+	}
+	if ns := sharedNamespace(container.IpcMode); ns != "" {
+		params = append(params, "--share-ipc", ns)
+	}
+	params = append(params,
 		"--",
 		"/.dockerinit",
-	}
+	)
 
 	// Networking
-	if !container.Config.NetworkDisabled {
+	if container.network != nil {
 		params = append(params, "-g", container.network.Gateway.String())
 	}
 
-	// User
-	if container.Config.User != "" {
-		params = append(params, "-u", container.Config.User)
+	for _, sysctl := range container.Config.Sysctls {
+		params = append(params, "-sysctl", sysctl)
 	}
-
-	if container.Config.Tty {
-		params = append(params, "-e", "TERM=xterm")
+	if container.CgroupParent != "" {
+		params = append(params, "-cgroup", path.Join(container.CgroupParent, container.ID))
 	}
 
-	// Setup environment
-	params = append(params,
-		"-e", "HOME=/",
-		"-e", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-		"-e", "container=lxc",
-		"-e", "HOSTNAME="+container.Config.Hostname,
-	)
+	workingDir := ""
 	if container.Config.WorkingDir != "" {
-		workingDir := path.Clean(container.Config.WorkingDir)
+		workingDir = path.Clean(container.Config.WorkingDir)
 		utils.Debugf("[working dir] working dir is %s", workingDir)
 
 		if err := os.MkdirAll(path.Join(container.RootfsPath(), workingDir), 0755); err != nil {
 			return nil
 		}
-
-		params = append(params,
-			"-w", workingDir,
-		)
-	}
-
-	for _, elem := range container.Config.Env {
-		params = append(params, "-e", elem)
 	}
+	params = append(params, container.processParams(container.Config.User, workingDir, container.Config.Tty, nil)...)
 
 	// Program
 	params = append(params, "--", container.Path)
@@ -700,15 +1637,15 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 
 	container.cmd = exec.Command("lxc-start", params...)
 
-	// Setup logging of stdout and stderr to disk
-	if err := container.runtime.LogToDisk(container.stdout, container.logPath("json"), "stdout"); err != nil {
-		return err
-	}
-	if err := container.runtime.LogToDisk(container.stderr, container.logPath("json"), "stderr"); err != nil {
+	// Setup logging of stdout and stderr
+	logDriver, err := newLogDriver(container, hostConfig.LogConfig)
+	if err != nil {
 		return err
 	}
+	container.logDriver = logDriver
+	container.stdout.AddWriter(&logWriter{driver: logDriver, source: "stdout"}, "")
+	container.stderr.AddWriter(&logWriter{driver: logDriver, source: "stderr"}, "")
 
-	var err error
 	if container.Config.Tty {
 		err = container.startPty()
 	} else {
@@ -717,6 +1654,24 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 	if err != nil {
 		return err
 	}
+	if container.CgroupParent != "" {
+		if err := container.joinCgroups(); err != nil {
+			container.cmd.Process.Kill()
+			container.cmd.Wait()
+			container.releaseNetwork()
+			removeCgroups(container.CgroupParent, container.ID)
+			return err
+		}
+	}
+	if veth := container.NetworkSettings.HostInterface; veth != "" {
+		if err := shapeVeth(veth, hostConfig.NetRateEgress, hostConfig.NetRateIngress); err != nil {
+			// Better not to run than to run without the limits
+			container.cmd.Process.Kill()
+			container.cmd.Wait()
+			container.releaseNetwork()
+			return err
+		}
+	}
 	// FIXME: save state on disk *first*, then converge
 	// this way disk state is used as a journal, eg. we can restore after crash etc.
 	container.State.setRunning(container.cmd.Process.Pid)
@@ -724,12 +1679,68 @@ func (container *Container) Start(hostConfig *HostConfig) error {
 	// Init the lock
 	container.waitLock = make(chan struct{})
 
+	atomic.StoreInt32(&container.oomKills, 0)
+	// The kernel doesn't kill anything without the OOM killer
+	if !container.OomKillDisable {
+		go container.watchOOM(container.waitLock)
+	}
+
+	container.State.Health = nil
+	container.startHealthMonitor()
+
+	container.MountedVolumes = mountedVolumes
 	container.ToDisk()
 	container.SaveHostConfig(hostConfig)
 	go container.monitor()
 	return nil
 }
 
+// The options of dockerinit setting up the user, the environment and the
+// working directory of a process of the container. env is added to the
+// environment of the container.
+func (container *Container) processParams(user, workingDir string, tty bool, env []string) []string {
+	var params []string
+	// User
+	if user != "" {
+		params = append(params, "-u", user)
+	}
+
+	if tty {
+		params = append(params, "-e", "TERM=xterm")
+	}
+
+	// Setup environment
+	params = append(params,
+		"-e", "HOME=/",
+		"-e", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"-e", "container=lxc",
+		"-e", "HOSTNAME="+container.Config.Hostname,
+	)
+	if workingDir != "" {
+		params = append(params, "-w", workingDir)
+	}
+	if container.SeccompProfilePath != "" {
+		params = append(params, "-seccomp", "/.dockerseccomp")
+	}
+	for _, ulimit := range container.Ulimits {
+		params = append(params, "-ulimit", ulimit.String())
+	}
+	if container.OomScoreAdj != 0 {
+		params = append(params, "-oom-score-adj", strconv.Itoa(container.OomScoreAdj))
+	}
+
+	for _, elem := range container.DeviceEnv {
+		params = append(params, "-e", elem)
+	}
+	for _, elem := range container.Config.Env {
+		params = append(params, "-e", elem)
+	}
+	for _, elem := range env {
+		params = append(params, "-e", elem)
+	}
+	return params
+}
+
 func (container *Container) Run() error {
 	hostConfig := &HostConfig{}
 	if err := container.Start(hostConfig); err != nil {
@@ -773,59 +1784,465 @@ func (container *Container) StderrPipe() (io.ReadCloser, error) {
 	return utils.NewBufReader(reader), nil
 }
 
-func (container *Container) allocateNetwork() error {
+// Prefix of Config.Network for the containers which share the network
+// namespace of another container
+const networkContainerPrefix = "container:"
+
+// The ID of the container whose network namespace is shared by the container
+// of config (e.g: a sniffer or a debugger), "" if it has its own network.
+func getNetworkContainer(config *Config) string {
+	if !strings.HasPrefix(config.Network, networkContainerPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(config.Network, networkContainerPrefix)
+}
+
+// The -pid and -ipc of a host config: host, or container:ID
+func validateNamespaceMode(kind, mode string) error {
+	if mode == "" || mode == "host" || (strings.HasPrefix(mode, networkContainerPrefix) && len(mode) > len(networkContainerPrefix)) {
+		return nil
+	}
+	return fmt.Errorf("Bad parameter: invalid %s mode %s, expected host or container:ID", kind, mode)
+}
+
+// The namespace of the PidMode or the IpcMode of a container for
+// lxc-start --share-pid and --share-ipc: the one of the init of the host,
+// or of a container. "" if the container has its own one.
+func sharedNamespace(mode string) string {
+	if mode == "host" {
+		return "1"
+	}
+	return strings.TrimPrefix(mode, networkContainerPrefix)
+}
+
+// The PidMode or IpcMode of the container: host, or container: and the ID
+// of the running container it joins the namespace of
+func (container *Container) joinNamespace(kind, mode string) (string, *Container, error) {
+	if !strings.HasPrefix(mode, networkContainerPrefix) {
+		if mode == "host" && container.IDMappings != nil {
+			return "", nil, fmt.Errorf("Bad parameter: a container can't join the %s namespace of the host in the user namespace of the daemon, use -userns host", kind)
+		}
+		return mode, nil, nil
+	}
+	id := strings.TrimPrefix(mode, networkContainerPrefix)
+	shared := container.runtime.Get(id)
+	if shared == nil {
+		return "", nil, fmt.Errorf("No such container: %s", id)
+	}
+	if shared.ID == container.ID {
+		return "", nil, fmt.Errorf("Bad parameter: the container %s can't join its own %s namespace", container.ShortID(), kind)
+	}
+	if !shared.State.Running {
+		return "", nil, fmt.Errorf("Impossible to join the %s namespace of the container %s, it is not running", kind, shared.ShortID())
+	}
+	return networkContainerPrefix + shared.ID, shared, nil
+}
+
+// Set the PID and IPC namespaces the container joins instead of having its
+// own ones. It gets the /dev/shm of the IPC namespace it joins too, the
+// POSIX shared memory lives there.
+func (container *Container) setupNamespaces(hostConfig *HostConfig) error {
+	container.PidMode, container.IpcMode, container.ShmPath = "", "", ""
+	pidMode, _, err := container.joinNamespace("pid", hostConfig.PidMode)
+	if err != nil {
+		return err
+	}
+	ipcMode, shared, err := container.joinNamespace("ipc", hostConfig.IpcMode)
+	if err != nil {
+		return err
+	}
+	if ipcMode == "host" {
+		container.ShmPath = "/dev/shm"
+	} else if shared != nil {
+		// The tmpfs of the other container is in its mount namespace
+		pid, err := lxcInitPid(shared.ID)
+		if err != nil {
+			return err
+		}
+		container.ShmPath = fmt.Sprintf("/proc/%d/root/dev/shm", pid)
+	}
+	container.PidMode, container.IpcMode = pidMode, ipcMode
+	return nil
+}
+
+// The network the container is attached to
+func (container *Container) networkName() string {
+	if container.Config.Network == "" {
+		return DefaultNetworkName
+	}
+	return container.Config.Network
+}
+
+// The names the DNS server of the network resolves to the container
+func (container *Container) dnsNames() []string {
+	names := []string{container.ID, utils.TruncateID(container.ID)}
+	if container.Config.Hostname != "" {
+		names = append(names, container.Config.Hostname)
+	}
+	return append(names, container.Config.NetworkAliases...)
+}
+
+// Unless the container has its own DNS servers, point it at the DNS server of
+// its network, or at the servers of the daemon (or of the host) if there is
+// none (e.g: the daemon restarted without it). The search domains and the
+// options of hostConfig replace the ones of the host.
+func (container *Container) setupResolvConf(hostConfig *HostConfig) error {
+	search, options := hostConfig.DnsSearch, hostConfig.DnsOptions
+	dns := container.Config.Dns
+	if len(dns) == 0 {
+		// Same network, same DNS servers
+		if id := getNetworkContainer(container.Config); id != "" && len(search) == 0 && len(options) == 0 {
+			if shared := container.runtime.Get(id); shared != nil {
+				container.ResolvConfPath = shared.ResolvConfPath
+				return nil
+			}
+		}
+		if server := container.runtime.dnsServer(container.networkName()); server != nil && !container.Config.NetworkDisabled {
+			dns = []string{server.Addr().(*net.UDPAddr).IP.String()}
+		} else {
+			dns = container.runtime.Dns
+		}
+	}
+	if len(dns) == 0 && len(search) == 0 && len(options) == 0 {
+		container.ResolvConfPath = "/etc/resolv.conf"
+		return nil
+	}
+	// What isn't set comes from the host
+	resolvConf, _ := utils.GetResolvConf()
+	if len(dns) == 0 {
+		dns = utils.GetNameservers(resolvConf)
+	}
+	if len(search) == 0 {
+		search = utils.GetSearchDomains(resolvConf)
+	} else if search[0] == "." {
+		search = nil
+	}
+	if len(options) == 0 {
+		options = utils.GetOptions(resolvConf)
+	}
+
+	var content bytes.Buffer
+	for _, dns := range dns {
+		content.WriteString("nameserver " + dns + "\n")
+	}
+	if len(search) > 0 {
+		content.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	if len(options) > 0 {
+		content.WriteString("options " + strings.Join(options, " ") + "\n")
+	}
+	container.ResolvConfPath = path.Join(container.root, "resolv.conf")
+	return ioutil.WriteFile(container.ResolvConfPath, content.Bytes(), 0644)
+}
+
+// Allocate the address and the ports of the container on its network. When
+// saved is not nil, the container is already running with the address and the
+// ports of saved (e.g: the daemon restarted), they are allocated again.
+func (container *Container) allocateNetwork(saved *NetworkSettings) error {
 	if container.Config.NetworkDisabled {
 		return nil
 	}
+	if id := getNetworkContainer(container.Config); id != "" {
+		return container.joinNetworkOf(id, saved)
+	}
 
-	iface, err := container.runtime.networkManager.Allocate()
+	networkName := container.networkName()
+	networkDriver, err := container.runtime.networkDriverOf(networkName)
+	if err != nil {
+		return err
+	}
+	var ip net.IP
+	if saved != nil && saved.IPAddress != "" {
+		ip = net.ParseIP(saved.IPAddress)
+	} else if container.Config.IPAddress != "" {
+		ip = net.ParseIP(container.Config.IPAddress)
+	}
+	iface, err := networkDriver.CreateEndpoint(networkName, ip)
 	if err != nil {
 		return err
 	}
+	// e.g: the bridge driver with -b none
+	if iface.disabled {
+		container.Config.NetworkDisabled = true
+		return nil
+	}
 	container.NetworkSettings.PortMapping = make(map[string]PortMapping)
 	container.NetworkSettings.PortMapping["Tcp"] = make(PortMapping)
 	container.NetworkSettings.PortMapping["Udp"] = make(PortMapping)
-	for _, spec := range container.Config.PortSpecs {
-		nat, err := iface.AllocatePort(spec)
-		if err != nil {
-			iface.Release()
-			return err
+	container.NetworkSettings.PortMapping["Sctp"] = make(PortMapping)
+	if iface.publishesPorts() {
+		for _, spec := range container.Config.PortSpecs {
+			nat, err := container.allocatePort(iface, spec, saved)
+			if err != nil {
+				networkDriver.Leave(networkName, iface)
+				return err
+			}
+			proto := strings.Title(nat.Proto)
+			backend, frontend := strconv.Itoa(nat.Backend), strconv.Itoa(nat.Frontend)
+			container.NetworkSettings.PortMapping[proto][backend] = frontend
 		}
-		proto := strings.Title(nat.Proto)
-		backend, frontend := strconv.Itoa(nat.Backend), strconv.Itoa(nat.Frontend)
-		container.NetworkSettings.PortMapping[proto][backend] = frontend
+	} else if len(container.Config.PortSpecs) > 0 {
+		log.Printf("WARNING: The ports of %s aren't published on network %s, use the address of the container instead", container.ID, networkName)
+	}
+	if err := networkDriver.Join(networkName, iface, container.NetworkSettings); err != nil {
+		networkDriver.Leave(networkName, iface)
+		return err
+	}
+	if err := container.setupIngressPolicy(iface); err != nil {
+		networkDriver.Leave(networkName, iface)
+		return err
 	}
 	container.network = iface
-	container.NetworkSettings.Bridge = container.runtime.networkManager.bridgeIface
-	container.NetworkSettings.IPAddress = iface.IPNet.IP.String()
-	container.NetworkSettings.IPPrefixLen, _ = iface.IPNet.Mask.Size()
-	container.NetworkSettings.Gateway = iface.Gateway.String()
 	return nil
 }
 
+// Apply the ingress policy of the container on iface, and let through the
+// traffic between the container and the running containers of its network it
+// allows or which allow it.
+func (container *Container) setupIngressPolicy(iface *NetworkInterface) error {
+	networkName := container.networkName()
+	if !iface.filtersIngress() {
+		if container.Config.IngressPolicy == "deny" {
+			return fmt.Errorf("Impossible to deny the traffic to %s: the traffic of network %s can't be filtered", container.ID, networkName)
+		}
+		return nil
+	}
+	if err := iface.SetIngressPolicy(container.Config.IngressPolicy); err != nil {
+		return err
+	}
+	for _, name := range container.Config.IngressFrom {
+		if ip := container.runtime.lookupContainer(networkName, strings.ToLower(name)); ip != nil {
+			if err := iface.AllowIngress(ip, iface.IPNet.IP); err != nil {
+				return err
+			}
+		}
+	}
+	names := make(map[string]bool)
+	for _, name := range container.dnsNames() {
+		names[strings.ToLower(name)] = true
+	}
+	for _, other := range container.runtime.List() {
+		if other == container || other.networkName() != networkName || !other.State.Running || other.NetworkSettings.IPAddress == "" {
+			continue
+		}
+		for _, name := range other.Config.IngressFrom {
+			if names[strings.ToLower(name)] {
+				if err := iface.AllowIngress(iface.IPNet.IP, net.ParseIP(other.NetworkSettings.IPAddress)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Share the network namespace of the container id: there is nothing to
+// allocate, the settings of the container are only copied for inspect.
+func (container *Container) joinNetworkOf(id string, saved *NetworkSettings) error {
+	if saved != nil {
+		*container.NetworkSettings = *saved
+		return nil
+	}
+	shared := container.runtime.Get(id)
+	if shared == nil {
+		return fmt.Errorf("No such container: %s", id)
+	}
+	if !shared.State.Running {
+		return fmt.Errorf("Impossible to join the network of %s: it isn't running", id)
+	}
+	if len(container.Config.PortSpecs) > 0 {
+		log.Printf("WARNING: The ports of %s aren't published, it shares the network of %s", container.ID, id)
+	}
+	container.NetworkSettings.IPAddress = shared.NetworkSettings.IPAddress
+	container.NetworkSettings.IPPrefixLen = shared.NetworkSettings.IPPrefixLen
+	container.NetworkSettings.Gateway = shared.NetworkSettings.Gateway
+	container.NetworkSettings.Bridge = shared.NetworkSettings.Bridge
+	return nil
+}
+
+// Publish the port spec on iface, on the same host port as in saved if the
+// port was already published.
+func (container *Container) allocatePort(iface *NetworkInterface, spec string, saved *NetworkSettings) (*Nat, error) {
+	nat, err := parseNat(spec)
+	if err != nil {
+		return nil, err
+	}
+	if saved == nil || nat.Frontend != 0 {
+		return iface.AllocateNat(nat)
+	}
+	frontend, err := strconv.Atoi(saved.PortMapping[strings.Title(nat.Proto)][strconv.Itoa(nat.Backend)])
+	if err != nil {
+		return iface.AllocateNat(nat)
+	}
+	nat.Frontend = frontend
+	allocated, err := iface.AllocateNat(nat)
+	if err != nil {
+		// The port was picked by docker, any other one will do
+		log.Printf("WARNING: Unable to publish %s of %s on port %d again, publishing it on another port: %s", spec, container.ID, frontend, err)
+		nat.Frontend = 0
+		return iface.AllocateNat(nat)
+	}
+	return allocated, nil
+}
+
+// Publish the port spec of the running container. The spec is added to the
+// configuration of the container, the port is published again when it
+// restarts.
+func (container *Container) PublishPort(spec string) (*Nat, error) {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	iface, err := container.publishingInterface()
+	if err != nil {
+		return nil, err
+	}
+	nat, err := parseNat(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Bad parameter: %s", err)
+	}
+	proto, backend := strings.Title(nat.Proto), strconv.Itoa(nat.Backend)
+	if frontend, exists := container.NetworkSettings.PortMapping[proto][backend]; exists {
+		return nil, fmt.Errorf("Conflict: port %s/%s of %s is already published on %s", backend, nat.Proto, container.ID, frontend)
+	}
+	if nat, err = iface.AllocateNat(nat); err != nil {
+		return nil, err
+	}
+	container.NetworkSettings.PortMapping[proto][backend] = strconv.Itoa(nat.Frontend)
+	container.Config.PortSpecs = append(container.Config.PortSpecs, spec)
+	if err := container.ToDisk(); err != nil {
+		return nil, err
+	}
+	return nat, nil
+}
+
+// Unpublish the port spec of the running container, and remove it from its
+// configuration.
+func (container *Container) UnpublishPort(spec string) (*Nat, error) {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	iface, err := container.publishingInterface()
+	if err != nil {
+		return nil, err
+	}
+	nat, err := iface.ReleasePort(spec)
+	if err != nil {
+		return nil, err
+	}
+	delete(container.NetworkSettings.PortMapping[strings.Title(nat.Proto)], strconv.Itoa(nat.Backend))
+	var specs []string
+	for _, s := range container.Config.PortSpecs {
+		if n, err := parseNat(s); err != nil || n.Proto != nat.Proto || n.Backend != nat.Backend {
+			specs = append(specs, s)
+		}
+	}
+	container.Config.PortSpecs = specs
+	if err := container.ToDisk(); err != nil {
+		return nil, err
+	}
+	return nat, nil
+}
+
+func (container *Container) publishingInterface() (*NetworkInterface, error) {
+	if !container.State.Running {
+		return nil, fmt.Errorf("Impossible to change the ports of a stopped container, start it first")
+	}
+	if container.network == nil || container.Config.NetworkDisabled {
+		return nil, fmt.Errorf("Impossible to publish ports: networking is disabled for %s", container.ID)
+	}
+	if !container.network.publishesPorts() {
+		return nil, fmt.Errorf("Impossible to publish ports: the ports of network %s can't be published", container.networkName())
+	}
+	return container.network, nil
+}
+
 func (container *Container) releaseNetwork() {
 	if container.Config.NetworkDisabled {
 		return
 	}
-	container.network.Release()
+	if getNetworkContainer(container.Config) != "" {
+		container.NetworkSettings = &NetworkSettings{}
+		return
+	}
+	networkName := container.networkName()
+	if networkDriver, err := container.runtime.networkDriverOf(networkName); err != nil {
+		utils.Debugf("Error releasing the network of %s: %s", container.ID, err)
+	} else if err := networkDriver.Leave(networkName, container.network); err != nil {
+		utils.Debugf("Error releasing the network of %s: %s", container.ID, err)
+	}
 	container.network = nil
 	container.NetworkSettings = &NetworkSettings{}
 }
 
+// Check whether the lxc container id is running
+func lxcRunning(id string) (bool, error) {
+	output, err := exec.Command("lxc-info", "-n", id).CombinedOutput()
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(output), "RUNNING"), nil
+}
+
+// The pid of the init of the lxc container id on the host
+func lxcInitPid(id string) (int, error) {
+	output, err := exec.Command("lxc-info", "-n", id, "-p").CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to find the init of the container %s: %s (%s)", id, err, output)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "PID:" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, fmt.Errorf("Unable to find the init of the container %s: %s", id, output)
+}
+
+// Move the init of the container into its cgroups under its cgroup parent
+// once lxc-start has started it, dockerinit waits for it before running the
+// program
+func (container *Container) joinCgroups() error {
+	var err error
+	for i := 0; i < 50; i++ {
+		var pid int
+		if pid, err = lxcInitPid(container.ID); err == nil {
+			return joinCgroups(container.CgroupParent, container.ID, pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
 // FIXME: replace this with a control socket within docker-init
 func (container *Container) waitLxc() error {
 	for {
-		output, err := exec.Command("lxc-info", "-n", container.ID).CombinedOutput()
+		running, err := lxcRunning(container.ID)
 		if err != nil {
 			return err
 		}
-		if !strings.Contains(string(output), "RUNNING") {
+		if !running {
 			return nil
 		}
 		time.Sleep(500 * time.Millisecond)
 	}
 }
 
+// The exit code and the signal which killed the process of a container,
+// from the status of lxc-start. lxc-start isn't killed itself: it exits with
+// the code the shells report for the process, 128 + the signal if it was
+// killed, which can't be told apart from the same code given to exit.
+func exitStatus(status syscall.WaitStatus) (exitCode, exitSignal int) {
+	if status.Signaled() {
+		exitSignal = int(status.Signal())
+		return 128 + exitSignal, exitSignal
+	}
+	exitCode = status.ExitStatus()
+	if exitCode > 128 && exitCode <= 128+64 {
+		exitSignal = exitCode - 128
+	}
+	return exitCode, exitSignal
+}
+
 func (container *Container) monitor() {
 	// Wait for the program to exit
 	utils.Debugf("Waiting for process")
@@ -845,13 +2262,16 @@ func (container *Container) monitor() {
 	if container.runtime != nil && container.runtime.srv != nil {
 		container.runtime.srv.LogEvent("die", container.ShortID(), container.runtime.repositories.ImageName(container.Image))
 	}
-	exitCode := -1
+	exitCode, exitSignal := -1, 0
 	if container.cmd != nil {
-		exitCode = container.cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+		exitCode, exitSignal = exitStatus(container.cmd.ProcessState.Sys().(syscall.WaitStatus))
 	}
 
 	// Cleanup
 	container.releaseNetwork()
+	if container.runtime != nil {
+		container.releaseDevices()
+	}
 	if container.Config.OpenStdin {
 		if err := container.stdin.Close(); err != nil {
 			utils.Debugf("%s: Error close stdin: %s", container.ID, err)
@@ -863,6 +2283,9 @@ func (container *Container) monitor() {
 	if err := container.stderr.CloseWriters(); err != nil {
 		utils.Debugf("%s: Error close stderr: %s", container.ID, err)
 	}
+	if err := container.logDriver.Close(); err != nil {
+		utils.Debugf("%s: Error closing the log driver: %s", container.ID, err)
+	}
 
 	if container.ptyMaster != nil {
 		if err := container.ptyMaster.Close(); err != nil {
@@ -870,9 +2293,18 @@ func (container *Container) monitor() {
 		}
 	}
 
+	container.cleanupDevices()
 	if err := container.Unmount(); err != nil {
 		log.Printf("%v: Failed to umount filesystem: %v", container.ID, err)
 	}
+	if container.runtime != nil {
+		container.runtime.unmountVolumes(container)
+	}
+	if container.CgroupParent != "" {
+		if err := removeCgroups(container.CgroupParent, container.ID); err != nil {
+			utils.Debugf("%s: Error removing the cgroups: %s", container.ID, err)
+		}
+	}
 
 	// Re-create a brand new stdin pipe once the container exited
 	if container.Config.OpenStdin {
@@ -881,6 +2313,14 @@ func (container *Container) monitor() {
 
 	// Report status back
 	container.State.setStopped(exitCode)
+	container.State.ExitSignal = exitSignal
+	container.State.OOMKilled = atomic.LoadInt32(&container.oomKills) > 0
+	container.waitersLock.Lock()
+	for _, waiter := range container.exitWaiters {
+		waiter <- exitCode
+	}
+	container.exitWaiters = nil
+	container.waitersLock.Unlock()
 
 	// Release the lock
 	close(container.waitLock)
@@ -894,12 +2334,27 @@ func (container *Container) monitor() {
 		// FIXME: why are we serializing running state to disk in the first place?
 		//log.Printf("%s: Failed to dump configuration to the disk: %s", container.ID, err)
 	}
+
+	container.supervise(exitCode)
+
+	container.State.Lock()
+	autoRemove := container.autoRemove
+	container.State.Unlock()
+	if autoRemove && container.runtime != nil {
+		container.runtime.autoRemove(container)
+	}
 }
 
 func (container *Container) kill() error {
 	if !container.State.Running {
 		return nil
 	}
+	// The frozen processes wouldn't die
+	if container.State.Paused {
+		if err := container.unpause(); err != nil {
+			return err
+		}
+	}
 
 	// Sending SIGKILL to the process via lxc
 	output, err := exec.Command("lxc-kill", "-n", container.ID, "9").CombinedOutput()
@@ -926,31 +2381,64 @@ func (container *Container) kill() error {
 func (container *Container) Kill() error {
 	container.State.Lock()
 	defer container.State.Unlock()
+	container.stopRequested = true
 	if !container.State.Running {
 		return nil
 	}
 	return container.kill()
 }
 
+// Stop sends the stop signal of the container to its process, and kills it if
+// it still runs after seconds (the stop timeout of the container if < 0).
 func (container *Container) Stop(seconds int) error {
 	container.State.Lock()
 	defer container.State.Unlock()
+	container.stopRequested = true
 	if !container.State.Running {
 		return nil
 	}
+	if seconds < 0 {
+		seconds = container.Config.StopTimeout
+		if seconds == 0 {
+			seconds = 10
+		}
+	}
+	signal := syscall.SIGTERM
+	if container.Config.StopSignal != "" {
+		var err error
+		if signal, err = parseSignal(container.Config.StopSignal); err != nil {
+			log.Printf("WARNING: %s, sending SIGTERM to %s", err, container.ID)
+			signal = syscall.SIGTERM
+		}
+	}
 
-	// 1. Send a SIGTERM
-	if output, err := exec.Command("lxc-kill", "-n", container.ID, "15").CombinedOutput(); err != nil {
+	// The draining and the wait for the process share the timeout
+	deadline := time.Now().Add(time.Duration(seconds) * time.Second)
+
+	// 0. Let the connections going through the published ports finish
+	if container.network != nil {
+		container.network.Drain(deadline.Sub(time.Now()))
+	}
+
+	// The frozen processes wouldn't get the signal
+	if container.State.Paused {
+		if err := container.unpause(); err != nil {
+			return err
+		}
+	}
+
+	// 1. Send the stop signal, SIGTERM by default
+	if output, err := exec.Command("lxc-kill", "-n", container.ID, strconv.Itoa(int(signal))).CombinedOutput(); err != nil {
 		log.Print(string(output))
-		log.Print("Failed to send SIGTERM to the process, force killing")
+		log.Printf("Failed to send signal %d to the process, force killing", signal)
 		if err := container.kill(); err != nil {
 			return err
 		}
 	}
 
 	// 2. Wait for the process to exit on its own
-	if err := container.WaitTimeout(time.Duration(seconds) * time.Second); err != nil {
-		log.Printf("Container %v failed to exit within %d seconds of SIGTERM - using the force", container.ID, seconds)
+	if err := container.WaitTimeout(deadline.Sub(time.Now())); err != nil {
+		log.Printf("Container %v failed to exit within %d seconds of signal %d - using the force", container.ID, seconds, signal)
 		if err := container.kill(); err != nil {
 			return err
 		}
@@ -958,6 +2446,230 @@ func (container *Container) Stop(seconds int) error {
 	return nil
 }
 
+// Pause freezes all the processes of the container, with the freezer cgroup,
+// until Unpause.
+func (container *Container) Pause() error {
+	container.State.Lock()
+	defer container.State.Unlock()
+	if !container.State.Running {
+		return fmt.Errorf("Impossible to pause the container %s, it's not running", container.ID)
+	}
+	if container.State.Ghost {
+		return fmt.Errorf("Impossible to pause a ghost container")
+	}
+	if container.State.Paused {
+		return fmt.Errorf("Conflict: the container %s is already paused", container.ID)
+	}
+	// lxc-freeze freezes the cgroup of lxc, the container isn't in it
+	// under a cgroup parent
+	if container.CgroupParent != "" {
+		if err := freezeCgroup(container.CgroupParent, container.ID, "FROZEN"); err != nil {
+			freezeCgroup(container.CgroupParent, container.ID, "THAWED")
+			return fmt.Errorf("Unable to freeze the container %s: %s", container.ID, err)
+		}
+	} else if output, err := exec.Command("lxc-freeze", "-n", container.ID).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to freeze the container %s: %s (%s)", container.ID, err, output)
+	}
+	container.State.Paused = true
+	return container.ToDisk()
+}
+
+func (container *Container) Unpause() error {
+	container.State.Lock()
+	defer container.State.Unlock()
+	if !container.State.Running || !container.State.Paused {
+		return fmt.Errorf("Impossible to unpause the container %s, it's not paused", container.ID)
+	}
+	if err := container.unpause(); err != nil {
+		return err
+	}
+	return container.ToDisk()
+}
+
+func (container *Container) unpause() error {
+	if container.CgroupParent != "" {
+		if err := freezeCgroup(container.CgroupParent, container.ID, "THAWED"); err != nil {
+			return fmt.Errorf("Unable to thaw the container %s: %s", container.ID, err)
+		}
+	} else if output, err := exec.Command("lxc-unfreeze", "-n", container.ID).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to thaw the container %s: %s (%s)", container.ID, err, output)
+	}
+	container.State.Paused = false
+	return nil
+}
+
+// Update changes the resources of the container. The cgroups of a running
+// container are changed right away, with lxc-cgroup.
+func (container *Container) Update(update *UpdateConfig) error {
+	if update.Memory != 0 && update.Memory < 524288 {
+		return fmt.Errorf("Bad parameter: Memory limit must be given in bytes (minimum 524288 bytes)")
+	}
+	if update.CpuShares < 0 {
+		return fmt.Errorf("Bad parameter: invalid CPU shares %d", update.CpuShares)
+	}
+	if update.Cpuset != "" && !validCpuset.MatchString(update.Cpuset) {
+		return fmt.Errorf("Bad parameter: invalid cpuset %s", update.Cpuset)
+	}
+	if update.CpusetMems != "" && !validCpuset.MatchString(update.CpusetMems) {
+		return fmt.Errorf("Bad parameter: invalid cpuset mems %s", update.CpusetMems)
+	}
+	if err := validateCpuQuota(update.CpuPeriod, update.CpuQuota); err != nil {
+		return err
+	}
+	capabilities := container.runtime.capabilities
+	if update.Memory > 0 && !capabilities.MemoryLimit {
+		return fmt.Errorf("Impossible to limit the memory: your kernel does not support memory limit capabilities")
+	}
+	if (update.CpuPeriod != 0 || update.CpuQuota != 0) && !capabilities.CpuCfsQuota {
+		return fmt.Errorf("Impossible to set the CPU quota: your kernel does not support CPU CFS quota")
+	}
+
+	container.State.Lock()
+	defer container.State.Unlock()
+	config := *container.Config
+	if update.Memory > 0 {
+		config.Memory = update.Memory
+	}
+	if update.CpuShares > 0 {
+		config.CpuShares = update.CpuShares
+	}
+	if update.Cpuset != "" {
+		config.Cpuset = update.Cpuset
+	}
+	if update.CpusetMems != "" {
+		config.CpusetMems = update.CpusetMems
+	}
+	if update.CpuPeriod != 0 {
+		config.CpuPeriod = update.CpuPeriod
+	}
+	if update.CpuQuota != 0 {
+		config.CpuQuota = update.CpuQuota
+	}
+	if config.MemorySwap > 0 && config.Memory > config.MemorySwap {
+		return fmt.Errorf("Bad parameter: the memory limit %d must be below the memory swap limit %d", config.Memory, config.MemorySwap)
+	}
+
+	if container.State.Running {
+		var values [][2]string
+		if update.Memory > 0 {
+			memory := strconv.FormatInt(config.Memory, 10)
+			values = append(values, [2]string{"memory.limit_in_bytes", memory})
+			if config.MemoryReservation == 0 {
+				values = append(values, [2]string{"memory.soft_limit_in_bytes", memory})
+			}
+			if memSwap := getMemorySwap(&config); memSwap > 0 && capabilities.SwapLimit {
+				swap := [2]string{"memory.memsw.limit_in_bytes", strconv.FormatInt(memSwap, 10)}
+				// memsw can't go below the memory limit: raise it first, lower it last
+				if container.Config.Memory > 0 && config.Memory > container.Config.Memory {
+					values = append([][2]string{swap}, values...)
+				} else {
+					values = append(values, swap)
+				}
+			}
+		}
+		if update.CpuShares > 0 {
+			values = append(values, [2]string{"cpu.shares", strconv.FormatInt(config.CpuShares, 10)})
+		}
+		if update.Cpuset != "" {
+			values = append(values, [2]string{"cpuset.cpus", config.Cpuset})
+		}
+		if update.CpusetMems != "" {
+			values = append(values, [2]string{"cpuset.mems", config.CpusetMems})
+		}
+		if update.CpuPeriod != 0 {
+			values = append(values, [2]string{"cpu.cfs_period_us", strconv.FormatInt(config.CpuPeriod, 10)})
+		}
+		if update.CpuQuota != 0 {
+			values = append(values, [2]string{"cpu.cfs_quota_us", strconv.FormatInt(config.CpuQuota, 10)})
+		}
+		for _, value := range values {
+			var err error
+			if container.CgroupParent != "" {
+				err = setCgroup(container.CgroupParent, container.ID, value[0], value[1])
+			} else {
+				err = lxcCgroup(container.ID, value[0], value[1])
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	*container.Config = config
+	return container.ToDisk()
+}
+
+// Count the OOM kills in the container until stop is closed, when its process
+// exits. lxc-start creates the cgroups of the container after it's started.
+func (container *Container) watchOOM(stop chan struct{}) {
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = notifyOOM(container.CgroupParent, container.ID, stop, func() {
+			utils.Debugf("%s: A process was killed by the kernel, out of memory", container.ID)
+			atomic.AddInt32(&container.oomKills, 1)
+		}); err == nil {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	utils.Debugf("%s: Unable to watch the OOM kills: %s", container.ID, err)
+}
+
+// The directory of the cgroup of the subsystem of a running container, under
+// its cgroup parent if it has one
+func cgroupPath(subsystem, parent, id string) (string, error) {
+	mountpoint, err := utils.FindCgroupMountpoint(subsystem)
+	if err != nil {
+		return "", err
+	}
+	if parent != "" {
+		dir := path.Join(mountpoint, parent, id)
+		if _, err := os.Stat(dir); err != nil {
+			return "", fmt.Errorf("The %s cgroup of the container %s was not found under %s", subsystem, id, parent)
+		}
+		return dir, nil
+	}
+	// lxc creates the cgroups of the containers under lxc/ since 0.8
+	for _, dir := range []string{path.Join(mountpoint, "lxc", id), path.Join(mountpoint, id)} {
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("The %s cgroup of the container %s was not found", subsystem, id)
+}
+
+// The PIDs, on the host, of the processes of a running container
+func (container *Container) pids() (map[int]bool, error) {
+	dir, err := cgroupPath("cpuacct", container.CgroupParent, container.ID)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := ioutil.ReadFile(path.Join(dir, "tasks"))
+	if err != nil {
+		return nil, err
+	}
+	pids := make(map[int]bool)
+	for _, field := range strings.Fields(string(tasks)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tasks of the container %s: %s", container.ID, tasks)
+		}
+		pids[pid] = true
+	}
+	return pids, nil
+}
+
+// Set the value of the cgroup of a running container
+func lxcCgroup(id, key, value string) error {
+	if output, err := exec.Command("lxc-cgroup", "-n", id, key, value).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to set %s of the container %s: %s (%s)", key, id, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
 func (container *Container) Restart(seconds int) error {
 	if err := container.Stop(seconds); err != nil {
 		return err
@@ -975,20 +2687,43 @@ func (container *Container) Wait() int {
 	return container.State.ExitCode
 }
 
+// WaitNextExit blocks until the process of the container exits, after the
+// container is started if it isn't running, then returns its exit code. It
+// returns the last exit code if the container is destroyed meanwhile.
+func (container *Container) WaitNextExit() int {
+	waiter := make(chan int, 1)
+	container.waitersLock.Lock()
+	container.exitWaiters = append(container.exitWaiters, waiter)
+	container.waitersLock.Unlock()
+	select {
+	case exitCode := <-waiter:
+		return exitCode
+	case <-container.removed:
+		return container.State.ExitCode
+	}
+}
+
+// WaitRemoved blocks until the container is destroyed, then returns the exit
+// code of its last run.
+func (container *Container) WaitRemoved() int {
+	<-container.removed
+	return container.State.ExitCode
+}
+
 func (container *Container) Resize(h, w int) error {
 	pty, ok := container.ptyMaster.(*os.File)
-	if !ok {
-		return fmt.Errorf("ptyMaster does not have Fd() method")
+	if !ok || !container.State.Running {
+		return fmt.Errorf("Impossible to resize the container %s, it has no running tty", container.ShortID())
 	}
 	return term.SetWinsize(pty.Fd(), &term.Winsize{Height: uint16(h), Width: uint16(w)})
 }
 
 func (container *Container) ExportRw() (Archive, error) {
-	return Tar(container.rwPath(), Uncompressed)
+	return container.containerArchive(container.runtime.graph.driver.Diff(container.ID))
 }
 
 func (container *Container) RwChecksum() (string, error) {
-	rwData, err := Tar(container.rwPath(), Xz)
+	rwData, err := container.runtime.graph.driver.Diff(container.ID)
 	if err != nil {
 		return "", err
 	}
@@ -999,7 +2734,16 @@ func (container *Container) Export() (Archive, error) {
 	if err := container.EnsureMounted(); err != nil {
 		return nil, err
 	}
-	return Tar(container.RootfsPath(), Uncompressed)
+	return container.containerArchive(Tar(container.RootfsPath(), Uncompressed))
+}
+
+// An archive of the files of the container with the ids it sees them
+// with, with -userns-remap
+func (container *Container) containerArchive(archive Archive, err error) (Archive, error) {
+	if err != nil || container.runtime.idMappings == nil {
+		return archive, err
+	}
+	return container.runtime.idMappings.containerArchive(archive), nil
 }
 
 func (container *Container) WaitTimeout(timeout time.Duration) error {
@@ -1017,29 +2761,23 @@ func (container *Container) WaitTimeout(timeout time.Duration) error {
 	}
 }
 
+// The graph driver returns the same path when the filesystem is already
+// mounted
 func (container *Container) EnsureMounted() error {
-	if mounted, err := container.Mounted(); err != nil {
-		return err
-	} else if mounted {
-		return nil
-	}
 	return container.Mount()
 }
 
 func (container *Container) Mount() error {
-	image, err := container.GetImage()
+	basefs, err := container.runtime.graph.driver.Get(container.ID)
 	if err != nil {
 		return err
 	}
-	return image.Mount(container.RootfsPath(), container.rwPath())
+	container.basefs = basefs
+	return nil
 }
 
 func (container *Container) Changes() ([]Change, error) {
-	image, err := container.GetImage()
-	if err != nil {
-		return nil, err
-	}
-	return image.Changes(container.rwPath())
+	return container.runtime.graph.driver.Changes(container.ID)
 }
 
 func (container *Container) GetImage() (*Image, error) {
@@ -1049,12 +2787,8 @@ func (container *Container) GetImage() (*Image, error) {
 	return container.runtime.graph.Get(container.Image)
 }
 
-func (container *Container) Mounted() (bool, error) {
-	return Mounted(container.RootfsPath())
-}
-
 func (container *Container) Unmount() error {
-	return Unmount(container.RootfsPath())
+	return container.runtime.graph.driver.Put(container.ID)
 }
 
 // ShortID returns a shorthand version of the container's id for convenience.
@@ -1069,8 +2803,19 @@ func (container *Container) logPath(name string) string {
 	return path.Join(container.root, fmt.Sprintf("%s-%s.log", container.ID, name))
 }
 
-func (container *Container) ReadLog(name string) (io.Reader, error) {
-	return os.Open(container.logPath(name))
+// ReadLog reads the log name of the container, after its rotated logs
+func (container *Container) ReadLog(name string) (io.ReadCloser, error) {
+	return openRotatedLog(container.logPath(name))
+}
+
+// Whether the log driver of the container keeps the logs ReadLog reads
+func (container *Container) logsReadable() bool {
+	hostConfig, err := container.ReadHostConfig()
+	if err != nil {
+		return true
+	}
+	driver, exists := logDrivers[hostConfig.LogConfig.Type]
+	return hostConfig.LogConfig.Type == "" || (exists && driver.readable)
 }
 
 func (container *Container) hostConfigPath() string {
@@ -1081,17 +2826,17 @@ func (container *Container) jsonPath() string {
 	return path.Join(container.root, "config.json")
 }
 
+func (container *Container) seccompProfilePath() string {
+	return path.Join(container.root, "seccomp.json")
+}
+
 func (container *Container) lxcConfigPath() string {
 	return path.Join(container.root, "config.lxc")
 }
 
 // This method must be exported to be used from the lxc template
 func (container *Container) RootfsPath() string {
-	return path.Join(container.root, "rootfs")
-}
-
-func (container *Container) rwPath() string {
-	return path.Join(container.root, "rw")
+	return container.basefs
 }
 
 func validateID(id string) error {
@@ -1103,17 +2848,15 @@ func validateID(id string) error {
 
 // GetSize, return real size, virtual size
 func (container *Container) GetSize() (int64, int64) {
-	var sizeRw, sizeRootfs int64
+	var sizeRootfs int64
 
-	filepath.Walk(container.rwPath(), func(path string, fileInfo os.FileInfo, err error) error {
-		if fileInfo != nil {
-			sizeRw += fileInfo.Size()
-		}
-		return nil
-	})
+	sizeRw, err := container.runtime.graph.driver.DiffSize(container.ID)
+	if err != nil {
+		utils.Debugf("%s: Error getting the size of its layer: %s", container.ID, err)
+	}
 
-	_, err := os.Stat(container.RootfsPath())
-	if err == nil {
+	// The filesystem of the container, if it was mounted
+	if _, err := os.Stat(container.RootfsPath()); err == nil {
 		filepath.Walk(container.RootfsPath(), func(path string, fileInfo os.FileInfo, err error) error {
 			if fileInfo != nil {
 				sizeRootfs += fileInfo.Size()
@@ -1142,5 +2885,5 @@ func (container *Container) Copy(resource string) (Archive, error) {
 		filter = []string{path.Base(basePath)}
 		basePath = path.Dir(basePath)
 	}
-	return TarFilter(basePath, Uncompressed, filter)
+	return container.containerArchive(TarFilter(basePath, Uncompressed, filter))
 }
@@ -2,15 +2,30 @@ package docker
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"fmt"
+	"github.com/dotcloud/docker/utils"
 	"io"
 	"io/ioutil"
+	"log/syslog"
+	"math/big"
 	"math/rand"
+	"net"
 	"os"
+	"os/exec"
 	"path"
 	"regexp"
 	"sort"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -517,6 +532,173 @@ func TestKill(t *testing.T) {
 	}
 }
 
+func TestHealthcheck(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"cat"},
+
+		OpenStdin: true,
+		Healthcheck: &HealthConfig{
+			Test:     []string{"test", "-e", "/tmp/healthy"},
+			Interval: 100 * time.Millisecond,
+			Retries:  2,
+		},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	waitHealth := func(status string) {
+		setTimeout(t, "The container didn't get "+status, 10*time.Second, func() {
+			for {
+				container.State.Lock()
+				current := container.State.Health.Status
+				container.State.Unlock()
+				if current == status {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	}
+	if status := container.State.Health.Status; status != HealthStarting {
+		t.Fatalf("Unexpected health before the first probe: %s", status)
+	}
+	waitHealth(HealthUnhealthy)
+	if !strings.Contains(container.State.String(), "(unhealthy)") {
+		t.Fatalf("The health should be in the state: %s", container.State.String())
+	}
+
+	e, err := runtime.CreateExec(container, &ExecConfig{Cmd: []string{"touch", "/tmp/healthy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Start(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	e.Wait()
+	waitHealth(HealthHealthy)
+
+	container.State.Lock()
+	defer container.State.Unlock()
+	if streak := container.State.Health.FailingStreak; streak != 0 {
+		t.Fatalf("The failing streak should be reset: %d", streak)
+	}
+	if log := container.State.Health.Log; len(log) == 0 || len(log) > healthLogSize || log[len(log)-1].ExitCode != 0 {
+		t.Fatalf("Unexpected health log: %v", log)
+	}
+}
+
+func TestHealthcheckTimeout(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"cat"},
+
+		OpenStdin: true,
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	// The probe which times out is killed in the container too
+	result := container.probe([]string{"sh", "-c", "sleep 1; touch /tmp/survived"}, 200*time.Millisecond)
+	if result.ExitCode != -1 || !strings.Contains(result.Output, "timed out") {
+		t.Fatalf("The probe should have timed out: %v", result)
+	}
+	time.Sleep(2 * time.Second)
+	if _, err := os.Stat(path.Join(container.RootfsPath(), "tmp", "survived")); !os.IsNotExist(err) {
+		t.Fatalf("The probe should have been killed in the container")
+	}
+}
+
+func TestPause(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"sh", "-c", "while true; do date +%s; sleep 0.1; done"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Pause(); err == nil {
+		t.Fatal("It should be impossible to pause a stopped container")
+	}
+	stdout, err := container.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	hostConfig := &HostConfig{}
+	if err := container.Start(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(stdout)
+	if !lines.Scan() {
+		t.Fatal("The container didn't print anything")
+	}
+
+	if err := container.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if !container.State.Paused || !strings.HasSuffix(container.State.String(), "(Paused)") {
+		t.Fatalf("The container should be paused: %s", container.State.String())
+	}
+	if err := container.Pause(); err == nil {
+		t.Fatal("A container shouldn't be paused twice")
+	}
+	output := make(chan bool)
+	go func() {
+		output <- lines.Scan()
+	}()
+	select {
+	case <-output:
+		t.Fatal("A paused container shouldn't print anything")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err := container.Unpause(); err != nil {
+		t.Fatal(err)
+	}
+	setTimeout(t, "The unpaused container didn't print anything", 2*time.Second, func() {
+		<-output
+	})
+	if container.State.Paused {
+		t.Fatal("The container shouldn't be paused")
+	}
+
+	// A paused container can be killed
+	if err := container.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if container.State.Running || container.State.Paused {
+		t.Fatalf("Unexpected state of the killed container: %s", container.State.String())
+	}
+}
+
 func TestExitCode(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -554,6 +736,86 @@ func TestExitCode(t *testing.T) {
 	}
 }
 
+func TestOOMKilled(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	if !runtime.capabilities.MemoryLimit || !runtime.capabilities.SwapLimit {
+		t.Skip("The kernel doesn't support the memory and swap limits")
+	}
+
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:      GetTestImage(runtime).ID,
+		Cmd:        []string{"tail", "/dev/zero"},
+		Memory:     4 * 1024 * 1024,
+		MemorySwap: 4 * 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	setTimeout(t, "The container wasn't killed", 10*time.Second, func() {
+		if err := container.Run(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !container.State.OOMKilled {
+		t.Fatalf("The container should have been killed out of memory: %s", container.State.String())
+	}
+	if !strings.Contains(container.State.String(), "OOM killed") {
+		t.Fatalf("The state should say the container was OOM killed: %s", container.State.String())
+	}
+
+	// The next run isn't OOM killed
+	container.Path, container.Args = "true", nil
+	if err := container.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if container.State.OOMKilled || container.State.ExitSignal != 0 {
+		t.Fatalf("The state of the previous run wasn't reset: %s, signal %d", container.State.String(), container.State.ExitSignal)
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	netDev := `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:     840      10    0    0    0     0          0         0      840      10    0    0    0     0       0          0
+  eth0:    2048      16    1    2    0     0          0         0     1024       8    3    4    0     0       0          0
+`
+	if err := ioutil.WriteFile(path.Join(dir, "dev"), []byte(netDev), 0600); err != nil {
+		t.Fatal(err)
+	}
+	networks, err := readNetworkStats(path.Join(dir, "dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NetworkStats{RxBytes: 2048, RxPackets: 16, RxErrors: 1, RxDropped: 2, TxBytes: 1024, TxPackets: 8, TxErrors: 3, TxDropped: 4}
+	if len(networks) != 1 || networks["eth0"] == nil || *networks["eth0"] != expected {
+		t.Fatalf("Unexpected network stats: %v", networks)
+	}
+
+	blkio := "8:0 Read 1024\n8:0 Write 512\n8:16 Read 1024\n8:16 Sync 42\nTotal 2560\n"
+	if err := ioutil.WriteFile(path.Join(dir, "blkio.throttle.io_service_bytes"), []byte(blkio), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := readBlkioStats(dir); err != nil || stats.ReadBytes != 2048 || stats.WriteBytes != 512 {
+		t.Fatalf("Unexpected block I/O stats: %v (%v)", stats, err)
+	}
+
+	stats := &ContainerStats{
+		CPU:    CPUStats{TotalUsage: 3000, PercpuUsage: []uint64{1500, 1500}, SystemUsage: 20000},
+		PreCPU: CPUStats{TotalUsage: 1000, SystemUsage: 10000},
+	}
+	if percent := stats.CPUPercent(); percent != 40 {
+		t.Fatalf("Unexpected CPU percentage: %f", percent)
+	}
+}
+
 func TestRestart(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -1070,129 +1332,1273 @@ func TestLXCConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer runtime.Destroy(container)
+	container.Tmpfs = map[string]string{"/run": tmpfsMountOptions("size=64m")}
+	container.AppArmorProfile = "docker-default"
+	container.ProcessLabel = "system_u:system_r:svirt_lxc_net_t:s0:c1,c2"
+	container.IDMappings = &IDMappings{Uids: []IDMap{{0, 100000, 65536}}, Gids: []IDMap{{0, 100000, 65536}}}
+	container.ShmPath = "/dev/shm"
+	container.CgroupParent = cgroupParentPath("workers-web.slice")
+	container.BlkioWeight = 300
+	container.DeviceMounts = []DeviceMount{{Source: "/usr/lib/libcuda.so.1", Destination: "/usr/local/nvidia/lib64/libcuda.so.1"}}
+	container.DevPath = "/var/lib/docker/containers/foobar/dev"
+	container.Config.CpuPeriod = 50000
+	container.Config.CpuQuota = 25000
+	container.Config.CpusetMems = "0"
+	swappiness := int64(0)
+	container.Config.MemorySwappiness = &swappiness
+	container.Config.KernelMemory = 16777216
+	container.OomKillDisable = true
+	container.OomScoreAdj = -500
+	container.BlkioThrottles = []BlkioThrottle{{"throttle.read_bps_device", 8, 0, 10485760}}
 	container.generateLXCConfig()
 	grepFile(t, container.lxcConfigPath(), "lxc.utsname = foobar")
+	grepFile(t, container.lxcConfigPath(),
+		fmt.Sprintf("lxc.mount.entry = tmpfs %s/run tmpfs nosuid,nodev,noexec,size=64m 0 0", container.RootfsPath()))
+	grepFile(t, container.lxcConfigPath(), "lxc.network.mtu = 1500")
+	grepFile(t, container.lxcConfigPath(), "lxc.aa_profile = docker-default")
+	grepFile(t, container.lxcConfigPath(), "lxc.se_context = system_u:system_r:svirt_lxc_net_t:s0:c1,c2")
+	grepFile(t, container.lxcConfigPath(), "lxc.id_map = u 0 100000 65536")
+	grepFile(t, container.lxcConfigPath(), "lxc.id_map = g 0 100000 65536")
+	grepFile(t, container.lxcConfigPath(), fmt.Sprintf("lxc.mount.entry = /dev/shm %s/dev/shm none bind 0 0", container.RootfsPath()))
+	grepFile(t, container.lxcConfigPath(), fmt.Sprintf("lxc.mount.entry = /var/lib/docker/containers/foobar/dev %s/dev none bind 0 0", container.RootfsPath()))
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.blkio.weight = 300")
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.cpu.cfs_period_us = 50000")
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.cpu.cfs_quota_us = 25000")
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.cpuset.mems = 0")
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.memory.swappiness = 0")
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.memory.kmem.limit_in_bytes = 16777216")
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.memory.oom_control = 1")
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.blkio.throttle.read_bps_device = 8:0 10485760")
+	grepFile(t, container.lxcConfigPath(),
+		fmt.Sprintf("lxc.mount.entry = /usr/lib/libcuda.so.1 %s/usr/local/nvidia/lib64/libcuda.so.1 none bind,ro 0 0", container.RootfsPath()))
 	grepFile(t, container.lxcConfigPath(),
 		fmt.Sprintf("lxc.cgroup.memory.limit_in_bytes = %d", mem))
 	grepFile(t, container.lxcConfigPath(),
 		fmt.Sprintf("lxc.cgroup.memory.memsw.limit_in_bytes = %d", mem*2))
 }
 
-func BenchmarkRunSequencial(b *testing.B) {
-	runtime := mkRuntime(b)
-	defer nuke(runtime)
-	for i := 0; i < b.N; i++ {
-		container, err := NewBuilder(runtime).Create(&Config{
-			Image: GetTestImage(runtime).ID,
-			Cmd:   []string{"echo", "-n", "foo"},
-		},
-		)
-		if err != nil {
-			b.Fatal(err)
-		}
-		defer runtime.Destroy(container)
-		output, err := container.Output()
-		if err != nil {
-			b.Fatal(err)
-		}
-		if string(output) != "foo" {
-			b.Fatalf("Unexpected output: %s", output)
-		}
-		if err := runtime.Destroy(container); err != nil {
-			b.Fatal(err)
+func TestParseRunNetworkOptions(t *testing.T) {
+	config, _, _, err := ParseRun([]string{"-ip", "172.17.0.42", "-mtu", "9000", "-sysctl", "net.ipv4.ip_forward=1", "-sysctl", "net.core.somaxconn=1024", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.IPAddress != "172.17.0.42" {
+		t.Fatalf("Expected the address 172.17.0.42, got %s", config.IPAddress)
+	}
+	if config.Mtu != 9000 {
+		t.Fatalf("Expected an MTU of 9000, got %d", config.Mtu)
+	}
+	if len(config.Sysctls) != 2 || config.Sysctls[0] != "net.ipv4.ip_forward=1" {
+		t.Fatalf("Unexpected sysctls: %v", config.Sysctls)
+	}
+	config, _, _, err = ParseRun([]string{"-ingress", "deny", "-ingress-from", "web", "-ingress-from", "backup", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.IngressPolicy != "deny" || len(config.IngressFrom) != 2 || config.IngressFrom[1] != "backup" {
+		t.Fatalf("Unexpected ingress policy: %s %v", config.IngressPolicy, config.IngressFrom)
+	}
+	for _, args := range [][]string{
+		{"-ip", "172.17.0"},
+		{"-ip", "::1"},
+		{"-ip", "172.17.0.42", "-n=false"},
+		{"-net", "container:", "-mtu", "1400"},
+		{"-net", "container:4fa6e0f0c678", "-p", "80"},
+		{"-net", "container:4fa6e0f0c678", "-ip", "172.17.0.42"},
+		{"-net", "container:4fa6e0f0c678", "-sysctl", "net.ipv4.ip_forward=1"},
+		{"-mtu", "42"},
+		{"-mtu", "70000"},
+		{"-sysctl", "kernel.shmmax=1"},
+		{"-sysctl", "net.ipv4.ip_forward"},
+		{"-sysctl", "net.ipv4/../../kernel/shmmax=1"},
+		{"-ingress", "reject"},
+		{"-ingress-from", "../web"},
+		{"-net", "container:4fa6e0f0c678", "-ingress", "deny"},
+	} {
+		if _, _, _, err := ParseRun(append(args, "busybox", "true"), nil); err == nil {
+			t.Fatalf("Expected an error for %v", args)
 		}
 	}
 }
 
-func BenchmarkRunParallel(b *testing.B) {
-	runtime := mkRuntime(b)
-	defer nuke(runtime)
-
-	var tasks []chan error
-
-	for i := 0; i < b.N; i++ {
-		complete := make(chan error)
-		tasks = append(tasks, complete)
-		go func(i int, complete chan error) {
-			container, err := NewBuilder(runtime).Create(&Config{
-				Image: GetTestImage(runtime).ID,
-				Cmd:   []string{"echo", "-n", "foo"},
-			},
-			)
-			if err != nil {
-				complete <- err
-				return
-			}
-			defer runtime.Destroy(container)
-			hostConfig := &HostConfig{}
-			if err := container.Start(hostConfig); err != nil {
-				complete <- err
-				return
-			}
-			if err := container.WaitTimeout(15 * time.Second); err != nil {
-				complete <- err
-				return
-			}
-			// if string(output) != "foo" {
-			// 	complete <- fmt.Errorf("Unexecpted output: %v", string(output))
-			// }
-			if err := runtime.Destroy(container); err != nil {
-				complete <- err
-				return
-			}
-			complete <- nil
-		}(i, complete)
+func TestParseRunDnsOptions(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-dns-search", "corp.example.com", "-dns-search", "example.com", "-dns-opt", "ndots:2", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-	var errors []error
-	for _, task := range tasks {
-		err := <-task
-		if err != nil {
-			errors = append(errors, err)
-		}
+	if len(hostConfig.DnsSearch) != 2 || hostConfig.DnsSearch[1] != "example.com" {
+		t.Fatalf("Unexpected search domains: %v", hostConfig.DnsSearch)
 	}
-	if len(errors) > 0 {
-		b.Fatal(errors)
+	if len(hostConfig.DnsOptions) != 1 || hostConfig.DnsOptions[0] != "ndots:2" {
+		t.Fatalf("Unexpected dns options: %v", hostConfig.DnsOptions)
+	}
+	for _, args := range [][]string{
+		{"-dns-search", ""},
+		{"-dns-search", "corp.example.com example.com"},
+		{"-dns-search", ".", "-dns-search", "example.com"},
+		{"-dns-opt", "ndots:2 rotate"},
+	} {
+		if _, _, _, err := ParseRun(append(args, "busybox", "true"), nil); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
 	}
 }
 
-func tempDir(t *testing.T) string {
-	tmpDir, err := ioutil.TempDir("", "docker-test")
+func TestParseRestartPolicy(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-restart", "on-failure:3", "busybox", "true"}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	return tmpDir
-}
-
-func TestBindMounts(t *testing.T) {
-	r := mkRuntime(t)
-	defer nuke(r)
-	tmpDir := tempDir(t)
-	defer os.RemoveAll(tmpDir)
-	writeFile(path.Join(tmpDir, "touch-me"), "", t)
-
-	// Test reading from a read-only bind mount
-	stdout, _ := runContainer(r, []string{"-v", fmt.Sprintf("%s:/tmp:ro", tmpDir), "_", "ls", "/tmp"}, t)
-	if !strings.Contains(stdout, "touch-me") {
-		t.Fatal("Container failed to read from bind mount")
+	if policy := hostConfig.RestartPolicy; policy.Name != "on-failure" || policy.MaximumRetryCount != 3 {
+		t.Fatalf("Unexpected restart policy: %v", policy)
+	}
+	for _, spec := range []string{"sometimes", "always:3", "on-failure:0", "on-failure:x"} {
+		if _, err := parseRestartPolicy(spec); err == nil {
+			t.Fatalf("Expected an error for the restart policy %s", spec)
+		}
 	}
 
-	// test writing to bind mount
-	runContainer(r, []string{"-v", fmt.Sprintf("%s:/tmp:rw", tmpDir), "_", "touch", "/tmp/holla"}, t)
-	readFile(path.Join(tmpDir, "holla"), t) // Will fail if the file doesn't exist
+	onFailure := RestartPolicy{Name: "on-failure", MaximumRetryCount: 2}
+	if onFailure.shouldRestart(0, 0) || !onFailure.shouldRestart(1, 1) || onFailure.shouldRestart(1, 2) {
+		t.Fatal("on-failure:2 should only restart after a failure, twice")
+	}
+	if !(RestartPolicy{Name: "always"}).shouldRestart(0, 100) || (RestartPolicy{Name: "no"}).shouldRestart(1, 0) {
+		t.Fatal("always should always restart, no never")
+	}
 
-	// test mounting to an illegal destination directory
-	if _, err := runContainer(r, []string{"-v", fmt.Sprintf("%s:.", tmpDir), "_", "ls", "."}, nil); err == nil {
-		t.Fatal("Container bind mounted illegal directory")
+	delay := time.Duration(0)
+	for _, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		if delay = nextRestartDelay(delay, time.Second); delay != expected {
+			t.Fatalf("Unexpected restart delay: %s instead of %s", delay, expected)
+		}
+	}
+	if delay := nextRestartDelay(50*time.Second, time.Second); delay != restartDelayMax {
+		t.Fatalf("The restart delay should be capped: %s", delay)
+	}
+	if delay := nextRestartDelay(restartDelayMax, time.Hour); delay != restartDelayMin {
+		t.Fatalf("The restart delay should be reset after a long run: %s", delay)
 	}
 }
 
-// Test that VolumesRW values are copied to the new container.  Regression test for #1201
-func TestVolumesFromReadonlyMount(t *testing.T) {
+func TestRestartPolicy(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
-	container, err := NewBuilder(runtime).Create(
-		&Config{
-			Image:   GetTestImage(runtime).ID,
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"sh", "-c", "exit 1"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	hostConfig := &HostConfig{RestartPolicy: RestartPolicy{Name: "on-failure", MaximumRetryCount: 2}}
+	if err := container.Start(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	setTimeout(t, "The container wasn't restarted twice", 10*time.Second, func() {
+		for {
+			container.State.Lock()
+			restarted := container.RestartCount == 2 && !container.State.Running
+			container.State.Unlock()
+			if restarted {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	// No third restart
+	time.Sleep(time.Second)
+	if container.RestartCount != 2 || container.State.Running || container.State.ExitCode != 1 {
+		t.Fatalf("Unexpected state after 2 restarts: %d restarts, %s", container.RestartCount, container.State.String())
+	}
+}
+
+func TestParseRunAutoRemove(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-rm", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hostConfig.AutoRemove {
+		t.Fatal("-rm should set AutoRemove")
+	}
+	if _, _, _, err := ParseRun([]string{"-rm", "-restart", "always", "busybox", "true"}, nil); err == nil {
+		t.Fatal("Expected an error for -rm with a restart policy")
+	}
+}
+
+func TestParseRunLogDriver(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-log-driver", "syslog", "-log-opt", "tag=web", "-log-opt", "syslog-facility=local0", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostConfig.LogConfig.Type != "syslog" || hostConfig.LogConfig.Config["tag"] != "web" || hostConfig.LogConfig.Config["syslog-facility"] != "local0" {
+		t.Fatalf("Unexpected log config: %v", hostConfig.LogConfig)
+	}
+	for _, args := range [][]string{
+		{"-log-driver", "foo"},
+		{"-log-opt", "max-size=10m"},
+		{"-log-driver", "none", "-log-opt", "tag=web"},
+		{"-log-driver", "syslog", "-log-opt", "tag"},
+	} {
+		if _, _, _, err := ParseRun(append(args, "busybox", "true"), nil); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestParseRunVolumeDriver(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-volume-driver", "local", "-v", "data:/data", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostConfig.VolumeDriver != "local" || len(hostConfig.Binds) != 1 || hostConfig.Binds[0] != "data:/data" {
+		t.Fatalf("Unexpected host config: %#v", hostConfig)
+	}
+	if _, _, _, err := ParseRun([]string{"-volume-driver", "foo", "busybox", "true"}, nil); err == nil {
+		t.Fatal("Expected an error for an unknown volume driver")
+	}
+}
+
+func TestParseRunTmpfs(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-tmpfs", "/run:size=64m,mode=1777", "-tmpfs", "/tmp/", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hostConfig.Tmpfs) != 2 || hostConfig.Tmpfs["/run"] != "size=64m,mode=1777" {
+		t.Fatalf("Unexpected tmpfs: %#v", hostConfig.Tmpfs)
+	}
+	if options, exists := hostConfig.Tmpfs["/tmp"]; !exists || options != "" {
+		t.Fatalf("Expected /tmp without options, got %#v", hostConfig.Tmpfs)
+	}
+	for _, spec := range []string{"run", "/", "/run:size=big", "/run:mode=999", "/run:remount", "/run:uid", "/my run", "/run\nlxc.cap.drop="} {
+		if _, _, _, err := ParseRun([]string{"-tmpfs", spec, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the tmpfs %s", spec)
+		}
+	}
+}
+
+func TestParseRunStorageOpt(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-storage-opt", "Size=10g", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := containerLayerSize(hostConfig.StorageOpt); err != nil {
+		t.Fatal(err)
+	} else if size != 10<<30 {
+		t.Fatalf("Expected a layer of 10g, got %d bytes", size)
+	}
+	for _, option := range []string{"size", "size=big", "size=512k", "dm.basesize=20g"} {
+		if _, _, _, err := ParseRun([]string{"-storage-opt", option, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the storage option %s", option)
+		}
+	}
+}
+
+func TestParseRunReadonlyRootfs(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-read-only", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hostConfig.ReadonlyRootfs {
+		t.Fatalf("Expected a read-only root filesystem: %#v", hostConfig)
+	}
+}
+
+func TestReadonlyRootfs(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"sh", "-c", "touch /tmp/foo /run/foo /data/foo && ! touch /foo"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{ReadonlyRootfs: true, Tmpfs: map[string]string{"/data": ""}}); err != nil {
+		t.Fatal(err)
+	}
+	container.Wait()
+	if container.State.ExitCode != 0 {
+		t.Fatalf("Expected only the tmpfs to be writable, the exit code is %d", container.State.ExitCode)
+	}
+	if !container.ReadonlyRootfs || len(container.Tmpfs) != 3 || container.Tmpfs["/tmp"] != tmpfsMountOptions("mode=1777") {
+		t.Fatalf("Unexpected tmpfs of a read-only container: %v", container.Tmpfs)
+	}
+}
+
+func TestParseRunDevices(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-device", "/dev/snd:/dev/snd:rw", "-device", "/dev/fuse:rwm", "-device", "/dev/ttyUSB0", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DeviceMapping{
+		{PathOnHost: "/dev/snd", PathInContainer: "/dev/snd", CgroupPermissions: "rw"},
+		{PathOnHost: "/dev/fuse", CgroupPermissions: "rwm"},
+		{PathOnHost: "/dev/ttyUSB0"},
+	}
+	if len(hostConfig.Devices) != len(expected) {
+		t.Fatalf("Expected %d devices, got %#v", len(expected), hostConfig.Devices)
+	}
+	for i, device := range expected {
+		if hostConfig.Devices[i] != device {
+			t.Fatalf("Expected the device %#v, got %#v", device, hostConfig.Devices[i])
+		}
+	}
+	for _, spec := range []string{"dev/snd", "/dev/snd:snd", "/dev/snd:/dev/snd:rwx", "/dev/snd:/:rw", "/dev/snd:/dev/snd:rw:foo"} {
+		if _, _, _, err := ParseRun([]string{"-device", spec, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the device %s", spec)
+		}
+	}
+}
+
+func TestDevices(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"sh", "-c", "test -c /dev/hostnull && echo foo > /dev/hostnull"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{Devices: []DeviceMapping{{PathOnHost: "/dev/null", PathInContainer: "/dev/hostnull", CgroupPermissions: "rw"}}}); err != nil {
+		t.Fatal(err)
+	}
+	container.Wait()
+	if container.State.ExitCode != 0 {
+		t.Fatalf("Expected the device /dev/hostnull to be usable, the exit code is %d", container.State.ExitCode)
+	}
+	if len(container.Devices) != 1 || container.Devices[0].Type != "c" || container.Devices[0].Major != 1 || container.Devices[0].Minor != 3 {
+		t.Fatalf("Unexpected devices: %#v", container.Devices)
+	}
+	grepFile(t, container.lxcConfigPath(), "lxc.cgroup.devices.allow = c 1:3 rw")
+	// Its node was in the tmpfs of its /dev, not in its layer
+	changes, err := container.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range changes {
+		if change.Path == "/dev/hostnull" {
+			t.Fatalf("Expected the device to stay out of the layer of the container, got %v", changes)
+		}
+	}
+	if container.DevPath != "" {
+		t.Fatalf("Expected the tmpfs of /dev to be unmounted, got %s", container.DevPath)
+	}
+
+	if err := container.Start(&HostConfig{Devices: []DeviceMapping{{PathOnHost: "/dev/nonexistent"}}}); err == nil {
+		t.Fatal("Expected an error for a device which doesn't exist")
+	}
+}
+
+func TestDevicePathInScope(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-device-path-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	container := &Container{root: root, basefs: path.Join(root, "rootfs")}
+	for _, dir := range []string{"rootfs/etc", "rootfs/usr", "host"} {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The links of the image lead to its own files, not to the ones of the host
+	if err := os.Symlink(path.Join(root, "host"), path.Join(root, "rootfs/usr/lib")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "rootfs/usr/file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := container.devicePath("/usr/lib/libcuda.so.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := path.Join(root, "rootfs", root, "host/libcuda.so.1"); p != expected {
+		t.Fatalf("Expected %s, got %s", expected, p)
+	}
+	if _, err := container.devicePath("/usr/file/x"); err == nil {
+		t.Fatal("Expected an error for a path under a file")
+	}
+	container.cleanupDevices()
+
+	// Nor the mount points of the device plugins
+	source := path.Join(root, "libcuda.so.1")
+	if err := ioutil.WriteFile(source, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := container.setupDevices(nil, []DeviceMount{{Source: source, Destination: "/usr/lib/libcuda.so.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(root, "host/libcuda.so.1")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no mount point on the host: %v", err)
+	}
+	if _, err := os.Stat(path.Join(root, "rootfs", root, "host/libcuda.so.1")); err != nil {
+		t.Fatalf("Expected the mount point in the container: %s", err)
+	}
+	if err := container.setupDevices(nil, []DeviceMount{{Source: source, Destination: "/etc"}}); err == nil {
+		t.Fatal("Expected an error for a file mounted on a directory")
+	}
+	container.cleanupDevices()
+	if _, err := os.Stat(path.Join(root, "rootfs", root)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the directories created for the device to be removed: %v", err)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	for _, test := range []struct {
+		status           syscall.WaitStatus
+		exitCode, signal int
+	}{
+		{0, 0, 0},
+		{1 << 8, 1, 0},
+		{137 << 8, 137, 9}, // lxc-start reports the SIGKILL of the process
+		{143 << 8, 143, 15},
+		{255 << 8, 255, 0},
+		{syscall.WaitStatus(syscall.SIGTERM), 143, 15},
+	} {
+		if exitCode, signal := exitStatus(test.status); exitCode != test.exitCode || signal != test.signal {
+			t.Fatalf("Expected %d and signal %d for the status %#x, got %d and %d", test.exitCode, test.signal, uint32(test.status), exitCode, signal)
+		}
+	}
+}
+
+func TestParseRunDetachKeys(t *testing.T) {
+	_, _, cmd, err := ParseRun([]string{"-detach-keys", "ctrl-x,ctrl-y", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := cmd.Lookup("detach-keys").Value.String(); keys != "ctrl-x,ctrl-y" {
+		t.Fatalf("Expected the detach keys ctrl-x,ctrl-y, got %s", keys)
+	}
+	if _, _, _, err := ParseRun([]string{"-detach-keys", "ctrl-1", "busybox", "true"}, nil); err == nil {
+		t.Fatal("Expected an error for invalid detach keys")
+	}
+}
+
+type testLogDriver struct {
+	messages []*LogMessage
+}
+
+func (driver *testLogDriver) Log(msg *LogMessage) error {
+	driver.messages = append(driver.messages, msg)
+	return nil
+}
+
+func (driver *testLogDriver) Close() error {
+	return nil
+}
+
+func TestLogWriter(t *testing.T) {
+	driver := &testLogDriver{}
+	w := &logWriter{driver: driver, source: "stderr"}
+	long := strings.Repeat("x", logLineMax+1)
+	for _, s := range []string{"hello\nwor", "ld\n\n", long, "\nbye"} {
+		if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("Unexpected write: %d, %v", n, err)
+		}
+	}
+	w.Close()
+
+	expected := []string{"hello", "world", "", long[:logLineMax], "x", "bye"}
+	partial := []bool{false, false, false, true, false, true}
+	if len(driver.messages) != len(expected) {
+		t.Fatalf("Expected %d messages, found %d", len(expected), len(driver.messages))
+	}
+	for i, msg := range driver.messages {
+		if string(msg.Line) != expected[i] || msg.Source != "stderr" {
+			t.Fatalf("Expected the message %d to be %.20q on stderr, found %.20q on %s", i, expected[i], msg.Line, msg.Source)
+		}
+		if msg.Partial != partial[i] {
+			t.Fatalf("Expected the message %d to be partial: %v", i, partial[i])
+		}
+	}
+}
+
+func TestJSONFileLogPartial(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	driver, err := newJSONFileLogDriver(&Container{ID: "foo", root: root}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &logWriter{driver: driver, source: "stdout"}
+	w.Write([]byte("hello\nprompt> "))
+	w.Close()
+	driver.Close()
+
+	data, err := ioutil.ReadFile(path.Join(root, "foo-json.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		l := &utils.JSONLog{}
+		if err := dec.Decode(l); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		output += l.Log
+	}
+	if output != "hello\nprompt> " {
+		t.Fatalf("Expected the output as the process wrote it, found %q", output)
+	}
+}
+
+func TestJSONFileLogRotation(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	container := &Container{ID: "foo", root: root}
+
+	if _, err := newJSONFileLogDriver(container, map[string]string{"max-file": "2"}); err == nil {
+		t.Fatal("max-file without max-size should fail")
+	}
+	for _, size := range []string{"", "0", "-1k", "10x", "k"} {
+		if _, err := parseLogSize(size); err == nil {
+			t.Fatalf("Expected an error for the size %q", size)
+		}
+	}
+	if size, err := parseLogSize("2k"); err != nil || size != 2048 {
+		t.Fatalf("Expected 2k to be 2048 bytes, found %d (%v)", size, err)
+	}
+
+	// Each line takes about 70 bytes in the log
+	driver, err := newJSONFileLogDriver(container, map[string]string{"max-size": "200", "max-file": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := driver.Log(&LogMessage{Line: []byte(fmt.Sprintf("line %d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := driver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"foo-json.log", "foo-json.log.1", "foo-json.log.2"} {
+		info, err := os.Stat(path.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Fatalf("%s should be at most 200 bytes, found %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path.Join(root, "foo-json.log.3")); !os.IsNotExist(err) {
+		t.Fatalf("Only 3 logs should be kept: %v", err)
+	}
+
+	// The logs kept are read in order, up to the last line
+	log, err := container.ReadLog("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	var lines []string
+	dec := json.NewDecoder(log)
+	for {
+		var l utils.JSONLog
+		if err := dec.Decode(&l); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l.Log)
+	}
+	if len(lines) < 3 || lines[len(lines)-1] != "line 19\n" {
+		t.Fatalf("Expected the last lines, found %v", lines)
+	}
+	for i := 0; i < len(lines); i++ {
+		if lines[i] != fmt.Sprintf("line %d\n", 20-len(lines)+i) {
+			t.Fatalf("Expected the lines in order, found %v", lines)
+		}
+	}
+}
+
+func TestWriteLogs(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	container := &Container{ID: "foo", root: root}
+
+	// 10 lines over several rotated logs, on stdout for the even ones
+	driver, err := newJSONFileLogDriver(container, map[string]string{"max-size": "300", "max-file": "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2013, 7, 17, 13, 32, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		source := "stdout"
+		if i%2 == 1 {
+			source = "stderr"
+		}
+		if err := driver.Log(&LogMessage{Line: []byte(fmt.Sprintf("line %d", i)), Source: source, Timestamp: start.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	driver.Close()
+	if _, err := os.Stat(rotatedLogPath(container.logPath("json"), 2)); err != nil {
+		t.Fatalf("The log should have been rotated: %s", err)
+	}
+
+	lines := func(i ...int) string {
+		var s string
+		for _, i := range i {
+			s += fmt.Sprintf("line %d\n", i)
+		}
+		return s
+	}
+	for _, test := range []struct {
+		config   LogsConfig
+		expected string
+	}{
+		{LogsConfig{Stdout: true, Stderr: true, Tail: -1}, lines(0, 1, 2, 3, 4, 5, 6, 7, 8, 9)},
+		{LogsConfig{Stdout: true, Tail: -1}, lines(0, 2, 4, 6, 8)},
+		{LogsConfig{Stdout: true, Stderr: true, Tail: 3}, lines(7, 8, 9)},
+		{LogsConfig{Stderr: true, Tail: 4}, lines(3, 5, 7, 9)},
+		{LogsConfig{Stdout: true, Stderr: true, Tail: 0}, ""},
+		{LogsConfig{Stdout: true, Stderr: true, Tail: 20}, lines(0, 1, 2, 3, 4, 5, 6, 7, 8, 9)},
+		{LogsConfig{Stdout: true, Stderr: true, Tail: 20, Since: start.Add(6 * time.Second)}, lines(6, 7, 8, 9)},
+		{LogsConfig{Stdout: true, Stderr: true, Tail: 2, Until: start.Add(4 * time.Second)}, lines(3, 4)},
+		{LogsConfig{Stdout: true, Tail: -1, Since: start.Add(time.Second), Until: start.Add(5 * time.Second)}, lines(2, 4)},
+		{LogsConfig{Stdout: true, Tail: 1, Timestamps: true}, "2013-07-17T13:32:08Z line 8\n"},
+	} {
+		out := &bytes.Buffer{}
+		if err := container.WriteLogs(&test.config, out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Fatalf("Expected the logs %q with %+v, found %q", test.expected, test.config, out.String())
+		}
+	}
+
+	for _, value := range []string{"yesterday", "2013-07-17"} {
+		if _, err := parseLogsTime(value); err == nil {
+			t.Fatalf("Expected an error for the time %s", value)
+		}
+	}
+	if since, err := parseLogsTime("1374067920.5"); err != nil || !since.Equal(start.Add(500*time.Millisecond)) {
+		t.Fatalf("Expected %s, found %s (%v)", start.Add(500*time.Millisecond), since, err)
+	}
+	if tail, err := parseLogsTail("all"); err != nil || tail != -1 {
+		t.Fatalf("Expected all the lines, found %d (%v)", tail, err)
+	}
+	if _, err := parseLogsTail("-2"); err == nil {
+		t.Fatal("Expected an error for a negative tail")
+	}
+}
+
+func TestParseSyslogOptions(t *testing.T) {
+	options, err := parseSyslogOptions(map[string]string{
+		"syslog-address":         "tcp+tls://10.0.0.1:6514",
+		"syslog-facility":        "local3",
+		"syslog-tls-skip-verify": "true",
+		"tag":                    "{{.Name}}/{{.ImageName}}/{{.ID}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.network != "tcp+tls" || options.address != "10.0.0.1:6514" || options.facility != syslog.LOG_LOCAL3 || !options.skipVerify {
+		t.Fatalf("Unexpected syslog options: %+v", options)
+	}
+	tag, err := expandLogTag(options.tag, &logTagData{ID: "4fa6e0f0c678", Name: "web", ImageName: "nginx:latest"})
+	if err != nil || tag != "web/nginx:latest/4fa6e0f0c678" {
+		t.Fatalf("Expected the tag web/nginx:latest/4fa6e0f0c678, found %s (%v)", tag, err)
+	}
+
+	for _, invalid := range []map[string]string{
+		{"syslog-address": "10.0.0.1:514"},
+		{"syslog-address": "http://10.0.0.1:514"},
+		{"syslog-address": "udp://10.0.0.1"},
+		{"syslog-facility": "foo"},
+		{"syslog-address": "udp://10.0.0.1:514", "syslog-tls-skip-verify": "true"},
+		{"syslog-address": "tcp+tls://10.0.0.1:6514", "syslog-tls-cert": "/etc/cert.pem"},
+		{"syslog-address": "tcp+tls://10.0.0.1:6514", "syslog-tls-skip-verify": "maybe"},
+		{"tag": "{{.Name"},
+		{"tag": "{{.Foo}}"},
+	} {
+		if _, err := parseSyslogOptions(invalid); err == nil {
+			t.Fatalf("Expected an error for %v", invalid)
+		}
+	}
+}
+
+func TestSyslogTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var length int
+		if _, err := fmt.Fscanf(r, "%d ", &length); err != nil {
+			t.Error(err)
+			return
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Error(err)
+			return
+		}
+		received <- string(msg)
+	}()
+
+	container := &Container{ID: "4fa6e0f0c678a4ed3c8e5e9d5c6e3bd7c52c6e8d4b1e2f8b3d4ab9d8c7e6f5a4", Config: &Config{Hostname: "web"}}
+	driver, err := newSyslogLogDriver(container, map[string]string{
+		"syslog-address":         "tcp+tls://" + listener.Addr().String(),
+		"syslog-facility":        "local0",
+		"syslog-tls-skip-verify": "true",
+		"tag":                    "{{.Name}}-{{.ID}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+	if err := driver.Log(&LogMessage{Line: []byte("hello"), Source: "stderr", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		// local0 (16) * 8 + err (3)
+		if !strings.HasPrefix(msg, "<131>1 ") || !strings.Contains(msg, " web-4fa6e0f0c678 ") || !strings.HasSuffix(msg, " - - hello") {
+			t.Fatalf("Unexpected syslog message: %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The syslog message wasn't received")
+	}
+}
+
+func TestGelfLogDriver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, invalid := range []map[string]string{
+		{},
+		{"gelf-address": "tcp://" + conn.LocalAddr().String()},
+		{"gelf-address": "udp://graylog"},
+		{"gelf-address": "udp://" + conn.LocalAddr().String(), "gelf-compression-type": "lz4"},
+	} {
+		if err := validateLogConfig(LogConfig{Type: "gelf", Config: invalid}); err == nil {
+			t.Fatalf("Expected an error for %v", invalid)
+		}
+	}
+
+	container := &Container{
+		ID:     "4fa6e0f0c678a4ed3c8e5e9d5c6e3bd7c52c6e8d4b1e2f8b3d4ab9d8c7e6f5a4",
+		Image:  "b750fe79269d2ec9a3c593ef05b4332b1d1a02a62b4accb2c21d589ff2f5f2dc",
+		Path:   "nginx",
+		Args:   []string{"-g", "daemon off;"},
+		Config: &Config{Hostname: "web", Env: []string{"STAGE=prod", "SECRET=foo"}},
+	}
+	driver, err := newGelfLogDriver(container, map[string]string{
+		"gelf-address": "udp://" + conn.LocalAddr().String(),
+		"env":          "STAGE",
+		"tag":          "{{.Name}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+
+	read := func() map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var message []byte
+		for {
+			b := make([]byte, 65536)
+			n, _, err := conn.ReadFrom(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n < 2 || b[0] != 0x1e || b[1] != 0x0f {
+				message = b[:n]
+				break
+			}
+			// A chunk, sent in order on the loopback
+			message = append(message, b[gelfChunkHeader:n]...)
+			if int(b[10]) == int(b[11])-1 {
+				break
+			}
+		}
+		r, err := gzip.NewReader(bytes.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := make(map[string]interface{})
+		if err := json.NewDecoder(r).Decode(&fields); err != nil {
+			t.Fatal(err)
+		}
+		return fields
+	}
+
+	if err := driver.Log(&LogMessage{Line: []byte("hello"), Source: "stderr", Timestamp: time.Unix(1374067920, 500000000)}); err != nil {
+		t.Fatal(err)
+	}
+	fields := read()
+	for name, value := range map[string]interface{}{
+		"version":         "1.1",
+		"short_message":   "hello",
+		"timestamp":       1374067920.5,
+		"level":           3.0,
+		"_container_id":   container.ID,
+		"_container_name": "web",
+		"_image_name":     "b750fe79269d",
+		"_command":        "nginx -g daemon off;",
+		"_tag":            "web",
+		"_STAGE":          "prod",
+	} {
+		if fields[name] != value {
+			t.Fatalf("Expected %s to be %v, found %v", name, value, fields[name])
+		}
+	}
+	if _, exists := fields["_SECRET"]; exists {
+		t.Fatal("Only the variables of the env option should be sent")
+	}
+
+	// Random, so that gzip keeps it big
+	line := make([]byte, 3*gelfChunkSize)
+	for i := range line {
+		line[i] = byte('a' + rand.Intn(26))
+	}
+	if err := driver.Log(&LogMessage{Line: line, Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if fields := read(); fields["short_message"] != string(line) || fields["level"] != 6.0 {
+		t.Fatalf("Unexpected chunked message: %v", fields["level"])
+	}
+}
+
+func TestLogDriverNone(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"echo", "-n", "foobar"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{LogConfig: LogConfig{Type: "none"}}); err != nil {
+		t.Fatal(err)
+	}
+	container.Wait()
+	if _, err := container.ReadLog("json"); !os.IsNotExist(err) {
+		t.Fatalf("The none log driver shouldn't write the json log: %v", err)
+	}
+	if container.logsReadable() {
+		t.Fatal("The logs of the none log driver can't be read")
+	}
+}
+
+func TestAutoRemove(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:   GetTestImage(runtime).ID,
+		Cmd:     []string{"touch", "/data/foo"},
+		Volumes: map[string]struct{}{"/data": {}},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Start(&HostConfig{AutoRemove: true, RestartPolicy: RestartPolicy{Name: "always"}}); err == nil {
+		t.Fatal("A container removed on exit can't have a restart policy")
+	}
+	if err := container.Start(&HostConfig{AutoRemove: true}); err != nil {
+		t.Fatal(err)
+	}
+	volume := runtime.volumeID(container.Volumes["/data"])
+	if volume == "" {
+		t.Fatalf("The volume of the container wasn't created by docker: %s", container.Volumes["/data"])
+	}
+	// The volume is removed last
+	setTimeout(t, "The container and its volume weren't removed", 5*time.Second, func() {
+		for runtime.Get(container.ID) != nil || runtime.volumes.Exists(volume) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	if _, err := os.Stat(container.root); !os.IsNotExist(err) {
+		t.Fatalf("The directory of the container wasn't removed: %v", err)
+	}
+}
+
+func TestParseRunStopSignal(t *testing.T) {
+	config, _, _, err := ParseRun([]string{"-stop-signal", "SIGUSR1", "-stop-timeout", "30", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StopSignal != "SIGUSR1" || config.StopTimeout != 30 {
+		t.Fatalf("Unexpected stop signal and timeout: %s, %d", config.StopSignal, config.StopTimeout)
+	}
+	if _, _, _, err := ParseRun([]string{"-stop-signal", "SIGBOGUS", "busybox", "true"}, nil); err == nil {
+		t.Fatal("Expected an error for an invalid stop signal")
+	}
+	if _, _, _, err := ParseRun([]string{"-stop-timeout", "-1", "busybox", "true"}, nil); err == nil {
+		t.Fatal("Expected an error for a negative stop timeout")
+	}
+
+	for s, expected := range map[string]syscall.Signal{"SIGQUIT": syscall.SIGQUIT, "usr2": syscall.SIGUSR2, "9": syscall.SIGKILL} {
+		if signal, err := parseSignal(s); err != nil || signal != expected {
+			t.Fatalf("Unexpected signal for %s: %d (%v)", s, signal, err)
+		}
+	}
+	for _, s := range []string{"", "0", "65", "SIG"} {
+		if _, err := parseSignal(s); err == nil {
+			t.Fatalf("Expected an error for the signal %s", s)
+		}
+	}
+}
+
+func TestStopSignal(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:       GetTestImage(runtime).ID,
+		Cmd:         []string{"sh", "-c", "trap 'exit 42' USR1; while true; do sleep 1; done"},
+		StopSignal:  "SIGUSR1",
+		StopTimeout: 5,
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	// Let the shell set up the trap
+	time.Sleep(500 * time.Millisecond)
+	if err := container.Stop(-1); err != nil {
+		t.Fatal(err)
+	}
+	if container.State.Running {
+		t.Fatal("The container is still running")
+	}
+	if container.State.ExitCode != 42 {
+		t.Fatalf("The container should have exited on SIGUSR1, exit code: %d", container.State.ExitCode)
+	}
+}
+
+func TestParseRunCpuset(t *testing.T) {
+	config, _, _, err := ParseRun([]string{"-cpuset", "0-2,4", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Cpuset != "0-2,4" {
+		t.Fatalf("Unexpected cpuset: %s", config.Cpuset)
+	}
+	for _, cpuset := range []string{"0-", "a", "0,,1", "0 1"} {
+		if _, _, _, err := ParseRun([]string{"-cpuset", cpuset, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the cpuset %q", cpuset)
+		}
+		if _, _, _, err := ParseRun([]string{"-cpuset-mems", cpuset, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the cpuset mems %q", cpuset)
+		}
+	}
+	config, _, _, err = ParseRun([]string{"-cpuset-cpus", "2-3", "-cpuset-mems", "1", "-cpu-period", "50000", "-cpu-quota", "25000", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Cpuset != "2-3" || config.CpusetMems != "1" || config.CpuPeriod != 50000 || config.CpuQuota != 25000 {
+		t.Fatalf("Unexpected config: cpuset %s, mems %s, period %d, quota %d", config.Cpuset, config.CpusetMems, config.CpuPeriod, config.CpuQuota)
+	}
+	for _, args := range [][]string{{"-cpu-period", "999"}, {"-cpu-period", "2000000"}, {"-cpu-quota", "10"}, {"-cpu-quota", "-2"}} {
+		if _, _, _, err := ParseRun(append(args, "busybox", "true"), nil); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:     GetTestImage(runtime).ID,
+		Cmd:       []string{"cat"},
+		OpenStdin: true,
+		CpuShares: 512,
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Update(&UpdateConfig{Cpuset: "0-"}); err == nil {
+		t.Fatal("An invalid cpuset should be refused")
+	}
+	if err := container.Update(&UpdateConfig{Memory: 1024}); err == nil {
+		t.Fatal("A memory limit below 512k should be refused")
+	}
+	if err := container.Update(&UpdateConfig{CpuQuota: 100}); err == nil {
+		t.Fatal("A CPU quota below 1ms should be refused")
+	}
+	// Stopped: the config only
+	if err := container.Update(&UpdateConfig{Cpuset: "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if container.Config.Cpuset != "0" || container.Config.CpuShares != 512 {
+		t.Fatalf("Unexpected config: cpuset %s, cpu shares %d", container.Config.Cpuset, container.Config.CpuShares)
+	}
+
+	hostConfig := &HostConfig{}
+	if err := container.Start(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+	if err := container.Update(&UpdateConfig{CpuShares: 256}); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command("lxc-cgroup", "-n", container.ID, "cpu.shares").CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(output)) != "256" {
+		t.Fatalf("The cpu shares of the running container should be 256, got %s", output)
+	}
+	if container.Config.CpuShares != 256 || container.Config.Cpuset != "0" {
+		t.Fatalf("Unexpected config: cpuset %s, cpu shares %d", container.Config.Cpuset, container.Config.CpuShares)
+	}
+}
+
+func TestExecParams(t *testing.T) {
+	container := &Container{
+		ID:     "abc",
+		Config: &Config{Hostname: "abc", User: "daemon", WorkingDir: "/srv/", Env: []string{"FOO=1"}},
+	}
+	e := &Exec{Container: container, Config: &ExecConfig{Tty: true, Env: []string{"BAR=2"}, Cmd: []string{"ls", "-l"}}}
+	params := strings.Join(e.params(), " ")
+	expected := "-n abc -- /.dockerinit -u daemon -e TERM=xterm -e HOME=/ -e PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin -e container=lxc -e HOSTNAME=abc -w /srv -e FOO=1 -e BAR=2 -- ls -l"
+	if params != expected {
+		t.Fatalf("Unexpected lxc-attach arguments: %s", params)
+	}
+	e.Config.User = "root"
+	e.Config.WorkingDir = "/tmp"
+	if params := strings.Join(e.params(), " "); !strings.Contains(params, "-u root ") || !strings.Contains(params, "-w /tmp ") {
+		t.Fatalf("The user and the working directory of the exec should be used: %s", params)
+	}
+}
+
+func TestExec(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"cat"},
+
+		OpenStdin: true,
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if _, err := runtime.CreateExec(container, &ExecConfig{Cmd: []string{"true"}}); err == nil {
+		t.Fatal("It should be impossible to exec in a stopped container")
+	}
+	hostConfig := &HostConfig{}
+	if err := container.Start(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	e, err := runtime.CreateExec(container, &ExecConfig{AttachStdin: true, AttachStdout: true, Cmd: []string{"sh", "-c", "cat; exit 3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GetExec(e.ID) != e {
+		t.Fatalf("The exec %s isn't registered", e.ID)
+	}
+	stdout := &bytes.Buffer{}
+	if err := e.Start(strings.NewReader("hello world"), stdout, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exitCode := e.Wait(); exitCode != 3 {
+		t.Fatalf("Unexpected exit code: %d", exitCode)
+	}
+	if stdout.String() != "hello world" {
+		t.Fatalf("Unexpected output. Expected %s, received: %s", "hello world", stdout.String())
+	}
+	if err := e.Start(nil, nil, nil); err == nil {
+		t.Fatal("An exec shouldn't be started twice")
+	}
+	if !container.State.Running {
+		t.Fatal("The container should still be running")
+	}
+
+	// The finished execs expire
+	e.Lock()
+	e.finished = time.Now().Add(-execTTL - time.Second)
+	e.Unlock()
+	if _, err := runtime.CreateExec(container, &ExecConfig{Cmd: []string{"true"}}); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GetExec(e.ID) != nil {
+		t.Fatalf("The exec %s should have expired", e.ID)
+	}
+}
+
+func BenchmarkRunSequencial(b *testing.B) {
+	runtime := mkRuntime(b)
+	defer nuke(runtime)
+	for i := 0; i < b.N; i++ {
+		container, err := NewBuilder(runtime).Create(&Config{
+			Image: GetTestImage(runtime).ID,
+			Cmd:   []string{"echo", "-n", "foo"},
+		},
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer runtime.Destroy(container)
+		output, err := container.Output()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if string(output) != "foo" {
+			b.Fatalf("Unexpected output: %s", output)
+		}
+		if err := runtime.Destroy(container); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRunParallel(b *testing.B) {
+	runtime := mkRuntime(b)
+	defer nuke(runtime)
+
+	var tasks []chan error
+
+	for i := 0; i < b.N; i++ {
+		complete := make(chan error)
+		tasks = append(tasks, complete)
+		go func(i int, complete chan error) {
+			container, err := NewBuilder(runtime).Create(&Config{
+				Image: GetTestImage(runtime).ID,
+				Cmd:   []string{"echo", "-n", "foo"},
+			},
+			)
+			if err != nil {
+				complete <- err
+				return
+			}
+			defer runtime.Destroy(container)
+			hostConfig := &HostConfig{}
+			if err := container.Start(hostConfig); err != nil {
+				complete <- err
+				return
+			}
+			if err := container.WaitTimeout(15 * time.Second); err != nil {
+				complete <- err
+				return
+			}
+			// if string(output) != "foo" {
+			// 	complete <- fmt.Errorf("Unexecpted output: %v", string(output))
+			// }
+			if err := runtime.Destroy(container); err != nil {
+				complete <- err
+				return
+			}
+			complete <- nil
+		}(i, complete)
+	}
+	var errors []error
+	for _, task := range tasks {
+		err := <-task
+		if err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if len(errors) > 0 {
+		b.Fatal(errors)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpDir
+}
+
+func TestBindMounts(t *testing.T) {
+	r := mkRuntime(t)
+	defer nuke(r)
+	tmpDir := tempDir(t)
+	defer os.RemoveAll(tmpDir)
+	writeFile(path.Join(tmpDir, "touch-me"), "", t)
+
+	// Test reading from a read-only bind mount
+	stdout, _ := runContainer(r, []string{"-v", fmt.Sprintf("%s:/tmp:ro", tmpDir), "_", "ls", "/tmp"}, t)
+	if !strings.Contains(stdout, "touch-me") {
+		t.Fatal("Container failed to read from bind mount")
+	}
+
+	// test writing to bind mount
+	runContainer(r, []string{"-v", fmt.Sprintf("%s:/tmp:rw", tmpDir), "_", "touch", "/tmp/holla"}, t)
+	readFile(path.Join(tmpDir, "holla"), t) // Will fail if the file doesn't exist
+
+	// test mounting to an illegal destination directory
+	if _, err := runContainer(r, []string{"-v", fmt.Sprintf("%s:.", tmpDir), "_", "ls", "."}, nil); err == nil {
+		t.Fatal("Container bind mounted illegal directory")
+	}
+}
+
+// Test that VolumesRW values are copied to the new container.  Regression test for #1201
+func TestVolumesFromReadonlyMount(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(
+		&Config{
+			Image:   GetTestImage(runtime).ID,
 			Cmd:     []string{"/bin/echo", "-n", "foobar"},
 			Volumes: map[string]struct{}{"/test": {}},
 		},
@@ -1402,6 +2808,473 @@ func TestPrivilegedCanMount(t *testing.T) {
 	}
 }
 
+func TestCapAdd(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	if output, _ := runContainer(runtime, []string{"-cap-add", "SYS_ADMIN", "_", "sh", "-c", "mount -t tmpfs none /tmp && echo ok"}, t); output != "ok\n" {
+		t.Fatal("Could not mount into a container with SYS_ADMIN")
+	}
+}
+
+func TestCapDrop(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	if output, _ := runContainer(runtime, []string{"-cap-drop", "chown", "_", "sh", "-c", "chown 1 /tmp || echo ok"}, t); output != "ok\n" {
+		t.Fatal("Could chown in a container without CHOWN")
+	}
+}
+
+func TestDefaultSeccompProfile(t *testing.T) {
+	denies := func(profile *SeccompProfile, name string) bool {
+		for _, rule := range profile.Syscalls {
+			for _, syscallName := range rule.names() {
+				if syscallName == name {
+					return rule.Action == "SCMP_ACT_ERRNO"
+				}
+			}
+		}
+		return false
+	}
+	profile := defaultSeccompProfile(droppedCapabilities(false, nil, nil))
+	if profile.DefaultAction != "SCMP_ACT_ALLOW" || !denies(profile, "keyctl") || !denies(profile, "mount") || !denies(profile, "init_module") {
+		t.Fatalf("Unexpected default seccomp profile: %#v", profile.Syscalls[0])
+	}
+	if denies(profile, "ptrace") {
+		t.Fatalf("The containers with SYS_PTRACE should be able to ptrace")
+	}
+	profile = defaultSeccompProfile(droppedCapabilities(false, []string{"SYS_ADMIN"}, nil))
+	if denies(profile, "mount") || !denies(profile, "keyctl") {
+		t.Fatalf("Expected the containers with SYS_ADMIN to mount: %#v", profile.Syscalls[0])
+	}
+}
+
+func TestDroppedCapabilities(t *testing.T) {
+	if dropped := droppedCapabilities(false, nil, nil); strings.Join(dropped, " ") != strings.Join(defaultCapDrop, " ") {
+		t.Fatalf("Expected the default capabilities to be dropped, got %v", dropped)
+	}
+	if dropped := droppedCapabilities(true, nil, nil); len(dropped) != 0 {
+		t.Fatalf("Expected a privileged container to keep all its capabilities, got %v", dropped)
+	}
+	dropped := droppedCapabilities(false, []string{"CAP_SYS_ADMIN", "mknod"}, []string{"NET_RAW"})
+	for _, capability := range dropped {
+		if capability == "sys_admin" || capability == "mknod" {
+			t.Fatalf("Expected %s to be added, got %v", capability, dropped)
+		}
+	}
+	if len(dropped) != len(defaultCapDrop)-1 {
+		t.Fatalf("Expected the default capabilities but 2, and net_raw, to be dropped, got %v", dropped)
+	}
+	if dropped := droppedCapabilities(false, []string{"chown"}, []string{"ALL"}); len(dropped) != len(allCapabilities)-1 {
+		t.Fatalf("Expected all the capabilities but chown to be dropped, got %v", dropped)
+	}
+	if err := validateCapabilities([]string{"NET_ADMIN", "cap_chown", "all"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ParseRun([]string{"-cap-add", "FOO", "busybox", "true"}, nil); err == nil {
+		t.Fatal("Expected an error for an unknown capability")
+	}
+}
+
+func TestParseRunSecurityOpt(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "docker-seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	profile := `{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["mkdir","mkdirat"],"action":"SCMP_ACT_ERRNO"}]}`
+	if _, err := tmp.WriteString(profile); err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+	_, hostConfig, _, err := ParseRun([]string{"-security-opt", "seccomp=" + tmp.Name(), "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hostConfig.SecurityOpt) != 1 || hostConfig.SecurityOpt[0] != "seccomp="+profile {
+		t.Fatalf("Expected the profile in the host config, got %v", hostConfig.SecurityOpt)
+	}
+	if _, hostConfig, _, err = ParseRun([]string{"-security-opt", "seccomp=unconfined", "busybox", "true"}, nil); err != nil || hostConfig.SecurityOpt[0] != "seccomp=unconfined" {
+		t.Fatalf("Expected seccomp=unconfined, got %v (%v)", hostConfig.SecurityOpt, err)
+	}
+	if _, hostConfig, _, err = ParseRun([]string{"-security-opt", "apparmor=docker-default", "-security-opt", "label=type:svirt_apache_t", "-security-opt", "label=level:s0:c100,c200", "busybox", "true"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	options, err := parseSecurityOpt(hostConfig.SecurityOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.apparmor != "docker-default" || options.label["type"] != "svirt_apache_t" || options.label["level"] != "s0:c100,c200" {
+		t.Fatalf("Unexpected security options: %v", options)
+	}
+	for _, opt := range []string{"foo=bar", "seccomp=/nonexistent.json", "apparmor=", "label=foo:bar", "label=user:", "label=enable"} {
+		if _, _, _, err := ParseRun([]string{"-security-opt", opt, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the security option %s", opt)
+		}
+	}
+	for _, profile := range []string{`{"defaultAction":"SCMP_ACT_FOO"}`, `{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"action":"SCMP_ACT_KILL"}]}`,
+		`{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"name":"kill","action":"SCMP_ACT_ERRNO","args":[{"index":1}]}]}`} {
+		if _, err := parseSeccompProfile([]byte(profile)); err == nil {
+			t.Fatalf("Expected an error for the seccomp profile %s", profile)
+		}
+	}
+}
+
+func TestParseBindMode(t *testing.T) {
+	for spec, expected := range map[string][2]string{"ro": {"ro", ""}, "RW": {"rw", ""}, "z": {"rw", "z"}, "ro,Z": {"ro", "Z"}, "Z,rw": {"rw", "Z"}} {
+		mode, relabel, err := parseBindMode(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode != expected[0] || relabel != expected[1] {
+			t.Fatalf("Expected %s and %s for %s, got %s and %s", expected[0], expected[1], spec, mode, relabel)
+		}
+	}
+	for _, spec := range []string{"", "foo", "ro,rw", "z,Z", "ro,z,z"} {
+		if _, _, err := parseBindMode(spec); err == nil {
+			t.Fatalf("Expected an error for the bind mode %q", spec)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	label := setLabelParts(defaultProcessLabel, map[string]string{"type": "svirt_apache_t", "level": "s0:c1,c2"})
+	if label != "system_u:system_r:svirt_apache_t:s0:c1,c2" {
+		t.Fatalf("Unexpected label %s", label)
+	}
+	if level := labelLevel(label); level != "s0:c1,c2" {
+		t.Fatalf("Expected the level s0:c1,c2, got %s", level)
+	}
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		level, err := newMCSLevel(used)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used[level] {
+			t.Fatalf("The level %s is used twice", level)
+		}
+		used[level] = true
+	}
+	if err := relabel("/usr", defaultMountLabel+":c1,c2", "Z"); err == nil {
+		t.Fatal("Expected an error relabeling /usr")
+	}
+}
+
+func TestParseRunUserns(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-userns", "host", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostConfig.UsernsMode != "host" {
+		t.Fatalf("Expected the user namespace mode host, got %q", hostConfig.UsernsMode)
+	}
+	if _, _, _, err := ParseRun([]string{"-userns", "private", "busybox", "true"}, nil); err == nil {
+		t.Fatal("Expected an error for the user namespace mode private")
+	}
+}
+
+func TestParseRunNamespaceModes(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-pid", "host", "-ipc", "container:foo", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostConfig.PidMode != "host" || hostConfig.IpcMode != "container:foo" {
+		t.Fatalf("Unexpected namespace modes %q and %q", hostConfig.PidMode, hostConfig.IpcMode)
+	}
+	for _, args := range [][]string{{"-pid", "private"}, {"-ipc", "container:"}, {"-ipc", "shareable"}} {
+		if _, _, _, err := ParseRun(append(args, "busybox", "true"), nil); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
+	}
+	if ns := sharedNamespace("host"); ns != "1" {
+		t.Fatalf("Expected the namespace of the init of the host, got %q", ns)
+	}
+}
+
+func TestParseRunUlimits(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-ulimit", "nofile=65535:65535", "-ulimit", "nproc=512", "-ulimit", "core=0:-1", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hostConfig.Ulimits) != 3 || *hostConfig.Ulimits[0] != (Ulimit{"nofile", 65535, 65535}) ||
+		*hostConfig.Ulimits[1] != (Ulimit{"nproc", 512, 512}) || *hostConfig.Ulimits[2] != (Ulimit{"core", 0, -1}) {
+		t.Fatalf("Unexpected ulimits %v", hostConfig.Ulimits)
+	}
+	for _, spec := range []string{"nofile", "foo=1", "nofile=a", "nofile=2:1", "nofile=-1:1024", "nofile=-2"} {
+		if _, _, _, err := ParseRun([]string{"-ulimit", spec, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the ulimit %s", spec)
+		}
+	}
+	merged := mergeUlimits([]*Ulimit{{"nofile", 1024, 4096}, {"core", 0, 0}}, hostConfig.Ulimits)
+	if len(merged) != 3 || merged[0].String() != "core=0:-1" || merged[1].String() != "nofile=65535:65535" || merged[2].String() != "nproc=512:512" {
+		t.Fatalf("Unexpected merged ulimits %v", merged)
+	}
+}
+
+func TestParseRunMemory(t *testing.T) {
+	config, _, _, err := ParseRun([]string{"-m", "67108864", "-memory-swap", "134217728", "-memory-reservation", "33554432",
+		"-kernel-memory", "8388608", "-memory-swappiness", "0", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MemorySwap != 134217728 || config.MemoryReservation != 33554432 || config.KernelMemory != 8388608 ||
+		config.MemorySwappiness == nil || *config.MemorySwappiness != 0 {
+		t.Fatalf("Unexpected memory limits: swap %d, reservation %d, kernel %d, swappiness %v", config.MemorySwap,
+			config.MemoryReservation, config.KernelMemory, config.MemorySwappiness)
+	}
+	if getMemorySwap(config) != 134217728 {
+		t.Fatalf("Expected the memsw limit 134217728, got %d", getMemorySwap(config))
+	}
+	if config, _, _, err = ParseRun([]string{"busybox", "true"}, nil); err != nil || config.MemorySwappiness != nil {
+		t.Fatalf("Expected the swappiness of the host, got %v (%v)", config.MemorySwappiness, err)
+	}
+	for _, args := range [][]string{{"-memory-swap", "134217728"}, {"-m", "67108864", "-memory-swap", "33554432"},
+		{"-m", "67108864", "-memory-reservation", "134217728"}, {"-kernel-memory", "1024"}, {"-memory-swappiness", "101"}} {
+		if _, _, _, err := ParseRun(append(args, "busybox", "true"), nil); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
+	}
+	capabilities := &Capabilities{MemoryLimit: true}
+	if warnings := discardMemoryLimits(capabilities, config); len(warnings) != 0 {
+		t.Fatalf("Unexpected warnings %v", warnings)
+	}
+	config.KernelMemory = 8388608
+	if warnings := discardMemoryLimits(capabilities, config); len(warnings) != 1 || config.KernelMemory != 0 {
+		t.Fatalf("The kernel memory limit should be discarded with a warning, got %v", warnings)
+	}
+}
+
+func TestParseRunOom(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-m", "67108864", "-oom-kill-disable", "-oom-score-adj", "-500", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hostConfig.OomKillDisable || hostConfig.OomScoreAdj != -500 {
+		t.Fatalf("Unexpected OOM policy: kill disable %v, score adjustment %d", hostConfig.OomKillDisable, hostConfig.OomScoreAdj)
+	}
+	for _, adj := range []string{"-1001", "1001"} {
+		if _, _, _, err := ParseRun([]string{"-oom-score-adj", adj, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the OOM score adjustment %s", adj)
+		}
+	}
+}
+
+func TestParseRunGpus(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-gpus", "all", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hostConfig.DeviceRequests) != 1 || hostConfig.DeviceRequests[0].Count != -1 || hostConfig.DeviceRequests[0].Driver != "" {
+		t.Fatalf("Unexpected device requests %v", hostConfig.DeviceRequests)
+	}
+	request, err := parseGpus("device=0,2,capabilities=compute,utility")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(request.DeviceIDs, ",") != "0,2" || strings.Join(request.Capabilities, ",") != "compute,utility" || request.Count != 0 {
+		t.Fatalf("Unexpected device request %v", request)
+	}
+	if request, err := parseGpus("2,driver=nvidia"); err != nil || request.Count != 2 || request.Driver != "nvidia" {
+		t.Fatalf("Unexpected device request %v (%v)", request, err)
+	}
+	for _, spec := range []string{"0", "-1", "foo", "all,2", "2,device=0", "count=0", "device=", "driver=foo,all"} {
+		if _, _, _, err := ParseRun([]string{"-gpus", spec, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the gpus %s", spec)
+		}
+	}
+}
+
+func TestNvidiaDevicePlugin(t *testing.T) {
+	dev, err := ioutil.TempDir("", "docker-test-nvidia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dev)
+	for _, name := range []string{"nvidia0", "nvidia1", "nvidia10", "nvidiactl", "nvidia-uvm"} {
+		if err := ioutil.WriteFile(path.Join(dev, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plugin := &nvidiaDevicePlugin{dev: dev}
+	injection, err := plugin.Inject("abc", DeviceRequest{Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(injection.Devices) != 4 || injection.Devices[1].PathOnHost != path.Join(dev, "nvidia1") ||
+		injection.Devices[2].PathOnHost != path.Join(dev, "nvidiactl") {
+		t.Fatalf("Unexpected devices %v", injection.Devices)
+	}
+	if injection.Env[0] != "NVIDIA_VISIBLE_DEVICES=0,1" || injection.Env[1] != "NVIDIA_DRIVER_CAPABILITIES=compute,utility" {
+		t.Fatalf("Unexpected environment %v", injection.Env)
+	}
+	if injection, err = plugin.Inject("abc", DeviceRequest{DeviceIDs: []string{"10"}, Capabilities: []string{"utility"}}); err != nil {
+		t.Fatal(err)
+	}
+	if injection.Env[0] != "NVIDIA_VISIBLE_DEVICES=10" || injection.Env[1] != "NVIDIA_DRIVER_CAPABILITIES=utility" {
+		t.Fatalf("Unexpected environment %v", injection.Env)
+	}
+	for _, request := range []DeviceRequest{{Count: 4}, {DeviceIDs: []string{"2"}}, {DeviceIDs: []string{"GPU-1"}}, {Count: -1, Options: map[string]string{"foo": "bar"}}} {
+		if _, err := plugin.Inject("abc", request); err == nil {
+			t.Fatalf("Expected an error for the request %v", request)
+		}
+	}
+}
+
+func TestParseRunCgroupParent(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-cgroup-parent", "/docker-workers", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostConfig.CgroupParent != "/docker-workers" {
+		t.Fatalf("Expected the cgroup parent /docker-workers, got %s", hostConfig.CgroupParent)
+	}
+	for parent, expected := range map[string]string{"/docker-workers": "docker-workers", "docker/workers/": "docker/workers", "workers.slice": "workers.slice", "a-b-c.slice": "a.slice/a-b.slice/a-b-c.slice"} {
+		if p := cgroupParentPath(parent); p != expected {
+			t.Fatalf("Expected the cgroup %s for the parent %s, got %s", expected, parent, p)
+		}
+	}
+	for _, parent := range []string{"/", "../foo", "/foo/../../bar", "foo bar", "-foo.slice", "foo--bar.slice", "foo-.slice"} {
+		if _, _, _, err := ParseRun([]string{"-cgroup-parent", parent, "busybox", "true"}, nil); err == nil {
+			t.Fatalf("Expected an error for the cgroup parent %s", parent)
+		}
+	}
+}
+
+func TestLxcCgroupSettings(t *testing.T) {
+	settings := lxcCgroupSettings([]byte("lxc.utsname = foo\nlxc.cgroup.devices.allow = a \n# lxc.cgroup.cpu.shares = 2\nlxc.cgroup.memory.limit_in_bytes = 1024\n"))
+	if len(settings) != 2 || settings[0] != [2]string{"devices.allow", "a"} || settings[1] != [2]string{"memory.limit_in_bytes", "1024"} {
+		t.Fatalf("Unexpected cgroup settings %v", settings)
+	}
+	moved := "5:memory:/workers.slice/foo\n4:cpu,cpuacct:/workers.slice/foo\n0::/init.scope\n"
+	if !inCgroup(moved, "workers.slice/foo") {
+		t.Fatalf("Expected %q in the cgroup workers.slice/foo", moved)
+	}
+	if inCgroup("5:memory:/workers.slice/foo\n4:cpu,cpuacct:/lxc/foo\n", "workers.slice/foo") {
+		t.Fatalf("A process not in all the cgroups should not be in them")
+	}
+}
+
+func TestParseRunBlkio(t *testing.T) {
+	_, hostConfig, _, err := ParseRun([]string{"-blkio-weight", "300", "-device-read-bps", "/dev/sda:10mb", "-device-write-bps", "/dev/sda:512k",
+		"-device-read-iops", "/dev/sdb:1000", "-device-write-iops", "/dev/sdb:200", "busybox", "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostConfig.BlkioWeight != 300 {
+		t.Fatalf("Expected the blkio weight 300, got %d", hostConfig.BlkioWeight)
+	}
+	if len(hostConfig.BlkioDeviceReadBps) != 1 || hostConfig.BlkioDeviceReadBps[0] != (ThrottleDevice{"/dev/sda", 10485760}) ||
+		len(hostConfig.BlkioDeviceWriteBps) != 1 || hostConfig.BlkioDeviceWriteBps[0] != (ThrottleDevice{"/dev/sda", 524288}) ||
+		len(hostConfig.BlkioDeviceReadIOps) != 1 || hostConfig.BlkioDeviceReadIOps[0] != (ThrottleDevice{"/dev/sdb", 1000}) ||
+		len(hostConfig.BlkioDeviceWriteIOps) != 1 || hostConfig.BlkioDeviceWriteIOps[0] != (ThrottleDevice{"/dev/sdb", 200}) {
+		t.Fatalf("Unexpected device rates %v %v %v %v", hostConfig.BlkioDeviceReadBps, hostConfig.BlkioDeviceWriteBps,
+			hostConfig.BlkioDeviceReadIOps, hostConfig.BlkioDeviceWriteIOps)
+	}
+	for _, args := range [][]string{{"-blkio-weight", "5"}, {"-blkio-weight", "2000"}, {"-device-read-bps", "/dev/sda"},
+		{"-device-read-bps", "sda:10mb"}, {"-device-write-bps", "/dev/sda:10mbit"}, {"-device-read-iops", "/dev/sda:10k"},
+		{"-device-write-iops", "/dev/sda:0"}} {
+		if _, _, _, err := ParseRun(append(args, "busybox", "true"), nil); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
+	}
+	if _, err := findBlkioThrottles(&HostConfig{BlkioDeviceReadBps: []ThrottleDevice{{"/dev/null", 1}}}); err == nil {
+		t.Fatal("Expected an error for the character device /dev/null")
+	}
+}
+
+func TestUlimits(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	if output, _ := runContainer(runtime, []string{"-ulimit", "nofile=512:1024", "_", "sh", "-c", "ulimit -n"}, t); output != "512\n" {
+		t.Fatalf("Expected the soft limit 512 of the descriptors, got %q", output)
+	}
+}
+
+func TestOomScoreAdj(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	if output, _ := runContainer(runtime, []string{"-oom-score-adj", "500", "_", "cat", "/proc/self/oom_score_adj"}, t); output != "500\n" {
+		t.Fatalf("Expected the oom_score_adj 500, got %q", output)
+	}
+}
+
+func TestIpcContainer(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"sh", "-c", "touch /dev/shm/foo && sleep 10"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+	output, _ := runContainer(runtime, []string{"-ipc", "container:" + container.ID, "_", "sh", "-c", "for i in 1 2 3 4 5; do test -e /dev/shm/foo && echo ok && break; sleep 1; done"}, t)
+	if output != "ok\n" {
+		t.Fatalf("Expected the container to share the /dev/shm of %s, got %q", container.ShortID(), output)
+	}
+	if _, err := runContainer(runtime, []string{"-pid", "container:nonexistent", "_", "true"}, nil); err == nil {
+		t.Fatal("Expected an error joining the namespace of a container which doesn't exist")
+	}
+}
+
+func TestUsernsPrivileged(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	runtime.idMappings = &IDMappings{Uids: []IDMap{{0, 100000, 65536}}, Gids: []IDMap{{0, 100000, 65536}}}
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:      GetTestImage(runtime).ID,
+		Cmd:        []string{"true"},
+		Privileged: true,
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.setupUserns(&HostConfig{}); err == nil {
+		t.Fatal("Expected a privileged container to be refused in the user namespace of the daemon")
+	}
+	if err := container.setupUserns(&HostConfig{UsernsMode: "host"}); err != nil || container.IDMappings != nil {
+		t.Fatalf("Expected -userns host to opt out of the user namespace (%v)", err)
+	}
+}
+
+func TestSeccomp(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	profile := `seccomp={"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["mkdir","mkdirat"],"action":"SCMP_ACT_ERRNO"}]}`
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"sh", "-c", "! mkdir /tmp/foo"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(&HostConfig{SecurityOpt: []string{profile}}); err != nil {
+		t.Fatal(err)
+	}
+	container.Wait()
+	if container.State.ExitCode != 0 {
+		t.Fatalf("Expected mkdir to be denied by the seccomp profile, the exit code is %d", container.State.ExitCode)
+	}
+	if container.SeccompProfilePath == "" {
+		t.Fatalf("Expected the container to have a seccomp profile")
+	}
+	grepFile(t, container.lxcConfigPath(), container.SeccompProfilePath+" "+container.RootfsPath()+"/.dockerseccomp")
+
+	if output, _ := runContainer(runtime, []string{"-security-opt", "seccomp=unconfined", "_", "sh", "-c", "mkdir /tmp/foo && echo ok"}, t); output != "ok\n" {
+		t.Fatal("Expected an unconfined container to mkdir")
+	}
+}
+
 func TestPrivilegedCannotMknod(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -1417,3 +3290,25 @@ func TestPrivilegedCannotMount(t *testing.T) {
 		t.Fatal("Could mount into secure container")
 	}
 }
+
+func TestHostConfigIsZero(t *testing.T) {
+	for _, hostConfig := range []*HostConfig{
+		{},
+		{ContainerIDFile: "/tmp/cid"},
+		{Binds: []string{}, Tmpfs: map[string]string{}, LogConfig: LogConfig{Config: map[string]string{}}},
+	} {
+		if !hostConfig.isZero() {
+			t.Fatalf("Expected %v to be empty", hostConfig)
+		}
+	}
+	for _, hostConfig := range []*HostConfig{
+		{Binds: []string{"/tmp:/tmp"}},
+		{RestartPolicy: RestartPolicy{Name: "always"}},
+		{OomScoreAdj: 100},
+		{DeviceRequests: []DeviceRequest{{Count: -1}}},
+	} {
+		if hostConfig.isZero() {
+			t.Fatalf("Expected %v not to be empty", hostConfig)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The device plugin of the requests which don't set one
+const DefaultDevicePlugin = "nvidia"
+
+// A request of a container for devices of a device plugin, from -gpus: a
+// count of them (-1 for all) or their IDs
+type DeviceRequest struct {
+	Driver       string            // The device plugin, nvidia if empty
+	Count        int               // The number of devices, -1 for all of them, unless DeviceIDs are given
+	DeviceIDs    []string          // The devices, by ID (e.g. their index)
+	Capabilities []string          // What the container does with them (e.g. compute, utility), the default ones of the plugin if empty
+	Options      map[string]string // Options of the plugin
+}
+
+// A file or a directory of the host a device plugin mounts read-only in a
+// container (e.g. a library of the driver of the devices)
+type DeviceMount struct {
+	Source      string
+	Destination string
+}
+
+// What a device plugin gives a container for its devices
+type DeviceInjection struct {
+	Devices []DeviceMapping // The device nodes, created like the ones of -device
+	Mounts  []DeviceMount
+	Env     []string // Added to the environment of the container, before its own one
+}
+
+// A DevicePlugin gives devices of the host (e.g. GPUs) to the containers
+// which request them, with what they need to use them: the nodes, the
+// libraries and the environment. Plugins are added with
+// RegisterDevicePlugin.
+type DevicePlugin interface {
+	// Allocate the devices of the request to the container id, which is
+	// starting, and return what it needs. It replaces what the container
+	// had if it wasn't released, when its previous start failed.
+	Inject(id string, request DeviceRequest) (*DeviceInjection, error)
+	// The container id stopped, its devices are free.
+	Release(id string) error
+}
+
+var devicePlugins = make(map[string]func() (DevicePlugin, error))
+
+// Make a device plugin available under the given name, the init function is
+// called the first time a container requests its devices.
+func RegisterDevicePlugin(name string, init func() (DevicePlugin, error)) {
+	if _, exists := devicePlugins[name]; exists {
+		panic(fmt.Sprintf("Device plugin %s registered twice", name))
+	}
+	devicePlugins[name] = init
+}
+
+// Parse the -gpus of docker run: all, a count, or comma separated options,
+// count=N (or all), device=ID[,ID...], capabilities=CAP[,CAP...], driver=NAME
+// and the options of the plugin (e.g. device=0,1,capabilities=compute)
+func parseGpus(spec string) (DeviceRequest, error) {
+	request := DeviceRequest{Options: make(map[string]string)}
+	counted := false
+	list := ""
+	for _, option := range strings.Split(spec, ",") {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) == 1 {
+			switch {
+			case option == "all" && !counted && list == "":
+				request.Count, counted = -1, true
+			case list == "device" && option != "":
+				request.DeviceIDs = append(request.DeviceIDs, option)
+			case list == "capabilities" && option != "":
+				request.Capabilities = append(request.Capabilities, option)
+			default:
+				count, err := strconv.Atoi(option)
+				if err != nil || count <= 0 || counted || list != "" {
+					return request, fmt.Errorf("Invalid gpus: %s (all, a count or device=IDs)", spec)
+				}
+				request.Count, counted = count, true
+			}
+			continue
+		}
+		list = ""
+		switch parts[0] {
+		case "count":
+			count, err := strconv.Atoi(parts[1])
+			if parts[1] == "all" {
+				count, err = -1, nil
+			}
+			if err != nil || count == 0 || count < -1 || counted {
+				return request, fmt.Errorf("Invalid gpus: %s (all, a count or device=IDs)", spec)
+			}
+			request.Count, counted = count, true
+		case "device", "capabilities":
+			list = parts[0]
+			if parts[1] == "" {
+				return request, fmt.Errorf("Invalid gpus: %s (%s=VALUE[,VALUE...])", spec, parts[0])
+			}
+			if list == "device" {
+				request.DeviceIDs = append(request.DeviceIDs, parts[1])
+			} else {
+				request.Capabilities = append(request.Capabilities, parts[1])
+			}
+		case "driver":
+			request.Driver = parts[1]
+		default:
+			request.Options[parts[0]] = parts[1]
+		}
+	}
+	return request, validateDeviceRequests([]DeviceRequest{request})
+}
+
+func validateDeviceRequests(requests []DeviceRequest) error {
+	for _, request := range requests {
+		if _, exists := devicePlugins[request.Driver]; request.Driver != "" && !exists {
+			names := make([]string, 0, len(devicePlugins))
+			for name := range devicePlugins {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("Bad parameter: invalid device plugin %s (%s)", request.Driver, strings.Join(names, ", "))
+		}
+		if len(request.DeviceIDs) > 0 && request.Count != 0 {
+			return fmt.Errorf("Bad parameter: a device request can't have both a count and device IDs")
+		}
+		if len(request.DeviceIDs) == 0 && (request.Count == 0 || request.Count < -1) {
+			return fmt.Errorf("Bad parameter: invalid count %d of devices (-1 for all of them)", request.Count)
+		}
+	}
+	return nil
+}
+
+// The instance of the device plugin name, it's created the first time a
+// container requests its devices
+func (runtime *Runtime) loadDevicePlugin(name string) (DevicePlugin, error) {
+	if name == "" {
+		name = DefaultDevicePlugin
+	}
+	runtime.devicePluginsLock.Lock()
+	defer runtime.devicePluginsLock.Unlock()
+	if plugin, exists := runtime.devicePlugins[name]; exists {
+		return plugin, nil
+	}
+	init, exists := devicePlugins[name]
+	if !exists {
+		return nil, fmt.Errorf("Bad parameter: invalid device plugin %s", name)
+	}
+	plugin, err := init()
+	if err != nil {
+		return nil, err
+	}
+	if runtime.devicePlugins == nil {
+		runtime.devicePlugins = make(map[string]DevicePlugin)
+	}
+	runtime.devicePlugins[name] = plugin
+	return plugin, nil
+}
+
+// Ask the device plugins of the requests of a starting container for its
+// devices, the container releases them when it stops
+func (container *Container) injectDevices(requests []DeviceRequest) (*DeviceInjection, error) {
+	injection := &DeviceInjection{}
+	container.DevicePlugins = nil
+	for _, request := range requests {
+		plugin, err := container.runtime.loadDevicePlugin(request.Driver)
+		if err != nil {
+			return nil, err
+		}
+		name := request.Driver
+		if name == "" {
+			name = DefaultDevicePlugin
+		}
+		container.DevicePlugins = append(container.DevicePlugins, name)
+		injected, err := plugin.Inject(container.ID, request)
+		if err != nil {
+			return nil, err
+		}
+		injection.Devices = append(injection.Devices, injected.Devices...)
+		injection.Mounts = append(injection.Mounts, injected.Mounts...)
+		injection.Env = append(injection.Env, injected.Env...)
+	}
+	return injection, nil
+}
+
+// Release the devices of the device plugins of a stopped container
+func (container *Container) releaseDevices() {
+	for _, name := range container.DevicePlugins {
+		plugin, err := container.runtime.loadDevicePlugin(name)
+		if err == nil {
+			err = plugin.Release(container.ID)
+		}
+		if err != nil {
+			log.Printf("WARNING: Unable to release the %s devices of %s: %s", name, container.ID, err)
+		}
+	}
+}
+
+func init() {
+	RegisterDevicePlugin("nvidia", func() (DevicePlugin, error) {
+		return &nvidiaDevicePlugin{dev: "/dev"}, nil
+	})
+}
+
+// The default plugin: the NVIDIA GPUs of the host, /dev/nvidia0,
+// /dev/nvidia1..., with the control devices of the driver, its libraries in
+// /usr/local/nvidia/lib and lib64, and its tools in /usr/local/nvidia/bin,
+// where the CUDA images look for them. The containers share the GPUs, none
+// is reserved.
+type nvidiaDevicePlugin struct {
+	dev string
+}
+
+// The devices of the driver the containers need along the GPUs
+var nvidiaControlDevices = []string{"nvidiactl", "nvidia-uvm", "nvidia-uvm-tools", "nvidia-modeset"}
+
+// The libraries and the tools of the driver, by the prefix of their names
+var nvidiaLibraries = []string{
+	"libcuda.so", "libnvidia-ml.so", "libnvidia-ptxjitcompiler.so", "libnvidia-fatbinaryloader.so",
+	"libnvidia-compiler.so", "libnvidia-opencl.so", "libnvcuvid.so", "libnvidia-encode.so",
+}
+var nvidiaBinaries = []string{"nvidia-smi", "nvidia-debugdump", "nvidia-persistenced"}
+
+// The capabilities of the containers which don't request any
+const nvidiaDefaultCapabilities = "compute,utility"
+
+// The indexes of the GPUs of the host, in order
+func (plugin *nvidiaDevicePlugin) gpus() ([]int, error) {
+	paths, err := filepath.Glob(path.Join(plugin.dev, "nvidia[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	var gpus []int
+	for _, p := range paths {
+		if index, err := strconv.Atoi(strings.TrimPrefix(path.Base(p), "nvidia")); err == nil {
+			gpus = append(gpus, index)
+		}
+	}
+	sort.Ints(gpus)
+	return gpus, nil
+}
+
+func (plugin *nvidiaDevicePlugin) Inject(id string, request DeviceRequest) (*DeviceInjection, error) {
+	for option := range request.Options {
+		return nil, fmt.Errorf("Bad parameter: the nvidia device plugin has no option %s", option)
+	}
+	gpus, err := plugin.gpus()
+	if err != nil {
+		return nil, err
+	}
+	if len(gpus) == 0 {
+		return nil, fmt.Errorf("No such device: the host has no NVIDIA GPU")
+	}
+	var selected []int
+	switch {
+	case len(request.DeviceIDs) > 0:
+		for _, deviceID := range request.DeviceIDs {
+			index, err := strconv.Atoi(deviceID)
+			if err != nil {
+				return nil, fmt.Errorf("Bad parameter: invalid GPU %s (an index, e.g. 0)", deviceID)
+			}
+			if i := sort.SearchInts(gpus, index); i == len(gpus) || gpus[i] != index {
+				return nil, fmt.Errorf("No such device: GPU %d", index)
+			}
+			selected = append(selected, index)
+		}
+	case request.Count == -1:
+		selected = gpus
+	case request.Count > len(gpus):
+		return nil, fmt.Errorf("The host has %d GPUs, %d were requested", len(gpus), request.Count)
+	default:
+		selected = gpus[:request.Count]
+	}
+
+	injection := &DeviceInjection{}
+	visible := make([]string, len(selected))
+	for i, index := range selected {
+		visible[i] = strconv.Itoa(index)
+		injection.Devices = append(injection.Devices, DeviceMapping{PathOnHost: path.Join(plugin.dev, "nvidia"+visible[i])})
+	}
+	for _, name := range nvidiaControlDevices {
+		if _, err := os.Stat(path.Join(plugin.dev, name)); err == nil {
+			injection.Devices = append(injection.Devices, DeviceMapping{PathOnHost: path.Join(plugin.dev, name)})
+		}
+	}
+	capabilities := nvidiaDefaultCapabilities
+	if len(request.Capabilities) > 0 {
+		capabilities = strings.Join(request.Capabilities, ",")
+	}
+	injection.Env = []string{
+		"NVIDIA_VISIBLE_DEVICES=" + strings.Join(visible, ","),
+		"NVIDIA_DRIVER_CAPABILITIES=" + capabilities,
+	}
+	injection.Mounts = append(nvidiaLibraryMounts(), nvidiaBinaryMounts()...)
+	return injection, nil
+}
+
+func (plugin *nvidiaDevicePlugin) Release(id string) error {
+	return nil
+}
+
+// The libraries of the driver in the cache of ldconfig: the 64 bits ones go
+// in /usr/local/nvidia/lib64, the others in /usr/local/nvidia/lib
+func nvidiaLibraryMounts() []DeviceMount {
+	output, err := exec.Command("ldconfig", "-p").Output()
+	if err != nil {
+		utils.Debugf("Unable to list the libraries of the NVIDIA driver: %s", err)
+		return nil
+	}
+	var mounts []DeviceMount
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		// libcuda.so.1 (libc6,x86-64) => /usr/lib/x86_64-linux-gnu/libcuda.so.1
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " => ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.Fields(fields[0])[0]
+		dir := "/usr/local/nvidia/lib"
+		if strings.Contains(fields[0], "64") {
+			dir = "/usr/local/nvidia/lib64"
+		}
+		for _, prefix := range nvidiaLibraries {
+			if strings.HasPrefix(name, prefix) && !seen[path.Join(dir, name)] {
+				seen[path.Join(dir, name)] = true
+				mounts = append(mounts, DeviceMount{Source: fields[1], Destination: path.Join(dir, name)})
+			}
+		}
+	}
+	return mounts
+}
+
+// The tools of the driver in the PATH of the daemon
+func nvidiaBinaryMounts() []DeviceMount {
+	var mounts []DeviceMount
+	for _, name := range nvidiaBinaries {
+		if p, err := exec.LookPath(name); err == nil {
+			mounts = append(mounts, DeviceMount{Source: p, Destination: path.Join("/usr/local/nvidia/bin", name)})
+		}
+	}
+	return mounts
+}
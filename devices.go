@@ -0,0 +1,292 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A device of the host given to a container, without making it privileged:
+// its node is created in the container and the devices cgroup allows it. A
+// directory (e.g. /dev/snd) gives all the devices under it.
+type DeviceMapping struct {
+	PathOnHost        string
+	PathInContainer   string // PathOnHost if empty
+	CgroupPermissions string // r (read), w (write) and m (mknod), rwm if empty
+}
+
+// A device node of a container, from one of its DeviceMapping
+type Device struct {
+	Path        string // In the container
+	Type        string // c or b
+	Major       int64
+	Minor       int64
+	Permissions string
+	FileMode    os.FileMode // The permissions of the node on the host
+	Uid         uint32
+	Gid         uint32
+}
+
+// Parse the host[:container[:permissions]] of -device (e.g.
+// /dev/snd:/dev/snd:rwm)
+func parseDevice(spec string) (DeviceMapping, error) {
+	parts := strings.Split(spec, ":")
+	device := DeviceMapping{PathOnHost: parts[0]}
+	switch len(parts) {
+	case 3:
+		device.CgroupPermissions = parts[2]
+		fallthrough
+	case 2:
+		// The permissions alone, /dev/fuse:rw
+		if len(parts) == 2 && validDevicePermissions(parts[1]) {
+			device.CgroupPermissions = parts[1]
+		} else {
+			device.PathInContainer = parts[1]
+		}
+	case 1:
+	default:
+		return device, fmt.Errorf("Invalid device: %s (host[:container[:permissions]])", spec)
+	}
+	return device, validateDeviceMapping(device)
+}
+
+func validDevicePermissions(permissions string) bool {
+	if permissions == "" {
+		return false
+	}
+	for _, c := range permissions {
+		if !strings.ContainsRune("rwm", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateDeviceMapping(device DeviceMapping) error {
+	if !path.IsAbs(device.PathOnHost) {
+		return fmt.Errorf("Bad parameter: invalid device %s, the path on the host must be absolute", device.PathOnHost)
+	}
+	if device.PathInContainer != "" && (!path.IsAbs(device.PathInContainer) || path.Clean(device.PathInContainer) == "/") {
+		return fmt.Errorf("Bad parameter: invalid device destination %s, it must be an absolute path other than /", device.PathInContainer)
+	}
+	if device.CgroupPermissions != "" && !validDevicePermissions(device.CgroupPermissions) {
+		return fmt.Errorf("Bad parameter: invalid permissions %s of the device %s (r, w and m)", device.CgroupPermissions, device.PathOnHost)
+	}
+	return nil
+}
+
+func validateDevices(devices []DeviceMapping) error {
+	for _, device := range devices {
+		if err := validateDeviceMapping(device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The device nodes of the devices of a host config, found on the host
+func findDevices(mappings []DeviceMapping) ([]*Device, error) {
+	var devices []*Device
+	for _, mapping := range mappings {
+		dst := mapping.PathInContainer
+		if dst == "" {
+			dst = mapping.PathOnHost
+		}
+		permissions := mapping.CgroupPermissions
+		if permissions == "" {
+			permissions = "rwm"
+		}
+		nodes, err := deviceNodes(path.Clean(mapping.PathOnHost), path.Clean(dst), permissions)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, nodes...)
+	}
+	return devices, nil
+}
+
+// The devices of a container under /dev, and the mount points of the device
+// mounts there, are created in a tmpfs of the daemon bound on its /dev along
+// a copy of the /dev of its image, the way lxc mounts /dev/pts: they never
+// end up in its layer. The ones elsewhere are created in its root
+// filesystem, and removed when it stops.
+func (container *Container) setupDevices(devices []*Device, mounts []DeviceMount) error {
+	container.cleanupDevices()
+	underDev := false
+	for _, device := range devices {
+		underDev = underDev || isUnderDev(device.Path)
+	}
+	for _, mount := range mounts {
+		if !path.IsAbs(mount.Destination) || path.Clean(mount.Destination) == "/" {
+			return fmt.Errorf("Invalid destination %s of the device mount %s", mount.Destination, mount.Source)
+		}
+		underDev = underDev || isUnderDev(mount.Destination)
+	}
+	if underDev {
+		devPath := path.Join(container.root, "dev")
+		if err := os.MkdirAll(devPath, 0755); err != nil {
+			return err
+		}
+		if err := mount("tmpfs", devPath, "tmpfs", 0, "mode=755"); err != nil {
+			return fmt.Errorf("Unable to mount the tmpfs of /dev: %s", err)
+		}
+		container.DevPath = devPath
+		imageDev, err := utils.FollowSymlinkInScope(path.Join(container.RootfsPath(), "dev"), container.RootfsPath())
+		if err != nil {
+			return err
+		}
+		if err := copyDevTree(imageDev, devPath); err != nil {
+			return err
+		}
+		for _, dir := range []string{"pts", "shm"} {
+			if err := os.MkdirAll(path.Join(devPath, dir), 0755); err != nil {
+				return err
+			}
+		}
+		// The links of the image aren't copied, the usual ones are created
+		for name, target := range devLinks {
+			if err := os.Symlink(target, path.Join(devPath, name)); err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+	}
+	// The mount points are resolved in the container like the devices, and
+	// what's already there must be of the kind of the source
+	for _, mount := range mounts {
+		info, err := os.Stat(mount.Source)
+		if err != nil {
+			return err
+		}
+		dst, err := container.devicePath(path.Clean(mount.Destination))
+		if err != nil {
+			return err
+		}
+		if existing, err := os.Lstat(dst); err == nil {
+			if existing.IsDir() != info.IsDir() {
+				return fmt.Errorf("Invalid destination %s of the device mount %s: it exists and is not of the same kind", mount.Destination, mount.Source)
+			}
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if info.IsDir() {
+			if err := os.Mkdir(dst, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	for _, device := range devices {
+		dst, err := container.devicePath(device.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := mknodDevice(dst, device); err != nil {
+			return fmt.Errorf("Unable to create the device %s: %s", device.Path, err)
+		}
+	}
+	return nil
+}
+
+// The links of the /dev of the containers
+var devLinks = map[string]string{
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+	"ptmx":   "pts/ptmx",
+}
+
+func isUnderDev(p string) bool {
+	return strings.HasPrefix(path.Clean(p), "/dev/")
+}
+
+// The path on the host of the file p of the container for its devices, with
+// its parents: in the tmpfs of its /dev, or in its root filesystem where the
+// ones created are kept in DeviceStubs. The links of the image are followed
+// as in the container, they never lead out of it.
+func (container *Container) devicePath(p string) (string, error) {
+	scope, rel := container.RootfsPath(), p
+	if container.DevPath != "" && isUnderDev(p) {
+		scope, rel = container.DevPath, strings.TrimPrefix(p, "/dev")
+	}
+	resolved, err := utils.FollowSymlinkInScope(path.Join(scope, rel), scope)
+	if err != nil {
+		return "", err
+	}
+	if resolved == scope {
+		return "", fmt.Errorf("Invalid device path %s: it's the root of the container", p)
+	}
+	// The parents which exist are real directories, the links were followed
+	parents, err := filepath.Rel(scope, path.Dir(resolved))
+	if err != nil {
+		return "", err
+	}
+	dir := scope
+	for _, part := range strings.Split(parents, "/") {
+		if part == "." {
+			continue
+		}
+		dir = path.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return "", err
+			}
+			if scope == container.RootfsPath() {
+				container.DeviceStubs = append(container.DeviceStubs, strings.TrimPrefix(dir, scope))
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("Invalid device path %s: %s is not a directory", p, strings.TrimPrefix(dir, scope))
+		}
+	}
+	// resolved itself is created by the caller
+	if _, err := os.Lstat(resolved); os.IsNotExist(err) && scope == container.RootfsPath() {
+		container.DeviceStubs = append(container.DeviceStubs, strings.TrimPrefix(resolved, scope))
+	}
+	return resolved, nil
+}
+
+// Remove the devices of a stopped container: the tmpfs of its /dev and what
+// was created in its root filesystem, the deepest first
+func (container *Container) cleanupDevices() {
+	if container.DevPath != "" {
+		if mounted, _ := Mounted(container.DevPath); mounted {
+			if err := Unmount(container.DevPath); err != nil {
+				log.Printf("WARNING: Unable to unmount the /dev of %s: %s", container.ID, err)
+			}
+		}
+		container.DevPath = ""
+	}
+	for i := len(container.DeviceStubs) - 1; i >= 0; i-- {
+		// The container may have replaced its parents with links since
+		stub := path.Join(container.RootfsPath(), container.DeviceStubs[i])
+		resolved, err := utils.FollowSymlinkInScope(path.Dir(stub), container.RootfsPath())
+		if err == nil && resolved != path.Dir(stub) {
+			err = fmt.Errorf("its parent was replaced by a link")
+		}
+		if err == nil {
+			err = os.Remove(stub)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("WARNING: Unable to remove %s from %s: %s", container.DeviceStubs[i], container.ID, err)
+		}
+	}
+	container.DeviceStubs = nil
+}
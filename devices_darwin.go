@@ -0,0 +1,15 @@
+package docker
+
+import "errors"
+
+func deviceNodes(src, dst, permissions string) ([]*Device, error) {
+	return nil, errors.New("Devices are not implemented on darwin")
+}
+
+func mknodDevice(p string, device *Device) error {
+	return errors.New("Devices are not implemented on darwin")
+}
+
+func copyDevTree(src, dst string) error {
+	return errors.New("Devices are not implemented on darwin")
+}
@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// The device nodes of src, walked if it's a directory, with the paths they
+// get under dst
+func deviceNodes(src, dst, permissions string) ([]*Device, error) {
+	// The links like /dev/cdrom are followed
+	if resolved, err := filepath.EvalSymlinks(src); err == nil {
+		src = resolved
+	}
+	var devices []*Device
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("Unable to stat the device %s", p)
+		}
+		var deviceType string
+		switch stat.Mode & syscall.S_IFMT {
+		case syscall.S_IFCHR:
+			deviceType = "c"
+		case syscall.S_IFBLK:
+			deviceType = "b"
+		default:
+			if p == src {
+				return fmt.Errorf("Bad parameter: %s is not a device", src)
+			}
+			// The links and files along the devices of a directory
+			return nil
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		devices = append(devices, &Device{
+			Path:        path.Join(dst, rel),
+			Type:        deviceType,
+			Major:       int64((stat.Rdev >> 8) & 0xfff),
+			Minor:       int64((stat.Rdev & 0xff) | ((stat.Rdev >> 12) & 0xfff00)),
+			Permissions: permissions,
+			FileMode:    info.Mode().Perm(),
+			Uid:         stat.Uid,
+			Gid:         stat.Gid,
+		})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No such device: %s", src)
+	}
+	return devices, err
+}
+
+func mknodDevice(p string, device *Device) error {
+	mode := uint32(device.FileMode)
+	if device.Type == "b" {
+		mode |= syscall.S_IFBLK
+	} else {
+		mode |= syscall.S_IFCHR
+	}
+	dev := (device.Minor & 0xff) | (device.Major&0xfff)<<8 | (device.Minor&^0xff)<<12
+	if err := syscall.Mknod(p, mode, int(dev)); err != nil {
+		return err
+	}
+	// Mknod is subject to the umask
+	if err := os.Chmod(p, device.FileMode); err != nil {
+		return err
+	}
+	return os.Chown(p, int(device.Uid), int(device.Gid))
+}
+
+// Copy the directories and the nodes of the /dev src of an image to dst, with
+// empty files for its regular files (e.g. mount points). Its links aren't
+// copied: the daemon would follow them out of the container.
+func copyDevTree(src, dst string) error {
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("Unable to stat %s", p)
+		}
+		target := filepath.Join(dst, rel)
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			err = os.Mkdir(target, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			return nil
+		case mode.IsRegular():
+			var f *os.File
+			if f, err = os.OpenFile(target, os.O_CREATE, mode.Perm()); err == nil {
+				f.Close()
+			}
+		default:
+			err = syscall.Mknod(target, stat.Mode, int(stat.Rdev))
+		}
+		if err != nil {
+			return err
+		}
+		// Mkdir and Mknod are subject to the umask
+		if err := os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSticky)); err != nil {
+			return err
+		}
+		return os.Lchown(target, int(stat.Uid), int(stat.Gid))
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package docker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"net"
+	"strings"
+	"time"
+)
+
+// When true, a DNS server runs on the gateway of each network and answers for
+// the containers attached to it; the other queries are forwarded.
+var EmbeddedDNS = true
+
+const (
+	dnsHeaderLen      = 12
+	dnsMaxMsgSize     = 65535
+	dnsTypeA          = 1
+	dnsClassIN        = 1
+	dnsRcodeServFail  = 2
+	dnsTTL            = 10 // seconds, containers come and go
+	dnsForwardTimeout = 5 * time.Second
+)
+
+var errDNSMalformed = errors.New("Malformed DNS query")
+
+type dnsQuestion struct {
+	name   string // lower case, without the trailing dot
+	qtype  uint16
+	qclass uint16
+	end    int // offset of the end of the question in the message
+}
+
+// Parse the question of a standard query. Only one question is supported,
+// like every resolver out there.
+func parseDNSQuestion(msg []byte) (*dnsQuestion, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	// A response, or not a standard query
+	if flags&0x8000 != 0 || flags&0x7800 != 0 {
+		return nil, errDNSMalformed
+	}
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, errDNSMalformed
+	}
+	var labels []string
+	offset := dnsHeaderLen
+	for {
+		if offset >= len(msg) {
+			return nil, errDNSMalformed
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// No compression in the questions
+		if length&0xc0 != 0 || offset+length > len(msg) {
+			return nil, errDNSMalformed
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(msg) {
+		return nil, errDNSMalformed
+	}
+	return &dnsQuestion{
+		name:   strings.ToLower(strings.Join(labels, ".")),
+		qtype:  binary.BigEndian.Uint16(msg[offset:]),
+		qclass: binary.BigEndian.Uint16(msg[offset+2:]),
+		end:    offset + 4,
+	}, nil
+}
+
+// Build the reply to query, with ip as the only answer if it's not nil
+func dnsReply(query []byte, question *dnsQuestion, rcode uint16, ip net.IP) []byte {
+	reply := make([]byte, question.end, question.end+16)
+	copy(reply, query[:question.end])
+	// QR, the RD bit of the query and RA
+	flags := 0x8000 | binary.BigEndian.Uint16(query[2:])&0x0100 | 0x0080 | rcode
+	if rcode == 0 {
+		// AA: we are the authority for the names of the containers
+		flags |= 0x0400
+	}
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	// Drop the other sections of the query (e.g: EDNS)
+	binary.BigEndian.PutUint16(reply[6:], 0)
+	binary.BigEndian.PutUint16(reply[8:], 0)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+	if ip == nil {
+		return reply
+	}
+	binary.BigEndian.PutUint16(reply[6:], 1)
+	answer := make([]byte, 16)
+	// Pointer to the name of the question
+	binary.BigEndian.PutUint16(answer[0:], 0xc000|dnsHeaderLen)
+	binary.BigEndian.PutUint16(answer[2:], dnsTypeA)
+	binary.BigEndian.PutUint16(answer[4:], dnsClassIN)
+	binary.BigEndian.PutUint32(answer[6:], dnsTTL)
+	binary.BigEndian.PutUint16(answer[10:], net.IPv4len)
+	copy(answer[12:], ip.To4())
+	return append(reply, answer...)
+}
+
+// DNSServer answers the queries for the names lookup knows and forwards the
+// others to the servers returned by upstream.
+type DNSServer struct {
+	conn     *net.UDPConn
+	lookup   func(name string) net.IP
+	upstream func() []string
+}
+
+func NewDNSServer(addr *net.UDPAddr, lookup func(name string) net.IP, upstream func() []string) (*DNSServer, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSServer{conn: conn, lookup: lookup, upstream: upstream}, nil
+}
+
+func (server *DNSServer) Addr() net.Addr {
+	return server.conn.LocalAddr()
+}
+
+// Serve the queries until the server is closed
+func (server *DNSServer) Run() {
+	for {
+		buf := make([]byte, dnsMaxMsgSize)
+		n, from, err := server.conn.ReadFromUDP(buf)
+		if err != nil {
+			utils.Debugf("Stopping the DNS server on %v (%v)", server.Addr(), err)
+			return
+		}
+		go server.handle(buf[:n], from)
+	}
+}
+
+func (server *DNSServer) Close() error {
+	return server.conn.Close()
+}
+
+func (server *DNSServer) handle(query []byte, from *net.UDPAddr) {
+	question, err := parseDNSQuestion(query)
+	if err != nil {
+		utils.Debugf("Dropping DNS query from %v: %v", from, err)
+		return
+	}
+	var reply []byte
+	if ip := server.lookup(question.name); ip != nil && question.qclass == dnsClassIN {
+		// A known name without an address of the requested type
+		if question.qtype != dnsTypeA {
+			ip = nil
+		}
+		reply = dnsReply(query, question, 0, ip)
+	} else if reply, err = server.forward(query); err != nil {
+		utils.Debugf("Unable to resolve %s: %v", question.name, err)
+		reply = dnsReply(query, question, dnsRcodeServFail, nil)
+	}
+	if _, err := server.conn.WriteToUDP(reply, from); err != nil {
+		utils.Debugf("Unable to send the DNS reply to %v: %v", from, err)
+	}
+}
+
+// Send query to the upstream servers in turn, until one of them replies
+func (server *DNSServer) forward(query []byte) ([]byte, error) {
+	err := fmt.Errorf("No upstream DNS server")
+	for _, upstream := range server.upstream() {
+		if _, _, e := net.SplitHostPort(upstream); e != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+		var reply []byte
+		if reply, err = dnsExchange(upstream, query); err == nil {
+			return reply, nil
+		}
+	}
+	return nil, err
+}
+
+func dnsExchange(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, dnsForwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMsgSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore the replies to other queries
+		if n >= dnsHeaderLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
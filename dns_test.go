@@ -0,0 +1,110 @@
+package docker
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	query := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(query[0:], id)
+	// RD
+	binary.BigEndian.PutUint16(query[2:], 0x0100)
+	binary.BigEndian.PutUint16(query[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		if label != "" {
+			query = append(query, byte(len(label)))
+			query = append(query, label...)
+		}
+	}
+	query = append(query, 0, 0, byte(qtype), 0, dnsClassIN)
+	return query
+}
+
+func mkDNSServer(t *testing.T, names map[string]string, upstream []string) *DNSServer {
+	lookup := func(name string) net.IP {
+		return net.ParseIP(names[name])
+	}
+	server, err := NewDNSServer(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, lookup, func() []string { return upstream })
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	return server
+}
+
+// Send a query for name to server and check the rcode and the address of the
+// reply (nil for no answer)
+func testDNSQuery(t *testing.T, server *DNSServer, id uint16, name string, qtype uint16, rcode uint16, ip net.IP) {
+	reply, err := dnsExchange(server.Addr().String(), dnsQuery(id, name, qtype))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(reply[0:]) != id {
+		t.Fatalf("%s: wrong id in the reply", name)
+	}
+	flags := binary.BigEndian.Uint16(reply[2:])
+	if flags&0x8000 == 0 || flags&0x0100 == 0 {
+		t.Fatalf("%s: wrong flags in the reply: %x", name, flags)
+	}
+	if flags&0xf != rcode {
+		t.Fatalf("%s: expected rcode %d, got %d", name, rcode, flags&0xf)
+	}
+	answers := binary.BigEndian.Uint16(reply[6:])
+	if ip == nil {
+		if answers != 0 {
+			t.Fatalf("%s: expected no answer, got %d", name, answers)
+		}
+		return
+	}
+	if answers != 1 {
+		t.Fatalf("%s: expected 1 answer, got %d", name, answers)
+	}
+	if addr := net.IP(reply[len(reply)-4:]); !addr.Equal(ip) {
+		t.Fatalf("%s: expected %v, got %v", name, ip, addr)
+	}
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	question, err := parseDNSQuestion(dnsQuery(42, "Web.Backend.", dnsTypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if question.name != "web.backend" || question.qtype != dnsTypeA || question.qclass != dnsClassIN {
+		t.Fatalf("Unexpected question: %#v", question)
+	}
+	query := dnsQuery(42, "web", dnsTypeA)
+	for _, invalid := range [][]byte{
+		nil,
+		query[:dnsHeaderLen],
+		query[:len(query)-1],
+		// A reply
+		append([]byte{0, 42, 0x81, 0}, query[4:]...),
+		// Two questions
+		append([]byte{0, 42, 1, 0, 0, 2}, query[6:]...),
+		// A compressed name
+		append(append([]byte{}, query[:dnsHeaderLen]...), 0xc0, 0x0c, 0, 1, 0, 1),
+	} {
+		if _, err := parseDNSQuestion(invalid); err == nil {
+			t.Fatalf("Expected an error for %v", invalid)
+		}
+	}
+}
+
+func TestDNSServer(t *testing.T) {
+	upstream := mkDNSServer(t, map[string]string{"example.com": "192.0.2.1"}, nil)
+	defer upstream.Close()
+	server := mkDNSServer(t, map[string]string{"web": "172.17.0.2"}, []string{upstream.Addr().String()})
+	defer server.Close()
+
+	testDNSQuery(t, server, 1, "web", dnsTypeA, 0, net.ParseIP("172.17.0.2"))
+	testDNSQuery(t, server, 2, "WEB.", dnsTypeA, 0, net.ParseIP("172.17.0.2"))
+	// AAAA: the name exists but has no IPv6 address
+	testDNSQuery(t, server, 3, "web", 28, 0, nil)
+	// Forwarded to the upstream server
+	testDNSQuery(t, server, 4, "example.com", dnsTypeA, 0, net.ParseIP("192.0.2.1"))
+	// The upstream server has no upstream
+	testDNSQuery(t, server, 5, "nonexistent", dnsTypeA, dnsRcodeServFail, nil)
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/registry"
 	"github.com/dotcloud/docker/utils"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -33,6 +36,35 @@ func main() {
 	flGraphPath := flag.String("g", "/var/lib/docker", "Path to graph storage base dir.")
 	flEnableCors := flag.Bool("api-enable-cors", false, "Enable CORS requests in the remote api.")
 	flDns := flag.String("dns", "", "Set custom dns servers")
+	flEmbeddedDns := flag.Bool("embedded-dns", true, "Run a DNS server on each network resolving the names of its containers")
+	flUserlandProxy := flag.Bool("userland-proxy", true, "Use the userland proxy for the published ports, when disabled iptables takes care of all the traffic except the one to 127.0.0.1")
+	flProxyAccessLog := flag.String("proxy-access-log", "", "Log the connections to the published ports to this file, use - for stderr")
+	flProxyProtocol := flag.Int("proxy-protocol", 0, "Send a PROXY protocol header (version 1 or 2) to the containers on the published tcp ports, 0 to disable")
+	flIptablesCheck := flag.Duration("iptables-check", docker.IptablesCheckInterval, "Interval between two checks of the firewall rules of docker, missing rules are restored; 0 to disable")
+	flIcc := flag.Bool("icc", docker.InterContainerCommunication, "Let the containers of a bridge network reach each other, unless their ingress policies or the icc option of the network deny it")
+	flClusterStore := flag.String("cluster-store", "", "Key/value store shared by the hosts of the overlay networks (e.g. etcd://10.0.0.1:2379)")
+	flClusterAdvertise := flag.String("cluster-advertise", "", "Address the other hosts of the overlay networks reach this one at")
+	flFirewall := flag.String("firewall", docker.FirewallBackend, "Firewall backend for the published ports and the NAT of the bridges: iptables, nftables or auto")
+	flUDPTimeout := flag.Duration("udp-timeout", docker.DefaultUDPConnTrackTimeout, "Idle timeout of the UDP flows handled by the userland proxy")
+	flGraphDriver := flag.String("storage-driver", docker.DefaultGraphDriver, "Driver storing the layers of the images and the containers: aufs, btrfs, devicemapper, vfs or zfs")
+	var flGraphDriverOptions docker.ListOpts
+	flag.Var(&flGraphDriverOptions, "storage-opt", "Set an option of the storage driver, key=value (e.g. dm.basesize=20g)")
+	flMaxConcurrentDownloads := flag.Int("max-concurrent-downloads", docker.MaxConcurrentDownloads, "Number of layers the pulls download at the same time from a registry")
+	var flRegistryMirrors docker.ListOpts
+	flag.Var(&flRegistryMirrors, "registry-mirror", "Pull the images of the official index from this mirror first, http(s)://host[:port]")
+	var flInsecureRegistries docker.ListOpts
+	flag.Var(&flInsecureRegistries, "insecure-registry", "Reach this registry, host[:port] or CIDR, over plain http or with an unverified certificate")
+	flUsernsRemap := flag.String("userns-remap", "", "Run the containers in a user namespace, root being the first subordinate uid and gid of this user[:group] in /etc/subuid and /etc/subgid (default for the dockremap user)")
+	var flDefaultUlimits docker.ListOpts
+	flag.Var(&flDefaultUlimits, "default-ulimit", "Set a default resource limit of the containers, name=soft[:hard] (e.g. nofile=65535:65535)")
+	flTls := flag.Bool("tls", false, "Use TLS on the tcp sockets; implied by -tlsverify")
+	flTlsVerify := flag.Bool("tlsverify", false, "Use TLS and verify the other side: the daemon requires the clients to present a certificate signed by -tlscacert, the client checks the one of the daemon")
+	certPath := filepath.Join(os.Getenv("HOME"), ".docker")
+	flCACert := flag.String("tlscacert", filepath.Join(certPath, docker.DEFAULTTLSCACERT), "Trust only the certificates signed by this CA")
+	flCert := flag.String("tlscert", filepath.Join(certPath, docker.DEFAULTTLSCERT), "Path to the TLS certificate")
+	flKey := flag.String("tlskey", filepath.Join(certPath, docker.DEFAULTTLSKEY), "Path to the TLS key")
+	var flAPIAccess docker.ListOpts
+	flag.Var(&flAPIAccess, "api-access", "Restrict the API on the unix socket to this user:NAME|UID or group:NAME|GID, =ro for a read-only access (e.g. group:docker=ro)")
 	flHosts := docker.ListOpts{fmt.Sprintf("unix://%s", docker.DEFAULTUNIXSOCKET)}
 	flag.Var(&flHosts, "H", "tcp://host:port to bind/connect to or unix://path/to/socket to use")
 	flag.Parse()
@@ -51,13 +83,86 @@ func main() {
 	if *flDebug {
 		os.Setenv("DEBUG", "1")
 	}
+	if *flUDPTimeout <= 0 {
+		log.Fatal("The UDP timeout must be strictly positive")
+	}
+	docker.UDPConnTrackTimeout = *flUDPTimeout
+	if *flMaxConcurrentDownloads < 1 {
+		log.Fatal("The pulls must download at least 1 layer at a time")
+	}
+	docker.MaxConcurrentDownloads = *flMaxConcurrentDownloads
+	for _, mirror := range flRegistryMirrors {
+		endpoint, err := registry.ValidateMirror(mirror)
+		if err != nil {
+			log.Fatal(err)
+		}
+		docker.RegistryMirrors = append(docker.RegistryMirrors, endpoint)
+	}
+	for _, insecure := range flInsecureRegistries {
+		if err := registry.ValidateInsecureRegistry(insecure); err != nil {
+			log.Fatal(err)
+		}
+	}
+	registry.InsecureRegistries = flInsecureRegistries
+	for _, access := range flAPIAccess {
+		rule, err := docker.ParseAPIAccessRule(access)
+		if err != nil {
+			log.Fatal(err)
+		}
+		docker.APIAccessRules = append(docker.APIAccessRules, rule)
+	}
+	docker.IptablesCheckInterval = *flIptablesCheck
+	docker.FirewallBackend = *flFirewall
+	docker.InterContainerCommunication = *flIcc
+	docker.ClusterStore = *flClusterStore
+	docker.ClusterAdvertise = *flClusterAdvertise
+	if *flProxyProtocol < 0 || *flProxyProtocol > 2 {
+		log.Fatal("The PROXY protocol version must be 0, 1 or 2")
+	}
+	docker.ProxyProtocolVersion = *flProxyProtocol
+	if !*flUserlandProxy && *flProxyProtocol != 0 {
+		log.Fatal("The PROXY protocol requires the userland proxy")
+	}
+	docker.UserlandProxy = *flUserlandProxy
+	docker.EmbeddedDNS = *flEmbeddedDns
+	docker.GraphDriverName = *flGraphDriver
+	docker.GraphDriverOptions = flGraphDriverOptions
+	docker.UsernsRemap = *flUsernsRemap
+	docker.DefaultUlimits = flDefaultUlimits
 	docker.GITCOMMIT = GITCOMMIT
+	var tlsOptions *docker.TLSOptions
+	if *flTls || *flTlsVerify {
+		tlsOptions = &docker.TLSOptions{
+			CACert: *flCACert,
+			Cert:   *flCert,
+			Key:    *flKey,
+			Verify: *flTlsVerify,
+		}
+	}
 	if *flDaemon {
 		if flag.NArg() != 0 {
 			flag.Usage()
 			return
 		}
-		if err := daemon(*pidfile, *flGraphPath, flHosts, *flAutoRestart, *flEnableCors, *flDns); err != nil {
+		if *flProxyAccessLog == "-" {
+			docker.ProxyAccessLog = docker.NewProxyAccessLogger(os.Stderr)
+		} else if *flProxyAccessLog != "" {
+			f, err := os.OpenFile(*flProxyAccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			docker.ProxyAccessLog = docker.NewProxyAccessLogger(f)
+		}
+		var tlsConfig *tls.Config
+		if tlsOptions != nil {
+			config, err := docker.ServerTLSConfig(tlsOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+			tlsConfig = config
+		}
+		if err := daemon(*pidfile, *flGraphPath, flHosts, *flAutoRestart, *flEnableCors, *flDns, tlsConfig); err != nil {
 			log.Fatal(err)
 			os.Exit(-1)
 		}
@@ -66,8 +171,16 @@ func main() {
 			log.Fatal("Please specify only one -H")
 			return
 		}
+		var tlsConfig *tls.Config
+		if tlsOptions != nil {
+			config, err := docker.ClientTLSConfig(tlsOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+			tlsConfig = config
+		}
 		protoAddrParts := strings.SplitN(flHosts[0], "://", 2)
-		if err := docker.ParseCommands(protoAddrParts[0], protoAddrParts[1], flag.Args()...); err != nil {
+		if err := docker.ParseCommands(protoAddrParts[0], protoAddrParts[1], tlsConfig, flag.Args()...); err != nil {
 			log.Fatal(err)
 			os.Exit(-1)
 		}
@@ -101,7 +214,7 @@ func removePidFile(pidfile string) {
 	}
 }
 
-func daemon(pidfile string, flGraphPath string, protoAddrs []string, autoRestart, enableCors bool, flDns string) error {
+func daemon(pidfile string, flGraphPath string, protoAddrs []string, autoRestart, enableCors bool, flDns string, tlsConfig *tls.Config) error {
 	if err := createPidFile(pidfile); err != nil {
 		log.Fatal(err)
 	}
@@ -129,15 +242,17 @@ func daemon(pidfile string, flGraphPath string, protoAddrs []string, autoRestart
 		if protoAddrParts[0] == "unix" {
 			syscall.Unlink(protoAddrParts[1])
 		} else if protoAddrParts[0] == "tcp" {
-			if !strings.HasPrefix(protoAddrParts[1], "127.0.0.1") {
+			if tlsConfig == nil && !strings.HasPrefix(protoAddrParts[1], "127.0.0.1") {
 				log.Println("/!\\ DON'T BIND ON ANOTHER IP ADDRESS THAN 127.0.0.1 IF YOU DON'T KNOW WHAT YOU'RE DOING /!\\")
+			} else if tlsConfig != nil && tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+				log.Println("/!\\ Without -tlsverify, any client reaching the daemon can use it /!\\")
 			}
 		} else {
 			log.Fatal("Invalid protocol format.")
 			os.Exit(-1)
 		}
 		go func() {
-			chErrors <- docker.ListenAndServe(protoAddrParts[0], protoAddrParts[1], server, true)
+			chErrors <- docker.ListenAndServe(protoAddrParts[0], protoAddrParts[1], server, true, tlsConfig)
 		}()
 	}
 	for i := 0; i < len(protoAddrs); i += 1 {
@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"strings"
+)
+
+// The events kept by the server to be replayed with since
+const eventsLimit = 64
+
+// EventFilters select the events by their type (the status of the
+// event: create, start, die, destroy, pull, untag...), by container (ID
+// or name) and by image (ID or name, with or without tag). The values of a
+// filter are alternatives, the filters must all match.
+type EventFilters map[string][]string
+
+// Parse the filters query parameter of /events, a JSON object such as:
+// {"event":["start","die"],"image":["base"]}
+func parseEventFilters(value string) (EventFilters, error) {
+	filters := EventFilters{}
+	if value == "" {
+		return filters, nil
+	}
+	if err := json.Unmarshal([]byte(value), &filters); err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid filters %s: %s", value, err)
+	}
+	for name := range filters {
+		switch name {
+		case "event", "container", "image":
+		default:
+			return nil, fmt.Errorf("Bad parameter: invalid filter %s (event, container or image)", name)
+		}
+	}
+	return filters, nil
+}
+
+func (filters EventFilters) match(event *utils.JSONMessage) bool {
+	for name, values := range filters {
+		matched := false
+		for _, value := range values {
+			switch name {
+			case "event":
+				matched = event.Status == value
+			case "container":
+				// Only the events of containers come from an image
+				matched = event.From != "" && strings.HasPrefix(event.ID, utils.TruncateID(value))
+			case "image":
+				image := event.From
+				if image == "" {
+					image = event.ID
+				}
+				repo, _ := utils.ParseRepositoryTag(image)
+				matched = image == value || repo == value || image == utils.TruncateID(value)
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Add the short IDs of the containers named in the container filter: the
+// events only have the IDs.
+func (srv *Server) resolveEventFilters(filters EventFilters) {
+	for _, name := range filters["container"] {
+		if container := srv.runtime.Get(name); container != nil {
+			filters["container"] = append(filters["container"], container.ShortID())
+		}
+	}
+}
+
+// The events kept which happened from since to until (up to now if 0). The
+// server must be locked.
+func (srv *Server) pastEvents(since, until int64) []utils.JSONMessage {
+	var events []utils.JSONMessage
+	for _, event := range srv.events {
+		if event.Time >= since && (until == 0 || event.Time <= until) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
@@ -0,0 +1,236 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/term"
+	"github.com/dotcloud/docker/utils"
+	"github.com/kr/pty"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ExecConfig is the process docker exec runs in a running container
+type ExecConfig struct {
+	User         string // The user of the container by default
+	Tty          bool
+	AttachStdin  bool
+	AttachStdout bool
+	AttachStderr bool
+	Env          []string // Added to the environment of the container
+	WorkingDir   string   // The working directory of the container by default
+	Cmd          []string
+}
+
+// An Exec is an additional process run in the namespaces (and the cgroups)
+// of a running container, with lxc-attach.
+type Exec struct {
+	sync.Mutex
+	ID        string
+	Container *Container
+	Config    *ExecConfig
+	Running   bool
+	ExitCode  int
+
+	started   bool
+	cmd       *exec.Cmd
+	ptyMaster *os.File
+	done      chan struct{}
+	created   time.Time
+	finished  time.Time // When its process exited
+}
+
+// How long the runtime keeps the execs once their process exited, or while
+// they aren't started, for their exit code to be inspected
+var execTTL = 5 * time.Minute
+
+// Whether the runtime can forget the exec, the state of e is locked
+func (e *Exec) expired(now time.Time) bool {
+	if e.Running {
+		return false
+	}
+	if e.started {
+		return now.Sub(e.finished) > execTTL
+	}
+	return now.Sub(e.created) > execTTL
+}
+
+func newExec(container *Container, config *ExecConfig) (*Exec, error) {
+	if len(config.Cmd) == 0 {
+		return nil, fmt.Errorf("Bad parameter: no command specified")
+	}
+	if !container.State.Running {
+		return nil, fmt.Errorf("Impossible to exec in the container %s, it's not running", container.ID)
+	}
+	if container.State.Ghost {
+		return nil, fmt.Errorf("Impossible to exec in a ghost container")
+	}
+	if container.State.Paused {
+		return nil, fmt.Errorf("Impossible to exec in the container %s, it's paused", container.ID)
+	}
+	return &Exec{
+		ID:        GenerateID(),
+		Container: container,
+		Config:    config,
+		ExitCode:  -1,
+		done:      make(chan struct{}),
+		created:   time.Now(),
+	}, nil
+}
+
+// The arguments of lxc-attach. dockerinit sets up the environment, the user
+// and the working directory of the process, the network is already set up.
+func (e *Exec) params() []string {
+	user := e.Config.User
+	if user == "" {
+		user = e.Container.Config.User
+	}
+	workingDir := e.Config.WorkingDir
+	if workingDir == "" {
+		workingDir = e.Container.Config.WorkingDir
+	}
+	if workingDir != "" {
+		workingDir = path.Clean(workingDir)
+	}
+	params := []string{"-n", e.Container.ID, "--", "/.dockerinit"}
+	params = append(params, e.Container.processParams(user, workingDir, e.Config.Tty, e.Config.Env)...)
+	params = append(params, "--")
+	return append(params, e.Config.Cmd...)
+}
+
+// Start the process, with stdin, stdout and stderr as its standard streams
+// (or the tty). The ones which are nil are discarded.
+func (e *Exec) Start(stdin io.Reader, stdout, stderr io.Writer) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.started {
+		return fmt.Errorf("Conflict: the exec %s was already started", e.ID)
+	}
+	if !e.Container.State.Running {
+		return fmt.Errorf("Impossible to exec in the container %s, it's not running", e.Container.ID)
+	}
+	// lxc-attach would put the process in the cgroup of lxc, the container
+	// isn't in it under a cgroup parent
+	if parent := e.Container.CgroupParent; parent != "" {
+		cmd, err := cgroupCommand(parent, e.Container.ID, "lxc-attach", append([]string{"--elevated-privileges=CGROUP"}, e.params()...)...)
+		if err != nil {
+			return err
+		}
+		e.cmd = cmd
+	} else {
+		e.cmd = exec.Command("lxc-attach", e.params()...)
+	}
+
+	// Wait for the output to be copied before reporting the end of the
+	// process, or the end of the output might be lost
+	var output sync.WaitGroup
+	if e.Config.Tty {
+		ptyMaster, ptySlave, err := pty.Open()
+		if err != nil {
+			return err
+		}
+		defer ptySlave.Close()
+		e.ptyMaster = ptyMaster
+		e.cmd.Stdin = ptySlave
+		e.cmd.Stdout = ptySlave
+		e.cmd.Stderr = ptySlave
+		e.cmd.SysProcAttr = &syscall.SysProcAttr{Setctty: true, Setsid: true}
+		if stdout == nil {
+			stdout = &utils.NopWriter{}
+		}
+		output.Add(1)
+		go func() {
+			defer output.Done()
+			io.Copy(stdout, ptyMaster)
+			utils.Debugf("[exec %s] End of the tty output", e.ID)
+		}()
+		if stdin != nil {
+			go func() {
+				io.Copy(ptyMaster, stdin)
+				utils.Debugf("[exec %s] End of stdin", e.ID)
+			}()
+		}
+	} else {
+		e.cmd.Stdout = stdout
+		e.cmd.Stderr = stderr
+		// In its own process group, like the ones with a tty in their
+		// session, so that kill stops the process in the container too
+		e.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		// Not set as the Stdin of the command: Wait would also wait for
+		// stdin to be closed
+		if stdin != nil {
+			pipe, err := e.cmd.StdinPipe()
+			if err != nil {
+				return err
+			}
+			go func() {
+				defer pipe.Close()
+				io.Copy(pipe, stdin)
+				utils.Debugf("[exec %s] End of stdin", e.ID)
+			}()
+		}
+	}
+	if err := e.cmd.Start(); err != nil {
+		if e.ptyMaster != nil {
+			e.ptyMaster.Close()
+		}
+		return err
+	}
+	e.started = true
+	e.Running = true
+	go e.monitor(&output)
+	return nil
+}
+
+func (e *Exec) monitor(output *sync.WaitGroup) {
+	if err := e.cmd.Wait(); err != nil {
+		// Discard the error as any signals or non 0 returns will generate an error
+		utils.Debugf("[exec %s] Process: %s", e.ID, err)
+	}
+	output.Wait()
+	e.Lock()
+	e.Running = false
+	e.finished = time.Now()
+	if status, ok := e.cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		e.ExitCode = status.ExitStatus()
+	}
+	if e.ptyMaster != nil {
+		if err := e.ptyMaster.Close(); err != nil {
+			utils.Debugf("[exec %s] Error closing Pty master: %s", e.ID, err)
+		}
+	}
+	e.Unlock()
+	close(e.done)
+}
+
+// Block until the process exits, and return its exit code
+func (e *Exec) Wait() int {
+	<-e.done
+	e.Lock()
+	defer e.Unlock()
+	return e.ExitCode
+}
+
+// Kill lxc-attach and the process it runs in the container, its process
+// group
+func (e *Exec) kill() error {
+	e.Lock()
+	defer e.Unlock()
+	if !e.Running {
+		return nil
+	}
+	return syscall.Kill(-e.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func (e *Exec) Resize(h, w int) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.ptyMaster == nil || !e.Running {
+		return fmt.Errorf("Impossible to resize the exec %s, it has no running tty", e.ID)
+	}
+	return term.SetWinsize(e.ptyMaster.Fd(), &term.Winsize{Height: uint16(h), Width: uint16(w)})
+}
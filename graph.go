@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
 	"io"
@@ -9,18 +10,27 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 // A Graph is a store for versioned filesystem images and the relationship between them.
 type Graph struct {
-	Root    string
-	idIndex *utils.TruncIndex
+	Root       string
+	idIndex    *utils.TruncIndex
+	driver     GraphDriver
+	layers     *layerStore // Keeps the layers of the images and the ones retained
+	idMappings *IDMappings // The layers are chowned to the ids of the host of the containers, with -userns-remap
+	// Fetches the layers pulled lazily, from their registry
+	fetchLayer func(source *lazyLayer) (io.ReadCloser, error)
+	// Held while the blob sources of an image are updated
+	blobSourcesLock sync.Mutex
 }
 
-// NewGraph instantiates a new graph at the given root path in the filesystem.
+// NewGraph instantiates a new graph at the given root path in the filesystem,
+// storing the layers of its images with driver.
 // `root` will be created if it doesn't exist.
-func NewGraph(root string) (*Graph, error) {
+func NewGraph(root string, driver GraphDriver) (*Graph, error) {
 	abspath, err := filepath.Abs(root)
 	if err != nil {
 		return nil, err
@@ -32,7 +42,13 @@ func NewGraph(root string) (*Graph, error) {
 	graph := &Graph{
 		Root:    abspath,
 		idIndex: utils.NewTruncIndex(),
+		driver:  driver,
 	}
+	graph.layers, err = newLayerStore(path.Join(abspath, "_layers"), driver, graph.imageIDs)
+	if err != nil {
+		return nil, err
+	}
+	graph.layers.materialize = graph.materialize
 	if err := graph.restore(); err != nil {
 		return nil, err
 	}
@@ -47,10 +63,34 @@ func (graph *Graph) restore() error {
 	for _, v := range dir {
 		id := v.Name()
 		graph.idIndex.Add(id)
+		// The layers of the images stored before the layer store are added
+		// to it
+		if graph.layers != nil && !graph.layers.Exists(id) {
+			if img, err := LoadImage(graph.imageRoot(id)); err == nil {
+				if err := graph.layers.adopt(id, img.Parent); err != nil {
+					return err
+				}
+			}
+		}
 	}
 	return nil
 }
 
+// The ids of the images of the graph, the ones whose json is stored
+func (graph *Graph) imageIDs() ([]string, error) {
+	dir, err := ioutil.ReadDir(graph.Root)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, v := range dir {
+		if _, err := os.Stat(jsonPath(graph.imageRoot(v.Name()))); err == nil {
+			ids = append(ids, v.Name())
+		}
+	}
+	return ids, nil
+}
+
 // FIXME: Implement error subclass instead of looking at the error text
 // Note: This is the way golang implements os.IsNotExists on Plan9
 func (graph *Graph) IsNotExist(err error) bool {
@@ -80,8 +120,13 @@ func (graph *Graph) Get(name string) (*Image, error) {
 	if img.ID != id {
 		return nil, fmt.Errorf("Image stored at '%s' has wrong id '%s'", id, img.ID)
 	}
+	materialized := graph.Materialized(img.ID)
+	if materialized && !graph.driver.Exists(img.ID) {
+		return nil, fmt.Errorf("Couldn't load image %s: no filesystem layer", img.ID)
+	}
 	img.graph = graph
-	if img.Size == 0 {
+	// The size of a lazy layer is only known once it's fetched
+	if img.Size == 0 && materialized {
 		root, err := img.root()
 		if err != nil {
 			return nil, err
@@ -93,10 +138,10 @@ func (graph *Graph) Get(name string) (*Image, error) {
 	return img, nil
 }
 
-// Create creates a new image and registers it in the graph.
+// Create creates a new image and registers it in the graph, or returns the
+// one the graph already has with the same content.
 func (graph *Graph) Create(layerData Archive, container *Container, comment, author string, config *Config) (*Image, error) {
 	img := &Image{
-		ID:            GenerateID(),
 		Comment:       comment,
 		Created:       time.Now(),
 		DockerVersion: VERSION,
@@ -109,7 +154,47 @@ func (graph *Graph) Create(layerData Archive, container *Container, comment, aut
 		img.Container = container.ID
 		img.ContainerConfig = *container.Config
 	}
-	if err := graph.Register(nil, layerData, img); err != nil {
+	return graph.registerContent(layerData, img)
+}
+
+// Register img with the id computed from its json and the digest of its
+// layer, unless the graph already has an image with this id, which is
+// returned instead. An image without layer (e.g: a volume) gets a random id.
+func (graph *Graph) registerContent(layerData Archive, img *Image) (*Image, error) {
+	if layerData == nil {
+		img.ID = GenerateID()
+		if err := graph.Register(nil, nil, img); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	// The layer is read twice, to compute its digest then to store it
+	tmp, err := graph.tmp()
+	if err != nil {
+		return nil, err
+	}
+	digester := NewDigestingArchive(layerData)
+	layer, err := NewTempArchive(digester, tmp.Root)
+	if err != nil {
+		digester.Close()
+		return nil, err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+	if img.LayerDigest, err = digester.Digest(); err != nil {
+		return nil, err
+	}
+	jsonData, err := json.Marshal(img)
+	if err != nil {
+		return nil, err
+	}
+	if img.ID, err = ContentID(jsonData); err != nil {
+		return nil, err
+	}
+	if existing, err := graph.Get(img.ID); err == nil {
+		return existing, nil
+	}
+	if err := graph.Register(nil, layer, img); err != nil {
 		return nil, err
 	}
 	return img, nil
@@ -118,27 +203,335 @@ func (graph *Graph) Create(layerData Archive, container *Container, comment, aut
 // Register imports a pre-existing image into the graph.
 // FIXME: pass img as first argument
 func (graph *Graph) Register(jsonData []byte, layerData Archive, img *Image) error {
+	return graph.register(jsonData, img, func() error {
+		// The layer is retained until the image is stored
+		if err := graph.layers.Create(img.ID, img.Parent); err != nil {
+			return err
+		}
+		var digester *DigestingArchive
+		if img.LayerDigest != "" && layerData != nil {
+			digester = NewDigestingArchive(layerData)
+			layerData = digester
+		}
+		if err := graph.storeLayer(img.ID, layerData); err != nil {
+			if digester != nil {
+				digester.Close()
+			}
+			graph.layers.Release(img.ID)
+			return err
+		}
+		if digester != nil {
+			digest, err := digester.Digest()
+			if err == nil && digest != img.LayerDigest {
+				err = fmt.Errorf("The layer of image %s doesn't match its digest (%s)", img.ID, digest)
+			}
+			if err != nil {
+				graph.layers.Release(img.ID)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RegisterLazy imports a pre-existing image into the graph without its
+// layer, which is fetched from source the first time it's used.
+func (graph *Graph) RegisterLazy(jsonData []byte, img *Image, source *lazyLayer) error {
+	return graph.register(jsonData, img, func() error {
+		return graph.layers.CreateLazy(img.ID, img.Parent, source)
+	})
+}
+
+// Register img, with its layer created and retained by create unless the
+// graph still has it
+func (graph *Graph) register(jsonData []byte, img *Image, create func() error) error {
 	if err := ValidateID(img.ID); err != nil {
 		return err
 	}
+	// The id of a content-addressable image is verified before its layer
+	// is downloaded. Its layer is verified with its digest, an id of its json
+	// alone would let anything be its layer.
+	data := jsonData
+	if data == nil {
+		var err error
+		if data, err = json.Marshal(img); err != nil {
+			return err
+		}
+	}
+	id, err := ContentID(data)
+	if err != nil {
+		return err
+	}
+	if img.LayerDigest != "" && id != img.ID {
+		return fmt.Errorf("Image %s doesn't match the digest of its json (%s)", img.ID, id)
+	}
+	if img.LayerDigest == "" && id == img.ID {
+		return fmt.Errorf("Image %s is content-addressed but has no layer digest", img.ID)
+	}
 	// (This is a convenience to save time. Race conditions are taken care of by os.Rename)
 	if graph.Exists(img.ID) {
 		return fmt.Errorf("Image %s already exists", img.ID)
 	}
+	root := graph.imageRoot(img.ID)
+	if err := os.RemoveAll(root); err != nil {
+		return err
+	}
+	// The layer of a deleted image, kept for the containers and the children
+	// using it, is the layer of the image again. What a previous attempt or
+	// another driver left of it is removed otherwise.
+	if !graph.layers.retainUnused(img.ID) {
+		if graph.driver.Exists(img.ID) && !graph.layers.Exists(img.ID) {
+			if err := graph.driver.Remove(img.ID); err != nil {
+				return err
+			}
+		}
+		if err := create(); err != nil {
+			return err
+		}
+	}
+	defer graph.layers.Release(img.ID)
+	// The image only loads once its json is stored
+	img.graph = graph
+	if err := StoreImage(img, jsonData, root); err != nil {
+		img.graph = nil
+		os.RemoveAll(root)
+		return err
+	}
+	graph.idIndex.Add(img.ID)
+	return nil
+}
+
+// Materialized returns whether the driver has the layers of the image id,
+// false if it was pulled lazily and its layer wasn't used yet
+func (graph *Graph) Materialized(id string) bool {
+	return graph.layers == nil || graph.layers.Materialized(id)
+}
+
+// Store the layer id pulled lazily, which the driver created empty, with the
+// archive fetched from its source
+func (graph *Graph) materialize(id string, source *lazyLayer) error {
+	if graph.fetchLayer == nil {
+		return fmt.Errorf("no registry to fetch it from")
+	}
+	blob, err := graph.fetchLayer(source)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	// The json of a deleted image whose layer is kept for its children is
+	// gone, the digest of the blob is still verified
+	var layerData Archive = blob
+	var digester *DigestingArchive
+	img, err := LoadImage(graph.imageRoot(id))
+	if err == nil && img.LayerDigest != "" {
+		digester = NewDigestingArchive(layerData)
+		layerData = digester
+	}
+	if err := graph.storeLayer(id, layerData); err != nil {
+		if digester != nil {
+			digester.Close()
+		}
+		return err
+	}
+	if digester != nil {
+		digest, err := digester.Digest()
+		if err != nil {
+			return err
+		}
+		if digest != img.LayerDigest {
+			return fmt.Errorf("The layer of image %s doesn't match its digest (%s)", id, digest)
+		}
+	}
+	return nil
+}
+
+// Apply the archive of a layer to the new layer id, with the ids of the host
+// of the containers with -userns-remap
+func (graph *Graph) storeLayer(id string, layerData Archive) error {
+	if layerData == nil {
+		if graph.idMappings == nil {
+			return nil
+		}
+		// An empty layer (e.g: a volume) belongs to the root of the containers
+		dir, err := graph.driver.Get(id)
+		if err != nil {
+			return err
+		}
+		defer graph.driver.Put(id)
+		uid, gid := graph.idMappings.RootPair()
+		return os.Chown(dir, uid, gid)
+	}
+	if graph.idMappings != nil {
+		// The files are chowned to the ids of the host before the driver
+		// stores them
+		tmp, err := graph.Mktemp("")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if err := os.MkdirAll(tmp, 0755); err != nil {
+			return err
+		}
+		if err := Untar(layerData, tmp); err != nil {
+			return err
+		}
+		if err := graph.idMappings.chownLayer(tmp); err != nil {
+			return err
+		}
+		if layerData, err = Tar(tmp, Uncompressed); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	utils.Debugf("Start untar layer")
+	if err := graph.driver.ApplyDiff(id, layerData); err != nil {
+		return err
+	}
+	utils.Debugf("Untar time: %vs\n", time.Now().Sub(start).Seconds())
+	return nil
+}
+
+// Squash creates an image with a single layer, the layers of img down to its
+// ancestor parent merged, as a child of parent (without parent if it's
+// empty) and with the config of img. img and its layers are kept.
+func (graph *Graph) Squash(img *Image, parent, comment string) (*Image, error) {
+	// The layers to merge, from the bottom one
+	var layers []string
+	ancestor := img
+	for ancestor != nil && ancestor.ID != parent {
+		layers = append([]string{ancestor.ID}, layers...)
+		var err error
+		if ancestor, err = ancestor.GetParent(); err != nil {
+			return nil, err
+		}
+	}
+	if ancestor == nil && parent != "" {
+		return nil, fmt.Errorf("%s is not a parent of %s", utils.TruncateID(parent), utils.TruncateID(img.ID))
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("%s has no layer to squash", utils.TruncateID(img.ID))
+	}
+
 	tmp, err := graph.Mktemp("")
+	if err != nil {
+		return nil, err
+	}
 	defer os.RemoveAll(tmp)
+	rootfs := path.Join(tmp, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return nil, err
+	}
+	for _, id := range layers {
+		if err := graph.layers.Retain(id); err != nil {
+			return nil, err
+		}
+		defer graph.layers.Release(id)
+	}
+	if err := graph.layers.Materialize(img.ID); err != nil {
+		return nil, err
+	}
+	for _, id := range layers {
+		layer := path.Join(tmp, id)
+		if err := os.Mkdir(layer, 0755); err != nil {
+			return nil, err
+		}
+		diff, err := graph.driver.Diff(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := Untar(diff, layer); err != nil {
+			return nil, err
+		}
+		if err := applyWhiteouts(layer, rootfs); err != nil {
+			return nil, err
+		}
+		if err := TarUntar(layer, nil, rootfs); err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(layer); err != nil {
+			return nil, err
+		}
+	}
+	// The whiteouts hide the files of parent, a base layer has none
+	if parent == "" {
+		if err := removeWhiteoutFiles(rootfs); err != nil {
+			return nil, err
+		}
+	}
+	archive, err := Tar(rootfs, Uncompressed)
 	if err != nil {
-		return fmt.Errorf("Mktemp failed: %s", err)
+		return nil, err
 	}
-	if err := StoreImage(img, jsonData, layerData, tmp); err != nil {
-		return err
+	if graph.idMappings != nil {
+		archive = graph.idMappings.containerArchive(archive)
 	}
-	// Commit
-	if err := os.Rename(tmp, graph.imageRoot(img.ID)); err != nil {
+
+	// Without the config of the container of img, the squashed image isn't
+	// the cache of a build
+	squashed := &Image{
+		Parent:        parent,
+		Comment:       comment,
+		Created:       time.Now(),
+		DockerVersion: VERSION,
+		Author:        img.Author,
+		Config:        img.Config,
+		Architecture:  img.Architecture,
+	}
+	return graph.registerContent(archive, squashed)
+}
+
+// Remove from dest, the layers below layer merged, the files the whiteouts
+// of layer delete
+func applyWhiteouts(layer, dest string) error {
+	return filepath.Walk(layer, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layer, p)
+		if err != nil {
+			return err
+		}
+		dir, name := filepath.Dir(rel), filepath.Base(rel)
+		if name == ".wh..wh..opq" {
+			// An opaque directory hides the contents of the layers below
+			entries, err := ioutil.ReadDir(filepath.Join(dest, dir))
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(dest, dir, entry.Name())); err != nil {
+					return err
+				}
+			}
+		} else if strings.HasPrefix(name, ".wh.") && !strings.HasPrefix(name, ".wh..wh.") {
+			return os.RemoveAll(filepath.Join(dest, dir, name[len(".wh."):]))
+		}
+		return nil
+	})
+}
+
+// Remove the whiteouts of layer, once they are applied
+func removeWhiteoutFiles(layer string) error {
+	var whiteouts []string
+	err := filepath.Walk(layer, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".wh.") {
+			whiteouts = append(whiteouts, p)
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
-	img.graph = graph
-	graph.idIndex.Add(img.ID)
+	for _, p := range whiteouts {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -159,6 +552,7 @@ func (graph *Graph) TempLayerArchive(id string, compression Compression, sf *uti
 	if err != nil {
 		return nil, err
 	}
+	defer closeArchive(archive)
 	return NewTempArchive(utils.ProgressReader(ioutil.NopCloser(archive), 0, output, sf.FormatProgress("", "Buffering to disk", "%v/%v (%v)"), sf, true), tmp.Root)
 }
 
@@ -177,65 +571,21 @@ func (graph *Graph) Mktemp(id string) (string, error) {
 	return tmp.imageRoot(id), nil
 }
 
-// getDockerInitLayer returns the path of a layer containing a mountpoint suitable
-// for bind-mounting dockerinit into the container. The mountpoint is simply an
-// empty file at /.dockerinit
-//
-// This extra layer is used by all containers as the top-most ro layer. It protects
-// the container from unwanted side-effects on the rw layer.
-func (graph *Graph) getDockerInitLayer() (string, error) {
-	tmp, err := graph.tmp()
-	if err != nil {
-		return "", err
-	}
-	initLayer := tmp.imageRoot("_dockerinit")
-	if err := os.Mkdir(initLayer, 0755); err != nil && !os.IsExist(err) {
-		// If directory already existed, keep going.
-		// For all other errors, abort.
-		return "", err
-	}
-
-	for pth, typ := range map[string]string{
-		"/dev/pts":         "dir",
-		"/dev/shm":         "dir",
-		"/proc":            "dir",
-		"/sys":             "dir",
-		"/.dockerinit":     "file",
-		"/etc/resolv.conf": "file",
-		// "var/run": "dir",
-		// "var/lock": "dir",
-	} {
-		if _, err := os.Stat(path.Join(initLayer, pth)); err != nil {
-			if os.IsNotExist(err) {
-				switch typ {
-				case "dir":
-					if err := os.MkdirAll(path.Join(initLayer, pth), 0755); err != nil {
-						return "", err
-					}
-				case "file":
-					if err := os.MkdirAll(path.Join(initLayer, path.Dir(pth)), 0755); err != nil {
-						return "", err
-					}
-
-					if f, err := os.OpenFile(path.Join(initLayer, pth), os.O_CREATE, 0755); err != nil {
-						return "", err
-					} else {
-						f.Close()
-					}
-				}
-			} else {
-				return "", err
-			}
-		}
-	}
-
-	// Layer is ready to use, if it wasn't before.
-	return initLayer, nil
-}
-
 func (graph *Graph) tmp() (*Graph, error) {
 	// Changed to _tmp from :tmp:, because it messed with ":" separators in aufs branch syntax...
-	return NewGraph(path.Join(graph.Root, "_tmp"))
+	// Its images have no layer, it's only a directory for the temporary files
+	tmp := &Graph{
+		Root:    path.Join(graph.Root, "_tmp"),
+		idIndex: utils.NewTruncIndex(),
+		driver:  graph.driver,
+	}
+	if err := os.MkdirAll(tmp.Root, 0700); err != nil {
+		return nil, err
+	}
+	if err := tmp.restore(); err != nil {
+		return nil, err
+	}
+	return tmp, nil
 }
 
 // Check if given error is "not empty".
@@ -267,7 +617,13 @@ func (graph *Graph) Delete(name string) error {
 	if err != nil {
 		return err
 	}
-	return os.RemoveAll(tmp)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	// The layer is removed once the containers and the children of the
+	// image don't use it anymore
+	_, err = graph.layers.GC()
+	return err
 }
 
 // Map returns a list of all images in the graph, addressable by ID.
@@ -0,0 +1,275 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+func init() {
+	RegisterGraphDriver("aufs", func(home string, options map[string]string) (GraphDriver, error) {
+		for option := range options {
+			return nil, fmt.Errorf("The aufs storage driver has no option %s", option)
+		}
+		for _, dir := range []string{"diff", "mnt", "layers"} {
+			if err := os.MkdirAll(path.Join(home, dir), 0755); err != nil {
+				return nil, err
+			}
+		}
+		return &aufsDriver{home: home}, nil
+	})
+}
+
+// The default driver: each layer is a branch of an aufs mount. diff/<id>
+// holds the files of the layer id, layers/<id> the ids of the layers below
+// it from the top one, and its filesystem is mounted on mnt/<id>.
+type aufsDriver struct {
+	home string
+}
+
+func (driver *aufsDriver) String() string {
+	return "aufs"
+}
+
+func (driver *aufsDriver) dir(kind, id string) string {
+	return path.Join(driver.home, kind, id)
+}
+
+// The ids of the layers below the layer id, from the top one
+func (driver *aufsDriver) parents(id string) ([]string, error) {
+	data, err := ioutil.ReadFile(driver.dir("layers", id))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			ids = append(ids, line)
+		}
+	}
+	return ids, nil
+}
+
+func (driver *aufsDriver) Create(id, parent string) error {
+	var ids []string
+	if parent != "" {
+		parents, err := driver.parents(parent)
+		if err != nil {
+			return err
+		}
+		ids = append([]string{parent}, parents...)
+	}
+	if err := os.Mkdir(driver.dir("diff", id), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(driver.dir("layers", id), []byte(strings.Join(ids, "\n")), 0644)
+}
+
+func (driver *aufsDriver) Remove(id string) error {
+	if err := driver.Put(id); err != nil {
+		return err
+	}
+	for _, kind := range []string{"mnt", "diff", "layers"} {
+		if err := os.RemoveAll(driver.dir(kind, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (driver *aufsDriver) Get(id string) (string, error) {
+	target := driver.dir("mnt", id)
+	if mounted, err := Mounted(target); err != nil {
+		return "", err
+	} else if mounted {
+		return target, nil
+	}
+	parents, err := driver.parents(id)
+	if err != nil {
+		return "", err
+	}
+	// A layer without parent doesn't need a mount
+	if len(parents) == 0 {
+		return driver.dir("diff", id), nil
+	}
+	var layers []string
+	for _, parent := range parents {
+		layers = append(layers, driver.dir("diff", parent))
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return "", err
+	}
+	if err := MountAUFS(layers, driver.dir("diff", id), target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+func (driver *aufsDriver) Put(id string) error {
+	target := driver.dir("mnt", id)
+	if mounted, err := Mounted(target); err != nil || !mounted {
+		return err
+	}
+	return Unmount(target)
+}
+
+func (driver *aufsDriver) Exists(id string) bool {
+	_, err := os.Stat(driver.dir("diff", id))
+	return err == nil
+}
+
+func (driver *aufsDriver) Diff(id string) (Archive, error) {
+	return Tar(driver.dir("diff", id), Uncompressed)
+}
+
+func (driver *aufsDriver) ApplyDiff(id string, diff Archive) error {
+	return Untar(diff, driver.dir("diff", id))
+}
+
+func (driver *aufsDriver) Changes(id string) ([]Change, error) {
+	parents, err := driver.parents(id)
+	if err != nil {
+		return nil, err
+	}
+	var layers []string
+	for _, parent := range parents {
+		layers = append(layers, driver.dir("diff", parent))
+	}
+	return Changes(layers, driver.dir("diff", id))
+}
+
+func (driver *aufsDriver) DiffSize(id string) (int64, error) {
+	return dirSize(driver.dir("diff", id)), nil
+}
+
+// Move the layers of the layout docker had before the graph drivers to the
+// driver: the graph/<id>/layer of the images and the containers/<id>/rw of
+// the containers become diff/<id>, and the containers get an init layer set
+// up by setupInit. The containers still mounted are left as they are.
+func (driver *aufsDriver) migrate(root string, setupInit func(string) error) error {
+	graphRoot := path.Join(root, "graph")
+	entries, err := ioutil.ReadDir(graphRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	parents := make(map[string]string)
+	for _, entry := range entries {
+		img := &Image{}
+		if data, err := ioutil.ReadFile(path.Join(graphRoot, entry.Name(), "json")); err != nil {
+			continue
+		} else if err := json.Unmarshal(data, img); err != nil {
+			continue
+		}
+		parents[entry.Name()] = img.Parent
+	}
+	// The layer of the parent of an image is moved before its own
+	var migrateImage func(id string) error
+	migrateImage = func(id string) error {
+		layer := path.Join(graphRoot, id, "layer")
+		if driver.Exists(id) {
+			return nil
+		} else if _, err := os.Stat(layer); err != nil {
+			return fmt.Errorf("Couldn't migrate image %s: no filesystem layer", id)
+		}
+		if parent := parents[id]; parent != "" {
+			if err := migrateImage(parent); err != nil {
+				return err
+			}
+		}
+		return driver.moveLayer(id, parents[id], layer)
+	}
+	for id := range parents {
+		if err := migrateImage(id); err != nil {
+			log.Printf("WARNING: %s", err)
+		}
+	}
+	if err := os.RemoveAll(path.Join(graphRoot, "_tmp", "_dockerinit")); err != nil {
+		return err
+	}
+
+	containersRoot := path.Join(root, "containers")
+	if entries, err = ioutil.ReadDir(containersRoot); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		id := entry.Name()
+		rw := path.Join(containersRoot, id, "rw")
+		rootfs := path.Join(containersRoot, id, "rootfs")
+		if _, err := os.Stat(rw); err != nil || driver.Exists(id) {
+			continue
+		}
+		if mounted, err := Mounted(rootfs); err != nil {
+			return err
+		} else if mounted {
+			log.Printf("WARNING: Couldn't migrate container %s to the %s driver: its filesystem is mounted on %s", id, driver, rootfs)
+			continue
+		}
+		container := &Container{}
+		if data, err := ioutil.ReadFile(path.Join(containersRoot, id, "config.json")); err != nil {
+			return err
+		} else if err := json.Unmarshal(data, container); err != nil {
+			return err
+		}
+		if !driver.Exists(container.Image) {
+			log.Printf("WARNING: Couldn't migrate container %s to the %s driver: its image %s has no layer", id, driver, container.Image)
+			continue
+		}
+		initID := id + "-init"
+		if !driver.Exists(initID) {
+			if err := driver.Create(initID, container.Image); err != nil {
+				return err
+			}
+			if err := setupInit(driver.dir("diff", initID)); err != nil {
+				return err
+			}
+		}
+		if err := driver.moveLayer(id, initID, rw); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(rootfs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create the layer id with the files of the directory dir
+func (driver *aufsDriver) moveLayer(id, parent, dir string) error {
+	if err := driver.Create(id, parent); err != nil {
+		return err
+	}
+	if err := os.Remove(driver.dir("diff", id)); err != nil {
+		return err
+	}
+	return os.Rename(dir, driver.dir("diff", id))
+}
+
+func MountAUFS(ro []string, rw string, target string) error {
+	// FIXME: Now mount the layers
+	rwBranch := fmt.Sprintf("%v=rw", rw)
+	roBranches := ""
+	for _, layer := range ro {
+		roBranches += fmt.Sprintf("%v=ro+wh:", layer)
+	}
+	branches := fmt.Sprintf("br:%v:%v", rwBranch, roBranches)
+
+	branches += ",xino=/dev/shm/aufs.xino"
+
+	//if error, try to load aufs kernel module
+	if err := mount("none", target, "aufs", 0, branches); err != nil {
+		log.Printf("Kernel does not support AUFS, trying to load the AUFS module with modprobe...")
+		if err := exec.Command("modprobe", "aufs").Run(); err != nil {
+			return fmt.Errorf("Unable to load the AUFS module")
+		}
+		log.Printf("...module loaded.")
+		if err := mount("none", target, "aufs", 0, branches); err != nil {
+			return fmt.Errorf("Unable to mount using aufs")
+		}
+	}
+	return nil
+}
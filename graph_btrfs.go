@@ -0,0 +1,225 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The f_type statfs gives for a btrfs filesystem, Statfs_t.Type is an int32
+// on 386 and arm
+const btrfsSuperMagic uint32 = 0x9123683e
+
+func init() {
+	RegisterGraphDriver("btrfs", func(home string, options map[string]string) (GraphDriver, error) {
+		driver := &btrfsDriver{home: home, quota: true}
+		for key, value := range options {
+			switch key {
+			case "btrfs.quota":
+				quota, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid storage option %s=%s, true or false", key, value)
+				}
+				driver.quota = quota
+			default:
+				return nil, fmt.Errorf("The btrfs storage driver has no option %s", key)
+			}
+		}
+		for _, dir := range []string{"subvolumes", "parents"} {
+			if err := os.MkdirAll(path.Join(home, dir), 0700); err != nil {
+				return nil, err
+			}
+		}
+		var buf syscall.Statfs_t
+		if err := syscall.Statfs(home, &buf); err != nil {
+			return nil, err
+		} else if uint32(buf.Type) != btrfsSuperMagic {
+			return nil, fmt.Errorf("The btrfs storage driver needs %s to be on a btrfs filesystem", home)
+		}
+		// Without the quota groups the sizes are the ones of the changed files
+		if driver.quota {
+			if _, err := btrfs("quota", "enable", home); err != nil {
+				log.Printf("WARNING: %s, the sizes of the layers are the ones of their files", err)
+				driver.quota = false
+			}
+		}
+		return driver, nil
+	})
+}
+
+// A driver for the hosts whose docker root is on btrfs: each layer is a
+// subvolume in subvolumes/<id>, a snapshot of the one of its parent, whose
+// id is in parents/<id>. The size of a layer is the exclusive size of its
+// quota group, the space only it uses.
+type btrfsDriver struct {
+	home  string
+	quota bool // Whether the quota groups of the subvolumes are enabled
+}
+
+func btrfs(args ...string) (string, error) {
+	output, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("btrfs %s: %s (%s)", strings.Join(args[:2], " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+func (driver *btrfsDriver) String() string {
+	return "btrfs"
+}
+
+func (driver *btrfsDriver) dir(id string) string {
+	return path.Join(driver.home, "subvolumes", id)
+}
+
+func (driver *btrfsDriver) parentPath(id string) string {
+	return path.Join(driver.home, "parents", id)
+}
+
+// The files of the parent of the layer id, empty if it has none
+func (driver *btrfsDriver) parentDir(id string) (string, error) {
+	data, err := ioutil.ReadFile(driver.parentPath(id))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return driver.dir(string(data)), nil
+}
+
+// The id of the subvolume of the layer id, the one of its quota group 0/<id>
+func (driver *btrfsDriver) subvolumeID(id string) (string, error) {
+	output, err := btrfs("inspect-internal", "rootid", driver.dir(id))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+func (driver *btrfsDriver) Create(id, parent string) error {
+	if parent == "" {
+		_, err := btrfs("subvolume", "create", driver.dir(id))
+		return err
+	}
+	if !driver.Exists(parent) {
+		return fmt.Errorf("No such layer: %s", parent)
+	}
+	if err := ioutil.WriteFile(driver.parentPath(id), []byte(parent), 0600); err != nil {
+		return err
+	}
+	if _, err := btrfs("subvolume", "snapshot", driver.dir(parent), driver.dir(id)); err != nil {
+		os.Remove(driver.parentPath(id))
+		return err
+	}
+	return nil
+}
+
+// The quota group of the subvolume limits the space it references, the
+// files of its parent included
+func (driver *btrfsDriver) CreateSized(id, parent string, size uint64) error {
+	if !driver.quota {
+		return fmt.Errorf("Bad parameter: the btrfs storage driver can't limit the size of the layers without the quota groups (btrfs.quota)")
+	}
+	if err := driver.Create(id, parent); err != nil {
+		return err
+	}
+	if _, err := btrfs("qgroup", "limit", strconv.FormatUint(size, 10), driver.dir(id)); err != nil {
+		driver.Remove(id)
+		return err
+	}
+	return nil
+}
+
+func (driver *btrfsDriver) Remove(id string) error {
+	if driver.Exists(id) {
+		// The quota group outlives the subvolume otherwise
+		var qgroup string
+		if driver.quota {
+			if subvolume, err := driver.subvolumeID(id); err == nil {
+				qgroup = "0/" + subvolume
+			}
+		}
+		if _, err := btrfs("subvolume", "delete", driver.dir(id)); err != nil {
+			return err
+		}
+		if qgroup != "" {
+			if _, err := btrfs("qgroup", "destroy", qgroup, driver.home); err != nil {
+				log.Printf("WARNING: %s", err)
+			}
+		}
+	}
+	if err := os.Remove(driver.parentPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (driver *btrfsDriver) Get(id string) (string, error) {
+	if !driver.Exists(id) {
+		return "", fmt.Errorf("No such layer: %s", id)
+	}
+	return driver.dir(id), nil
+}
+
+func (driver *btrfsDriver) Put(id string) error {
+	return nil
+}
+
+func (driver *btrfsDriver) Exists(id string) bool {
+	_, err := os.Stat(driver.dir(id))
+	return err == nil
+}
+
+func (driver *btrfsDriver) Diff(id string) (Archive, error) {
+	parentDir, err := driver.parentDir(id)
+	if err != nil {
+		return nil, err
+	}
+	return naiveDiff(driver.dir(id), parentDir)
+}
+
+func (driver *btrfsDriver) ApplyDiff(id string, diff Archive) error {
+	return naiveApplyDiff(driver.dir(id), diff)
+}
+
+func (driver *btrfsDriver) Changes(id string) ([]Change, error) {
+	parentDir, err := driver.parentDir(id)
+	if err != nil {
+		return nil, err
+	}
+	return ChangesDirs(driver.dir(id), parentDir)
+}
+
+func (driver *btrfsDriver) DiffSize(id string) (int64, error) {
+	if !driver.quota {
+		parentDir, err := driver.parentDir(id)
+		if err != nil {
+			return 0, err
+		}
+		return naiveDiffSize(driver.dir(id), parentDir)
+	}
+	subvolume, err := driver.subvolumeID(id)
+	if err != nil {
+		return 0, err
+	}
+	// The quota groups are accounted when the transaction is committed
+	syscall.Sync()
+	output, err := btrfs("qgroup", "show", "--raw", "-f", driver.dir(id))
+	if err != nil {
+		return 0, err
+	}
+	// qgroupid rfer excl
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "0/"+subvolume {
+			return strconv.ParseInt(fields[2], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("No quota group for the layer %s", id)
+}
@@ -0,0 +1,562 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+func init() {
+	RegisterGraphDriver("devicemapper", func(home string, options map[string]string) (GraphDriver, error) {
+		driver, err := parseDevmapperOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		driver.home = home
+		if err := driver.setup(); err != nil {
+			return nil, err
+		}
+		return driver, nil
+	})
+}
+
+// The sizes of the sparse files backing the thin pool and of the base
+// device, the filesystem of the layers, without -storage-opt
+const (
+	DefaultDmLoopDataSize     = 100 << 30
+	DefaultDmLoopMetadataSize = 2 << 30
+	DefaultDmBaseSize         = 10 << 30
+)
+
+// A driver for the hosts without union filesystem: each layer is a thin
+// device of a device-mapper thin pool, a snapshot of the one of its parent,
+// and the layers without parent are snapshots of an empty base device. The
+// pool is backed by the sparse files devicemapper/data and
+// devicemapper/metadata attached to loop devices, metadata/<id> describes
+// the device of the layer id and its ext4 filesystem is mounted on
+// mnt/<id>, the files of the layer being in its rootfs directory.
+type devmapperDriver struct {
+	sync.Mutex
+	home         string
+	prefix       string // Of the names of the devices in /dev/mapper
+	dataSize     uint64
+	metadataSize uint64
+	baseSize     uint64
+	blkdiscard   bool // Discard the blocks of the removed devices
+	nextID       int
+}
+
+// The thin device of a layer
+type dmDevice struct {
+	DeviceID int    `json:"device_id"`
+	Size     uint64 `json:"size"`
+	Parent   string `json:"parent,omitempty"`
+}
+
+// The id of the metadata of the base device, not a layer
+const dmBaseID = "base"
+
+// Parse the dm. options of -storage-opt: dm.loopdatasize,
+// dm.loopmetadatasize and dm.basesize are sizes like 20g, dm.blkdiscard a
+// boolean
+func parseDevmapperOptions(options map[string]string) (*devmapperDriver, error) {
+	driver := &devmapperDriver{
+		dataSize:     DefaultDmLoopDataSize,
+		metadataSize: DefaultDmLoopMetadataSize,
+		baseSize:     DefaultDmBaseSize,
+		blkdiscard:   true,
+	}
+	for key, value := range options {
+		switch key {
+		case "dm.loopdatasize", "dm.loopmetadatasize", "dm.basesize":
+			size, err := parseBlkioRate(value)
+			if err != nil || size < 512 {
+				return nil, fmt.Errorf("Invalid storage option %s=%s, the size must be at least 512b", key, value)
+			}
+			switch key {
+			case "dm.loopdatasize":
+				driver.dataSize = size
+			case "dm.loopmetadatasize":
+				driver.metadataSize = size
+			case "dm.basesize":
+				driver.baseSize = size
+			}
+		case "dm.blkdiscard":
+			blkdiscard, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid storage option %s=%s, true or false", key, value)
+			}
+			driver.blkdiscard = blkdiscard
+		default:
+			return nil, fmt.Errorf("The devicemapper storage driver has no option %s", key)
+		}
+	}
+	return driver, nil
+}
+
+func dmsetup(args ...string) error {
+	if output, err := exec.Command("dmsetup", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("dmsetup %s: %s (%s)", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (driver *devmapperDriver) String() string {
+	return "devicemapper"
+}
+
+func (driver *devmapperDriver) pool() string {
+	return driver.prefix + "-pool"
+}
+
+func (driver *devmapperDriver) deviceName(id string) string {
+	return driver.prefix + "-" + id
+}
+
+func (driver *devmapperDriver) devicePath(id string) string {
+	return path.Join("/dev/mapper", driver.deviceName(id))
+}
+
+func (driver *devmapperDriver) metadataPath(id string) string {
+	return path.Join(driver.home, "metadata", id)
+}
+
+func (driver *devmapperDriver) mountPath(id string) string {
+	return path.Join(driver.home, "mnt", id)
+}
+
+func (driver *devmapperDriver) device(id string) (*dmDevice, error) {
+	data, err := ioutil.ReadFile(driver.metadataPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("No such layer: %s", id)
+		}
+		return nil, err
+	}
+	device := &dmDevice{}
+	if err := json.Unmarshal(data, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (driver *devmapperDriver) saveDevice(id string, device *dmDevice) error {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	tmp := driver.metadataPath("." + id)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, driver.metadataPath(id))
+}
+
+// Create the thin pool if it isn't active, and the base device the first
+// time
+func (driver *devmapperDriver) setup() error {
+	for _, dir := range []string{"devicemapper", "metadata", "mnt"} {
+		if err := os.MkdirAll(path.Join(driver.home, dir), 0700); err != nil {
+			return err
+		}
+	}
+	// The devices of several daemons don't conflict
+	st, err := os.Stat(driver.home)
+	if err != nil {
+		return err
+	}
+	sys := st.Sys().(*syscall.Stat_t)
+	driver.prefix = fmt.Sprintf("docker-%d:%d-%d", sys.Dev>>8, sys.Dev&0xff, sys.Ino)
+
+	entries, err := ioutil.ReadDir(path.Join(driver.home, "metadata"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if device, err := driver.device(entry.Name()); err == nil && device.DeviceID >= driver.nextID {
+			driver.nextID = device.DeviceID + 1
+		}
+	}
+
+	if _, err := os.Stat(path.Join("/dev/mapper", driver.pool())); os.IsNotExist(err) {
+		data, err := attachLoopFile(path.Join(driver.home, "devicemapper", "data"), driver.dataSize)
+		if err != nil {
+			return err
+		}
+		metadata, err := attachLoopFile(path.Join(driver.home, "devicemapper", "metadata"), driver.metadataSize)
+		if err != nil {
+			return err
+		}
+		dataSize, err := loopSize(data)
+		if err != nil {
+			return err
+		}
+		// Blocks of 64k, the pool isn't zeroed as the filesystems are
+		table := fmt.Sprintf("0 %d thin-pool %s %s 128 32768 1 skip_block_zeroing", dataSize/512, metadata, data)
+		if err := dmsetup("create", driver.pool(), "--table", table); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := driver.device(dmBaseID); err == nil {
+		return nil
+	}
+	return driver.createBase()
+}
+
+// Create the empty base device, with the rootfs directory the layers
+// without parent start from
+func (driver *devmapperDriver) createBase() error {
+	device := &dmDevice{DeviceID: driver.nextID, Size: driver.baseSize}
+	if err := dmsetup("message", driver.pool(), "0", fmt.Sprintf("create_thin %d", device.DeviceID)); err != nil {
+		return err
+	}
+	driver.nextID++
+	if err := driver.activate(dmBaseID, device); err != nil {
+		return err
+	}
+	defer driver.deactivate(dmBaseID)
+	if output, err := exec.Command("mkfs.ext4", "-E", "nodiscard,lazy_itable_init=0,lazy_journal_init=0", driver.devicePath(dmBaseID)).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to create the filesystem of the base device: %s (%s)", err, strings.TrimSpace(string(output)))
+	}
+	target := driver.mountPath(dmBaseID)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := mount(driver.devicePath(dmBaseID), target, "ext4", 0, ""); err != nil {
+		return err
+	}
+	err := os.Mkdir(path.Join(target, "rootfs"), 0755)
+	if err2 := syscall.Unmount(target, 0); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	// The base device exists once its metadata is saved
+	return driver.saveDevice(dmBaseID, device)
+}
+
+// Attach the sparse file name, created with the given size if it doesn't
+// exist, to a loop device and return its path
+func attachLoopFile(name string, size uint64) (string, error) {
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		f, err := os.Create(name)
+		if err != nil {
+			return "", err
+		}
+		err = f.Truncate(int64(size))
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	output, err := exec.Command("losetup", "-f", "--show", name).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Unable to attach %s to a loop device: %s (%s)", name, err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func loopSize(device string) (uint64, error) {
+	output, err := exec.Command("blockdev", "--getsize64", device).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get the size of %s: %s", device, err)
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(output)), 10, 64)
+}
+
+func (driver *devmapperDriver) activate(id string, device *dmDevice) error {
+	if _, err := os.Stat(driver.devicePath(id)); err == nil {
+		return nil
+	}
+	table := fmt.Sprintf("0 %d thin %s %d", device.Size/512, path.Join("/dev/mapper", driver.pool()), device.DeviceID)
+	return dmsetup("create", driver.deviceName(id), "--table", table)
+}
+
+func (driver *devmapperDriver) deactivate(id string) error {
+	if _, err := os.Stat(driver.devicePath(id)); os.IsNotExist(err) {
+		return nil
+	}
+	return dmsetup("remove", driver.deviceName(id))
+}
+
+func (driver *devmapperDriver) Create(id, parent string) error {
+	return driver.CreateSized(id, parent, 0)
+}
+
+// The thin device of the layer is size bytes, its filesystem grown to it,
+// the size of the one of its parent if 0. It can't be smaller.
+func (driver *devmapperDriver) CreateSized(id, parent string, size uint64) error {
+	driver.Lock()
+	defer driver.Unlock()
+	if parent == "" {
+		parent = dmBaseID
+	}
+	parentDevice, err := driver.device(parent)
+	if err != nil {
+		return err
+	}
+	if driver.exists(id) {
+		return fmt.Errorf("Layer %s already exists", id)
+	}
+	if size == 0 {
+		size = parentDevice.Size
+	} else if size < parentDevice.Size {
+		return fmt.Errorf("The size of the layer %s can't be less than the one of the filesystem of its parent (%d bytes)", id, parentDevice.Size)
+	}
+	device := &dmDevice{DeviceID: driver.nextID, Size: size}
+	if parent != dmBaseID {
+		device.Parent = parent
+	}
+	// An active origin is suspended while it's snapshotted
+	_, err = os.Stat(driver.devicePath(parent))
+	active := err == nil
+	if active {
+		if err := dmsetup("suspend", driver.deviceName(parent)); err != nil {
+			return err
+		}
+	}
+	err = dmsetup("message", driver.pool(), "0", fmt.Sprintf("create_snap %d %d", device.DeviceID, parentDevice.DeviceID))
+	if active {
+		if err2 := dmsetup("resume", driver.deviceName(parent)); err == nil {
+			err = err2
+		}
+	}
+	if err != nil {
+		return err
+	}
+	driver.nextID++
+	if err := driver.saveDevice(id, device); err != nil {
+		return err
+	}
+	if size == parentDevice.Size {
+		return nil
+	}
+	// ext4 grows online
+	if _, err := driver.mount(id); err != nil {
+		return err
+	}
+	output, err := exec.Command("resize2fs", driver.devicePath(id)).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("Unable to grow the filesystem of the layer %s: %s (%s)", id, err, strings.TrimSpace(string(output)))
+	}
+	if err2 := driver.unmount(id); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (driver *devmapperDriver) Remove(id string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	device, err := driver.device(id)
+	if err != nil {
+		// Already removed
+		return nil
+	}
+	if err := driver.unmount(id); err != nil {
+		return err
+	}
+	if driver.blkdiscard {
+		// The pool gets the blocks of the device back
+		if err := driver.activate(id, device); err != nil {
+			return err
+		}
+		if output, err := exec.Command("blkdiscard", driver.devicePath(id)).CombinedOutput(); err != nil {
+			log.Printf("WARNING: Unable to discard the blocks of %s: %s (%s)", driver.deviceName(id), err, strings.TrimSpace(string(output)))
+		}
+	}
+	if err := driver.deactivate(id); err != nil {
+		return err
+	}
+	if err := dmsetup("message", driver.pool(), "0", fmt.Sprintf("delete %d", device.DeviceID)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(driver.mountPath(id)); err != nil {
+		return err
+	}
+	return os.Remove(driver.metadataPath(id))
+}
+
+func (driver *devmapperDriver) Get(id string) (string, error) {
+	driver.Lock()
+	defer driver.Unlock()
+	_, err := driver.mount(id)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(driver.mountPath(id), "rootfs"), nil
+}
+
+// Mount the device of the layer id if it isn't, and return whether it
+// wasn't
+func (driver *devmapperDriver) mount(id string) (bool, error) {
+	target := driver.mountPath(id)
+	if mounted, err := Mounted(target); err != nil {
+		return false, err
+	} else if mounted {
+		return false, nil
+	}
+	device, err := driver.device(id)
+	if err != nil {
+		return false, err
+	}
+	if err := driver.activate(id, device); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return false, err
+	}
+	if err := mount(driver.devicePath(id), target, "ext4", 0, "discard"); err != nil {
+		return false, fmt.Errorf("Unable to mount %s on %s: %s", driver.deviceName(id), target, err)
+	}
+	return true, nil
+}
+
+func (driver *devmapperDriver) unmount(id string) error {
+	target := driver.mountPath(id)
+	if mounted, err := Mounted(target); err != nil {
+		return err
+	} else if mounted {
+		if err := syscall.Unmount(target, 0); err != nil {
+			return err
+		}
+	}
+	return driver.deactivate(id)
+}
+
+func (driver *devmapperDriver) Put(id string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	return driver.unmount(id)
+}
+
+func (driver *devmapperDriver) exists(id string) bool {
+	_, err := os.Stat(driver.metadataPath(id))
+	return err == nil
+}
+
+func (driver *devmapperDriver) Exists(id string) bool {
+	driver.Lock()
+	defer driver.Unlock()
+	return driver.exists(id)
+}
+
+// Mount the layer id and its parent if they aren't, and return the paths of
+// their files (empty for the parent of a layer without one) and a function
+// unmounting the ones it mounted
+func (driver *devmapperDriver) mountWithParent(id string) (dir, parentDir string, release func(), err error) {
+	driver.Lock()
+	defer driver.Unlock()
+	device, err := driver.device(id)
+	if err != nil {
+		return "", "", nil, err
+	}
+	var mounted []string
+	unmount := func() {
+		for _, id := range mounted {
+			if err := driver.unmount(id); err != nil {
+				log.Printf("WARNING: Unable to unmount the layer %s: %s", id, err)
+			}
+		}
+	}
+	for _, layer := range []string{id, device.Parent} {
+		if layer == "" {
+			continue
+		}
+		done, err := driver.mount(layer)
+		if err != nil {
+			unmount()
+			return "", "", nil, err
+		} else if done {
+			mounted = append(mounted, layer)
+		}
+		if layer == id {
+			dir = path.Join(driver.mountPath(layer), "rootfs")
+		} else {
+			parentDir = path.Join(driver.mountPath(layer), "rootfs")
+		}
+	}
+	release = func() {
+		driver.Lock()
+		defer driver.Unlock()
+		unmount()
+	}
+	return dir, parentDir, release, nil
+}
+
+// Calls release once the archive is read
+type releasingArchive struct {
+	Archive
+	release func()
+	once    sync.Once
+}
+
+func (archive *releasingArchive) Read(data []byte) (int, error) {
+	n, err := archive.Archive.Read(data)
+	if err != nil {
+		archive.once.Do(archive.release)
+	}
+	return n, err
+}
+
+// Close the archive which isn't read to its end, what it keeps is released
+// once
+func (archive *releasingArchive) Close() error {
+	err := closeArchive(archive.Archive)
+	archive.once.Do(archive.release)
+	return err
+}
+
+func (driver *devmapperDriver) Diff(id string) (Archive, error) {
+	dir, parentDir, release, err := driver.mountWithParent(id)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := naiveDiff(dir, parentDir)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingArchive{Archive: archive, release: release}, nil
+}
+
+func (driver *devmapperDriver) ApplyDiff(id string, diff Archive) error {
+	dir, _, release, err := driver.mountWithParent(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return naiveApplyDiff(dir, diff)
+}
+
+func (driver *devmapperDriver) Changes(id string) ([]Change, error) {
+	dir, parentDir, release, err := driver.mountWithParent(id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ChangesDirs(dir, parentDir)
+}
+
+func (driver *devmapperDriver) DiffSize(id string) (int64, error) {
+	dir, parentDir, release, err := driver.mountWithParent(id)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return naiveDiffSize(dir, parentDir)
+}
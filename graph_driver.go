@@ -0,0 +1,179 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The driver of the layers of the images and the containers when the daemon
+// isn't given one
+const DefaultGraphDriver = "aufs"
+
+// Driver storing the layers of the images and the containers, can be changed
+// before the runtime is created
+var GraphDriverName = DefaultGraphDriver
+
+// The -storage-opt of the daemon, key=value options of the graph driver
+var GraphDriverOptions []string
+
+// A GraphDriver stores the filesystem layers. Each layer has an id and the
+// id of its parent, the layer below it. The graph and the containers only
+// deal with this interface so new backends (devicemapper, btrfs...) can
+// store the layers, with RegisterGraphDriver.
+type GraphDriver interface {
+	// The name of the driver.
+	String() string
+	// Create the empty layer id on top of the layer parent (none if empty).
+	Create(id, parent string) error
+	// Remove the layer id, unmounting it first if needed. No layer has it
+	// as parent.
+	Remove(id string) error
+	// Mount the layer id with the ones below it and return the path of the
+	// filesystem, the changes made to it go to the layer id. Getting a
+	// mounted layer returns the same path.
+	Get(id string) (string, error)
+	// The filesystem of the layer id isn't used anymore.
+	Put(id string) error
+	// Whether the layer id exists.
+	Exists(id string) bool
+	// An uncompressed tar archive of the changes of the layer id to its
+	// parent, with the aufs whiteouts of the files it deletes.
+	Diff(id string) (Archive, error)
+	// Apply the changes of a tar archive made by Diff to the layer id.
+	ApplyDiff(id string, diff Archive) error
+	// The changes of the layer id to its parent.
+	Changes(id string) ([]Change, error)
+	// The size of the changes of the layer id.
+	DiffSize(id string) (int64, error)
+}
+
+// The graph drivers which can limit the size of the writable layer of a
+// container, with the size storage option of docker run, implement it
+type SizedGraphDriver interface {
+	// Create the layer id like Create, with a filesystem of size bytes at
+	// most, the files of its parent included.
+	CreateSized(id, parent string, size uint64) error
+}
+
+// The init functions of the graph drivers get the directory the driver keeps
+// the layers in, <root>/<name>, and the options of the daemon, which are
+// driver specific.
+var graphDrivers = make(map[string]func(home string, options map[string]string) (GraphDriver, error))
+
+// Make a graph driver available under the given name, the init function is
+// called once when the runtime is created.
+func RegisterGraphDriver(name string, init func(home string, options map[string]string) (GraphDriver, error)) {
+	if _, exists := graphDrivers[name]; exists {
+		panic(fmt.Sprintf("Graph driver %s registered twice", name))
+	}
+	graphDrivers[name] = init
+}
+
+func newGraphDriver(name, root string) (GraphDriver, error) {
+	if name == "" {
+		name = DefaultGraphDriver
+	}
+	init, exists := graphDrivers[name]
+	if !exists {
+		names := make([]string, 0, len(graphDrivers))
+		for name := range graphDrivers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Invalid storage driver %s (%s)", name, strings.Join(names, ", "))
+	}
+	options, err := parseStorageOptions(GraphDriverOptions)
+	if err != nil {
+		return nil, err
+	}
+	return init(path.Join(root, name), options)
+}
+
+// Parse key=value storage options, the keys are case insensitive
+func parseStorageOptions(options []string) (map[string]string, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]string)
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid storage option %s (key=value)", option)
+		}
+		parsed[strings.ToLower(parts[0])] = parts[1]
+	}
+	return parsed, nil
+}
+
+// The size the storage options of a container limit its writable layer to,
+// 0 for none. size (e.g. 10g) is the only option.
+func containerLayerSize(options map[string]string) (uint64, error) {
+	var size uint64
+	for key, value := range options {
+		if key != "size" {
+			return 0, fmt.Errorf("Bad parameter: invalid storage option %s, the containers only have the size option", key)
+		}
+		var err error
+		if size, err = parseBlkioRate(value); err != nil || size < 1<<20 {
+			return 0, fmt.Errorf("Bad parameter: invalid storage option size=%s, the size must be at least 1m", value)
+		}
+	}
+	return size, nil
+}
+
+// The diff of the drivers whose layers are full filesystems, which don't
+// keep the changes apart: the changes of the files in dir to the ones of its
+// parent in parentDir, all of them if it's empty.
+func naiveDiff(dir, parentDir string) (Archive, error) {
+	if parentDir == "" {
+		return Tar(dir, Uncompressed)
+	}
+	changes, err := ChangesDirs(dir, parentDir)
+	if err != nil {
+		return nil, err
+	}
+	return ExportChanges(dir, changes), nil
+}
+
+func naiveDiffSize(dir, parentDir string) (int64, error) {
+	changes, err := ChangesDirs(dir, parentDir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, change := range changes {
+		if change.Kind == ChangeDelete {
+			continue
+		}
+		if info, err := os.Lstat(path.Join(dir, change.Path)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
+
+// Apply a diff to dir, a full copy of the files of the parent layer: the diff
+// is untarred next to it, so that its whiteouts, opaque directories included,
+// apply to the files of the parent only
+func naiveApplyDiff(dir string, diff Archive) error {
+	layer, err := ioutil.TempDir(filepath.Dir(dir), ".diff-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layer)
+	if err := Untar(diff, layer); err != nil {
+		return err
+	}
+	if err := applyWhiteouts(layer, dir); err != nil {
+		return err
+	}
+	if err := removeWhiteoutFiles(layer); err != nil {
+		return err
+	}
+	return TarUntar(layer, nil, dir)
+}
@@ -3,12 +3,16 @@ package docker
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/dotcloud/docker/utils"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -116,39 +120,156 @@ func TestRegister(t *testing.T) {
 	}
 }
 
-func TestMount(t *testing.T) {
+func TestTarLayerClose(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	img, err := graph.Create(testArchive(t), nil, "Testing", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := func() int {
+		graph.layers.Lock()
+		defer graph.layers.Unlock()
+		return graph.layers.refs[img.ID]
+	}
+	before := refs()
+	// The archive isn't read to its end
+	layer, err := img.TarLayer(Uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs() != before+1 {
+		t.Fatalf("Expected the archive to retain the layer")
+	}
+	if _, err := layer.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := closeArchive(layer); err != nil {
+			t.Fatal(err)
+		}
+		if refs() != before {
+			t.Fatalf("Expected the layer to be released once when the archive is closed, %d references instead of %d", refs(), before)
+		}
+	}
+}
+
+func TestContentAddressableID(t *testing.T) {
 	graph := tempGraph(t)
 	defer os.RemoveAll(graph.Root)
+	img, err := graph.Create(testArchive(t), nil, "Testing", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(img.LayerDigest, "sha256:") {
+		t.Fatalf("Expected the digest of the layer, got %s", img.LayerDigest)
+	}
+	jsonData, err := ioutil.ReadFile(jsonPath(graph.imageRoot(img.ID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := ContentID(jsonData); err != nil {
+		t.Fatal(err)
+	} else if id != img.ID {
+		t.Fatalf("Expected the id %s from the json of the image, got %s", id, img.ID)
+	}
+
+	// Another graph gets the same image from its json and its layer
+	other := tempGraph(t)
+	defer os.RemoveAll(other.Root)
+	layer, err := img.TarLayer(Uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeArchive(layer)
+	copied, err := NewImgJSON(jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Register(jsonData, layer, copied); err != nil {
+		t.Fatal(err)
+	}
+	if !other.Exists(img.ID) {
+		t.Fatalf("Expected the image %s in the other graph", img.ID)
+	}
+
+	// But not if they were changed
+	other = tempGraph(t)
+	defer os.RemoveAll(other.Root)
+	changed := *copied
+	changed.Comment = "Changed"
+	if err := other.Register(nil, testArchive(t), &changed); err == nil {
+		t.Fatal("Expected an error for an image which doesn't match its id")
+	}
 	archive, err := fakeTar()
 	if err != nil {
 		t.Fatal(err)
 	}
-	image, err := graph.Create(archive, nil, "Testing", "", nil)
+	if err := other.Register(jsonData, archive, copied); err == nil {
+		t.Fatal("Expected an error for a layer which doesn't match its digest")
+	}
+	if other.Exists(img.ID) || other.driver.Exists(img.ID) {
+		t.Fatal("Expected no image nor layer after the layer didn't match its digest")
+	}
+	// Nor without the digest of its layer, with the id of its json
+	stripped := *copied
+	stripped.LayerDigest = ""
+	strippedJSON, err := json.Marshal(&stripped)
 	if err != nil {
 		t.Fatal(err)
 	}
-	tmp, err := ioutil.TempDir("", "docker-test-graph-mount-")
+	if stripped.ID, err = ContentID(strippedJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Register(nil, testArchive(t), &stripped); err == nil {
+		t.Fatal("Expected an error for a content-addressed image without the digest of its layer")
+	}
+}
+
+func TestMount(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	archive, err := fakeTar()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(tmp)
-	rootfs := path.Join(tmp, "rootfs")
-	if err := os.MkdirAll(rootfs, 0700); err != nil {
+	image, err := graph.Create(archive, nil, "Testing", "", nil)
+	if err != nil {
 		t.Fatal(err)
 	}
-	rw := path.Join(tmp, "rw")
-	if err := os.MkdirAll(rw, 0700); err != nil {
+	id := GenerateID()
+	if err := graph.driver.Create(id, image.ID); err != nil {
 		t.Fatal(err)
 	}
-	if err := image.Mount(rootfs, rw); err != nil {
+	defer graph.driver.Remove(id)
+	rootfs, err := graph.driver.Get(id)
+	if err != nil {
 		t.Fatal(err)
 	}
-	// FIXME: test for mount contents
 	defer func() {
-		if err := Unmount(rootfs); err != nil {
+		if err := graph.driver.Put(id); err != nil {
 			t.Error(err)
 		}
 	}()
+	if _, err := os.Stat(path.Join(rootfs, "etc/passwd")); err != nil {
+		t.Fatalf("The files of the image should be mounted: %s", err)
+	}
+	if err := ioutil.WriteFile(path.Join(rootfs, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := graph.driver.Changes(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, change := range changes {
+		if change.Path == "/etc/passwd" && change.Kind == ChangeModify {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected /etc/passwd to be modified, got %v", changes)
+	}
 }
 
 // Test that an image can be deleted by its shorthand prefix
@@ -234,6 +355,188 @@ func TestDelete(t *testing.T) {
 	assertNImages(graph, t, 1)
 }
 
+// Test that the layers of the deleted images are kept while a container or
+// a child image uses them
+func TestLayerStoreGC(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	image, err := graph.Create(testArchive(t), nil, "Testing", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The layers of a container
+	if err := graph.layers.Create("test-init", image.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := graph.layers.Create("test", "test-init"); err != nil {
+		t.Fatal(err)
+	}
+	graph.layers.Release("test-init")
+	if err := graph.Delete(image.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{image.ID, "test-init", "test"} {
+		if !graph.driver.Exists(id) {
+			t.Fatalf("The layer %s should be kept for the container", id)
+		}
+	}
+	// Pulled again, the image has its layer back
+	image.graph = nil
+	if err := graph.Register(nil, testArchive(t), image); err != nil {
+		t.Fatal(err)
+	}
+	graph.layers.Release("test")
+	for _, id := range []string{"test-init", "test"} {
+		if graph.driver.Exists(id) {
+			t.Fatalf("The layer %s should be removed with the container", id)
+		}
+	}
+	if !graph.driver.Exists(image.ID) {
+		t.Fatal("The layer of the image should be kept")
+	}
+
+	// A layer nothing keeps, left by an interrupted daemon
+	if err := graph.layers.Create("left", image.ID); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewGraph(graph.Root, graph.driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := restarted.layers.GC(); err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 1 || removed[0] != "left" {
+		t.Fatalf("The garbage collection should remove the layer left, not %v", removed)
+	}
+	if err := restarted.Delete(image.ID); err != nil {
+		t.Fatal(err)
+	}
+	if graph.driver.Exists(image.ID) {
+		t.Fatal("The layer of the deleted image should be removed")
+	}
+}
+
+func TestLazyLayer(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	base := &Image{ID: GenerateID(), Created: time.Now()}
+	child := &Image{ID: GenerateID(), Parent: base.ID, Created: time.Now()}
+	for _, img := range []*Image{base, child} {
+		if err := graph.RegisterLazy(nil, img, &lazyLayer{BlobSum: "sha256:" + img.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := graph.Get(child.ID); err != nil {
+		t.Fatal(err)
+	}
+	if graph.Materialized(child.ID) || graph.driver.Exists(child.ID) {
+		t.Fatal("The layer of an image pulled lazily shouldn't be materialized")
+	}
+
+	// The layers are fetched the first time they are used, after a restart
+	restarted, err := NewGraph(graph.Root, graph.driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Materialized(base.ID) {
+		t.Fatal("The lazy layers should be kept by a restart")
+	}
+	restarted.fetchLayer = func(source *lazyLayer) (io.ReadCloser, error) {
+		return nil, errors.New("unreachable registry")
+	}
+	if err := restarted.layers.Create("test", child.ID); err == nil {
+		t.Fatal("Creating a layer on top of a layer which can't be fetched should fail")
+	}
+	var fetched []string
+	restarted.fetchLayer = func(source *lazyLayer) (io.ReadCloser, error) {
+		fetched = append(fetched, source.BlobSum)
+		archive, err := fakeTar()
+		return ioutil.NopCloser(archive), err
+	}
+	if err := restarted.layers.Create("test", child.ID); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.layers.Release("test")
+	if len(fetched) != 2 || fetched[0] != "sha256:"+base.ID || fetched[1] != "sha256:"+child.ID {
+		t.Fatalf("The layers should be fetched from the base one, not %v", fetched)
+	}
+	if !restarted.Materialized(child.ID) || !restarted.Materialized(base.ID) {
+		t.Fatal("The layers below a new layer should be materialized")
+	}
+	root, err := restarted.driver.Get("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.driver.Put("test")
+	if _, err := os.Stat(path.Join(root, "etc", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A layer materialized by two calls at once is fetched once
+	other := &Image{ID: GenerateID(), Parent: child.ID, Created: time.Now()}
+	if err := restarted.RegisterLazy(nil, other, &lazyLayer{BlobSum: "sha256:" + other.ID}); err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	fetching := make(chan struct{})
+	restarted.fetchLayer = func(source *lazyLayer) (io.ReadCloser, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-fetching
+		archive, err := fakeTar()
+		return ioutil.NopCloser(archive), err
+	}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- restarted.layers.Materialize(other.ID)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(fetching)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 1 || !restarted.Materialized(other.ID) {
+		t.Fatalf("The layer should be fetched once, not %d times", fetches)
+	}
+}
+
+func TestBlobSources(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	image := createTestImage(graph, t)
+	if sources, err := graph.BlobSources(image.ID); err != nil {
+		t.Fatal(err)
+	} else if len(sources) != 0 {
+		t.Fatalf("A new image shouldn't have blob sources, not %v", sources)
+	}
+	base := &BlobSource{BlobSum: "sha256:1234", Endpoint: "https://localhost:5000/v1/", Repository: "foo/base"}
+	for i := 0; i < maxBlobSources+2; i++ {
+		source := &BlobSource{BlobSum: "sha256:1234", Endpoint: base.Endpoint, Repository: fmt.Sprintf("foo/app%d", i)}
+		if err := graph.AddBlobSource(image.ID, source); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Added again, a source is the most recent one
+	for i := 0; i < 2; i++ {
+		if err := graph.AddBlobSource(image.ID, base); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sources, err := graph.BlobSources(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != maxBlobSources {
+		t.Fatalf("Expected %d blob sources, not %d", maxBlobSources, len(sources))
+	}
+	if *sources[0] != *base || sources[1].Repository != fmt.Sprintf("foo/app%d", maxBlobSources+1) {
+		t.Fatalf("Unexpected order of the blob sources: %v, %v", sources[0], sources[1])
+	}
+}
+
 func TestByParent(t *testing.T) {
 	archive1, _ := fakeTar()
 	archive2, _ := fakeTar()
@@ -273,6 +576,237 @@ func TestByParent(t *testing.T) {
 	}
 }
 
+func TestSquash(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	base, err := graph.Create(testArchive(t), nil, "base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := base.ID
+	for _, files := range [][][2]string{
+		{{"a", "hello"}, {"b", "hello"}},
+		{{".wh.a", ""}, {"etc/.wh.passwd", ""}, {"c", "hello"}},
+	} {
+		archive, err := mkBuildContext("", files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := &Image{ID: GenerateID(), Parent: parent, Created: time.Now(), Config: &Config{Cmd: []string{"/bin/c"}}}
+		if err := graph.Register(nil, archive, img); err != nil {
+			t.Fatal(err)
+		}
+		parent = img.ID
+	}
+	img, err := graph.Get(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	squashed, err := graph.Squash(img, base.ID, "squashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if squashed.Parent != base.ID || len(squashed.Config.Cmd) != 1 {
+		t.Fatalf("The squashed image should be a child of %s with the config of %s: %v", base.ID, img.ID, squashed)
+	}
+	layer, err := ioutil.TempDir("", "docker-test-squash-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(layer)
+	diff, err := graph.driver.Diff(squashed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Untar(diff, layer); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"b", "c", "etc/.wh.passwd"} {
+		if _, err := os.Stat(path.Join(layer, file)); err != nil {
+			t.Fatalf("%s should be in the squashed layer: %s", file, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(layer, "a")); !os.IsNotExist(err) {
+		t.Fatalf("The file a was deleted, it should not be in the squashed layer")
+	}
+	if !graph.Exists(img.ID) {
+		t.Fatalf("The squashed image should be kept")
+	}
+
+	// Squashed into a base layer, without the whiteouts
+	squashed, err = graph.Squash(img, "", "squashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if squashed.Parent != "" {
+		t.Fatalf("The squashed image should have no parent: %v", squashed)
+	}
+	if diff, err = graph.driver.Diff(squashed.ID); err != nil {
+		t.Fatal(err)
+	}
+	flat := path.Join(layer, "base")
+	if err := os.Mkdir(flat, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Untar(diff, flat); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(flat, "c")); err != nil {
+		t.Fatalf("c should be in the squashed layer: %s", err)
+	}
+	for _, file := range []string{"a", "etc/passwd", "etc/.wh.passwd", ".wh.a"} {
+		if _, err := os.Stat(path.Join(flat, file)); !os.IsNotExist(err) {
+			t.Fatalf("%s should not be in the squashed base layer", file)
+		}
+	}
+	if _, err := graph.Squash(base, img.ID, "squashed"); err == nil {
+		t.Fatalf("Squashing down to an image which isn't a parent should fail")
+	}
+}
+
+func TestVFSDriverDiff(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-vfs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	driver, err := newGraphDriver("vfs", tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create("base", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.ApplyDiff("base", testArchive(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create("child", "base"); err != nil {
+		t.Fatal(err)
+	}
+	rootfs, err := driver.Get("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(rootfs, "etc/passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(rootfs, "foo"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := driver.Changes("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	for _, change := range changes {
+		list = append(list, change.String())
+	}
+	if strings.Join(list, ", ") != "C /etc, A /foo, D /etc/passwd" {
+		t.Fatalf("Expected C /etc, A /foo and D /etc/passwd, got %v", list)
+	}
+
+	// The diff applied to another copy of base makes the same changes
+	diff, err := driver.Diff("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create("copy", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.ApplyDiff("copy", diff); err != nil {
+		t.Fatal(err)
+	}
+	copyfs, err := driver.Get("copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(copyfs, "etc/passwd")); !os.IsNotExist(err) {
+		t.Fatalf("/etc/passwd should have been deleted")
+	}
+	if _, err := os.Stat(path.Join(copyfs, "etc/.wh.passwd")); !os.IsNotExist(err) {
+		t.Fatalf("The whiteout of /etc/passwd should not be in the layer")
+	}
+	if data, err := ioutil.ReadFile(path.Join(copyfs, "foo")); err != nil || string(data) != "foo" {
+		t.Fatalf("/foo should have been added: %s", err)
+	}
+
+	// An opaque directory of a diff hides the files of the parent only
+	opaque, err := ioutil.TempDir("", "docker-test-opaque-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(opaque)
+	if err := os.Mkdir(path.Join(opaque, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".wh..wh..opq", "hosts"} {
+		if err := ioutil.WriteFile(path.Join(opaque, "etc", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opaqueDiff, err := Tar(opaque, Uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create("opaque", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.ApplyDiff("opaque", opaqueDiff); err != nil {
+		t.Fatal(err)
+	}
+	opaquefs, err := driver.Get("opaque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(path.Join(opaquefs, "etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "hosts" {
+		t.Fatalf("/etc should only contain the hosts of the diff, got %v", entries)
+	}
+}
+
+func TestDevmapperOptions(t *testing.T) {
+	driver, err := parseDevmapperOptions(map[string]string{"dm.basesize": "20g", "dm.loopdatasize": "200G", "dm.blkdiscard": "false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if driver.baseSize != 20<<30 || driver.dataSize != 200<<30 || driver.metadataSize != DefaultDmLoopMetadataSize || driver.blkdiscard {
+		t.Fatalf("Unexpected options of the devicemapper driver: %#v", driver)
+	}
+	for _, options := range []map[string]string{
+		{"dm.basesize": "10x"},
+		{"dm.basesize": "0"},
+		{"dm.blkdiscard": "maybe"},
+		{"dm.fs": "xfs"},
+	} {
+		if _, err := parseDevmapperOptions(options); err == nil {
+			t.Fatalf("The options %v should be invalid", options)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-test-storage-opt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func() { GraphDriverOptions = nil }()
+	for _, option := range []string{"dm.basesize=20g", "dm.basesize"} {
+		GraphDriverOptions = []string{option}
+		if _, err := newGraphDriver("vfs", tmp); err == nil {
+			t.Fatalf("The vfs driver should refuse the storage option %s", option)
+		}
+	}
+	for driver, option := range map[string]string{"btrfs": "btrfs.quota=maybe", "zfs": "dm.basesize=20g"} {
+		GraphDriverOptions = []string{option}
+		if _, err := newGraphDriver(driver, tmp); err == nil {
+			t.Fatalf("The %s driver should refuse the storage option %s", driver, option)
+		}
+	}
+}
+
 func assertNImages(graph *Graph, t *testing.T, n int) {
 	if images, err := graph.All(); err != nil {
 		t.Fatal(err)
@@ -290,7 +824,11 @@ func tempGraph(t *testing.T) *Graph {
 	if err != nil {
 		t.Fatal(err)
 	}
-	graph, err := NewGraph(tmp)
+	driver, err := newGraphDriver(DefaultGraphDriver, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := NewGraph(tmp, driver)
 	if err != nil {
 		t.Fatal(err)
 	}
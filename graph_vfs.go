@@ -0,0 +1,129 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+)
+
+func init() {
+	RegisterGraphDriver("vfs", func(home string, options map[string]string) (GraphDriver, error) {
+		for option := range options {
+			return nil, fmt.Errorf("The vfs storage driver has no option %s", option)
+		}
+		if err := os.MkdirAll(home, 0700); err != nil {
+			return nil, err
+		}
+		return &vfsDriver{home: home}, nil
+	})
+}
+
+// A driver which works on any filesystem, without mount: each layer is a
+// full copy of its parent, in <home>/<id>/layer. The anonymous volumes use
+// it too.
+type vfsDriver struct {
+	home string
+}
+
+func (driver *vfsDriver) String() string {
+	return "vfs"
+}
+
+func (driver *vfsDriver) dir(id string) string {
+	return path.Join(driver.home, id, "layer")
+}
+
+func (driver *vfsDriver) parentPath(id string) string {
+	return path.Join(driver.home, id, "parent")
+}
+
+// The files of the parent of the layer id, empty if it has none
+func (driver *vfsDriver) parentDir(id string) (string, error) {
+	data, err := ioutil.ReadFile(driver.parentPath(id))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return driver.dir(string(data)), nil
+}
+
+func (driver *vfsDriver) Create(id, parent string) error {
+	if parent != "" && !driver.Exists(parent) {
+		return fmt.Errorf("No such layer: %s", parent)
+	}
+	if err := os.MkdirAll(path.Join(driver.home, id), 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(driver.dir(id), 0755); err != nil {
+		return err
+	}
+	if parent == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(driver.parentPath(id), []byte(parent), 0600); err != nil {
+		return err
+	}
+	if output, err := exec.Command("cp", "-a", driver.dir(parent)+"/.", driver.dir(id)).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to copy the layer %s: %s (%s)", parent, err, output)
+	}
+	return nil
+}
+
+func (driver *vfsDriver) Remove(id string) error {
+	if err := os.RemoveAll(driver.dir(id)); err != nil {
+		return err
+	}
+	if err := os.Remove(driver.parentPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The graph of the volumes keeps its own files in the directory
+	os.Remove(path.Join(driver.home, id))
+	return nil
+}
+
+func (driver *vfsDriver) Get(id string) (string, error) {
+	if !driver.Exists(id) {
+		return "", fmt.Errorf("No such layer: %s", id)
+	}
+	return driver.dir(id), nil
+}
+
+func (driver *vfsDriver) Put(id string) error {
+	return nil
+}
+
+func (driver *vfsDriver) Exists(id string) bool {
+	_, err := os.Stat(driver.dir(id))
+	return err == nil
+}
+
+func (driver *vfsDriver) Diff(id string) (Archive, error) {
+	parentDir, err := driver.parentDir(id)
+	if err != nil {
+		return nil, err
+	}
+	return naiveDiff(driver.dir(id), parentDir)
+}
+
+func (driver *vfsDriver) ApplyDiff(id string, diff Archive) error {
+	return naiveApplyDiff(driver.dir(id), diff)
+}
+
+func (driver *vfsDriver) Changes(id string) ([]Change, error) {
+	parentDir, err := driver.parentDir(id)
+	if err != nil {
+		return nil, err
+	}
+	return ChangesDirs(driver.dir(id), parentDir)
+}
+
+func (driver *vfsDriver) DiffSize(id string) (int64, error) {
+	parentDir, err := driver.parentDir(id)
+	if err != nil {
+		return 0, err
+	}
+	return naiveDiffSize(driver.dir(id), parentDir)
+}
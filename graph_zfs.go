@@ -0,0 +1,325 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+func init() {
+	RegisterGraphDriver("zfs", func(home string, options map[string]string) (GraphDriver, error) {
+		driver := &zfsDriver{home: home}
+		for key, value := range options {
+			switch key {
+			case "zfs.fsname":
+				driver.dataset = value
+			default:
+				return nil, fmt.Errorf("The zfs storage driver has no option %s", key)
+			}
+		}
+		for _, dir := range []string{"mnt", "origin"} {
+			if err := os.MkdirAll(path.Join(home, dir), 0700); err != nil {
+				return nil, err
+			}
+		}
+		if driver.dataset == "" {
+			dataset, err := zfsMountedDataset(home)
+			if err != nil {
+				return nil, err
+			}
+			driver.dataset = dataset
+		}
+		if _, err := zfs("list", "-H", "-o", "name", driver.dataset); err != nil {
+			return nil, err
+		}
+		return driver, nil
+	})
+}
+
+// A driver for the hosts with a ZFS pool: each layer is a dataset, a child
+// of the one given with zfs.fsname or of the one the docker root is on. The
+// dataset of a layer with a parent is a clone of the snapshot <parent>@<id>
+// of the one of its parent, the origin of the layer. The datasets aren't
+// mounted by zfs, the filesystem of the layer id is mounted on mnt/<id> and
+// its origin on origin/<id> to compare them. The size of a layer is the
+// space its dataset uses apart from its origin.
+type zfsDriver struct {
+	sync.Mutex
+	home    string
+	dataset string // The parent of the datasets of the layers
+}
+
+func zfs(args ...string) (string, error) {
+	output, err := exec.Command("zfs", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("zfs %s: %s (%s)", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// The zfs dataset mounted on dir or the closest of its parents
+func zfsMountedDataset(dir string) (string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var dataset, mountpoint string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// source mountpoint type options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != "zfs" {
+			continue
+		}
+		if fields[1] != dir && fields[1] != "/" && !strings.HasPrefix(dir, fields[1]+"/") {
+			continue
+		}
+		if len(fields[1]) > len(mountpoint) {
+			dataset, mountpoint = fields[0], fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if dataset == "" {
+		return "", fmt.Errorf("The zfs storage driver needs %s to be on a zfs dataset or the zfs.fsname storage option", dir)
+	}
+	return dataset, nil
+}
+
+func (driver *zfsDriver) String() string {
+	return "zfs"
+}
+
+func (driver *zfsDriver) name(id string) string {
+	return driver.dataset + "/" + id
+}
+
+func (driver *zfsDriver) mountPath(id string) string {
+	return path.Join(driver.home, "mnt", id)
+}
+
+func (driver *zfsDriver) originPath(id string) string {
+	return path.Join(driver.home, "origin", id)
+}
+
+// The snapshot the dataset of the layer id is a clone of, empty for a layer
+// without parent
+func (driver *zfsDriver) origin(id string) (string, error) {
+	output, err := zfs("get", "-H", "-o", "value", "origin", driver.name(id))
+	if err != nil {
+		return "", err
+	}
+	if origin := strings.TrimSpace(output); origin != "-" {
+		return origin, nil
+	}
+	return "", nil
+}
+
+func (driver *zfsDriver) Create(id, parent string) error {
+	return driver.CreateSized(id, parent, 0)
+}
+
+// The refquota of the dataset limits the space it references, the files of
+// its origin included, none if size is 0
+func (driver *zfsDriver) CreateSized(id, parent string, size uint64) error {
+	driver.Lock()
+	defer driver.Unlock()
+	properties := []string{"-o", "mountpoint=legacy"}
+	if size != 0 {
+		properties = append(properties, "-o", fmt.Sprintf("refquota=%d", size))
+	}
+	if parent == "" {
+		if _, err := zfs(append(append([]string{"create"}, properties...), driver.name(id))...); err != nil {
+			return err
+		}
+	} else {
+		if !driver.exists(parent) {
+			return fmt.Errorf("No such layer: %s", parent)
+		}
+		snapshot := driver.name(parent) + "@" + id
+		if _, err := zfs("snapshot", snapshot); err != nil {
+			return err
+		}
+		if _, err := zfs(append(append([]string{"clone"}, properties...), snapshot, driver.name(id))...); err != nil {
+			zfs("destroy", snapshot)
+			return err
+		}
+	}
+	// The layer exists once its mountpoint does
+	return os.Mkdir(driver.mountPath(id), 0755)
+}
+
+func (driver *zfsDriver) Remove(id string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	if !driver.exists(id) {
+		return nil
+	}
+	if err := driver.unmount(driver.mountPath(id)); err != nil {
+		return err
+	}
+	origin, err := driver.origin(id)
+	if err != nil {
+		return err
+	}
+	if _, err := zfs("destroy", driver.name(id)); err != nil {
+		return err
+	}
+	if origin != "" {
+		if _, err := zfs("destroy", origin); err != nil {
+			log.Printf("WARNING: %s", err)
+		}
+	}
+	os.Remove(driver.originPath(id))
+	return os.Remove(driver.mountPath(id))
+}
+
+// Mount the dataset or snapshot name on target if it isn't, return whether
+// it did
+func (driver *zfsDriver) mount(name, target string, flags uintptr) (bool, error) {
+	if mounted, err := Mounted(target); err != nil {
+		return false, err
+	} else if mounted {
+		return false, nil
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return false, err
+	}
+	if err := mount(name, target, "zfs", flags, ""); err != nil {
+		return false, fmt.Errorf("Unable to mount %s on %s: %s", name, target, err)
+	}
+	return true, nil
+}
+
+func (driver *zfsDriver) unmount(target string) error {
+	if mounted, err := Mounted(target); err != nil || !mounted {
+		return err
+	}
+	return syscall.Unmount(target, 0)
+}
+
+func (driver *zfsDriver) Get(id string) (string, error) {
+	driver.Lock()
+	defer driver.Unlock()
+	if !driver.exists(id) {
+		return "", fmt.Errorf("No such layer: %s", id)
+	}
+	if _, err := driver.mount(driver.name(id), driver.mountPath(id), 0); err != nil {
+		return "", err
+	}
+	return driver.mountPath(id), nil
+}
+
+func (driver *zfsDriver) Put(id string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	return driver.unmount(driver.mountPath(id))
+}
+
+func (driver *zfsDriver) exists(id string) bool {
+	_, err := os.Stat(driver.mountPath(id))
+	return err == nil
+}
+
+func (driver *zfsDriver) Exists(id string) bool {
+	driver.Lock()
+	defer driver.Unlock()
+	return driver.exists(id)
+}
+
+// Mount the layer id and its origin, read-only, if they aren't, and return
+// the paths of their files (empty for the origin of a layer without parent)
+// and a function unmounting the ones it mounted
+func (driver *zfsDriver) mountWithOrigin(id string) (dir, originDir string, release func(), err error) {
+	driver.Lock()
+	defer driver.Unlock()
+	if !driver.exists(id) {
+		return "", "", nil, fmt.Errorf("No such layer: %s", id)
+	}
+	origin, err := driver.origin(id)
+	if err != nil {
+		return "", "", nil, err
+	}
+	var mounted []string
+	unmount := func() {
+		for _, target := range mounted {
+			if err := driver.unmount(target); err != nil {
+				log.Printf("WARNING: Unable to unmount %s: %s", target, err)
+			}
+		}
+	}
+	dir = driver.mountPath(id)
+	if done, err := driver.mount(driver.name(id), dir, 0); err != nil {
+		return "", "", nil, err
+	} else if done {
+		mounted = append(mounted, dir)
+	}
+	if origin != "" {
+		originDir = driver.originPath(id)
+		if done, err := driver.mount(origin, originDir, syscall.MS_RDONLY); err != nil {
+			unmount()
+			return "", "", nil, err
+		} else if done {
+			mounted = append(mounted, originDir)
+		}
+	}
+	release = func() {
+		driver.Lock()
+		defer driver.Unlock()
+		unmount()
+	}
+	return dir, originDir, release, nil
+}
+
+func (driver *zfsDriver) Diff(id string) (Archive, error) {
+	dir, originDir, release, err := driver.mountWithOrigin(id)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := naiveDiff(dir, originDir)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingArchive{Archive: archive, release: release}, nil
+}
+
+func (driver *zfsDriver) ApplyDiff(id string, diff Archive) error {
+	dir, _, release, err := driver.mountWithOrigin(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return naiveApplyDiff(dir, diff)
+}
+
+func (driver *zfsDriver) Changes(id string) ([]Change, error) {
+	dir, originDir, release, err := driver.mountWithOrigin(id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ChangesDirs(dir, originDir)
+}
+
+func (driver *zfsDriver) DiffSize(id string) (int64, error) {
+	if !driver.Exists(id) {
+		return 0, fmt.Errorf("No such layer: %s", id)
+	}
+	// The space used is accounted when the transaction group is synced
+	syscall.Sync()
+	output, err := zfs("get", "-H", "-p", "-o", "value", "usedbydataset", driver.name(id))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+}
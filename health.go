@@ -0,0 +1,211 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The health of a container with a health check
+const (
+	HealthStarting  = "starting"  // No successful probe yet, nor enough failures
+	HealthHealthy   = "healthy"   // The last probe succeeded
+	HealthUnhealthy = "unhealthy" // The last Retries probes failed
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+
+	healthLogSize   = 5    // Results of probes kept in the health of a container
+	healthOutputMax = 4096 // Bytes of output kept in the result of a probe
+)
+
+// HealthConfig is the health check of a container, set by the HEALTHCHECK
+// instruction of its Dockerfile. Without Test, it disables the health check
+// of the image it is built on.
+type HealthConfig struct {
+	Test     []string      // The probe, run in the container, healthy if it exits with 0
+	Interval time.Duration // Between the end of a probe and the next one, 30s if 0
+	Timeout  time.Duration // After which the probe is killed and fails, 30s if 0
+	Retries  int           // Failures in a row for the container to be unhealthy, 3 if 0
+}
+
+type Health struct {
+	Status        string
+	FailingStreak int             // Probes failed in a row
+	Log           []*HealthResult // The last probes, the latest last
+}
+
+type HealthResult struct {
+	Start    time.Time
+	End      time.Time
+	ExitCode int
+	Output   string
+}
+
+// Parse the arguments of HEALTHCHECK: NONE, or the options followed by
+// CMD and the probe, in the JSON or in the shell form.
+func parseHealthcheck(args string) (*HealthConfig, error) {
+	if strings.ToUpper(args) == "NONE" {
+		return &HealthConfig{}, nil
+	}
+	config := &HealthConfig{}
+	for strings.HasPrefix(args, "--") {
+		parts := strings.SplitN(args, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("HEALTHCHECK requires a CMD")
+		}
+		option := strings.SplitN(parts[0][2:], "=", 2)
+		if len(option) != 2 {
+			return nil, fmt.Errorf("Invalid HEALTHCHECK option: %s", parts[0])
+		}
+		switch option[0] {
+		case "interval", "timeout":
+			duration, err := time.ParseDuration(option[1])
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("Invalid HEALTHCHECK %s: %s", option[0], option[1])
+			}
+			if option[0] == "interval" {
+				config.Interval = duration
+			} else {
+				config.Timeout = duration
+			}
+		case "retries":
+			retries, err := strconv.Atoi(option[1])
+			if err != nil || retries <= 0 {
+				return nil, fmt.Errorf("Invalid HEALTHCHECK retries: %s", option[1])
+			}
+			config.Retries = retries
+		default:
+			return nil, fmt.Errorf("Invalid HEALTHCHECK option: %s", parts[0])
+		}
+		args = strings.TrimLeft(parts[1], " ")
+	}
+	parts := strings.SplitN(args, " ", 2)
+	if len(parts) != 2 || strings.ToUpper(parts[0]) != "CMD" {
+		return nil, fmt.Errorf("HEALTHCHECK requires a CMD")
+	}
+	test := strings.Trim(parts[1], " ")
+	if err := json.Unmarshal([]byte(test), &config.Test); err != nil {
+		config.Test = []string{"/bin/sh", "-c", test}
+	}
+	if len(config.Test) == 0 {
+		return nil, fmt.Errorf("HEALTHCHECK requires a CMD")
+	}
+	return config, nil
+}
+
+// Probe the container with its healthcheck, if it has one, until its
+// process exits. The health a daemon saved before it restarted is kept.
+func (container *Container) startHealthMonitor() {
+	healthcheck := container.Config.Healthcheck
+	if healthcheck == nil || len(healthcheck.Test) == 0 {
+		return
+	}
+	if container.State.Health == nil {
+		container.State.Health = &Health{Status: HealthStarting}
+	}
+	go container.monitorHealth(healthcheck, container.waitLock)
+}
+
+// Probe the container every interval until stop is closed, when the
+// process of the container exits
+func (container *Container) monitorHealth(config *HealthConfig, stop chan struct{}) {
+	interval, timeout, retries := config.Interval, config.Timeout, config.Retries
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	if retries == 0 {
+		retries = defaultHealthRetries
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		container.State.Lock()
+		paused := container.State.Paused
+		container.State.Unlock()
+		if paused {
+			continue
+		}
+		result := container.probe(config.Test, timeout)
+
+		container.State.Lock()
+		select {
+		case <-stop:
+			container.State.Unlock()
+			return
+		default:
+		}
+		health := container.State.Health
+		previous := health.Status
+		if result.ExitCode == 0 {
+			health.FailingStreak = 0
+			health.Status = HealthHealthy
+		} else {
+			utils.Debugf("Health check of %s failed: %s", container.ID, result.Output)
+			health.FailingStreak++
+			if health.FailingStreak >= retries {
+				health.Status = HealthUnhealthy
+			}
+		}
+		health.Log = append(health.Log, result)
+		if len(health.Log) > healthLogSize {
+			health.Log = health.Log[len(health.Log)-healthLogSize:]
+		}
+		status := health.Status
+		container.State.Unlock()
+
+		if status != previous {
+			if err := container.ToDisk(); err != nil {
+				utils.Debugf("%s: Failed to save the health: %s", container.ID, err)
+			}
+			if container.runtime != nil && container.runtime.srv != nil {
+				container.runtime.srv.LogEvent("health_status: "+status, container.ShortID(), container.runtime.repositories.ImageName(container.Image))
+			}
+		}
+	}
+}
+
+// Run test in the container, as docker exec would, and kill it after timeout
+func (container *Container) probe(test []string, timeout time.Duration) *HealthResult {
+	result := &HealthResult{Start: time.Now(), ExitCode: -1}
+	defer func() { result.End = time.Now() }()
+
+	e, err := newExec(container, &ExecConfig{Cmd: test})
+	if err != nil {
+		result.Output = err.Error()
+		return result
+	}
+	output := &bytes.Buffer{}
+	if err := e.Start(nil, output, output); err != nil {
+		result.Output = err.Error()
+		return result
+	}
+	exitCode := make(chan int, 1)
+	go func() { exitCode <- e.Wait() }()
+	select {
+	case result.ExitCode = <-exitCode:
+		result.Output = output.String()
+		if len(result.Output) > healthOutputMax {
+			result.Output = result.Output[:healthOutputMax]
+		}
+	case <-time.After(timeout):
+		if err := e.kill(); err != nil {
+			utils.Debugf("%s: Unable to kill the health check: %s", container.ID, err)
+		}
+		result.Output = fmt.Sprintf("Health check timed out after %s", timeout)
+	}
+	return result
+}
@@ -1,18 +1,17 @@
 package docker
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
 	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -29,8 +28,12 @@ type Image struct {
 	Author          string    `json:"author,omitempty"`
 	Config          *Config   `json:"config,omitempty"`
 	Architecture    string    `json:"architecture,omitempty"`
-	graph           *Graph
-	Size            int64
+	// The LayerDigest of the archive of its layer. The id of an image with
+	// one is the ContentID of its json, the images of the docker before
+	// don't have it.
+	LayerDigest string `json:"layer_digest,omitempty"`
+	graph       *Graph
+	Size        int64
 }
 
 func LoadImage(root string) (*Image, error) {
@@ -59,66 +62,40 @@ func LoadImage(root string) (*Image, error) {
 			img.Size = int64(size)
 		}
 	}
-
-	// Check that the filesystem layer exists
-	if stat, err := os.Stat(layerPath(root)); err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("Couldn't load image %s: no filesystem layer", img.ID)
-		}
-		return nil, err
-	} else if !stat.IsDir() {
-		return nil, fmt.Errorf("Couldn't load image %s: %s is not a directory", img.ID, layerPath(root))
-	}
 	return img, nil
 }
 
-func StoreImage(img *Image, jsonData []byte, layerData Archive, root string) error {
-	// Check that root doesn't already exist
-	if _, err := os.Stat(root); err == nil {
-		return fmt.Errorf("Image %s already exists", img.ID)
-	} else if !os.IsNotExist(err) {
+// StoreImage stores the json and the size of img, registered in a graph
+// which already has its layer, in root.
+func StoreImage(img *Image, jsonData []byte, root string) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
 		return err
 	}
-	// Store the layer
-	layer := layerPath(root)
-	if err := os.MkdirAll(layer, 0755); err != nil {
+	if err := StoreSize(img, root); err != nil {
 		return err
 	}
-
-	// If layerData is not nil, unpack it into the new layer
-	if layerData != nil {
-		start := time.Now()
-		utils.Debugf("Start untar layer")
-		if err := Untar(layerData, layer); err != nil {
-			return err
-		}
-		utils.Debugf("Untar time: %vs\n", time.Now().Sub(start).Seconds())
-	}
-
 	// If raw json is provided, then use it
-	if jsonData != nil {
-		return ioutil.WriteFile(jsonPath(root), jsonData, 0600)
-	} else { // Otherwise, unmarshal the image
-		jsonData, err := json.Marshal(img)
-		if err != nil {
-			return err
-		}
-		if err := ioutil.WriteFile(jsonPath(root), jsonData, 0600); err != nil {
+	if jsonData == nil { // Otherwise, unmarshal the image
+		var err error
+		if jsonData, err = json.Marshal(img); err != nil {
 			return err
 		}
 	}
-
-	return StoreSize(img, root)
+	return ioutil.WriteFile(jsonPath(root), jsonData, 0600)
 }
 
 func StoreSize(img *Image, root string) error {
-	layer := layerPath(root)
-
-	var totalSize int64 = 0
-	filepath.Walk(layer, func(path string, fileInfo os.FileInfo, err error) error {
-		totalSize += fileInfo.Size()
+	if img.graph == nil {
+		return fmt.Errorf("Can't lookup the layer of unregistered image")
+	}
+	// The size of a lazy layer is only known once it's fetched
+	if !img.graph.Materialized(img.ID) {
 		return nil
-	})
+	}
+	totalSize, err := img.graph.driver.DiffSize(img.ID)
+	if err != nil {
+		return err
+	}
 	img.Size = totalSize
 
 	if err := ioutil.WriteFile(path.Join(root, "layersize"), []byte(strconv.Itoa(int(totalSize))), 0600); err != nil {
@@ -128,77 +105,37 @@ func StoreSize(img *Image, root string) error {
 	return nil
 }
 
-func layerPath(root string) string {
-	return path.Join(root, "layer")
-}
-
 func jsonPath(root string) string {
 	return path.Join(root, "json")
 }
 
-func MountAUFS(ro []string, rw string, target string) error {
-	// FIXME: Now mount the layers
-	rwBranch := fmt.Sprintf("%v=rw", rw)
-	roBranches := ""
-	for _, layer := range ro {
-		roBranches += fmt.Sprintf("%v=ro+wh:", layer)
-	}
-	branches := fmt.Sprintf("br:%v:%v", rwBranch, roBranches)
-
-	branches += ",xino=/dev/shm/aufs.xino"
-
-	//if error, try to load aufs kernel module
-	if err := mount("none", target, "aufs", 0, branches); err != nil {
-		log.Printf("Kernel does not support AUFS, trying to load the AUFS module with modprobe...")
-		if err := exec.Command("modprobe", "aufs").Run(); err != nil {
-			return fmt.Errorf("Unable to load the AUFS module")
-		}
-		log.Printf("...module loaded.")
-		if err := mount("none", target, "aufs", 0, branches); err != nil {
-			return fmt.Errorf("Unable to mount using aufs")
-		}
-	}
-	return nil
-}
-
 // TarLayer returns a tar archive of the image's filesystem layer.
 func (image *Image) TarLayer(compression Compression) (Archive, error) {
-	layerPath, err := image.layer()
-	if err != nil {
-		return nil, err
-	}
-	return Tar(layerPath, compression)
-}
-
-func (image *Image) Mount(root, rw string) error {
-	if mounted, err := Mounted(root); err != nil {
-		return err
-	} else if mounted {
-		return fmt.Errorf("%s is already mounted", root)
+	if image.graph == nil {
+		return nil, fmt.Errorf("Can't lookup the layer of unregistered image")
 	}
-	layers, err := image.layers()
-	if err != nil {
-		return err
+	if compression != Uncompressed {
+		return nil, fmt.Errorf("The layers of the %s driver can only be archived uncompressed", image.graph.driver)
 	}
-	// Create the target directories if they don't exist
-	if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
-		return err
-	}
-	if err := os.Mkdir(rw, 0755); err != nil && !os.IsExist(err) {
-		return err
+	// The layer is kept until the archive is read, even if the image is
+	// deleted meanwhile
+	layers := image.graph.layers
+	if err := layers.Retain(image.ID); err != nil {
+		return nil, err
 	}
-	if err := MountAUFS(layers, rw, root); err != nil {
-		return err
+	if err := layers.Materialize(image.ID); err != nil {
+		layers.Release(image.ID)
+		return nil, err
 	}
-	return nil
-}
-
-func (image *Image) Changes(rw string) ([]Change, error) {
-	layers, err := image.layers()
+	archive, err := image.graph.driver.Diff(image.ID)
 	if err != nil {
+		layers.Release(image.ID)
 		return nil, err
 	}
-	return Changes(layers, rw)
+	if image.graph.idMappings != nil {
+		archive = image.graph.idMappings.containerArchive(archive)
+	}
+	return &releasingArchive{Archive: archive, release: func() { layers.Release(image.ID) }}, nil
 }
 
 func (image *Image) ShortID() string {
@@ -215,6 +152,27 @@ func ValidateID(id string) error {
 	return nil
 }
 
+// ContentID computes the id of an image from its json: the sha256 of the
+// json without its id and its size, with the keys sorted, so the same image
+// has the same id wherever it's built or pulled from.
+func ContentID(jsonData []byte) (string, error) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return "", err
+	}
+	delete(fields, "id")
+	delete(fields, "Size")
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func GenerateID() string {
 	id := make([]byte, 32)
 	_, err := io.ReadFull(rand.Reader, id)
@@ -240,39 +198,6 @@ func (img *Image) History() ([]*Image, error) {
 	return parents, nil
 }
 
-// layers returns all the filesystem layers needed to mount an image
-// FIXME: @shykes refactor this function with the new error handling
-//        (I'll do it if I have time tonight, I focus on the rest)
-func (img *Image) layers() ([]string, error) {
-	var list []string
-	var e error
-	if err := img.WalkHistory(
-		func(img *Image) (err error) {
-			if layer, err := img.layer(); err != nil {
-				e = err
-			} else if layer != "" {
-				list = append(list, layer)
-			}
-			return err
-		},
-	); err != nil {
-		return nil, err
-	} else if e != nil { // Did an error occur inside the handler?
-		return nil, e
-	}
-	if len(list) == 0 {
-		return nil, fmt.Errorf("No layer found for image %s\n", img.ID)
-	}
-
-	// Inject the dockerinit layer (empty place-holder for mount-binding dockerinit)
-	if dockerinitLayer, err := img.getDockerInitLayer(); err != nil {
-		return nil, err
-	} else {
-		list = append([]string{dockerinitLayer}, list...)
-	}
-	return list, nil
-}
-
 func (img *Image) WalkHistory(handler func(*Image) error) (err error) {
 	currentImg := img
 	for currentImg != nil {
@@ -299,13 +224,6 @@ func (img *Image) GetParent() (*Image, error) {
 	return img.graph.Get(img.Parent)
 }
 
-func (img *Image) getDockerInitLayer() (string, error) {
-	if img.graph == nil {
-		return "", fmt.Errorf("Can't lookup dockerinit layer of unregistered image")
-	}
-	return img.graph.getDockerInitLayer()
-}
-
 func (img *Image) root() (string, error) {
 	if img.graph == nil {
 		return "", fmt.Errorf("Can't lookup root of unregistered image")
@@ -313,15 +231,6 @@ func (img *Image) root() (string, error) {
 	return img.graph.imageRoot(img.ID), nil
 }
 
-// Return the path of an image's layer
-func (img *Image) layer() (string, error) {
-	root, err := img.root()
-	if err != nil {
-		return "", err
-	}
-	return layerPath(root), nil
-}
-
 func (img *Image) getParentsSize(size int64) int64 {
 	parentImage, err := img.GetParent()
 	if err != nil || parentImage == nil {
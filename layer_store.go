@@ -0,0 +1,426 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+)
+
+// A layerStore keeps the layers of a graph driver as long as something uses
+// them. The layers of the images of the graph are always kept, with the
+// layers below them. The other ones are kept while they are retained: a
+// container retains its layer from its creation to its destruction, the
+// readers of a layer retain it while they read it. A layer is removed by the
+// garbage collection once nothing keeps it: the one of a deleted image when
+// the last container or child image using it goes, the ones a daemon
+// interrupted while creating them when it starts again.
+//
+// The layers pulled lazily are part of the store without being in the
+// driver: they are materialized, with the ones below them, the first time a
+// layer is created on top of them or they are read. Their archive is
+// downloaded whole then, the files aren't fetched on demand.
+type layerStore struct {
+	sync.Mutex
+	driver        GraphDriver
+	root          string                   // The parent of the layer id is in <root>/<id>
+	parents       map[string]string        // The layers of the store, and their parent
+	refs          map[string]int           // How many times the layers are retained
+	images        func() ([]string, error) // The layers of the images of the graph
+	lazy          map[string]*lazyLayer    // The layers not materialized yet, their source is in <root>/.lazy/<id>
+	materialize   func(id string, source *lazyLayer) error
+	materializing map[string]*layerFetch // The lazy layers being fetched
+}
+
+// The fetch of a lazy layer, the ones materializing it too wait for done
+type layerFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// The source of a layer pulled lazily, with docker pull -lazy: the blob of
+// its archive in a repository of a registry speaking the v2 protocol
+type lazyLayer struct {
+	Endpoint   string
+	Repository string
+	BlobSum    string
+}
+
+func newLayerStore(root string, driver GraphDriver, images func() ([]string, error)) (*layerStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	store := &layerStore{
+		driver:        driver,
+		root:          root,
+		parents:       make(map[string]string),
+		refs:          make(map[string]int),
+		images:        images,
+		lazy:          make(map[string]*lazyLayer),
+		materializing: make(map[string]*layerFetch),
+	}
+	if err := os.MkdirAll(path.Join(root, ".lazy"), 0700); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name[0] != '.' {
+			parent, err := ioutil.ReadFile(path.Join(root, name))
+			if err != nil {
+				return nil, err
+			}
+			store.parents[name] = string(parent)
+		}
+	}
+	if entries, err = ioutil.ReadDir(path.Join(root, ".lazy")); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name[0] == '.' {
+			continue
+		}
+		// The source of a lazy layer is saved before its record
+		if _, exists := store.parents[name]; !exists {
+			if err := os.Remove(store.lazyPath(name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		jsonData, err := ioutil.ReadFile(store.lazyPath(name))
+		if err != nil {
+			return nil, err
+		}
+		source := &lazyLayer{}
+		if err := json.Unmarshal(jsonData, source); err != nil {
+			return nil, err
+		}
+		store.lazy[name] = source
+	}
+	return store, nil
+}
+
+func (store *layerStore) lazyPath(id string) string {
+	return path.Join(store.root, ".lazy", id)
+}
+
+// Save the parent of the layer id, its layer is part of the store
+func (store *layerStore) record(id, parent string) error {
+	tmp := path.Join(store.root, "."+id)
+	if err := ioutil.WriteFile(tmp, []byte(parent), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(store.root, id)); err != nil {
+		return err
+	}
+	store.parents[id] = parent
+	return nil
+}
+
+// Whether the layer id is part of the store
+func (store *layerStore) Exists(id string) bool {
+	store.Lock()
+	defer store.Unlock()
+	_, exists := store.parents[id]
+	return exists
+}
+
+// Whether the driver has the layer id, false if it was pulled lazily and
+// nothing used it yet. The layers below a materialized one are too.
+func (store *layerStore) Materialized(id string) bool {
+	store.Lock()
+	defer store.Unlock()
+	_, lazy := store.lazy[id]
+	return !lazy
+}
+
+// Forget the source of the layer id, which isn't lazy anymore
+func (store *layerStore) dropLazy(id string) error {
+	if err := os.Remove(store.lazyPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(store.lazy, id)
+	return nil
+}
+
+// Add the layer id the driver has, created without the store (e.g: before
+// it or by the migration of a driver), to the store
+func (store *layerStore) adopt(id, parent string) error {
+	store.Lock()
+	defer store.Unlock()
+	if _, exists := store.parents[id]; exists || !store.driver.Exists(id) {
+		return nil
+	}
+	return store.record(id, parent)
+}
+
+// Create the layer id on top of parent, retained by the caller
+func (store *layerStore) Create(id, parent string) error {
+	return store.create(id, parent, func() error {
+		return store.driver.Create(id, parent)
+	})
+}
+
+// Create the layer id on top of parent with the size limit of a
+// SizedGraphDriver, retained by the caller
+func (store *layerStore) CreateSized(id, parent string, size uint64) error {
+	sized, ok := store.driver.(SizedGraphDriver)
+	if !ok {
+		return fmt.Errorf("Bad parameter: the %s storage driver can't limit the size of the layers", store.driver)
+	}
+	return store.create(id, parent, func() error {
+		return sized.CreateSized(id, parent, size)
+	})
+}
+
+func (store *layerStore) create(id, parent string, create func() error) error {
+	if parent != "" {
+		if err := store.Materialize(parent); err != nil {
+			return err
+		}
+	}
+	store.Lock()
+	// A record without layer is what a garbage collection interrupted left
+	if _, exists := store.parents[id]; exists && (store.refs[id] != 0 || store.driver.Exists(id)) {
+		store.Unlock()
+		return fmt.Errorf("Layer %s already exists", id)
+	}
+	if _, exists := store.parents[parent]; parent != "" && !exists && !store.driver.Exists(parent) {
+		store.Unlock()
+		return fmt.Errorf("No such layer: %s", parent)
+	}
+	// Recorded and retained first, the garbage collection keeps the parent
+	// while the driver creates the layer
+	if err := store.record(id, parent); err != nil {
+		store.Unlock()
+		return err
+	}
+	store.refs[id]++
+	if err := store.dropLazy(id); err != nil {
+		store.Unlock()
+		store.Release(id)
+		return err
+	}
+	store.Unlock()
+	if err := create(); err != nil {
+		store.Release(id)
+		return err
+	}
+	return nil
+}
+
+// Add the layer id on top of parent to the store without materializing it,
+// retained by the caller. It's fetched from source when it's materialized.
+func (store *layerStore) CreateLazy(id, parent string, source *lazyLayer) error {
+	store.Lock()
+	defer store.Unlock()
+	if _, exists := store.parents[id]; exists && (store.refs[id] != 0 || store.driver.Exists(id) || store.lazy[id] != nil) {
+		return fmt.Errorf("Layer %s already exists", id)
+	}
+	if _, exists := store.parents[parent]; parent != "" && !exists && !store.driver.Exists(parent) {
+		return fmt.Errorf("No such layer: %s", parent)
+	}
+	jsonData, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(store.root, ".lazy", "."+id)
+	if err := ioutil.WriteFile(tmp, jsonData, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, store.lazyPath(id)); err != nil {
+		return err
+	}
+	if err := store.record(id, parent); err != nil {
+		return err
+	}
+	store.lazy[id] = source
+	store.refs[id]++
+	return nil
+}
+
+// Materialize the layer id and the lazy ones below it, from the bottom one:
+// the driver creates each of them and materialize stores its archive. A
+// layer another call is already fetching is waited for, no lock is held
+// while the layers are fetched.
+func (store *layerStore) Materialize(id string) error {
+	store.Lock()
+	var pending []string
+	for layer := id; store.lazy[layer] != nil; layer = store.parents[layer] {
+		pending = append([]string{layer}, pending...)
+	}
+	if len(pending) == 0 {
+		store.Unlock()
+		return nil
+	}
+	// Retained, the garbage collection keeps the layers while they are
+	// fetched
+	store.refs[id]++
+	store.Unlock()
+	defer store.Release(id)
+	for _, layer := range pending {
+		store.Lock()
+		if store.lazy[layer] == nil {
+			store.Unlock()
+			continue
+		}
+		if fetch := store.materializing[layer]; fetch != nil {
+			store.Unlock()
+			<-fetch.done
+			if fetch.err != nil {
+				return fetch.err
+			}
+			continue
+		}
+		fetch := &layerFetch{done: make(chan struct{})}
+		store.materializing[layer] = fetch
+		parent, source := store.parents[layer], store.lazy[layer]
+		store.Unlock()
+
+		fetch.err = store.fetchLayer(layer, parent, source)
+		store.Lock()
+		if fetch.err == nil {
+			fetch.err = store.dropLazy(layer)
+		}
+		delete(store.materializing, layer)
+		store.Unlock()
+		close(fetch.done)
+		if fetch.err != nil {
+			return fetch.err
+		}
+	}
+	return nil
+}
+
+// Create the lazy layer id on top of parent with the driver, and store the
+// archive fetched from source in it
+func (store *layerStore) fetchLayer(id, parent string, source *lazyLayer) error {
+	// What an interrupted materialization left is removed
+	if store.driver.Exists(id) {
+		if err := store.driver.Remove(id); err != nil {
+			return err
+		}
+	}
+	if store.materialize == nil {
+		return fmt.Errorf("Unable to fetch the layer %s: no registry to fetch it from", utils.TruncateID(id))
+	}
+	if err := store.driver.Create(id, parent); err != nil {
+		return err
+	}
+	if err := store.materialize(id, source); err != nil {
+		store.driver.Remove(id)
+		return fmt.Errorf("Unable to fetch the layer %s: %s", utils.TruncateID(id), err)
+	}
+	return nil
+}
+
+// Retain the layer id, it's kept until it's released
+func (store *layerStore) Retain(id string) error {
+	store.Lock()
+	defer store.Unlock()
+	if _, exists := store.parents[id]; !exists && !store.driver.Exists(id) {
+		return fmt.Errorf("No such layer: %s", id)
+	}
+	store.refs[id]++
+	return nil
+}
+
+// Retain the layer id if it's part of the store and nothing retains it,
+// like the layer of a deleted image kept for its children, and return
+// whether it did
+func (store *layerStore) retainUnused(id string) bool {
+	store.Lock()
+	defer store.Unlock()
+	if _, exists := store.parents[id]; !exists || store.refs[id] != 0 || (!store.driver.Exists(id) && store.lazy[id] == nil) {
+		return false
+	}
+	store.refs[id]++
+	return true
+}
+
+// Release the layer id, which is removed if nothing keeps it anymore
+func (store *layerStore) Release(id string) {
+	store.Lock()
+	store.refs[id]--
+	unused := store.refs[id] <= 0
+	if unused {
+		delete(store.refs, id)
+	}
+	store.Unlock()
+	if unused {
+		if _, err := store.GC(); err != nil {
+			log.Printf("WARNING: Unable to remove the unused layers: %s", err)
+		}
+	}
+}
+
+// GC removes the layers of the store which nothing keeps: they are neither
+// retained, nor the layer of an image, nor below one of them. It returns the
+// ids of the removed layers.
+func (store *layerStore) GC() ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+	images, err := store.images()
+	if err != nil {
+		return nil, err
+	}
+	// Mark
+	marked := make(map[string]bool)
+	mark := func(id string) {
+		for id != "" && !marked[id] {
+			marked[id] = true
+			id = store.parents[id]
+		}
+	}
+	for _, id := range images {
+		mark(id)
+	}
+	for id := range store.refs {
+		mark(id)
+	}
+	// Sweep, the children before their parent
+	children := make(map[string][]string)
+	for id, parent := range store.parents {
+		if !marked[id] {
+			children[parent] = append(children[parent], id)
+		}
+	}
+	var removed []string
+	var sweep func(id string) error
+	sweep = func(id string) error {
+		for _, child := range children[id] {
+			if err := sweep(child); err != nil {
+				return err
+			}
+		}
+		if store.driver.Exists(id) {
+			if err := store.driver.Remove(id); err != nil {
+				return err
+			}
+		}
+		if err := store.dropLazy(id); err != nil {
+			return err
+		}
+		if err := os.Remove(path.Join(store.root, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(store.parents, id)
+		removed = append(removed, id)
+		return nil
+	}
+	for id, parent := range store.parents {
+		if _, exists := store.parents[parent]; !marked[id] && (parent == "" || !exists || marked[parent]) {
+			if err := sweep(id); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,413 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The log driver of the containers which don't set one
+const defaultLogDriver = "json-file"
+
+// The longest line a log driver gets, the longer ones are split
+const logLineMax = 16 * 1024
+
+// LogConfig is the log driver of a container, and its options
+type LogConfig struct {
+	Type   string // json-file if empty
+	Config map[string]string
+}
+
+// LogMessage is a line the process of a container wrote
+type LogMessage struct {
+	Line      []byte // Without the line feed
+	Source    string // stdout or stderr, stdout for the tty
+	Timestamp time.Time
+	Partial   bool // The line had no line feed: it was split, or the output ended
+}
+
+// A LogDriver sends the output of the process of a container somewhere. It
+// gets the lines of stdout and of stderr concurrently.
+type LogDriver interface {
+	Log(msg *LogMessage) error
+	Close() error
+}
+
+type logDriverType struct {
+	new      func(container *Container, options map[string]string) (LogDriver, error)
+	options  []string                      // The options the driver takes
+	validate func(map[string]string) error // Check the values of the options, if set
+	readable bool                          // Whether docker logs can read the logs back
+}
+
+// The log drivers, by name
+var logDrivers = map[string]*logDriverType{
+	"json-file": {new: newJSONFileLogDriver, options: []string{"max-size", "max-file"}, validate: validateJSONFileOptions, readable: true},
+	"syslog":    {new: newSyslogLogDriver, options: syslogOptionNames, validate: validateSyslogOptions},
+	"gelf":      {new: newGelfLogDriver, options: gelfOptionNames, validate: validateGelfOptions},
+	"none":      {new: newNoneLogDriver},
+}
+
+func validateLogConfig(config LogConfig) error {
+	name := config.Type
+	if name == "" {
+		name = defaultLogDriver
+	}
+	driver, exists := logDrivers[name]
+	if !exists {
+		names := make([]string, 0, len(logDrivers))
+		for name := range logDrivers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Bad parameter: invalid log driver %s (%s)", config.Type, strings.Join(names, ", "))
+	}
+	for option := range config.Config {
+		valid := false
+		for _, name := range driver.options {
+			if option == name {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Bad parameter: the %s log driver has no option %s", name, option)
+		}
+	}
+	if driver.validate != nil {
+		return driver.validate(config.Config)
+	}
+	return nil
+}
+
+// The tag of the messages of the log drivers which have one, unless the tag
+// option sets it
+const defaultLogTag = "{{.ID}}"
+
+// The fields of the template of the tag option
+type logTagData struct {
+	ID        string // The short ID of the container
+	FullID    string
+	Name      string // The host name of the container
+	ImageID   string
+	ImageName string // The name the image of the container is tagged with, or its short ID
+}
+
+func newLogTagData(container *Container) *logTagData {
+	data := &logTagData{
+		ID:        container.ShortID(),
+		FullID:    container.ID,
+		ImageID:   container.Image,
+		ImageName: utils.TruncateID(container.Image),
+	}
+	if container.Config != nil {
+		data.Name = container.Config.Hostname
+	}
+	if container.runtime != nil {
+		data.ImageName = container.runtime.repositories.ImageName(container.Image)
+	}
+	return data
+}
+
+func parseLogTag(tag string) (*template.Template, error) {
+	if tag == "" {
+		tag = defaultLogTag
+	}
+	tmpl, err := template.New("tag").Parse(tag)
+	if err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid tag %s: %s", tag, err)
+	}
+	if _, err := expandLogTag(tmpl, &logTagData{}); err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid tag %s: %s", tag, err)
+	}
+	return tmpl, nil
+}
+
+func expandLogTag(tmpl *template.Template, data *logTagData) (string, error) {
+	tag := &bytes.Buffer{}
+	if err := tmpl.Execute(tag, data); err != nil {
+		return "", err
+	}
+	return tag.String(), nil
+}
+
+// Parse the key=value options of -log-opt
+func parseLogOptions(options []string) (map[string]string, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]string)
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid log option: %s (key=value)", option)
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	return parsed, nil
+}
+
+func newLogDriver(container *Container, config LogConfig) (LogDriver, error) {
+	if err := validateLogConfig(config); err != nil {
+		return nil, err
+	}
+	if config.Type == "" {
+		config.Type = defaultLogDriver
+	}
+	return logDrivers[config.Type].new(container, config.Config)
+}
+
+// Split what the process of a container writes into the messages of the log
+// driver
+type logWriter struct {
+	driver LogDriver
+	source string
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 && len(w.buf) < logLineMax {
+			break
+		}
+		end, next := i, i+1
+		partial := i < 0 || i > logLineMax
+		if partial {
+			end, next = logLineMax, logLineMax
+		}
+		w.log(w.buf[:end], partial)
+		w.buf = w.buf[next:]
+	}
+	return len(p), nil
+}
+
+// Flush the last line, even without a line feed
+func (w *logWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.log(w.buf, true)
+		w.buf = nil
+	}
+	return nil
+}
+
+// The process mustn't get stuck on the errors of the driver: they are only
+// reported
+func (w *logWriter) log(line []byte, partial bool) {
+	msg := &LogMessage{Line: append([]byte(nil), line...), Source: w.source, Timestamp: time.Now(), Partial: partial}
+	if err := w.driver.Log(msg); err != nil {
+		utils.Debugf("Error logging to the log driver (%s): %s", w.source, err)
+	}
+}
+
+// The json-file driver writes the lines in the json log of the container,
+// which docker logs reads back. With max-size, the log is rotated before it
+// gets bigger: it's renamed <log>.1 (<log>.1 is renamed <log>.2 and so on)
+// and the oldest one beyond max-file is dropped.
+type jsonFileLogDriver struct {
+	sync.Mutex
+	file    *os.File
+	path    string
+	size    int64
+	maxSize int64 // Never rotated if 0
+	maxFile int   // The logs kept, the current one included
+}
+
+func newJSONFileLogDriver(container *Container, options map[string]string) (LogDriver, error) {
+	maxSize, maxFile, err := parseJSONFileOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	driver := &jsonFileLogDriver{path: container.logPath("json"), maxSize: maxSize, maxFile: maxFile}
+	if driver.file, err = os.OpenFile(driver.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	info, err := driver.file.Stat()
+	if err != nil {
+		driver.file.Close()
+		return nil, err
+	}
+	driver.size = info.Size()
+	return driver, nil
+}
+
+// max-size is a size in bytes, with the k, m or g suffix; max-file is the
+// number of logs kept, 1 by default
+func parseJSONFileOptions(options map[string]string) (int64, int, error) {
+	var maxSize int64
+	maxFile := 1
+	if value, exists := options["max-size"]; exists {
+		var err error
+		if maxSize, err = parseLogSize(value); err != nil {
+			return 0, 0, err
+		}
+	}
+	if value, exists := options["max-file"]; exists {
+		var err error
+		if maxFile, err = strconv.Atoi(value); err != nil || maxFile < 1 {
+			return 0, 0, fmt.Errorf("Bad parameter: invalid max-file %s", value)
+		}
+		if maxSize == 0 {
+			return 0, 0, fmt.Errorf("Bad parameter: max-file requires max-size")
+		}
+	}
+	return maxSize, maxFile, nil
+}
+
+func validateJSONFileOptions(options map[string]string) error {
+	_, _, err := parseJSONFileOptions(options)
+	return err
+}
+
+// Parse a size like 512k, 10m or 1g (the multiples of 1024) into bytes
+func parseLogSize(size string) (int64, error) {
+	number := strings.ToLower(size)
+	multiplier := int64(1)
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'k':
+			multiplier = 1024
+		case 'm':
+			multiplier = 1024 * 1024
+		case 'g':
+			multiplier = 1024 * 1024 * 1024
+		}
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("Bad parameter: invalid max-size %s", size)
+	}
+	return value * multiplier, nil
+}
+
+func rotatedLogPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// The lines are written as the process wrote them: docker logs joins the
+// partial ones with the next one
+func (driver *jsonFileLogDriver) Log(msg *LogMessage) error {
+	line := string(msg.Line)
+	if !msg.Partial {
+		line += "\n"
+	}
+	b, err := json.Marshal(&utils.JSONLog{Log: line, Stream: msg.Source, Created: msg.Timestamp})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	driver.Lock()
+	defer driver.Unlock()
+	if driver.maxSize > 0 && driver.size > 0 && driver.size+int64(len(b)) > driver.maxSize {
+		if err := driver.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := driver.file.Write(b)
+	driver.size += int64(n)
+	return err
+}
+
+// Rotate the log, without a moment when it doesn't exist: the log is kept
+// as <log>.1 with a hard link, then replaced by an empty one.
+func (driver *jsonFileLogDriver) rotate() error {
+	if driver.maxFile > 1 {
+		for i := driver.maxFile - 1; i > 1; i-- {
+			if err := os.Rename(rotatedLogPath(driver.path, i-1), rotatedLogPath(driver.path, i)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Remove(rotatedLogPath(driver.path, 1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(driver.path, rotatedLogPath(driver.path, 1)); err != nil {
+			return err
+		}
+	}
+	tmp := driver.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, driver.path); err != nil {
+		file.Close()
+		return err
+	}
+	if err := driver.file.Close(); err != nil {
+		utils.Debugf("Error closing the rotated log %s: %s", driver.path, err)
+	}
+	driver.file = file
+	driver.size = 0
+	return nil
+}
+
+func (driver *jsonFileLogDriver) Close() error {
+	driver.Lock()
+	defer driver.Unlock()
+	return driver.file.Close()
+}
+
+// A log read after its rotated logs, the oldest first
+type rotatedLogReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func openRotatedLog(path string) (io.ReadCloser, error) {
+	var files []*os.File
+	for i := 1; ; i++ {
+		file, err := os.Open(rotatedLogPath(path, i))
+		if err != nil {
+			break
+		}
+		files = append([]*os.File{file}, files...)
+	}
+	current, err := os.Open(path)
+	if err != nil {
+		for _, file := range files {
+			file.Close()
+		}
+		return nil, err
+	}
+	files = append(files, current)
+	readers := make([]io.Reader, len(files))
+	for i, file := range files {
+		readers[i] = file
+	}
+	return &rotatedLogReader{Reader: io.MultiReader(readers...), files: files}, nil
+}
+
+func (r *rotatedLogReader) Close() error {
+	for _, file := range r.files {
+		file.Close()
+	}
+	return nil
+}
+
+// The none driver discards the output
+type noneLogDriver struct{}
+
+func newNoneLogDriver(container *Container, options map[string]string) (LogDriver, error) {
+	return &noneLogDriver{}, nil
+}
+
+func (*noneLogDriver) Log(msg *LogMessage) error {
+	return nil
+}
+
+func (*noneLogDriver) Close() error {
+	return nil
+}
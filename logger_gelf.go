@@ -0,0 +1,209 @@
+package docker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The options of the gelf log driver:
+// - gelf-address: udp://host:port of the Graylog server (or of any GELF
+//   input), required
+// - gelf-compression-type: gzip (the default), zlib or none
+// - env: the comma separated variables of the environment of the container
+//   to add to the messages
+// - tag: a template of the _tag field of the messages, with the fields of
+//   logTagData, {{.ID}} by default
+var gelfOptionNames = []string{"gelf-address", "gelf-compression-type", "env", "tag"}
+
+const (
+	gelfChunkSize   = 1420 // Bytes of message in a UDP datagram, small enough for the WAN
+	gelfChunksMax   = 128  // Chunks of a message at most, as GELF says
+	gelfChunkHeader = 12   // The magic bytes, the ID of the message, the index and the count of the chunk
+)
+
+type gelfOptions struct {
+	address     string
+	compression string
+	env         []string
+	tag         string
+}
+
+func parseGelfOptions(options map[string]string) (*gelfOptions, error) {
+	parsed := &gelfOptions{compression: "gzip", tag: options["tag"]}
+	address := options["gelf-address"]
+	if !strings.HasPrefix(address, "udp://") {
+		return nil, fmt.Errorf("Bad parameter: the gelf log driver requires a gelf-address udp://host:port")
+	}
+	parsed.address = strings.TrimPrefix(address, "udp://")
+	if _, _, err := net.SplitHostPort(parsed.address); err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid gelf-address %s (udp://host:port)", address)
+	}
+	if value, exists := options["gelf-compression-type"]; exists {
+		switch value {
+		case "gzip", "zlib", "none":
+			parsed.compression = value
+		default:
+			return nil, fmt.Errorf("Bad parameter: invalid gelf-compression-type %s (gzip, zlib or none)", value)
+		}
+	}
+	if value := options["env"]; value != "" {
+		parsed.env = strings.Split(value, ",")
+	}
+	if _, err := parseLogTag(parsed.tag); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+func validateGelfOptions(options map[string]string) error {
+	_, err := parseGelfOptions(options)
+	return err
+}
+
+// The gelf driver sends each line as a GELF message, with the container it
+// comes from in its additional fields, so it can be searched for in Graylog
+// (or the Elasticsearch behind it) as is.
+type gelfLogDriver struct {
+	conn        net.Conn
+	compression string
+	hostname    string
+	fields      map[string]interface{} // The additional fields, the same for all the messages
+}
+
+func newGelfLogDriver(container *Container, options map[string]string) (LogDriver, error) {
+	parsed, err := parseGelfOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := parseLogTag(parsed.tag)
+	if err != nil {
+		return nil, err
+	}
+	data := newLogTagData(container)
+	tag, err := expandLogTag(tmpl, data)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{
+		"_container_id":   container.ID,
+		"_container_name": data.Name,
+		"_image_id":       data.ImageID,
+		"_image_name":     data.ImageName,
+		"_command":        strings.Join(append([]string{container.Path}, container.Args...), " "),
+		"_created":        container.Created.Format(time.RFC3339Nano),
+		"_tag":            tag,
+	}
+	if container.Config != nil {
+		for _, name := range parsed.env {
+			for _, env := range container.Config.Env {
+				if parts := strings.SplitN(env, "=", 2); len(parts) == 2 && parts[0] == name {
+					fields["_"+name] = parts[1]
+				}
+			}
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", parsed.address)
+	if err != nil {
+		return nil, err
+	}
+	return &gelfLogDriver{conn: conn, compression: parsed.compression, hostname: hostname, fields: fields}, nil
+}
+
+// The GELF message of a line, the severity being info for stdout and err
+// for stderr, like syslog
+func (driver *gelfLogDriver) message(msg *LogMessage) ([]byte, error) {
+	level := 6
+	if msg.Source == "stderr" {
+		level = 3
+	}
+	message := map[string]interface{}{
+		"version":       "1.1",
+		"host":          driver.hostname,
+		"short_message": string(msg.Line),
+		"timestamp":     float64(msg.Timestamp.UnixNano()) / 1e9,
+		"level":         level,
+		"_source":       msg.Source,
+	}
+	for name, value := range driver.fields {
+		message[name] = value
+	}
+	b, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	if driver.compression == "none" {
+		return b, nil
+	}
+	compressed := &bytes.Buffer{}
+	var w io.WriteCloser
+	if driver.compression == "zlib" {
+		w = zlib.NewWriter(compressed)
+	} else {
+		w = gzip.NewWriter(compressed)
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func (driver *gelfLogDriver) Log(msg *LogMessage) error {
+	b, err := driver.message(msg)
+	if err != nil {
+		return err
+	}
+	if len(b) <= gelfChunkSize {
+		_, err := driver.conn.Write(b)
+		return err
+	}
+	return driver.writeChunks(b)
+}
+
+// The messages bigger than a datagram are split in chunks, each one with the
+// random ID of the message, its index and the number of chunks
+func (driver *gelfLogDriver) writeChunks(b []byte) error {
+	count := (len(b) + gelfChunkSize - 1) / gelfChunkSize
+	if count > gelfChunksMax {
+		return fmt.Errorf("The GELF message is too big: %d bytes", len(b))
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	chunk := make([]byte, 0, gelfChunkHeader+gelfChunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * gelfChunkSize
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk = append(chunk[:0], 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, b[i*gelfChunkSize:end]...)
+		if _, err := driver.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (driver *gelfLogDriver) Close() error {
+	return driver.conn.Close()
+}
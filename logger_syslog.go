@@ -0,0 +1,265 @@
+package docker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The options of the syslog log driver:
+// - syslog-address: proto://address of the syslog server, with proto udp,
+//   tcp, tcp+tls, unix or unixgram (e.g. tcp+tls://10.0.0.1:6514), the local
+//   one by default
+// - syslog-facility: daemon by default
+// - syslog-tls-ca-cert, syslog-tls-cert, syslog-tls-key: the CA the certificate
+//   of the server is checked with (the ones of the host by default), and the
+//   certificate and key of the client, for tcp+tls
+// - syslog-tls-skip-verify: don't check the certificate of the server
+// - tag: a template of the tag of the messages, with the fields of
+//   logTagData, {{.ID}} by default
+var syslogOptionNames = []string{
+	"syslog-address", "syslog-facility",
+	"syslog-tls-ca-cert", "syslog-tls-cert", "syslog-tls-key", "syslog-tls-skip-verify",
+	"tag",
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+type syslogOptions struct {
+	network  string // Empty for the local syslog
+	address  string
+	facility syslog.Priority
+	tag      *template.Template
+
+	caCert, cert, key string
+	skipVerify        bool
+}
+
+func parseSyslogOptions(options map[string]string) (*syslogOptions, error) {
+	parsed := &syslogOptions{facility: syslog.LOG_DAEMON}
+	if value := options["syslog-address"]; value != "" {
+		parts := strings.SplitN(value, "://", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Bad parameter: invalid syslog-address %s (proto://address)", value)
+		}
+		switch parts[0] {
+		case "udp", "tcp", "tcp+tls":
+			if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+				return nil, fmt.Errorf("Bad parameter: invalid syslog-address %s (host:port)", value)
+			}
+		case "unix", "unixgram":
+		default:
+			return nil, fmt.Errorf("Bad parameter: invalid syslog-address %s (udp, tcp, tcp+tls, unix or unixgram)", value)
+		}
+		parsed.network, parsed.address = parts[0], parts[1]
+	}
+	if value := options["syslog-facility"]; value != "" {
+		var exists bool
+		if parsed.facility, exists = syslogFacilities[value]; !exists {
+			return nil, fmt.Errorf("Bad parameter: invalid syslog-facility %s", value)
+		}
+	}
+
+	parsed.caCert, parsed.cert, parsed.key = options["syslog-tls-ca-cert"], options["syslog-tls-cert"], options["syslog-tls-key"]
+	if value, exists := options["syslog-tls-skip-verify"]; exists {
+		var err error
+		if parsed.skipVerify, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("Bad parameter: invalid syslog-tls-skip-verify %s", value)
+		}
+	}
+	if parsed.network != "tcp+tls" && (parsed.caCert != "" || parsed.cert != "" || parsed.key != "" || parsed.skipVerify) {
+		return nil, fmt.Errorf("Bad parameter: the syslog-tls options require a tcp+tls syslog-address")
+	}
+	if (parsed.cert == "") != (parsed.key == "") {
+		return nil, fmt.Errorf("Bad parameter: syslog-tls-cert and syslog-tls-key go together")
+	}
+
+	var err error
+	if parsed.tag, err = parseLogTag(options["tag"]); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+func validateSyslogOptions(options map[string]string) error {
+	_, err := parseSyslogOptions(options)
+	return err
+}
+
+func (options *syslogOptions) tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(options.address)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: options.skipVerify}
+	if options.caCert != "" {
+		pem, err := ioutil.ReadFile(options.caCert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Invalid syslog-tls-ca-cert %s: no certificate", options.caCert)
+		}
+	}
+	if options.cert != "" {
+		cert, err := tls.LoadX509KeyPair(options.cert, options.key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// The writers of the syslog driver: log/syslog, or the one with TLS
+type syslogWriter interface {
+	Info(m string) error
+	Err(m string) error
+	Close() error
+}
+
+// The syslog driver sends the lines of stdout with the info severity, the
+// ones of stderr with the err severity
+type syslogLogDriver struct {
+	writer syslogWriter
+}
+
+func newSyslogLogDriver(container *Container, options map[string]string) (LogDriver, error) {
+	parsed, err := parseSyslogOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := expandLogTag(parsed.tag, newLogTagData(container))
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.network == "tcp+tls" {
+		config, err := parsed.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		writer := &tlsSyslogWriter{address: parsed.address, config: config, facility: parsed.facility, tag: tag}
+		// Fail right away if the server can't be reached: the container
+		// would run without its logs
+		if err := writer.connect(); err != nil {
+			return nil, err
+		}
+		return &syslogLogDriver{writer: writer}, nil
+	}
+	writer, err := syslog.Dial(parsed.network, parsed.address, parsed.facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogLogDriver{writer: writer}, nil
+}
+
+func (driver *syslogLogDriver) Log(msg *LogMessage) error {
+	if msg.Source == "stderr" {
+		return driver.writer.Err(string(msg.Line))
+	}
+	return driver.writer.Info(string(msg.Line))
+}
+
+func (driver *syslogLogDriver) Close() error {
+	return driver.writer.Close()
+}
+
+// log/syslog has no TLS: the messages are formatted as RFC 5424 says and
+// sent with their length first (RFC 5425). The connection is opened again
+// if it breaks.
+type tlsSyslogWriter struct {
+	sync.Mutex
+	address  string
+	config   *tls.Config
+	facility syslog.Priority
+	tag      string
+	conn     *tls.Conn
+}
+
+func (w *tlsSyslogWriter) connect() error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", w.address, w.config)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+func (w *tlsSyslogWriter) Info(m string) error {
+	return w.write(syslog.LOG_INFO, m)
+}
+
+func (w *tlsSyslogWriter) Err(m string) error {
+	return w.write(syslog.LOG_ERR, m)
+}
+
+func (w *tlsSyslogWriter) write(severity syslog.Priority, m string) error {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", w.facility|severity, time.Now().Format(time.RFC3339Nano), hostname, w.tag, os.Getpid(), m)
+	frame := fmt.Sprintf("%d %s", len(msg), msg)
+
+	w.Lock()
+	defer w.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if err = w.connect(); err != nil {
+				return err
+			}
+		}
+		if _, err = io.WriteString(w.conn, frame); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *tlsSyslogWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
@@ -0,0 +1,195 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// LogsConfig selects the lines of the logs of a container
+type LogsConfig struct {
+	Stdout     bool
+	Stderr     bool
+	Since      time.Time // The lines written from Since, all of them if zero
+	Until      time.Time // The lines written up to Until, all of them if zero
+	Tail       int       // The last Tail lines of the selection, all of them if negative
+	Timestamps bool      // Prefix the lines with the time they were written, in RFC3339
+}
+
+// Parse a time of the since or until parameters of the logs: a unix
+// timestamp, with fractions of seconds, or a RFC3339 date
+func parseLogsTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*1e9)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad parameter: invalid time %s (a unix timestamp or a RFC3339 date)", value)
+	}
+	return t, nil
+}
+
+// Parse the tail parameter of the logs: the number of lines or all
+func parseLogsTail(value string) (int, error) {
+	if value == "" || value == "all" {
+		return -1, nil
+	}
+	tail, err := strconv.Atoi(value)
+	if err != nil || tail < 0 {
+		return 0, fmt.Errorf("Bad parameter: invalid tail %s (a number of lines or all)", value)
+	}
+	return tail, nil
+}
+
+func (config *LogsConfig) match(l *utils.JSONLog) bool {
+	if (l.Stream == "stdout" && !config.Stdout) || (l.Stream == "stderr" && !config.Stderr) {
+		return false
+	}
+	if !config.Since.IsZero() && l.Created.Before(config.Since) {
+		return false
+	}
+	return config.Until.IsZero() || !l.Created.After(config.Until)
+}
+
+// WriteLogs writes the lines of the json log of the container (and of its
+// rotated logs) config selects. Only the end of the logs is read for the
+// tail.
+func (container *Container) WriteLogs(config *LogsConfig, out io.Writer) error {
+	var lines []*utils.JSONLog
+	if config.Tail < 0 {
+		log, err := container.ReadLog("json")
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer log.Close()
+		dec := json.NewDecoder(log)
+		for {
+			l := &utils.JSONLog{}
+			if err := dec.Decode(l); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("Error reading the logs of %s: %s", container.ID, err)
+			}
+			if !config.match(l) {
+				continue
+			}
+			if err := writeLogLine(out, l, config.Timestamps); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Read the logs backwards, starting with the current one, until the tail
+	// is found or the lines are older than since
+	logPath := container.logPath("json")
+	for i := 0; len(lines) < config.Tail; i++ {
+		name := logPath
+		if i > 0 {
+			name = rotatedLogPath(logPath, i)
+		}
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		done := false
+		err = reverseLines(file, func(line []byte) bool {
+			// The logs of the older versions have no line feed between
+			// the records
+			var records []*utils.JSONLog
+			dec := json.NewDecoder(bytes.NewReader(line))
+			for {
+				l := &utils.JSONLog{}
+				if err := dec.Decode(l); err == io.EOF {
+					break
+				} else if err != nil {
+					utils.Debugf("Invalid line in the logs of %s: %s", container.ID, err)
+					break
+				}
+				records = append(records, l)
+			}
+			for j := len(records) - 1; j >= 0 && len(lines) < config.Tail; j-- {
+				if !config.Since.IsZero() && records[j].Created.Before(config.Since) {
+					done = true
+					return false
+				}
+				if config.match(records[j]) {
+					lines = append(lines, records[j])
+				}
+			}
+			return len(lines) < config.Tail
+		})
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		if err := writeLogLine(out, lines[i], config.Timestamps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeLogLine(out io.Writer, l *utils.JSONLog, timestamps bool) error {
+	if timestamps {
+		_, err := fmt.Fprintf(out, "%s %s", l.Created.Format(time.RFC3339Nano), l.Log)
+		return err
+	}
+	_, err := io.WriteString(out, l.Log)
+	return err
+}
+
+// Call f with the lines of file, the last one first, until it returns false.
+// The file is read by blocks from its end.
+func reverseLines(file *os.File, f func(line []byte) bool) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+	block := make([]byte, 32*1024)
+	var partial []byte // The beginning of the line, the end of which was read
+	for offset > 0 {
+		n := int64(len(block))
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		if _, err := file.ReadAt(block[:n], offset); err != nil {
+			return err
+		}
+		chunk := append(append([]byte(nil), block[:n]...), partial...)
+		for {
+			i := bytes.LastIndexByte(chunk, '\n')
+			if i < 0 {
+				break
+			}
+			if line := chunk[i+1:]; len(line) > 0 && !f(line) {
+				return nil
+			}
+			chunk = chunk[:i]
+		}
+		partial = chunk
+	}
+	if len(partial) > 0 {
+		f(partial)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"strings"
 	"text/template"
 )
 
@@ -11,20 +12,47 @@ lxc.utsname = {{.Config.Hostname}}
 {{else}}
 lxc.utsname = {{.Id}}
 {{end}}
+{{if .AppArmorProfile}}
+lxc.aa_profile = {{.AppArmorProfile}}
+{{else}}
 #lxc.aa_profile = unconfined
+{{end}}
+{{if .ProcessLabel}}
+# the SELinux label of the processes of the container
+lxc.se_context = {{.ProcessLabel}}
+{{end}}
+{{with .IDMappings}}
+# user namespace, root of the container is an unprivileged user of the host
+{{range .Uids}}
+lxc.id_map = u {{.ContainerID}} {{.HostID}} {{.Size}}
+{{end}}
+{{range .Gids}}
+lxc.id_map = g {{.ContainerID}} {{.HostID}} {{.Size}}
+{{end}}
+{{end}}
 
 {{if .Config.NetworkDisabled}}
 # network is disabled (-n=false)
 lxc.network.type = empty
+{{else}}{{with $id := getNetworkContainer .Config}}
+# network namespace of the container {{$id}} (lxc-start --share-net)
 {{else}}
 # network configuration
+{{if .NetworkSettings.MacvlanMode}}
+lxc.network.type = macvlan
+lxc.network.macvlan.mode = {{.NetworkSettings.MacvlanMode}}
+{{else}}
 lxc.network.type = veth
+{{with .NetworkSettings.HostInterface}}
+lxc.network.veth.pair = {{.}}
+{{end}}
+{{end}}
 lxc.network.flags = up
 lxc.network.link = {{.NetworkSettings.Bridge}}
 lxc.network.name = eth0
-lxc.network.mtu = 1500
+lxc.network.mtu = {{getMtu .Config}}
 lxc.network.ipv4 = {{.NetworkSettings.IPAddress}}/{{.NetworkSettings.IPPrefixLen}}
-{{end}}
+{{end}}{{end}}
 
 # root filesystem
 {{$ROOTFS := .RootfsPath}}
@@ -72,6 +100,17 @@ lxc.cgroup.devices.allow = c 10:200 rwm
 
 # rtc
 #lxc.cgroup.devices.allow = c 254:0 rwm
+
+# the devices given with -device
+{{range .Devices}}
+lxc.cgroup.devices.allow = {{.Type}} {{.Major}}:{{.Minor}} {{.Permissions}}
+{{end}}
+{{end}}
+
+{{if .ReadonlyRootfs}}
+# read-only root filesystem: bound on itself read-only, before the other
+# mount points are mounted on it
+lxc.mount.entry = {{$ROOTFS}} {{$ROOTFS}} none bind,ro 0 0
 {{end}}
 
 # standard mount point
@@ -81,13 +120,26 @@ lxc.mount.entry = proc {{$ROOTFS}}/proc proc nosuid,nodev,noexec 0 0
 #  WARNING: sysfs is a known attack vector and should probably be disabled
 #           if your userspace allows it. eg. see http://bit.ly/T9CkqJ
 lxc.mount.entry = sysfs {{$ROOTFS}}/sys sysfs nosuid,nodev,noexec 0 0
+{{if .DevPath}}
+# the /dev of the image with the devices of the container, in a tmpfs
+lxc.mount.entry = {{.DevPath}} {{$ROOTFS}}/dev none bind 0 0
+{{end}}
 lxc.mount.entry = devpts {{$ROOTFS}}/dev/pts devpts newinstance,ptmxmode=0666,nosuid,noexec 0 0
 #lxc.mount.entry = varrun {{$ROOTFS}}/var/run tmpfs mode=755,size=4096k,nosuid,nodev,noexec 0 0
 #lxc.mount.entry = varlock {{$ROOTFS}}/var/lock tmpfs size=1024k,nosuid,nodev,noexec 0 0
+{{if .ShmPath}}
+# the /dev/shm of the IPC namespace the container joins
+lxc.mount.entry = {{.ShmPath}} {{$ROOTFS}}/dev/shm none bind 0 0
+{{else}}
 lxc.mount.entry = shm {{$ROOTFS}}/dev/shm tmpfs size=65536k,nosuid,nodev,noexec 0 0
+{{end}}
 
 # Inject docker-init
 lxc.mount.entry = {{.SysInitPath}} {{$ROOTFS}}/.dockerinit none bind,ro 0 0
+{{if .SeccompProfilePath}}
+# The seccomp profile docker-init applies
+lxc.mount.entry = {{.SeccompProfilePath}} {{$ROOTFS}}/.dockerseccomp none bind,ro 0 0
+{{end}}
 
 # In order to get a working DNS environment, mount bind (ro) the host's /etc/resolv.conf into the container
 lxc.mount.entry = {{.ResolvConfPath}} {{$ROOTFS}}/etc/resolv.conf none bind,ro 0 0
@@ -97,28 +149,69 @@ lxc.mount.entry = {{.ResolvConfPath}} {{$ROOTFS}}/etc/resolv.conf none bind,ro 0
 lxc.mount.entry = {{$realPath}} {{$ROOTFS}}/{{$virtualPath}} none bind,{{ if index $rw $virtualPath }}rw{{else}}ro{{end}} 0 0
 {{end}}
 {{end}}
+{{range $path, $options := .Tmpfs}}
+lxc.mount.entry = tmpfs {{$ROOTFS}}{{$path}} tmpfs {{$options}} 0 0
+{{end}}
+{{range .DeviceMounts}}
+# given by a device plugin
+lxc.mount.entry = {{.Source}} {{$ROOTFS}}{{.Destination}} none bind,ro 0 0
+{{end}}
 
-{{if .Config.Privileged}}
-# retain all capabilities; no lxc.cap.drop line
-{{else}}
-# drop linux capabilities (apply mainly to the user root in the container)
+{{with $capDrop := .DroppedCapabilities}}
+# drop linux capabilities (apply mainly to the user root in the container):
+# the default ones unless privileged, and the ones of -cap-drop but not of
+# -cap-add
 #  (Note: 'lxc.cap.keep' is coming soon and should replace this under the
 #         security principle 'deny all unless explicitly permitted', see
 #         http://sourceforge.net/mailarchive/message.php?msg_id=31054627 )
-lxc.cap.drop = audit_control audit_write mac_admin mac_override mknod setfcap setpcap sys_admin sys_boot sys_module sys_nice sys_pacct sys_rawio sys_resource sys_time sys_tty_config
+lxc.cap.drop = {{join $capDrop " "}}
+{{else}}
+# retain all capabilities; no lxc.cap.drop line
 {{end}}
 
 # limits
 {{if .Config.Memory}}
 lxc.cgroup.memory.limit_in_bytes = {{.Config.Memory}}
+{{if not .Config.MemoryReservation}}
 lxc.cgroup.memory.soft_limit_in_bytes = {{.Config.Memory}}
+{{end}}
 {{with $memSwap := getMemorySwap .Config}}
 lxc.cgroup.memory.memsw.limit_in_bytes = {{$memSwap}}
 {{end}}
 {{end}}
+{{if .Config.MemoryReservation}}
+lxc.cgroup.memory.soft_limit_in_bytes = {{.Config.MemoryReservation}}
+{{end}}
+{{if .Config.KernelMemory}}
+lxc.cgroup.memory.kmem.limit_in_bytes = {{.Config.KernelMemory}}
+{{end}}
+{{with .Config.MemorySwappiness}}
+lxc.cgroup.memory.swappiness = {{.}}
+{{end}}
+{{if .OomKillDisable}}
+lxc.cgroup.memory.oom_control = 1
+{{end}}
 {{if .Config.CpuShares}}
 lxc.cgroup.cpu.shares = {{.Config.CpuShares}}
 {{end}}
+{{if .Config.CpuPeriod}}
+lxc.cgroup.cpu.cfs_period_us = {{.Config.CpuPeriod}}
+{{end}}
+{{if .Config.CpuQuota}}
+lxc.cgroup.cpu.cfs_quota_us = {{.Config.CpuQuota}}
+{{end}}
+{{if .Config.Cpuset}}
+lxc.cgroup.cpuset.cpus = {{.Config.Cpuset}}
+{{end}}
+{{if .Config.CpusetMems}}
+lxc.cgroup.cpuset.mems = {{.Config.CpusetMems}}
+{{end}}
+{{if .BlkioWeight}}
+lxc.cgroup.blkio.weight = {{.BlkioWeight}}
+{{end}}
+{{range .BlkioThrottles}}
+lxc.cgroup.blkio.{{.File}} = {{.Major}}:{{.Minor}} {{.Rate}}
+{{end}}
 `
 
 var LxcTemplateCompiled *template.Template
@@ -129,13 +222,26 @@ func getMemorySwap(config *Config) int64 {
 	if config.MemorySwap < 0 {
 		return 0
 	}
+	if config.MemorySwap > 0 {
+		return config.MemorySwap
+	}
 	return config.Memory * 2
 }
 
+func getMtu(config *Config) int {
+	if config.Mtu == 0 {
+		return 1500
+	}
+	return config.Mtu
+}
+
 func init() {
 	var err error
 	funcMap := template.FuncMap{
-		"getMemorySwap": getMemorySwap,
+		"getMemorySwap":       getMemorySwap,
+		"getMtu":              getMtu,
+		"getNetworkContainer": getNetworkContainer,
+		"join":                strings.Join,
 	}
 	LxcTemplateCompiled, err = template.New("lxc").Funcs(funcMap).Parse(LxcTemplate)
 	if err != nil {
@@ -0,0 +1,194 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The manifest lists created with docker manifest create, kept until they
+// are pushed
+type ManifestListStore struct {
+	path  string
+	Lists map[string]*ManifestList
+}
+
+// A ManifestList is the image repo:tag of a registry made of the images of
+// its repository built for other platforms, it's pushed as the list of
+// their manifests
+type ManifestList struct {
+	Name      string
+	Manifests []*ManifestListEntry
+}
+
+// An image of a manifest list, repo:tag or repo@digest. Its platform is the
+// one of its manifest unless it's annotated.
+type ManifestListEntry struct {
+	Image        string
+	Architecture string `json:",omitempty"`
+	OS           string `json:",omitempty"`
+	Variant      string `json:",omitempty"`
+}
+
+func NewManifestListStore(path string) (*ManifestListStore, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &ManifestListStore{
+		path:  abspath,
+		Lists: make(map[string]*ManifestList),
+	}
+	// Load the json file if it exists, otherwise create it.
+	if err := store.Reload(); os.IsNotExist(err) {
+		if err := store.Save(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *ManifestListStore) Save() error {
+	jsonData, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(store.path, jsonData, 0600)
+}
+
+func (store *ManifestListStore) Reload() error {
+	jsonData, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonData, store)
+}
+
+// Get returns the manifest list name
+func (store *ManifestListStore) Get(name string) (*ManifestList, error) {
+	name, err := normalizeManifestListName(name)
+	if err != nil {
+		return nil, err
+	}
+	list, exists := store.Lists[name]
+	if !exists {
+		return nil, fmt.Errorf("No such manifest list: %s", name)
+	}
+	return list, nil
+}
+
+// Create the manifest list name of the images, or add them to it with amend
+func (store *ManifestListStore) Create(name string, images []string, amend bool) (*ManifestList, error) {
+	name, err := normalizeManifestListName(name)
+	if err != nil {
+		return nil, err
+	}
+	list, exists := store.Lists[name]
+	if exists && !amend {
+		return nil, fmt.Errorf("Conflict: manifest list %s already exists, amend it with -amend", name)
+	} else if !exists {
+		list = &ManifestList{Name: name, Manifests: []*ManifestListEntry{}}
+	}
+	repoName, _ := utils.ParseRepositoryTag(name)
+	for _, image := range images {
+		image, err := normalizeManifestListImage(repoName, image)
+		if err != nil {
+			return nil, err
+		}
+		if list.entry(image) == nil {
+			list.Manifests = append(list.Manifests, &ManifestListEntry{Image: image})
+		}
+	}
+	if len(list.Manifests) == 0 {
+		return nil, fmt.Errorf("Bad parameter: a manifest list needs at least one image")
+	}
+	store.Lists[name] = list
+	return list, store.Save()
+}
+
+// Annotate the image of the manifest list name with the parts of the
+// platform which aren't empty
+func (store *ManifestListStore) Annotate(name, image, arch, os, variant string) error {
+	list, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	repoName, _ := utils.ParseRepositoryTag(list.Name)
+	image, err = normalizeManifestListImage(repoName, image)
+	if err != nil {
+		return err
+	}
+	entry := list.entry(image)
+	if entry == nil {
+		return fmt.Errorf("No such image in the manifest list %s: %s", list.Name, image)
+	}
+	if arch != "" {
+		entry.Architecture = registry.NormalizeArchitecture(arch)
+	}
+	if os != "" {
+		entry.OS = os
+	}
+	if variant != "" {
+		entry.Variant = variant
+	}
+	return store.Save()
+}
+
+// Delete the manifest list name
+func (store *ManifestListStore) Delete(name string) error {
+	list, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	delete(store.Lists, list.Name)
+	return store.Save()
+}
+
+func (list *ManifestList) entry(image string) *ManifestListEntry {
+	for _, entry := range list.Manifests {
+		if entry.Image == image {
+			return entry
+		}
+	}
+	return nil
+}
+
+// The name of a manifest list is repo:tag, latest by default
+func normalizeManifestListName(name string) (string, error) {
+	repoName, tag := utils.ParseRepositoryTag(name)
+	if tag == "" {
+		tag = DEFAULTTAG
+	}
+	if err := validateRepoName(repoName); err != nil {
+		return "", fmt.Errorf("Bad parameter: %s", err)
+	}
+	if err := validateTagName(tag); err != nil {
+		return "", fmt.Errorf("Bad parameter: %s", err)
+	}
+	return repoName + ":" + tag, nil
+}
+
+// The images of a manifest list are repo:tag or repo@digest, in the
+// repository repoName of the list
+func normalizeManifestListImage(repoName, image string) (string, error) {
+	imageRepo, tag := utils.ParseRepositoryTag(image)
+	if imageRepo != repoName {
+		return "", fmt.Errorf("Bad parameter: the image %s isn't in the repository %s of the manifest list", image, repoName)
+	}
+	if utils.IsDigest(tag) {
+		return imageRepo + "@" + tag, nil
+	}
+	if tag == "" {
+		tag = DEFAULTTAG
+	}
+	if err := validateTagName(tag); err != nil {
+		return "", fmt.Errorf("Bad parameter: %s", err)
+	}
+	return imageRepo + ":" + tag, nil
+}
@@ -0,0 +1,65 @@
+package docker
+
+import "fmt"
+
+// The smallest kernel memory limit: the kernel allocates more than that for
+// the first processes of a container
+const minKernelMemory = 4194304
+
+// The memory limits of a config other than Memory (see ContainerCreate):
+// MemorySwap above Memory (or -1 for no swap limit), a MemoryReservation
+// below it, and a MemorySwappiness from 0 to 100
+func validateMemory(config *Config) error {
+	if config.MemorySwap > 0 {
+		if config.Memory == 0 {
+			return fmt.Errorf("Bad parameter: the memory swap limit requires a memory limit")
+		}
+		if config.MemorySwap < config.Memory {
+			return fmt.Errorf("Bad parameter: the memory swap limit %d must be above the memory limit %d", config.MemorySwap, config.Memory)
+		}
+	} else if config.MemorySwap < -1 {
+		return fmt.Errorf("Bad parameter: invalid memory swap limit %d", config.MemorySwap)
+	}
+	if config.MemoryReservation < 0 || (config.Memory > 0 && config.MemoryReservation > config.Memory) {
+		return fmt.Errorf("Bad parameter: the memory reservation %d must be below the memory limit", config.MemoryReservation)
+	}
+	if config.KernelMemory != 0 && config.KernelMemory < minKernelMemory {
+		return fmt.Errorf("Bad parameter: the kernel memory limit must be given in bytes (minimum %d bytes)", minKernelMemory)
+	}
+	if swappiness := config.MemorySwappiness; swappiness != nil && (*swappiness < 0 || *swappiness > 100) {
+		return fmt.Errorf("Bad parameter: invalid memory swappiness %d (0 to 100)", *swappiness)
+	}
+	return nil
+}
+
+// Discard the memory limits of the config the kernel doesn't support, with
+// a warning for each. Memory itself is checked with MemoryLimit.
+func discardMemoryLimits(capabilities *Capabilities, config *Config) []string {
+	var warnings []string
+	if config.MemoryReservation > 0 && !capabilities.MemoryLimit {
+		warnings = append(warnings, "Your kernel does not support memory soft limit capabilities. Reservation discarded.")
+		config.MemoryReservation = 0
+	}
+	if config.MemorySwap > 0 && !capabilities.SwapLimit {
+		warnings = append(warnings, "Your kernel does not support swap limit capabilities. Memory swap limit discarded.")
+		config.MemorySwap = -1
+	}
+	if config.KernelMemory > 0 && !capabilities.KernelMemory {
+		warnings = append(warnings, "Your kernel does not support kernel memory limit capabilities. Limitation discarded.")
+		config.KernelMemory = 0
+	}
+	if config.MemorySwappiness != nil && !capabilities.MemorySwappiness {
+		warnings = append(warnings, "Your kernel does not support memory swappiness capabilities. Swappiness discarded.")
+		config.MemorySwappiness = nil
+	}
+	return warnings
+}
+
+// The -oom-score-adj of a host config, as /proc/PID/oom_score_adj takes it:
+// -1000 (never killed) to 1000 (killed first)
+func validateOomScoreAdj(adj int) error {
+	if adj < -1000 || adj > 1000 {
+		return fmt.Errorf("Bad parameter: invalid OOM score adjustment %d (-1000 to 1000)", adj)
+	}
+	return nil
+}
@@ -11,10 +11,20 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var NetworkBridgeIface string
 
+// When false, the published ports are only handled by iptables (including the
+// traffic from the containers to the published ports of the host, a.k.a
+// hairpin NAT) and no userland proxy is started.
+var UserlandProxy = true
+
+// Default policy of the bridge networks: when false, the containers of a
+// bridge can only reach each other when their ingress policies allow it.
+var InterContainerCommunication = true
+
 const (
 	DefaultNetworkBridge = "docker0"
 	DisableNetworkBridge = "none"
@@ -165,6 +175,34 @@ func CreateBridgeIface(ifaceName string) error {
 	if ifaceAddr == "" {
 		return fmt.Errorf("Could not find a free IP address range for interface '%s'. Please configure its address manually and run 'docker -b %s'", ifaceName, ifaceName)
 	}
+	return createBridgeIface(ifaceName, ifaceAddr)
+}
+
+// CreateBridgeIfaceWithSubnet creates the bridge `ifaceName` on the given subnet (e.g: 10.5.0.0/24).
+// The bridge gets the first address of the subnet, unless one is given (e.g: 10.5.0.254/24).
+func CreateBridgeIfaceWithSubnet(ifaceName, subnet string) error {
+	gateway, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return fmt.Errorf("Invalid subnet %s: %s", subnet, err)
+	}
+	if gateway.To4() == nil {
+		return fmt.Errorf("Invalid subnet %s: only IPv4 is supported", subnet)
+	}
+	if gateway.Equal(network.IP) {
+		gateway = intToIP(ipToInt(network.IP) + 1)
+	}
+	routes, err := ip("route")
+	if err != nil {
+		return err
+	}
+	if err := checkRouteOverlaps(routes, network); err != nil {
+		return err
+	}
+	ifaceAddr := (&net.IPNet{IP: gateway, Mask: network.Mask}).String()
+	return createBridgeIface(ifaceName, ifaceAddr)
+}
+
+func createBridgeIface(ifaceName, ifaceAddr string) error {
 	utils.Debugf("Creating bridge %s with network %s", ifaceName, ifaceAddr)
 
 	if output, err := ip("link", "add", ifaceName, "type", "bridge"); err != nil {
@@ -177,9 +215,18 @@ func CreateBridgeIface(ifaceName string) error {
 	if output, err := ip("link", "set", ifaceName, "up"); err != nil {
 		return fmt.Errorf("Unable to start network bridge: %s (%s)", err, output)
 	}
-	if err := iptables("-t", "nat", "-A", "POSTROUTING", "-s", ifaceAddr,
-		"!", "-d", ifaceAddr, "-j", "MASQUERADE"); err != nil {
-		return fmt.Errorf("Unable to enable network bridge NAT: %s", err)
+	return nil
+}
+
+// DeleteBridgeIface removes a bridge created by CreateBridgeIface, its NAT rule
+// is removed by its NetworkManager.
+func DeleteBridgeIface(ifaceName string) error {
+	utils.Debugf("Deleting bridge %s", ifaceName)
+	if output, err := ip("link", "set", ifaceName, "down"); err != nil {
+		return fmt.Errorf("Unable to stop network bridge: %s (%s)", err, output)
+	}
+	if output, err := ip("link", "del", ifaceName); err != nil {
+		return fmt.Errorf("Error deleting bridge: %s (output: %s)", err, output)
 	}
 	return nil
 }
@@ -212,73 +259,97 @@ func getIfaceAddr(name string) (net.Addr, error) {
 }
 
 // Port mapper takes care of mapping external ports to containers by setting
-// up iptables rules.
+// up firewall rules.
 // It keeps track of all mappings and is able to unmap at will
 type PortMapper struct {
-	tcpMapping map[int]*net.TCPAddr
-	tcpProxies map[int]Proxy
-	udpMapping map[int]*net.UDPAddr
-	udpProxies map[int]Proxy
+	tcpMapping  map[int]*net.TCPAddr
+	tcpProxies  map[int]Proxy
+	udpMapping  map[int]*net.UDPAddr
+	udpProxies  map[int]Proxy
+	sctpMapping map[int]*SCTPAddr
+	sctpProxies map[int]Proxy
+
+	// tcp ports for which a DNAT rule is set
+	tcpForwarded map[int]bool
 }
 
 func (mapper *PortMapper) cleanup() error {
-	// Ignore errors - This could mean the chains were never set up
-	iptables("-t", "nat", "-D", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "DOCKER")
-	iptables("-t", "nat", "-D", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "!", "--dst", "127.0.0.0/8", "-j", "DOCKER")
-	iptables("-t", "nat", "-D", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "DOCKER") // Created in versions <= 0.1.6
-	// Also cleanup rules created by older versions, or -X might fail.
-	iptables("-t", "nat", "-D", "PREROUTING", "-j", "DOCKER")
-	iptables("-t", "nat", "-D", "OUTPUT", "-j", "DOCKER")
-	iptables("-t", "nat", "-F", "DOCKER")
-	iptables("-t", "nat", "-X", "DOCKER")
 	mapper.tcpMapping = make(map[int]*net.TCPAddr)
 	mapper.tcpProxies = make(map[int]Proxy)
+	mapper.tcpForwarded = make(map[int]bool)
 	mapper.udpMapping = make(map[int]*net.UDPAddr)
 	mapper.udpProxies = make(map[int]Proxy)
+	mapper.sctpMapping = make(map[int]*SCTPAddr)
+	mapper.sctpProxies = make(map[int]Proxy)
 	return nil
 }
 
 func (mapper *PortMapper) setup() error {
-	if err := iptables("-t", "nat", "-N", "DOCKER"); err != nil {
-		return fmt.Errorf("Failed to create DOCKER chain: %s", err)
+	if firewall == nil {
+		return initFirewall()
 	}
-	if err := iptables("-t", "nat", "-A", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "DOCKER"); err != nil {
-		return fmt.Errorf("Failed to inject docker in PREROUTING chain: %s", err)
-	}
-	if err := iptables("-t", "nat", "-A", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "!", "--dst", "127.0.0.0/8", "-j", "DOCKER"); err != nil {
-		return fmt.Errorf("Failed to inject docker in OUTPUT chain: %s", err)
-	}
-	return nil
+	return firewall.Setup()
 }
 
-func (mapper *PortMapper) iptablesForward(rule string, port int, proto string, dest_addr string, dest_port int) error {
-	return iptables("-t", "nat", rule, "DOCKER", "-p", proto, "--dport", strconv.Itoa(port),
-		"!", "-i", NetworkBridgeIface,
-		"-j", "DNAT", "--to-destination", net.JoinHostPort(dest_addr, strconv.Itoa(dest_port)))
-}
-
-func (mapper *PortMapper) Map(port int, backendAddr net.Addr) error {
-	if _, isTCP := backendAddr.(*net.TCPAddr); isTCP {
+// Map port to backendAddr; limits are enforced by the userland proxy and are
+// only supported for tcp.
+func (mapper *PortMapper) Map(port int, backendAddr net.Addr, limits ProxyLimits) error {
+	switch backendAddr.(type) {
+	case *net.TCPAddr:
 		backendPort := backendAddr.(*net.TCPAddr).Port
 		backendIP := backendAddr.(*net.TCPAddr).IP
-		if err := mapper.iptablesForward("-A", port, "tcp", backendIP.String(), backendPort); err != nil {
-			return err
+		// The PROXY protocol header is sent and the limits are enforced
+		// by the userland proxy, so all the traffic must go through it:
+		needsProxy := ProxyProtocolVersion != 0 || !limits.Unlimited()
+		if needsProxy && !UserlandProxy {
+			return fmt.Errorf("The PROXY protocol and the port limits require the userland proxy")
+		}
+		if !needsProxy {
+			if err := firewall.Forward(true, "tcp", port, backendIP.String(), backendPort); err != nil {
+				return err
+			}
+			mapper.tcpForwarded[port] = true
 		}
 		mapper.tcpMapping[port] = backendAddr.(*net.TCPAddr)
-		proxy, err := NewProxy(&net.TCPAddr{IP: net.IPv4(0, 0, 0, 0), Port: port}, backendAddr)
+		if !UserlandProxy {
+			break
+		}
+		// iptables only takes care of IPv4, let the proxy serve IPv6 clients as well:
+		proxy, err := NewDualStackProxy(&net.TCPAddr{IP: net.IPv6unspecified, Port: port}, backendAddr)
 		if err != nil {
 			mapper.Unmap(port, "tcp")
 			return err
 		}
+		proxy.(*TCPProxy).ProxyLimits = limits
 		mapper.tcpProxies[port] = proxy
 		go proxy.Run()
-	} else {
+	case *SCTPAddr:
+		backendPort := backendAddr.(*SCTPAddr).Port
+		backendIP := backendAddr.(*SCTPAddr).IP
+		if err := firewall.Forward(true, "sctp", port, backendIP.String(), backendPort); err != nil {
+			return err
+		}
+		mapper.sctpMapping[port] = backendAddr.(*SCTPAddr)
+		if !UserlandProxy {
+			break
+		}
+		proxy, err := NewProxy(&SCTPAddr{IP: net.IPv4(0, 0, 0, 0), Port: port}, backendAddr)
+		if err != nil {
+			mapper.Unmap(port, "sctp")
+			return err
+		}
+		mapper.sctpProxies[port] = proxy
+		go proxy.Run()
+	default:
 		backendPort := backendAddr.(*net.UDPAddr).Port
 		backendIP := backendAddr.(*net.UDPAddr).IP
-		if err := mapper.iptablesForward("-A", port, "udp", backendIP.String(), backendPort); err != nil {
+		if err := firewall.Forward(true, "udp", port, backendIP.String(), backendPort); err != nil {
 			return err
 		}
 		mapper.udpMapping[port] = backendAddr.(*net.UDPAddr)
+		if !UserlandProxy {
+			break
+		}
 		proxy, err := NewProxy(&net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: port}, backendAddr)
 		if err != nil {
 			mapper.Unmap(port, "udp")
@@ -291,7 +362,8 @@ func (mapper *PortMapper) Map(port int, backendAddr net.Addr) error {
 }
 
 func (mapper *PortMapper) Unmap(port int, proto string) error {
-	if proto == "tcp" {
+	switch proto {
+	case "tcp":
 		backendAddr, ok := mapper.tcpMapping[port]
 		if !ok {
 			return fmt.Errorf("Port tcp/%v is not mapped", port)
@@ -300,11 +372,27 @@ func (mapper *PortMapper) Unmap(port int, proto string) error {
 			proxy.Close()
 			delete(mapper.tcpProxies, port)
 		}
-		if err := mapper.iptablesForward("-D", port, proto, backendAddr.IP.String(), backendAddr.Port); err != nil {
-			return err
+		if mapper.tcpForwarded[port] {
+			if err := firewall.Forward(false, proto, port, backendAddr.IP.String(), backendAddr.Port); err != nil {
+				return err
+			}
+			delete(mapper.tcpForwarded, port)
 		}
 		delete(mapper.tcpMapping, port)
-	} else {
+	case "sctp":
+		backendAddr, ok := mapper.sctpMapping[port]
+		if !ok {
+			return fmt.Errorf("Port sctp/%v is not mapped", port)
+		}
+		if proxy, exists := mapper.sctpProxies[port]; exists {
+			proxy.Close()
+			delete(mapper.sctpProxies, port)
+		}
+		if err := firewall.Forward(false, proto, port, backendAddr.IP.String(), backendAddr.Port); err != nil {
+			return err
+		}
+		delete(mapper.sctpMapping, port)
+	default:
 		backendAddr, ok := mapper.udpMapping[port]
 		if !ok {
 			return fmt.Errorf("Port udp/%v is not mapped", port)
@@ -313,7 +401,7 @@ func (mapper *PortMapper) Unmap(port int, proto string) error {
 			proxy.Close()
 			delete(mapper.udpProxies, port)
 		}
-		if err := mapper.iptablesForward("-D", port, proto, backendAddr.IP.String(), backendAddr.Port); err != nil {
+		if err := firewall.Forward(false, proto, port, backendAddr.IP.String(), backendAddr.Port); err != nil {
 			return err
 		}
 		delete(mapper.udpMapping, port)
@@ -321,6 +409,48 @@ func (mapper *PortMapper) Unmap(port int, proto string) error {
 	return nil
 }
 
+// Return the userland proxy of the given port, or nil if it's disabled.
+func (mapper *PortMapper) proxy(port int, proto string) (Proxy, error) {
+	if !UserlandProxy {
+		return nil, nil
+	}
+	var proxies map[int]Proxy
+	switch proto {
+	case "tcp":
+		proxies = mapper.tcpProxies
+	case "sctp":
+		proxies = mapper.sctpProxies
+	default:
+		proxies = mapper.udpProxies
+	}
+	proxy, exists := proxies[port]
+	if !exists {
+		return nil, fmt.Errorf("Port %v/%v is not mapped", proto, port)
+	}
+	return proxy, nil
+}
+
+// Return the traffic counters of the userland proxy of the given port.
+func (mapper *PortMapper) Stats(port int, proto string) (ProxyStats, error) {
+	proxy, err := mapper.proxy(port, proto)
+	if err != nil || proxy == nil {
+		return ProxyStats{}, err
+	}
+	return proxy.Stats(), nil
+}
+
+// Stop accepting connections on the userland proxy of the given port and wait
+// for at most timeout for the established ones to finish. The mapping itself
+// is left in place until Unmap is called.
+func (mapper *PortMapper) Drain(port int, proto string, timeout time.Duration) error {
+	proxy, err := mapper.proxy(port, proto)
+	if err != nil || proxy == nil {
+		return err
+	}
+	proxy.Drain(timeout)
+	return nil
+}
+
 func newPortMapper() (*PortMapper, error) {
 	mapper := &PortMapper{}
 	if err := mapper.cleanup(); err != nil {
@@ -390,6 +520,7 @@ type IPAllocator struct {
 	network       *net.IPNet
 	queueAlloc    chan allocatedIP
 	queueReleased chan net.IP
+	queueReserved chan reservedIP
 	inUse         map[int32]struct{}
 }
 
@@ -398,6 +529,11 @@ type allocatedIP struct {
 	err error
 }
 
+type reservedIP struct {
+	ip  net.IP
+	err chan error
+}
+
 func (alloc *IPAllocator) run() {
 	firstIP, _ := networkRange(alloc.network)
 	ipNum := ipToInt(firstIP)
@@ -454,6 +590,25 @@ func (alloc *IPAllocator) run() {
 					pos--
 				}
 			}
+		case reserved := <-alloc.queueReserved:
+			r := ipToInt(reserved.ip)
+			if r <= ipNum || r > ipNum+max || r == ownIP {
+				reserved.err <- fmt.Errorf("Bad parameter: %s is not a valid address in %s", reserved.ip, &net.IPNet{IP: firstIP, Mask: alloc.network.Mask})
+			} else if _, exists := alloc.inUse[r]; exists {
+				reserved.err <- fmt.Errorf("Conflict: %s is already allocated", reserved.ip)
+			} else {
+				alloc.inUse[r] = struct{}{}
+				reserved.err <- nil
+			}
+			// Offer the same IP next time, it's skipped if it was the
+			// reserved one
+			if !inUse {
+				if pos == 1 {
+					pos = max
+				} else {
+					pos--
+				}
+			}
 		}
 	}
 }
@@ -463,6 +618,13 @@ func (alloc *IPAllocator) Acquire() (net.IP, error) {
 	return ip.ip, ip.err
 }
 
+// Allocate the given ip, failing if it's not in the network or already in use
+func (alloc *IPAllocator) Reserve(ip net.IP) error {
+	reserved := reservedIP{ip: ip, err: make(chan error)}
+	alloc.queueReserved <- reserved
+	return <-reserved.err
+}
+
 func (alloc *IPAllocator) Release(ip net.IP) {
 	alloc.queueReleased <- ip
 }
@@ -472,6 +634,7 @@ func newIPAllocator(network *net.IPNet) *IPAllocator {
 		network:       network,
 		queueAlloc:    make(chan allocatedIP),
 		queueReleased: make(chan net.IP),
+		queueReserved: make(chan reservedIP),
 		inUse:         make(map[int32]struct{}),
 	}
 
@@ -490,36 +653,88 @@ type NetworkInterface struct {
 	disabled bool
 }
 
-// Allocate an external TCP port and map it to the interface
-func (iface *NetworkInterface) AllocatePort(spec string) (*Nat, error) {
+// Whether the ports of the container can be published on the host, they
+// can't when the container has its own address on the physical network
+// (e.g: macvlan)
+func (iface *NetworkInterface) publishesPorts() bool {
+	return iface.manager != nil
+}
 
-	if iface.disabled {
-		return nil, fmt.Errorf("Trying to allocate port for interface %v, which is disabled", iface) // FIXME
+// Whether the traffic between the containers of the network goes through the
+// firewall of the host, it doesn't when they talk on the physical network
+// (e.g: macvlan)
+func (iface *NetworkInterface) filtersIngress() bool {
+	return iface.manager != nil
+}
+
+// Allow or deny the traffic from the other containers of the bridge to the
+// container, "" to follow the policy of the network. The policy is removed
+// with the interface.
+func (iface *NetworkInterface) SetIngressPolicy(policy string) error {
+	switch policy {
+	case "":
+		return nil
+	case "allow", "deny":
+		return iface.manager.addIccRule(iccRule{dst: iface.IPNet.IP, allow: policy == "allow"})
 	}
+	return fmt.Errorf("Bad parameter: invalid ingress policy %s, expected allow or deny", policy)
+}
 
+// Let the traffic from the container at src to the one at dst through,
+// whatever their policies, until one of them leaves the bridge.
+func (iface *NetworkInterface) AllowIngress(src, dst net.IP) error {
+	return iface.manager.addIccRule(iccRule{src: src, dst: dst, allow: true})
+}
+
+// Allocate an external TCP port and map it to the interface
+func (iface *NetworkInterface) AllocatePort(spec string) (*Nat, error) {
 	nat, err := parseNat(spec)
 	if err != nil {
 		return nil, err
 	}
+	return iface.AllocateNat(nat)
+}
 
-	if nat.Proto == "tcp" {
+// Publish the port described by nat, on nat.Frontend if it's not 0
+func (iface *NetworkInterface) AllocateNat(nat *Nat) (*Nat, error) {
+
+	if iface.disabled {
+		return nil, fmt.Errorf("Trying to allocate port for interface %v, which is disabled", iface) // FIXME
+	}
+	if !iface.publishesPorts() {
+		return nil, fmt.Errorf("Ports can't be published for interface %v", iface)
+	}
+
+	switch nat.Proto {
+	case "tcp":
 		extPort, err := iface.manager.tcpPortAllocator.Acquire(nat.Frontend)
 		if err != nil {
 			return nil, err
 		}
 		backend := &net.TCPAddr{IP: iface.IPNet.IP, Port: nat.Backend}
-		if err := iface.manager.portMapper.Map(extPort, backend); err != nil {
+		if err := iface.manager.portMapper.Map(extPort, backend, nat.ProxyLimits); err != nil {
 			iface.manager.tcpPortAllocator.Release(extPort)
 			return nil, err
 		}
 		nat.Frontend = extPort
-	} else {
+	case "sctp":
+		extPort, err := iface.manager.sctpPortAllocator.Acquire(nat.Frontend)
+		if err != nil {
+			return nil, err
+		}
+		backend := &SCTPAddr{IP: iface.IPNet.IP, Port: nat.Backend}
+		if err := iface.manager.portMapper.Map(extPort, backend, nat.ProxyLimits); err != nil {
+			iface.manager.sctpPortAllocator.Release(extPort)
+			return nil, err
+		}
+		nat.Frontend = extPort
+	default:
 		extPort, err := iface.manager.udpPortAllocator.Acquire(nat.Frontend)
 		if err != nil {
 			return nil, err
 		}
 		backend := &net.UDPAddr{IP: iface.IPNet.IP, Port: nat.Backend}
-		if err := iface.manager.portMapper.Map(extPort, backend); err != nil {
+		if err := iface.manager.portMapper.Map(extPort, backend, nat.ProxyLimits); err != nil {
 			iface.manager.udpPortAllocator.Release(extPort)
 			return nil, err
 		}
@@ -534,11 +749,77 @@ type Nat struct {
 	Proto    string
 	Frontend int
 	Backend  int
+	ProxyLimits
+}
+
+// Parse a rate like 10mbit (bits per second, like with tc) or 1mbps (bytes
+// per second) into bytes per second.
+func parseRate(rate string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		// Longest suffixes first since they share their endings:
+		{"gbit", 1e9 / 8}, {"mbit", 1e6 / 8}, {"kbit", 1e3 / 8}, {"bit", 1.0 / 8},
+		{"gbps", 1e9}, {"mbps", 1e6}, {"kbps", 1e3}, {"bps", 1},
+	}
+	number := strings.ToLower(rate)
+	multiplier := 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = number[:len(number)-len(unit.suffix)]
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	// Under 1 byte per second, the rate would be 0: no limit
+	value, err := strconv.ParseFloat(number, 64)
+	bytes := value * multiplier
+	if err != nil || !(value > 0) || bytes < 1 || bytes >= 1<<63 {
+		return 0, fmt.Errorf("Invalid port format: invalid rate %v.", rate)
+	}
+	return int64(bytes), nil
+}
+
+// Parse the options following the port in a spec, e.g: "maxconn=100,rate=10mbit"
+func parseNatOptions(nat *Nat, options []string) error {
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid port format: invalid option %v.", option)
+		}
+		switch parts[0] {
+		case "maxconn":
+			maxConn, err := strconv.ParseUint(parts[1], 10, 31)
+			if err != nil || maxConn == 0 {
+				return fmt.Errorf("Invalid port format: invalid maxconn %v.", parts[1])
+			}
+			nat.MaxConnections = int(maxConn)
+		case "rate":
+			rate, err := parseRate(parts[1])
+			if err != nil {
+				return err
+			}
+			nat.RateLimit = rate
+		default:
+			return fmt.Errorf("Invalid port format: unknown option %v.", parts[0])
+		}
+	}
+	if nat.Proto != "tcp" && !nat.Unlimited() {
+		return fmt.Errorf("Invalid port format: maxconn and rate are only supported for tcp.")
+	}
+	return nil
 }
 
 func parseNat(spec string) (*Nat, error) {
 	var nat Nat
 
+	var options []string
+	if strings.Contains(spec, ",") {
+		options = strings.Split(spec, ",")
+		spec, options = options[0], options[1:]
+	}
+
 	if strings.Contains(spec, "/") {
 		specParts := strings.Split(spec, "/")
 		if len(specParts) != 2 {
@@ -546,7 +827,7 @@ func parseNat(spec string) (*Nat, error) {
 		}
 		proto := specParts[1]
 		spec = specParts[0]
-		if proto != "tcp" && proto != "udp" {
+		if proto != "tcp" && proto != "udp" && proto != "sctp" {
 			return nil, fmt.Errorf("Invalid port format: unknown protocol %v.", proto)
 		}
 		nat.Proto = proto
@@ -587,9 +868,33 @@ func parseNat(spec string) (*Nat, error) {
 		nat.Backend = int(port)
 	}
 
+	if err := parseNatOptions(&nat, options); err != nil {
+		return nil, err
+	}
 	return &nat, nil
 }
 
+// Drain the proxies of all the ports allocated on the interface, in parallel,
+// for at most timeout.
+func (iface *NetworkInterface) Drain(timeout time.Duration) {
+	if iface.disabled {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, nat := range iface.extPorts {
+		wg.Add(1)
+		go func(nat *Nat) {
+			defer wg.Done()
+			utils.Debugf("Draining %v/%v", nat.Proto, nat.Frontend)
+			if err := iface.manager.portMapper.Drain(nat.Frontend, nat.Proto, timeout); err != nil {
+				log.Printf("Unable to drain port %v/%v: %v", nat.Proto, nat.Frontend, err)
+			}
+		}(nat)
+	}
+	wg.Wait()
+}
+
 // Release: Network cleanup - release all resources
 func (iface *NetworkInterface) Release() {
 
@@ -598,44 +903,128 @@ func (iface *NetworkInterface) Release() {
 	}
 
 	for _, nat := range iface.extPorts {
-		utils.Debugf("Unmaping %v/%v", nat.Proto, nat.Frontend)
-		if err := iface.manager.portMapper.Unmap(nat.Frontend, nat.Proto); err != nil {
-			log.Printf("Unable to unmap port %v/%v: %v", nat.Proto, nat.Frontend, err)
-		}
-		if nat.Proto == "tcp" {
-			if err := iface.manager.tcpPortAllocator.Release(nat.Frontend); err != nil {
-				log.Printf("Unable to release port tcp/%v: %v", nat.Frontend, err)
-			}
-		} else if err := iface.manager.udpPortAllocator.Release(nat.Frontend); err != nil {
-			log.Printf("Unable to release port udp/%v: %v", nat.Frontend, err)
-		}
+		iface.releaseNat(nat)
 	}
 
+	iface.manager.releaseIccRules(iface.IPNet.IP)
 	iface.manager.ipAllocator.Release(iface.IPNet.IP)
 }
 
-// Network Manager manages a set of network interfaces
-// Only *one* manager per host machine should be used
+// Unpublish the port spec of the interface. The host port in spec is optional,
+// the port is identified by its protocol and its port in the container.
+func (iface *NetworkInterface) ReleasePort(spec string) (*Nat, error) {
+	if iface.disabled {
+		return nil, fmt.Errorf("Trying to release port for interface %v, which is disabled", iface)
+	}
+	nat, err := parseNat(spec)
+	if err != nil {
+		return nil, err
+	}
+	for i, allocated := range iface.extPorts {
+		if allocated.Proto == nat.Proto && allocated.Backend == nat.Backend && (nat.Frontend == 0 || allocated.Frontend == nat.Frontend) {
+			iface.releaseNat(allocated)
+			iface.extPorts = append(iface.extPorts[:i], iface.extPorts[i+1:]...)
+			return allocated, nil
+		}
+	}
+	return nil, fmt.Errorf("No such port: %s", spec)
+}
+
+func (iface *NetworkInterface) releaseNat(nat *Nat) {
+	utils.Debugf("Unmaping %v/%v", nat.Proto, nat.Frontend)
+	if err := iface.manager.portMapper.Unmap(nat.Frontend, nat.Proto); err != nil {
+		log.Printf("Unable to unmap port %v/%v: %v", nat.Proto, nat.Frontend, err)
+	}
+	if nat.Proto == "tcp" {
+		if err := iface.manager.tcpPortAllocator.Release(nat.Frontend); err != nil {
+			log.Printf("Unable to release port tcp/%v: %v", nat.Frontend, err)
+		}
+	} else if nat.Proto == "sctp" {
+		if err := iface.manager.sctpPortAllocator.Release(nat.Frontend); err != nil {
+			log.Printf("Unable to release port sctp/%v: %v", nat.Frontend, err)
+		}
+	} else if err := iface.manager.udpPortAllocator.Release(nat.Frontend); err != nil {
+		log.Printf("Unable to release port udp/%v: %v", nat.Frontend, err)
+	}
+}
+
+// Network Manager manages the network interfaces of the containers attached
+// to one bridge
 type NetworkManager struct {
 	bridgeIface   string
 	bridgeNetwork *net.IPNet
 
-	ipAllocator      *IPAllocator
-	tcpPortAllocator *PortAllocator
-	udpPortAllocator *PortAllocator
-	portMapper       *PortMapper
+	ipAllocator       *IPAllocator
+	tcpPortAllocator  *PortAllocator
+	udpPortAllocator  *PortAllocator
+	sctpPortAllocator *PortAllocator
+	portMapper        *PortMapper
 
-	disabled bool
+	disabled   bool
+	masquerade bool // whether the outgoing traffic of the bridge is masqueraded
+
+	icc      bool // whether the containers of the bridge can reach each other by default
+	iccLock  sync.Mutex
+	iccRules []iccRule
 }
 
-// Allocate a network interface
-func (manager *NetworkManager) Allocate() (*NetworkInterface, error) {
+// A rule of the ingress policies of the containers of a bridge: the traffic
+// from src (any container if nil) to dst is allowed or dropped.
+type iccRule struct {
+	src   net.IP
+	dst   net.IP
+	allow bool
+}
+
+func (manager *NetworkManager) applyIccRule(add bool, rule iccRule) error {
+	src := ""
+	if rule.src != nil {
+		src = rule.src.String()
+	}
+	if rule.allow {
+		return firewall.IccAllow(add, manager.bridgeIface, src, rule.dst.String())
+	}
+	return firewall.IccDeny(add, manager.bridgeIface, rule.dst.String())
+}
+
+func (manager *NetworkManager) addIccRule(rule iccRule) error {
+	manager.iccLock.Lock()
+	defer manager.iccLock.Unlock()
+	if err := manager.applyIccRule(true, rule); err != nil {
+		return err
+	}
+	manager.iccRules = append(manager.iccRules, rule)
+	return nil
+}
+
+// Remove the rules about ip, all of them if ip is nil
+func (manager *NetworkManager) releaseIccRules(ip net.IP) {
+	manager.iccLock.Lock()
+	defer manager.iccLock.Unlock()
+	var kept []iccRule
+	for _, rule := range manager.iccRules {
+		if ip == nil || rule.dst.Equal(ip) || (rule.src != nil && rule.src.Equal(ip)) {
+			manager.applyIccRule(false, rule)
+		} else {
+			kept = append(kept, rule)
+		}
+	}
+	manager.iccRules = kept
+}
+
+// Allocate a network interface, with the address ip if it's not nil
+func (manager *NetworkManager) Allocate(ip net.IP) (*NetworkInterface, error) {
 
 	if manager.disabled {
 		return &NetworkInterface{disabled: true}, nil
 	}
 
-	ip, err := manager.ipAllocator.Acquire()
+	var err error
+	if ip != nil {
+		err = manager.ipAllocator.Reserve(ip)
+	} else {
+		ip, err = manager.ipAllocator.Acquire()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -647,7 +1036,12 @@ func (manager *NetworkManager) Allocate() (*NetworkInterface, error) {
 	return iface, nil
 }
 
-func newNetworkManager(bridgeIface string) (*NetworkManager, error) {
+// Create a manager for the bridge bridgeIface, creating the bridge on subnet
+// if it doesn't exist. Unless icc is true, the traffic between the containers
+// of the bridge is dropped by default. When shared is not nil, its port allocators and port
+// mapper are reused: the published ports are unique on the host, whatever the
+// network of the container.
+func newNetworkManager(bridgeIface, subnet string, icc bool, shared *NetworkManager) (*NetworkManager, error) {
 
 	if bridgeIface == DisableNetworkBridge {
 		manager := &NetworkManager{
@@ -656,42 +1050,99 @@ func newNetworkManager(bridgeIface string) (*NetworkManager, error) {
 		return manager, nil
 	}
 
+	created := false
 	addr, err := getIfaceAddr(bridgeIface)
 	if err != nil {
 		// If the iface is not found, try to create it
-		if err := CreateBridgeIface(bridgeIface); err != nil {
+		created = true
+		if subnet != "" {
+			err = CreateBridgeIfaceWithSubnet(bridgeIface, subnet)
+		} else {
+			err = CreateBridgeIface(bridgeIface)
+		}
+		if err != nil {
 			return nil, err
 		}
 		addr, err = getIfaceAddr(bridgeIface)
 		if err != nil {
 			return nil, err
 		}
+	} else if subnet != "" {
+		if _, network, err := net.ParseCIDR(subnet); err != nil {
+			return nil, fmt.Errorf("Invalid subnet %s: %s", subnet, err)
+		} else if !network.Contains(addr.(*net.IPNet).IP) {
+			return nil, fmt.Errorf("Conflict: bridge %s already exists with address %s", bridgeIface, addr)
+		}
 	}
 	network := addr.(*net.IPNet)
 
 	ipAllocator := newIPAllocator(network)
 
-	tcpPortAllocator, err := newPortAllocator()
-	if err != nil {
-		return nil, err
+	manager := &NetworkManager{
+		bridgeIface:   bridgeIface,
+		bridgeNetwork: network,
+		ipAllocator:   ipAllocator,
 	}
-	udpPortAllocator, err := newPortAllocator()
-	if err != nil {
-		return nil, err
+	if shared != nil {
+		manager.tcpPortAllocator = shared.tcpPortAllocator
+		manager.udpPortAllocator = shared.udpPortAllocator
+		manager.sctpPortAllocator = shared.sctpPortAllocator
+		manager.portMapper = shared.portMapper
+	} else {
+		if manager.tcpPortAllocator, err = newPortAllocator(); err != nil {
+			return nil, err
+		}
+		if manager.udpPortAllocator, err = newPortAllocator(); err != nil {
+			return nil, err
+		}
+		if manager.sctpPortAllocator, err = newPortAllocator(); err != nil {
+			return nil, err
+		}
+		if manager.portMapper, err = newPortMapper(); err != nil {
+			return nil, err
+		}
 	}
 
-	portMapper, err := newPortMapper()
-	if err != nil {
-		return nil, err
+	// The bridges docker created have their outgoing traffic masqueraded
+	if created || firewall.Masqueraded(network) {
+		if err := firewall.Masquerade(true, network); err != nil {
+			return nil, fmt.Errorf("Unable to enable network bridge NAT: %s", err)
+		}
+		manager.masquerade = true
 	}
 
-	manager := &NetworkManager{
-		bridgeIface:      bridgeIface,
-		bridgeNetwork:    network,
-		ipAllocator:      ipAllocator,
-		tcpPortAllocator: tcpPortAllocator,
-		udpPortAllocator: udpPortAllocator,
-		portMapper:       portMapper,
+	firewall.Hairpin(false, network)
+	if !UserlandProxy {
+		if err := firewall.Hairpin(true, network); err != nil {
+			return nil, fmt.Errorf("Failed to setup hairpin NAT: %s", err)
+		}
+	}
+
+	manager.icc = icc
+	if !icc {
+		if err := firewall.IccDeny(true, bridgeIface, ""); err != nil {
+			return nil, fmt.Errorf("Unable to deny the inter-container communication: %s", err)
+		}
 	}
 	return manager, nil
 }
+
+// Remove the firewall rules of the manager; the bridge itself is deleted if
+// deleteBridge is true.
+func (manager *NetworkManager) destroy(deleteBridge bool) error {
+	if manager.disabled {
+		return nil
+	}
+	firewall.Hairpin(false, manager.bridgeNetwork)
+	manager.releaseIccRules(nil)
+	if !manager.icc {
+		firewall.IccDeny(false, manager.bridgeIface, "")
+	}
+	if deleteBridge {
+		if manager.masquerade {
+			firewall.Masquerade(false, manager.bridgeNetwork)
+		}
+		return DeleteBridgeIface(manager.bridgeIface)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Name of the network the containers are attached to by default
+const DefaultNetworkName = "bridge"
+
+// Driver used to setup the networks of the containers, can be changed before
+// the runtime is created
+var NetworkDriverName = "bridge"
+
+// A NetworkDriver sets up networks and connects containers to them. The
+// runtime only deals with this interface so new kinds of networks (macvlan,
+// overlay...) can be added with RegisterNetworkDriver.
+type NetworkDriver interface {
+	// Create the network name, options are driver specific.
+	CreateNetwork(name string, options map[string]string) error
+	// Allocate the resources (address, ports...) a container needs on the
+	// network name, with the address ip if it's not nil.
+	CreateEndpoint(name string, ip net.IP) (*NetworkInterface, error)
+	// Fill settings with what the container needs to use iface when it
+	// starts (e.g: the bridge to link its veth to).
+	Join(name string, iface *NetworkInterface, settings *NetworkSettings) error
+	// Release the resources allocated by CreateEndpoint.
+	Leave(name string, iface *NetworkInterface) error
+	// Remove the network name, no container is attached to it anymore.
+	DeleteNetwork(name string) error
+	// Describe the network name.
+	NetworkInfo(name string) (*APINetwork, error)
+}
+
+var networkDrivers = make(map[string]func() (NetworkDriver, error))
+
+// Make a network driver available under the given name, the init function is
+// called once when the runtime is created.
+func RegisterNetworkDriver(name string, init func() (NetworkDriver, error)) {
+	if _, exists := networkDrivers[name]; exists {
+		panic(fmt.Sprintf("Network driver %s registered twice", name))
+	}
+	networkDrivers[name] = init
+}
+
+func newNetworkDriver(name string) (NetworkDriver, error) {
+	init, exists := networkDrivers[name]
+	if !exists {
+		return nil, fmt.Errorf("Unknown network driver: %s", name)
+	}
+	return init()
+}
+
+func init() {
+	RegisterNetworkDriver("bridge", func() (NetworkDriver, error) {
+		return &bridgeDriver{
+			networks: make(map[string]*NetworkManager),
+			owned:    make(map[string]bool),
+		}, nil
+	})
+}
+
+// The default driver: each network is a linux bridge, containers get an
+// address on it and their ports are published with iptables and the userland
+// proxy.
+type bridgeDriver struct {
+	sync.Mutex
+	networks map[string]*NetworkManager
+	// networks whose bridge was named by the driver, and is removed with them
+	owned map[string]bool
+}
+
+func (driver *bridgeDriver) network(name string) (*NetworkManager, error) {
+	driver.Lock()
+	defer driver.Unlock()
+	manager, exists := driver.networks[name]
+	if !exists {
+		return nil, fmt.Errorf("No such network: %s", name)
+	}
+	return manager, nil
+}
+
+// The "bridge" option is the name of the bridge interface to use, it's
+// created if it doesn't exist yet (by default "br-" followed by the name of
+// the network). The "subnet" option is the address range of a new bridge,
+// a free one is picked otherwise. Use DisableNetworkBridge to disable the
+// networking of the containers attached to the network. The "icc" option
+// (true or false, InterContainerCommunication by default) is the ingress
+// policy of the containers which have none.
+func (driver *bridgeDriver) CreateNetwork(name string, options map[string]string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	if _, exists := driver.networks[name]; exists {
+		return fmt.Errorf("Conflict: network %s already exists", name)
+	}
+	icc := InterContainerCommunication
+	if options["icc"] != "" {
+		var err error
+		if icc, err = strconv.ParseBool(options["icc"]); err != nil {
+			return fmt.Errorf("Bad parameter: invalid icc option %s, expected true or false", options["icc"])
+		}
+	}
+	bridgeIface := options["bridge"]
+	owned := bridgeIface == ""
+	if owned {
+		bridgeIface = "br-" + name
+		// Interface names are limited to 15 characters
+		if len(bridgeIface) > 15 {
+			bridgeIface = bridgeIface[:15]
+		}
+	}
+	var shared *NetworkManager
+	for other, manager := range driver.networks {
+		if manager.disabled {
+			continue
+		}
+		if manager.bridgeIface == bridgeIface {
+			return fmt.Errorf("Conflict: bridge %s is already used by network %s", bridgeIface, other)
+		}
+		shared = manager
+	}
+	manager, err := newNetworkManager(bridgeIface, options["subnet"], icc, shared)
+	if err != nil {
+		return err
+	}
+	if !manager.disabled {
+		for _, other := range driver.networks {
+			if other.disabled {
+				continue
+			}
+			// Remove the rules left by a previous run before adding them
+			firewall.Isolate(false, bridgeIface, other.bridgeIface)
+			if err := firewall.Isolate(true, bridgeIface, other.bridgeIface); err != nil {
+				manager.destroy(owned)
+				return fmt.Errorf("Unable to isolate network %s: %s", name, err)
+			}
+		}
+	}
+	driver.networks[name] = manager
+	driver.owned[name] = owned
+	return nil
+}
+
+func (driver *bridgeDriver) DeleteNetwork(name string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	manager, exists := driver.networks[name]
+	if !exists {
+		return fmt.Errorf("No such network: %s", name)
+	}
+	if !manager.disabled {
+		for other, otherManager := range driver.networks {
+			if other == name || otherManager.disabled {
+				continue
+			}
+			firewall.Isolate(false, manager.bridgeIface, otherManager.bridgeIface)
+		}
+	}
+	if err := manager.destroy(driver.owned[name]); err != nil {
+		return err
+	}
+	delete(driver.networks, name)
+	delete(driver.owned, name)
+	return nil
+}
+
+func (driver *bridgeDriver) NetworkInfo(name string) (*APINetwork, error) {
+	manager, err := driver.network(name)
+	if err != nil {
+		return nil, err
+	}
+	info := &APINetwork{Name: name, Driver: "bridge"}
+	if manager.disabled {
+		info.Bridge = DisableNetworkBridge
+		return info, nil
+	}
+	network := manager.bridgeNetwork
+	info.Bridge = manager.bridgeIface
+	info.Subnet = (&net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask}).String()
+	info.Gateway = network.IP.String()
+	return info, nil
+}
+
+func (driver *bridgeDriver) CreateEndpoint(name string, ip net.IP) (*NetworkInterface, error) {
+	manager, err := driver.network(name)
+	if err != nil {
+		return nil, err
+	}
+	return manager.Allocate(ip)
+}
+
+func (driver *bridgeDriver) Join(name string, iface *NetworkInterface, settings *NetworkSettings) error {
+	manager, err := driver.network(name)
+	if err != nil {
+		return err
+	}
+	settings.Bridge = manager.bridgeIface
+	settings.IPAddress = iface.IPNet.IP.String()
+	settings.IPPrefixLen, _ = iface.IPNet.Mask.Size()
+	settings.Gateway = iface.Gateway.String()
+	return nil
+}
+
+func (driver *bridgeDriver) Leave(name string, iface *NetworkInterface) error {
+	if _, err := driver.network(name); err != nil {
+		return err
+	}
+	iface.Release()
+	return nil
+}
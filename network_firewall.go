@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The firewall backend used to publish the ports and to set up the NAT of
+// the bridges: "iptables", "nftables" or "auto" to pick nftables on the hosts
+// where iptables is missing or is itself built on nftables.
+var FirewallBackend = "auto"
+
+// The firewall of docker, set up with the first network which needs it
+var firewall Firewall
+
+// Firewall sets the rules docker needs on the host. The rules of docker are
+// kept apart from the ones of the host (in their own chains or table), so
+// they can be removed and restored without touching the others.
+type Firewall interface {
+	// Set up the rules of docker. The published ports and the isolation of
+	// the networks left by a previous run are removed, the NAT of the
+	// bridges is kept: it's needed as long as the bridges exist.
+	Setup() error
+
+	// Masquerade the outgoing traffic of the bridge network behind the
+	// address of the host.
+	Masquerade(add bool, network *net.IPNet) error
+
+	// Whether the outgoing traffic of network is already masqueraded (e.g:
+	// by a previous run of docker).
+	Masqueraded(network *net.IPNet) bool
+
+	// Without the userland proxy, the traffic from a container to a
+	// published port is DNATed straight to the backend container:
+	// masquerade it so the replies go back through the host and get
+	// un-DNATed.
+	Hairpin(add bool, network *net.IPNet) error
+
+	// Drop the traffic between two bridges so the networks are isolated
+	// from each other. Connections to published ports are DNATed and still
+	// go through.
+	Isolate(add bool, bridgeA, bridgeB string) error
+
+	// Let the traffic from the container src (any container if empty) to
+	// the container dst of bridge through, whatever the policies.
+	IccAllow(add bool, bridge, src, dst string) error
+
+	// Drop the traffic from the other containers of bridge to the
+	// container dst (to any container if empty). The replies to the
+	// connections it opens still go through.
+	IccDeny(add bool, bridge, dst string) error
+
+	// DNAT the traffic to the port of the host to backendIP:backendPort.
+	// The traffic from the default bridge is left to the userland proxy,
+	// unless it's disabled.
+	Forward(add bool, proto string, port int, backendIP string, backendPort int) error
+
+	// Put back the rules which were removed, and return how many were
+	// restored.
+	Reconcile() int
+}
+
+func newFirewall(backend string) (Firewall, error) {
+	switch backend {
+	case "iptables":
+		return &iptablesFirewall{&IptablesRules{}}, nil
+	case "nftables":
+		if err := nft("list tables"); err != nil {
+			return nil, fmt.Errorf("nftables is not available: %s", err)
+		}
+		return newNftablesFirewall(), nil
+	case "auto", "":
+		if preferNftables() {
+			utils.Debugf("Using the nftables firewall backend")
+			return newNftablesFirewall(), nil
+		}
+		utils.Debugf("Using the iptables firewall backend")
+		return &iptablesFirewall{&IptablesRules{}}, nil
+	}
+	return nil, fmt.Errorf("Invalid firewall backend: %s (iptables, nftables or auto)", backend)
+}
+
+// Create and set up the firewall, unless it's already done
+func initFirewall() error {
+	if firewall != nil {
+		return nil
+	}
+	fw, err := newFirewall(FirewallBackend)
+	if err != nil {
+		return err
+	}
+	if err := fw.Setup(); err != nil {
+		return err
+	}
+	firewall = fw
+	return nil
+}
+
+// nftables is used when it works and iptables is either missing or the
+// nf_tables variant, which only translates the rules to nftables.
+func preferNftables() bool {
+	if nft("list tables") != nil {
+		return false
+	}
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		return true
+	}
+	output, err := exec.Command(path, "--version").CombinedOutput()
+	return err == nil && strings.Contains(string(output), "nf_tables")
+}
+
+// Check the rules of the firewall every interval, forever
+func watchFirewall(firewall Firewall, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if restored := firewall.Reconcile(); restored > 0 {
+			log.Printf("WARNING: %d firewall rules of docker were removed (e.g: by a reload of the firewall), they have been restored", restored)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The key/value store shared by the daemons of a cluster (e.g:
+// etcd://10.0.0.1:2379), used by the overlay driver. Empty without cluster.
+var ClusterStore string
+
+// The address the other daemons of the cluster reach this host at
+var ClusterAdvertise string
+
+var (
+	errKeyNotFound = errors.New("Key not found")
+	errKeyExists   = errors.New("Key already exists")
+)
+
+// A kvStore keeps string values under paths like /docker/overlay/networks/foo
+type kvStore interface {
+	Get(key string) (string, error)
+	// The values of the keys of the directory dir, by name
+	List(dir string) (map[string]string, error)
+	// Set key, unless it already exists
+	Create(key, value string) error
+	Put(key, value string) error
+	Delete(key string) error
+}
+
+func newKVStore(location string) (kvStore, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid cluster store: %s", location)
+	}
+	switch u.Scheme {
+	case "etcd":
+		return &etcdStore{endpoint: "http://" + u.Host, client: &http.Client{}}, nil
+	}
+	return nil, fmt.Errorf("Unsupported cluster store: %s, only etcd:// is supported", location)
+}
+
+// A client of the v2 API of etcd
+type etcdStore struct {
+	endpoint string
+	client   *http.Client
+}
+
+type etcdNode struct {
+	Key   string
+	Value string
+	Dir   bool
+	Nodes []*etcdNode
+}
+
+type etcdResponse struct {
+	Node *etcdNode
+}
+
+func (store *etcdStore) do(method, key string, query url.Values, value *string) (*etcdResponse, error) {
+	u := store.endpoint + "/v2/keys" + key
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var req *http.Request
+	var err error
+	if value != nil {
+		req, err = http.NewRequest(method, u, strings.NewReader(url.Values{"value": {*value}}.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(method, u, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach the cluster store: %s", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusNotFound:
+		return nil, errKeyNotFound
+	case http.StatusPreconditionFailed:
+		return nil, errKeyExists
+	default:
+		return nil, fmt.Errorf("The cluster store failed to %s %s: %s", method, key, resp.Status)
+	}
+	response := &etcdResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (store *etcdStore) Get(key string) (string, error) {
+	response, err := store.do("GET", key, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if response.Node == nil || response.Node.Dir {
+		return "", errKeyNotFound
+	}
+	return response.Node.Value, nil
+}
+
+func (store *etcdStore) List(dir string) (map[string]string, error) {
+	values := make(map[string]string)
+	response, err := store.do("GET", dir, nil, nil)
+	if err == errKeyNotFound {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if response.Node == nil {
+		return values, nil
+	}
+	for _, node := range response.Node.Nodes {
+		if !node.Dir {
+			values[node.Key[strings.LastIndex(node.Key, "/")+1:]] = node.Value
+		}
+	}
+	return values, nil
+}
+
+func (store *etcdStore) Create(key, value string) error {
+	_, err := store.do("PUT", key, url.Values{"prevExist": {"false"}}, &value)
+	return err
+}
+
+func (store *etcdStore) Put(key, value string) error {
+	_, err := store.do("PUT", key, nil, &value)
+	return err
+}
+
+func (store *etcdStore) Delete(key string) error {
+	_, err := store.do("DELETE", key, nil, nil)
+	return err
+}
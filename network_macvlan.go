@@ -0,0 +1,170 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+func init() {
+	RegisterNetworkDriver("macvlan", func() (NetworkDriver, error) {
+		return &macvlanDriver{networks: make(map[string]*macvlanNetwork)}, nil
+	})
+}
+
+// The macvlan driver gives each container a macvlan interface on top of a
+// physical interface of the host: the container gets an address on the
+// physical network, without NAT nor userland proxy. Like with any macvlan,
+// the host itself can't reach the containers through the parent interface.
+type macvlanDriver struct {
+	sync.Mutex
+	networks map[string]*macvlanNetwork
+}
+
+type macvlanNetwork struct {
+	parent      string
+	mode        string
+	subnet      *net.IPNet
+	gateway     net.IP
+	ipAllocator *IPAllocator
+}
+
+func (driver *macvlanDriver) network(name string) (*macvlanNetwork, error) {
+	driver.Lock()
+	defer driver.Unlock()
+	network, exists := driver.networks[name]
+	if !exists {
+		return nil, fmt.Errorf("No such network: %s", name)
+	}
+	return network, nil
+}
+
+// The options are "parent", the interface of the host the macvlans are
+// created on, "subnet" and "gateway" (the first address of the subnet by
+// default) of the physical network, "ip-range", the part of the subnet the
+// addresses of the containers are picked from (the whole subnet by default),
+// and "mode", the macvlan mode: bridge (the default), vepa or private.
+func (driver *macvlanDriver) CreateNetwork(name string, options map[string]string) error {
+	parent := options["parent"]
+	if parent == "" {
+		return fmt.Errorf("Bad parameter: the macvlan driver needs a parent interface")
+	}
+	if _, err := net.InterfaceByName(parent); err != nil {
+		return fmt.Errorf("Bad parameter: invalid parent interface %s: %s", parent, err)
+	}
+	mode := options["mode"]
+	switch mode {
+	case "":
+		mode = "bridge"
+	case "bridge", "vepa", "private":
+	default:
+		return fmt.Errorf("Bad parameter: invalid macvlan mode %s", mode)
+	}
+	if options["subnet"] == "" {
+		return fmt.Errorf("Bad parameter: the macvlan driver needs the subnet of the physical network")
+	}
+	_, subnet, err := net.ParseCIDR(options["subnet"])
+	if err != nil || subnet.IP.To4() == nil {
+		return fmt.Errorf("Bad parameter: invalid subnet %s", options["subnet"])
+	}
+	gateway := intToIP(ipToInt(subnet.IP) + 1)
+	if options["gateway"] != "" {
+		if gateway = net.ParseIP(options["gateway"]); gateway == nil || !subnet.Contains(gateway) {
+			return fmt.Errorf("Bad parameter: invalid gateway %s for subnet %s", options["gateway"], subnet)
+		}
+	}
+	ipRange := subnet
+	if options["ip-range"] != "" {
+		var first, last net.IP
+		if _, ipRange, err = net.ParseCIDR(options["ip-range"]); err == nil && ipRange.IP.To4() != nil {
+			first, last = networkRange(ipRange)
+		}
+		if first == nil || !subnet.Contains(first) || !subnet.Contains(last) {
+			return fmt.Errorf("Bad parameter: invalid ip range %s for subnet %s", options["ip-range"], subnet)
+		}
+	}
+	// The allocator never hands out the address of its network
+	allocatorNetwork := *ipRange
+	if ipRange.Contains(gateway) {
+		allocatorNetwork.IP = gateway
+	}
+
+	driver.Lock()
+	defer driver.Unlock()
+	if _, exists := driver.networks[name]; exists {
+		return fmt.Errorf("Conflict: network %s already exists", name)
+	}
+	driver.networks[name] = &macvlanNetwork{
+		parent:      parent,
+		mode:        mode,
+		subnet:      subnet,
+		gateway:     gateway,
+		ipAllocator: newIPAllocator(&allocatorNetwork),
+	}
+	return nil
+}
+
+func (driver *macvlanDriver) CreateEndpoint(name string, ip net.IP) (*NetworkInterface, error) {
+	network, err := driver.network(name)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		err = network.ipAllocator.Reserve(ip)
+	} else {
+		ip, err = network.ipAllocator.Acquire()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkInterface{
+		IPNet:   net.IPNet{IP: ip, Mask: network.subnet.Mask},
+		Gateway: network.gateway,
+	}, nil
+}
+
+func (driver *macvlanDriver) Join(name string, iface *NetworkInterface, settings *NetworkSettings) error {
+	network, err := driver.network(name)
+	if err != nil {
+		return err
+	}
+	settings.Bridge = network.parent
+	settings.MacvlanMode = network.mode
+	settings.IPAddress = iface.IPNet.IP.String()
+	settings.IPPrefixLen, _ = iface.IPNet.Mask.Size()
+	settings.Gateway = iface.Gateway.String()
+	return nil
+}
+
+func (driver *macvlanDriver) Leave(name string, iface *NetworkInterface) error {
+	network, err := driver.network(name)
+	if err != nil {
+		return err
+	}
+	network.ipAllocator.Release(iface.IPNet.IP)
+	return nil
+}
+
+func (driver *macvlanDriver) DeleteNetwork(name string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	if _, exists := driver.networks[name]; !exists {
+		return fmt.Errorf("No such network: %s", name)
+	}
+	delete(driver.networks, name)
+	return nil
+}
+
+func (driver *macvlanDriver) NetworkInfo(name string) (*APINetwork, error) {
+	network, err := driver.network(name)
+	if err != nil {
+		return nil, err
+	}
+	return &APINetwork{
+		Name:    name,
+		Driver:  "macvlan",
+		Bridge:  network.parent,
+		Subnet:  network.subnet.String(),
+		Gateway: network.gateway.String(),
+	}, nil
+}
@@ -0,0 +1,223 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The nftables table of docker
+const nftablesTable = "docker"
+
+// Run the nftables script, e.g: "list tables"
+func nft(script string) error {
+	_, err := nftOutput(script)
+	return err
+}
+
+// Wrapper around the nft command, which reads the script on its stdin
+func nftOutput(script string) (string, error) {
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return "", fmt.Errorf("command not found: nft")
+	}
+	cmd := exec.Command(path, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("nft failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// The nftables backend of the firewall. All the rules of docker are in the
+// table docker, which is replaced as a whole (and atomically) whenever a rule
+// changes: nftables rules can only be deleted by handle, and the whole table
+// is what a reload of the firewall of the host removes.
+type nftablesFirewall struct {
+	sync.Mutex
+	// The rules of the chains which change: ports (the published ports),
+	// postrouting, isolation, and icc-allow and icc-deny, the exceptions to
+	// the ingress policies of the containers and these policies
+	rules map[string][]string
+}
+
+func newNftablesFirewall() *nftablesFirewall {
+	return &nftablesFirewall{rules: make(map[string][]string)}
+}
+
+// The script replacing the table of docker with its current rules
+func (fw *nftablesFirewall) script() string {
+	var script bytes.Buffer
+	// Declaring the table first makes sure the deletion doesn't fail
+	fmt.Fprintf(&script, "table ip %s\ndelete table ip %s\ntable ip %s {\n", nftablesTable, nftablesTable, nftablesTable)
+	chain := func(name, header string, rules ...string) {
+		fmt.Fprintf(&script, "\tchain %s {\n", name)
+		if header != "" {
+			fmt.Fprintf(&script, "\t\t%s\n", header)
+		}
+		for _, rule := range rules {
+			fmt.Fprintf(&script, "\t\t%s\n", rule)
+		}
+		fmt.Fprintf(&script, "\t}\n")
+	}
+	chain("ports", "", fw.rules["ports"]...)
+	chain("prerouting", "type nat hook prerouting priority -100; policy accept;", "fib daddr type local jump ports")
+	chain("output", "type nat hook output priority -100; policy accept;", "ip daddr != 127.0.0.0/8 fib daddr type local jump ports")
+	chain("postrouting", "type nat hook postrouting priority 100; policy accept;", fw.rules["postrouting"]...)
+	chain("isolation", "", fw.rules["isolation"]...)
+	icc := append([]string{"ct state established,related return"}, fw.rules["icc-allow"]...)
+	chain("icc", "", append(icc, fw.rules["icc-deny"]...)...)
+	chain("forward", "type filter hook forward priority 0; policy accept;", "jump icc", "ct status dnat accept", "jump isolation")
+	script.WriteString("}\n")
+	return script.String()
+}
+
+func (fw *nftablesFirewall) load() error {
+	return nft(fw.script())
+}
+
+func (fw *nftablesFirewall) contains(chain, rule string) bool {
+	for _, r := range fw.rules[chain] {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// Add or remove the rule of chain, and load the new table
+func (fw *nftablesFirewall) apply(add bool, chain, rule string) error {
+	fw.Lock()
+	defer fw.Unlock()
+	previous := fw.rules[chain]
+	if add {
+		if fw.contains(chain, rule) {
+			return nil
+		}
+		fw.rules[chain] = append(append([]string{}, previous...), rule)
+	} else {
+		var kept []string
+		for _, r := range previous {
+			if r != rule {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == len(previous) {
+			return nil
+		}
+		fw.rules[chain] = kept
+	}
+	if err := fw.load(); err != nil {
+		fw.rules[chain] = previous
+		return err
+	}
+	return nil
+}
+
+func (fw *nftablesFirewall) Setup() error {
+	fw.Lock()
+	defer fw.Unlock()
+	fw.rules = make(map[string][]string)
+	// Keep the NAT of the bridges set by a previous run
+	if output, err := nftOutput(fmt.Sprintf("list chain ip %s postrouting", nftablesTable)); err == nil {
+		for _, line := range strings.Split(output, "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasSuffix(line, " masquerade") && !strings.Contains(line, "ct status") {
+				fw.rules["postrouting"] = append(fw.rules["postrouting"], line)
+			}
+		}
+	}
+	if err := fw.load(); err != nil {
+		return fmt.Errorf("Failed to create the nftables table of docker: %s", err)
+	}
+	return nil
+}
+
+// nftables prints the networks without their host bits, e.g: 172.17.0.0/16
+func nftablesNetwork(network *net.IPNet) string {
+	return (&net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask}).String()
+}
+
+func (fw *nftablesFirewall) masqueradeRule(network *net.IPNet) string {
+	return fmt.Sprintf("ip saddr %s ip daddr != %s masquerade", nftablesNetwork(network), nftablesNetwork(network))
+}
+
+func (fw *nftablesFirewall) Masquerade(add bool, network *net.IPNet) error {
+	return fw.apply(add, "postrouting", fw.masqueradeRule(network))
+}
+
+func (fw *nftablesFirewall) Masqueraded(network *net.IPNet) bool {
+	fw.Lock()
+	defer fw.Unlock()
+	return fw.contains("postrouting", fw.masqueradeRule(network))
+}
+
+func (fw *nftablesFirewall) Hairpin(add bool, network *net.IPNet) error {
+	return fw.apply(add, "postrouting", fmt.Sprintf("ip saddr %s ip daddr %s ct status dnat masquerade", nftablesNetwork(network), nftablesNetwork(network)))
+}
+
+// The DNATed traffic is accepted by the forward chain before the isolation
+// rules are evaluated.
+func (fw *nftablesFirewall) Isolate(add bool, bridgeA, bridgeB string) error {
+	for _, pair := range [][2]string{{bridgeA, bridgeB}, {bridgeB, bridgeA}} {
+		if err := fw.apply(add, "isolation", fmt.Sprintf("iifname %q oifname %q drop", pair[0], pair[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fw *nftablesFirewall) IccAllow(add bool, bridge, src, dst string) error {
+	rule := fmt.Sprintf("iifname %q oifname %q ", bridge, bridge)
+	if src != "" {
+		rule += fmt.Sprintf("ip saddr %s ", src)
+	}
+	return fw.apply(add, "icc-allow", rule+fmt.Sprintf("ip daddr %s return", dst))
+}
+
+func (fw *nftablesFirewall) IccDeny(add bool, bridge, dst string) error {
+	rule := fmt.Sprintf("iifname %q oifname %q ", bridge, bridge)
+	if dst != "" {
+		rule += fmt.Sprintf("ip daddr %s ", dst)
+	}
+	return fw.apply(add, "icc-deny", rule+"drop")
+}
+
+func (fw *nftablesFirewall) Forward(add bool, proto string, port int, backendIP string, backendPort int) error {
+	rule := ""
+	// The userland proxy takes care of the traffic coming from the
+	// containers, unless it's disabled:
+	if UserlandProxy {
+		rule = fmt.Sprintf("iifname != %q ", NetworkBridgeIface)
+	}
+	rule += fmt.Sprintf("%s dport %d dnat to %s", proto, port, net.JoinHostPort(backendIP, strconv.Itoa(backendPort)))
+	return fw.apply(add, "ports", rule)
+}
+
+// The table is restored when it's missing, e.g: after a flush of the ruleset
+func (fw *nftablesFirewall) Reconcile() int {
+	fw.Lock()
+	defer fw.Unlock()
+	if nft(fmt.Sprintf("list table ip %s", nftablesTable)) == nil {
+		return 0
+	}
+	if err := fw.load(); err != nil {
+		log.Printf("Unable to restore the nftables table of docker: %s", err)
+		return 0
+	}
+	// The rules of the base chains and of the icc chain, and the rules of
+	// docker
+	restored := 6
+	for _, rules := range fw.rules {
+		restored += len(rules)
+	}
+	return restored
+}
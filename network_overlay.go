@@ -0,0 +1,455 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterNetworkDriver("overlay", newOverlayDriver)
+}
+
+const (
+	// The keys of the overlay driver in the cluster store
+	overlayStorePrefix = "/docker/overlay"
+	// The UDP port of the VXLAN tunnels (the one assigned by IANA)
+	vxlanPort = 4789
+	// The VXLAN network ids picked by docker start there
+	vxlanFirstVNI = 256
+	vxlanMaxVNI   = 1<<24 - 1
+)
+
+// How often the hosts of the overlay networks are looked up in the store
+var overlayPeersInterval = 5 * time.Second
+
+// Wrapper around the bridge command of iproute2
+func bridgeCmd(args ...string) error {
+	path, err := exec.LookPath("bridge")
+	if err != nil {
+		return fmt.Errorf("command not found: bridge")
+	}
+	if output, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("bridge failed: bridge %v: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// The overlay driver connects the containers of several hosts on a flat
+// subnet: the bridge of the network on each host is linked to the others
+// through a VXLAN tunnel. The networks, the hosts which joined them and the
+// addresses of the containers are kept in the cluster store, so every host
+// sees the same network. Each bridge has the address of the gateway, with a
+// MAC address of its host: the outgoing traffic of the containers leaves
+// through the host they run on and is masqueraded behind it.
+type overlayDriver struct {
+	sync.Mutex
+	store     kvStore
+	advertise net.IP
+	networks  map[string]*overlayNetwork
+}
+
+type overlayNetwork struct {
+	vni     int
+	subnet  *net.IPNet
+	gateway net.IP
+	bridge  string
+	vxlan   string
+
+	sync.Mutex
+	peers map[string]bool // the hosts the broadcasts are sent to
+	local map[string]bool // the addresses of the containers of this host
+	stop  chan bool
+}
+
+// What every host knows about an overlay network
+type overlayConfig struct {
+	Subnet string
+	VNI    int
+}
+
+func newOverlayDriver() (NetworkDriver, error) {
+	if ClusterStore == "" {
+		return nil, fmt.Errorf("The overlay driver needs a cluster store, start the daemon with -cluster-store")
+	}
+	store, err := newKVStore(ClusterStore)
+	if err != nil {
+		return nil, err
+	}
+	advertise := net.ParseIP(ClusterAdvertise)
+	if advertise == nil || advertise.To4() == nil {
+		return nil, fmt.Errorf("The overlay driver needs the IPv4 address of the host in the cluster, start the daemon with -cluster-advertise")
+	}
+	return &overlayDriver{
+		store:     store,
+		advertise: advertise,
+		networks:  make(map[string]*overlayNetwork),
+	}, nil
+}
+
+func (driver *overlayDriver) network(name string) (*overlayNetwork, error) {
+	driver.Lock()
+	defer driver.Unlock()
+	network, exists := driver.networks[name]
+	if !exists {
+		return nil, fmt.Errorf("No such network: %s", name)
+	}
+	return network, nil
+}
+
+func overlayKey(parts ...string) string {
+	return overlayStorePrefix + "/" + strings.Join(parts, "/")
+}
+
+// Pick a VXLAN network id no other overlay network uses
+func (driver *overlayDriver) claimVNI(name string) (int, error) {
+	for vni := vxlanFirstVNI; vni <= vxlanMaxVNI; vni++ {
+		err := driver.store.Create(overlayKey("vnis", strconv.Itoa(vni)), name)
+		if err == nil {
+			return vni, nil
+		} else if err != errKeyExists {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("No VXLAN network id left")
+}
+
+// Find the network name in the store, or add it there with options
+func (driver *overlayDriver) networkConfig(name string, options map[string]string) (*overlayConfig, error) {
+	config := &overlayConfig{}
+	value, err := driver.store.Get(overlayKey("networks", name))
+	if err == nil {
+		if err := json.Unmarshal([]byte(value), config); err != nil {
+			return nil, fmt.Errorf("Invalid overlay network %s in the cluster store: %s", name, err)
+		}
+		if options["subnet"] != "" && options["subnet"] != config.Subnet {
+			return nil, fmt.Errorf("Conflict: overlay network %s already exists with subnet %s", name, config.Subnet)
+		}
+		return config, nil
+	} else if err != errKeyNotFound {
+		return nil, err
+	}
+
+	if options["subnet"] == "" {
+		return nil, fmt.Errorf("Bad parameter: the overlay driver needs a subnet")
+	}
+	if _, subnet, err := net.ParseCIDR(options["subnet"]); err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("Bad parameter: invalid subnet %s", options["subnet"])
+	} else if ones, _ := subnet.Mask.Size(); ones > 30 {
+		return nil, fmt.Errorf("Bad parameter: subnet %s is too small", options["subnet"])
+	}
+	config.Subnet = options["subnet"]
+	if options["vni"] != "" {
+		if config.VNI, err = strconv.Atoi(options["vni"]); err != nil || config.VNI < 1 || config.VNI > vxlanMaxVNI {
+			return nil, fmt.Errorf("Bad parameter: invalid VXLAN network id %s", options["vni"])
+		}
+		if err := driver.store.Create(overlayKey("vnis", options["vni"]), name); err == errKeyExists {
+			return nil, fmt.Errorf("Conflict: VXLAN network id %s is already used", options["vni"])
+		} else if err != nil {
+			return nil, err
+		}
+	} else if config.VNI, err = driver.claimVNI(name); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := driver.store.Create(overlayKey("networks", name), string(data)); err == errKeyExists {
+		// Another host created it at the same time
+		driver.store.Delete(overlayKey("vnis", strconv.Itoa(config.VNI)))
+		return driver.networkConfig(name, options)
+	} else if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// The options are "subnet", the flat subnet of the containers of all the
+// hosts, and "vni", the VXLAN network id (picked by docker by default). They
+// are only needed on the first host: the others join the network with the
+// same name.
+func (driver *overlayDriver) CreateNetwork(name string, options map[string]string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	if _, exists := driver.networks[name]; exists {
+		return fmt.Errorf("Conflict: network %s already exists", name)
+	}
+	config, err := driver.networkConfig(name, options)
+	if err != nil {
+		return err
+	}
+	network := newOverlayNetwork(config)
+	if err := network.setupInterfaces(driver.advertise); err != nil {
+		network.removeInterfaces()
+		return err
+	}
+	if err := initFirewall(); err != nil {
+		network.removeInterfaces()
+		return err
+	}
+	if err := firewall.Masquerade(true, network.subnet); err != nil {
+		network.removeInterfaces()
+		return fmt.Errorf("Unable to enable the NAT of network %s: %s", name, err)
+	}
+	if err := driver.store.Put(overlayKey("hosts", name, driver.advertise.String()), ""); err != nil {
+		firewall.Masquerade(false, network.subnet)
+		network.removeInterfaces()
+		return err
+	}
+	driver.networks[name] = network
+	driver.syncPeers(name, network)
+	go func() {
+		for {
+			select {
+			case <-network.stop:
+				return
+			case <-time.After(overlayPeersInterval):
+				driver.syncPeers(name, network)
+			}
+		}
+	}()
+	return nil
+}
+
+// The gateway is the first address of the subnet
+func newOverlayNetwork(config *overlayConfig) *overlayNetwork {
+	_, subnet, _ := net.ParseCIDR(config.Subnet)
+	return &overlayNetwork{
+		vni:     config.VNI,
+		subnet:  subnet,
+		gateway: intToIP(ipToInt(subnet.IP) + 1),
+		bridge:  fmt.Sprintf("ov-%d", config.VNI),
+		vxlan:   fmt.Sprintf("vx-%d", config.VNI),
+		peers:   make(map[string]bool),
+		local:   make(map[string]bool),
+		stop:    make(chan bool),
+	}
+}
+
+// Create the bridge and the VXLAN interface of the network, unless they
+// already exist (e.g: the daemon restarted)
+func (network *overlayNetwork) setupInterfaces(local net.IP) error {
+	if _, err := net.InterfaceByName(network.bridge); err != nil {
+		mac := overlayGatewayMAC(local)
+		ones, _ := network.subnet.Mask.Size()
+		gateway := fmt.Sprintf("%s/%d", network.gateway, ones)
+		for _, args := range [][]string{
+			{"link", "add", network.bridge, "type", "bridge"},
+			{"link", "set", network.bridge, "address", mac},
+			{"addr", "add", gateway, "dev", network.bridge},
+			{"link", "set", network.bridge, "up"},
+		} {
+			if output, err := ip(args...); err != nil {
+				return fmt.Errorf("Unable to create the bridge %s: %s (%s)", network.bridge, err, output)
+			}
+		}
+	}
+	if _, err := net.InterfaceByName(network.vxlan); err != nil {
+		for _, args := range [][]string{
+			{"link", "add", network.vxlan, "type", "vxlan", "id", strconv.Itoa(network.vni), "local", local.String(), "dstport", strconv.Itoa(vxlanPort)},
+			{"link", "set", network.vxlan, "master", network.bridge},
+			{"link", "set", network.vxlan, "up"},
+		} {
+			if output, err := ip(args...); err != nil {
+				return fmt.Errorf("Unable to create the VXLAN interface %s: %s (%s)", network.vxlan, err, output)
+			}
+		}
+	}
+	return nil
+}
+
+// Remove the bridge and the VXLAN interface of the network
+func (network *overlayNetwork) removeInterfaces() {
+	ip("link", "del", network.vxlan)
+	if _, err := net.InterfaceByName(network.bridge); err == nil {
+		if err := DeleteBridgeIface(network.bridge); err != nil {
+			utils.Debugf("Unable to remove the bridge %s: %s", network.bridge, err)
+		}
+	}
+}
+
+// The MAC address of the gateway on the bridge of the host local. Every
+// host has the address of the gateway on the same segment: they must not
+// share a MAC address too, or the VXLAN interfaces would learn it from all
+// of them. A container keeps the first reply to its ARP request, the one of
+// its host.
+func overlayGatewayMAC(local net.IP) string {
+	ip := local.To4()
+	return fmt.Sprintf("02:42:%02x:%02x:%02x:%02x", ip[0], ip[1], ip[2], ip[3])
+}
+
+// Send the broadcasts of the network (e.g: ARP) to the hosts which joined it,
+// the addresses of the containers are then learnt from their traffic.
+func (driver *overlayDriver) syncPeers(name string, network *overlayNetwork) {
+	hosts, err := driver.store.List(overlayKey("hosts", name))
+	if err != nil {
+		utils.Debugf("Unable to list the hosts of network %s: %s", name, err)
+		return
+	}
+	delete(hosts, driver.advertise.String())
+	network.Lock()
+	defer network.Unlock()
+	for host := range hosts {
+		if network.peers[host] {
+			continue
+		}
+		if err := bridgeCmd("fdb", "append", "00:00:00:00:00:00", "dev", network.vxlan, "dst", host); err != nil {
+			log.Printf("WARNING: Unable to reach host %s on network %s: %s", host, name, err)
+			continue
+		}
+		network.peers[host] = true
+	}
+	for host := range network.peers {
+		if _, exists := hosts[host]; !exists {
+			bridgeCmd("fdb", "del", "00:00:00:00:00:00", "dev", network.vxlan, "dst", host)
+			delete(network.peers, host)
+		}
+	}
+}
+
+// The first address of subnet which isn't the gateway nor used, nil if
+// there is none
+func pickOverlayIP(subnet *net.IPNet, gateway net.IP, used map[string]string) net.IP {
+	first, last := networkRange(subnet)
+	for n := ipToInt(first) + 1; n < ipToInt(last); n++ {
+		ip := intToIP(n)
+		if _, exists := used[ip.String()]; !exists && !ip.Equal(gateway) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Claim ip for a container of this host. An address this host claimed
+// before isn't taken back, unless no container of the daemon uses it (e.g:
+// the daemon restarted).
+func (driver *overlayDriver) claimIP(name string, network *overlayNetwork, ip net.IP) error {
+	if !network.subnet.Contains(ip) || ip.Equal(network.gateway) {
+		return fmt.Errorf("Bad parameter: %s is not a valid address in %s", ip, network.subnet)
+	}
+	network.Lock()
+	defer network.Unlock()
+	if network.local[ip.String()] {
+		return fmt.Errorf("Conflict: %s is already allocated", ip)
+	}
+	err := driver.store.Create(overlayKey("ips", name, ip.String()), driver.advertise.String())
+	if err == errKeyExists {
+		if owner, _ := driver.store.Get(overlayKey("ips", name, ip.String())); owner != driver.advertise.String() {
+			return fmt.Errorf("Conflict: %s is already allocated", ip)
+		}
+	} else if err != nil {
+		return err
+	}
+	network.local[ip.String()] = true
+	return nil
+}
+
+func (driver *overlayDriver) CreateEndpoint(name string, ip net.IP) (*NetworkInterface, error) {
+	network, err := driver.network(name)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		err = driver.claimIP(name, network, ip)
+	} else {
+		// Another host might claim the same address first, try the next one
+		for ip == nil {
+			used, err := driver.store.List(overlayKey("ips", name))
+			if err != nil {
+				return nil, err
+			}
+			if ip = pickOverlayIP(network.subnet, network.gateway, used); ip == nil {
+				return nil, fmt.Errorf("No more IP addresses available on network %s", name)
+			}
+			if err := driver.store.Create(overlayKey("ips", name, ip.String()), driver.advertise.String()); err == errKeyExists {
+				ip = nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		network.Lock()
+		network.local[ip.String()] = true
+		network.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkInterface{
+		IPNet:   net.IPNet{IP: ip, Mask: network.subnet.Mask},
+		Gateway: network.gateway,
+	}, nil
+}
+
+func (driver *overlayDriver) Join(name string, iface *NetworkInterface, settings *NetworkSettings) error {
+	network, err := driver.network(name)
+	if err != nil {
+		return err
+	}
+	settings.Bridge = network.bridge
+	settings.IPAddress = iface.IPNet.IP.String()
+	settings.IPPrefixLen, _ = iface.IPNet.Mask.Size()
+	settings.Gateway = iface.Gateway.String()
+	return nil
+}
+
+func (driver *overlayDriver) Leave(name string, iface *NetworkInterface) error {
+	network, err := driver.network(name)
+	if err != nil {
+		return err
+	}
+	network.Lock()
+	delete(network.local, iface.IPNet.IP.String())
+	network.Unlock()
+	if err := driver.store.Delete(overlayKey("ips", name, iface.IPNet.IP.String())); err != nil && err != errKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// The host leaves the network; the network is removed from the store with
+// the last host.
+func (driver *overlayDriver) DeleteNetwork(name string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	network, exists := driver.networks[name]
+	if !exists {
+		return fmt.Errorf("No such network: %s", name)
+	}
+	close(network.stop)
+	if err := driver.store.Delete(overlayKey("hosts", name, driver.advertise.String())); err != nil && err != errKeyNotFound {
+		return err
+	}
+	firewall.Masquerade(false, network.subnet)
+	ip("link", "del", network.vxlan)
+	if err := DeleteBridgeIface(network.bridge); err != nil {
+		return err
+	}
+	delete(driver.networks, name)
+	if hosts, err := driver.store.List(overlayKey("hosts", name)); err == nil && len(hosts) == 0 {
+		driver.store.Delete(overlayKey("networks", name))
+		driver.store.Delete(overlayKey("vnis", strconv.Itoa(network.vni)))
+	}
+	return nil
+}
+
+func (driver *overlayDriver) NetworkInfo(name string) (*APINetwork, error) {
+	network, err := driver.network(name)
+	if err != nil {
+		return nil, err
+	}
+	return &APINetwork{
+		Name:    name,
+		Driver:  "overlay",
+		Bridge:  network.bridge,
+		Subnet:  network.subnet.String(),
+		Gateway: network.gateway.String(),
+	}, nil
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
@@ -8,34 +9,186 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
-	UDPConnTrackTimeout = 90 * time.Second
-	UDPBufSize          = 2048
+	DefaultUDPConnTrackTimeout = 90 * time.Second
+	UDPBufSize                 = 2048
 )
 
+// How long an idle UDP "connection" is kept in the proxies connection
+// tracking table, can be changed before the proxies are created (e.g: from a
+// daemon flag):
+var UDPConnTrackTimeout = DefaultUDPConnTrackTimeout
+
+// Version of the HAProxy PROXY protocol header sent to the backends by the
+// TCP proxies created with NewProxy, 0 to disable it:
+var ProxyProtocolVersion = 0
+
 type Proxy interface {
 	// Start forwarding traffic back and forth the front and back-end
 	// addresses.
 	Run()
 	// Stop forwarding traffic and close both ends of the Proxy.
 	Close()
+	// Stop accepting new connections but let the established ones finish,
+	// for at most timeout, before closing the Proxy.
+	Drain(timeout time.Duration)
 	// Return the address on which the proxy is listening.
 	FrontendAddr() net.Addr
 	// Return the proxied address.
 	BackendAddr() net.Addr
+	// Return a snapshot of the traffic counters of the proxy.
+	Stats() ProxyStats
+}
+
+// Traffic counters of a Proxy. BytesIn is what the clients sent to the
+// backend and BytesOut what the backend sent back. For UDP a "connection" is
+// an entry of the connection tracking table.
+type ProxyStats struct {
+	ActiveConnections int64
+	TotalAccepted     int64
+	BytesIn           int64
+	BytesOut          int64
+	Errors            int64
+}
+
+// ProxyAccess describes a client connection (or UDP flow) once it's over.
+type ProxyAccess struct {
+	Proto        string
+	ClientAddr   net.Addr
+	FrontendAddr net.Addr
+	BackendAddr  net.Addr
+	BytesIn      int64
+	BytesOut     int64
+	Duration     time.Duration
+}
+
+// A ProxyAccessLogger can be plugged on the proxies to audit who connected to
+// the published ports.
+type ProxyAccessLogger interface {
+	LogAccess(access *ProxyAccess)
+}
+
+// Access logger used by the proxies created with NewProxy, nil to disable
+// access logging:
+var ProxyAccessLog ProxyAccessLogger
+
+type writerAccessLogger struct {
+	logger *log.Logger
 }
 
+// Return a ProxyAccessLogger writing one line per access to w.
+func NewProxyAccessLogger(w io.Writer) ProxyAccessLogger {
+	return &writerAccessLogger{logger: log.New(w, "", log.LstdFlags)}
+}
+
+func (l *writerAccessLogger) LogAccess(access *ProxyAccess) {
+	l.logger.Printf("%s %v -> %v -> %v in=%d out=%d duration=%v", access.Proto, access.ClientAddr, access.FrontendAddr, access.BackendAddr, access.BytesIn, access.BytesOut, access.Duration)
+}
+
+// The counters are updated with sync/atomic, hence ProxyStats must be the
+// first field of the proxies structs to be correctly aligned on 32 bits
+// platforms.
+func (stats *ProxyStats) snapshot() ProxyStats {
+	return ProxyStats{
+		ActiveConnections: atomic.LoadInt64(&stats.ActiveConnections),
+		TotalAccepted:     atomic.LoadInt64(&stats.TotalAccepted),
+		BytesIn:           atomic.LoadInt64(&stats.BytesIn),
+		BytesOut:          atomic.LoadInt64(&stats.BytesOut),
+		Errors:            atomic.LoadInt64(&stats.Errors),
+	}
+}
+
+// Limits enforced by a TCPProxy, the zero value means no limits.
+type ProxyLimits struct {
+	// Maximum number of concurrent client connections.
+	MaxConnections int
+	// Bandwidth, in bytes per second, shared by all the connections and
+	// both directions.
+	RateLimit int64
+}
+
+func (limits ProxyLimits) Unlimited() bool {
+	return limits.MaxConnections == 0 && limits.RateLimit == 0
+}
+
+// A token bucket refilled at rate bytes per second and holding at most one
+// second worth of tokens.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Take n tokens, sleeping if the bucket doesn't hold enough of them. The
+// bucket can go into debt so large reads don't starve.
+func (bucket *tokenBucket) take(n int) {
+	bucket.Lock()
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.rate {
+		bucket.tokens = bucket.rate
+	}
+	bucket.last = now
+	bucket.tokens -= float64(n)
+	debt := -bucket.tokens
+	bucket.Unlock()
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / bucket.rate * float64(time.Second)))
+	}
+}
+
+type rateLimitedReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (reader *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := reader.r.Read(p)
+	reader.bucket.take(n)
+	return n, err
+}
+
+// TCPProxy forwards TCP connections to a backend which can either be a
+// *net.TCPAddr or a *net.UnixAddr (e.g: a service only listening on a unix
+// socket inside the container).
 type TCPProxy struct {
-	listener     *net.TCPListener
+	stats        ProxyStats
+	clientsCount int64
+	listeners    []*net.TCPListener
 	frontendAddr *net.TCPAddr
-	backendAddr  *net.TCPAddr
+	backendAddr  net.Addr
+	clients      sync.WaitGroup
+	lock         sync.Mutex // Protects closed, and the clients added after it's set
+	closed       bool
+	quit         chan bool
+	quitOnce     sync.Once
+	// Version (1 or 2) of the PROXY protocol header to send to the
+	// backend before any data, so it can recover the real address of the
+	// client; 0 to disable it. Must be set before Run is called.
+	ProxyProtocol int
+	// Called once each client connection is done, can be nil.
+	AccessLog ProxyAccessLogger
+	// Must be set before Run is called.
+	ProxyLimits
+	bucket *tokenBucket
 }
 
-func NewTCPProxy(frontendAddr, backendAddr *net.TCPAddr) (*TCPProxy, error) {
+func NewTCPProxy(frontendAddr *net.TCPAddr, backendAddr net.Addr) (*TCPProxy, error) {
+	switch backendAddr.(type) {
+	case *net.TCPAddr, *net.UnixAddr:
+	default:
+		return nil, fmt.Errorf("Unsupported backend for a tcp proxy: %v/%v", backendAddr.Network(), backendAddr)
+	}
 	listener, err := net.ListenTCP("tcp", frontendAddr)
 	if err != nil {
 		return nil, err
@@ -43,23 +196,145 @@ func NewTCPProxy(frontendAddr, backendAddr *net.TCPAddr) (*TCPProxy, error) {
 	// If the port in frontendAddr was 0 then ListenTCP will have a picked
 	// a port to listen on, hence the call to Addr to get that actual port:
 	return &TCPProxy{
-		listener:     listener,
+		listeners:    []*net.TCPListener{listener},
 		frontendAddr: listener.Addr().(*net.TCPAddr),
 		backendAddr:  backendAddr,
+		quit:         make(chan bool),
 	}, nil
 }
 
-func (proxy *TCPProxy) clientLoop(client *net.TCPConn, quit chan bool) {
-	backend, err := net.DialTCP("tcp", nil, proxy.backendAddr)
+// Return the IPv4 address which should be served alongside the given IPv6
+// address in dual-stack mode, or nil if there is none.
+func dualStackPeer(ip net.IP) net.IP {
+	switch {
+	case ip.Equal(net.IPv6loopback):
+		return net.IPv4(127, 0, 0, 1)
+	case ip.Equal(net.IPv6unspecified):
+		return net.IPv4zero
+	}
+	return nil
+}
+
+// NewDualStackTCPProxy works like NewTCPProxy but, when frontendAddr is the
+// IPv6 loopback or wildcard address, it also listens on the IPv4 equivalent
+// on the same port so a single proxy serves both address families.
+func NewDualStackTCPProxy(frontendAddr *net.TCPAddr, backendAddr net.Addr) (*TCPProxy, error) {
+	peerIP := dualStackPeer(frontendAddr.IP)
+	if peerIP == nil {
+		return NewTCPProxy(frontendAddr, backendAddr)
+	}
+	proxy, err := NewTCPProxy(frontendAddr, backendAddr)
 	if err != nil {
-		log.Printf("Can't forward traffic to backend tcp/%v: %v\n", proxy.backendAddr, err.Error())
-		client.Close()
-		return
+		// The host might not have IPv6 at all, try to fallback on IPv4:
+		utils.Debugf("Can't listen on tcp/%v, falling back to IPv4: %v", frontendAddr, err)
+		return NewTCPProxy(&net.TCPAddr{IP: peerIP, Port: frontendAddr.Port}, backendAddr)
 	}
+	peerAddr := &net.TCPAddr{IP: peerIP, Port: proxy.frontendAddr.Port}
+	listener, err := net.ListenTCP("tcp4", peerAddr)
+	if err != nil {
+		// On a wildcard address the IPv6 socket usually accepts IPv4
+		// connections already (IPV6_V6ONLY is off), in which case the
+		// bind fails with EADDRINUSE and there is nothing left to do:
+		if peerIP.Equal(net.IPv4zero) {
+			return proxy, nil
+		}
+		proxy.Close()
+		return nil, err
+	}
+	proxy.listeners = append(proxy.listeners, listener)
+	return proxy, nil
+}
+
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// Write the PROXY protocol header (see
+// http://haproxy.1wt.eu/download/1.5/doc/proxy-protocol.txt) describing a
+// connection from src to dst.
+func writeProxyProtocolHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcAddr, srcIsTCP := src.(*net.TCPAddr)
+	dstAddr, dstIsTCP := dst.(*net.TCPAddr)
+	isTCP := srcIsTCP && dstIsTCP
+	isIPv4 := isTCP && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+
+	var header bytes.Buffer
+	switch version {
+	case 1:
+		switch {
+		case !isTCP:
+			header.WriteString("PROXY UNKNOWN\r\n")
+		case isIPv4:
+			fmt.Fprintf(&header, "PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP.To4(), dstAddr.IP.To4(), srcAddr.Port, dstAddr.Port)
+		default:
+			fmt.Fprintf(&header, "PROXY TCP6 %s %s %d %d\r\n", srcAddr.IP.To16(), dstAddr.IP.To16(), srcAddr.Port, dstAddr.Port)
+		}
+	case 2:
+		header.Write(proxyProtocolV2Signature)
+		// Version 2, PROXY command:
+		header.WriteByte(0x21)
+		var addrs []byte
+		switch {
+		case !isTCP:
+			// AF_UNSPEC, UNSPEC:
+			header.WriteByte(0x00)
+		case isIPv4:
+			// AF_INET, STREAM:
+			header.WriteByte(0x11)
+			addrs = append(append(addrs, srcAddr.IP.To4()...), dstAddr.IP.To4()...)
+		default:
+			// AF_INET6, STREAM:
+			header.WriteByte(0x21)
+			addrs = append(append(addrs, srcAddr.IP.To16()...), dstAddr.IP.To16()...)
+		}
+		if addrs != nil {
+			ports := make([]byte, 4)
+			binary.BigEndian.PutUint16(ports[0:], uint16(srcAddr.Port))
+			binary.BigEndian.PutUint16(ports[2:], uint16(dstAddr.Port))
+			addrs = append(addrs, ports...)
+		}
+		binary.Write(&header, binary.BigEndian, uint16(len(addrs)))
+		header.Write(addrs)
+	default:
+		return fmt.Errorf("Unsupported PROXY protocol version: %d", version)
+	}
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+// Wait for wg, return false if it took longer than timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
 
+// A stream-oriented connection which can be half-closed, e.g: *net.TCPConn or
+// *SCTPConn.
+type halfCloser interface {
+	io.ReadWriteCloser
+	CloseRead() error
+	CloseWrite() error
+	RemoteAddr() net.Addr
+}
+
+// Copy data back and forth between client and backend until both directions
+// are done or quit is closed, and return the number of bytes sent by the
+// client and by the backend.
+func brokerStreams(client, backend halfCloser, quit chan bool, stats *ProxyStats, bucket *tokenBucket) (bytesIn, bytesOut int64) {
 	event := make(chan int64)
-	var broker = func(to, from *net.TCPConn) {
-		written, err := io.Copy(to, from)
+	var broker = func(to, from halfCloser, counter, local *int64) {
+		var src io.Reader = from
+		if bucket != nil {
+			src = &rateLimitedReader{r: from, bucket: bucket}
+		}
+		written, err := io.Copy(to, src)
 		if err != nil {
 			err, ok := err.(*net.OpError)
 			// If the socket we are writing to is shutdown with
@@ -69,50 +344,159 @@ func (proxy *TCPProxy) clientLoop(client *net.TCPConn, quit chan bool) {
 			}
 		}
 		to.CloseRead()
+		atomic.AddInt64(counter, written)
+		*local = written
 		event <- written
 	}
-	utils.Debugf("Forwarding traffic between tcp/%v and tcp/%v", client.RemoteAddr(), backend.RemoteAddr())
-	go broker(client, backend)
-	go broker(backend, client)
+	atomic.AddInt64(&stats.ActiveConnections, 1)
+	defer atomic.AddInt64(&stats.ActiveConnections, -1)
+	go broker(client, backend, &stats.BytesOut, &bytesOut)
+	go broker(backend, client, &stats.BytesIn, &bytesIn)
 
-	var transferred int64 = 0
 	for i := 0; i < 2; i++ {
 		select {
-		case written := <-event:
-			transferred += written
+		case <-event:
 		case <-quit:
 			// Interrupt the two brokers and "join" them.
 			client.Close()
 			backend.Close()
 			for ; i < 2; i++ {
-				transferred += <-event
+				<-event
 			}
-			goto done
+			return
 		}
 	}
 	client.Close()
 	backend.Close()
-done:
-	utils.Debugf("%v bytes transferred between tcp/%v and tcp/%v", transferred, client.RemoteAddr(), backend.RemoteAddr())
+	return
 }
 
-func (proxy *TCPProxy) Run() {
-	quit := make(chan bool)
-	defer close(quit)
-	utils.Debugf("Starting proxy on tcp/%v for tcp/%v", proxy.frontendAddr, proxy.backendAddr)
+func (proxy *TCPProxy) dialBackend() (halfCloser, error) {
+	switch backendAddr := proxy.backendAddr.(type) {
+	case *net.UnixAddr:
+		return net.DialUnix("unix", nil, backendAddr)
+	default:
+		return net.DialTCP("tcp", nil, backendAddr.(*net.TCPAddr))
+	}
+}
+
+func (proxy *TCPProxy) clientLoop(client *net.TCPConn, quit chan bool) {
+	defer proxy.clients.Done()
+	defer atomic.AddInt64(&proxy.clientsCount, -1)
+	start := time.Now()
+	atomic.AddInt64(&proxy.stats.TotalAccepted, 1)
+	backendProto := proxy.backendAddr.Network()
+	backend, err := proxy.dialBackend()
+	if err != nil {
+		atomic.AddInt64(&proxy.stats.Errors, 1)
+		log.Printf("Can't forward traffic to backend %v/%v: %v\n", backendProto, proxy.backendAddr, err.Error())
+		client.Close()
+		return
+	}
+
+	if proxy.ProxyProtocol != 0 {
+		if err := writeProxyProtocolHeader(backend, proxy.ProxyProtocol, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			atomic.AddInt64(&proxy.stats.Errors, 1)
+			log.Printf("Can't send the PROXY protocol header to %v/%v: %v\n", backendProto, proxy.backendAddr, err.Error())
+			client.Close()
+			backend.Close()
+			return
+		}
+	}
+
+	utils.Debugf("Forwarding traffic between tcp/%v and %v/%v", client.RemoteAddr(), backendProto, proxy.backendAddr)
+	bytesIn, bytesOut := brokerStreams(client, backend, quit, &proxy.stats, proxy.bucket)
+	utils.Debugf("%v bytes transferred between tcp/%v and %v/%v", bytesIn+bytesOut, client.RemoteAddr(), backendProto, proxy.backendAddr)
+	if proxy.AccessLog != nil {
+		proxy.AccessLog.LogAccess(&ProxyAccess{
+			Proto:        "tcp",
+			ClientAddr:   client.RemoteAddr(),
+			FrontendAddr: client.LocalAddr(),
+			BackendAddr:  proxy.backendAddr,
+			BytesIn:      bytesIn,
+			BytesOut:     bytesOut,
+			Duration:     time.Since(start),
+		})
+	}
+}
+
+func (proxy *TCPProxy) acceptLoop(listener *net.TCPListener) {
 	for {
-		client, err := proxy.listener.Accept()
+		client, err := listener.Accept()
 		if err != nil {
-			utils.Debugf("Stopping proxy on tcp/%v for tcp/%v (%v)", proxy.frontendAddr, proxy.backendAddr, err.Error())
+			utils.Debugf("Stopping proxy on tcp/%v for %v/%v (%v)", listener.Addr(), proxy.backendAddr.Network(), proxy.backendAddr, err.Error())
 			return
 		}
-		go proxy.clientLoop(client.(*net.TCPConn), quit)
+		count := atomic.AddInt64(&proxy.clientsCount, 1)
+		if proxy.MaxConnections != 0 && count > int64(proxy.MaxConnections) {
+			atomic.AddInt64(&proxy.clientsCount, -1)
+			atomic.AddInt64(&proxy.stats.Errors, 1)
+			utils.Debugf("Too many connections on tcp/%v, rejecting tcp/%v", listener.Addr(), client.RemoteAddr())
+			client.Close()
+			continue
+		}
+		if !proxy.addClient() {
+			atomic.AddInt64(&proxy.clientsCount, -1)
+			client.Close()
+			continue
+		}
+		go proxy.clientLoop(client.(*net.TCPConn), proxy.quit)
 	}
 }
 
-func (proxy *TCPProxy) Close()                 { proxy.listener.Close() }
+// Count a client accepted in the clients Drain waits for, false if the
+// proxy was closed since: Drain may be waiting already
+func (proxy *TCPProxy) addClient() bool {
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	if proxy.closed {
+		return false
+	}
+	proxy.clients.Add(1)
+	return true
+}
+
+func (proxy *TCPProxy) Run() {
+	if proxy.RateLimit != 0 {
+		proxy.bucket = newTokenBucket(proxy.RateLimit)
+	}
+	utils.Debugf("Starting proxy on tcp/%v for %v/%v", proxy.frontendAddr, proxy.backendAddr.Network(), proxy.backendAddr)
+	var wg sync.WaitGroup
+	for _, listener := range proxy.listeners {
+		wg.Add(1)
+		go func(listener *net.TCPListener) {
+			defer wg.Done()
+			proxy.acceptLoop(listener)
+		}(listener)
+	}
+	wg.Wait()
+}
+
+func (proxy *TCPProxy) closeListeners() {
+	proxy.lock.Lock()
+	proxy.closed = true
+	proxy.lock.Unlock()
+	for _, listener := range proxy.listeners {
+		listener.Close()
+	}
+}
+
+func (proxy *TCPProxy) Close() {
+	proxy.closeListeners()
+	proxy.quitOnce.Do(func() { close(proxy.quit) })
+}
+
+func (proxy *TCPProxy) Drain(timeout time.Duration) {
+	proxy.closeListeners()
+	if !waitTimeout(&proxy.clients, timeout) {
+		utils.Debugf("Connections to tcp/%v still open after %v, closing them", proxy.frontendAddr, timeout)
+	}
+	proxy.Close()
+}
+
 func (proxy *TCPProxy) FrontendAddr() net.Addr { return proxy.frontendAddr }
 func (proxy *TCPProxy) BackendAddr() net.Addr  { return proxy.backendAddr }
+func (proxy *TCPProxy) Stats() ProxyStats      { return proxy.stats.snapshot() }
 
 // A net.Addr where the IP is split into two fields so you can use it as a key
 // in a map:
@@ -137,41 +521,72 @@ func newConnTrackKey(addr *net.UDPAddr) *connTrackKey {
 	}
 }
 
-type connTrackMap map[connTrackKey]*net.UDPConn
+// A UDP "connection" between a client and the backend.
+type udpFlow struct {
+	*net.UDPConn
+	created  time.Time
+	bytesIn  int64
+	bytesOut int64
+}
+
+type connTrackMap map[connTrackKey]*udpFlow
 
 type UDPProxy struct {
-	listener       *net.UDPConn
-	frontendAddr   *net.UDPAddr
-	backendAddr    *net.UDPAddr
-	connTrackTable connTrackMap
-	connTrackLock  sync.Mutex
+	stats            ProxyStats
+	listener         *net.UDPConn
+	frontendAddr     *net.UDPAddr
+	backendAddr      *net.UDPAddr
+	connTrackTable   connTrackMap
+	connTrackLock    sync.Mutex
+	connTrackTimeout time.Duration
+	// Called once each UDP flow expires, can be nil.
+	AccessLog ProxyAccessLogger
 }
 
-func NewUDPProxy(frontendAddr, backendAddr *net.UDPAddr) (*UDPProxy, error) {
+// NewUDPProxy creates a proxy which forgets about a client after it has been
+// idle for connTrackTimeout, if connTrackTimeout isn't strictly positive
+// DefaultUDPConnTrackTimeout is used.
+func NewUDPProxy(frontendAddr, backendAddr *net.UDPAddr, connTrackTimeout time.Duration) (*UDPProxy, error) {
+	if connTrackTimeout <= 0 {
+		connTrackTimeout = DefaultUDPConnTrackTimeout
+	}
 	listener, err := net.ListenUDP("udp", frontendAddr)
 	if err != nil {
 		return nil, err
 	}
 	return &UDPProxy{
-		listener:       listener,
-		frontendAddr:   listener.LocalAddr().(*net.UDPAddr),
-		backendAddr:    backendAddr,
-		connTrackTable: make(connTrackMap),
+		listener:         listener,
+		frontendAddr:     listener.LocalAddr().(*net.UDPAddr),
+		backendAddr:      backendAddr,
+		connTrackTable:   make(connTrackMap),
+		connTrackTimeout: connTrackTimeout,
 	}, nil
 }
 
-func (proxy *UDPProxy) replyLoop(proxyConn *net.UDPConn, clientAddr *net.UDPAddr, clientKey *connTrackKey) {
+func (proxy *UDPProxy) replyLoop(proxyConn *udpFlow, clientAddr *net.UDPAddr, clientKey *connTrackKey) {
 	defer func() {
 		proxy.connTrackLock.Lock()
 		delete(proxy.connTrackTable, *clientKey)
 		proxy.connTrackLock.Unlock()
+		atomic.AddInt64(&proxy.stats.ActiveConnections, -1)
 		utils.Debugf("Done proxying between udp/%v and udp/%v", clientAddr.String(), proxy.backendAddr.String())
 		proxyConn.Close()
+		if proxy.AccessLog != nil {
+			proxy.AccessLog.LogAccess(&ProxyAccess{
+				Proto:        "udp",
+				ClientAddr:   clientAddr,
+				FrontendAddr: proxy.frontendAddr,
+				BackendAddr:  proxy.backendAddr,
+				BytesIn:      atomic.LoadInt64(&proxyConn.bytesIn),
+				BytesOut:     atomic.LoadInt64(&proxyConn.bytesOut),
+				Duration:     time.Since(proxyConn.created),
+			})
+		}
 	}()
 
 	readBuf := make([]byte, UDPBufSize)
 	for {
-		proxyConn.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout))
+		proxyConn.SetReadDeadline(time.Now().Add(proxy.connTrackTimeout))
 	again:
 		read, err := proxyConn.Read(readBuf)
 		if err != nil {
@@ -179,7 +594,7 @@ func (proxy *UDPProxy) replyLoop(proxyConn *net.UDPConn, clientAddr *net.UDPAddr
 				// This will happen if the last write failed
 				// (e.g: nothing is actually listening on the
 				// proxied port on the container), ignore it
-				// and continue until UDPConnTrackTimeout
+				// and continue until connTrackTimeout
 				// expires:
 				goto again
 			}
@@ -188,9 +603,12 @@ func (proxy *UDPProxy) replyLoop(proxyConn *net.UDPConn, clientAddr *net.UDPAddr
 		for i := 0; i != read; {
 			written, err := proxy.listener.WriteToUDP(readBuf[i:read], clientAddr)
 			if err != nil {
+				atomic.AddInt64(&proxy.stats.Errors, 1)
 				return
 			}
 			i += written
+			atomic.AddInt64(&proxy.stats.BytesOut, int64(written))
+			atomic.AddInt64(&proxyConn.bytesOut, int64(written))
 			utils.Debugf("Forwarded %v/%v bytes to udp/%v", i, read, clientAddr.String())
 		}
 	}
@@ -213,22 +631,30 @@ func (proxy *UDPProxy) Run() {
 		proxy.connTrackLock.Lock()
 		proxyConn, hit := proxy.connTrackTable[*fromKey]
 		if !hit {
-			proxyConn, err = net.DialUDP("udp", nil, proxy.backendAddr)
+			conn, err := net.DialUDP("udp", nil, proxy.backendAddr)
 			if err != nil {
+				proxy.connTrackLock.Unlock()
+				atomic.AddInt64(&proxy.stats.Errors, 1)
 				log.Printf("Can't proxy a datagram to udp/%s: %v\n", proxy.backendAddr.String(), err)
 				continue
 			}
+			proxyConn = &udpFlow{UDPConn: conn, created: time.Now()}
 			proxy.connTrackTable[*fromKey] = proxyConn
+			atomic.AddInt64(&proxy.stats.TotalAccepted, 1)
+			atomic.AddInt64(&proxy.stats.ActiveConnections, 1)
 			go proxy.replyLoop(proxyConn, from, fromKey)
 		}
 		proxy.connTrackLock.Unlock()
 		for i := 0; i != read; {
 			written, err := proxyConn.Write(readBuf[i:read])
 			if err != nil {
+				atomic.AddInt64(&proxy.stats.Errors, 1)
 				log.Printf("Can't proxy a datagram to udp/%s: %v\n", proxy.backendAddr.String(), err)
 				break
 			}
 			i += written
+			atomic.AddInt64(&proxy.stats.BytesIn, int64(written))
+			atomic.AddInt64(&proxyConn.bytesIn, int64(written))
 			utils.Debugf("Forwarded %v/%v bytes to udp/%v", i, read, proxy.backendAddr.String())
 		}
 	}
@@ -243,16 +669,162 @@ func (proxy *UDPProxy) Close() {
 	}
 }
 
+// There is no such thing as an established session with UDP, the flows are
+// just dropped.
+func (proxy *UDPProxy) Drain(timeout time.Duration) { proxy.Close() }
+
 func (proxy *UDPProxy) FrontendAddr() net.Addr { return proxy.frontendAddr }
 func (proxy *UDPProxy) BackendAddr() net.Addr  { return proxy.backendAddr }
+func (proxy *UDPProxy) Stats() ProxyStats      { return proxy.stats.snapshot() }
+
+type SCTPProxy struct {
+	stats        ProxyStats
+	listener     *SCTPListener
+	frontendAddr *SCTPAddr
+	backendAddr  *SCTPAddr
+	clients      sync.WaitGroup
+	lock         sync.Mutex // Protects closed, and the clients added after it's set
+	closed       bool
+	quit         chan bool
+	quitOnce     sync.Once
+	// Called once each client connection is done, can be nil.
+	AccessLog ProxyAccessLogger
+}
+
+func NewSCTPProxy(frontendAddr, backendAddr *SCTPAddr) (*SCTPProxy, error) {
+	listener, err := ListenSCTP(frontendAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &SCTPProxy{
+		listener:     listener,
+		frontendAddr: listener.Addr().(*SCTPAddr),
+		backendAddr:  backendAddr,
+		quit:         make(chan bool),
+	}, nil
+}
+
+func (proxy *SCTPProxy) clientLoop(client *SCTPConn, quit chan bool) {
+	defer proxy.clients.Done()
+	start := time.Now()
+	atomic.AddInt64(&proxy.stats.TotalAccepted, 1)
+	backend, err := DialSCTP(proxy.backendAddr)
+	if err != nil {
+		atomic.AddInt64(&proxy.stats.Errors, 1)
+		log.Printf("Can't forward traffic to backend sctp/%v: %v\n", proxy.backendAddr, err.Error())
+		client.Close()
+		return
+	}
+
+	utils.Debugf("Forwarding traffic between sctp/%v and sctp/%v", client.RemoteAddr(), backend.RemoteAddr())
+	bytesIn, bytesOut := brokerStreams(client, backend, quit, &proxy.stats, nil)
+	utils.Debugf("%v bytes transferred between sctp/%v and sctp/%v", bytesIn+bytesOut, client.RemoteAddr(), backend.RemoteAddr())
+	if proxy.AccessLog != nil {
+		proxy.AccessLog.LogAccess(&ProxyAccess{
+			Proto:        "sctp",
+			ClientAddr:   client.RemoteAddr(),
+			FrontendAddr: client.LocalAddr(),
+			BackendAddr:  proxy.backendAddr,
+			BytesIn:      bytesIn,
+			BytesOut:     bytesOut,
+			Duration:     time.Since(start),
+		})
+	}
+}
+
+func (proxy *SCTPProxy) Run() {
+	utils.Debugf("Starting proxy on sctp/%v for sctp/%v", proxy.frontendAddr, proxy.backendAddr)
+	for {
+		client, err := proxy.listener.Accept()
+		if err != nil {
+			utils.Debugf("Stopping proxy on sctp/%v for sctp/%v (%v)", proxy.frontendAddr, proxy.backendAddr, err.Error())
+			return
+		}
+		if !proxy.addClient() {
+			client.Close()
+			continue
+		}
+		go proxy.clientLoop(client, proxy.quit)
+	}
+}
+
+// Count a client accepted in the clients Drain waits for, false if the
+// proxy was closed since: Drain may be waiting already
+func (proxy *SCTPProxy) addClient() bool {
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	if proxy.closed {
+		return false
+	}
+	proxy.clients.Add(1)
+	return true
+}
+
+func (proxy *SCTPProxy) closeListener() {
+	proxy.lock.Lock()
+	proxy.closed = true
+	proxy.lock.Unlock()
+	proxy.listener.Close()
+}
+
+func (proxy *SCTPProxy) Close() {
+	proxy.closeListener()
+	proxy.quitOnce.Do(func() { close(proxy.quit) })
+}
+
+func (proxy *SCTPProxy) Drain(timeout time.Duration) {
+	proxy.closeListener()
+	if !waitTimeout(&proxy.clients, timeout) {
+		utils.Debugf("Connections to sctp/%v still open after %v, closing them", proxy.frontendAddr, timeout)
+	}
+	proxy.Close()
+}
+
+func (proxy *SCTPProxy) FrontendAddr() net.Addr { return proxy.frontendAddr }
+func (proxy *SCTPProxy) BackendAddr() net.Addr  { return proxy.backendAddr }
+func (proxy *SCTPProxy) Stats() ProxyStats      { return proxy.stats.snapshot() }
 
 func NewProxy(frontendAddr, backendAddr net.Addr) (Proxy, error) {
 	switch frontendAddr.(type) {
 	case *net.UDPAddr:
-		return NewUDPProxy(frontendAddr.(*net.UDPAddr), backendAddr.(*net.UDPAddr))
+		proxy, err := NewUDPProxy(frontendAddr.(*net.UDPAddr), backendAddr.(*net.UDPAddr), UDPConnTrackTimeout)
+		if err != nil {
+			return nil, err
+		}
+		proxy.AccessLog = ProxyAccessLog
+		return proxy, nil
 	case *net.TCPAddr:
-		return NewTCPProxy(frontendAddr.(*net.TCPAddr), backendAddr.(*net.TCPAddr))
+		proxy, err := NewTCPProxy(frontendAddr.(*net.TCPAddr), backendAddr)
+		if err != nil {
+			return nil, err
+		}
+		proxy.ProxyProtocol = ProxyProtocolVersion
+		proxy.AccessLog = ProxyAccessLog
+		return proxy, nil
+	case *SCTPAddr:
+		proxy, err := NewSCTPProxy(frontendAddr.(*SCTPAddr), backendAddr.(*SCTPAddr))
+		if err != nil {
+			return nil, err
+		}
+		proxy.AccessLog = ProxyAccessLog
+		return proxy, nil
 	default:
 		panic(fmt.Errorf("Unsupported protocol"))
 	}
 }
+
+// NewDualStackProxy returns a Proxy serving both IPv4 and IPv6 clients for
+// TCP frontends (see NewDualStackTCPProxy), other protocols are handled like
+// in NewProxy.
+func NewDualStackProxy(frontendAddr, backendAddr net.Addr) (Proxy, error) {
+	if frontendAddr, isTCP := frontendAddr.(*net.TCPAddr); isTCP {
+		proxy, err := NewDualStackTCPProxy(frontendAddr, backendAddr)
+		if err != nil {
+			return nil, err
+		}
+		proxy.ProxyProtocol = ProxyProtocolVersion
+		proxy.AccessLog = ProxyAccessLog
+		return proxy, nil
+	}
+	return NewProxy(frontendAddr, backendAddr)
+}
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -19,6 +23,11 @@ type EchoServer interface {
 	LocalAddr() net.Addr
 }
 
+type SCTPEchoServer struct {
+	listener *SCTPListener
+	testCtx  *testing.T
+}
+
 type TCPEchoServer struct {
 	listener net.Listener
 	testCtx  *testing.T
@@ -31,7 +40,21 @@ type UDPEchoServer struct {
 
 func NewEchoServer(t *testing.T, proto, address string) EchoServer {
 	var server EchoServer
-	if strings.HasPrefix(proto, "tcp") {
+	if proto == "sctp" {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := ListenSCTP(&SCTPAddr{IP: net.ParseIP(host), Port: portNum})
+		if err != nil {
+			t.Skipf("SCTP is not supported on this host: %v", err)
+		}
+		server = &SCTPEchoServer{listener: listener, testCtx: t}
+	} else if strings.HasPrefix(proto, "tcp") || proto == "unix" {
 		listener, err := net.Listen(proto, address)
 		if err != nil {
 			t.Fatal(err)
@@ -71,6 +94,29 @@ func (server *TCPEchoServer) Run() {
 func (server *TCPEchoServer) LocalAddr() net.Addr { return server.listener.Addr() }
 func (server *TCPEchoServer) Close()              { server.listener.Addr() }
 
+func (server *SCTPEchoServer) Run() {
+	go func() {
+		for {
+			client, err := server.listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(client *SCTPConn) {
+				server.testCtx.Logf("SCTP client accepted on the EchoServer\n")
+				written, err := io.Copy(client, client)
+				server.testCtx.Logf("%v bytes echoed back to the client\n", written)
+				if err != nil {
+					server.testCtx.Logf("can't echo to the client: %v\n", err.Error())
+				}
+				client.Close()
+			}(client)
+		}
+	}()
+}
+
+func (server *SCTPEchoServer) LocalAddr() net.Addr { return server.listener.Addr() }
+func (server *SCTPEchoServer) Close()              { server.listener.Close() }
+
 func (server *UDPEchoServer) Run() {
 	go func() {
 		readBuf := make([]byte, 1024)
@@ -115,6 +161,26 @@ func testProxyAt(t *testing.T, proto string, proxy Proxy, addr string) {
 	}
 }
 
+func testSCTPProxy(t *testing.T, proxy Proxy) {
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := DialSCTP(proxy.FrontendAddr().(*SCTPAddr))
+	if err != nil {
+		t.Fatalf("Can't connect to the proxy: %v", err)
+	}
+	defer client.Close()
+	if _, err = client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err = io.ReadFull(client, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testBuf, recvBuf) {
+		t.Fatal(fmt.Errorf("Expected [%v] but got [%v]", testBuf, recvBuf))
+	}
+}
+
 func testProxy(t *testing.T, proto string, proxy Proxy) {
 	testProxyAt(t, proto, proxy, proxy.FrontendAddr().String())
 }
@@ -144,14 +210,11 @@ func TestTCP6Proxy(t *testing.T) {
 }
 
 func TestTCPDualStackProxy(t *testing.T) {
-	// If I understand `godoc -src net favoriteAddrFamily` (used by the
-	// net.Listen* functions) correctly this should work, but it doesn't.
-	t.Skip("No support for dual stack yet")
 	backend := NewEchoServer(t, "tcp", "[::1]:0")
 	defer backend.Close()
 	backend.Run()
 	frontendAddr := &net.TCPAddr{IP: net.IPv6loopback, Port: 0}
-	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	proxy, err := NewDualStackProxy(frontendAddr, backend.LocalAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -162,6 +225,350 @@ func TestTCPDualStackProxy(t *testing.T) {
 	testProxyAt(t, "tcp", proxy, ipv4ProxyAddr.String())
 }
 
+func TestTCPDualStackProxyIPv6(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv6loopback, Port: 0}
+	proxy, err := NewDualStackProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+}
+
+func TestTCPToUnixProxy(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	backend := NewEchoServer(t, "unix", path.Join(tmp, "echo.sock"))
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+}
+
+func TestTCPProxyStats(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+	// The brokers update the counters once both ends are closed:
+	var stats ProxyStats
+	for i := 0; i < 100; i++ {
+		if stats = proxy.Stats(); stats.ActiveConnections == 0 && stats.BytesOut != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected := ProxyStats{TotalAccepted: 1, BytesIn: int64(testBufSize), BytesOut: int64(testBufSize)}
+	if stats != expected {
+		t.Fatalf("Expected %#v but got %#v", expected, stats)
+	}
+}
+
+func TestTCPProxyDrain(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatalf("Can't connect to the proxy: %v", err)
+	}
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	// Make sure the connection has been accepted before draining:
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err := io.ReadFull(client, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan bool)
+	go func() {
+		proxy.Drain(10 * time.Second)
+		close(drained)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := net.Dial("tcp", proxy.FrontendAddr().String()); err == nil {
+		t.Fatalf("The proxy shouldn't accept new connections while draining")
+	}
+	// The established connection still works:
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testBuf, recvBuf) {
+		t.Fatal(fmt.Errorf("Expected [%v] but got [%v]", testBuf, recvBuf))
+	}
+	client.Close()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Drain didn't return once the last connection was closed")
+	}
+}
+
+func TestTCPProxyDrainTimeout(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatalf("Can't connect to the proxy: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err := io.ReadFull(client, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+	proxy.Drain(100 * time.Millisecond)
+	// The proxy closed the connection once the timeout expired:
+	if _, err := client.Read(recvBuf); err != io.EOF {
+		t.Fatalf("Expected EOF on the client, got %v", err)
+	}
+}
+
+func TestTCPProxyDrainLateClient(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewTCPProxy(frontendAddr, frontendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Drain(100 * time.Millisecond)
+	// A connection accepted while Drain waited isn't counted, it's closed
+	if proxy.addClient() {
+		t.Fatal("Expected the proxy to refuse the clients accepted after Drain")
+	}
+	if !waitTimeout(&proxy.clients, time.Second) {
+		t.Fatal("Expected no client to be waited for")
+	}
+}
+
+func TestTCPProxyMaxConnections(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewTCPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	proxy.MaxConnections = 1
+	go proxy.Run()
+	first, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatalf("Can't connect to the proxy: %v", err)
+	}
+	defer first.Close()
+	first.SetDeadline(time.Now().Add(10 * time.Second))
+	// Make sure the first connection has been accepted:
+	if _, err := first.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err := io.ReadFull(first, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+	second, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatalf("Can't connect to the proxy: %v", err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := second.Read(recvBuf); err != io.EOF {
+		t.Fatalf("Expected the second connection to be closed by the proxy, got %v", err)
+	}
+	if errors := proxy.Stats().Errors; errors != 1 {
+		t.Fatalf("Expected 1 rejected connection in the stats, got %d", errors)
+	}
+}
+
+func TestTCPProxyRateLimit(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewTCPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// testBuf goes back and forth, so the first exchange empties the
+	// bucket and the second one has to wait for it to be refilled:
+	proxy.RateLimit = int64(testBufSize)
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatalf("Can't connect to the proxy: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	recvBuf := make([]byte, testBufSize)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := client.Write(testBuf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, recvBuf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Fatalf("Expected the transfer to be throttled, it took %v", elapsed)
+	}
+}
+
+type chanAccessLogger chan *ProxyAccess
+
+func (l chanAccessLogger) LogAccess(access *ProxyAccess) { l <- access }
+
+func TestTCPProxyAccessLog(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewTCPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessLog := make(chanAccessLogger, 1)
+	proxy.AccessLog = accessLog
+	testProxy(t, "tcp", proxy)
+	select {
+	case access := <-accessLog:
+		if access.Proto != "tcp" || access.BytesIn != int64(testBufSize) || access.BytesOut != int64(testBufSize) {
+			t.Fatalf("Unexpected access log entry: %#v", access)
+		}
+		if access.BackendAddr.String() != backend.LocalAddr().String() {
+			t.Fatalf("Expected backend %v in the access log, got %v", backend.LocalAddr(), access.BackendAddr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The connection wasn't logged")
+	}
+}
+
+// Start a TCP proxy sending the given version of the PROXY protocol and return
+// the client side of a connection going through it and what the backend
+// received first.
+func testProxyProtocol(t *testing.T, version int, readHeader func(conn io.Reader) ([]byte, error)) (net.Conn, []byte) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewTCPProxy(frontendAddr, backend.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	proxy.ProxyProtocol = version
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatalf("Can't connect to the proxy: %v", err)
+	}
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	header, err := readHeader(conn)
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	return client, header
+}
+
+func TestTCPProxyProtocolV1(t *testing.T) {
+	client, header := testProxyProtocol(t, 1, func(conn io.Reader) ([]byte, error) {
+		header := []byte{}
+		for !bytes.HasSuffix(header, []byte("\r\n")) {
+			b := make([]byte, 1)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return nil, err
+			}
+			header = append(header, b...)
+		}
+		return header, nil
+	})
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.TCPAddr)
+	proxyAddr := client.RemoteAddr().(*net.TCPAddr)
+	expected := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", clientAddr.Port, proxyAddr.Port)
+	if string(header) != expected {
+		t.Fatalf("Expected header %q but got %q", expected, header)
+	}
+}
+
+func TestTCPProxyProtocolV2(t *testing.T) {
+	client, header := testProxyProtocol(t, 2, func(conn io.Reader) ([]byte, error) {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		addrs := make([]byte, int(header[14])<<8+int(header[15]))
+		if _, err := io.ReadFull(conn, addrs); err != nil {
+			return nil, err
+		}
+		return append(header, addrs...), nil
+	})
+	defer client.Close()
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) {
+		t.Fatalf("Invalid signature: %v", header[:12])
+	}
+	if header[12] != 0x21 || header[13] != 0x11 {
+		t.Fatalf("Expected a PROXY command for TCP over IPv4, got %#x %#x", header[12], header[13])
+	}
+	clientAddr := client.LocalAddr().(*net.TCPAddr)
+	proxyAddr := client.RemoteAddr().(*net.TCPAddr)
+	addrs := header[16:]
+	if len(addrs) != 12 {
+		t.Fatalf("Expected 12 bytes of addresses, got %d", len(addrs))
+	}
+	if !net.IP(addrs[0:4]).Equal(clientAddr.IP) || !net.IP(addrs[4:8]).Equal(proxyAddr.IP) {
+		t.Fatalf("Wrong addresses in the header: %v", addrs)
+	}
+	if int(addrs[8])<<8+int(addrs[9]) != clientAddr.Port || int(addrs[10])<<8+int(addrs[11]) != proxyAddr.Port {
+		t.Fatalf("Wrong ports in the header: %v", addrs)
+	}
+}
+
 func TestUDP4Proxy(t *testing.T) {
 	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
 	defer backend.Close()
@@ -186,6 +593,39 @@ func TestUDP6Proxy(t *testing.T) {
 	testProxy(t, "udp", proxy)
 }
 
+func TestSCTP4Proxy(t *testing.T) {
+	backend := NewEchoServer(t, "sctp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &SCTPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSCTPProxy(t, proxy)
+}
+
+func TestUDPConnTrackTimeout(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewUDPProxy(frontendAddr, backend.LocalAddr().(*net.UDPAddr), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "udp", proxy)
+	time.Sleep(500 * time.Millisecond)
+	proxy.connTrackLock.Lock()
+	defer proxy.connTrackLock.Unlock()
+	if len(proxy.connTrackTable) != 0 {
+		t.Fatalf("Expected the idle flow to be expired, %d flows still tracked", len(proxy.connTrackTable))
+	}
+	if stats := proxy.Stats(); stats.TotalAccepted != 1 || stats.ActiveConnections != 0 {
+		t.Fatalf("Expected 1 expired flow in the stats, got %#v", stats)
+	}
+}
+
 func TestUDPWriteError(t *testing.T) {
 	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
 	// Hopefully, this port will be free: */
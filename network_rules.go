@@ -0,0 +1,276 @@
+package docker
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between two checks of the firewall rules of docker, 0 to never
+// check them.
+var IptablesCheckInterval = 10 * time.Second
+
+// The chains of docker, each one is jumped to from a built-in chain: the
+// published ports (DOCKER, in PREROUTING and OUTPUT), the NAT of the bridges
+// (DOCKER-POSTROUTING), the isolation of the networks (DOCKER-ISOLATION, in
+// FORWARD) and the ingress policies of the containers (DOCKER-ICC, in
+// FORWARD).
+const (
+	iptablesPortsChain     = "DOCKER"
+	iptablesNATChain       = "DOCKER-POSTROUTING"
+	iptablesIsolationChain = "DOCKER-ISOLATION"
+	iptablesIccChain       = "DOCKER-ICC"
+)
+
+type iptablesRule struct {
+	table     string
+	chain     string
+	operation string // -A or -I
+	args      []string
+}
+
+func (rule *iptablesRule) run(operation string) error {
+	return iptables(append([]string{"-t", rule.table, operation, rule.chain}, rule.args...)...)
+}
+
+func (rule *iptablesRule) String() string {
+	return strings.Join(append([]string{"-t", rule.table, rule.operation, rule.chain}, rule.args...), " ")
+}
+
+func (rule *iptablesRule) equals(table, chain string, args []string) bool {
+	return rule.table == table && rule.chain == chain && strings.Join(rule.args, " ") == strings.Join(args, " ")
+}
+
+type iptablesChain struct {
+	table string
+	name  string
+}
+
+// IptablesRules keeps track of the chains and the rules docker sets, so they
+// can be put back when something else removes them (e.g: a reload of the
+// firewall of the host).
+type IptablesRules struct {
+	sync.Mutex
+	chains []iptablesChain
+	rules  []*iptablesRule
+}
+
+// Create the chain name in table, if it doesn't exist yet.
+func (rules *IptablesRules) NewChain(table, name string) error {
+	rules.Lock()
+	defer rules.Unlock()
+	if iptables("-t", table, "-n", "-L", name) != nil {
+		if err := iptables("-t", table, "-N", name); err != nil {
+			return err
+		}
+	}
+	rules.forgetChain(table, name)
+	rules.chains = append(rules.chains, iptablesChain{table: table, name: name})
+	return nil
+}
+
+// Flush and remove the chain name of table. The errors are ignored, the chain
+// might have never been set up.
+func (rules *IptablesRules) DeleteChain(table, name string) {
+	rules.Lock()
+	defer rules.Unlock()
+	iptables("-t", table, "-F", name)
+	iptables("-t", table, "-X", name)
+	rules.forgetChain(table, name)
+}
+
+func (rules *IptablesRules) forgetChain(table, name string) {
+	var chains []iptablesChain
+	for _, chain := range rules.chains {
+		if chain.table != table || chain.name != name {
+			chains = append(chains, chain)
+		}
+	}
+	rules.chains = chains
+	var kept []*iptablesRule
+	for _, rule := range rules.rules {
+		if rule.table != table || rule.chain != name {
+			kept = append(kept, rule)
+		}
+	}
+	rules.rules = kept
+}
+
+// Apply operation (-A, -I or -D) to the rule args of chain in table. The
+// rules which are appended or inserted are set again by Reconcile when they
+// disappear, until they are deleted. A rule which is already there isn't
+// added twice.
+func (rules *IptablesRules) Apply(operation, table, chain string, args ...string) error {
+	rules.Lock()
+	defer rules.Unlock()
+	for i, rule := range rules.rules {
+		if rule.equals(table, chain, args) {
+			rules.rules = append(rules.rules[:i], rules.rules[i+1:]...)
+			break
+		}
+	}
+	rule := &iptablesRule{table: table, chain: chain, operation: operation, args: args}
+	if operation == "-D" {
+		return rule.run(operation)
+	}
+	if rule.run("-C") != nil {
+		if err := rule.run(operation); err != nil {
+			return err
+		}
+	}
+	rules.rules = append(rules.rules, rule)
+	return nil
+}
+
+// Put back the chains and the rules which are missing, and return how many
+// rules were restored.
+func (rules *IptablesRules) Reconcile() int {
+	rules.Lock()
+	defer rules.Unlock()
+	for _, chain := range rules.chains {
+		if iptables("-t", chain.table, "-n", "-L", chain.name) != nil {
+			if err := iptables("-t", chain.table, "-N", chain.name); err != nil {
+				log.Printf("Unable to restore the iptables chain %s: %s", chain.name, err)
+			}
+		}
+	}
+	restored := 0
+	for _, rule := range rules.rules {
+		if rule.run("-C") == nil {
+			continue
+		}
+		if err := rule.run(rule.operation); err != nil {
+			log.Printf("Unable to restore the iptables rule %s: %s", rule, err)
+			continue
+		}
+		restored++
+	}
+	return restored
+}
+
+// The iptables backend of the firewall
+type iptablesFirewall struct {
+	*IptablesRules
+}
+
+func (fw *iptablesFirewall) Setup() error {
+	// Ignore errors - This could mean the chains were never set up
+	fw.Apply("-D", "nat", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", iptablesPortsChain)
+	fw.Apply("-D", "nat", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "!", "--dst", "127.0.0.0/8", "-j", iptablesPortsChain)
+	iptables("-t", "nat", "-D", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "DOCKER") // Created in versions <= 0.1.6
+	// Also cleanup rules created by older versions, or -X might fail.
+	iptables("-t", "nat", "-D", "PREROUTING", "-j", "DOCKER")
+	iptables("-t", "nat", "-D", "OUTPUT", "-j", "DOCKER")
+	fw.DeleteChain("nat", iptablesPortsChain)
+	fw.Apply("-D", "filter", "FORWARD", "-j", iptablesIsolationChain)
+	fw.DeleteChain("filter", iptablesIsolationChain)
+	fw.Apply("-D", "filter", "FORWARD", "-j", iptablesIccChain)
+	fw.DeleteChain("filter", iptablesIccChain)
+
+	if err := fw.NewChain("nat", iptablesPortsChain); err != nil {
+		return fmt.Errorf("Failed to create DOCKER chain: %s", err)
+	}
+	if err := fw.Apply("-A", "nat", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", iptablesPortsChain); err != nil {
+		return fmt.Errorf("Failed to inject docker in PREROUTING chain: %s", err)
+	}
+	if err := fw.Apply("-A", "nat", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "!", "--dst", "127.0.0.0/8", "-j", iptablesPortsChain); err != nil {
+		return fmt.Errorf("Failed to inject docker in OUTPUT chain: %s", err)
+	}
+	if err := fw.NewChain("nat", iptablesNATChain); err != nil {
+		return fmt.Errorf("Failed to create %s chain: %s", iptablesNATChain, err)
+	}
+	if err := fw.Apply("-A", "nat", "POSTROUTING", "-j", iptablesNATChain); err != nil {
+		return fmt.Errorf("Failed to inject docker in POSTROUTING chain: %s", err)
+	}
+	if err := fw.NewChain("filter", iptablesIsolationChain); err != nil {
+		return fmt.Errorf("Failed to create %s chain: %s", iptablesIsolationChain, err)
+	}
+	if err := fw.Apply("-I", "filter", "FORWARD", "-j", iptablesIsolationChain); err != nil {
+		return fmt.Errorf("Failed to inject docker in FORWARD chain: %s", err)
+	}
+	// The exceptions (RETURN) are inserted before the drops, which are
+	// appended
+	if err := fw.NewChain("filter", iptablesIccChain); err != nil {
+		return fmt.Errorf("Failed to create %s chain: %s", iptablesIccChain, err)
+	}
+	if err := fw.Apply("-A", "filter", iptablesIccChain, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"); err != nil {
+		return fmt.Errorf("Failed to setup the %s chain: %s", iptablesIccChain, err)
+	}
+	if err := fw.Apply("-I", "filter", "FORWARD", "-j", iptablesIccChain); err != nil {
+		return fmt.Errorf("Failed to inject docker in FORWARD chain: %s", err)
+	}
+	return nil
+}
+
+func iptablesOperation(add bool, operation string) string {
+	if add {
+		return operation
+	}
+	return "-D"
+}
+
+func (fw *iptablesFirewall) masqueradeArgs(network *net.IPNet) []string {
+	return []string{"-s", network.String(), "!", "-d", network.String(), "-j", "MASQUERADE"}
+}
+
+func (fw *iptablesFirewall) Masquerade(add bool, network *net.IPNet) error {
+	return fw.Apply(iptablesOperation(add, "-A"), "nat", iptablesNATChain, fw.masqueradeArgs(network)...)
+}
+
+// Versions <= 0.5.3 set the NAT rules in POSTROUTING, they are moved to the
+// chain of docker.
+func (fw *iptablesFirewall) Masqueraded(network *net.IPNet) bool {
+	masquerade := fw.masqueradeArgs(network)
+	legacy := iptables(append([]string{"-t", "nat", "-D", "POSTROUTING"}, masquerade...)...) == nil
+	iptables("-t", "nat", "-D", "POSTROUTING", "-s", network.String(), "-d", network.String(),
+		"-m", "conntrack", "--ctstate", "DNAT", "-j", "MASQUERADE")
+	return legacy || iptables(append([]string{"-t", "nat", "-C", iptablesNATChain}, masquerade...)...) == nil
+}
+
+func (fw *iptablesFirewall) Hairpin(add bool, network *net.IPNet) error {
+	return fw.Apply(iptablesOperation(add, "-A"), "nat", iptablesNATChain, "-s", network.String(), "-d", network.String(),
+		"-m", "conntrack", "--ctstate", "DNAT", "-j", "MASQUERADE")
+}
+
+func (fw *iptablesFirewall) Isolate(add bool, bridgeA, bridgeB string) error {
+	for _, pair := range [][2]string{{bridgeA, bridgeB}, {bridgeB, bridgeA}} {
+		if err := fw.Apply(iptablesOperation(add, "-I"), "filter", iptablesIsolationChain, "-i", pair[0], "-o", pair[1],
+			"-m", "conntrack", "!", "--ctstate", "DNAT", "-j", "DROP"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fw *iptablesFirewall) IccAllow(add bool, bridge, src, dst string) error {
+	args := []string{"-i", bridge, "-o", bridge}
+	if src != "" {
+		args = append(args, "-s", src)
+	}
+	args = append(args, "-d", dst, "-j", "RETURN")
+	return fw.Apply(iptablesOperation(add, "-I"), "filter", iptablesIccChain, args...)
+}
+
+func (fw *iptablesFirewall) IccDeny(add bool, bridge, dst string) error {
+	args := []string{"-i", bridge, "-o", bridge}
+	if dst != "" {
+		args = append(args, "-d", dst)
+	}
+	args = append(args, "-j", "DROP")
+	return fw.Apply(iptablesOperation(add, "-A"), "filter", iptablesIccChain, args...)
+}
+
+func (fw *iptablesFirewall) Forward(add bool, proto string, port int, backendIP string, backendPort int) error {
+	args := []string{"-p", proto, "--dport", strconv.Itoa(port)}
+	// The userland proxy takes care of the traffic coming from the
+	// containers, unless it's disabled:
+	if UserlandProxy {
+		args = append(args, "!", "-i", NetworkBridgeIface)
+	}
+	args = append(args, "-j", "DNAT", "--to-destination", net.JoinHostPort(backendIP, strconv.Itoa(backendPort)))
+	return fw.Apply(iptablesOperation(add, "-A"), "nat", iptablesPortsChain, args...)
+}
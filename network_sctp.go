@@ -0,0 +1,195 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// The net package has no support for SCTP, so we talk to the kernel
+// directly. We only use one-to-one style (SOCK_STREAM) sockets which behave
+// pretty much like TCP sockets: listen, accept, connect and a reliable byte
+// stream.
+const ipprotoSCTP = 132
+
+// SCTPAddr represents the address of an SCTP end point.
+type SCTPAddr struct {
+	IP   net.IP
+	Port int
+}
+
+func (a *SCTPAddr) Network() string { return "sctp" }
+
+func (a *SCTPAddr) String() string {
+	if a == nil {
+		return "<nil>"
+	}
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+func (a *SCTPAddr) family() int {
+	if a.IP == nil || a.IP.To4() != nil {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+func (a *SCTPAddr) sockaddr() (syscall.Sockaddr, error) {
+	switch a.family() {
+	case syscall.AF_INET:
+		sa := &syscall.SockaddrInet4{Port: a.Port}
+		if a.IP != nil {
+			copy(sa.Addr[:], a.IP.To4())
+		}
+		return sa, nil
+	case syscall.AF_INET6:
+		sa := &syscall.SockaddrInet6{Port: a.Port}
+		copy(sa.Addr[:], a.IP.To16())
+		return sa, nil
+	}
+	return nil, fmt.Errorf("Unsupported address: %v", a)
+}
+
+func sockaddrToSCTPAddr(sa syscall.Sockaddr) *SCTPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &SCTPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &SCTPAddr{IP: ip, Port: sa.Port}
+	}
+	return nil
+}
+
+func sctpSocket(addr *SCTPAddr) (int, syscall.Sockaddr, error) {
+	sa, err := addr.sockaddr()
+	if err != nil {
+		return -1, nil, err
+	}
+	fd, err := syscall.Socket(addr.family(), syscall.SOCK_STREAM, ipprotoSCTP)
+	if err != nil {
+		return -1, nil, fmt.Errorf("Can't create sctp socket: %v", err)
+	}
+	syscall.CloseOnExec(fd)
+	return fd, sa, nil
+}
+
+// SCTPListener is an SCTP network listener, the counterpart of
+// net.TCPListener.
+type SCTPListener struct {
+	fd        int
+	addr      *SCTPAddr
+	closeOnce sync.Once
+}
+
+func ListenSCTP(laddr *SCTPAddr) (*SCTPListener, error) {
+	fd, sa, err := sctpSocket(laddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Can't bind sctp/%v: %v", laddr, err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Can't listen on sctp/%v: %v", laddr, err)
+	}
+	// If the port was 0 the kernel picked one for us:
+	bound, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &SCTPListener{fd: fd, addr: sockaddrToSCTPAddr(bound)}, nil
+}
+
+func (l *SCTPListener) Accept() (*SCTPConn, error) {
+	fd, sa, err := syscall.Accept(l.fd)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	return &SCTPConn{fd: fd, laddr: l.addr, raddr: sockaddrToSCTPAddr(sa)}, nil
+}
+
+// Close stops listening. The shutdown call is needed to wake up a goroutine
+// blocked in Accept, close alone doesn't do it. Calling Close more than once
+// is a no-op: the fd could have been reused in the meantime.
+func (l *SCTPListener) Close() error {
+	var err error = syscall.EINVAL
+	l.closeOnce.Do(func() {
+		syscall.Shutdown(l.fd, syscall.SHUT_RDWR)
+		err = syscall.Close(l.fd)
+	})
+	return err
+}
+
+func (l *SCTPListener) Addr() net.Addr { return l.addr }
+
+// SCTPConn is an established SCTP association used as a byte stream.
+type SCTPConn struct {
+	fd    int
+	laddr *SCTPAddr
+	raddr *SCTPAddr
+}
+
+func DialSCTP(raddr *SCTPAddr) (*SCTPConn, error) {
+	fd, sa, err := sctpSocket(raddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Connect(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "dial", Net: "sctp", Addr: raddr, Err: err}
+	}
+	conn := &SCTPConn{fd: fd, raddr: raddr}
+	if local, err := syscall.Getsockname(fd); err == nil {
+		conn.laddr = sockaddrToSCTPAddr(local)
+	}
+	return conn, nil
+}
+
+func (c *SCTPConn) Read(b []byte) (int, error) {
+	n, err := syscall.Read(c.fd, b)
+	if err != nil {
+		return 0, &net.OpError{Op: "read", Net: "sctp", Addr: c.raddr, Err: err}
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *SCTPConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := syscall.Write(c.fd, b[written:])
+		if err != nil {
+			return written, &net.OpError{Op: "write", Net: "sctp", Addr: c.raddr, Err: err}
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c *SCTPConn) CloseRead() error  { return syscall.Shutdown(c.fd, syscall.SHUT_RD) }
+func (c *SCTPConn) CloseWrite() error { return syscall.Shutdown(c.fd, syscall.SHUT_WR) }
+
+// Close tears down the association; like for the listener, shutdown makes
+// sure any goroutine blocked in Read returns.
+func (c *SCTPConn) Close() error {
+	syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+	return syscall.Close(c.fd)
+}
+
+func (c *SCTPConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *SCTPConn) RemoteAddr() net.Addr { return c.raddr }
@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long to wait for lxc to create the veth of a container
+const vethTimeout = 10 * time.Second
+
+// Wrapper around the tc command
+func tc(args ...string) error {
+	path, err := exec.LookPath("tc")
+	if err != nil {
+		return fmt.Errorf("command not found: tc")
+	}
+	if output, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tc failed: tc %v: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Parse the -net-rate option of docker run: the egress rate of the container,
+// optionally followed by its ingress rate (e.g: "10mbit" or "10mbit:100mbit").
+// Without ingress rate, both directions are capped to the egress rate. The
+// rates are returned in bytes per second.
+func parseNetRate(spec string) (int64, int64, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("Invalid network rate: %s", spec)
+	}
+	egress, err := parseRate(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid network rate: %s", spec)
+	}
+	ingress := egress
+	if len(parts) == 2 {
+		if ingress, err = parseRate(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("Invalid network rate: %s", spec)
+		}
+	}
+	return egress, ingress, nil
+}
+
+// Cap the traffic of the container on the host side of its veth: what the
+// host sends on it is what the container receives (shaped with HTB), what the
+// host receives on it is what the container sends (policed, tc can't shape
+// the ingress of an interface). Rates are in bytes per second, 0 for
+// unlimited.
+func shapeVeth(veth string, egress, ingress int64) error {
+	deadline := time.Now().Add(vethTimeout)
+	for {
+		if _, err := net.InterfaceByName(veth); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("Unable to find the veth %s of the container: %s", veth, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if ingress > 0 {
+		rate := fmt.Sprintf("%dbit", ingress*8)
+		if err := tc("qdisc", "add", "dev", veth, "root", "handle", "1:", "htb", "default", "1"); err != nil {
+			return err
+		}
+		if err := tc("class", "add", "dev", veth, "parent", "1:", "classid", "1:1", "htb", "rate", rate, "ceil", rate); err != nil {
+			return err
+		}
+	}
+	if egress > 0 {
+		// Allow bursts of 100ms of traffic, and of at least a few packets
+		burst := egress / 10
+		if burst < 16*1024 {
+			burst = 16 * 1024
+		}
+		if err := tc("qdisc", "add", "dev", veth, "handle", "ffff:", "ingress"); err != nil {
+			return err
+		}
+		if err := tc("filter", "add", "dev", veth, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0",
+			"police", "rate", fmt.Sprintf("%dbit", egress*8), "burst", fmt.Sprintf("%db", burst), "drop", "flowid", ":1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,8 +1,14 @@
 package docker
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -18,6 +24,82 @@ func TestIptables(t *testing.T) {
 	}
 }
 
+func TestIptablesRulesReconcile(t *testing.T) {
+	rules := &IptablesRules{}
+	if err := rules.NewChain("filter", "DOCKER-TEST"); err != nil {
+		t.Fatal(err)
+	}
+	defer rules.DeleteChain("filter", "DOCKER-TEST")
+	rule := []string{"-s", "192.0.2.1", "-j", "DROP"}
+	if err := rules.Apply("-A", "filter", "DOCKER-TEST", rule...); err != nil {
+		t.Fatal(err)
+	}
+	// Applied twice, set once
+	if err := rules.Apply("-A", "filter", "DOCKER-TEST", rule...); err != nil {
+		t.Fatal(err)
+	}
+	if restored := rules.Reconcile(); restored != 0 {
+		t.Fatalf("Expected no rule to restore, %d restored", restored)
+	}
+
+	// Simulate a reload of the firewall
+	if err := iptables("-F", "DOCKER-TEST"); err != nil {
+		t.Fatal(err)
+	}
+	if err := iptables("-X", "DOCKER-TEST"); err != nil {
+		t.Fatal(err)
+	}
+	if restored := rules.Reconcile(); restored != 1 {
+		t.Fatalf("Expected 1 rule to restore, %d restored", restored)
+	}
+	if err := iptables(append([]string{"-C", "DOCKER-TEST"}, rule...)...); err != nil {
+		t.Fatalf("The rule wasn't restored: %s", err)
+	}
+	iptables(append([]string{"-D", "DOCKER-TEST"}, rule...)...)
+	if err := iptables(append([]string{"-C", "DOCKER-TEST"}, rule...)...); err == nil {
+		t.Fatalf("The rule was set twice")
+	}
+
+	// Deleted rules aren't restored
+	if err := rules.Apply("-A", "filter", "DOCKER-TEST", rule...); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.Apply("-D", "filter", "DOCKER-TEST", rule...); err != nil {
+		t.Fatal(err)
+	}
+	if restored := rules.Reconcile(); restored != 0 {
+		t.Fatalf("Expected no rule to restore, %d restored", restored)
+	}
+}
+
+func TestNftablesScript(t *testing.T) {
+	_, network, err := net.ParseCIDR("172.17.42.1/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.IP = net.ParseIP("172.17.42.1")
+	fw := newNftablesFirewall()
+	fw.rules["postrouting"] = []string{fw.masqueradeRule(network)}
+	fw.rules["ports"] = []string{"tcp dport 80 dnat to 172.17.0.2:8080"}
+	fw.rules["icc-deny"] = []string{`iifname "docker0" oifname "docker0" drop`}
+	fw.rules["icc-allow"] = []string{`iifname "docker0" oifname "docker0" ip saddr 172.17.0.3 ip daddr 172.17.0.2 return`}
+	script := fw.script()
+	for _, expected := range []string{
+		"delete table ip docker\n",
+		"\tchain ports {\n\t\ttcp dport 80 dnat to 172.17.0.2:8080\n\t}\n",
+		"\t\tip saddr 172.17.0.0/16 ip daddr != 172.17.0.0/16 masquerade\n",
+		"\t\tjump icc\n\t\tct status dnat accept\n\t\tjump isolation\n",
+		// The exceptions come before the policies
+		"return\n\t\tiifname \"docker0\" oifname \"docker0\" ip saddr 172.17.0.3 ip daddr 172.17.0.2 return\n\t\tiifname \"docker0\" oifname \"docker0\" drop\n",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Fatalf("%q not found in the nftables script:\n%s", expected, script)
+		}
+	}
+	if !fw.Masqueraded(network) {
+		t.Fatalf("The network should be masqueraded")
+	}
+}
 func TestParseNat(t *testing.T) {
 	if nat, err := parseNat("4500"); err == nil {
 		if nat.Frontend != 0 || nat.Backend != 4500 || nat.Proto != "tcp" {
@@ -100,6 +182,49 @@ func TestParseNat(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	if nat, err := parseNat("8080:80/tcp,maxconn=100,rate=10mbit"); err == nil {
+		if nat.Frontend != 8080 || nat.Backend != 80 || nat.Proto != "tcp" || nat.MaxConnections != 100 || nat.RateLimit != 1250000 {
+			t.Errorf("-p 8080:80/tcp,maxconn=100,rate=10mbit should produce 8080->80/tcp with 100 connections at 1250000 B/s, got %d->%d/%s with %d connections at %d B/s",
+				nat.Frontend, nat.Backend, nat.Proto, nat.MaxConnections, nat.RateLimit)
+		}
+	} else {
+		t.Fatal(err)
+	}
+
+	if nat, err := parseNat("80,rate=1kbps"); err == nil {
+		if nat.Backend != 80 || nat.Proto != "tcp" || nat.MaxConnections != 0 || nat.RateLimit != 1000 {
+			t.Errorf("-p 80,rate=1kbps should produce 0->80/tcp at 1000 B/s, got %d->%d/%s with %d connections at %d B/s",
+				nat.Frontend, nat.Backend, nat.Proto, nat.MaxConnections, nat.RateLimit)
+		}
+	} else {
+		t.Fatal(err)
+	}
+
+	if _, err := parseNat("53/udp,maxconn=10"); err == nil {
+		t.Errorf("maxconn should only be accepted for tcp")
+	}
+
+	if _, err := parseNat("80,maxconn=zero"); err == nil {
+		t.Errorf("maxconn=zero should be rejected")
+	}
+
+	if _, err := parseNat("80,rate=10furlongs"); err == nil {
+		t.Errorf("rate=10furlongs should be rejected")
+	}
+
+	if _, err := parseNat("80,burst=10"); err == nil {
+		t.Errorf("Unknown port options should be rejected")
+	}
+
+	if nat, err := parseNat("4502:4503/sctp"); err == nil {
+		if nat.Frontend != 4502 || nat.Backend != 4503 || nat.Proto != "sctp" {
+			t.Errorf("-p 4502:4503/sctp should produce 4502->4503/sctp, got %d->%d/%s",
+				nat.Frontend, nat.Backend, nat.Proto)
+		}
+	} else {
+		t.Fatal(err)
+	}
+
 	if _, err := parseNat("4503/tcpgarbage"); err == nil {
 		t.Fatal(err)
 	}
@@ -113,6 +238,27 @@ func TestParseNat(t *testing.T) {
 	}
 }
 
+func TestParseNetRate(t *testing.T) {
+	egress, ingress, err := parseNetRate("8mbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if egress != 1e6 || ingress != 1e6 {
+		t.Fatalf("8mbit should cap both directions to 1MB/s, got %d and %d", egress, ingress)
+	}
+	if egress, ingress, err = parseNetRate("1mbps:10mbps"); err != nil {
+		t.Fatal(err)
+	}
+	if egress != 1e6 || ingress != 1e7 {
+		t.Fatalf("1mbps:10mbps should cap the egress to 1MB/s and the ingress to 10MB/s, got %d and %d", egress, ingress)
+	}
+	for _, invalid := range []string{"", "fast", "1mbit:", "1mbit:2mbit:3mbit", "-1mbit", "4bit", "0.5bps", "1mbit:7bit", "nan", "inf"} {
+		if _, _, err := parseNetRate(invalid); err == nil {
+			t.Fatalf("Expected an error for %q", invalid)
+		}
+	}
+}
+
 func TestPortAllocation(t *testing.T) {
 	allocator, err := newPortAllocator()
 	if err != nil {
@@ -343,6 +489,57 @@ func TestIPAllocator(t *testing.T) {
 	}
 }
 
+func TestIPAllocatorReserve(t *testing.T) {
+	gwIP, n, _ := net.ParseCIDR("127.0.0.1/29")
+	alloc := newIPAllocator(&net.IPNet{IP: gwIP, Mask: n.Mask})
+
+	if err := alloc.Reserve(net.IPv4(127, 0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.Reserve(net.IPv4(127, 0, 0, 2)); err == nil {
+		t.Fatal("The same IP shouldn't be reserved twice")
+	}
+	// The network, the gateway, the broadcast address and outside the network
+	for _, ip := range []net.IP{
+		net.IPv4(127, 0, 0, 0),
+		net.IPv4(127, 0, 0, 1),
+		net.IPv4(127, 0, 0, 7),
+		net.IPv4(127, 0, 0, 8),
+	} {
+		if err := alloc.Reserve(ip); err == nil {
+			t.Fatalf("%s shouldn't be reservable", ip)
+		}
+	}
+	// The reserved IP is skipped
+	ip, err := alloc.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIPEquals(t, net.IPv4(127, 0, 0, 3), ip)
+	// The next free IP can be reserved, and is skipped too
+	if err := alloc.Reserve(net.IPv4(127, 0, 0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	ip, err = alloc.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIPEquals(t, net.IPv4(127, 0, 0, 5), ip)
+	// A released IP can be reserved again
+	alloc.Release(net.IPv4(127, 0, 0, 2))
+	if err := alloc.Reserve(net.IPv4(127, 0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	ip, err = alloc.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIPEquals(t, net.IPv4(127, 0, 0, 6), ip)
+	if _, err := alloc.Acquire(); err == nil {
+		t.Fatal("There shouldn't be any IP addresses at this point")
+	}
+}
+
 func assertIPEquals(t *testing.T, ip1, ip2 net.IP) {
 	if !ip1.Equal(ip2) {
 		t.Fatalf("Expected IP %s, got %s", ip1, ip2)
@@ -402,3 +599,222 @@ func TestCheckRouteOverlaps(t *testing.T) {
 		t.Fatalf("10.0.2.0/24 and 10.0.2.0 should overlap but it doesn't")
 	}
 }
+
+func TestNetworkDriver(t *testing.T) {
+	if _, err := newNetworkDriver("nonexistent"); err == nil {
+		t.Fatalf("Expected an error for an unknown network driver")
+	}
+	driver, err := newNetworkDriver("bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.CreateNetwork("test", map[string]string{"bridge": DisableNetworkBridge}); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.CreateNetwork("test", map[string]string{"bridge": DisableNetworkBridge}); err == nil {
+		t.Fatalf("Creating the same network twice should fail")
+	}
+	if _, err := driver.CreateEndpoint("nonexistent", nil); err == nil {
+		t.Fatalf("Expected an error for an unknown network")
+	}
+	iface, err := driver.CreateEndpoint("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !iface.disabled {
+		t.Fatalf("The endpoints of a network without bridge should be disabled")
+	}
+	if err := driver.Leave("test", iface); err != nil {
+		t.Fatal(err)
+	}
+	info, err := driver.NetworkInfo("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "test" || info.Bridge != DisableNetworkBridge || info.Subnet != "" {
+		t.Fatalf("Unexpected network info: %#v", info)
+	}
+	if err := driver.DeleteNetwork("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.DeleteNetwork("test"); err == nil {
+		t.Fatalf("Deleting the same network twice should fail")
+	}
+	if _, err := driver.CreateEndpoint("test", nil); err == nil {
+		t.Fatalf("Expected an error for a deleted network")
+	}
+}
+
+func TestMacvlanDriver(t *testing.T) {
+	driver, err := newNetworkDriver("macvlan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []map[string]string{
+		{"subnet": "192.168.77.0/24"},
+		{"parent": "nonexistent0", "subnet": "192.168.77.0/24"},
+		{"parent": "lo"},
+		{"parent": "lo", "subnet": "192.168.77.0/24", "mode": "invalid"},
+		{"parent": "lo", "subnet": "192.168.77.0/24", "gateway": "10.0.0.1"},
+		{"parent": "lo", "subnet": "192.168.77.0/24", "ip-range": "192.168.0.0/16"},
+	} {
+		if err := driver.CreateNetwork("lan", options); err == nil {
+			t.Fatalf("Expected an error for %v", options)
+		}
+	}
+	options := map[string]string{"parent": "lo", "subnet": "192.168.77.0/24", "ip-range": "192.168.77.128/25"}
+	if err := driver.CreateNetwork("lan", options); err != nil {
+		t.Fatal(err)
+	}
+	iface, err := driver.CreateEndpoint("lan", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface.publishesPorts() {
+		t.Fatalf("The ports of a macvlan shouldn't be published")
+	}
+	settings := &NetworkSettings{}
+	if err := driver.Join("lan", iface, settings); err != nil {
+		t.Fatal(err)
+	}
+	if ip := net.ParseIP(settings.IPAddress).To4(); ip == nil || ip[2] != 77 || ip[3] <= 128 {
+		t.Fatalf("%s is not in the ip range", settings.IPAddress)
+	}
+	if settings.IPPrefixLen != 24 || settings.Gateway != "192.168.77.1" || settings.Bridge != "lo" || settings.MacvlanMode != "bridge" {
+		t.Fatalf("Unexpected settings: %#v", settings)
+	}
+	if err := driver.Leave("lan", iface); err != nil {
+		t.Fatal(err)
+	}
+	info, err := driver.NetworkInfo("lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Driver != "macvlan" || info.Subnet != "192.168.77.0/24" {
+		t.Fatalf("Unexpected network info: %#v", info)
+	}
+	if err := driver.DeleteNetwork("lan"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Just enough of the v2 API of etcd for the overlay driver
+type fakeEtcd struct {
+	sync.Mutex
+	keys map[string]string
+}
+
+func (etcd *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	etcd.Lock()
+	defer etcd.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+	value, exists := etcd.keys[key]
+	switch r.Method {
+	case "PUT":
+		if exists && r.URL.Query().Get("prevExist") == "false" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		etcd.keys[key] = r.FormValue("value")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&etcdResponse{Node: &etcdNode{Key: key, Value: etcd.keys[key]}})
+	case "GET":
+		if exists {
+			json.NewEncoder(w).Encode(&etcdResponse{Node: &etcdNode{Key: key, Value: value}})
+			return
+		}
+		dir := &etcdNode{Key: key, Dir: true}
+		for k, v := range etcd.keys {
+			if strings.HasPrefix(k, key+"/") && !strings.Contains(k[len(key)+1:], "/") {
+				dir.Nodes = append(dir.Nodes, &etcdNode{Key: k, Value: v})
+			}
+		}
+		if len(dir.Nodes) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&etcdResponse{Node: dir})
+	case "DELETE":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(etcd.keys, key)
+		json.NewEncoder(w).Encode(&etcdResponse{Node: &etcdNode{Key: key}})
+	}
+}
+
+func TestOverlayAddresses(t *testing.T) {
+	server := httptest.NewServer(&fakeEtcd{keys: make(map[string]string)})
+	defer server.Close()
+	if _, err := newKVStore("consul://" + server.Listener.Addr().String()); err == nil {
+		t.Fatalf("Expected an error for an unsupported store")
+	}
+	store, err := newKVStore("etcd://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostA := &overlayDriver{store: store, advertise: net.ParseIP("10.0.0.1"), networks: make(map[string]*overlayNetwork)}
+	hostB := &overlayDriver{store: store, advertise: net.ParseIP("10.0.0.2"), networks: make(map[string]*overlayNetwork)}
+
+	if _, err := hostA.networkConfig("multi", map[string]string{}); err == nil {
+		t.Fatalf("Expected an error for a network without subnet")
+	}
+	config, err := hostA.networkConfig("multi", map[string]string{"subnet": "10.8.0.0/29"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.VNI != vxlanFirstVNI {
+		t.Fatalf("Expected the VXLAN network id %d, got %d", vxlanFirstVNI, config.VNI)
+	}
+	// The other hosts join the same network
+	if joined, err := hostB.networkConfig("multi", nil); err != nil {
+		t.Fatal(err)
+	} else if *joined != *config {
+		t.Fatalf("Expected %#v, got %#v", config, joined)
+	}
+	if _, err := hostB.networkConfig("multi", map[string]string{"subnet": "10.9.0.0/24"}); err == nil {
+		t.Fatalf("Expected an error for a network with another subnet")
+	}
+	if other, err := hostB.networkConfig("other", map[string]string{"subnet": "10.9.0.0/24"}); err != nil {
+		t.Fatal(err)
+	} else if other.VNI == config.VNI {
+		t.Fatalf("Two networks got the VXLAN network id %d", config.VNI)
+	}
+	hostA.networks["multi"] = newOverlayNetwork(config)
+	hostB.networks["multi"] = newOverlayNetwork(config)
+	// Each host has its own MAC address for the gateway
+	if macA, macB := overlayGatewayMAC(hostA.advertise), overlayGatewayMAC(hostB.advertise); macA == macB || macA != "02:42:0a:00:00:01" {
+		t.Fatalf("Expected distinct MAC addresses for the gateways, got %s and %s", macA, macB)
+	}
+
+	// 10.8.0.1 is the gateway
+	var ifaces []*NetworkInterface
+	for i, host := range []*overlayDriver{hostA, hostB, hostA, hostB, hostA} {
+		iface, err := host.CreateEndpoint("multi", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("10.8.0.%d", i+2); iface.IPNet.IP.String() != expected || !iface.Gateway.Equal(net.ParseIP("10.8.0.1")) {
+			t.Fatalf("Expected %s, got %s", expected, iface.IPNet.IP)
+		}
+		ifaces = append(ifaces, iface)
+	}
+	if _, err := hostB.CreateEndpoint("multi", nil); err == nil {
+		t.Fatalf("Expected an error for a full network")
+	}
+	if err := hostA.Leave("multi", ifaces[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hostA.CreateEndpoint("multi", net.ParseIP("10.8.0.3")); err == nil {
+		t.Fatalf("Expected an error for an address used by another host")
+	}
+	if _, err := hostA.CreateEndpoint("multi", net.ParseIP("10.8.0.1")); err == nil {
+		t.Fatalf("Expected an error for the address of the gateway")
+	}
+	if iface, err := hostA.CreateEndpoint("multi", net.ParseIP("10.8.0.4")); err != nil {
+		t.Fatal(err)
+	} else if !iface.IPNet.IP.Equal(net.ParseIP("10.8.0.4")) {
+		t.Fatalf("Expected 10.8.0.4, got %s", iface.IPNet.IP)
+	}
+}
@@ -0,0 +1,541 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var validNetworkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// The networks created by the users, they are recreated when the runtime
+// starts. The default network isn't part of it.
+type NetworkStore struct {
+	path     string
+	Networks map[string]*NetworkConfig
+}
+
+type NetworkConfig struct {
+	Name    string
+	Driver  string
+	Options map[string]string
+}
+
+func NewNetworkStore(path string) (*NetworkStore, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &NetworkStore{
+		path:     abspath,
+		Networks: make(map[string]*NetworkConfig),
+	}
+	// Load the json file if it exists, otherwise create it.
+	if err := store.Reload(); os.IsNotExist(err) {
+		if err := store.Save(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *NetworkStore) Save() error {
+	jsonData, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(store.path, jsonData, 0600)
+}
+
+func (store *NetworkStore) Reload() error {
+	jsonData, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonData, store)
+}
+
+// Create the network name with the network driver driverName (the one of the
+// default network if empty) and remember it
+func (runtime *Runtime) CreateNetwork(name, driverName string, options map[string]string) error {
+	if !validNetworkName.MatchString(name) {
+		return fmt.Errorf("Bad parameter: invalid network name %q", name)
+	}
+	if name == DefaultNetworkName || runtime.networks.Networks[name] != nil {
+		return fmt.Errorf("Conflict: network %s already exists", name)
+	}
+	if driverName == "" {
+		driverName = NetworkDriverName
+	}
+	driver, err := runtime.loadNetworkDriver(driverName)
+	if err != nil {
+		return fmt.Errorf("Bad parameter: %s", err)
+	}
+	if err := driver.CreateNetwork(name, options); err != nil {
+		return err
+	}
+	runtime.startDNSServer(name)
+	runtime.networks.Networks[name] = &NetworkConfig{
+		Name:    name,
+		Driver:  driverName,
+		Options: options,
+	}
+	return runtime.networks.Save()
+}
+
+// The instance of the network driver name, it's created the first time a
+// network uses it
+func (runtime *Runtime) loadNetworkDriver(name string) (NetworkDriver, error) {
+	if name == NetworkDriverName {
+		return runtime.networkDriver, nil
+	}
+	runtime.networkDriversLock.Lock()
+	defer runtime.networkDriversLock.Unlock()
+	if driver, exists := runtime.networkDrivers[name]; exists {
+		return driver, nil
+	}
+	driver, err := newNetworkDriver(name)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.networkDrivers == nil {
+		runtime.networkDrivers = make(map[string]NetworkDriver)
+	}
+	runtime.networkDrivers[name] = driver
+	return driver, nil
+}
+
+// The driver of the network name
+func (runtime *Runtime) networkDriverOf(name string) (NetworkDriver, error) {
+	if name == DefaultNetworkName {
+		return runtime.networkDriver, nil
+	}
+	config := runtime.networks.Networks[name]
+	if config == nil {
+		return nil, fmt.Errorf("No such network: %s", name)
+	}
+	return runtime.loadNetworkDriver(config.Driver)
+}
+
+// Delete a network created with CreateNetwork, it must not be used by any
+// container.
+func (runtime *Runtime) DeleteNetwork(name string) error {
+	if name == DefaultNetworkName {
+		return fmt.Errorf("Impossible to remove the default network")
+	}
+	if runtime.networks.Networks[name] == nil {
+		return fmt.Errorf("No such network: %s", name)
+	}
+	if containers := runtime.networkContainers(name); len(containers) > 0 {
+		return fmt.Errorf("Conflict: network %s is used by container %s", name, containers[0])
+	}
+	driver, err := runtime.networkDriverOf(name)
+	if err != nil {
+		return err
+	}
+	runtime.stopDNSServer(name)
+	if err := driver.DeleteNetwork(name); err != nil {
+		return err
+	}
+	delete(runtime.networks.Networks, name)
+	return runtime.networks.Save()
+}
+
+// Connect container to the network name under the given aliases, which the
+// DNS server answers right away. A running container is moved to the network
+// right away too, a stopped one when it starts. The aliases it already has
+// are kept once.
+func (runtime *Runtime) ConnectContainer(name string, container *Container, aliases []string) error {
+	if !runtime.NetworkExists(name) {
+		return fmt.Errorf("No such network: %s", name)
+	}
+	runtime.namesLock.Lock()
+	defer runtime.namesLock.Unlock()
+	container.State.Lock()
+	defer container.State.Unlock()
+	var added []string
+	for _, alias := range aliases {
+		if !validNetworkName.MatchString(alias) {
+			return fmt.Errorf("Bad parameter: invalid alias %q", alias)
+		}
+		if containsFold(container.Config.NetworkAliases, alias) || containsFold(added, alias) {
+			continue
+		}
+		if ip := runtime.lookupContainer(name, strings.ToLower(alias)); ip != nil {
+			return fmt.Errorf("Conflict: %s is already used on network %s", alias, name)
+		}
+		added = append(added, alias)
+	}
+	if id := getNetworkContainer(container.Config); id != "" {
+		return fmt.Errorf("Conflict: container %s shares the network of %s", container.ID, id)
+	}
+	if container.State.Running && container.networkName() != name {
+		if err := container.moveToNetwork(name); err != nil {
+			return err
+		}
+	}
+	if name == DefaultNetworkName {
+		container.Config.Network = ""
+	} else {
+		container.Config.Network = name
+	}
+	container.Config.NetworkAliases = append(container.Config.NetworkAliases, added...)
+	return container.ToDisk()
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Move the running container to the network name: the interface of its
+// network is replaced by one on name in its network namespace, set up as lxc
+// sets it up when it starts. Its state is locked. The container is only
+// released from its network once it's on name: if it can't be moved, it's
+// put back on its network.
+func (container *Container) moveToNetwork(name string) error {
+	if container.network == nil {
+		return fmt.Errorf("Conflict: container %s has no network", container.ID)
+	}
+	pid, err := lxcInitPid(container.ID)
+	if err != nil {
+		return err
+	}
+	oldName, oldConfig, oldIface, oldSettings := container.networkName(), container.Config.Network, container.network, container.NetworkSettings
+	if name == DefaultNetworkName {
+		container.Config.Network = ""
+	} else {
+		container.Config.Network = name
+	}
+	container.NetworkSettings = &NetworkSettings{}
+	if err := container.allocateNetwork(nil); err != nil {
+		container.Config.Network, container.network, container.NetworkSettings = oldConfig, oldIface, oldSettings
+		return err
+	}
+	if container.network == nil {
+		container.Config.Network, container.network, container.NetworkSettings = oldConfig, oldIface, oldSettings
+		container.Config.NetworkDisabled = false
+		return fmt.Errorf("Conflict: network %s gives no interface to container %s", name, container.ID)
+	}
+	// A capped veth keeps its name, and is capped again
+	hostInterface := oldSettings.HostInterface
+	if hostInterface == "" {
+		hostInterface = "veth" + GenerateID()[:11]
+	} else {
+		container.NetworkSettings.HostInterface = hostInterface
+	}
+	hostConfig, _ := container.ReadHostConfig()
+	mtu := getMtu(container.Config)
+	if err := plugInterface(pid, container.NetworkSettings, mtu, hostInterface); err != nil {
+		if newDriver, err := container.runtime.networkDriverOf(name); err != nil {
+			utils.Debugf("Error releasing the network of %s: %s", container.ID, err)
+		} else if err := newDriver.Leave(name, container.network); err != nil {
+			utils.Debugf("Error releasing the network of %s: %s", container.ID, err)
+		}
+		container.Config.Network, container.network, container.NetworkSettings = oldConfig, oldIface, oldSettings
+		if restoreErr := restoreInterface(pid, oldSettings, mtu, hostConfig); restoreErr != nil {
+			return fmt.Errorf("Unable to move container %s to network %s: %s, nor to put it back on network %s: %s", container.ID, name, err, oldName, restoreErr)
+		}
+		return fmt.Errorf("Unable to move container %s to network %s: %s", container.ID, name, err)
+	}
+	if oldDriver, err := container.runtime.networkDriverOf(oldName); err != nil {
+		utils.Debugf("Error releasing the network of %s: %s", container.ID, err)
+	} else if err := oldDriver.Leave(oldName, oldIface); err != nil {
+		utils.Debugf("Error releasing the network of %s: %s", container.ID, err)
+	}
+	if container.NetworkSettings.HostInterface != "" {
+		if err := shapeVeth(hostInterface, hostConfig.NetRateEgress, hostConfig.NetRateIngress); err != nil {
+			return err
+		}
+	}
+	// The DNS server of the new network answers its queries
+	return container.setupResolvConf(hostConfig)
+}
+
+// Put the interface of settings back in the network namespace of the process
+// pid, which plugInterface failed to replace: eth0 is kept if it wasn't
+// removed yet
+func restoreInterface(pid int, settings *NetworkSettings, mtu int, hostConfig *HostConfig) error {
+	if ipIn(pid, "link", "show", "eth0") == nil {
+		return nil
+	}
+	hostInterface := settings.HostInterface
+	if hostInterface == "" {
+		hostInterface = "veth" + GenerateID()[:11]
+	}
+	if err := plugInterface(pid, settings, mtu, hostInterface); err != nil {
+		return err
+	}
+	if settings.HostInterface != "" && hostConfig != nil {
+		return shapeVeth(hostInterface, hostConfig.NetRateEgress, hostConfig.NetRateIngress)
+	}
+	return nil
+}
+
+// Replace eth0 in the network namespace of the process pid by an interface
+// on the network of settings: a veth linked to its bridge, hostInterface on
+// the host side, or a macvlan of its parent interface. The new interface is
+// removed if it fails.
+func plugInterface(pid int, settings *NetworkSettings, mtu int, hostInterface string) error {
+	if err := ipIn(pid, "link", "del", "eth0"); err != nil {
+		return err
+	}
+	peer := "dp" + GenerateID()[:10]
+	if settings.MacvlanMode != "" {
+		if _, err := ip("link", "add", "link", settings.Bridge, "name", peer, "type", "macvlan", "mode", settings.MacvlanMode); err != nil {
+			return err
+		}
+	} else {
+		if _, err := ip("link", "add", hostInterface, "type", "veth", "peer", "name", peer); err != nil {
+			return err
+		}
+		if _, err := ip("link", "set", hostInterface, "master", settings.Bridge, "up"); err != nil {
+			ip("link", "del", hostInterface)
+			return err
+		}
+	}
+	if _, err := ip("link", "set", peer, "netns", strconv.Itoa(pid)); err != nil {
+		ip("link", "del", peer)
+		return err
+	}
+	name := peer
+	for _, args := range [][]string{
+		{"link", "set", peer, "name", "eth0"},
+		{"addr", "add", fmt.Sprintf("%s/%d", settings.IPAddress, settings.IPPrefixLen), "dev", "eth0"},
+		{"link", "set", "eth0", "mtu", strconv.Itoa(mtu), "up"},
+	} {
+		if err := ipIn(pid, args...); err != nil {
+			ipIn(pid, "link", "del", name)
+			return err
+		}
+		name = "eth0"
+	}
+	if settings.Gateway != "" {
+		if err := ipIn(pid, "route", "add", "default", "via", settings.Gateway); err != nil {
+			ipIn(pid, "link", "del", "eth0")
+			return err
+		}
+	}
+	return nil
+}
+
+// Run ip in the network namespace of the process pid
+func ipIn(pid int, args ...string) error {
+	output, err := exec.Command("nsenter", append([]string{"-t", strconv.Itoa(pid), "-n", "ip"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip failed in the network namespace of %d: ip %s: %s (%s)", pid, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Rename the container on its network: name replaces its hostname, which the
+// DNS server answers right away, in the -ingress-from of the other containers
+// of the network too. The hostname inside a running container only changes
+// when it restarts.
+func (runtime *Runtime) RenameContainer(container *Container, name string) error {
+	if !validNetworkName.MatchString(name) {
+		return fmt.Errorf("Bad parameter: invalid name %q", name)
+	}
+	runtime.namesLock.Lock()
+	defer runtime.namesLock.Unlock()
+	network := container.networkName()
+	for _, other := range runtime.List() {
+		if other == container || other.networkName() != network {
+			continue
+		}
+		for _, otherName := range other.dnsNames() {
+			if strings.EqualFold(otherName, name) {
+				return fmt.Errorf("Conflict: %s is already used on network %s by %s", name, network, other.ShortID())
+			}
+		}
+	}
+
+	container.State.Lock()
+	old := container.Config.Hostname
+	container.Config.Hostname = name
+	err := container.ToDisk()
+	container.State.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, other := range runtime.List() {
+		if other == container || other.networkName() != network {
+			continue
+		}
+		other.State.Lock()
+		renamed := false
+		for i, from := range other.Config.IngressFrom {
+			if strings.EqualFold(from, old) {
+				other.Config.IngressFrom[i] = name
+				renamed = true
+			}
+		}
+		if renamed {
+			if err := other.ToDisk(); err != nil {
+				log.Printf("WARNING: Unable to save the renamed -ingress-from of %s: %s", other.ID, err)
+			}
+		}
+		other.State.Unlock()
+	}
+	return nil
+}
+
+func (runtime *Runtime) NetworkExists(name string) bool {
+	return name == DefaultNetworkName || runtime.networks.Networks[name] != nil
+}
+
+func (runtime *Runtime) NetworkInfo(name string) (*APINetwork, error) {
+	driver, err := runtime.networkDriverOf(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := driver.NetworkInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	info.Containers = runtime.networkContainers(name)
+	return info, nil
+}
+
+// The names of all the networks, the default one first
+func (runtime *Runtime) NetworkNames() []string {
+	names := []string{}
+	for name := range runtime.networks.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultNetworkName}, names...)
+}
+
+// The IDs of the containers attached to the network name
+func (runtime *Runtime) networkContainers(name string) []string {
+	ids := []string{}
+	for _, container := range runtime.List() {
+		if container.networkName() == name {
+			ids = append(ids, container.ID)
+		}
+	}
+	return ids
+}
+
+// Recreate the networks of the store after a restart
+func (runtime *Runtime) restoreNetworks() {
+	runtime.startDNSServer(DefaultNetworkName)
+	for _, name := range runtime.NetworkNames()[1:] {
+		config := runtime.networks.Networks[name]
+		driver, err := runtime.networkDriverOf(name)
+		if err == nil {
+			err = driver.CreateNetwork(name, config.Options)
+		}
+		if err != nil {
+			log.Printf("WARNING: Failed to restore network %s: %s\n", name, err)
+			continue
+		}
+		runtime.startDNSServer(name)
+	}
+}
+
+// Start the DNS server of the network name on its gateway, if it fails the
+// containers use the same servers as the host.
+func (runtime *Runtime) startDNSServer(name string) {
+	if !EmbeddedDNS {
+		return
+	}
+	info, err := runtime.NetworkInfo(name)
+	// The gateway isn't an address of the host with every driver (e.g: macvlan)
+	if err != nil || info.Gateway == "" || !isLocalAddr(net.ParseIP(info.Gateway)) {
+		return
+	}
+	lookup := func(host string) net.IP {
+		return runtime.lookupContainer(name, host)
+	}
+	server, err := NewDNSServer(&net.UDPAddr{IP: net.ParseIP(info.Gateway), Port: 53}, lookup, runtime.upstreamDNS)
+	if err != nil {
+		log.Printf("WARNING: Unable to start the DNS server of network %s: %s\n", name, err)
+		return
+	}
+	runtime.dnsLock.Lock()
+	runtime.dnsServers[name] = server
+	runtime.dnsLock.Unlock()
+	go server.Run()
+}
+
+func (runtime *Runtime) stopDNSServer(name string) {
+	runtime.dnsLock.Lock()
+	defer runtime.dnsLock.Unlock()
+	if server, exists := runtime.dnsServers[name]; exists {
+		server.Close()
+		delete(runtime.dnsServers, name)
+	}
+}
+
+// The DNS server of the network name (the default one if empty, like
+// Config.Network), nil if it doesn't have one.
+func (runtime *Runtime) dnsServer(name string) *DNSServer {
+	if name == "" {
+		name = DefaultNetworkName
+	}
+	runtime.dnsLock.Lock()
+	defer runtime.dnsLock.Unlock()
+	return runtime.dnsServers[name]
+}
+
+// The address of the running container of the network called host
+func (runtime *Runtime) lookupContainer(network, host string) net.IP {
+	for _, container := range runtime.List() {
+		if container.networkName() != network || !container.State.Running || container.NetworkSettings.IPAddress == "" {
+			continue
+		}
+		for _, name := range container.dnsNames() {
+			if strings.ToLower(name) == host {
+				return net.ParseIP(container.NetworkSettings.IPAddress)
+			}
+		}
+	}
+	return nil
+}
+
+func isLocalAddr(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The servers the queries for anything but the containers are forwarded to:
+// the ones given to the daemon, or the ones of the host.
+func (runtime *Runtime) upstreamDNS() []string {
+	if len(runtime.Dns) > 0 {
+		return runtime.Dns
+	}
+	resolvConf, err := utils.GetResolvConf()
+	if err != nil {
+		return defaultDns
+	}
+	if nameservers := utils.GetNameservers(resolvConf); len(nameservers) > 0 {
+		return nameservers
+	}
+	return defaultDns
+}
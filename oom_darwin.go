@@ -0,0 +1,7 @@
+package docker
+
+import "errors"
+
+func notifyOOM(parent, id string, stop chan struct{}, oomKilled func()) error {
+	return errors.New("OOM notifications are not implemented on darwin")
+}
@@ -0,0 +1,57 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Call oomKilled each time the kernel kills a process of the memory cgroup of
+// the container id (under the cgroup parent, if any) because it's out of
+// memory, until stop is closed or the cgroup is removed.
+func notifyOOM(parent, id string, stop chan struct{}, oomKilled func()) error {
+	dir, err := cgroupPath("memory", parent, id)
+	if err != nil {
+		return err
+	}
+	oomControl, err := os.Open(path.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return err
+	}
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		oomControl.Close()
+		return errno
+	}
+	eventfd := os.NewFile(fd, "eventfd")
+	control := fmt.Sprintf("%d %d", eventfd.Fd(), oomControl.Fd())
+	if err := ioutil.WriteFile(path.Join(dir, "cgroup.event_control"), []byte(control), 0700); err != nil {
+		eventfd.Close()
+		oomControl.Close()
+		return err
+	}
+	go func() {
+		defer oomControl.Close()
+		defer eventfd.Close()
+		buf := make([]byte, 8)
+		for {
+			if _, err := eventfd.Read(buf); err != nil {
+				return
+			}
+			// The eventfd is also notified when the cgroup is removed, the
+			// container may already be restarted with a new one
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := os.Lstat(path.Join(dir, "cgroup.event_control")); os.IsNotExist(err) {
+				return
+			}
+			oomKilled()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The credentials of the process at the other end of conn (SO_PEERCRED),
+// with its supplementary groups in /proc/<pid>/status. The pid may have been
+// reused since the client connected: the groups are only read from a process
+// with its uid and gid, the credentials are unknown otherwise.
+func peerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	cred := &PeerCredentials{Pid: int(ucred.Pid), Uid: int(ucred.Uid), Gids: []int{int(ucred.Gid)}}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", ucred.Pid))
+	if err != nil {
+		// The process may be gone, its primary group is known
+		return cred, nil
+	}
+	defer f.Close()
+	var groups []int
+	uidMatches, gidMatches := false, false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		// Uid: real effective saved filesystem, SO_PEERCRED has the effective one
+		case "Uid:":
+			uidMatches = len(fields) > 2 && fields[2] == strconv.Itoa(int(ucred.Uid))
+		case "Gid:":
+			gidMatches = len(fields) > 2 && fields[2] == strconv.Itoa(int(ucred.Gid))
+		case "Groups:":
+			for _, field := range fields[1:] {
+				if gid, err := strconv.Atoi(field); err == nil && gid != int(ucred.Gid) {
+					groups = append(groups, gid)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !uidMatches || !gidMatches {
+		return nil, fmt.Errorf("the process %d isn't the client anymore", ucred.Pid)
+	}
+	cred.Gids = append(cred.Gids, groups...)
+	return cred, nil
+}
@@ -16,6 +16,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,7 +41,15 @@ func pingRegistryEndpoint(endpoint string) error {
 		conn.SetDeadline(time.Now().Add(time.Duration(10) * time.Second))
 		return conn, nil
 	}
-	httpTransport := &http.Transport{Dial: httpDial}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	config, err := registryTLSConfig(u.Host)
+	if err != nil {
+		return err
+	}
+	httpTransport := &http.Transport{Dial: httpDial, TLSClientConfig: config}
 	client := &http.Client{Transport: httpTransport}
 	resp, err := client.Get(endpoint + "_ping")
 	if err != nil {
@@ -104,6 +113,10 @@ func ResolveRepositoryName(reposName string) (string, string, error) {
 	}
 	endpoint := fmt.Sprintf("https://%s/v1/", hostname)
 	if err := pingRegistryEndpoint(endpoint); err != nil {
+		// Only the insecure registries are reached over plain http
+		if !IsInsecureRegistry(hostname) {
+			return "", "", fmt.Errorf("Invalid Registry endpoint %s: %s (start the daemon with -insecure-registry %s for a registry over http or with a self-signed certificate)", endpoint, err, hostname)
+		}
 		utils.Debugf("Registry %s does not work (%s), falling back to http", endpoint, err)
 		endpoint = fmt.Sprintf("http://%s/v1/", hostname)
 		if err = pingRegistryEndpoint(endpoint); err != nil {
@@ -129,6 +142,27 @@ func doWithCookies(c *http.Client, req *http.Request) (*http.Response, error) {
 	return res, err
 }
 
+// Authenticate req with the tokens the index gave for its registries, a
+// mirror doesn't get any
+func setTokenAuth(req *http.Request, token []string) {
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	}
+}
+
+// ValidateMirror checks the url of a registry mirror, http(s)://host[:port],
+// and returns its endpoint
+func ValidateMirror(mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return "", fmt.Errorf("Invalid registry mirror %s: %s", mirror, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return "", fmt.Errorf("Invalid registry mirror %s (http(s)://host[:port])", mirror)
+	}
+	return fmt.Sprintf("%s://%s/v1/", u.Scheme, u.Host), nil
+}
+
 // Retrieve the history of a given image from the Registry.
 // Return a list of the parent's json (requested image included)
 func (r *Registry) GetRemoteHistory(imgID, registry string, token []string) ([]string, error) {
@@ -136,7 +170,7 @@ func (r *Registry) GetRemoteHistory(imgID, registry string, token []string) ([]s
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	setTokenAuth(req, token)
 	res, err := doWithCookies(r.client, req)
 	if err != nil || res.StatusCode != 200 {
 		if res != nil {
@@ -166,7 +200,7 @@ func (r *Registry) LookupRemoteImage(imgID, registry string, token []string) boo
 	if err != nil {
 		return false
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	setTokenAuth(req, token)
 	res, err := doWithCookies(r.client, req)
 	if err != nil {
 		return false
@@ -182,7 +216,7 @@ func (r *Registry) GetRemoteImageJSON(imgID, registry string, token []string) ([
 	if err != nil {
 		return nil, -1, fmt.Errorf("Failed to download json: %s", err)
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	setTokenAuth(req, token)
 	res, err := doWithCookies(r.client, req)
 	if err != nil {
 		return nil, -1, fmt.Errorf("Failed to download json: %s", err)
@@ -204,21 +238,164 @@ func (r *Registry) GetRemoteImageJSON(imgID, registry string, token []string) ([
 	return jsonString, imageSize, nil
 }
 
+// How many times the download of a layer is resumed after transient errors
+// without receiving anything, and the delay before the first attempt, which
+// grows with each of them
+var (
+	layerDownloadRetries = 5
+	layerRetryDelay      = time.Second
+)
+
+// GetRemoteImageLayer returns the layer of an image. When the connection
+// breaks or the registry fails (5xx) the download is resumed from the last
+// byte received, with a Range request.
 func (r *Registry) GetRemoteImageLayer(imgID, registry string, token []string) (io.ReadCloser, error) {
-	req, err := r.reqFactory.NewRequest("GET", registry+"images/"+imgID+"/layer", nil)
+	return r.getResumable(imgID, registry+"images/"+imgID+"/layer", func(req *http.Request) error {
+		setTokenAuth(req, token)
+		return nil
+	})
+}
+
+// Get the layer id at url, authenticating the requests with authorize
+func (r *Registry) getResumable(id, url string, authorize func(*http.Request) error) (io.ReadCloser, error) {
+	layer := &resumableLayer{
+		r:         r,
+		id:        id,
+		url:       url,
+		authorize: authorize,
+		done:      make(chan struct{}),
+	}
+	if retry, err := layer.request(); err != nil {
+		if !retry {
+			return nil, err
+		}
+		if err := layer.resume(err); err != nil {
+			return nil, err
+		}
+	}
+	return layer, nil
+}
+
+// The error of the reads of a layer closed during its download
+var errLayerClosed = errors.New("The download of the layer was canceled")
+
+type resumableLayer struct {
+	r         *Registry
+	id        string
+	url       string
+	authorize func(*http.Request) error
+	received  int64 // The bytes of the layer read so far
+	retries   int   // The attempts since the last byte received
+
+	// Close interrupts the reads and the retries, it closes done
+	lock   sync.Mutex
+	body   io.ReadCloser
+	closed bool
+	done   chan struct{}
+}
+
+// Request the layer from the first byte not received, and return whether
+// the request may be retried if it fails
+func (layer *resumableLayer) request() (bool, error) {
+	req, err := layer.r.reqFactory.NewRequest("GET", layer.url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Error while getting from the server: %s\n", err)
+		return false, fmt.Errorf("Error while getting from the server: %s\n", err)
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
-	res, err := doWithCookies(r.client, req)
+	if err := layer.authorize(req); err != nil {
+		return false, err
+	}
+	if layer.received != 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", layer.received))
+	}
+	res, err := doWithCookies(layer.r.client, req)
 	if err != nil {
-		return nil, err
+		return true, err
+	}
+	switch {
+	case res.StatusCode == 206 && layer.received != 0 && strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", layer.received)):
+	case res.StatusCode == 200:
+		// A registry without Range support sends the whole layer again
+		if _, err := io.CopyN(ioutil.Discard, res.Body, layer.received); err != nil {
+			res.Body.Close()
+			return true, err
+		}
+	default:
+		res.Body.Close()
+		return res.StatusCode >= 500, fmt.Errorf("Server error: Status %d while fetching image layer (%s)",
+			res.StatusCode, layer.id)
+	}
+	layer.lock.Lock()
+	defer layer.lock.Unlock()
+	if layer.closed {
+		res.Body.Close()
+		return false, errLayerClosed
+	}
+	layer.body = res.Body
+	return false, nil
+}
+
+// Request the layer again after the transient error cause, as long as the
+// retries aren't exhausted and the layer isn't closed
+func (layer *resumableLayer) resume(cause error) error {
+	for layer.retries < layerDownloadRetries {
+		layer.retries++
+		delay := time.Duration(layer.retries) * layerRetryDelay
+		utils.Debugf("Resuming the download of the layer %s at byte %d in %v (%s)", layer.id, layer.received, delay, cause)
+		select {
+		case <-time.After(delay):
+		case <-layer.done:
+			return errLayerClosed
+		}
+		retry, err := layer.request()
+		if err == nil {
+			return nil
+		} else if !retry {
+			return err
+		}
+		cause = err
 	}
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("Server error: Status %d while fetching image layer (%s)",
-			res.StatusCode, imgID)
+	return cause
+}
+
+func (layer *resumableLayer) Read(data []byte) (int, error) {
+	layer.lock.Lock()
+	if layer.closed {
+		layer.lock.Unlock()
+		return 0, errLayerClosed
+	}
+	body := layer.body
+	layer.lock.Unlock()
+	n, err := body.Read(data)
+	layer.received += int64(n)
+	if n > 0 {
+		layer.retries = 0
+	}
+	if err != nil && err != io.EOF {
+		layer.lock.Lock()
+		closed := layer.closed
+		layer.lock.Unlock()
+		// The read failed because the layer was closed
+		if closed {
+			return n, errLayerClosed
+		}
+		body.Close()
+		if err := layer.resume(err); err != nil {
+			return n, err
+		}
+		return n, nil
 	}
-	return res.Body, nil
+	return n, err
+}
+
+func (layer *resumableLayer) Close() error {
+	layer.lock.Lock()
+	defer layer.lock.Unlock()
+	if layer.closed {
+		return nil
+	}
+	layer.closed = true
+	close(layer.done)
+	return layer.body.Close()
 }
 
 func (r *Registry) GetRemoteTags(registries []string, repository string, token []string) (map[string]string, error) {
@@ -553,8 +730,14 @@ func (r *Registry) PushImageJSONIndex(indexEp, remote string, imgList []*ImgData
 	}, nil
 }
 
-func (r *Registry) SearchRepositories(term string) (*SearchResults, error) {
-	u := auth.IndexServerAddress() + "search?q=" + url.QueryEscape(term)
+// SearchRepositories returns the page (from 1) of pageSize results of the
+// search of term on the index at indexEp
+func (r *Registry) SearchRepositories(indexEp, term string, page, pageSize int) (*SearchResults, error) {
+	v := url.Values{}
+	v.Set("q", term)
+	v.Set("page", strconv.Itoa(page))
+	v.Set("n", strconv.Itoa(pageSize))
+	u := indexEp + "search?" + v.Encode()
 	req, err := r.reqFactory.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
@@ -589,9 +772,21 @@ func (r *Registry) GetAuthConfig(withPasswd bool) *auth.AuthConfig {
 }
 
 type SearchResults struct {
-	Query      string              `json:"query"`
-	NumResults int                 `json:"num_results"`
-	Results    []map[string]string `json:"results"`
+	Query      string         `json:"query"`
+	NumResults int            `json:"num_results"`
+	NumPages   int            `json:"num_pages"`
+	Page       int            `json:"page"`
+	PageSize   int            `json:"page_size"`
+	Results    []SearchResult `json:"results"`
+}
+
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	StarCount   int    `json:"star_count"`
+	IsOfficial  bool   `json:"is_official"`
+	IsAutomated bool   `json:"is_automated"`
+	IsTrusted   bool   `json:"is_trusted"` // is_automated before it was renamed
 }
 
 type RepositoryData struct {
@@ -613,15 +808,10 @@ type Registry struct {
 }
 
 func NewRegistry(root string, authConfig *auth.AuthConfig, factory *utils.HTTPRequestFactory) (r *Registry, err error) {
-	httpTransport := &http.Transport{
-		DisableKeepAlives: true,
-		Proxy:             http.ProxyFromEnvironment,
-	}
-
 	r = &Registry{
 		authConfig: authConfig,
 		client: &http.Client{
-			Transport: httpTransport,
+			Transport: &registryTransport{},
 		},
 	}
 	r.client.Jar, err = cookiejar.New(nil)
@@ -321,7 +321,26 @@ func handlerAuth(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlerSearch(w http.ResponseWriter, r *http.Request) {
-	writeResponse(w, "{}", 200)
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	pageSize, _ := strconv.Atoi(query.Get("n"))
+	results := []map[string]interface{}{}
+	if query.Get("q") == "busybox" && page == 1 {
+		results = append(results, map[string]interface{}{
+			"name":        "busybox",
+			"description": "Busybox base image.",
+			"star_count":  42,
+			"is_official": true,
+		})
+	}
+	writeResponse(w, map[string]interface{}{
+		"query":       query.Get("q"),
+		"num_results": len(results),
+		"num_pages":   1,
+		"page":        page,
+		"page_size":   pageSize,
+		"results":     results,
+	}, 200)
 }
 
 func TestPing(t *testing.T) {
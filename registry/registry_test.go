@@ -1,10 +1,28 @@
 package registry
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"github.com/dotcloud/docker/auth"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -82,6 +100,547 @@ func TestGetRemoteImageLayer(t *testing.T) {
 	}
 }
 
+// Test that a broken layer download is resumed from the last byte received
+func TestGetRemoteImageLayerResume(t *testing.T) {
+	layerRetryDelay = time.Millisecond
+	content := bytes.Repeat([]byte("layer"), 10000)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		switch len(ranges) {
+		case 1:
+			// The connection breaks after half the layer
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(200)
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case 2:
+			w.WriteHeader(503)
+		default:
+			var start int
+			fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+			w.WriteHeader(206)
+			w.Write(content[start:])
+		}
+	}))
+	defer server.Close()
+	r := spawnTestRegistry(t)
+	layer, err := r.GetRemoteImageLayer(IMAGE_ID, server.URL+"/v1/", TOKEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+	data, err := ioutil.ReadAll(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expected the layer of %d bytes, not %d", len(content), len(data))
+	}
+	expected := fmt.Sprintf("bytes=%d-", len(content)/2)
+	if len(ranges) != 3 || ranges[0] != "" || ranges[1] != expected || ranges[2] != expected {
+		t.Fatalf("Unexpected Range requests: %v", ranges)
+	}
+}
+
+// Test that a layer closed during its download isn't resumed
+func TestGetRemoteImageLayerClose(t *testing.T) {
+	layerRetryDelay = time.Millisecond
+	requests := 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(200)
+		w.Write([]byte("layer"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	r := spawnTestRegistry(t)
+	layer, err := r.GetRemoteImageLayer(IMAGE_ID, server.URL+"/v1/", TOKEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		layer.Close()
+	}()
+	if _, err := ioutil.ReadAll(layer); err == nil {
+		t.Fatal("Expected an error for a layer closed during its download")
+	}
+	if requests != 1 {
+		t.Fatalf("Expected the download not to be resumed, got %d requests", requests)
+	}
+	if _, err := layer.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected an error reading a closed layer")
+	}
+}
+
+// Verify the signatures of a manifest like a registry, and return the
+// content its digest is computed on
+func verifyManifest(content []byte) ([]byte, error) {
+	payload, signed, err := manifestPayload(content)
+	if err != nil {
+		return nil, err
+	} else if !signed {
+		return nil, fmt.Errorf("The manifest isn't signed")
+	}
+	var manifest struct {
+		Signatures []*manifestSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+	for _, signature := range manifest.Signatures {
+		jwk := signature.Header.JWK
+		if signature.Header.Algorithm != "ES256" || jwk == nil || jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("Unexpected signature %v", signature.Header)
+		}
+		x, err1 := joseBase64Decode(jwk.X)
+		y, err2 := joseBase64Decode(jwk.Y)
+		raw, err3 := joseBase64Decode(signature.Signature)
+		if err1 != nil || err2 != nil || err3 != nil || len(raw) != 64 {
+			return nil, fmt.Errorf("Invalid signature %v", signature)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if kid, err := trustKeyID(pub); err != nil || kid != jwk.Kid {
+			return nil, fmt.Errorf("The key id %s doesn't match the key %s", jwk.Kid, kid)
+		}
+		hash := sha256.Sum256([]byte(signature.Protected + "." + joseBase64(payload)))
+		if !ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(raw[:32]), new(big.Int).SetBytes(raw[32:])) {
+			return nil, fmt.Errorf("Invalid signature of the manifest")
+		}
+	}
+	return payload, nil
+}
+
+func TestV2Repository(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	TrustKeyPath, trustKey = path.Join(tmp, "key.json"), nil
+	defer func() { TrustKeyPath, trustKey = "/etc/docker/key.json", nil }()
+
+	blobs := make(map[string][]byte)
+	manifests := make(map[string][]byte)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		if req.URL.Path == "/token" {
+			if scope := req.URL.Query().Get("scope"); scope != "repository:foo/bar:pull,push" && scope != "repository:foo/bar:pull" {
+				t.Errorf("Unexpected scope %s", scope)
+			}
+			fmt.Fprintf(w, `{"token": "fake-bearer"}`)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer fake-bearer" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:foo/bar:pull,push"`, server.URL))
+			w.WriteHeader(401)
+			return
+		}
+		switch {
+		case req.URL.Path == "/v2/":
+		case req.Method == "POST" && req.URL.Path == "/v2/foo/bar/blobs/uploads/":
+			w.Header().Set("Location", "/v2/foo/bar/blobs/uploads/1?state=x")
+			w.WriteHeader(202)
+		case req.Method == "PUT" && req.URL.Path == "/v2/foo/bar/blobs/uploads/1":
+			content, _ := ioutil.ReadAll(req.Body)
+			blobs[req.URL.Query().Get("digest")] = content
+			w.WriteHeader(201)
+		case strings.HasPrefix(req.URL.Path, "/v2/foo/bar/blobs/"):
+			content, exists := blobs[strings.TrimPrefix(req.URL.Path, "/v2/foo/bar/blobs/")]
+			if !exists {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(content)
+		case req.Method == "PUT" && strings.HasPrefix(req.URL.Path, "/v2/foo/bar/manifests/"):
+			content, _ := ioutil.ReadAll(req.Body)
+			payload, err := verifyManifest(content)
+			if err != nil || req.Header.Get("Content-Type") != SignedManifestMediaType {
+				t.Errorf("The registry rejects the manifest %s: %v", req.Header.Get("Content-Type"), err)
+				w.WriteHeader(400)
+				return
+			}
+			manifests[strings.TrimPrefix(req.URL.Path, "/v2/foo/bar/manifests/")] = content
+			manifests[Digest(payload)] = content
+			w.Header().Set("Docker-Content-Digest", Digest(payload))
+			w.WriteHeader(201)
+		case strings.HasPrefix(req.URL.Path, "/v2/foo/bar/manifests/"):
+			content, exists := manifests[strings.TrimPrefix(req.URL.Path, "/v2/foo/bar/manifests/")]
+			if !exists {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(content)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	r := spawnTestRegistry(t)
+	repo, err := r.NewV2Repository(server.URL+"/v1/", "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := []byte("layer")
+	blobSum := Digest(layer)
+	if exists, err := repo.BlobExists(blobSum); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatalf("The blob %s shouldn't exist", blobSum)
+	}
+	if err := repo.PushBlob(blobSum, bytes.NewReader(layer), int64(len(layer))); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := repo.BlobExists(blobSum); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatalf("The blob %s should exist", blobSum)
+	}
+
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion": 1, "name": "foo/bar", "tag": "latest", "fsLayers": [{"blobSum": "%s"}], "history": [{"v1Compatibility": "{\"id\": \"%s\"}"}]}`, blobSum, IMAGE_ID))
+	digest, err := repo.PutManifest("latest", manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, digest, Digest(manifest), "Unexpected digest of the manifest")
+	// The registries sign the manifests they serve again, the digest stays
+	resigned, err := signManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(resigned, manifests["latest"]) {
+		t.Fatalf("Expected another signature of the manifest")
+	}
+	manifests["latest"] = resigned
+	// The trust key is kept in TrustKeyPath
+	key := trustKey
+	trustKey = nil
+	if reloaded, err := loadTrustKey(); err != nil || reloaded.D.Cmp(key.D) != 0 || reloaded.X.Cmp(key.X) != 0 {
+		t.Fatalf("Expected the trust key to be loaded again: %v", err)
+	}
+	for _, reference := range []string{"latest", digest} {
+		m, d, err := repo.GetManifest(reference, Platform{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, d, digest, "Unexpected digest of "+reference)
+		assertEqual(t, m.FSLayers[0].BlobSum, blobSum, "Unexpected layer of "+reference)
+	}
+
+	blob, err := repo.GetBlob(blobSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadAll(blob); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(content, layer) {
+		t.Fatalf("Unexpected blob %s", content)
+	}
+	blob.Close()
+
+	// The content not matching its digest is an error
+	blobs[blobSum] = []byte("tampered")
+	blob, err = repo.GetBlob(blobSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(blob); err == nil {
+		t.Fatalf("Reading a tampered blob should fail")
+	}
+	blob.Close()
+	manifests[digest] = []byte(`{"schemaVersion": 1}`)
+	if _, _, err := repo.GetManifest(digest, Platform{}); err == nil {
+		t.Fatalf("Getting a tampered manifest should fail")
+	}
+}
+
+func TestV2ManifestList(t *testing.T) {
+	manifests := make(map[string][]byte)
+	for _, arch := range []string{"x86_64", "arm64"} {
+		manifest := []byte(fmt.Sprintf(`{"schemaVersion": 1, "name": "foo/bar", "tag": "%s", "architecture": "%s", "fsLayers": [{"blobSum": "%s"}], "history": [{"v1Compatibility": "{}"}]}`, arch, arch, Digest([]byte(arch))))
+		manifests[arch] = manifest
+		manifests[Digest(manifest)] = manifest
+	}
+	var mediaTypes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		reference := strings.TrimPrefix(req.URL.Path, "/v2/foo/bar/manifests/")
+		switch {
+		case req.URL.Path == "/v2/":
+		case req.Method == "PUT":
+			mediaTypes = append(mediaTypes, req.Header.Get("Content-Type"))
+			content, _ := ioutil.ReadAll(req.Body)
+			manifests[reference] = content
+			w.WriteHeader(201)
+		case manifests[reference] != nil:
+			w.Write(manifests[reference])
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	r := spawnTestRegistry(t)
+	repo, err := r.NewV2Repository(server.URL+"/v1/", "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &ManifestList{SchemaVersion: 2, MediaType: ManifestListMediaType}
+	for _, tag := range []string{"x86_64", "arm64"} {
+		descriptor, err := repo.GetManifestDescriptor(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list.Manifests = append(list.Manifests, *descriptor)
+	}
+	assertEqual(t, list.Manifests[0].Platform.Architecture, "amd64", "Unexpected architecture of x86_64")
+	digest, err := repo.PutManifestList("latest", list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, mediaTypes[0], ManifestListMediaType, "Unexpected media type of the manifest list")
+
+	// Each platform gets its manifest, with the digest of the list
+	for arch, tag := range map[string]string{"amd64": "x86_64", "arm64": "arm64"} {
+		manifest, d, err := repo.GetManifest("latest", Platform{Architecture: arch, OS: "linux"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, manifest.Tag, tag, "Unexpected manifest of "+arch)
+		assertEqual(t, d, digest, "Unexpected digest of the manifest list")
+	}
+	if _, _, err := repo.GetManifest("latest", Platform{Architecture: "s390x", OS: "linux"}); err == nil {
+		t.Fatalf("A manifest list without manifest for the platform should fail")
+	}
+}
+
+func TestV2TokenExpiry(t *testing.T) {
+	// The server only accepts the last token it issued
+	issued := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		if req.URL.Path == "/token" {
+			issued++
+			fmt.Fprintf(w, `{"token": "token-%d", "expires_in": 300}`, issued)
+			return
+		}
+		if req.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", issued) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprintf(w, `{"tags": ["latest"]}`)
+	}))
+	defer server.Close()
+
+	r := spawnTestRegistry(t)
+	repo, err := r.NewV2Repository(server.URL+"/v1/", "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetTags(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetTags(); err != nil || issued != 1 {
+		t.Fatalf("The token should be reused until it expires, %d issued: %v", issued, err)
+	}
+	repo.tokens["repository:foo/bar:pull"].expires = time.Now().Add(-time.Second)
+	if _, err := repo.GetTags(); err != nil || issued != 2 {
+		t.Fatalf("An expired token should be renewed, %d issued: %v", issued, err)
+	}
+	// A token the registry refuses is renewed
+	issued++
+	if _, err := repo.GetTags(); err != nil || issued != 4 {
+		t.Fatalf("A refused token should be renewed, %d issued: %v", issued, err)
+	}
+}
+
+func TestV2BlobMount(t *testing.T) {
+	blobSum := Digest([]byte("layer"))
+	mounts := true
+	var scopes [][]string
+	var deleted []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		if req.URL.Path == "/token" {
+			scopes = append(scopes, req.URL.Query()["scope"])
+			fmt.Fprintf(w, `{"token": "fake-bearer"}`)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer fake-bearer" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(401)
+			return
+		}
+		switch {
+		case req.URL.Path == "/v2/":
+		case req.Method == "HEAD" && req.URL.Path == "/v2/foo/base/blobs/"+blobSum:
+		case req.Method == "POST" && req.URL.Path == "/v2/foo/bar/blobs/uploads/":
+			if mounts && req.URL.Query().Get("mount") == blobSum && req.URL.Query().Get("from") == "foo/base" {
+				w.WriteHeader(201)
+				return
+			}
+			w.Header().Set("Location", "/v2/foo/bar/blobs/uploads/1")
+			w.WriteHeader(202)
+		case req.Method == "DELETE":
+			deleted = append(deleted, req.URL.Path)
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	r := spawnTestRegistry(t)
+	repo, err := r.NewV2Repository(server.URL+"/v1/", "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := repo.BlobExistsIn("foo/base", blobSum); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatal("The blob of foo/base should exist")
+	}
+	if exists, err := repo.BlobExistsIn("foo/other", blobSum); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("The blob of foo/other shouldn't exist")
+	}
+	if mounted, err := repo.MountBlob(blobSum, "foo/base"); err != nil {
+		t.Fatal(err)
+	} else if !mounted {
+		t.Fatal("The blob should be mounted")
+	}
+	expected := []string{"repository:foo/bar:pull,push", "repository:foo/base:pull"}
+	if last := scopes[len(scopes)-1]; len(last) != 2 || last[0] != expected[0] || last[1] != expected[1] {
+		t.Fatalf("Unexpected scopes of the mount: %v", last)
+	}
+
+	// The upload a registry without mounts starts is canceled
+	mounts = false
+	if mounted, err := repo.MountBlob(blobSum, "foo/base"); err != nil {
+		t.Fatal(err)
+	} else if mounted {
+		t.Fatal("The blob shouldn't be mounted")
+	}
+	if len(deleted) != 1 || deleted[0] != "/v2/foo/bar/blobs/uploads/1" {
+		t.Fatalf("The upload should be canceled, not %v", deleted)
+	}
+}
+
+func TestValidateMirror(t *testing.T) {
+	for mirror, expected := range map[string]string{
+		"http://mirror.local":        "http://mirror.local/v1/",
+		"https://mirror.local:5000/": "https://mirror.local:5000/v1/",
+	} {
+		endpoint, err := ValidateMirror(mirror)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, endpoint, expected, "Unexpected endpoint of "+mirror)
+	}
+	for _, mirror := range []string{"mirror.local", "ftp://mirror.local", "http://mirror.local/v1/", "http://"} {
+		if _, err := ValidateMirror(mirror); err == nil {
+			t.Fatalf("%s should be an invalid mirror", mirror)
+		}
+	}
+}
+
+func TestIsInsecureRegistry(t *testing.T) {
+	InsecureRegistries = []string{"registry.local:5000", "10.1.0.0/16"}
+	defer func() { InsecureRegistries = nil }()
+	for hostname, insecure := range map[string]bool{
+		"localhost:5000":      true,
+		"127.0.0.1":           true,
+		"registry.local:5000": true,
+		"registry.local:5001": false,
+		"10.1.2.3:5000":       true,
+		"10.2.2.3:5000":       false,
+	} {
+		assertEqual(t, IsInsecureRegistry(hostname), insecure, "Unexpected security of "+hostname)
+	}
+	for _, invalid := range []string{"http://registry.local", "10.1.0.0/33"} {
+		if err := ValidateInsecureRegistry(invalid); err == nil {
+			t.Fatalf("%s should be an invalid insecure registry", invalid)
+		}
+	}
+}
+
+func TestRegistryTLSConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-certs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	CertsDir = tmp
+	defer func() { CertsDir = "/etc/docker/certs.d" }()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := path.Join(tmp, "registry.local:5000")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	for name, data := range map[string][]byte{
+		"ca.crt":      certPem,
+		"client.cert": certPem,
+		"client.key":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, err := registryTLSConfig("registry.local:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(config.Certificates), 1, "Expected a client certificate")
+	assertEqual(t, len(config.RootCAs.Subjects()), 1, "Expected a CA certificate")
+	assertEqual(t, config.InsecureSkipVerify, false, "Expected the certificate of the registry to be verified")
+	if config, err := registryTLSConfig("registry.local"); err != nil {
+		t.Fatal(err)
+	} else if len(config.Certificates) != 0 || config.RootCAs != nil {
+		t.Fatal("Expected the default TLS config for a registry without certificates")
+	}
+
+	// A key without its certificate
+	if err := os.Remove(path.Join(dir, "client.cert")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registryTLSConfig("registry.local:5000"); err == nil {
+		t.Fatal("Expected an error for a client key without certificate")
+	}
+}
+
 func TestGetRemoteTags(t *testing.T) {
 	r := spawnTestRegistry(t)
 	tags, err := r.GetRemoteTags([]string{makeURL("/v1/")}, REPO, TOKEN)
@@ -187,7 +746,7 @@ func TestPushImageJSONIndex(t *testing.T) {
 
 func TestSearchRepositories(t *testing.T) {
 	r := spawnTestRegistry(t)
-	results, err := r.SearchRepositories("supercalifragilisticepsialidocious")
+	results, err := r.SearchRepositories(makeURL("/v1/"), "supercalifragilisticepsialidocious", 1, 25)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -195,4 +754,15 @@ func TestSearchRepositories(t *testing.T) {
 		t.Fatal("Expected non-nil SearchResults object")
 	}
 	assertEqual(t, results.NumResults, 0, "Expected 0 search results")
+
+	results, err = r.SearchRepositories(makeURL("/v1/"), "busybox", 1, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results.Results), 1, "Expected 1 search result")
+	assertEqual(t, results.PageSize, 25, "Expected the page size to be sent")
+	result := results.Results[0]
+	if result.Name != "busybox" || result.StarCount != 42 || !result.IsOfficial || result.IsAutomated {
+		t.Fatalf("Unexpected search result: %#v", result)
+	}
 }
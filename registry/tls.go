@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+var (
+	// The registries reached over plain http or with an unverified
+	// certificate, with -insecure-registry: host[:port], or a CIDR their
+	// address is in. The ones on the loopback interface always are.
+	InsecureRegistries []string
+
+	// The directory of the certificates of the registries. <CertsDir>/<host[:port]>
+	// has the CA certificates checking the one of the registry (*.crt), and
+	// the client certificates docker presents to it (<name>.cert with the
+	// key <name>.key).
+	CertsDir = "/etc/docker/certs.d"
+)
+
+// ValidateInsecureRegistry checks an entry of InsecureRegistries
+func ValidateInsecureRegistry(registry string) error {
+	if strings.Contains(registry, "://") {
+		return fmt.Errorf("Invalid insecure registry %s, host[:port] or CIDR without scheme", registry)
+	}
+	if strings.Contains(registry, "/") {
+		if _, _, err := net.ParseCIDR(registry); err != nil {
+			return fmt.Errorf("Invalid insecure registry %s: %s", registry, err)
+		}
+	}
+	return nil
+}
+
+// IsInsecureRegistry returns whether the registry at hostname (host[:port])
+// is reached over plain http or with an unverified certificate
+func IsInsecureRegistry(hostname string) bool {
+	host := hostname
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if addrs, err := net.LookupIP(host); err == nil {
+		ips = addrs
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			return true
+		}
+	}
+	for _, registry := range InsecureRegistries {
+		if registry == hostname || registry == host {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(registry); err == nil {
+			for _, ip := range ips {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// The TLS config of the connections to the registry at hostname, with the
+// certificates of its directory in CertsDir
+func registryTLSConfig(hostname string) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: IsInsecureRegistry(hostname)}
+	dir := path.Join(CertsDir, hostname)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".crt"):
+			pem, err := ioutil.ReadFile(path.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			if config.RootCAs == nil {
+				config.RootCAs = x509.NewCertPool()
+			}
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("Invalid CA certificate %s: no certificate", path.Join(dir, name))
+			}
+		case strings.HasSuffix(name, ".cert"):
+			key := strings.TrimSuffix(name, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(path.Join(dir, name), path.Join(dir, key))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid client certificate %s: %s", path.Join(dir, name), err)
+			}
+			config.Certificates = append(config.Certificates, cert)
+		case strings.HasSuffix(name, ".key"):
+			cert := strings.TrimSuffix(name, ".key") + ".cert"
+			if _, err := os.Stat(path.Join(dir, cert)); err != nil {
+				return nil, fmt.Errorf("Missing client certificate %s for the key %s", cert, path.Join(dir, name))
+			}
+		}
+	}
+	return config, nil
+}
+
+// A transport using the TLS config of each registry
+type registryTransport struct {
+	sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func (t *registryTransport) transport(hostname string) (*http.Transport, error) {
+	t.Lock()
+	defer t.Unlock()
+	if transport, exists := t.transports[hostname]; exists {
+		return transport, nil
+	}
+	config, err := registryTLSConfig(hostname)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   config,
+	}
+	if t.transports == nil {
+		t.transports = make(map[string]*http.Transport)
+	}
+	t.transports[hostname] = transport
+	return transport, nil
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport, err := t.transport(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// The media type of the signed manifests of the schema 1
+const SignedManifestMediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+
+var (
+	// The key of the daemon signing the manifests it pushes, in the JWK
+	// format of libtrust. It's created the first time it's needed.
+	TrustKeyPath = "/etc/docker/key.json"
+
+	trustKeyLock sync.Mutex
+	trustKey     *ecdsa.PrivateKey
+)
+
+// A P-256 key in the JWK format, without d for a public key
+type jsonWebKey struct {
+	Crv string `json:"crv"`
+	D   string `json:"d,omitempty"`
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// A signature of a manifest, which signs its content up to formatLength
+// followed by formatTail: the manifest without its signatures
+type manifestSignature struct {
+	Header struct {
+		JWK       *jsonWebKey `json:"jwk"`
+		Algorithm string      `json:"alg"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+	Protected string `json:"protected"`
+}
+
+type protectedHeader struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+	Time         string `json:"time"`
+}
+
+func joseBase64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func joseBase64Decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// The coordinates of a P-256 key on 32 bytes
+func fixedBytes(n *big.Int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// The id of a key for libtrust: the base32 of the first 240 bits of the
+// sha256 of its DER, in groups of 4 characters
+func trustKeyID(pub *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	encoded := strings.TrimRight(base32.StdEncoding.EncodeToString(sum[:30]), "=")
+	groups := []string{}
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, ":"), nil
+}
+
+func publicJWK(pub *ecdsa.PublicKey) (*jsonWebKey, error) {
+	kid, err := trustKeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonWebKey{Crv: "P-256", Kid: kid, Kty: "EC", X: joseBase64(fixedBytes(pub.X)), Y: joseBase64(fixedBytes(pub.Y))}, nil
+}
+
+// Load the trust key, or create it
+func loadTrustKey() (*ecdsa.PrivateKey, error) {
+	trustKeyLock.Lock()
+	defer trustKeyLock.Unlock()
+	if trustKey != nil {
+		return trustKey, nil
+	}
+	content, err := ioutil.ReadFile(TrustKeyPath)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		jwk, err := publicJWK(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		jwk.D = joseBase64(fixedBytes(key.D))
+		content, err := json.MarshalIndent(jwk, "", "   ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(path.Dir(TrustKeyPath), 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(TrustKeyPath, content, 0600); err != nil {
+			return nil, err
+		}
+		trustKey = key
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	jwk := &jsonWebKey{}
+	if err := json.Unmarshal(content, jwk); err != nil {
+		return nil, fmt.Errorf("Invalid trust key %s: %s", TrustKeyPath, err)
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+		return nil, fmt.Errorf("Unsupported trust key %s: %s %s, not EC P-256", TrustKeyPath, jwk.Kty, jwk.Crv)
+	}
+	var coordinates [3]*big.Int
+	for i, s := range []string{jwk.X, jwk.Y, jwk.D} {
+		b, err := joseBase64Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trust key %s: %s", TrustKeyPath, err)
+		}
+		coordinates[i] = new(big.Int).SetBytes(b)
+	}
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: coordinates[0], Y: coordinates[1]},
+		D:         coordinates[2],
+	}
+	trustKey = key
+	return key, nil
+}
+
+func notSpace(r rune) bool {
+	return !unicode.IsSpace(r)
+}
+
+// Sign the manifest content with the trust key, in the pretty JWS format
+// of libtrust: the signatures are inserted before its closing brace
+func signManifest(content []byte) ([]byte, error) {
+	key, err := loadTrustKey()
+	if err != nil {
+		return nil, err
+	}
+	closeIndex := bytes.LastIndexFunc(content, notSpace)
+	if closeIndex < 0 || content[closeIndex] != '}' {
+		return nil, fmt.Errorf("Invalid manifest: not a JSON object")
+	}
+	formatLength := bytes.LastIndexFunc(content[:closeIndex], notSpace) + 1
+	tail := content[formatLength:]
+	protected, err := json.Marshal(&protectedHeader{
+		FormatLength: formatLength,
+		FormatTail:   joseBase64(tail),
+		Time:         time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	signature := &manifestSignature{Protected: joseBase64(protected)}
+	hash := sha256.Sum256([]byte(signature.Protected + "." + joseBase64(content)))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	signature.Signature = joseBase64(append(fixedBytes(r), fixedBytes(s)...))
+	if signature.Header.JWK, err = publicJWK(&key.PublicKey); err != nil {
+		return nil, err
+	}
+	signature.Header.Algorithm = "ES256"
+	signatures, err := json.MarshalIndent([]*manifestSignature{signature}, "   ", "   ")
+	if err != nil {
+		return nil, err
+	}
+	signed := append([]byte{}, content[:formatLength]...)
+	signed = append(signed, ",\n   \"signatures\": "...)
+	signed = append(signed, signatures...)
+	return append(signed, tail...), nil
+}
+
+// The payload of a signed manifest, without its signatures: the registries
+// compute the digest of the manifest on it. An unsigned manifest is its own
+// payload.
+func manifestPayload(content []byte) ([]byte, bool, error) {
+	var signed struct {
+		Signatures []*manifestSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(content, &signed); err != nil {
+		return nil, false, fmt.Errorf("Invalid manifest: %s", err)
+	}
+	if len(signed.Signatures) == 0 {
+		return content, false, nil
+	}
+	var payload []byte
+	for _, signature := range signed.Signatures {
+		protectedJSON, err := joseBase64Decode(signature.Protected)
+		if err != nil {
+			return nil, false, fmt.Errorf("Invalid signature of the manifest: %s", err)
+		}
+		protected := &protectedHeader{}
+		if err := json.Unmarshal(protectedJSON, protected); err != nil {
+			return nil, false, fmt.Errorf("Invalid signature of the manifest: %s", err)
+		}
+		tail, err := joseBase64Decode(protected.FormatTail)
+		if err != nil || protected.FormatLength <= 0 || protected.FormatLength > len(content) {
+			return nil, false, fmt.Errorf("Invalid signature of the manifest: bad format")
+		}
+		signedPayload := append(append([]byte{}, content[:protected.FormatLength]...), tail...)
+		if payload != nil && !bytes.Equal(payload, signedPayload) {
+			return nil, false, fmt.Errorf("Invalid manifest: its signatures sign different contents")
+		}
+		payload = signedPayload
+	}
+	return payload, true, nil
+}
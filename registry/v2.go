@@ -0,0 +1,652 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The media type of the manifests, the schema 1 without signature. The
+	// pushes sign them, SignedManifestMediaType.
+	ManifestMediaType = "application/vnd.docker.distribution.manifest.v1+json"
+	// The media type of the manifest lists
+	ManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+var ErrV2Unsupported = errors.New("The registry doesn't support the v2 protocol")
+
+// A Manifest describes an image and its parents, from the top image down to
+// the base one: the json of each of them and the digest of its layer, the
+// blob of the registry. Its own digest refers to them byte for byte, without
+// its signatures.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Name          string            `json:"name"`
+	Tag           string            `json:"tag"`
+	Architecture  string            `json:"architecture"`
+	FSLayers      []FSLayer         `json:"fsLayers"`
+	History       []ManifestHistory `json:"history"`
+}
+
+type FSLayer struct {
+	BlobSum string `json:"blobSum"`
+}
+
+type ManifestHistory struct {
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+// A ManifestList refers to the manifests of an image for each platform, a
+// pull gets the one of its host
+type ManifestList struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Manifests     []ManifestDescriptor `json:"manifests"`
+}
+
+type ManifestDescriptor struct {
+	MediaType string   `json:"mediaType"`
+	Size      int64    `json:"size"`
+	Digest    string   `json:"digest"`
+	Platform  Platform `json:"platform"`
+}
+
+// The platform an image runs on, with the names of GOOS and GOARCH
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// NormalizeArchitecture returns the GOARCH name of the architecture arch,
+// e.g: amd64 for x86_64
+func NormalizeArchitecture(arch string) string {
+	switch arch {
+	case "x86_64", "x86-64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "i386", "i686":
+		return "386"
+	case "armhf", "armel":
+		return "arm"
+	}
+	return arch
+}
+
+// Select returns the manifest of the list for platform, the one of its
+// variant if there is one, nil if there is none
+func (list *ManifestList) Select(platform Platform) *ManifestDescriptor {
+	var match *ManifestDescriptor
+	for i := range list.Manifests {
+		descriptor := &list.Manifests[i]
+		if descriptor.Platform.OS != platform.OS || NormalizeArchitecture(descriptor.Platform.Architecture) != NormalizeArchitecture(platform.Architecture) {
+			continue
+		}
+		if descriptor.Platform.Variant == platform.Variant {
+			return descriptor
+		} else if match == nil {
+			match = descriptor
+		}
+	}
+	return match
+}
+
+// Digest returns the digest of content, sha256:<hex>
+func Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// V2Endpoint returns the endpoint of the v2 protocol of the registry at
+// the v1 endpoint, https://host/v2/
+func V2Endpoint(endpoint string) string {
+	return strings.TrimSuffix(endpoint, "v1/") + "v2/"
+}
+
+// A V2Repository is a repository of a registry speaking the v2 protocol
+type V2Repository struct {
+	sync.Mutex
+	r         *Registry
+	endpoint  string                  // https://host/v2/
+	name      string                  // The name of the repository on the registry
+	challenge map[string]string       // The authentication the registry asks for, if any
+	tokens    map[string]*bearerToken // The bearer tokens by scope
+}
+
+// A bearer token of the authorization server, used until it expires
+type bearerToken struct {
+	token   string
+	expires time.Time
+}
+
+// NewV2Repository returns the repository name of the registry at the v1
+// endpoint, or ErrV2Unsupported if it only speaks the v1 protocol
+func (r *Registry) NewV2Repository(endpoint, name string) (*V2Repository, error) {
+	repo := &V2Repository{
+		r:        r,
+		endpoint: V2Endpoint(endpoint),
+		name:     name,
+		tokens:   make(map[string]*bearerToken),
+	}
+	req, err := r.reqFactory.NewRequest("GET", repo.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := doWithCookies(r.client, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.Header.Get("Docker-Distribution-API-Version") != "registry/2.0" && res.StatusCode != 200 {
+		return nil, ErrV2Unsupported
+	}
+	switch res.StatusCode {
+	case 200:
+	case 401:
+		if repo.challenge = parseChallenge(res.Header.Get("WWW-Authenticate")); repo.challenge == nil {
+			return nil, fmt.Errorf("Invalid authentication challenge: %s", res.Header.Get("WWW-Authenticate"))
+		}
+	default:
+		return nil, utils.NewHTTPRequestError(fmt.Sprintf("Server error: %d trying to reach %s", res.StatusCode, repo.endpoint), res)
+	}
+	return repo, nil
+}
+
+// Name returns the name of the repository on its registry
+func (repo *V2Repository) Name() string {
+	return repo.name
+}
+
+// Parse the WWW-Authenticate header scheme key="value", ... into a map,
+// with the scheme in lower case as "scheme"
+func parseChallenge(header string) map[string]string {
+	header = strings.TrimSpace(header)
+	n := strings.Index(header, " ")
+	if n < 0 {
+		if header == "" {
+			return nil
+		}
+		n = len(header)
+	}
+	challenge := map[string]string{"scheme": strings.ToLower(header[:n])}
+	params := header[n:]
+	for {
+		params = strings.TrimLeft(params, " ,")
+		eq := strings.Index(params, "=")
+		if eq < 0 {
+			return challenge
+		}
+		key := strings.ToLower(strings.TrimSpace(params[:eq]))
+		params = params[eq+1:]
+		var value string
+		if strings.HasPrefix(params, "\"") {
+			end := strings.Index(params[1:], "\"")
+			if end < 0 {
+				return nil
+			}
+			value, params = params[1:end+1], params[end+2:]
+		} else if end := strings.Index(params, ","); end >= 0 {
+			value, params = params[:end], params[end:]
+		} else {
+			value, params = params, ""
+		}
+		challenge[key] = value
+	}
+}
+
+// Authenticate req to the registry, for the actions (pull or pull,push) on
+// the repository
+func (repo *V2Repository) authorize(req *http.Request, actions string) error {
+	return repo.authorizeScopes(req, "repository:"+repo.name+":"+actions)
+}
+
+// Authenticate req to the registry for the scopes, repository:NAME:ACTIONS
+func (repo *V2Repository) authorizeScopes(req *http.Request, scopes ...string) error {
+	switch repo.challenge["scheme"] {
+	case "":
+	case "basic":
+		if repo.r.authConfig != nil && repo.r.authConfig.Username != "" {
+			req.SetBasicAuth(repo.r.authConfig.Username, repo.r.authConfig.Password)
+		}
+	case "bearer":
+		token, err := repo.token(scopes...)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return fmt.Errorf("Unsupported authentication scheme: %s", repo.challenge["scheme"])
+	}
+	return nil
+}
+
+// Get a bearer token for the scopes from the authorization server of the
+// registry, with the credentials of the user if there are some
+func (repo *V2Repository) token(scopes ...string) (string, error) {
+	repo.Lock()
+	defer repo.Unlock()
+	scope := strings.Join(scopes, " ")
+	if token, exists := repo.tokens[scope]; exists && time.Now().Before(token.expires) {
+		return token.token, nil
+	}
+	realm, err := url.Parse(repo.challenge["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", fmt.Errorf("Invalid authentication realm: %s", repo.challenge["realm"])
+	}
+	query := realm.Query()
+	if service := repo.challenge["service"]; service != "" {
+		query.Set("service", service)
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+	req, err := repo.r.reqFactory.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if repo.r.authConfig != nil && repo.r.authConfig.Username != "" {
+		req.SetBasicAuth(repo.r.authConfig.Username, repo.r.authConfig.Password)
+	}
+	res, err := doWithCookies(repo.r.client, req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", utils.NewHTTPRequestError(fmt.Sprintf("Error %d while getting a token for %s", res.StatusCode, scope), res)
+	}
+	var response struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("Invalid token for %s: %s", scope, err)
+	}
+	token := response.Token
+	if token == "" {
+		token = response.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("The authorization server sent no token for %s", scope)
+	}
+	// The tokens expire after 60 seconds unless the server says otherwise
+	expiresIn := 60
+	if response.ExpiresIn > 0 {
+		expiresIn = response.ExpiresIn
+	}
+	repo.tokens[scope] = &bearerToken{token: token, expires: time.Now().Add(time.Duration(expiresIn) * time.Second)}
+	return token, nil
+}
+
+// Forget the bearer token of the scopes, the registry refused it
+func (repo *V2Repository) dropToken(scopes ...string) {
+	repo.Lock()
+	defer repo.Unlock()
+	delete(repo.tokens, strings.Join(scopes, " "))
+}
+
+// Send a request to the repository for the actions. A request the registry
+// refuses with a bearer token is sent again with a new one, if its body can
+// be read again.
+func (repo *V2Repository) do(method, url string, body io.Reader, actions string, header http.Header) (*http.Response, error) {
+	for retry := true; ; retry = false {
+		req, err := repo.r.reqFactory.NewRequest(method, url, body)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if err := repo.authorize(req, actions); err != nil {
+			return nil, err
+		}
+		res, err := doWithCookies(repo.r.client, req)
+		if err != nil || res.StatusCode != 401 || repo.challenge["scheme"] != "bearer" || !retry {
+			return res, err
+		}
+		if body != nil {
+			seeker, ok := body.(io.Seeker)
+			if !ok {
+				return res, nil
+			}
+			if _, err := seeker.Seek(0, 0); err != nil {
+				return res, nil
+			}
+		}
+		res.Body.Close()
+		repo.dropToken("repository:" + repo.name + ":" + actions)
+	}
+}
+
+// GetTags returns the tags of the repository
+func (repo *V2Repository) GetTags() ([]string, error) {
+	res, err := repo.do("GET", repo.endpoint+repo.name+"/tags/list", nil, "pull", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, utils.NewHTTPRequestError(fmt.Sprintf("Error %d while retrieving the tags of %s", res.StatusCode, repo.name), res)
+	}
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+	return tags.Tags, nil
+}
+
+// Get the manifest or the manifest list of the reference, a tag or a
+// digest, with its media type and its digest. The manifest of a digest is
+// checked against it. A signed manifest is returned without its signatures,
+// the content its digest is computed on.
+func (repo *V2Repository) getManifest(reference string) ([]byte, string, string, error) {
+	res, err := repo.do("GET", repo.endpoint+repo.name+"/manifests/"+reference, nil, "pull", http.Header{"Accept": {SignedManifestMediaType, ManifestMediaType, ManifestListMediaType}})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, "", "", fmt.Errorf("Manifest %s:%s not found", repo.name, reference)
+	} else if res.StatusCode != 200 {
+		return nil, "", "", utils.NewHTTPRequestError(fmt.Sprintf("Error %d while retrieving the manifest %s:%s", res.StatusCode, repo.name, reference), res)
+	}
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	content, signed, err := manifestPayload(content)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("%s:%s: %s", repo.name, reference, err)
+	}
+	digest := Digest(content)
+	if utils.IsDigest(reference) && digest != reference {
+		return nil, "", "", fmt.Errorf("The manifest of %s@%s has the digest %s", repo.name, reference, digest)
+	}
+	if header := res.Header.Get("Docker-Content-Digest"); utils.IsDigest(header) && header != digest {
+		return nil, "", "", fmt.Errorf("The manifest of %s:%s has the digest %s, not %s", repo.name, reference, digest, header)
+	}
+	// The schema 1 manifests have no media type
+	var mediaType struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(content, &mediaType); err != nil {
+		return nil, "", "", fmt.Errorf("Invalid manifest %s:%s: %s", repo.name, reference, err)
+	}
+	if signed {
+		mediaType.MediaType = SignedManifestMediaType
+	} else if mediaType.MediaType == "" {
+		mediaType.MediaType = ManifestMediaType
+	}
+	return content, mediaType.MediaType, digest, nil
+}
+
+// Parse the schema 1 manifest of reference
+func parseManifest(reference string, content []byte, mediaType string) (*Manifest, error) {
+	if mediaType != ManifestMediaType && mediaType != SignedManifestMediaType {
+		return nil, fmt.Errorf("Unsupported manifest media type %s for %s", mediaType, reference)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s: %s", reference, err)
+	}
+	if manifest.SchemaVersion != 1 {
+		return nil, fmt.Errorf("Unsupported manifest schema version %d", manifest.SchemaVersion)
+	}
+	if len(manifest.FSLayers) == 0 || len(manifest.FSLayers) != len(manifest.History) {
+		return nil, fmt.Errorf("Invalid manifest %s: %d layers for %d images", reference, len(manifest.FSLayers), len(manifest.History))
+	}
+	return manifest, nil
+}
+
+// GetManifest returns the manifest of the reference, a tag or a digest, and
+// its digest. A manifest list is resolved to its manifest for platform, the
+// digest is the one of the list.
+func (repo *V2Repository) GetManifest(reference string, platform Platform) (*Manifest, string, error) {
+	content, mediaType, digest, err := repo.getManifest(reference)
+	if err != nil {
+		return nil, "", err
+	}
+	if mediaType == ManifestListMediaType {
+		list := &ManifestList{}
+		if err := json.Unmarshal(content, list); err != nil {
+			return nil, "", fmt.Errorf("Invalid manifest list %s:%s: %s", repo.name, reference, err)
+		}
+		descriptor := list.Select(platform)
+		if descriptor == nil {
+			return nil, "", fmt.Errorf("No manifest for %s/%s in the manifest list %s:%s", platform.OS, platform.Architecture, repo.name, reference)
+		}
+		if content, mediaType, _, err = repo.getManifest(descriptor.Digest); err != nil {
+			return nil, "", err
+		}
+	}
+	manifest, err := parseManifest(repo.name+":"+reference, content, mediaType)
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, digest, nil
+}
+
+// GetManifestDescriptor returns the descriptor of the manifest of the
+// reference in a manifest list, with the platform of its image
+func (repo *V2Repository) GetManifestDescriptor(reference string) (*ManifestDescriptor, error) {
+	content, mediaType, digest, err := repo.getManifest(reference)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := parseManifest(repo.name+":"+reference, content, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestDescriptor{
+		MediaType: mediaType,
+		Size:      int64(len(content)),
+		Digest:    digest,
+		Platform: Platform{
+			Architecture: NormalizeArchitecture(manifest.Architecture),
+			OS:           "linux",
+		},
+	}, nil
+}
+
+// PutManifest signs and uploads the manifest of the tag, and returns its
+// digest
+func (repo *V2Repository) PutManifest(tag string, manifest []byte) (string, error) {
+	signed, err := signManifest(manifest)
+	if err != nil {
+		return "", err
+	}
+	return repo.putManifest(tag, signed, SignedManifestMediaType, Digest(manifest))
+}
+
+// PutManifestList uploads the manifest list of the tag and returns its
+// digest
+func (repo *V2Repository) PutManifestList(tag string, list *ManifestList) (string, error) {
+	content, err := json.MarshalIndent(list, "", "   ")
+	if err != nil {
+		return "", err
+	}
+	return repo.putManifest(tag, content, ManifestListMediaType, Digest(content))
+}
+
+// Upload the manifest of the tag, which has the digest: the one of its
+// content without signatures
+func (repo *V2Repository) putManifest(tag string, manifest []byte, mediaType, digest string) (string, error) {
+	res, err := repo.do("PUT", repo.endpoint+repo.name+"/manifests/"+tag, bytes.NewReader(manifest), "pull,push", http.Header{"Content-Type": {mediaType}})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 && res.StatusCode != 202 {
+		errBody, _ := ioutil.ReadAll(res.Body)
+		return "", utils.NewHTTPRequestError(fmt.Sprintf("Error %d while uploading the manifest %s:%s: %s", res.StatusCode, repo.name, tag, errBody), res)
+	}
+	if header := res.Header.Get("Docker-Content-Digest"); utils.IsDigest(header) && header != digest {
+		return "", fmt.Errorf("The registry computed the digest %s of the manifest %s:%s, not %s", header, repo.name, tag, digest)
+	}
+	return digest, nil
+}
+
+// GetBlob returns the blob digest, resumed like the layers of the v1
+// protocol. Reading it fails at the end if its content doesn't match the
+// digest.
+func (repo *V2Repository) GetBlob(digest string) (io.ReadCloser, error) {
+	if !utils.IsDigest(digest) {
+		return nil, fmt.Errorf("Invalid digest: %s", digest)
+	}
+	blob, err := repo.r.getResumable(digest, repo.endpoint+repo.name+"/blobs/"+digest, func(req *http.Request) error {
+		return repo.authorize(req, "pull")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedBlob{ReadCloser: blob, digest: digest, hash: sha256.New()}, nil
+}
+
+type verifiedBlob struct {
+	io.ReadCloser
+	digest string
+	hash   hash.Hash
+}
+
+func (blob *verifiedBlob) Read(data []byte) (int, error) {
+	n, err := blob.ReadCloser.Read(data)
+	blob.hash.Write(data[:n])
+	if err == io.EOF {
+		if digest := "sha256:" + hex.EncodeToString(blob.hash.Sum(nil)); digest != blob.digest {
+			return n, fmt.Errorf("The blob %s has the digest %s", blob.digest, digest)
+		}
+	}
+	return n, err
+}
+
+// BlobExists returns whether the repository has the blob digest
+func (repo *V2Repository) BlobExists(digest string) (bool, error) {
+	res, err := repo.do("HEAD", repo.endpoint+repo.name+"/blobs/"+digest, nil, "pull", nil)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, utils.NewHTTPRequestError(fmt.Sprintf("Error %d while checking the blob %s", res.StatusCode, digest), res)
+}
+
+// BlobExistsIn returns whether the repository from of the same registry has
+// the blob digest, which it can be mounted from
+func (repo *V2Repository) BlobExistsIn(from, digest string) (bool, error) {
+	req, err := repo.r.reqFactory.NewRequest("HEAD", repo.endpoint+from+"/blobs/"+digest, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := repo.authorizeScopes(req, "repository:"+from+":pull"); err != nil {
+		return false, err
+	}
+	res, err := doWithCookies(repo.r.client, req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 401, 403, 404:
+		// The user may not pull from the repository
+		return false, nil
+	}
+	return false, utils.NewHTTPRequestError(fmt.Sprintf("Error %d while checking the blob %s of %s", res.StatusCode, digest, from), res)
+}
+
+// MountBlob adds the blob digest of the repository from of the same
+// registry to the repository, without uploading it. It returns false if the
+// registry doesn't mount blobs.
+func (repo *V2Repository) MountBlob(digest, from string) (bool, error) {
+	query := url.Values{}
+	query.Set("mount", digest)
+	query.Set("from", from)
+	req, err := repo.r.reqFactory.NewRequest("POST", repo.endpoint+repo.name+"/blobs/uploads/?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	if err := repo.authorizeScopes(req, "repository:"+repo.name+":pull,push", "repository:"+from+":pull"); err != nil {
+		return false, err
+	}
+	res, err := doWithCookies(repo.r.client, req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 201:
+		return true, nil
+	case 202:
+		// The registry started an upload instead, which is canceled
+		if location, err := res.Request.URL.Parse(res.Header.Get("Location")); err == nil && res.Header.Get("Location") != "" {
+			if res, err := repo.do("DELETE", location.String(), nil, "pull,push", nil); err == nil {
+				res.Body.Close()
+			}
+		}
+		return false, nil
+	}
+	return false, utils.NewHTTPRequestError(fmt.Sprintf("Error %d while mounting the blob %s from %s", res.StatusCode, digest, from), res)
+}
+
+// PushBlob uploads the blob digest of size bytes, in one request
+func (repo *V2Repository) PushBlob(digest string, blob io.Reader, size int64) error {
+	res, err := repo.do("POST", repo.endpoint+repo.name+"/blobs/uploads/", nil, "pull,push", nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 202 {
+		return utils.NewHTTPRequestError(fmt.Sprintf("Error %d while starting the upload of the blob %s", res.StatusCode, digest), res)
+	}
+	location, err := res.Request.URL.Parse(res.Header.Get("Location"))
+	if err != nil || res.Header.Get("Location") == "" {
+		return fmt.Errorf("Invalid upload location: %s", res.Header.Get("Location"))
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	req, err := repo.r.reqFactory.NewRequest("PUT", location.String(), blob)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if err := repo.authorize(req, "pull,push"); err != nil {
+		return err
+	}
+	res, err = doWithCookies(repo.r.client, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		errBody, _ := ioutil.ReadAll(res.Body)
+		return utils.NewHTTPRequestError(fmt.Sprintf("Error %d while uploading the blob %s: %s", res.StatusCode, digest, errBody), res)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The delay before restarting a container doubles from restartDelayMin up to
+// restartDelayMax while it keeps on exiting within restartDelayReset of its
+// start.
+const (
+	restartDelayMin   = 100 * time.Millisecond
+	restartDelayMax   = time.Minute
+	restartDelayReset = 10 * time.Second
+)
+
+// RestartPolicy says when the daemon restarts a container whose process
+// exited: never ("no", the default), when it exits with a non zero status
+// ("on-failure", at most MaximumRetryCount times in a row if not 0) or
+// whatever its status ("always", on the start of the daemon too).
+type RestartPolicy struct {
+	Name              string
+	MaximumRetryCount int
+}
+
+// Parse no, always or on-failure[:max]
+func parseRestartPolicy(spec string) (RestartPolicy, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	policy := RestartPolicy{Name: parts[0]}
+	if len(parts) == 2 {
+		if policy.Name != "on-failure" {
+			return policy, fmt.Errorf("Invalid restart policy: %s, only on-failure takes a maximum retry count", spec)
+		}
+		max, err := strconv.Atoi(parts[1])
+		if err != nil || max <= 0 {
+			return policy, fmt.Errorf("Invalid restart policy: %s, the maximum retry count must be a positive integer", spec)
+		}
+		policy.MaximumRetryCount = max
+	}
+	return policy, validateRestartPolicy(policy)
+}
+
+func validateRestartPolicy(policy RestartPolicy) error {
+	switch policy.Name {
+	case "", "no", "always":
+		if policy.MaximumRetryCount != 0 {
+			return fmt.Errorf("Bad parameter: only the on-failure restart policy takes a maximum retry count")
+		}
+	case "on-failure":
+		if policy.MaximumRetryCount < 0 {
+			return fmt.Errorf("Bad parameter: invalid maximum retry count %d", policy.MaximumRetryCount)
+		}
+	default:
+		return fmt.Errorf("Bad parameter: invalid restart policy %s (no, on-failure[:max] or always)", policy.Name)
+	}
+	return nil
+}
+
+// Whether a container restarted restartCount times in a row should be
+// restarted again after exiting with exitCode
+func (policy RestartPolicy) shouldRestart(exitCode, restartCount int) bool {
+	switch policy.Name {
+	case "always":
+		return true
+	case "on-failure":
+		return exitCode != 0 && (policy.MaximumRetryCount == 0 || restartCount < policy.MaximumRetryCount)
+	}
+	return false
+}
+
+// The delay before the next restart of a container which ran for ran, when
+// the previous restart was delayed by previous
+func nextRestartDelay(previous, ran time.Duration) time.Duration {
+	if previous == 0 || ran > restartDelayReset {
+		return restartDelayMin
+	}
+	if previous*2 > restartDelayMax {
+		return restartDelayMax
+	}
+	return previous * 2
+}
+
+// Whether the container was destroyed
+func (container *Container) isRemoved() bool {
+	select {
+	case <-container.removed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Restart the container after its process exited, as its restart policy
+// says, unless it was stopped with docker stop or docker kill, or destroyed,
+// meanwhile.
+func (container *Container) supervise(exitCode int) {
+	container.State.Lock()
+	defer container.State.Unlock()
+	if container.stopRequested || !container.restartPolicy.shouldRestart(exitCode, container.RestartCount) {
+		return
+	}
+	delay := nextRestartDelay(container.restartDelay, time.Now().Sub(container.State.StartedAt))
+	container.restartDelay = delay
+	utils.Debugf("Restarting %s in %s (exit code %d)", container.ID, delay, exitCode)
+
+	container.State.Unlock()
+	time.Sleep(delay)
+	container.State.Lock()
+	// It may have been stopped, started again or destroyed meanwhile
+	if container.stopRequested || container.State.Running || container.isRemoved() {
+		return
+	}
+	container.RestartCount++
+	if err := container.startLocked(&HostConfig{}); err != nil {
+		log.Printf("WARNING: Unable to restart %s: %s", container.ID, err)
+		return
+	}
+	if container.runtime != nil && container.runtime.srv != nil {
+		container.runtime.srv.LogEvent("restart", container.ShortID(), container.runtime.repositories.ImageName(container.Image))
+	}
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"bytes"
 	"container/list"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
@@ -8,32 +9,71 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"sort"
-	"strings"
+	"sync"
+	"time"
 )
 
 type Capabilities struct {
-	MemoryLimit    bool
-	SwapLimit      bool
-	IPv4Forwarding bool
+	MemoryLimit      bool
+	SwapLimit        bool
+	KernelMemory     bool
+	MemorySwappiness bool
+	CpuCfsQuota      bool
+	IPv4Forwarding   bool
+	Seccomp          bool
+	AppArmor         bool
+	SELinux          bool
 }
 
 type Runtime struct {
-	root           string
-	repository     string
-	containers     *list.List
-	networkManager *NetworkManager
-	graph          *Graph
-	repositories   *TagStore
-	idIndex        *utils.TruncIndex
-	capabilities   *Capabilities
-	kernelVersion  *utils.KernelVersionInfo
-	autoRestart    bool
-	volumes        *Graph
-	srv            *Server
-	Dns            []string
+	root          string
+	repository    string
+	containers    *list.List
+	networkDriver NetworkDriver
+	networks      *NetworkStore
+	dnsServers    map[string]*DNSServer
+	dnsLock       sync.Mutex
+	graph         *Graph
+	repositories  *TagStore
+	manifestLists *ManifestListStore
+	idIndex       *utils.TruncIndex
+	capabilities  *Capabilities
+	kernelVersion *utils.KernelVersionInfo
+	autoRestart   bool
+	volumes       *Graph
+	namedVolumes  *VolumeStore
+	srv           *Server
+	Dns           []string
+
+	// The drivers of the networks not using the default one, by name
+	networkDrivers     map[string]NetworkDriver
+	networkDriversLock sync.Mutex
+
+	// The drivers of the named volumes, by name
+	volumeDrivers     map[string]VolumeDriver
+	volumeDriversLock sync.Mutex
+
+	// The device plugins the containers requested devices of, by name
+	devicePlugins     map[string]DevicePlugin
+	devicePluginsLock sync.Mutex
+
+	// The processes run by docker exec, by id, until their container is
+	// destroyed or they expire
+	execs     map[string]*Exec
+	execsLock sync.Mutex
+
+	// Held while the names of the containers on their networks change
+	namesLock sync.Mutex
+
+	// Held while a destroy claims a container, only one removes it
+	removingLock sync.Mutex
+
+	// The user namespace of the containers, nil without -userns-remap
+	idMappings *IDMappings
+	// The -default-ulimit of the daemon
+	ulimits []*Ulimit
 }
 
 var sysInitPath string
@@ -105,9 +145,23 @@ func (runtime *Runtime) Register(container *Container) error {
 	if err := validateID(container.ID); err != nil {
 		return err
 	}
+	// The layers of the container are kept until it's destroyed, the ones
+	// of the containers created before the layer store are added to it
+	layers := runtime.graph.layers
+	initID := container.ID + "-init"
+	if err := layers.adopt(initID, container.Image); err != nil {
+		return err
+	}
+	if err := layers.adopt(container.ID, initID); err != nil {
+		return err
+	}
+	if err := layers.Retain(container.ID); err != nil {
+		log.Printf("WARNING: The filesystem of %s is missing: %s", container.ID, err)
+	}
 
 	// init the wait lock
 	container.waitLock = make(chan struct{})
+	container.removed = make(chan struct{})
 
 	container.runtime = runtime
 
@@ -128,17 +182,22 @@ func (runtime *Runtime) Register(container *Container) error {
 	// However, when we simply 'reattach', we have to restart a monitor
 	nomonitor := false
 
+	// The monitor of a running container restarts it as its policy says
+	if hostConfig, err := container.ReadHostConfig(); err == nil {
+		container.restartPolicy = hostConfig.RestartPolicy
+	}
+
 	// FIXME: if the container is supposed to be running but is not, auto restart it?
 	//        if so, then we need to restart monitor and init a new lock
 	// If the container is supposed to be running, make sure of it
 	if container.State.Running {
-		output, err := exec.Command("lxc-info", "-n", container.ID).CombinedOutput()
+		running, err := lxcRunning(container.ID)
 		if err != nil {
 			return err
 		}
-		if !strings.Contains(string(output), "RUNNING") {
+		if !running {
 			utils.Debugf("Container %s was supposed to be running be is not.", container.ID)
-			if runtime.autoRestart {
+			if runtime.autoRestart || container.restartPolicy.Name == "always" {
 				utils.Debugf("Restarting")
 				container.State.Ghost = false
 				container.State.setStopped(0)
@@ -162,57 +221,241 @@ func (runtime *Runtime) Register(container *Container) error {
 	if !container.State.Running {
 		close(container.waitLock)
 	} else if !nomonitor {
-		container.allocateNetwork()
+		// Its filesystem is still mounted, the driver returns where
+		if err := container.Mount(); err != nil {
+			log.Printf("WARNING: Unable to mount the filesystem of %s: %s", container.ID, err)
+		}
+		// Publish the ports of the container where they were before
+		saved := container.NetworkSettings
+		container.NetworkSettings = &NetworkSettings{}
+		if err := container.allocateNetwork(saved); err != nil {
+			log.Printf("WARNING: Unable to restore the network of %s: %s", container.ID, err)
+		} else if err := container.ToDisk(); err != nil {
+			return err
+		}
+		container.startHealthMonitor()
 		go container.monitor()
 	}
 	return nil
 }
 
-func (runtime *Runtime) LogToDisk(src *utils.WriteBroadcaster, dst, stream string) error {
-	log, err := os.OpenFile(dst, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
-	if err != nil {
-		return err
-	}
-	src.AddWriter(log, stream)
-	return nil
-}
-
 func (runtime *Runtime) Destroy(container *Container) error {
 	if container == nil {
 		return fmt.Errorf("The given container is <nil>")
 	}
 
+	// A concurrent destroy (e.g. the one of -rm) removes it only once
+	runtime.removingLock.Lock()
 	element := runtime.getContainerElement(container.ID)
-	if element == nil {
+	if element == nil || container.removing {
+		runtime.removingLock.Unlock()
 		return fmt.Errorf("Container %v not found - maybe it was already destroyed?", container.ID)
 	}
+	container.removing = true
+	runtime.removingLock.Unlock()
 
+	// Its restart policy doesn't restart it anymore, even if it exits
+	// before it's stopped
+	container.State.Lock()
+	container.stopRequested = true
+	container.State.Unlock()
 	if err := container.Stop(3); err != nil {
+		runtime.cancelRemoving(container)
 		return err
 	}
-	if mounted, err := container.Mounted(); err != nil {
-		return err
-	} else if mounted {
-		if err := container.Unmount(); err != nil {
-			return fmt.Errorf("Unable to unmount container %v: %v", container.ID, err)
-		}
+	if err := container.Unmount(); err != nil {
+		runtime.cancelRemoving(container)
+		return fmt.Errorf("Unable to unmount container %v: %v", container.ID, err)
 	}
 	// Deregister the container before removing its directory, to avoid race conditions
 	runtime.idIndex.Delete(container.ID)
 	runtime.containers.Remove(element)
+	runtime.execsLock.Lock()
+	for id, e := range runtime.execs {
+		if e.Container == container {
+			delete(runtime.execs, id)
+		}
+	}
+	runtime.execsLock.Unlock()
+	close(container.removed)
+	// Its layers are removed with the ones of the deleted images only it
+	// used
+	runtime.graph.layers.Release(container.ID)
 	if err := os.RemoveAll(container.root); err != nil {
 		return fmt.Errorf("Unable to remove filesystem for %v: %v", container.ID, err)
 	}
 	return nil
 }
 
+// Let the container be destroyed again, after a destroy failed
+func (runtime *Runtime) cancelRemoving(container *Container) {
+	runtime.removingLock.Lock()
+	container.removing = false
+	runtime.removingLock.Unlock()
+}
+
+// Create the layers of the filesystem of a new container: its rw layer on
+// top of the init layer, which has the mountpoints of the files docker
+// bind-mounts into the container on top of its image. It protects the
+// container from unwanted side-effects on the rw layer. The size storage
+// option of its host config limits the size of the rw layer.
+func (runtime *Runtime) createRootfs(container *Container, storageOpt map[string]string) error {
+	driver, layers := runtime.graph.driver, runtime.graph.layers
+	size, err := containerLayerSize(storageOpt)
+	if err != nil {
+		return err
+	}
+	if _, ok := driver.(SizedGraphDriver); size != 0 && !ok {
+		return fmt.Errorf("Bad parameter: the %s storage driver can't limit the size of the containers", driver)
+	}
+	// The layers are retained by the caller, until the container is
+	// registered, through the rw layer for the init one
+	initID := container.ID + "-init"
+	if err := layers.Create(initID, container.Image); err != nil {
+		return err
+	}
+	defer layers.Release(initID)
+	initPath, err := driver.Get(initID)
+	if err != nil {
+		return err
+	}
+	if err := setupInitLayer(initPath, runtime.idMappings); err != nil {
+		driver.Put(initID)
+		return err
+	}
+	if err := driver.Put(initID); err != nil {
+		return err
+	}
+	if size != 0 {
+		return layers.CreateSized(container.ID, initID, size)
+	}
+	return layers.Create(container.ID, initID)
+}
+
+// Create the mountpoints of the init layer of a container in the filesystem
+// root, owned by the root of the containers with -userns-remap
+func setupInitLayer(root string, idMappings *IDMappings) error {
+	for pth, typ := range map[string]string{
+		"/dev/pts":         "dir",
+		"/dev/shm":         "dir",
+		"/proc":            "dir",
+		"/sys":             "dir",
+		"/.dockerinit":     "file",
+		"/.dockerseccomp":  "file",
+		"/etc/resolv.conf": "file",
+		// "var/run": "dir",
+		// "var/lock": "dir",
+	} {
+		if _, err := os.Stat(path.Join(root, pth)); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		switch typ {
+		case "dir":
+			if err := os.MkdirAll(path.Join(root, pth), 0755); err != nil {
+				return err
+			}
+		case "file":
+			if err := os.MkdirAll(path.Join(root, path.Dir(pth)), 0755); err != nil {
+				return err
+			}
+			if f, err := os.OpenFile(path.Join(root, pth), os.O_CREATE, 0755); err != nil {
+				return err
+			} else {
+				f.Close()
+			}
+		}
+		if idMappings != nil {
+			uid, gid := idMappings.RootPair()
+			for dir := pth; dir != "/"; dir = path.Dir(dir) {
+				if err := os.Lchown(path.Join(root, dir), uid, gid); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Destroy a container started with -rm once its process exited, along with
+// the volumes docker created for it which no other container uses.
+func (runtime *Runtime) autoRemove(container *Container) {
+	if err := runtime.Destroy(container); err != nil {
+		log.Printf("WARNING: Unable to remove %s on exit: %s", container.ID, err)
+		return
+	}
+	if runtime.srv != nil {
+		runtime.srv.LogEvent("destroy", container.ShortID(), runtime.repositories.ImageName(container.Image))
+	}
+	used := make(map[string]bool)
+	for _, c := range runtime.List() {
+		for _, srcPath := range c.Volumes {
+			used[srcPath] = true
+		}
+	}
+	for _, srcPath := range container.Volumes {
+		if id := runtime.volumeID(srcPath); id != "" && !used[srcPath] {
+			if err := runtime.volumes.Delete(id); err != nil {
+				log.Printf("WARNING: Unable to remove the volume %s of %s: %s", id, container.ID, err)
+			}
+		}
+	}
+}
+
+// The ID of the volume docker created at srcPath, empty if it isn't one
+// (e.g: a bind mount)
+func (runtime *Runtime) volumeID(srcPath string) string {
+	if path.Base(srcPath) != "layer" || path.Dir(path.Dir(srcPath)) != path.Clean(runtime.volumes.Root) {
+		return ""
+	}
+	return path.Base(path.Dir(srcPath))
+}
+
+// Create a process to run in the running container with docker exec
+func (runtime *Runtime) CreateExec(container *Container, config *ExecConfig) (*Exec, error) {
+	e, err := newExec(container, config)
+	if err != nil {
+		return nil, err
+	}
+	runtime.execsLock.Lock()
+	defer runtime.execsLock.Unlock()
+	// The ones which expired are dropped meanwhile
+	now := time.Now()
+	for id, other := range runtime.execs {
+		other.Lock()
+		expired := other.expired(now)
+		other.Unlock()
+		if expired {
+			delete(runtime.execs, id)
+		}
+	}
+	runtime.execs[e.ID] = e
+	return e, nil
+}
+
+func (runtime *Runtime) GetExec(id string) *Exec {
+	runtime.execsLock.Lock()
+	defer runtime.execsLock.Unlock()
+	return runtime.execs[id]
+}
+
 func (runtime *Runtime) restore() error {
 	dir, err := ioutil.ReadDir(runtime.repository)
 	if err != nil {
 		return err
 	}
+	// Reattach the running containers first: the ports they publish must
+	// be allocated again before the other containers are restarted
+	var running, others []string
 	for _, v := range dir {
-		id := v.Name()
+		if ok, _ := lxcRunning(v.Name()); ok {
+			running = append(running, v.Name())
+		} else {
+			others = append(others, v.Name())
+		}
+	}
+	for _, id := range append(running, others...) {
 		container, err := runtime.Load(id)
 		if err != nil {
 			utils.Debugf("Failed to load container %v: %v", id, err)
@@ -241,6 +484,26 @@ func (runtime *Runtime) UpdateCapabilities(quiet bool) {
 		if !runtime.capabilities.SwapLimit && !quiet {
 			log.Printf("WARNING: Your kernel does not support cgroup swap limit.")
 		}
+
+		_, err = ioutil.ReadFile(path.Join(cgroupMemoryMountpoint, "memory.kmem.limit_in_bytes"))
+		runtime.capabilities.KernelMemory = err == nil
+		if !runtime.capabilities.KernelMemory && !quiet {
+			log.Printf("WARNING: Your kernel does not support cgroup kernel memory limit.")
+		}
+
+		_, err = ioutil.ReadFile(path.Join(cgroupMemoryMountpoint, "memory.swappiness"))
+		runtime.capabilities.MemorySwappiness = err == nil
+		if !runtime.capabilities.MemorySwappiness && !quiet {
+			log.Printf("WARNING: Your kernel does not support cgroup memory swappiness.")
+		}
+	}
+
+	if cgroupCpuMountpoint, err := utils.FindCgroupMountpoint("cpu"); err == nil {
+		_, err = ioutil.ReadFile(path.Join(cgroupCpuMountpoint, "cpu.cfs_quota_us"))
+		runtime.capabilities.CpuCfsQuota = err == nil
+		if !runtime.capabilities.CpuCfsQuota && !quiet {
+			log.Printf("WARNING: Your kernel does not support cgroup CPU CFS quota.")
+		}
 	}
 
 	content, err3 := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
@@ -248,6 +511,19 @@ func (runtime *Runtime) UpdateCapabilities(quiet bool) {
 	if !runtime.capabilities.IPv4Forwarding && !quiet {
 		log.Printf("WARNING: IPv4 forwarding is disabled.")
 	}
+
+	status, err4 := ioutil.ReadFile("/proc/self/status")
+	// The filters are only compiled for the syscalls of x86_64
+	runtime.capabilities.Seccomp = seccompSupported && err4 == nil && bytes.Contains(status, []byte("\nSeccomp:"))
+	if !runtime.capabilities.Seccomp && !quiet {
+		log.Printf("WARNING: Your kernel does not support seccomp.")
+	}
+
+	// Optional, the containers have the labels of the MAC the host enables
+	enabled, err5 := ioutil.ReadFile("/sys/module/apparmor/parameters/enabled")
+	runtime.capabilities.AppArmor = err5 == nil && bytes.HasPrefix(enabled, []byte("Y"))
+	_, err6 := os.Stat("/sys/fs/selinux/enforce")
+	runtime.capabilities.SELinux = err6 == nil
 }
 
 // FIXME: harmonize with NewGraph()
@@ -267,21 +543,65 @@ func NewRuntime(flGraphPath string, autoRestart bool, dns []string) (*Runtime, e
 		}
 	}
 	runtime.UpdateCapabilities(false)
+	if IptablesCheckInterval > 0 && firewall != nil {
+		go watchFirewall(firewall, IptablesCheckInterval)
+	}
 	return runtime, nil
 }
 
 func NewRuntimeFromDirectory(root string, autoRestart bool) (*Runtime, error) {
+	// With -userns-remap, the images and the containers are apart from the
+	// ones of the daemon without it: the files of their layers have the
+	// ids of the host of the containers
+	var idMappings *IDMappings
+	if UsernsRemap != "" {
+		m, err := parseUsernsRemap(UsernsRemap)
+		if err != nil {
+			return nil, err
+		}
+		idMappings = m
+		// The root of the containers goes through it to their files
+		if err := os.MkdirAll(root, 0711); err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(root, 0711); err != nil {
+			return nil, err
+		}
+		uid, gid := m.RootPair()
+		root = path.Join(root, fmt.Sprintf("%d.%d", uid, gid))
+	}
+	var ulimits []*Ulimit
+	for _, spec := range DefaultUlimits {
+		ulimit, err := parseUlimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		ulimits = append(ulimits, ulimit)
+	}
 	runtimeRepo := path.Join(root, "containers")
 
 	if err := os.MkdirAll(runtimeRepo, 0700); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
 
-	g, err := NewGraph(path.Join(root, "graph"))
+	driver, err := newGraphDriver(GraphDriverName, root)
+	if err != nil {
+		return nil, err
+	}
+	if aufs, ok := driver.(*aufsDriver); ok {
+		if err := aufs.migrate(root, func(initPath string) error {
+			return setupInitLayer(initPath, idMappings)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	g, err := NewGraph(path.Join(root, "graph"), driver)
 	if err != nil {
 		return nil, err
 	}
-	volumes, err := NewGraph(path.Join(root, "volumes"))
+	// The anonymous volumes are plain directories, in
+	// <root>/volumes/<id>/layer
+	volumes, err := NewGraph(path.Join(root, "volumes"), &vfsDriver{home: path.Join(root, "volumes")})
 	if err != nil {
 		return nil, err
 	}
@@ -289,29 +609,66 @@ func NewRuntimeFromDirectory(root string, autoRestart bool) (*Runtime, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't create Tag store: %s", err)
 	}
+	manifestLists, err := NewManifestListStore(path.Join(root, "manifest-lists"))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create Manifest list store: %s", err)
+	}
 	if NetworkBridgeIface == "" {
 		NetworkBridgeIface = DefaultNetworkBridge
 	}
-	netManager, err := newNetworkManager(NetworkBridgeIface)
+	networkDriver, err := newNetworkDriver(NetworkDriverName)
 	if err != nil {
 		return nil, err
 	}
-	runtime := &Runtime{
-		root:           root,
-		repository:     runtimeRepo,
-		containers:     list.New(),
-		networkManager: netManager,
-		graph:          g,
-		repositories:   repositories,
-		idIndex:        utils.NewTruncIndex(),
-		capabilities:   &Capabilities{},
-		autoRestart:    autoRestart,
-		volumes:        volumes,
+	if err := networkDriver.CreateNetwork(DefaultNetworkName, map[string]string{"bridge": NetworkBridgeIface}); err != nil {
+		return nil, err
 	}
-
+	networks, err := NewNetworkStore(path.Join(root, "networks"))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create Network store: %s", err)
+	}
+	namedVolumes, err := NewVolumeStore(path.Join(root, "named-volumes"))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create Volume store: %s", err)
+	}
+	if idMappings != nil {
+		uid, gid := idMappings.RootPair()
+		for _, dir := range []string{root, runtimeRepo, g.Root, volumes.Root, path.Join(root, "named-volumes")} {
+			if err := os.Chown(dir, uid, gid); err != nil {
+				return nil, err
+			}
+		}
+		g.idMappings = idMappings
+		volumes.idMappings = idMappings
+	}
+	runtime := &Runtime{
+		root:          root,
+		repository:    runtimeRepo,
+		containers:    list.New(),
+		networkDriver: networkDriver,
+		networks:      networks,
+		dnsServers:    make(map[string]*DNSServer),
+		execs:         make(map[string]*Exec),
+		graph:         g,
+		repositories:  repositories,
+		manifestLists: manifestLists,
+		idIndex:       utils.NewTruncIndex(),
+		capabilities:  &Capabilities{},
+		autoRestart:   autoRestart,
+		volumes:       volumes,
+		namedVolumes:  namedVolumes,
+		idMappings:    idMappings,
+		ulimits:       ulimits,
+	}
+
+	runtime.restoreNetworks()
 	if err := runtime.restore(); err != nil {
 		return nil, err
 	}
+	// The layers nothing keeps since a daemon was interrupted are removed
+	if _, err := runtime.graph.layers.GC(); err != nil {
+		log.Printf("WARNING: Unable to remove the unused layers: %s", err)
+	}
 	return runtime, nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/dotcloud/docker/utils"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -101,13 +102,13 @@ func init() {
 	// If the unit test is not found, try to download it.
 	if img, err := globalRuntime.repositories.LookupImage(unitTestImageName); err != nil || img.ID != unitTestImageID {
 		// Retrieve the Image
-		if err := srv.ImagePull(unitTestImageName, "", os.Stdout, utils.NewStreamFormatter(false), nil, true); err != nil {
+		if err := srv.ImagePull(unitTestImageName, "", os.Stdout, utils.NewStreamFormatter(false), nil, true, false); err != nil {
 			panic(err)
 		}
 	}
 	// Spawn a Daemon
 	go func() {
-		if err := ListenAndServe(testDaemonProto, testDaemonAddr, srv, os.Getenv("DEBUG") != ""); err != nil {
+		if err := ListenAndServe(testDaemonProto, testDaemonAddr, srv, os.Getenv("DEBUG") != "", nil); err != nil {
 			panic(err)
 		}
 	}()
@@ -247,6 +248,21 @@ func TestDestroy(t *testing.T) {
 		// It should have failed
 		t.Errorf("Double destroy did not fail")
 	}
+
+	// Concurrent destroys remove it once
+	container, err = NewBuilder(runtime).Create(&Config{Image: GetTestImage(runtime).ID, Cmd: []string{"ls", "-al"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- runtime.Destroy(container)
+		}()
+	}
+	if err1, err2 := <-errs, <-errs; (err1 == nil) == (err2 == nil) {
+		t.Errorf("Expected one destroy to fail, got %v and %v", err1, err2)
+	}
 }
 
 func TestGet(t *testing.T) {
@@ -483,3 +499,163 @@ func TestRestore(t *testing.T) {
 	}
 	container2.State.Running = false
 }
+
+// A volume driver keeping its volumes in a temporary directory, which
+// remembers what it was asked
+type testVolumeDriver struct {
+	sync.Mutex
+	root    string
+	options map[string]map[string]string
+	mounts  map[string]int
+	removed []string
+}
+
+var theTestVolumeDriver = &testVolumeDriver{options: make(map[string]map[string]string), mounts: make(map[string]int)}
+
+func init() {
+	RegisterVolumeDriver("test", func(root string) (VolumeDriver, error) {
+		theTestVolumeDriver.root = root
+		return theTestVolumeDriver, nil
+	})
+}
+
+func (driver *testVolumeDriver) Create(name string, options map[string]string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	driver.options[name] = options
+	return os.MkdirAll(driver.root+"/"+name+"/data", 0755)
+}
+
+func (driver *testVolumeDriver) Mount(name, id string) (string, error) {
+	driver.Lock()
+	defer driver.Unlock()
+	driver.mounts[name]++
+	return driver.root + "/" + name + "/data", nil
+}
+
+func (driver *testVolumeDriver) Unmount(name, id string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	driver.mounts[name]--
+	return nil
+}
+
+func (driver *testVolumeDriver) Remove(name string) error {
+	driver.Lock()
+	defer driver.Unlock()
+	driver.removed = append(driver.removed, name)
+	return nil
+}
+
+func (driver *testVolumeDriver) Path(name string) (string, error) {
+	return "", nil
+}
+
+func TestVolumeDriver(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	if _, err := runtime.CreateVolume("remote", "test", map[string]string{"server": "nfs.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if options := theTestVolumeDriver.options["remote"]; options["server"] != "nfs.example.com" {
+		t.Fatalf("Expected the options of the volume to be passed to its driver, got %v", options)
+	}
+	if _, err := runtime.CreateVolume("local", "foo", nil); err == nil {
+		t.Fatal("Expected an error for an unknown volume driver")
+	}
+	if _, err := runtime.CreateVolume("local", "", map[string]string{"server": "nfs.example.com"}); err == nil {
+		t.Fatal("Expected an error for an option of the local driver")
+	}
+
+	container, err := NewBuilder(runtime).Create(&Config{
+		Image:   GetTestImage(runtime).ID,
+		Cmd:     []string{"true"},
+		Volumes: map[string]struct{}{"/data": {}, "/cache": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	// /scratch isn't a volume of the container
+	hostConfig := &HostConfig{Binds: []string{"remote:/data", "cache:/cache", "scratch:/scratch"}, VolumeDriver: "test"}
+	if err := container.Start(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	container.Wait()
+	if container.Volumes["/data"] != theTestVolumeDriver.root+"/remote/data" || container.NamedVolumes["/data"] != "remote" {
+		t.Fatalf("Expected the path the driver mounted on /data, got %s", container.Volumes["/data"])
+	}
+	// The volume driver of the container creates the missing volumes
+	if info, err := runtime.VolumeInfo("cache", false); err != nil || info.Driver != "test" {
+		t.Fatalf("Expected the volume cache to be created with the test driver, got %v (%v)", info, err)
+	}
+	theTestVolumeDriver.Lock()
+	mounts := theTestVolumeDriver.mounts["remote"]
+	scratchMounts := theTestVolumeDriver.mounts["scratch"]
+	theTestVolumeDriver.Unlock()
+	if mounts != 0 || scratchMounts != 0 {
+		t.Fatalf("Expected the volumes to be unmounted when the container stopped, %d and %d mounts left", mounts, scratchMounts)
+	}
+	if len(container.MountedVolumes) != 0 {
+		t.Fatalf("Expected no volume mounted for a stopped container, got %v", container.MountedVolumes)
+	}
+
+	// The volumes mounted before a start fails are unmounted
+	if err := container.Start(&HostConfig{Binds: []string{"remote:/data", "/tmp:/"}, VolumeDriver: "test"}); err == nil {
+		t.Fatal("Expected an error for the bind on /")
+	}
+	theTestVolumeDriver.Lock()
+	mounts = theTestVolumeDriver.mounts["remote"]
+	theTestVolumeDriver.Unlock()
+	if mounts != 0 {
+		t.Fatalf("Expected the volume to be unmounted when the container failed to start, %d mounts left", mounts)
+	}
+
+	if err := runtime.DeleteVolume("remote"); err == nil {
+		t.Fatal("Deleting a volume still in use should fail")
+	}
+	if err := runtime.Destroy(container); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.DeleteVolume("remote"); err != nil {
+		t.Fatal(err)
+	}
+	if len(theTestVolumeDriver.removed) != 1 || theTestVolumeDriver.removed[0] != "remote" {
+		t.Fatalf("Expected the driver to remove the volume, got %v", theTestVolumeDriver.removed)
+	}
+}
+
+func TestIDMappings(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "docker-subuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString("alice:100000:65536\ndockremap:200000:1000\ndockremap:300000:64536\n"); err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+	maps, err := readSubIDs(tmp.Name(), "dockremap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(maps) != 2 || maps[0] != (IDMap{0, 200000, 1000}) || maps[1] != (IDMap{1000, 300000, 64536}) {
+		t.Fatalf("Unexpected id mappings %v", maps)
+	}
+	if id, err := hostID(maps, 1500); err != nil || id != 300500 {
+		t.Fatalf("Expected the host id 300500, got %d (%v)", id, err)
+	}
+	if _, err := hostID(maps, 65536); err == nil {
+		t.Fatal("Expected an error for an id out of the mappings")
+	}
+	if id := containerID(maps, 300500); id != 1500 {
+		t.Fatalf("Expected the container id 1500, got %d", id)
+	}
+	if id := containerID(maps, 0); id != 0 {
+		t.Fatalf("Expected the id 0 of the host to be left as is, got %d", id)
+	}
+	if _, err := readSubIDs(tmp.Name(), "bob"); err == nil {
+		t.Fatal("Expected an error for a user without subordinate ids")
+	}
+}
@@ -0,0 +1,105 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A seccomp profile, in the JSON of the profiles of docker:
+// {"defaultAction":"SCMP_ACT_ERRNO","syscalls":[{"names":["read","write"],"action":"SCMP_ACT_ALLOW"}]}
+// The first rule of a syscall wins, the others get the default action.
+type SeccompProfile struct {
+	DefaultAction string            `json:"defaultAction"`
+	Syscalls      []*SeccompSyscall `json:"syscalls"`
+}
+
+type SeccompSyscall struct {
+	Name   string        `json:"name,omitempty"`
+	Names  []string      `json:"names,omitempty"`
+	Action string        `json:"action"`
+	Args   []interface{} `json:"args,omitempty"` // Unsupported, the rules match any arguments
+}
+
+// The actions of the rules: let the process make the syscall, kill it, send
+// it SIGSYS or fail with EPERM
+var seccompActions = []string{"SCMP_ACT_ALLOW", "SCMP_ACT_KILL", "SCMP_ACT_TRAP", "SCMP_ACT_ERRNO"}
+
+// -security-opt seccomp=unconfined runs the container without seccomp
+const seccompUnconfined = "unconfined"
+
+// The syscalls the default profile denies whatever the capabilities of the
+// container: the kernel doesn't isolate what they touch, or they are
+// obsolete
+var seccompDeniedSyscalls = []string{
+	"add_key", "create_module", "get_kernel_syms", "keyctl", "nfsservctl",
+	"query_module", "request_key", "_sysctl", "sysfs", "uselib",
+	"userfaultfd", "ustat",
+}
+
+// The syscalls the default profile denies to the containers without the
+// capability they require
+var seccompCapabilitySyscalls = map[string][]string{
+	"dac_read_search": {"name_to_handle_at", "open_by_handle_at"},
+	"sys_admin": {"bpf", "lookup_dcookie", "mount", "perf_event_open", "pivot_root",
+		"quotactl", "setns", "swapoff", "swapon", "umount2", "unshare"},
+	"sys_boot":   {"kexec_file_load", "kexec_load", "reboot"},
+	"sys_module": {"delete_module", "finit_module", "init_module"},
+	"sys_pacct":  {"acct"},
+	"sys_ptrace": {"kcmp", "process_vm_readv", "process_vm_writev", "ptrace"},
+	"sys_rawio":  {"ioperm", "iopl"},
+	"sys_time":   {"clock_adjtime", "clock_settime", "settimeofday"},
+	"syslog":     {"syslog"},
+}
+
+// The default profile of a container which drops the capabilities dropped:
+// the syscalls are allowed but the ones of seccompDeniedSyscalls and the
+// ones of the capabilities it doesn't have
+func defaultSeccompProfile(dropped []string) *SeccompProfile {
+	denied := append([]string{}, seccompDeniedSyscalls...)
+	for _, capability := range dropped {
+		denied = append(denied, seccompCapabilitySyscalls[capability]...)
+	}
+	return &SeccompProfile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls:      []*SeccompSyscall{{Names: denied, Action: "SCMP_ACT_ERRNO"}},
+	}
+}
+
+func (rule *SeccompSyscall) names() []string {
+	if rule.Name != "" {
+		return append([]string{rule.Name}, rule.Names...)
+	}
+	return rule.Names
+}
+
+func validSeccompAction(action string) bool {
+	for _, valid := range seccompActions {
+		if action == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSeccompProfile(data []byte) (*SeccompProfile, error) {
+	profile := &SeccompProfile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid seccomp profile: %s", err)
+	}
+	if !validSeccompAction(profile.DefaultAction) {
+		return nil, fmt.Errorf("Bad parameter: invalid default action %q of the seccomp profile (%s)", profile.DefaultAction, strings.Join(seccompActions, ", "))
+	}
+	for _, rule := range profile.Syscalls {
+		if len(rule.names()) == 0 {
+			return nil, fmt.Errorf("Bad parameter: a rule of the seccomp profile has no syscall")
+		}
+		if !validSeccompAction(rule.Action) {
+			return nil, fmt.Errorf("Bad parameter: invalid action %q of %s in the seccomp profile (%s)", rule.Action, rule.names()[0], strings.Join(seccompActions, ", "))
+		}
+		if len(rule.Args) > 0 {
+			return nil, fmt.Errorf("Bad parameter: the arguments of %s in the seccomp profile are not supported", rule.names()[0])
+		}
+	}
+	return profile, nil
+}
@@ -0,0 +1,9 @@
+package docker
+
+import "errors"
+
+const seccompSupported = false
+
+func applySeccomp(profile *SeccompProfile) error {
+	return errors.New("seccomp is not implemented on darwin")
+}
@@ -0,0 +1,116 @@
+//go:build linux && amd64
+// +build linux,amd64
+
+package docker
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// The BPF of the seccomp filters, from linux/filter.h and linux/seccomp.h
+const (
+	bpfLdWAbs = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK   = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK   = 0x06 // BPF_RET | BPF_K
+	bpfMaxLen = 4096 // The instructions of a filter at most
+
+	seccompDataNr   = 0 // The offsets of the fields of struct seccomp_data
+	seccompDataArch = 4
+
+	seccompRetKill  = 0x00000000
+	seccompRetTrap  = 0x00030000
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+)
+
+type sockFilter struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+type sockFprog struct {
+	Len    uint16
+	Filter *sockFilter
+}
+
+func seccompRet(action string) uint32 {
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap
+	case "SCMP_ACT_ERRNO":
+		return seccompRetErrno | uint32(syscall.EPERM)
+	}
+	return seccompRetKill
+}
+
+// Compile the profile into a filter. The syscalls of the other
+// architectures (like the i386 ones of int 0x80) fail with ENOSYS, they
+// would bypass the rules. The syscalls the kernel of the architecture
+// doesn't have are skipped, the profiles may list the ones of other
+// architectures.
+func compileSeccomp(profile *SeccompProfile) ([]sockFilter, error) {
+	deny := sockFilter{Code: bpfRetK, K: seccompRetErrno | uint32(syscall.ENOSYS)}
+	filter := []sockFilter{
+		{Code: bpfLdWAbs, K: seccompDataArch},
+		{Code: bpfJeqK, Jt: 1, K: seccompAuditArch},
+		deny,
+		{Code: bpfLdWAbs, K: seccompDataNr},
+		{Code: bpfJgeK, Jf: 1, K: seccompSyscallMax},
+		deny,
+	}
+	seen := make(map[int]bool)
+	for _, rule := range profile.Syscalls {
+		for _, name := range rule.names() {
+			nr, exists := seccompSyscalls[name]
+			if !exists || seen[nr] {
+				continue
+			}
+			seen[nr] = true
+			filter = append(filter,
+				sockFilter{Code: bpfJeqK, Jf: 1, K: uint32(nr)},
+				sockFilter{Code: bpfRetK, K: seccompRet(rule.Action)},
+			)
+		}
+	}
+	filter = append(filter, sockFilter{Code: bpfRetK, K: seccompRet(profile.DefaultAction)})
+	if len(filter) > bpfMaxLen {
+		return nil, fmt.Errorf("The seccomp profile has too many syscalls")
+	}
+	return filter, nil
+}
+
+// Install the profile in the process, for the program it executes next: the
+// thread is locked, the filter is only installed in the current one. The
+// process must not gain privileges (with setuid binaries) if it can't
+// install a filter otherwise, without CAP_SYS_ADMIN.
+func applySeccomp(profile *SeccompProfile) error {
+	filter, err := compileSeccomp(profile)
+	if err != nil {
+		return err
+	}
+	runtime.LockOSThread()
+	prog := &sockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(prog)))
+	if errno == syscall.EACCES {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			return errno
+		}
+		_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(prog)))
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build linux && !amd64
+// +build linux,!amd64
+
+package docker
+
+import (
+	"errors"
+	"runtime"
+)
+
+// The syscalls of the architecture aren't known, the runtime reports that
+// the kernel doesn't support seccomp
+const seccompSupported = false
+
+func applySeccomp(profile *SeccompProfile) error {
+	return errors.New("seccomp is not implemented on " + runtime.GOARCH)
+}
@@ -0,0 +1,94 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// The options of -security-opt, from a host config
+type securityOptions struct {
+	seccomp       string            // The JSON of the seccomp profile, or unconfined
+	apparmor      string            // The AppArmor profile of the processes
+	label         map[string]string // The user, role, type and level of the SELinux labels
+	labelDisabled bool              // label=disable, no SELinux labels
+}
+
+// The parts of the SELinux labels -security-opt label=part:value sets
+var labelParts = []string{"user", "role", "type", "level"}
+
+// Parse the key=value options of -security-opt:
+// seccomp=<the JSON of a profile> or seccomp=unconfined, apparmor=PROFILE,
+// label=user:USER, label=role:ROLE, label=type:TYPE, label=level:LEVEL and
+// label=disable
+func parseSecurityOpt(opts []string) (*securityOptions, error) {
+	options := &securityOptions{label: make(map[string]string)}
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Bad parameter: invalid security option %s (seccomp=, apparmor= or label=)", opt)
+		}
+		switch parts[0] {
+		case "seccomp":
+			if parts[1] != seccompUnconfined {
+				if _, err := parseSeccompProfile([]byte(parts[1])); err != nil {
+					return nil, err
+				}
+			}
+			options.seccomp = parts[1]
+		case "apparmor":
+			if parts[1] == "" || strings.ContainsAny(parts[1], " \t\n") {
+				return nil, fmt.Errorf("Bad parameter: invalid AppArmor profile %q", parts[1])
+			}
+			options.apparmor = parts[1]
+		case "label":
+			if parts[1] == "disable" {
+				options.labelDisabled = true
+				continue
+			}
+			if err := parseLabelOpt(options.label, parts[1]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Bad parameter: invalid security option %s (seccomp=, apparmor= or label=)", opt)
+		}
+	}
+	if options.labelDisabled && len(options.label) > 0 {
+		return nil, fmt.Errorf("Bad parameter: the SELinux labels can't be both disabled and set")
+	}
+	return options, nil
+}
+
+// Set the part of user:USER (or role, type and level) in label
+func parseLabelOpt(label map[string]string, opt string) error {
+	parts := strings.SplitN(opt, ":", 2)
+	if len(parts) == 2 && parts[1] != "" && !strings.ContainsAny(parts[1], " \t\n") {
+		for _, part := range labelParts {
+			if parts[0] == part {
+				label[part] = parts[1]
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Bad parameter: invalid label option %s (user:, role:, type:, level: or disable)", opt)
+}
+
+// The -security-opt of docker run, with the seccomp profiles read: the
+// daemon gets their JSON
+func readSecurityOpt(opts []string) ([]string, error) {
+	var read []string
+	for _, opt := range opts {
+		if parts := strings.SplitN(opt, "=", 2); len(parts) == 2 && parts[0] == "seccomp" && parts[1] != seccompUnconfined {
+			data, err := ioutil.ReadFile(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read the seccomp profile %s: %s", parts[1], err)
+			}
+			opt = "seccomp=" + string(data)
+		}
+		read = append(read, opt)
+	}
+	if _, err := parseSecurityOpt(read); err != nil {
+		return nil, err
+	}
+	return read, nil
+}
@@ -0,0 +1,95 @@
+package docker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The SELinux labels of the processes of the containers and of their files,
+// the ones the policies of the hosts have for lxc. Each container gets an
+// MCS level of its own, it can't touch the files of the others.
+const (
+	defaultProcessLabel = "system_u:system_r:svirt_lxc_net_t:s0"
+	defaultMountLabel   = "system_u:object_r:svirt_sandbox_file_t:s0"
+	selinuxXattr        = "security.selinux"
+)
+
+// The directories of the host the volumes can't relabel, the host would
+// break and it can't be undone
+var relabelForbidden = []string{"/", "/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib64", "/proc", "/sbin", "/sys", "/usr", "/var"}
+
+// Set parts (user, role, type or level) of a user:role:type:level label,
+// the level has colons itself (s0:c1,c2)
+func setLabelParts(label string, parts map[string]string) string {
+	fields := strings.SplitN(label, ":", 4)
+	for i, part := range labelParts {
+		if value, exists := parts[part]; exists && i < len(fields) {
+			fields[i] = value
+		}
+	}
+	return strings.Join(fields, ":")
+}
+
+func labelLevel(label string) string {
+	if fields := strings.SplitN(label, ":", 4); len(fields) == 4 {
+		return fields[3]
+	}
+	return ""
+}
+
+// A random MCS level, two categories out of 1024, none of the ones used
+func newMCSLevel(used map[string]bool) (string, error) {
+	b := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return "", err
+		}
+		c1, c2 := binary.BigEndian.Uint16(b[:2])%1024, binary.BigEndian.Uint16(b[2:])%1024
+		if c1 == c2 {
+			continue
+		}
+		if c1 > c2 {
+			c1, c2 = c2, c1
+		}
+		if level := fmt.Sprintf("s0:c%d,c%d", c1, c2); !used[level] {
+			return level, nil
+		}
+	}
+}
+
+// Relabel the files of the source of a bind mount (src:dst:z or src:dst:Z)
+// for a container: the containers share them with z, the label has no
+// categories, and only this one can use them with Z
+func relabel(src, mountLabel, mode string) error {
+	if mountLabel == "" || mode == "" {
+		return nil
+	}
+	for _, forbidden := range relabelForbidden {
+		if path.Clean(src) == forbidden {
+			return fmt.Errorf("Bad parameter: relabeling %s would break the host", src)
+		}
+	}
+	label := mountLabel
+	if mode == "z" {
+		label = setLabelParts(mountLabel, map[string]string{"level": "s0"})
+	}
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// The label would go to the target of the link
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		if err := setFileLabel(p, label); err != nil {
+			return fmt.Errorf("Unable to relabel %s: %s", p, err)
+		}
+		return nil
+	})
+}
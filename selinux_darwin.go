@@ -0,0 +1,7 @@
+package docker
+
+import "errors"
+
+func setFileLabel(p, label string) error {
+	return errors.New("SELinux labels are not implemented on darwin")
+}
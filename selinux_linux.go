@@ -0,0 +1,7 @@
+package docker
+
+import "syscall"
+
+func setFileLabel(p, label string) error {
+	return syscall.Setxattr(p, selinuxXattr, []byte(label), 0)
+}
@@ -1,7 +1,8 @@
 package docker
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,6 +18,8 @@ import (
 	"os/exec"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -83,6 +86,42 @@ func (srv *Server) ContainerKill(name string) error {
 	return nil
 }
 
+func (srv *Server) ContainerUpdate(name string, update *UpdateConfig) error {
+	if container := srv.runtime.Get(name); container != nil {
+		if err := container.Update(update); err != nil {
+			return err
+		}
+		srv.LogEvent("update", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	} else {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	return nil
+}
+
+func (srv *Server) ContainerPause(name string) error {
+	if container := srv.runtime.Get(name); container != nil {
+		if err := container.Pause(); err != nil {
+			return err
+		}
+		srv.LogEvent("pause", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	} else {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	return nil
+}
+
+func (srv *Server) ContainerUnpause(name string) error {
+	if container := srv.runtime.Get(name); container != nil {
+		if err := container.Unpause(); err != nil {
+			return err
+		}
+		srv.LogEvent("unpause", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	} else {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	return nil
+}
+
 func (srv *Server) ContainerExport(name string, out io.Writer) error {
 	if container := srv.runtime.Get(name); container != nil {
 
@@ -101,22 +140,120 @@ func (srv *Server) ContainerExport(name string, out io.Writer) error {
 	return fmt.Errorf("No such container: %s", name)
 }
 
-func (srv *Server) ImagesSearch(term string) ([]APISearch, error) {
-	r, err := registry.NewRegistry(srv.runtime.root, nil, srv.HTTPRequestFactory())
-	if err != nil {
-		return nil, err
+// The results of a search by default, and at most
+const (
+	DefaultSearchLimit = 25
+	MaxSearchLimit     = 100
+)
+
+// The pages of results a search reads at most to find the ones matching
+// its filters
+const maxSearchPages = 10
+
+// SearchFilters select the results of a search: is-official and
+// is-automated by their value, true or false, stars by their minimum number
+// of stars. The values of a filter are alternatives.
+type SearchFilters map[string][]string
+
+// Parse the filters query parameter of /images/search, a JSON object such
+// as: {"is-official":["true"],"stars":["3"]}
+func parseSearchFilters(value string) (SearchFilters, error) {
+	filters := SearchFilters{}
+	if value == "" {
+		return filters, nil
+	}
+	if err := json.Unmarshal([]byte(value), &filters); err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid filters %s: %s", value, err)
+	}
+	for name, values := range filters {
+		for _, value := range values {
+			switch name {
+			case "is-official", "is-automated":
+				if _, err := strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("Bad parameter: invalid %s filter %s (true or false)", name, value)
+				}
+			case "stars":
+				if stars, err := strconv.Atoi(value); err != nil || stars < 0 {
+					return nil, fmt.Errorf("Bad parameter: invalid stars filter %s (a number of stars)", value)
+				}
+			default:
+				return nil, fmt.Errorf("Bad parameter: invalid filter %s (is-official, is-automated or stars)", name)
+			}
+		}
+	}
+	return filters, nil
+}
+
+func (filters SearchFilters) match(result *APISearch) bool {
+	for name, values := range filters {
+		matched := false
+		for _, value := range values {
+			switch name {
+			case "is-official":
+				official, _ := strconv.ParseBool(value)
+				matched = matched || official == result.IsOfficial
+			case "is-automated":
+				automated, _ := strconv.ParseBool(value)
+				matched = matched || automated == result.IsAutomated
+			case "stars":
+				stars, _ := strconv.Atoi(value)
+				matched = matched || result.StarCount >= stars
+			}
+		}
+		if !matched {
+			return false
+		}
 	}
-	results, err := r.SearchRepositories(term)
+	return true
+}
+
+// ImagesSearch returns the first limit repositories of the index matching
+// term and the filters. A term starting with the hostname of a registry
+// searches it instead of the index.
+func (srv *Server) ImagesSearch(term string, limit int, filters SearchFilters) ([]APISearch, error) {
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	} else if limit < 0 || limit > MaxSearchLimit {
+		return nil, fmt.Errorf("Bad parameter: invalid limit %d (between 1 and %d)", limit, MaxSearchLimit)
+	}
+	indexEp := auth.IndexServerAddress()
+	if parts := strings.SplitN(term, "/", 2); len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		endpoint, name, err := registry.ResolveRepositoryName(term)
+		if err != nil {
+			return nil, err
+		}
+		indexEp, term = endpoint, name
+	}
+	r, err := registry.NewRegistry(srv.runtime.root, nil, srv.HTTPRequestFactory())
 	if err != nil {
 		return nil, err
 	}
 
-	var outs []APISearch
-	for _, repo := range results.Results {
-		var out APISearch
-		out.Description = repo["description"]
-		out.Name = repo["name"]
-		outs = append(outs, out)
+	outs := []APISearch{}
+	for page := 1; page <= maxSearchPages; page++ {
+		results, err := r.SearchRepositories(indexEp, term, page, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results.Results {
+			out := APISearch{
+				Name:        result.Name,
+				Description: result.Description,
+				StarCount:   result.StarCount,
+				IsOfficial:  result.IsOfficial,
+				IsAutomated: result.IsAutomated || result.IsTrusted,
+			}
+			if filters.match(&out) {
+				outs = append(outs, out)
+				if len(outs) == limit {
+					return outs, nil
+				}
+			}
+		}
+		// The registries without pages send all the results at once
+		if len(results.Results) == 0 || page >= results.NumPages {
+			break
+		}
 	}
 	return outs, nil
 }
@@ -157,6 +294,151 @@ func (srv *Server) ImageInsert(name, url, path string, out io.Writer, sf *utils.
 	return img.ShortID(), nil
 }
 
+// ImagesPrune deletes the dangling images no container uses, then their
+// parents which become dangling, and returns them with the size of their
+// layers.
+func (srv *Server) ImagesPrune() (*APIImagesPrune, error) {
+	used := make(map[string]bool)
+	for _, container := range srv.runtime.List() {
+		used[container.Image] = true
+	}
+	tagged := srv.runtime.repositories.ByID()
+	pruned := &APIImagesPrune{ImagesDeleted: []string{}}
+	for {
+		heads, err := srv.runtime.graph.Heads()
+		if err != nil {
+			return nil, err
+		}
+		deleted := false
+		for id, image := range heads {
+			if used[id] || len(tagged[id]) > 0 {
+				continue
+			}
+			if err := srv.runtime.graph.Delete(id); err != nil {
+				log.Printf("WARNING: Unable to remove the image %s: %s", id, err)
+				continue
+			}
+			srv.LogEvent("delete", utils.TruncateID(id), "")
+			pruned.ImagesDeleted = append(pruned.ImagesDeleted, id)
+			pruned.SpaceReclaimed += image.Size
+			deleted = true
+		}
+		if !deleted {
+			return pruned, nil
+		}
+	}
+}
+
+// SystemDF returns the disk usage of the images, the read-write layers of
+// the containers, the volumes and the build cache: the images no tag or
+// container references, the ones docker image prune removes. Verbose adds
+// the usage of each of them.
+func (srv *Server) SystemDF(verbose bool) (*APISystemDF, error) {
+	images, err := srv.runtime.graph.Map()
+	if err != nil {
+		return nil, err
+	}
+	tagged := srv.runtime.repositories.ByID()
+	containers := srv.runtime.List()
+
+	// Mark an image and its parents
+	mark := func(id string, marked map[string]bool) {
+		for id != "" && !marked[id] {
+			image, exists := images[id]
+			if !exists {
+				return
+			}
+			marked[id] = true
+			id = image.Parent
+		}
+	}
+	referenced := make(map[string]bool)
+	active := make(map[string]bool)
+	used := make(map[string]bool)
+	for id := range tagged {
+		mark(id, referenced)
+	}
+	for _, container := range containers {
+		mark(container.Image, referenced)
+		mark(container.Image, active)
+		used[container.Image] = true
+	}
+
+	df := &APISystemDF{}
+	imagesUsage := APIDiskUsage{Type: "Images"}
+	cacheUsage := APIDiskUsage{Type: "Build Cache"}
+	for id, image := range images {
+		if !referenced[id] {
+			cacheUsage.Total++
+			cacheUsage.Size += image.Size
+			cacheUsage.Reclaimable += image.Size
+			if verbose {
+				df.Objects = append(df.Objects, APIDiskUsageObject{Type: "Build Cache", ID: id, Size: image.Size})
+			}
+			continue
+		}
+		imagesUsage.Size += image.Size
+		if !active[id] {
+			imagesUsage.Reclaimable += image.Size
+		}
+		// The layers are only counted in the size of the images
+		if len(tagged[id]) == 0 && !used[id] {
+			continue
+		}
+		imagesUsage.Total++
+		if active[id] {
+			imagesUsage.Active++
+		}
+		if verbose {
+			var name string
+			if len(tagged[id]) > 0 {
+				name = tagged[id][0]
+			}
+			df.Objects = append(df.Objects, APIDiskUsageObject{Type: "Image", ID: id, Name: name, Size: image.getParentsSize(0) + image.Size, Active: active[id]})
+		}
+	}
+
+	containersUsage := APIDiskUsage{Type: "Containers"}
+	for _, container := range containers {
+		sizeRw, _ := container.GetSize()
+		containersUsage.Total++
+		containersUsage.Size += sizeRw
+		if container.State.Running {
+			containersUsage.Active++
+		} else {
+			containersUsage.Reclaimable += sizeRw
+		}
+		if verbose {
+			df.Objects = append(df.Objects, APIDiskUsageObject{Type: "Container", ID: container.ID, Size: sizeRw, Active: container.State.Running})
+		}
+	}
+
+	volumes, err := srv.runtime.VolumeList()
+	if err != nil {
+		return nil, err
+	}
+	volumesUsage := APIDiskUsage{Type: "Local Volumes"}
+	for _, volume := range volumes {
+		var size int64
+		if volume.Mountpoint != "" {
+			size = dirSize(volume.Mountpoint)
+		}
+		volumesUsage.Total++
+		volumesUsage.Size += size
+		if len(volume.Containers) > 0 {
+			volumesUsage.Active++
+		} else {
+			volumesUsage.Reclaimable += size
+		}
+		if verbose {
+			df.Objects = append(df.Objects, APIDiskUsageObject{Type: "Volume", ID: volume.Name, Size: size, Active: len(volume.Containers) > 0})
+		}
+	}
+
+	df.Usage = []APIDiskUsage{imagesUsage, containersUsage, volumesUsage, cacheUsage}
+	return df, nil
+}
+
 func (srv *Server) ImagesViz(out io.Writer) error {
 	images, _ := srv.runtime.graph.All()
 	if images == nil {
@@ -195,9 +477,48 @@ func (srv *Server) ImagesViz(out io.Writer) error {
 	return nil
 }
 
-func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
+// ImageFilters select the images by dangling: true for the heads of the
+// graph no tag references, false for the other images. Like the
+// VolumeFilters, the values of a filter are alternatives.
+type ImageFilters map[string][]string
+
+// Parse the filters query parameter of /images/json, a JSON object such
+// as: {"dangling":["true"]}
+func parseImageFilters(value string) (ImageFilters, error) {
+	filters := ImageFilters{}
+	if value == "" {
+		return filters, nil
+	}
+	if err := json.Unmarshal([]byte(value), &filters); err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid filters %s: %s", value, err)
+	}
+	for name, values := range filters {
+		if name != "dangling" {
+			return nil, fmt.Errorf("Bad parameter: invalid filter %s (dangling)", name)
+		}
+		for _, value := range values {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("Bad parameter: invalid dangling filter %s (true or false)", value)
+			}
+		}
+	}
+	return filters, nil
+}
+
+func (filters ImageFilters) match(image *APIImages, heads map[string]*Image) bool {
+	for _, value := range filters["dangling"] {
+		_, isHead := heads[image.ID]
+		if dangling, _ := strconv.ParseBool(value); dangling == (isHead && image.Repository == "") {
+			return true
+		}
+	}
+	return len(filters["dangling"]) == 0
+}
+
+func (srv *Server) Images(all bool, filter string, filters ImageFilters) ([]APIImages, error) {
 	var (
 		allImages map[string]*Image
+		heads     map[string]*Image
 		err       error
 	)
 	if all {
@@ -208,6 +529,11 @@ func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(filters) > 0 {
+		if heads, err = srv.runtime.graph.Heads(); err != nil {
+			return nil, err
+		}
+	}
 	outs := []APIImages{} //produce [] when empty instead of 'null'
 	for name, repository := range srv.runtime.repositories.Repositories {
 		if filter != "" && name != filter {
@@ -230,6 +556,26 @@ func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
 			outs = append(outs, out)
 		}
 	}
+	// The images only pulled by digest are part of their repository too
+	for name, digests := range srv.runtime.repositories.Digests {
+		if filter != "" && name != filter {
+			continue
+		}
+		for _, id := range digests {
+			image, exists := allImages[id]
+			if !exists {
+				continue
+			}
+			delete(allImages, id)
+			outs = append(outs, APIImages{
+				Repository:  name,
+				ID:          image.ID,
+				Created:     image.Created.Unix(),
+				Size:        image.Size,
+				VirtualSize: image.getParentsSize(0) + image.Size,
+			})
+		}
+	}
 	// Display images which aren't part of a
 	if filter == "" {
 		for _, image := range allImages {
@@ -241,6 +587,15 @@ func (srv *Server) Images(all bool, filter string) ([]APIImages, error) {
 			outs = append(outs, out)
 		}
 	}
+	if len(filters) > 0 {
+		filtered := []APIImages{}
+		for _, out := range outs {
+			if filters.match(&out, heads) {
+				filtered = append(filtered, out)
+			}
+		}
+		outs = filtered
+	}
 
 	sortImagesByCreationAndTag(outs)
 	return outs, nil
@@ -269,6 +624,7 @@ func (srv *Server) DockerInfo() *APIInfo {
 	return &APIInfo{
 		Containers:         len(srv.runtime.List()),
 		Images:             imgcount,
+		Driver:             srv.runtime.graph.driver.String(),
 		MemoryLimit:        srv.runtime.capabilities.MemoryLimit,
 		SwapLimit:          srv.runtime.capabilities.SwapLimit,
 		IPv4Forwarding:     srv.runtime.capabilities.IPv4Forwarding,
@@ -302,9 +658,10 @@ func (srv *Server) ImageHistory(name string) ([]APIHistory, error) {
 	outs := []APIHistory{} //produce [] when empty instead of 'null'
 	err = image.WalkHistory(func(img *Image) error {
 		var out APIHistory
-		out.ID = srv.runtime.repositories.ImageName(img.ShortID())
+		out.ID = img.ID
 		out.Created = img.Created.Unix()
 		out.CreatedBy = strings.Join(img.ContainerConfig.Cmd, " ")
+		out.Size = img.Size
 		out.Tags = lookupMap[img.ID]
 		outs = append(outs, out)
 		return nil
@@ -313,37 +670,50 @@ func (srv *Server) ImageHistory(name string) ([]APIHistory, error) {
 
 }
 
-func (srv *Server) ContainerTop(name, ps_args string) (*APITop, error) {
-	if container := srv.runtime.Get(name); container != nil {
-		output, err := exec.Command("lxc-ps", "--name", container.ID, "--", ps_args).CombinedOutput()
-		if err != nil {
-			return nil, fmt.Errorf("Error trying to use lxc-ps: %s (%s)", err, output)
+// ContainerTop runs ps on the host with psArgs (-ef by default) and keeps the
+// processes of the container, the ones in its cgroups. The output of ps must
+// have a PID column.
+func (srv *Server) ContainerTop(name, psArgs string) (*APITop, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	if !container.State.Running {
+		return nil, fmt.Errorf("Impossible to list the processes of the container %s, it's not running", container.ID)
+	}
+	pids, err := container.pids()
+	if err != nil {
+		return nil, err
+	}
+	if psArgs == "" {
+		psArgs = "-ef"
+	}
+	output, err := exec.Command("ps", strings.Fields(psArgs)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error running ps %s: %s", psArgs, err)
+	}
+	lines := strings.Split(string(output), "\n")
+	procs := &APITop{Titles: strings.Fields(lines[0])}
+	pidIndex := -1
+	for i, title := range procs.Titles {
+		if title == "PID" {
+			pidIndex = i
+			break
 		}
-		procs := APITop{}
-		for i, line := range strings.Split(string(output), "\n") {
-			if len(line) == 0 {
-				continue
-			}
-			words := []string{}
-			scanner := bufio.NewScanner(strings.NewReader(line))
-			scanner.Split(bufio.ScanWords)
-			if !scanner.Scan() {
-				return nil, fmt.Errorf("Error trying to use lxc-ps")
-			}
-			// no scanner.Text because we skip container id
-			for scanner.Scan() {
-				words = append(words, scanner.Text())
-			}
-			if i == 0 {
-				procs.Titles = words
-			} else {
-				procs.Processes = append(procs.Processes, words)
-			}
+	}
+	if pidIndex == -1 {
+		return nil, fmt.Errorf("Bad parameter: the output of ps %s has no PID column", psArgs)
+	}
+	for _, line := range lines[1:] {
+		words := strings.Fields(line)
+		if len(words) <= pidIndex {
+			continue
+		}
+		if pid, err := strconv.Atoi(words[pidIndex]); err == nil && pids[pid] {
+			procs.Processes = append(procs.Processes, words)
 		}
-		return &procs, nil
-
 	}
-	return nil, fmt.Errorf("No such container: %s", name)
+	return procs, nil
 }
 
 func (srv *Server) ContainerChanges(name string) ([]Change, error) {
@@ -353,6 +723,131 @@ func (srv *Server) ContainerChanges(name string) ([]Change, error) {
 	return nil, fmt.Errorf("No such container: %s", name)
 }
 
+func (srv *Server) ContainerPortStats(name string) ([]APIPortStats, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	stats := []APIPortStats{}
+	// The network is released when the container stops:
+	iface := container.network
+	if iface == nil {
+		return stats, nil
+	}
+	for _, nat := range iface.extPorts {
+		proxyStats, err := iface.manager.portMapper.Stats(nat.Frontend, nat.Proto)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, APIPortStats{
+			PrivatePort: nat.Backend,
+			PublicPort:  nat.Frontend,
+			Type:        nat.Proto,
+			ProxyStats:  proxyStats,
+		})
+	}
+	return stats, nil
+}
+
+func (srv *Server) ContainerPublishPort(name, spec string) (*APIPortMapping, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	nat, err := container.PublishPort(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &APIPortMapping{PrivatePort: nat.Backend, PublicPort: nat.Frontend, Type: nat.Proto}, nil
+}
+
+func (srv *Server) ContainerUnpublishPort(name, spec string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	_, err := container.UnpublishPort(spec)
+	return err
+}
+
+func (srv *Server) NetworkCreate(name, driver string, options map[string]string) (*APINetwork, error) {
+	if err := srv.runtime.CreateNetwork(name, driver, options); err != nil {
+		return nil, err
+	}
+	return srv.runtime.NetworkInfo(name)
+}
+
+func (srv *Server) Networks() ([]APINetwork, error) {
+	networks := []APINetwork{}
+	for _, name := range srv.runtime.NetworkNames() {
+		info, err := srv.runtime.NetworkInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, *info)
+	}
+	return networks, nil
+}
+
+func (srv *Server) NetworkInspect(name string) (*APINetwork, error) {
+	return srv.runtime.NetworkInfo(name)
+}
+
+func (srv *Server) NetworkConnect(network, name string, aliases []string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	return srv.runtime.ConnectContainer(network, container, aliases)
+}
+
+func (srv *Server) ContainerRename(name, newName string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if err := srv.runtime.RenameContainer(container, newName); err != nil {
+		return err
+	}
+	srv.LogEvent("rename", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
+
+func (srv *Server) NetworkDelete(name string) error {
+	return srv.runtime.DeleteNetwork(name)
+}
+
+func (srv *Server) VolumeCreate(name, driver string, options map[string]string) (*APIVolume, error) {
+	return srv.runtime.CreateVolume(name, driver, options)
+}
+
+// The volumes matching the filters
+func (srv *Server) Volumes(filters VolumeFilters) ([]APIVolume, error) {
+	volumes, err := srv.runtime.VolumeList()
+	if err != nil {
+		return nil, err
+	}
+	matching := []APIVolume{}
+	for _, volume := range volumes {
+		if filters.match(&volume) {
+			matching = append(matching, volume)
+		}
+	}
+	return matching, nil
+}
+
+func (srv *Server) VolumeInspect(name string) (*APIVolume, error) {
+	return srv.runtime.VolumeInfo(name, true)
+}
+
+func (srv *Server) VolumeDelete(name string) error {
+	return srv.runtime.DeleteVolume(name)
+}
+
+func (srv *Server) VolumesPrune() (*APIVolumesPrune, error) {
+	return srv.runtime.PruneVolumes()
+}
+
 func (srv *Server) Containers(all, size bool, n int, since, before string) []APIContainers {
 	var foundBefore bool
 	var displayed int
@@ -395,11 +890,30 @@ func (srv *Server) Containers(all, size bool, n int, since, before string) []API
 	return retContainers
 }
 
-func (srv *Server) ContainerCommit(name, repo, tag, author, comment string, config *Config) (string, error) {
+// ContainerCommit commits the container name with config, or, with changes
+// (e.g. ENV X=1), with the config of the container they are applied to
+func (srv *Server) ContainerCommit(name, repo, tag, author, comment string, config *Config, changes []string) (string, error) {
 	container := srv.runtime.Get(name)
 	if container == nil {
 		return "", fmt.Errorf("No such container: %s", name)
 	}
+	if len(changes) > 0 {
+		if config == nil {
+			config = &Config{}
+		}
+		MergeConfig(config, container.Config)
+		// The changes mustn't modify the config of the container
+		config.Env = append([]string{}, config.Env...)
+		config.PortSpecs = append([]string{}, config.PortSpecs...)
+		labels := make(map[string]string, len(config.Labels))
+		for k, v := range config.Labels {
+			labels[k] = v
+		}
+		config.Labels = labels
+		if err := applyChanges(config, changes); err != nil {
+			return "", fmt.Errorf("Bad parameter: %s", err)
+		}
+	}
 	img, err := NewBuilder(srv.runtime).Commit(container, repo, tag, comment, author, config)
 	if err != nil {
 		return "", err
@@ -407,6 +921,32 @@ func (srv *Server) ContainerCommit(name, repo, tag, author, comment string, conf
 	return img.ShortID(), err
 }
 
+// ImageSquash merges the layers of the image down to parent, or all of them
+// if it's empty, in a new image tagged repo:tag
+func (srv *Server) ImageSquash(name, parent, repo, tag string) (string, error) {
+	img, err := srv.runtime.repositories.LookupImage(name)
+	if err != nil {
+		return "", err
+	}
+	if parent != "" {
+		parentImg, err := srv.runtime.repositories.LookupImage(parent)
+		if err != nil {
+			return "", err
+		}
+		parent = parentImg.ID
+	}
+	squashed, err := srv.runtime.graph.Squash(img, parent, fmt.Sprintf("squashed from %s", img.ID))
+	if err != nil {
+		return "", err
+	}
+	if repo != "" {
+		if err := srv.runtime.repositories.Set(repo, tag, squashed.ID, true); err != nil {
+			return "", err
+		}
+	}
+	return squashed.ShortID(), nil
+}
+
 func (srv *Server) ContainerTag(name, repo, tag string, force bool) error {
 	if err := srv.runtime.repositories.Set(repo, tag, name, force); err != nil {
 		return err
@@ -414,38 +954,147 @@ func (srv *Server) ContainerTag(name, repo, tag string, force bool) error {
 	return nil
 }
 
+// The endpoints of the mirrors of the official index, with -registry-mirror
+var RegistryMirrors []string
+
+// The layers a daemon downloads at the same time from a registry, for all
+// its pulls, with -max-concurrent-downloads
+var MaxConcurrentDownloads = 3
+
+// An image downloaded by a pull, its layer buffered to disk until its
+// parent is registered
+type imageDownload struct {
+	img     *Image
+	imgJSON []byte
+	layer   *TempArchive
+	err     error
+}
+
+// The slots of the downloads from the registry endpoint, a download holds
+// one while it reads from it
+func (srv *Server) downloadSlots(endpoint string) chan struct{} {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.downloads == nil {
+		srv.downloads = make(map[string]chan struct{})
+	}
+	slots, exists := srv.downloads[endpoint]
+	if !exists {
+		slots = make(chan struct{}, MaxConcurrentDownloads)
+		srv.downloads[endpoint] = slots
+	}
+	return slots
+}
+
+// Close the layer a download reads if the pull is canceled, which stops the
+// download, until done is called
+func closeOnCancel(layer io.Closer, cancel chan struct{}) (done func()) {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+			layer.Close()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+// Download the json and the layer of the image id, once the registry has a
+// free slot, unless the pull is canceled first
+func (srv *Server) downloadImage(r *registry.Registry, out io.Writer, id, endpoint string, token []string, sf *utils.StreamFormatter, cancel chan struct{}) *imageDownload {
+	slots := srv.downloadSlots(endpoint)
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-cancel:
+		return &imageDownload{err: fmt.Errorf("The pull of %s was canceled", utils.TruncateID(id))}
+	}
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "metadata"))
+	imgJSON, imgSize, err := r.GetRemoteImageJSON(id, endpoint, token)
+	if err != nil {
+		return &imageDownload{err: err}
+	}
+	img, err := NewImgJSON(imgJSON)
+	if err != nil {
+		return &imageDownload{err: fmt.Errorf("Failed to parse json: %s", err)}
+	}
+	if img.ID != id {
+		return &imageDownload{err: fmt.Errorf("The registry sent the image %s for %s", utils.TruncateID(img.ID), utils.TruncateID(id))}
+	}
+
+	// Get the layer
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "fs layer"))
+	layer, err := r.GetRemoteImageLayer(img.ID, endpoint, token)
+	if err != nil {
+		return &imageDownload{err: err}
+	}
+	defer layer.Close()
+	defer closeOnCancel(layer, cancel)()
+	tmp, err := srv.runtime.graph.tmp()
+	if err != nil {
+		return &imageDownload{err: err}
+	}
+	archive, err := NewTempArchive(utils.ProgressReader(layer, imgSize, out, sf.FormatProgress(utils.TruncateID(id), "Downloading", "%8v/%v (%v)"), sf, false), tmp.Root)
+	if err != nil {
+		return &imageDownload{err: err}
+	}
+	return &imageDownload{img: img, imgJSON: imgJSON, layer: archive}
+}
+
 func (srv *Server) pullImage(r *registry.Registry, out io.Writer, imgID, endpoint string, token []string, sf *utils.StreamFormatter) error {
 	history, err := r.GetRemoteHistory(imgID, endpoint, token)
 	if err != nil {
 		return err
 	}
+	var ids []string
+	for i := len(history) - 1; i >= 0; i-- {
+		ids = append(ids, history[i])
+	}
+	return srv.registerDownloads(ids, func(id string, cancel chan struct{}) *imageDownload {
+		return srv.downloadImage(r, out, id, endpoint, token, sf, cancel)
+	})
+}
 
-	// FIXME: Try to stream the images?
-	// FIXME: Launch the getRemoteImage() in goroutines
-	for _, id := range history {
+// Download the images ids, from the base image up, concurrently with
+// download and register them in order, as the parent of an image is
+// registered before it. The images the graph has are skipped.
+func (srv *Server) registerDownloads(ids []string, download func(id string, cancel chan struct{}) *imageDownload) error {
+	var downloads []chan *imageDownload
+	cancel := make(chan struct{})
+	for _, id := range ids {
 		if !srv.runtime.graph.Exists(id) {
-			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "metadata"))
-			imgJSON, imgSize, err := r.GetRemoteImageJSON(id, endpoint, token)
-			if err != nil {
-				// FIXME: Keep going in case of error?
-				return err
-			}
-			img, err := NewImgJSON(imgJSON)
-			if err != nil {
-				return fmt.Errorf("Failed to parse json: %s", err)
-			}
-
-			// Get the layer
-			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "fs layer"))
-			layer, err := r.GetRemoteImageLayer(img.ID, endpoint, token)
-			if err != nil {
-				return err
-			}
-			defer layer.Close()
-			if err := srv.runtime.graph.Register(imgJSON, utils.ProgressReader(layer, imgSize, out, sf.FormatProgress(utils.TruncateID(id), "Downloading", "%8v/%v (%v)"), sf, false), img); err != nil {
-				return err
+			d := make(chan *imageDownload, 1)
+			go func(id string) {
+				d <- download(id, cancel)
+			}(id)
+			downloads = append(downloads, d)
+		}
+	}
+	defer func() {
+		// The downloads a failure leaves are canceled, and discarded once
+		// they stopped
+		close(cancel)
+		for _, download := range downloads {
+			if d := <-download; d.layer != nil {
+				d.layer.Close()
+				os.Remove(d.layer.Name())
 			}
 		}
+	}()
+	for len(downloads) != 0 {
+		d := <-downloads[0]
+		downloads = downloads[1:]
+		if d.err != nil {
+			return d.err
+		}
+		err := srv.runtime.graph.Register(d.imgJSON, d.layer, d.img)
+		d.layer.Close()
+		os.Remove(d.layer.Name())
+		// Another pull may have registered it meanwhile
+		if err != nil && !srv.runtime.graph.Exists(d.img.ID) {
+			return err
+		}
 	}
 	return nil
 }
@@ -488,6 +1137,16 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 		repoData.ImgList[id].Tag = askedTag
 	}
 
+	// The images of the official index are pulled from its mirrors first,
+	// falling back to its registries for the ones they don't have (yet).
+	// The mirrors don't get the tokens of the index, the private images
+	// are only pulled from its registries.
+	var mirrors []string
+	if indexEp == auth.IndexServerAddress() {
+		mirrors = RegistryMirrors
+	}
+	endpoints := append(append([]string{}, mirrors...), repoData.Endpoints...)
+
 	errors := make(chan error)
 	for _, image := range repoData.ImgList {
 		downloadImage := func(img *registry.ImgData) {
@@ -504,8 +1163,12 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 			}
 			out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Pulling", fmt.Sprintf("image (%s) from %s", img.Tag, localName)))
 			success := false
-			for _, ep := range repoData.Endpoints {
-				if err := srv.pullImage(r, out, img.ID, ep, repoData.Tokens, sf); err != nil {
+			for i, ep := range endpoints {
+				token := repoData.Tokens
+				if i < len(mirrors) {
+					token = nil
+				}
+				if err := srv.pullImage(r, out, img.ID, ep, token, sf); err != nil {
 					out.Write(sf.FormatStatus(utils.TruncateID(img.ID), "Error while retrieving image for tag: %s (%s); checking next endpoint", askedTag, err))
 					continue
 				}
@@ -548,6 +1211,142 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 	return nil
 }
 
+// Download the layer of the image img of a manifest, the blob blobSum, once
+// the registry has a free slot, unless the pull is canceled first
+func (srv *Server) downloadBlob(repo *registry.V2Repository, out io.Writer, img *Image, imgJSON []byte, blobSum, endpoint string, sf *utils.StreamFormatter, cancel chan struct{}) *imageDownload {
+	slots := srv.downloadSlots(endpoint)
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-cancel:
+		return &imageDownload{err: fmt.Errorf("The pull of %s was canceled", img.ShortID())}
+	}
+	out.Write(sf.FormatProgress(img.ShortID(), "Pulling", "fs layer"))
+	blob, err := repo.GetBlob(blobSum)
+	if err != nil {
+		return &imageDownload{err: err}
+	}
+	defer blob.Close()
+	defer closeOnCancel(blob, cancel)()
+	tmp, err := srv.runtime.graph.tmp()
+	if err != nil {
+		return &imageDownload{err: err}
+	}
+	archive, err := NewTempArchive(utils.ProgressReader(blob, 0, out, sf.FormatProgress(img.ShortID(), "Downloading", "%8v/%v (%v)"), sf, false), tmp.Root)
+	if err != nil {
+		return &imageDownload{err: err}
+	}
+	return &imageDownload{img: img, imgJSON: imgJSON, layer: archive}
+}
+
+// pullV2Repository pulls the tag of the repository, a tag or a digest, or
+// all its tags if it's empty, with the manifests of the v2 protocol. The
+// download of the layers of the images pulled lazily is deferred until
+// they are used.
+func (srv *Server) pullV2Repository(repo *registry.V2Repository, out io.Writer, localName, tag, endpoint string, sf *utils.StreamFormatter, lazy bool) error {
+	out.Write(sf.FormatStatus("", "Pulling repository %s", localName))
+	tags := []string{tag}
+	if tag == "" {
+		var err error
+		if tags, err = repo.GetTags(); err != nil {
+			return err
+		}
+	}
+	for _, tag := range tags {
+		if err := srv.pullV2Tag(repo, out, localName, tag, endpoint, sf, lazy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (srv *Server) pullV2Tag(repo *registry.V2Repository, out io.Writer, localName, tag, endpoint string, sf *utils.StreamFormatter, lazy bool) error {
+	// The manifest lists resolve to the manifest of the platform of the host
+	manifest, digest, err := repo.GetManifest(tag, registry.Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS})
+	if err != nil {
+		return err
+	}
+
+	// The manifest lists the images from the top one down, each the child
+	// of the next one
+	var ids []string
+	images := make(map[string]*Image)
+	imgJSONs := make(map[string][]byte)
+	blobSums := make(map[string]string)
+	for i := len(manifest.History) - 1; i >= 0; i-- {
+		imgJSON := []byte(manifest.History[i].V1Compatibility)
+		img, err := NewImgJSON(imgJSON)
+		if err != nil {
+			return fmt.Errorf("Invalid manifest %s:%s: %s", localName, tag, err)
+		}
+		if err := ValidateID(img.ID); err != nil {
+			return fmt.Errorf("Invalid manifest %s:%s: %s", localName, tag, err)
+		}
+		parent := ""
+		if len(ids) != 0 {
+			parent = ids[len(ids)-1]
+		}
+		if img.Parent != parent {
+			return fmt.Errorf("Invalid manifest %s:%s: the parent of %s isn't %s", localName, tag, img.ShortID(), utils.TruncateID(parent))
+		}
+		ids = append(ids, img.ID)
+		images[img.ID] = img
+		imgJSONs[img.ID] = imgJSON
+		blobSums[img.ID] = manifest.FSLayers[i].BlobSum
+	}
+	id := ids[len(ids)-1]
+	if lazy {
+		srv.Lock()
+		if srv.lazyRepositories == nil {
+			srv.lazyRepositories = make(map[string]*registry.V2Repository)
+		}
+		srv.lazyRepositories[endpoint+repo.Name()] = repo
+		srv.Unlock()
+		for _, id := range ids {
+			if srv.runtime.graph.Exists(id) {
+				continue
+			}
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "metadata, the fs layer is fetched when it's used"))
+			source := &lazyLayer{Endpoint: endpoint, Repository: repo.Name(), BlobSum: blobSums[id]}
+			if err := srv.runtime.graph.RegisterLazy(imgJSONs[id], images[id], source); err != nil && !srv.runtime.graph.Exists(id) {
+				return err
+			}
+		}
+	} else {
+		if err := srv.registerDownloads(ids, func(id string, cancel chan struct{}) *imageDownload {
+			return srv.downloadBlob(repo, out, images[id], imgJSONs[id], blobSums[id], endpoint, sf, cancel)
+		}); err != nil {
+			return err
+		}
+		// What a lazy pull left is fetched
+		if !srv.runtime.graph.Materialized(id) {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "lazy fs layers"))
+			if err := srv.runtime.graph.layers.Materialize(id); err != nil {
+				return err
+			}
+		}
+	}
+	// A push of the images to another repository of the registry mounts
+	// their layers from this one
+	for _, id := range ids {
+		source := &BlobSource{BlobSum: blobSums[id], Endpoint: endpoint, Repository: repo.Name()}
+		if err := srv.runtime.graph.AddBlobSource(id, source); err != nil {
+			return err
+		}
+	}
+
+	if !utils.IsDigest(tag) {
+		if err := srv.runtime.repositories.Set(localName, tag, id, true); err != nil {
+			return err
+		}
+	}
+	if err := srv.runtime.repositories.SetDigest(localName, digest, id); err != nil {
+		return err
+	}
+	out.Write(sf.FormatStatus("", "Digest: %s", digest))
+	return nil
+}
+
 func (srv *Server) poolAdd(kind, key string) error {
 	srv.Lock()
 	defer srv.Unlock()
@@ -586,7 +1385,25 @@ func (srv *Server) poolRemove(kind, key string) error {
 	return nil
 }
 
-func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *utils.StreamFormatter, authConfig *auth.AuthConfig, parallel bool) error {
+// Fetch the blob of a layer pulled lazily, with the credentials of its pull
+// unless the daemon restarted since
+func (srv *Server) fetchLazyLayer(source *lazyLayer) (io.ReadCloser, error) {
+	srv.Lock()
+	repo, exists := srv.lazyRepositories[source.Endpoint+source.Repository]
+	srv.Unlock()
+	if !exists {
+		r, err := registry.NewRegistry(srv.runtime.root, nil, srv.HTTPRequestFactory())
+		if err != nil {
+			return nil, err
+		}
+		if repo, err = r.NewV2Repository(source.Endpoint, source.Repository); err != nil {
+			return nil, err
+		}
+	}
+	return repo.GetBlob(source.BlobSum)
+}
+
+func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *utils.StreamFormatter, authConfig *auth.AuthConfig, parallel, lazy bool) error {
 	r, err := registry.NewRegistry(srv.runtime.root, authConfig, srv.HTTPRequestFactory())
 	if err != nil {
 		return err
@@ -608,14 +1425,40 @@ func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *ut
 	}
 
 	out = utils.NewWriteFlusher(out)
-	err = srv.pullRepository(r, out, localName, remoteName, tag, endpoint, sf, parallel)
-	if err != nil {
-		if err := srv.pullImage(r, out, remoteName, endpoint, nil, sf); err != nil {
-			return err
+	// The registries speaking the v2 protocol are pulled with their
+	// manifests, the only way to pull by digest
+	v2Err := registry.ErrV2Unsupported
+	if endpoint != auth.IndexServerAddress() {
+		var repo *registry.V2Repository
+		if repo, v2Err = r.NewV2Repository(endpoint, remoteName); v2Err == nil {
+			if err := srv.pullV2Repository(repo, out, localName, tag, endpoint, sf, lazy); err != nil {
+				return err
+			}
+		} else {
+			utils.Debugf("Pulling %s with the v1 protocol: %s", localName, v2Err)
 		}
-		return nil
 	}
-
+	if v2Err != nil {
+		if utils.IsDigest(tag) {
+			return fmt.Errorf("Unable to pull %s@%s: %s", localName, tag, v2Err)
+		}
+		if lazy {
+			return fmt.Errorf("Unable to pull %s lazily: %s", localName, v2Err)
+		}
+		err = srv.pullRepository(r, out, localName, remoteName, tag, endpoint, sf, parallel)
+		if err != nil {
+			if err := srv.pullImage(r, out, remoteName, endpoint, nil, sf); err != nil {
+				return err
+			}
+		}
+	}
+	if utils.IsDigest(tag) {
+		srv.LogEvent("pull", localName+"@"+tag, "")
+	} else if tag != "" {
+		srv.LogEvent("pull", localName+":"+tag, "")
+	} else {
+		srv.LogEvent("pull", localName, "")
+	}
 	return nil
 }
 
@@ -709,28 +1552,185 @@ func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID,
 			out.Write(sf.FormatStatus("", "Image %s already pushed, skipping", imgData.ID))
 			return "", nil
 		}
-		return "", err
+		return "", err
+	}
+
+	layerData, err := srv.runtime.graph.TempLayerArchive(imgID, Uncompressed, sf, out)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate layer archive: %s", err)
+	}
+
+	// Send the layer
+	if checksum, err := r.PushImageLayerRegistry(imgData.ID, utils.ProgressReader(layerData, int(layerData.Size), out, sf.FormatProgress("", "Pushing", "%8v/%v (%v)"), sf, false), ep, token, jsonRaw); err != nil {
+		return "", err
+	} else {
+		imgData.Checksum = checksum
+	}
+	out.Write(sf.FormatStatus("", ""))
+
+	// Send the checksum
+	if err := r.PushImageChecksumRegistry(imgData, ep, token); err != nil {
+		return "", err
+	}
+
+	return imgData.Checksum, nil
+}
+
+// pushV2Repository uploads the layers of the tags of the repository the
+// registry doesn't have yet, then the manifest of each tag, and records
+// their digest
+func (srv *Server) pushV2Repository(repo *registry.V2Repository, out io.Writer, localName, remoteName, endpoint string, localRepo map[string]string, sf *utils.StreamFormatter) error {
+	out.Write(sf.FormatStatus("", "Pushing repository %s (%d tags)", localName, len(localRepo)))
+	var tags []string
+	for tag := range localRepo {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	// The digests of the layers already pushed or found, by image id
+	blobSums := make(map[string]string)
+	for _, tag := range tags {
+		img, err := srv.runtime.graph.Get(localRepo[tag])
+		if err != nil {
+			return err
+		}
+		history, err := img.History()
+		if err != nil {
+			return err
+		}
+		manifest := &registry.Manifest{
+			SchemaVersion: 1,
+			Name:          remoteName,
+			Tag:           tag,
+			Architecture:  img.Architecture,
+		}
+		for _, img := range history {
+			imgJSON, err := ioutil.ReadFile(jsonPath(srv.runtime.graph.imageRoot(img.ID)))
+			if err != nil {
+				return fmt.Errorf("Error while retrieving the json of %s: %s", img.ID, err)
+			}
+			blobSum, exists := blobSums[img.ID]
+			if !exists {
+				if blobSum, err = srv.pushV2Layer(repo, out, img, endpoint, sf); err != nil {
+					return err
+				}
+				blobSums[img.ID] = blobSum
+			}
+			manifest.FSLayers = append(manifest.FSLayers, registry.FSLayer{BlobSum: blobSum})
+			manifest.History = append(manifest.History, registry.ManifestHistory{V1Compatibility: string(imgJSON)})
+		}
+		manifestJSON, err := json.MarshalIndent(manifest, "", "   ")
+		if err != nil {
+			return err
+		}
+		digest, err := repo.PutManifest(tag, manifestJSON)
+		if err != nil {
+			return err
+		}
+		if err := srv.runtime.repositories.SetDigest(localName, digest, img.ID); err != nil {
+			return err
+		}
+		out.Write(sf.FormatStatus("", "%s: digest: %s", tag, digest))
+	}
+	return nil
+}
+
+// Upload the layer of img unless the registry has it already, or mount it
+// from another repository of the registry, and return the digest of the blob
+func (srv *Server) pushV2Layer(repo *registry.V2Repository, out io.Writer, img *Image, endpoint string, sf *utils.StreamFormatter) (string, error) {
+	digest, err := srv.mountV2Layer(repo, out, img, endpoint, sf)
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		if digest, err = srv.uploadV2Layer(repo, out, img, sf); err != nil {
+			return "", err
+		}
+	}
+	source := &BlobSource{BlobSum: digest, Endpoint: endpoint, Repository: repo.Name()}
+	if err := srv.runtime.graph.AddBlobSource(img.ID, source); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// Find the blob of the layer of img the registry already has, pulled or
+// pushed before: in the repository, or in another repository the blob is
+// mounted from, checked with a HEAD first. The digest is empty if none has
+// it.
+func (srv *Server) mountV2Layer(repo *registry.V2Repository, out io.Writer, img *Image, endpoint string, sf *utils.StreamFormatter) (string, error) {
+	sources, err := srv.runtime.graph.BlobSources(img.ID)
+	if err != nil {
+		return "", err
+	}
+	for _, source := range sources {
+		if source.Endpoint != endpoint {
+			continue
+		}
+		if source.Repository == repo.Name() {
+			if exists, err := repo.BlobExists(source.BlobSum); err != nil {
+				return "", err
+			} else if exists {
+				out.Write(sf.FormatStatus("", "Image %s already pushed, skipping", img.ShortID()))
+				return source.BlobSum, nil
+			}
+			continue
+		}
+		if exists, err := repo.BlobExistsIn(source.Repository, source.BlobSum); err != nil {
+			utils.Debugf("Unable to check the blob %s of %s: %s", source.BlobSum, source.Repository, err)
+			continue
+		} else if !exists {
+			continue
+		}
+		mounted, err := repo.MountBlob(source.BlobSum, source.Repository)
+		if err != nil {
+			utils.Debugf("Unable to mount the blob %s from %s: %s", source.BlobSum, source.Repository, err)
+			continue
+		}
+		if !mounted {
+			// The registry doesn't mount blobs
+			return "", nil
+		}
+		out.Write(sf.FormatStatus("", "Image %s mounted from %s", img.ShortID(), source.Repository))
+		return source.BlobSum, nil
 	}
+	return "", nil
+}
 
-	layerData, err := srv.runtime.graph.TempLayerArchive(imgID, Uncompressed, sf, out)
+// Upload the layer of img unless the registry has it already, and return
+// the digest of the blob
+func (srv *Server) uploadV2Layer(repo *registry.V2Repository, out io.Writer, img *Image, sf *utils.StreamFormatter) (string, error) {
+	tmp, err := srv.runtime.graph.tmp()
+	if err != nil {
+		return "", err
+	}
+	layerData, err := img.TarLayer(Uncompressed)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate layer archive: %s", err)
+	}
+	defer closeArchive(layerData)
+	hash := sha256.New()
+	layer, err := NewTempArchive(utils.ProgressReader(ioutil.NopCloser(io.TeeReader(layerData, hash)), 0, out, sf.FormatProgress(img.ShortID(), "Buffering to disk", "%v/%v (%v)"), sf, true), tmp.Root)
 	if err != nil {
 		return "", fmt.Errorf("Failed to generate layer archive: %s", err)
 	}
+	defer func() {
+		layer.Close()
+		os.Remove(layer.Name())
+	}()
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
 
-	// Send the layer
-	if checksum, err := r.PushImageLayerRegistry(imgData.ID, utils.ProgressReader(layerData, int(layerData.Size), out, sf.FormatProgress("", "Pushing", "%8v/%v (%v)"), sf, false), ep, token, jsonRaw); err != nil {
+	if exists, err := repo.BlobExists(digest); err != nil {
 		return "", err
-	} else {
-		imgData.Checksum = checksum
+	} else if exists {
+		out.Write(sf.FormatStatus("", "Image %s already pushed, skipping", img.ShortID()))
+		return digest, nil
 	}
-	out.Write(sf.FormatStatus("", ""))
-
-	// Send the checksum
-	if err := r.PushImageChecksumRegistry(imgData, ep, token); err != nil {
+	out.Write(sf.FormatStatus("", "Pushing %s", img.ShortID()))
+	if err := repo.PushBlob(digest, utils.ProgressReader(layer, int(layer.Size), out, sf.FormatProgress("", "Pushing", "%8v/%v (%v)"), sf, false), layer.Size); err != nil {
 		return "", err
 	}
-
-	return imgData.Checksum, nil
+	out.Write(sf.FormatStatus("", ""))
+	return digest, nil
 }
 
 // FIXME: Allow to interrupt current push when new push of same image is done.
@@ -758,6 +1758,13 @@ func (srv *Server) ImagePush(localName string, out io.Writer, sf *utils.StreamFo
 		out.Write(sf.FormatStatus("", "The push refers to a repository [%s] (len: %d)", localName, reposLen))
 		// If it fails, try to get the repository
 		if localRepo, exists := srv.runtime.repositories.Repositories[localName]; exists {
+			if endpoint != auth.IndexServerAddress() {
+				if repo, err := r.NewV2Repository(endpoint, remoteName); err == nil {
+					return srv.pushV2Repository(repo, out, localName, remoteName, endpoint, localRepo, sf)
+				} else {
+					utils.Debugf("Pushing %s with the v1 protocol: %s", localName, err)
+				}
+			}
 			if err := srv.pushRepository(r, out, localName, remoteName, localRepo, endpoint, sf); err != nil {
 				return err
 			}
@@ -774,7 +1781,91 @@ func (srv *Server) ImagePush(localName string, out io.Writer, sf *utils.StreamFo
 	return nil
 }
 
-func (srv *Server) ImageImport(src, repo, tag string, in io.Reader, out io.Writer, sf *utils.StreamFormatter) error {
+// ManifestListCreate creates the manifest list name of the images of its
+// repository, or adds them to it with amend
+func (srv *Server) ManifestListCreate(name string, images []string, amend bool) (*ManifestList, error) {
+	return srv.runtime.manifestLists.Create(name, images, amend)
+}
+
+// ManifestListAnnotate sets the platform of the image of the manifest list
+// name, the parts of it which aren't empty
+func (srv *Server) ManifestListAnnotate(name, image, arch, os, variant string) error {
+	return srv.runtime.manifestLists.Annotate(name, image, arch, os, variant)
+}
+
+func (srv *Server) ManifestListInspect(name string) (*ManifestList, error) {
+	return srv.runtime.manifestLists.Get(name)
+}
+
+// ManifestListPush pushes the manifest list name to its registry, which
+// must speak the v2 protocol and have the manifests of its images. purge
+// deletes the local manifest list once it's pushed.
+func (srv *Server) ManifestListPush(name string, out io.Writer, sf *utils.StreamFormatter, authConfig *auth.AuthConfig, purge bool) error {
+	list, err := srv.runtime.manifestLists.Get(name)
+	if err != nil {
+		return err
+	}
+	if err := srv.poolAdd("push", list.Name); err != nil {
+		return err
+	}
+	defer srv.poolRemove("push", list.Name)
+
+	repoName, tag := utils.ParseRepositoryTag(list.Name)
+	endpoint, remoteName, err := registry.ResolveRepositoryName(repoName)
+	if err != nil {
+		return err
+	}
+	if endpoint == auth.IndexServerAddress() {
+		return fmt.Errorf("Impossible to push the manifest list %s, the index doesn't support manifest lists", list.Name)
+	}
+	r, err := registry.NewRegistry(srv.runtime.root, authConfig, srv.HTTPRequestFactory())
+	if err != nil {
+		return err
+	}
+	repo, err := r.NewV2Repository(endpoint, remoteName)
+	if err != nil {
+		return fmt.Errorf("Impossible to push the manifest list %s: %s", list.Name, err)
+	}
+
+	out = utils.NewWriteFlusher(out)
+	manifestList := &registry.ManifestList{
+		SchemaVersion: 2,
+		MediaType:     registry.ManifestListMediaType,
+	}
+	for _, entry := range list.Manifests {
+		_, reference := utils.ParseRepositoryTag(entry.Image)
+		descriptor, err := repo.GetManifestDescriptor(reference)
+		if err != nil {
+			return err
+		}
+		if entry.Architecture != "" {
+			descriptor.Platform.Architecture = entry.Architecture
+		}
+		if entry.OS != "" {
+			descriptor.Platform.OS = entry.OS
+		}
+		if entry.Variant != "" {
+			descriptor.Platform.Variant = entry.Variant
+		}
+		platform := descriptor.Platform.OS + "/" + descriptor.Platform.Architecture
+		if descriptor.Platform.Variant != "" {
+			platform += "/" + descriptor.Platform.Variant
+		}
+		out.Write(sf.FormatStatus("", "%s: %s %s", entry.Image, platform, descriptor.Digest))
+		manifestList.Manifests = append(manifestList.Manifests, *descriptor)
+	}
+	digest, err := repo.PutManifestList(tag, manifestList)
+	if err != nil {
+		return err
+	}
+	out.Write(sf.FormatStatus("", "%s: digest: %s", tag, digest))
+	if purge {
+		return srv.runtime.manifestLists.Delete(list.Name)
+	}
+	return nil
+}
+
+func (srv *Server) ImageImport(src, repo, tag string, config *Config, in io.Reader, out io.Writer, sf *utils.StreamFormatter) error {
 	var archive io.Reader
 	var resp *http.Response
 
@@ -799,7 +1890,7 @@ func (srv *Server) ImageImport(src, repo, tag string, in io.Reader, out io.Write
 		}
 		archive = utils.ProgressReader(resp.Body, int(resp.ContentLength), out, sf.FormatProgress("", "Importing", "%8v/%v (%v)"), sf, true)
 	}
-	img, err := srv.runtime.graph.Create(archive, nil, "Imported from "+src, "", nil)
+	img, err := srv.runtime.graph.Create(archive, nil, "Imported from "+src, "", config)
 	if err != nil {
 		return err
 	}
@@ -813,21 +1904,262 @@ func (srv *Server) ImageImport(src, repo, tag string, in io.Reader, out io.Write
 	return nil
 }
 
-func (srv *Server) ContainerCreate(config *Config) (string, error) {
+// ImageSave writes to out a tar archive of the image name and its parents,
+// each in a directory with its json and the tar of its layer, and of the
+// tags referencing them in a repositories file. A repository name without
+// a tag saves all the tags of the repository.
+func (srv *Server) ImageSave(name string, out io.Writer) error {
+	var images []*Image
+	repositories := make(map[string]Repository)
+	repoName, tag := utils.ParseRepositoryTag(name)
+	repo, err := srv.runtime.repositories.Get(repoName)
+	if err != nil {
+		return err
+	}
+	if repo != nil && tag == "" {
+		for _, id := range repo {
+			img, err := srv.runtime.graph.Get(id)
+			if err != nil {
+				return err
+			}
+			images = append(images, img)
+		}
+		repositories[repoName] = repo
+	} else {
+		img, err := srv.runtime.repositories.LookupImage(name)
+		if err != nil {
+			return err
+		}
+		images = append(images, img)
+		if repo != nil && repo[tag] == img.ID {
+			repositories[repoName] = Repository{tag: img.ID}
+		}
+	}
+
+	tmp, err := srv.runtime.graph.Mktemp("")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	saved := make(map[string]bool)
+	for _, img := range images {
+		history, err := img.History()
+		if err != nil {
+			return err
+		}
+		for _, img := range history {
+			if saved[img.ID] {
+				continue
+			}
+			if err := srv.saveImage(img, tmp); err != nil {
+				return err
+			}
+			saved[img.ID] = true
+		}
+	}
+	if len(repositories) > 0 {
+		repositoriesJSON, err := json.Marshal(repositories)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(tmp, "repositories"), repositoriesJSON, 0644); err != nil {
+			return err
+		}
+	}
+
+	archive, err := Tar(tmp, Uncompressed)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, archive); err != nil {
+		return err
+	}
+	srv.LogEvent("save", name, "")
+	return nil
+}
+
+// saveImage writes the json and the tar of the layer of img in a directory
+// of root named after its id.
+func (srv *Server) saveImage(img *Image, root string) error {
+	dir := path.Join(root, img.ID)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	jsonData, err := ioutil.ReadFile(jsonPath(srv.runtime.graph.imageRoot(img.ID)))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "json"), jsonData, 0644); err != nil {
+		return err
+	}
+	layerData, err := img.TarLayer(Uncompressed)
+	if err != nil {
+		return err
+	}
+	defer closeArchive(layerData)
+	layer, err := os.Create(path.Join(dir, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+	if _, err := io.Copy(layer, layerData); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ImageLoad registers the images of a tar archive written by ImageSave
+// which aren't in the graph yet, and sets the tags it has.
+func (srv *Server) ImageLoad(in io.Reader) error {
+	tmp, err := srv.runtime.graph.Mktemp("")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := Untar(in, tmp); err != nil {
+		return err
+	}
+
+	dirs, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			if err := srv.loadImage(tmp, dir.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	repositoriesJSON, err := ioutil.ReadFile(path.Join(tmp, "repositories"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	repositories := make(map[string]Repository)
+	if err := json.Unmarshal(repositoriesJSON, &repositories); err != nil {
+		return err
+	}
+	for repoName, repo := range repositories {
+		for tag, id := range repo {
+			if err := srv.runtime.repositories.Set(repoName, tag, id, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadImage registers the image id of the directory root, after its parents.
+// The chain of its parents is walked first, an archive can't make it loop.
+func (srv *Server) loadImage(root, id string) error {
+	type loadedImage struct {
+		jsonData []byte
+		img      *Image
+	}
+	var chain []loadedImage
+	visited := make(map[string]bool)
+	for id != "" && !srv.runtime.graph.Exists(id) {
+		if visited[id] {
+			return fmt.Errorf("Image %s is its own parent in the archive", utils.TruncateID(id))
+		}
+		visited[id] = true
+		jsonData, err := ioutil.ReadFile(path.Join(root, id, "json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("Image %s is missing from the archive", utils.TruncateID(id))
+			}
+			return err
+		}
+		img, err := NewImgJSON(jsonData)
+		if err != nil {
+			return err
+		}
+		if img.ID != id {
+			return fmt.Errorf("Image %s has the json of %s", utils.TruncateID(id), utils.TruncateID(img.ID))
+		}
+		if img.Parent != "" {
+			if err := ValidateID(img.Parent); err != nil {
+				return err
+			}
+		}
+		chain = append(chain, loadedImage{jsonData, img})
+		id = img.Parent
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if err := srv.registerLoadedImage(root, chain[i].jsonData, chain[i].img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (srv *Server) registerLoadedImage(root string, jsonData []byte, img *Image) error {
+	layer, err := os.Open(path.Join(root, img.ID, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+	if err := srv.runtime.graph.Register(jsonData, layer, img); err != nil {
+		return err
+	}
+	srv.LogEvent("load", img.ShortID(), "")
+	return nil
+}
+
+// ContainerCreate creates the container of config, hostConfig (which can be
+// nil) gives the storage options of its filesystem
+func (srv *Server) ContainerCreate(config *Config, hostConfig *HostConfig) (string, error) {
 
 	if config.Memory != 0 && config.Memory < 524288 {
 		return "", fmt.Errorf("Memory limit must be given in bytes (minimum 524288 bytes)")
 	}
 
+	if err := validateMemory(config); err != nil {
+		return "", err
+	}
+
 	if config.Memory > 0 && !srv.runtime.capabilities.MemoryLimit {
 		config.Memory = 0
 	}
+	discardMemoryLimits(srv.runtime.capabilities, config)
+
+	if config.Cpuset != "" && !validCpuset.MatchString(config.Cpuset) {
+		return "", fmt.Errorf("Invalid cpuset: %s", config.Cpuset)
+	}
+	if config.CpusetMems != "" && !validCpuset.MatchString(config.CpusetMems) {
+		return "", fmt.Errorf("Invalid cpuset mems: %s", config.CpusetMems)
+	}
+	if err := validateCpuQuota(config.CpuPeriod, config.CpuQuota); err != nil {
+		return "", err
+	}
+
+	if config.StopSignal != "" {
+		if _, err := parseSignal(config.StopSignal); err != nil {
+			return "", err
+		}
+	}
+	if config.StopTimeout < 0 {
+		return "", fmt.Errorf("Invalid stop timeout: %d", config.StopTimeout)
+	}
 
 	if config.Memory > 0 && !srv.runtime.capabilities.SwapLimit {
 		config.MemorySwap = -1
 	}
+	if (config.CpuPeriod != 0 || config.CpuQuota != 0) && !srv.runtime.capabilities.CpuCfsQuota {
+		config.CpuPeriod, config.CpuQuota = 0, 0
+	}
 	b := NewBuilder(srv.runtime)
-	container, err := b.Create(config)
+	container, err := b.create(config, hostConfig)
 	if err != nil {
 		if srv.runtime.graph.IsNotExist(err) {
 
@@ -886,7 +2218,13 @@ func (srv *Server) ContainerDestroy(name string, removeVolume bool) error {
 					log.Printf("The volume %s is used by the container %s. Impossible to remove it. Skipping.\n", volumeId, c.ID)
 					continue
 				}
-				if err := srv.runtime.volumes.Delete(volumeId); err != nil {
+				// Only the volumes docker created for the container: not
+				// the bind mounts, nor the named volumes
+				id := srv.runtime.volumeID(volumeId)
+				if id == "" {
+					continue
+				}
+				if err := srv.runtime.volumes.Delete(id); err != nil {
 					return err
 				}
 			}
@@ -960,30 +2298,38 @@ func (srv *Server) deleteImageParents(img *Image, imgs *[]APIRmi) error {
 func (srv *Server) deleteImage(img *Image, repoName, tag string) ([]APIRmi, error) {
 	imgs := []APIRmi{}
 
-	//If delete by id, see if the id belong only to one repository
+	// Deleting by id removes all the tags of the image, if they are all in
+	// one repository, and deleting by name only the tag of the name
+	var names []string
 	if strings.Contains(img.ID, repoName) && tag == "" {
-		for _, repoAndTag := range srv.runtime.repositories.ByID()[img.ID] {
-			parsedRepo, parsedTag := utils.ParseRepositoryTag(repoAndTag)
-			if strings.Contains(img.ID, repoName) {
-				repoName = parsedRepo
-				if len(srv.runtime.repositories.ByID()[img.ID]) == 1 && len(parsedTag) > 1 {
-					tag = parsedTag
-				}
-			} else if repoName != parsedRepo {
-				// the id belongs to multiple repos, like base:latest and user:test,
-				// in that case return conflict
-				return imgs, nil
+		names = srv.runtime.repositories.ByID()[img.ID]
+		for _, name := range names {
+			firstRepo, _ := utils.ParseRepositoryTag(names[0])
+			if parsedRepo, _ := utils.ParseRepositoryTag(name); parsedRepo != firstRepo {
+				// the id belongs to multiple repos, like base:latest and user:test
+				return nil, fmt.Errorf("Conflict, %s is tagged in several repositories (%s), remove the tags by name", img.ShortID(), strings.Join(names, ", "))
 			}
 		}
+	} else {
+		if tag == "" {
+			tag = DEFAULTTAG
+		}
+		if utils.IsDigest(tag) {
+			names = []string{repoName + "@" + tag}
+		} else {
+			names = []string{repoName + ":" + tag}
+		}
 	}
-	//Untag the current image
-	tagDeleted, err := srv.runtime.repositories.Delete(repoName, tag)
-	if err != nil {
-		return nil, err
-	}
-	if tagDeleted {
-		imgs = append(imgs, APIRmi{Untagged: img.ShortID()})
-		srv.LogEvent("untag", img.ShortID(), "")
+	for _, name := range names {
+		repoName, tag := utils.ParseRepositoryTag(name)
+		tagDeleted, err := srv.runtime.repositories.Delete(repoName, tag)
+		if err != nil {
+			return nil, err
+		}
+		if tagDeleted {
+			imgs = append(imgs, APIRmi{Untagged: img.ShortID()})
+			srv.LogEvent("untag", img.ShortID(), "")
+		}
 	}
 	if len(srv.runtime.repositories.ByID()[img.ID]) == 0 {
 		if err := srv.deleteImageAndChildren(img.ID, &imgs); err != nil {
@@ -1069,11 +2415,37 @@ func (srv *Server) ContainerStop(name string, t int) error {
 	return nil
 }
 
-func (srv *Server) ContainerWait(name string) (int, error) {
-	if container := srv.runtime.Get(name); container != nil {
-		return container.Wait(), nil
+func (srv *Server) ContainerStats(name string) (*ContainerStats, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	return container.Stats()
+}
+
+// ContainerWait blocks until the container meets condition: "not-running"
+// (the default), "next-exit" or "removed", and returns how it exited.
+func (srv *Server) ContainerWait(name, condition string) (*APIWait, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	var exitCode int
+	switch condition {
+	case "", "not-running":
+		exitCode = container.Wait()
+	case "next-exit":
+		exitCode = container.WaitNextExit()
+	case "removed":
+		exitCode = container.WaitRemoved()
+	default:
+		return nil, fmt.Errorf("Bad parameter: invalid condition %s (not-running, next-exit or removed)", condition)
 	}
-	return 0, fmt.Errorf("No such container: %s", name)
+	return &APIWait{
+		StatusCode: exitCode,
+		ExitSignal: container.State.ExitSignal,
+		OOMKilled:  container.State.OOMKilled,
+	}, nil
 }
 
 func (srv *Server) ContainerResize(name string, h, w int) error {
@@ -1083,12 +2455,34 @@ func (srv *Server) ContainerResize(name string, h, w int) error {
 	return fmt.Errorf("No such container: %s", name)
 }
 
-func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, stderr bool, in io.ReadCloser, out io.Writer) error {
+func (srv *Server) ContainerLogs(name string, config *LogsConfig, out io.Writer) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if !container.logsReadable() {
+		return fmt.Errorf("Impossible to read the logs of the container %s, its log driver doesn't keep them", container.ID)
+	}
+	return container.WriteLogs(config, out)
+}
+
+// Attach to the container, writing stdout on outStream and stderr on
+// errStream (e.g. the same writer, or the streams of a multiplexed stream).
+// With a tty, detachKeys on in detach from it (utils.DefaultDetachKeys if
+// nil).
+func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, stderr bool, detachKeys []byte, in io.ReadCloser, outStream, errStream io.Writer) error {
 	container := srv.runtime.Get(name)
 	if container == nil {
 		return fmt.Errorf("No such container: %s", name)
 	}
 	//logs
+	if logs && !container.logsReadable() {
+		if !stream {
+			return fmt.Errorf("Impossible to read the logs of the container %s, its log driver doesn't keep them", container.ID)
+		}
+		utils.Debugf("The logs of %s can't be read back, only streaming", container.ID)
+		logs = false
+	}
 	if logs {
 		cLog, err := container.ReadLog("json")
 		if err != nil && os.IsNotExist(err) {
@@ -1098,16 +2492,22 @@ func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, std
 				cLog, err := container.ReadLog("stdout")
 				if err != nil {
 					utils.Debugf("Error reading logs (stdout): %s", err)
-				} else if _, err := io.Copy(out, cLog); err != nil {
-					utils.Debugf("Error streaming logs (stdout): %s", err)
+				} else {
+					if _, err := io.Copy(outStream, cLog); err != nil {
+						utils.Debugf("Error streaming logs (stdout): %s", err)
+					}
+					cLog.Close()
 				}
 			}
 			if stderr {
 				cLog, err := container.ReadLog("stderr")
 				if err != nil {
 					utils.Debugf("Error reading logs (stderr): %s", err)
-				} else if _, err := io.Copy(out, cLog); err != nil {
-					utils.Debugf("Error streaming logs (stderr): %s", err)
+				} else {
+					if _, err := io.Copy(errStream, cLog); err != nil {
+						utils.Debugf("Error streaming logs (stderr): %s", err)
+					}
+					cLog.Close()
 				}
 			}
 		} else if err != nil {
@@ -1122,10 +2522,13 @@ func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, std
 					utils.Debugf("Error streaming logs: %s", err)
 					break
 				}
-				if (l.Stream == "stdout" && stdout) || (l.Stream == "stderr" && stderr) {
-					fmt.Fprintf(out, "%s", l.Log)
+				if l.Stream == "stdout" && stdout {
+					fmt.Fprintf(outStream, "%s", l.Log)
+				} else if l.Stream == "stderr" && stderr {
+					fmt.Fprintf(errStream, "%s", l.Log)
 				}
 			}
+			cLog.Close()
 		}
 	}
 
@@ -1152,13 +2555,13 @@ func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, std
 			cStdinCloser = in
 		}
 		if stdout {
-			cStdout = out
+			cStdout = outStream
 		}
 		if stderr {
-			cStderr = out
+			cStderr = errStream
 		}
 
-		<-container.Attach(cStdin, cStdinCloser, cStdout, cStderr)
+		<-container.Attach(cStdin, cStdinCloser, cStdout, cStderr, detachKeys)
 
 		// If we are in stdinonce mode, wait for the process to end
 		// otherwise, simply return
@@ -1169,6 +2572,70 @@ func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, std
 	return nil
 }
 
+func (srv *Server) ContainerExecCreate(name string, config *ExecConfig) (string, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return "", fmt.Errorf("No such container: %s", name)
+	}
+	e, err := srv.runtime.CreateExec(container, config)
+	if err != nil {
+		return "", err
+	}
+	return e.ID, nil
+}
+
+// Run the exec id, attached to the streams of its config, until it exits.
+// Without any stream attached, it runs in the background.
+func (srv *Server) ExecStart(id string, in io.ReadCloser, out io.Writer) error {
+	e := srv.runtime.GetExec(id)
+	if e == nil {
+		return fmt.Errorf("No such exec: %s", id)
+	}
+	var (
+		stdin          io.Reader
+		stdout, stderr io.Writer
+	)
+	if e.Config.AttachStdin {
+		stdin = in
+	}
+	if e.Config.AttachStdout {
+		stdout = out
+	}
+	if e.Config.AttachStderr {
+		stderr = out
+	}
+	if err := e.Start(stdin, stdout, stderr); err != nil {
+		return err
+	}
+	if stdin != nil || stdout != nil || stderr != nil {
+		e.Wait()
+	}
+	return nil
+}
+
+func (srv *Server) ExecResize(id string, h, w int) error {
+	if e := srv.runtime.GetExec(id); e != nil {
+		return e.Resize(h, w)
+	}
+	return fmt.Errorf("No such exec: %s", id)
+}
+
+func (srv *Server) ExecInspect(id string) (*APIExec, error) {
+	e := srv.runtime.GetExec(id)
+	if e == nil {
+		return nil, fmt.Errorf("No such exec: %s", id)
+	}
+	e.Lock()
+	defer e.Unlock()
+	return &APIExec{
+		ID:        e.ID,
+		Container: e.Container.ID,
+		Running:   e.Running,
+		ExitCode:  e.ExitCode,
+		Config:    e.Config,
+	}, nil
+}
+
 func (srv *Server) ContainerInspect(name string) (*Container, error) {
 	if container := srv.runtime.Get(name); container != nil {
 		return container, nil
@@ -1213,11 +2680,12 @@ func NewServer(flGraphPath string, autoRestart, enableCors bool, dns ListOpts) (
 		enableCors:  enableCors,
 		pullingPool: make(map[string]struct{}),
 		pushingPool: make(map[string]struct{}),
-		events:      make([]utils.JSONMessage, 0, 64), //only keeps the 64 last events
+		events:      make([]utils.JSONMessage, 0, eventsLimit),
 		listeners:   make(map[string]chan utils.JSONMessage),
 		reqFactory:  nil,
 	}
 	runtime.srv = srv
+	runtime.graph.fetchLayer = srv.fetchLazyLayer
 	return srv, nil
 }
 
@@ -1233,6 +2701,13 @@ func (srv *Server) HTTPRequestFactory() *utils.HTTPRequestFactory {
 func (srv *Server) LogEvent(action, id, from string) {
 	now := time.Now().Unix()
 	jm := utils.JSONMessage{Status: action, ID: id, From: from, Time: now}
+	srv.Lock()
+	defer srv.Unlock()
+	// Only keep the eventsLimit last events
+	if len(srv.events) >= eventsLimit {
+		copy(srv.events, srv.events[len(srv.events)-eventsLimit+1:])
+		srv.events = srv.events[:eventsLimit-1]
+	}
 	srv.events = append(srv.events, jm)
 	for _, c := range srv.listeners {
 		select { // non blocking channel
@@ -1248,7 +2723,13 @@ type Server struct {
 	enableCors  bool
 	pullingPool map[string]struct{}
 	pushingPool map[string]struct{}
+	downloads   map[string]chan struct{} // The download slots of the registries
 	events      []utils.JSONMessage
 	listeners   map[string]chan utils.JSONMessage
+	listenerID  int // The id of the last listener of the events
 	reqFactory  *utils.HTTPRequestFactory
+
+	// The repositories of the lazy pulls, the layers are fetched with their
+	// credentials
+	lazyRepositories map[string]*registry.V2Repository
 }
@@ -1,7 +1,12 @@
 package docker
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -13,7 +18,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 
 	srv := &Server{runtime: runtime}
 
-	initialImages, err := srv.Images(false, "")
+	initialImages, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -29,7 +34,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err := srv.Images(false, "")
+	images, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,7 +47,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,7 +60,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -68,7 +73,7 @@ func TestContainerTagImageDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -89,7 +94,7 @@ func TestCreateRm(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	id, err := srv.ContainerCreate(config)
+	id, err := srv.ContainerCreate(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -119,14 +124,35 @@ func TestCommit(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	id, err := srv.ContainerCreate(config)
+	id, err := srv.ContainerCreate(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if _, err := srv.ContainerCommit(id, "testrepo", "testtag", "", "", config); err != nil {
+	if _, err := srv.ContainerCommit(id, "testrepo", "testtag", "", "", config, nil); err != nil {
 		t.Fatal(err)
 	}
+
+	// The changes apply to the config of the container
+	container := runtime.Get(id)
+	container.Config.Env = []string{"PATH=/bin", "X=0"}
+	imageID, err := srv.ContainerCommit(id, "", "", "", "", nil, []string{"ENV X=1", "LABEL committed=yes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := runtime.repositories.LookupImage(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Config.Cmd) != 1 || img.Config.Cmd[0] != "/bin/cat" {
+		t.Fatalf("Expected the Cmd of the container, %v found", img.Config.Cmd)
+	}
+	if strings.Join(img.Config.Env, " ") != "PATH=/bin X=1" || img.Config.Labels["committed"] != "yes" {
+		t.Fatalf("Expected the changes applied to the config of the container, %v %v found", img.Config.Env, img.Config.Labels)
+	}
+	if container.Config.Env[1] != "X=0" || container.Config.Labels["committed"] != "" {
+		t.Fatalf("The config of the container shouldn't change: %v %v", container.Config.Env, container.Config.Labels)
+	}
 }
 
 func TestCreateStartRestartStopStartKillRm(t *testing.T) {
@@ -140,7 +166,7 @@ func TestCreateStartRestartStopStartKillRm(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	id, err := srv.ContainerCreate(config)
+	id, err := srv.ContainerCreate(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -198,6 +224,7 @@ func TestRunWithTooLowMemoryLimit(t *testing.T) {
 			CpuShares: 1000,
 			Cmd:       []string{"/bin/cat"},
 		},
+		nil,
 	)
 	if err == nil {
 		t.Errorf("Memory limit is smaller than the allowed limit. Container creation should've failed!")
@@ -347,12 +374,28 @@ func TestLogEvent(t *testing.T) {
 	})
 }
 
+func TestLogEventLimit(t *testing.T) {
+	srv := &Server{
+		events:    make([]utils.JSONMessage, 0, eventsLimit),
+		listeners: make(map[string]chan utils.JSONMessage),
+	}
+	for i := 0; i < eventsLimit+10; i++ {
+		srv.LogEvent(fmt.Sprintf("fakeaction%d", i), "fakeid", "fakeimage")
+	}
+	if len(srv.events) != eventsLimit {
+		t.Fatalf("Expected %d events, found %d", eventsLimit, len(srv.events))
+	}
+	if srv.events[0].Status != "fakeaction10" || srv.events[eventsLimit-1].Status != fmt.Sprintf("fakeaction%d", eventsLimit+9) {
+		t.Fatalf("Expected the last %d events, found %s to %s", eventsLimit, srv.events[0].Status, srv.events[eventsLimit-1].Status)
+	}
+}
+
 func TestRmi(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
 	srv := &Server{runtime: runtime}
 
-	initialImages, err := srv.Images(false, "")
+	initialImages, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -362,7 +405,7 @@ func TestRmi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	containerID, err := srv.ContainerCreate(config)
+	containerID, err := srv.ContainerCreate(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -373,7 +416,7 @@ func TestRmi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	imageID, err := srv.ContainerCommit(containerID, "test", "", "", "", nil)
+	imageID, err := srv.ContainerCommit(containerID, "test", "", "", "", nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -383,7 +426,7 @@ func TestRmi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	containerID, err = srv.ContainerCreate(config)
+	containerID, err = srv.ContainerCreate(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -394,12 +437,12 @@ func TestRmi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = srv.ContainerCommit(containerID, "test", "", "", "", nil)
+	_, err = srv.ContainerCommit(containerID, "test", "", "", "", nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	images, err := srv.Images(false, "")
+	images, err := srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -413,7 +456,7 @@ func TestRmi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	images, err = srv.Images(false, "")
+	images, err = srv.Images(false, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -431,3 +474,379 @@ func TestRmi(t *testing.T) {
 		}
 	}
 }
+
+func TestImageSaveLoad(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	config, hostConfig, _, err := ParseRun([]string{GetTestImage(runtime).ID, "touch", "/saved"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerID, err := srv.ContainerCreate(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerStart(containerID, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	runtime.Get(containerID).Wait()
+	imageID, err := srv.ContainerCommit(containerID, "testsave", "", "", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := runtime.repositories.LookupImage(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerDestroy(containerID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := bytes.NewBuffer(nil)
+	if err := srv.ImageSave("testsave", archive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ImageDelete("testsave", true); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.graph.Exists(img.ID) {
+		t.Fatalf("Image %s should have been deleted", img.ID)
+	}
+
+	if err := srv.ImageLoad(archive); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := runtime.repositories.GetImage("testsave", DEFAULTTAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded == nil || loaded.ID != img.ID {
+		t.Fatalf("Expected testsave:%s to be %s, got %v", DEFAULTTAG, img.ID, loaded)
+	}
+	if loaded.Parent != GetTestImage(runtime).ID {
+		t.Errorf("Expected the parent %s, got %s", GetTestImage(runtime).ID, loaded.Parent)
+	}
+	changes, err := runtime.graph.driver.Changes(loaded.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, change := range changes {
+		found = found || change.Path == "/saved"
+	}
+	if !found {
+		t.Errorf("The layer of the loaded image should have /saved, got %v", changes)
+	}
+}
+
+func TestImageLoadParentCycle(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	root, err := ioutil.TempDir("", "docker-test-load-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	a, b := GenerateID(), GenerateID()
+	for id, parent := range map[string]string{a: b, b: a} {
+		if err := os.Mkdir(path.Join(root, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		jsonData := fmt.Sprintf(`{"id":%q,"parent":%q}`, id, parent)
+		if err := ioutil.WriteFile(path.Join(root, id, "json"), []byte(jsonData), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.loadImage(root, a); err == nil {
+		t.Fatal("Expected an error for images which are their own parents")
+	}
+	if runtime.graph.Exists(a) || runtime.graph.Exists(b) {
+		t.Fatal("Expected no image to be loaded")
+	}
+}
+
+func TestImageImportChanges(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	config := &Config{}
+	if err := applyChanges(config, []string{`CMD ["/bin/true"]`, "ENV MODE imported"}); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ImageImport("-", "testimport", "", config, archive, ioutil.Discard, utils.NewStreamFormatter(false)); err != nil {
+		t.Fatal(err)
+	}
+	img, err := runtime.repositories.LookupImage("testimport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Parent != "" {
+		t.Errorf("The imported image shouldn't have a parent, got %s", img.Parent)
+	}
+	if img.Config == nil || len(img.Config.Cmd) != 1 || img.Config.Cmd[0] != "/bin/true" {
+		t.Fatalf("Expected the Cmd [/bin/true], got %v", img.Config)
+	}
+	if len(img.Config.Env) != 1 || img.Config.Env[0] != "MODE=imported" {
+		t.Errorf("Expected the Env [MODE=imported], got %v", img.Config.Env)
+	}
+}
+
+func TestImageDeleteUntags(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := runtime.graph.Create(archive, nil, "Testing", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"tag1", "tag2"} {
+		if err := srv.ContainerTag(img.ID, "utest", tag, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.ContainerTag(unitTestImageName, "utest", "other", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The image keeps its other tag
+	if _, err := srv.ImageDelete("utest:tag1", true); err != nil {
+		t.Fatal(err)
+	}
+	if !runtime.graph.Exists(img.ID) {
+		t.Fatalf("The image is still tagged utest:tag2, it shouldn't be deleted")
+	}
+
+	// Deleting by id removes its tags but not the other ones of the repository
+	if _, err := srv.ImageDelete(img.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.graph.Exists(img.ID) {
+		t.Fatalf("The image should be deleted")
+	}
+	if other, err := runtime.repositories.GetImage("utest", "other"); err != nil {
+		t.Fatal(err)
+	} else if other == nil {
+		t.Fatalf("utest:other shouldn't be deleted")
+	}
+
+	// An id tagged in several repositories is only deleted by name
+	if err := srv.ContainerTag(unitTestImageName, "utest2", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ImageDelete(unitTestImageID, true); err == nil {
+		t.Fatalf("Deleting an image tagged in several repositories by id should fail")
+	}
+}
+
+func TestImagesDanglingPrune(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := runtime.graph.Create(archive, nil, "Testing", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err = fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := &Image{ID: GenerateID(), Parent: parent.ID, Created: time.Now()}
+	if err := runtime.graph.Register(nil, archive, child); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the head is dangling, its parent is a layer of it
+	images, err := srv.Images(true, "", ImageFilters{"dangling": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != child.ID {
+		t.Fatalf("Expected the dangling image %s, got %v", child.ID, images)
+	}
+	images, err = srv.Images(false, "", ImageFilters{"dangling": {"false"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range images {
+		if image.ID == child.ID {
+			t.Fatalf("The dangling image %s shouldn't be listed", child.ID)
+		}
+	}
+
+	pruned, err := srv.ImagesPrune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned.ImagesDeleted) != 2 {
+		t.Fatalf("Expected the image and its parent to be deleted, got %v", pruned.ImagesDeleted)
+	}
+	if pruned.SpaceReclaimed != parent.Size+child.Size {
+		t.Errorf("Expected %d bytes reclaimed, got %d", parent.Size+child.Size, pruned.SpaceReclaimed)
+	}
+	if runtime.graph.Exists(parent.ID) || runtime.graph.Exists(child.ID) {
+		t.Errorf("The dangling images should be deleted")
+	}
+	if !runtime.graph.Exists(GetTestImage(runtime).ID) {
+		t.Errorf("The tagged test image shouldn't be deleted")
+	}
+}
+
+func TestSystemDF(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dangling, err := runtime.graph.Create(archive, nil, "Testing", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, _, err := ParseRun([]string{GetTestImage(runtime).ID, "echo test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ContainerCreate(config, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	df, err := srv.SystemDF(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := make(map[string]APIDiskUsage)
+	for _, u := range df.Usage {
+		usage[u.Type] = u
+	}
+	if images := usage["Images"]; images.Total < 1 || images.Active < 1 {
+		t.Errorf("Expected the active test image, got %v", images)
+	}
+	if containers := usage["Containers"]; containers.Total != 1 || containers.Active != 0 {
+		t.Errorf("Expected a stopped container, got %v", containers)
+	}
+	if cache := usage["Build Cache"]; cache.Total != 1 || cache.Size != dangling.Size || cache.Reclaimable != dangling.Size {
+		t.Errorf("Expected the dangling image in the build cache, got %v", cache)
+	}
+	found := false
+	for _, object := range df.Objects {
+		if object.Type == "Build Cache" && object.ID == dangling.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the dangling image %s in the objects, got %v", dangling.ID, df.Objects)
+	}
+}
+
+func TestManifestList(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	if _, err := srv.ManifestListCreate("localhost:5000/app", []string{"localhost:5000/other:arm64"}, false); err == nil {
+		t.Fatalf("The images of another repository shouldn't be part of the manifest list")
+	}
+	list, err := srv.ManifestListCreate("localhost:5000/app", []string{"localhost:5000/app:amd64", "localhost:5000/app:arm64"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Name != "localhost:5000/app:latest" || len(list.Manifests) != 2 {
+		t.Fatalf("Unexpected manifest list %v", list)
+	}
+	if _, err := srv.ManifestListCreate("localhost:5000/app:latest", []string{"localhost:5000/app:arm"}, false); err == nil {
+		t.Fatalf("Creating a manifest list again without amend should fail")
+	}
+	if _, err := srv.ManifestListCreate("localhost:5000/app:latest", []string{"localhost:5000/app:arm", "localhost:5000/app:amd64"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.ManifestListAnnotate("localhost:5000/app", "localhost:5000/app:arm", "armhf", "linux", "v7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ManifestListAnnotate("localhost:5000/app", "localhost:5000/app:s390x", "s390x", "", ""); err == nil {
+		t.Fatalf("Annotating an image which isn't part of the manifest list should fail")
+	}
+
+	// The manifest lists are kept until they're pushed
+	if err := runtime.manifestLists.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	list, err = srv.ManifestListInspect("localhost:5000/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Manifests) != 3 {
+		t.Fatalf("Expected 3 images in the manifest list, got %d", len(list.Manifests))
+	}
+	if entry := list.Manifests[2]; entry.Image != "localhost:5000/app:arm" || entry.Architecture != "arm" || entry.OS != "linux" || entry.Variant != "v7" {
+		t.Fatalf("Unexpected annotated image %v", entry)
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	if _, err := parseSearchFilters(`{"stars":["many"]}`); err == nil {
+		t.Fatal("Expected an invalid stars filter to fail")
+	}
+	if _, err := parseSearchFilters(`{"is-trusted":["true"]}`); err == nil {
+		t.Fatal("Expected an unknown filter to fail")
+	}
+	filters, err := parseSearchFilters(`{"is-official":["true"],"stars":["10"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filters.match(&APISearch{Name: "busybox", StarCount: 42, IsOfficial: true}) {
+		t.Fatal("Expected an official image with 42 stars to match")
+	}
+	if filters.match(&APISearch{Name: "base", StarCount: 3, IsOfficial: true}) {
+		t.Fatal("Expected an image with 3 stars not to match")
+	}
+	if filters.match(&APISearch{Name: "user/busybox", StarCount: 42}) {
+		t.Fatal("Expected an image which isn't official not to match")
+	}
+}
+
+func TestRegisterDownloadsCanceled(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	// The download still running when another fails is canceled, and waited
+	// for
+	stopped := false
+	err := srv.registerDownloads([]string{"failed", "running"}, func(id string, cancel chan struct{}) *imageDownload {
+		if id == "failed" {
+			return &imageDownload{err: fmt.Errorf("Failed download")}
+		}
+		<-cancel
+		stopped = true
+		return &imageDownload{err: fmt.Errorf("Canceled download")}
+	})
+	if err == nil || err.Error() != "Failed download" {
+		t.Fatalf("Expected the error of the failed download, got %v", err)
+	}
+	if !stopped {
+		t.Fatal("The running download should have stopped before the pull returns")
+	}
+}
@@ -14,6 +14,11 @@ type State struct {
 	ExitCode  int
 	StartedAt time.Time
 	Ghost     bool
+	Paused    bool    // All the processes are frozen by docker pause
+	Health    *Health // The result of the health check of the container, if it has one
+
+	ExitSignal int  // The signal which killed the process, 0 if it exited on its own
+	OOMKilled  bool // Whether the kernel killed a process of the container as it was out of memory
 }
 
 // String returns a human-readable description of the state
@@ -22,21 +27,34 @@ func (s *State) String() string {
 		if s.Ghost {
 			return fmt.Sprintf("Ghost")
 		}
+		if s.Paused {
+			return fmt.Sprintf("Up %s (Paused)", utils.HumanDuration(time.Now().Sub(s.StartedAt)))
+		}
+		if s.Health != nil {
+			return fmt.Sprintf("Up %s (%s)", utils.HumanDuration(time.Now().Sub(s.StartedAt)), s.Health.Status)
+		}
 		return fmt.Sprintf("Up %s", utils.HumanDuration(time.Now().Sub(s.StartedAt)))
 	}
+	if s.OOMKilled {
+		return fmt.Sprintf("Exit %d (OOM killed)", s.ExitCode)
+	}
 	return fmt.Sprintf("Exit %d", s.ExitCode)
 }
 
 func (s *State) setRunning(pid int) {
 	s.Running = true
 	s.Ghost = false
+	s.Paused = false
 	s.ExitCode = 0
+	s.ExitSignal = 0
+	s.OOMKilled = false
 	s.Pid = pid
 	s.StartedAt = time.Now()
 }
 
 func (s *State) setStopped(exitCode int) {
 	s.Running = false
+	s.Paused = false
 	s.Pid = 0
 	s.ExitCode = exitCode
 }
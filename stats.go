@@ -0,0 +1,235 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The clock ticks per second of /proc/stat (USER_HZ)
+const clockTicks = 100
+
+// ContainerStats is a sample of the resources used by a running container,
+// read from its cgroups and from the network devices of its namespace.
+type ContainerStats struct {
+	Read     time.Time
+	CPU      CPUStats
+	PreCPU   CPUStats // The CPU stats of the previous sample, to compute the CPU percentage
+	Memory   MemoryStats
+	Blkio    BlkioStats
+	Networks map[string]*NetworkStats // By interface of the container
+}
+
+type CPUStats struct {
+	TotalUsage  uint64   // CPU time used by the container since it started, in nanoseconds
+	PercpuUsage []uint64 // The same, per CPU of the host
+	SystemUsage uint64   // CPU time used by the host since it booted, in nanoseconds
+}
+
+type MemoryStats struct {
+	Usage    uint64 // In bytes, including the page cache
+	MaxUsage uint64
+	Limit    uint64
+}
+
+type BlkioStats struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+type NetworkStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDropped uint64
+}
+
+// CPUPercent returns the share of the CPUs of the host the container used
+// since the previous sample, 100% per CPU.
+func (stats *ContainerStats) CPUPercent() float64 {
+	if stats.CPU.SystemUsage <= stats.PreCPU.SystemUsage || stats.CPU.TotalUsage < stats.PreCPU.TotalUsage {
+		return 0
+	}
+	container := float64(stats.CPU.TotalUsage - stats.PreCPU.TotalUsage)
+	system := float64(stats.CPU.SystemUsage - stats.PreCPU.SystemUsage)
+	return container / system * float64(len(stats.CPU.PercpuUsage)) * 100
+}
+
+// Stats samples the resources used by the container
+func (container *Container) Stats() (*ContainerStats, error) {
+	if !container.State.Running {
+		return nil, fmt.Errorf("Impossible to get the stats of the container %s, it's not running", container.ID)
+	}
+	stats := &ContainerStats{Read: time.Now()}
+
+	cpuacct, err := cgroupPath("cpuacct", container.CgroupParent, container.ID)
+	if err != nil {
+		return nil, err
+	}
+	if stats.CPU.TotalUsage, err = readCgroupUint(cpuacct, "cpuacct.usage"); err != nil {
+		return nil, err
+	}
+	percpu, err := ioutil.ReadFile(path.Join(cpuacct, "cpuacct.usage_percpu"))
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range strings.Fields(string(percpu)) {
+		usage, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cpuacct.usage_percpu: %s", percpu)
+		}
+		stats.CPU.PercpuUsage = append(stats.CPU.PercpuUsage, usage)
+	}
+	if stats.CPU.SystemUsage, err = systemCPUUsage(); err != nil {
+		return nil, err
+	}
+
+	memory, err := cgroupPath("memory", container.CgroupParent, container.ID)
+	if err != nil {
+		return nil, err
+	}
+	for file, value := range map[string]*uint64{
+		"memory.usage_in_bytes":     &stats.Memory.Usage,
+		"memory.max_usage_in_bytes": &stats.Memory.MaxUsage,
+		"memory.limit_in_bytes":     &stats.Memory.Limit,
+	} {
+		if *value, err = readCgroupUint(memory, file); err != nil {
+			return nil, err
+		}
+	}
+
+	// The blkio cgroup isn't always mounted
+	if blkio, err := cgroupPath("blkio", container.CgroupParent, container.ID); err == nil {
+		if stats.Blkio, err = readBlkioStats(blkio); err != nil {
+			return nil, err
+		}
+	}
+
+	// Any process of the container is in its network namespace
+	tasks, err := ioutil.ReadFile(path.Join(cpuacct, "tasks"))
+	if err != nil {
+		return nil, err
+	}
+	pids := strings.Fields(string(tasks))
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("Impossible to get the stats of the container %s, it has no process", container.ID)
+	}
+	if stats.Networks, err = readNetworkStats(path.Join("/proc", pids[0], "net/dev")); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func readCgroupUint(dir, file string) (uint64, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %s", file, data)
+	}
+	return value, nil
+}
+
+// The CPU time used by the host, from the first line of /proc/stat:
+// cpu  user nice system idle iowait irq softirq ...
+func systemCPUUsage() (uint64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 8 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("Invalid /proc/stat: %s", line)
+	}
+	var ticks uint64
+	for _, field := range fields[1:8] {
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid /proc/stat: %s", line)
+		}
+		ticks += n
+	}
+	return ticks * uint64(time.Second) / clockTicks, nil
+}
+
+// Sum the bytes read and written on all the devices:
+// 8:0 Read 1024
+// 8:0 Write 2048
+func readBlkioStats(dir string) (BlkioStats, error) {
+	var stats BlkioStats
+	data, err := ioutil.ReadFile(path.Join(dir, "blkio.throttle.io_service_bytes"))
+	if err != nil {
+		return stats, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return stats, fmt.Errorf("Invalid blkio.throttle.io_service_bytes: %s", line)
+		}
+		switch fields[1] {
+		case "Read":
+			stats.ReadBytes += n
+		case "Write":
+			stats.WriteBytes += n
+		}
+	}
+	return stats, nil
+}
+
+// The counters of the network devices, but the loopback, of /proc/PID/net/dev:
+//   eth0: rx_bytes rx_packets rx_errs rx_drop fifo frame compressed multicast tx_bytes tx_packets tx_errs tx_drop ...
+func readNetworkStats(file string) (map[string]*NetworkStats, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	networks := make(map[string]*NetworkStats)
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		iface := strings.TrimSpace(parts[0])
+		fields := strings.Fields(parts[1])
+		if iface == "lo" || len(fields) < 12 {
+			continue
+		}
+		var counters [12]uint64
+		for i := range counters {
+			if counters[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("Invalid %s: %s", file, line)
+			}
+		}
+		networks[iface] = &NetworkStats{
+			RxBytes:   counters[0],
+			RxPackets: counters[1],
+			RxErrors:  counters[2],
+			RxDropped: counters[3],
+			TxBytes:   counters[8],
+			TxPackets: counters[9],
+			TxErrors:  counters[10],
+			TxDropped: counters[11],
+		}
+	}
+	return networks, nil
+}
@@ -4,12 +4,15 @@ import (
 	"flag"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // Setup networking
@@ -22,6 +25,64 @@ func setupNetworking(gw string) {
 	}
 }
 
+// Wait for the daemon to move the process into the cgroups of the container
+// under its cgroup parent, before its program runs
+func waitCgroup(cgroup string) {
+	if cgroup == "" {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		procCgroup, err := ioutil.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			log.Fatalf("Unable to read the cgroups of the process: %v", err)
+		}
+		if inCgroup(string(procCgroup), cgroup) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Fatalf("The process was not moved into the cgroup %s", cgroup)
+}
+
+// Set the kernel parameters of the network namespace of the container
+func setupSysctls(sysctls ListOpts) {
+	for _, sysctl := range sysctls {
+		key, value, err := parseSysctl(sysctl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p := path.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
+		if err := ioutil.WriteFile(p, []byte(value), 0644); err != nil {
+			log.Fatalf("Unable to set %s: %v", key, err)
+		}
+	}
+}
+
+// Set the resource limits of the process, its program inherits them. The
+// hard limits can't go above the ones of the daemon without SYS_RESOURCE.
+func setupUlimits(ulimits ListOpts) {
+	for _, spec := range ulimits {
+		ulimit, err := parseUlimit(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := setRlimit(ulimit); err != nil {
+			log.Fatalf("Unable to set the ulimit %s: %v", spec, err)
+		}
+	}
+}
+
+// Set how readily the kernel kills the process, and its program, when the
+// host is out of memory. It can't be lowered without SYS_RESOURCE.
+func setupOomScoreAdj(adj int) {
+	if adj == 0 {
+		return
+	}
+	if err := ioutil.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(adj)), 0644); err != nil {
+		log.Fatalf("Unable to set the oom_score_adj %d: %v", adj, err)
+	}
+}
+
 // Setup working directory
 func setupWorkingDirectory(workdir string) {
 	if workdir == "" {
@@ -70,6 +131,25 @@ func cleanupEnv(env ListOpts) {
 	}
 }
 
+// Restrict the syscalls of the process with the seccomp profile, the last
+// thing before it executes the program
+func setupSeccomp(profilePath string) {
+	if profilePath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(profilePath)
+	if err != nil {
+		log.Fatalf("Unable to read the seccomp profile: %v", err)
+	}
+	profile, err := parseSeccompProfile(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := applySeccomp(profile); err != nil {
+		log.Fatalf("Unable to apply the seccomp profile: %v", err)
+	}
+}
+
 func executeProgram(name string, args []string) {
 	path, err := exec.LookPath(name)
 	if err != nil {
@@ -93,15 +173,30 @@ func SysInit() {
 	var u = flag.String("u", "", "username or uid")
 	var gw = flag.String("g", "", "gateway address")
 	var workdir = flag.String("w", "", "workdir")
+	var seccomp = flag.String("seccomp", "", "seccomp profile")
+	var cgroup = flag.String("cgroup", "", "cgroup under the cgroup parent")
 
 	var flEnv ListOpts
 	flag.Var(&flEnv, "e", "Set environment variables")
 
+	var flSysctls ListOpts
+	flag.Var(&flSysctls, "sysctl", "Set kernel parameters")
+
+	var flUlimits ListOpts
+	flag.Var(&flUlimits, "ulimit", "Set resource limits")
+
+	var oomScoreAdj = flag.Int("oom-score-adj", 0, "Adjust the OOM score")
+
 	flag.Parse()
 
 	cleanupEnv(flEnv)
+	waitCgroup(*cgroup)
 	setupNetworking(*gw)
+	setupSysctls(flSysctls)
+	setupUlimits(flUlimits)
+	setupOomScoreAdj(*oomScoreAdj)
 	setupWorkingDirectory(*workdir)
 	changeUser(*u)
+	setupSeccomp(*seccomp)
 	executeProgram(flag.Arg(0), flag.Args())
 }
@@ -17,6 +17,9 @@ type TagStore struct {
 	path         string
 	graph        *Graph
 	Repositories map[string]Repository
+	// The images pulled or pushed with a manifest, by the digest of the
+	// manifest in each repository: repo@sha256:... always refers to them
+	Digests map[string]Repository
 }
 
 type Repository map[string]string
@@ -30,6 +33,7 @@ func NewTagStore(path string, graph *Graph) (*TagStore, error) {
 		path:         abspath,
 		graph:        graph,
 		Repositories: make(map[string]Repository),
+		Digests:      make(map[string]Repository),
 	}
 	// Load the json file if it exists, otherwise create it.
 	if err := store.Reload(); os.IsNotExist(err) {
@@ -48,7 +52,23 @@ func (store *TagStore) Save() error {
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(store.path, jsonData, 0600); err != nil {
+	// Write it next to the store and rename it over, so that a crash never
+	// leaves a truncated store behind
+	tmp, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(jsonData); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), store.path); err != nil {
+		os.Remove(tmp.Name())
 		return err
 	}
 	return nil
@@ -86,23 +106,44 @@ func (store *TagStore) LookupImage(name string) (*Image, error) {
 }
 
 // Return a reverse-lookup table of all the names which refer to each image
-// Eg. {"43b5f19b10584": {"base:latest", "base:v1"}}
+// Eg. {"43b5f19b10584": {"base:latest", "base:v1", "base@sha256:9f86d..."}}
 func (store *TagStore) ByID() map[string][]string {
 	byID := make(map[string][]string)
+	add := func(id, name string) {
+		if _, exists := byID[id]; !exists {
+			byID[id] = []string{name}
+		} else {
+			byID[id] = append(byID[id], name)
+			sort.Strings(byID[id])
+		}
+	}
 	for repoName, repository := range store.Repositories {
 		for tag, id := range repository {
-			name := repoName + ":" + tag
-			if _, exists := byID[id]; !exists {
-				byID[id] = []string{name}
-			} else {
-				byID[id] = append(byID[id], name)
-				sort.Strings(byID[id])
-			}
+			add(id, repoName+":"+tag)
+		}
+	}
+	for repoName, digests := range store.Digests {
+		for digest, id := range digests {
+			add(id, repoName+"@"+digest)
 		}
 	}
 	return byID
 }
 
+// RepoDigests returns the repo@digest names of the image id
+func (store *TagStore) RepoDigests(id string) []string {
+	digests := []string{}
+	for repoName, repository := range store.Digests {
+		for digest, digestID := range repository {
+			if digestID == id {
+				digests = append(digests, repoName+"@"+digest)
+			}
+		}
+	}
+	sort.Strings(digests)
+	return digests
+}
+
 func (store *TagStore) ImageName(id string) string {
 	if names, exists := store.ByID()[id]; exists && len(names) > 0 {
 		return names[0]
@@ -116,15 +157,9 @@ func (store *TagStore) DeleteAll(id string) error {
 		return nil
 	}
 	for _, name := range names {
-		if strings.Contains(name, ":") {
-			nameParts := strings.Split(name, ":")
-			if _, err := store.Delete(nameParts[0], nameParts[1]); err != nil {
-				return err
-			}
-		} else {
-			if _, err := store.Delete(name, ""); err != nil {
-				return err
-			}
+		repoName, tag := utils.ParseRepositoryTag(name)
+		if _, err := store.Delete(repoName, tag); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -135,6 +170,20 @@ func (store *TagStore) Delete(repoName, tag string) (bool, error) {
 	if err := store.Reload(); err != nil {
 		return false, err
 	}
+	if utils.IsDigest(tag) {
+		if _, exists := store.Digests[repoName][tag]; !exists {
+			return false, fmt.Errorf("No such digest: %s@%s", repoName, tag)
+		}
+		delete(store.Digests[repoName], tag)
+		if len(store.Digests[repoName]) == 0 {
+			delete(store.Digests, repoName)
+		}
+		return true, store.Save()
+	}
+	if _, exists := store.Digests[repoName]; exists && tag == "" {
+		delete(store.Digests, repoName)
+		deleted = true
+	}
 	if r, exists := store.Repositories[repoName]; exists {
 		if tag != "" {
 			if _, exists2 := r[tag]; exists2 {
@@ -150,8 +199,8 @@ func (store *TagStore) Delete(repoName, tag string) (bool, error) {
 			delete(store.Repositories, repoName)
 			deleted = true
 		}
-	} else {
-		fmt.Errorf("No such repository: %s", repoName)
+	} else if !deleted {
+		return false, fmt.Errorf("No such repository: %s", repoName)
 	}
 	return deleted, store.Save()
 }
@@ -176,17 +225,41 @@ func (store *TagStore) Set(repoName, tag, imageName string, force bool) error {
 	var repo Repository
 	if r, exists := store.Repositories[repoName]; exists {
 		repo = r
+		if old, exists := repo[tag]; exists && old != img.ID && !force {
+			return fmt.Errorf("Conflict: Tag %s:%s is already set to %s", repoName, tag, utils.TruncateID(old))
+		}
 	} else {
 		repo = make(map[string]string)
-		if old, exists := store.Repositories[repoName]; exists && !force {
-			return fmt.Errorf("Conflict: Tag %s:%s is already set to %s", repoName, tag, old)
-		}
 		store.Repositories[repoName] = repo
 	}
 	repo[tag] = img.ID
 	return store.Save()
 }
 
+// SetDigest records that repoName@digest is the image id
+func (store *TagStore) SetDigest(repoName, digest, id string) error {
+	if !utils.IsDigest(digest) {
+		return fmt.Errorf("Invalid digest: %s", digest)
+	}
+	if err := validateRepoName(repoName); err != nil {
+		return err
+	}
+	if !store.graph.Exists(id) {
+		return fmt.Errorf("No such image: %s", id)
+	}
+	if err := store.Reload(); err != nil {
+		return err
+	}
+	if store.Digests == nil {
+		store.Digests = make(map[string]Repository)
+	}
+	if _, exists := store.Digests[repoName]; !exists {
+		store.Digests[repoName] = make(map[string]string)
+	}
+	store.Digests[repoName][digest] = id
+	return store.Save()
+}
+
 func (store *TagStore) Get(repoName string) (Repository, error) {
 	if err := store.Reload(); err != nil {
 		return nil, err
@@ -198,6 +271,16 @@ func (store *TagStore) Get(repoName string) (Repository, error) {
 }
 
 func (store *TagStore) GetImage(repoName, tagOrID string) (*Image, error) {
+	// A digest only refers to the image its manifest describes
+	if utils.IsDigest(tagOrID) {
+		if err := store.Reload(); err != nil {
+			return nil, err
+		}
+		if id, exists := store.Digests[repoName][tagOrID]; exists {
+			return store.graph.Get(id)
+		}
+		return nil, nil
+	}
 	repo, err := store.Get(repoName)
 	if err != nil {
 		return nil, err
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -44,3 +45,83 @@ func TestLookupImage(t *testing.T) {
 		t.Errorf("Expected 1 image, none found")
 	}
 }
+
+func TestSetTagConflict(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := runtime.graph.Create(archive, nil, "Testing", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runtime.repositories.Set("utest", "tag1", unitTestImageName, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.repositories.Set("utest", "tag2", unitTestImageName, false); err != nil {
+		t.Fatal(err)
+	}
+	// Setting a tag again to the same image isn't a conflict
+	if err := runtime.repositories.Set("utest", "tag1", unitTestImageName, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.repositories.Set("utest", "tag1", img.ID, false); err == nil {
+		t.Fatalf("Moving a tag to another image without force should fail")
+	}
+	if err := runtime.repositories.Set("utest", "tag1", img.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store is saved and reloaded with both images
+	if err := runtime.repositories.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if tagged, err := runtime.repositories.GetImage("utest", "tag1"); err != nil {
+		t.Fatal(err)
+	} else if tagged == nil || tagged.ID != img.ID {
+		t.Errorf("Expected utest:tag1 to be %s, got %v", img.ID, tagged)
+	}
+	if tagged, err := runtime.repositories.GetImage("utest", "tag2"); err != nil {
+		t.Fatal(err)
+	} else if tagged == nil || tagged.ID != GetTestImage(runtime).ID {
+		t.Errorf("Expected utest:tag2 to be %s, got %v", GetTestImage(runtime).ID, tagged)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	digest := "sha256:" + strings.Repeat("4a", 32)
+	if err := runtime.repositories.SetDigest("utest", "latest", unitTestImageID); err == nil {
+		t.Fatalf("A tag shouldn't be a valid digest")
+	}
+	if err := runtime.repositories.SetDigest("utest", digest, unitTestImageID); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := runtime.repositories.LookupImage("utest@" + digest); err != nil {
+		t.Fatal(err)
+	} else if img.ID != unitTestImageID {
+		t.Errorf("Expected utest@%s to be %s, got %s", digest, unitTestImageID, img.ID)
+	}
+	if _, err := runtime.repositories.LookupImage("utest@sha256:" + strings.Repeat("00", 32)); err == nil {
+		t.Errorf("Expected error, none found")
+	}
+	if digests := runtime.repositories.RepoDigests(unitTestImageID); len(digests) != 1 || digests[0] != "utest@"+digest {
+		t.Errorf("Expected the digest utest@%s, got %v", digest, digests)
+	}
+
+	if _, err := runtime.repositories.Delete("utest", digest); err != nil {
+		t.Fatal(err)
+	}
+	if digests := runtime.repositories.RepoDigests(unitTestImageID); len(digests) != 0 {
+		t.Errorf("Expected no digest, got %v", digests)
+	}
+	if _, err := runtime.repositories.Delete("nonexistent", ""); err == nil {
+		t.Errorf("Expected an error for a repository which doesn't exist")
+	}
+}
@@ -0,0 +1,83 @@
+package docker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// The certificates of the TLS of the remote API on tcp, with -tls or
+// -tlsverify. The client looks for them in ~/.docker by default.
+const (
+	DEFAULTTLSCACERT = "ca.pem"
+	DEFAULTTLSCERT   = "cert.pem"
+	DEFAULTTLSKEY    = "key.pem"
+)
+
+type TLSOptions struct {
+	CACert string
+	Cert   string
+	Key    string
+	// Verify the certificate of the other side with CACert: the daemon
+	// requires the clients to present one signed by it
+	Verify bool
+}
+
+// The TLS config of the daemon, which presents Cert
+func ServerTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TLS certificate %s: %s", opts.Cert, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.Verify {
+		pool, err := loadCACert(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// The TLS config of the client, which presents Cert if it exists. Without
+// Verify, it accepts any certificate of the daemon.
+func ClientTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: !opts.Verify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if opts.Verify {
+		pool, err := loadCACert(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if _, err := os.Stat(opts.Cert); err == nil {
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TLS certificate %s: %s", opts.Cert, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCACert(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Invalid CA certificate %s: no certificate", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,91 @@
+package docker
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// The options of the tmpfs which don't override them: the scratch space of
+// a container isn't meant for binaries or devices
+const defaultTmpfsOptions = "nosuid,nodev,noexec"
+
+// The tmpfs mounted in the containers with a read-only root filesystem
+var readonlyRootfsTmpfs = []string{"/tmp", "/run"}
+
+// The options of the tmpfs mounts a container can set, the others (like
+// remount or bind) would change more than the tmpfs
+var (
+	tmpfsFlags = map[string]bool{
+		"ro": true, "rw": true,
+		"exec": true, "noexec": true,
+		"suid": true, "nosuid": true,
+		"dev": true, "nodev": true,
+		"atime": true, "noatime": true,
+	}
+	tmpfsValues = map[string]*regexp.Regexp{
+		"size":      regexp.MustCompile(`^[0-9]+[kmgKMG%]?$`),
+		"nr_inodes": regexp.MustCompile(`^[0-9]+[kmgKMG]?$`),
+		"mode":      regexp.MustCompile(`^[0-7]{3,4}$`),
+		"uid":       regexp.MustCompile(`^[0-9]+$`),
+		"gid":       regexp.MustCompile(`^[0-9]+$`),
+	}
+)
+
+// Parse the path[:options] of -tmpfs (e.g. /run:size=64m,mode=1777)
+func parseTmpfs(spec string) (string, string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	options := ""
+	if len(parts) == 2 {
+		options = parts[1]
+	}
+	if err := validateTmpfs(parts[0], options); err != nil {
+		return "", "", err
+	}
+	return path.Clean(parts[0]), options, nil
+}
+
+func validateTmpfs(dst, options string) error {
+	if !path.IsAbs(dst) || path.Clean(dst) == "/" {
+		return fmt.Errorf("Bad parameter: invalid tmpfs destination %s, it must be an absolute path other than /", dst)
+	}
+	// It's a field of a line of the lxc config
+	if strings.IndexFunc(dst, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("Bad parameter: invalid tmpfs destination %q, it can't contain spaces", dst)
+	}
+	if options == "" {
+		return nil
+	}
+	for _, option := range strings.Split(options, ",") {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) == 1 && tmpfsFlags[option] {
+			continue
+		}
+		if valid, exists := tmpfsValues[parts[0]]; exists && len(parts) == 2 && valid.MatchString(parts[1]) {
+			continue
+		}
+		return fmt.Errorf("Bad parameter: invalid tmpfs option %s of %s", option, dst)
+	}
+	return nil
+}
+
+// Check the tmpfs of a host config, they may come from the API
+func validateTmpfsMounts(tmpfs map[string]string) error {
+	for dst, options := range tmpfs {
+		if err := validateTmpfs(dst, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The options lxc mounts a tmpfs with: the given ones come after the
+// defaults, so they override them
+func tmpfsMountOptions(options string) string {
+	if options == "" {
+		return defaultTmpfsOptions
+	}
+	return defaultTmpfsOptions + "," + options
+}
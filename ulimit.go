@@ -0,0 +1,102 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The -default-ulimit of the daemon, name=soft[:hard]: the limits of the
+// containers which don't set them
+var DefaultUlimits []string
+
+// A resource limit of the processes of a container, docker-init sets it
+// before it executes them. -1 is unlimited.
+type Ulimit struct {
+	Name string
+	Soft int64
+	Hard int64
+}
+
+// The resources of the limits, with their RLIMIT_ numbers on Linux
+var ulimitResources = map[string]int{
+	"cpu": 0, "fsize": 1, "data": 2, "stack": 3, "core": 4, "rss": 5,
+	"nproc": 6, "nofile": 7, "memlock": 8, "as": 9, "locks": 10,
+	"sigpending": 11, "msgqueue": 12, "nice": 13, "rtprio": 14, "rttime": 15,
+}
+
+// Parse the name=soft[:hard] of -ulimit (e.g. nofile=65535:65535), the
+// hard limit is the soft one if it's not given
+func parseUlimit(spec string) (*Ulimit, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Bad parameter: invalid ulimit %s, expected name=soft[:hard]", spec)
+	}
+	limits := strings.SplitN(parts[1], ":", 2)
+	soft, err := strconv.ParseInt(limits[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid soft limit %s of the ulimit %s", limits[0], parts[0])
+	}
+	hard := soft
+	if len(limits) == 2 {
+		if hard, err = strconv.ParseInt(limits[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("Bad parameter: invalid hard limit %s of the ulimit %s", limits[1], parts[0])
+		}
+	}
+	ulimit := &Ulimit{Name: parts[0], Soft: soft, Hard: hard}
+	if err := validateUlimit(ulimit); err != nil {
+		return nil, err
+	}
+	return ulimit, nil
+}
+
+func validateUlimit(ulimit *Ulimit) error {
+	if _, exists := ulimitResources[ulimit.Name]; !exists {
+		return fmt.Errorf("Bad parameter: invalid ulimit %s", ulimit.Name)
+	}
+	if ulimit.Soft < -1 || ulimit.Hard < -1 {
+		return fmt.Errorf("Bad parameter: invalid limits of the ulimit %s, -1 is unlimited", ulimit.Name)
+	}
+	if ulimit.Hard != -1 && (ulimit.Soft == -1 || ulimit.Soft > ulimit.Hard) {
+		return fmt.Errorf("Bad parameter: the soft limit of the ulimit %s is above the hard one", ulimit.Name)
+	}
+	return nil
+}
+
+// Check the ulimits of a host config, they may come from the API
+func validateUlimits(ulimits []*Ulimit) error {
+	for _, ulimit := range ulimits {
+		if err := validateUlimit(ulimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The ulimits of a container, the ones of its host config and the defaults
+// of the daemon it doesn't set, by name
+func mergeUlimits(defaults, ulimits []*Ulimit) []*Ulimit {
+	byName := make(map[string]*Ulimit)
+	for _, ulimit := range defaults {
+		byName[ulimit.Name] = ulimit
+	}
+	for _, ulimit := range ulimits {
+		byName[ulimit.Name] = ulimit
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	merged := make([]*Ulimit, 0, len(names))
+	for _, name := range names {
+		merged = append(merged, byName[name])
+	}
+	return merged
+}
+
+// The name=soft:hard of the -ulimit of docker-init
+func (ulimit *Ulimit) String() string {
+	return fmt.Sprintf("%s=%d:%d", ulimit.Name, ulimit.Soft, ulimit.Hard)
+}
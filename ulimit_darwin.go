@@ -0,0 +1,7 @@
+package docker
+
+import "errors"
+
+func setRlimit(ulimit *Ulimit) error {
+	return errors.New("Ulimits are not implemented on darwin")
+}
@@ -0,0 +1,14 @@
+package docker
+
+import "syscall"
+
+func rlimitValue(limit int64) uint64 {
+	if limit == -1 {
+		return ^uint64(0) // RLIM_INFINITY
+	}
+	return uint64(limit)
+}
+
+func setRlimit(ulimit *Ulimit) error {
+	return syscall.Setrlimit(ulimitResources[ulimit.Name], &syscall.Rlimit{Cur: rlimitValue(ulimit.Soft), Max: rlimitValue(ulimit.Hard)})
+}
@@ -0,0 +1,207 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The user (or user:group) of -userns-remap, whose subordinate uids and gids
+// in /etc/subuid and /etc/subgid the containers get: their root is an
+// unprivileged user of the host. None if empty, default for dockremap.
+var UsernsRemap string
+
+const defaultRemapUser = "dockremap"
+
+// A range of ids of a user namespace: the ids from ContainerID in the
+// container are the ones from HostID on the host
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// The uids and gids of the containers of a daemon with -userns-remap
+type IDMappings struct {
+	Uids []IDMap
+	Gids []IDMap
+}
+
+// Parse the user[:group] of -userns-remap, the names or the ids of the
+// entries of /etc/subuid and /etc/subgid
+func parseUsernsRemap(spec string) (*IDMappings, error) {
+	if spec == "default" {
+		spec = defaultRemapUser
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+		return nil, fmt.Errorf("Invalid -userns-remap %s (user[:group])", spec)
+	}
+	group := parts[0]
+	if len(parts) == 2 {
+		group = parts[1]
+	}
+	uids, err := readSubIDs("/etc/subuid", parts[0])
+	if err != nil {
+		return nil, err
+	}
+	gids, err := readSubIDs("/etc/subgid", group)
+	if err != nil {
+		return nil, err
+	}
+	return &IDMappings{Uids: uids, Gids: gids}, nil
+}
+
+// The name:start:count ranges of a user (or group) in /etc/subuid (or
+// /etc/subgid), one after the other in the containers
+func readSubIDs(file, name string) ([]IDMap, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the subordinate ids of %s: %s", name, err)
+	}
+	defer f.Close()
+	var maps []IDMap
+	containerID := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || fields[0] != name {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		size, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || start < 0 || size <= 0 {
+			return nil, fmt.Errorf("Invalid entry %s of %s", scanner.Text(), file)
+		}
+		maps = append(maps, IDMap{ContainerID: containerID, HostID: start, Size: size})
+		containerID += size
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(maps) == 0 {
+		return nil, fmt.Errorf("No subordinate ids of %s in %s", name, file)
+	}
+	return maps, nil
+}
+
+// The id on the host of an id of the containers, an error if the
+// containers don't have it
+func hostID(maps []IDMap, id int) (int, error) {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, nil
+		}
+	}
+	return -1, fmt.Errorf("The id %d has no id on the host in the user namespace of the containers", id)
+}
+
+// The id in the containers of an id of the host. The ones the containers
+// don't have are left as they are, the files of the containers without the
+// user namespace (-userns=host) have them.
+func containerID(maps []IDMap, id int) int {
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID
+		}
+	}
+	return id
+}
+
+// The uid and gid of the root of the containers on the host
+func (m *IDMappings) RootPair() (int, int) {
+	uid, _ := hostID(m.Uids, 0)
+	gid, _ := hostID(m.Gids, 0)
+	return uid, gid
+}
+
+// Chown the files of a new layer from the ids of the containers to the
+// ones of the host
+func (m *IDMappings) chownLayer(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		uid, err := hostID(m.Uids, int(stat.Uid))
+		if err != nil {
+			return fmt.Errorf("Unable to chown %s: %s", p, err)
+		}
+		gid, err := hostID(m.Gids, int(stat.Gid))
+		if err != nil {
+			return fmt.Errorf("Unable to chown %s: %s", p, err)
+		}
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return err
+		}
+		// chown clears the setuid and setgid bits
+		if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 && info.Mode()&os.ModeSymlink == 0 {
+			return os.Chmod(p, info.Mode())
+		}
+		return nil
+	})
+}
+
+// Chown the files of a directory to the root of the containers, whether
+// they were already or not
+func (m *IDMappings) chownRoot(root string) error {
+	uid, gid := m.RootPair()
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// An uncompressed tar archive of files of the host, with the ids of the
+// containers: the images pushed, exported or committed don't depend on the
+// ids of the host
+func (m *IDMappings) containerArchive(archive Archive) Archive {
+	r, w := io.Pipe()
+	go func() {
+		tr := tar.NewReader(archive)
+		tw := tar.NewWriter(w)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			hdr.Uid = containerID(m.Uids, hdr.Uid)
+			hdr.Gid = containerID(m.Gids, hdr.Gid)
+			hdr.Uname, hdr.Gname = "", ""
+			if err := tw.WriteHeader(hdr); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.CloseWithError(tw.Close())
+	}()
+	return r
+}
+
+// The -userns of a host config: host runs the container without the user
+// namespace of -userns-remap
+func validateUsernsMode(mode string) error {
+	if mode != "" && mode != "host" {
+		return fmt.Errorf("Bad parameter: invalid user namespace mode %s (host)", mode)
+	}
+	return nil
+}
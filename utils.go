@@ -16,7 +16,11 @@ func CompareConfig(a, b *Config) bool {
 		a.User != b.User ||
 		a.Memory != b.Memory ||
 		a.MemorySwap != b.MemorySwap ||
+		a.MemoryReservation != b.MemoryReservation ||
+		a.KernelMemory != b.KernelMemory ||
 		a.CpuShares != b.CpuShares ||
+		a.CpuPeriod != b.CpuPeriod ||
+		a.CpuQuota != b.CpuQuota ||
 		a.OpenStdin != b.OpenStdin ||
 		a.Tty != b.Tty ||
 		a.VolumesFrom != b.VolumesFrom {
@@ -27,7 +31,8 @@ func CompareConfig(a, b *Config) bool {
 		len(a.Env) != len(b.Env) ||
 		len(a.PortSpecs) != len(b.PortSpecs) ||
 		len(a.Entrypoint) != len(b.Entrypoint) ||
-		len(a.Volumes) != len(b.Volumes) {
+		len(a.Volumes) != len(b.Volumes) ||
+		len(a.Labels) != len(b.Labels) {
 		return false
 	}
 
@@ -61,6 +66,11 @@ func CompareConfig(a, b *Config) bool {
 			return false
 		}
 	}
+	for key, value := range a.Labels {
+		if other, exists := b.Labels[key]; !exists || other != value {
+			return false
+		}
+	}
 	return true
 }
 
@@ -74,9 +84,24 @@ func MergeConfig(userConf, imageConf *Config) {
 	if userConf.MemorySwap == 0 {
 		userConf.MemorySwap = imageConf.MemorySwap
 	}
+	if userConf.MemoryReservation == 0 {
+		userConf.MemoryReservation = imageConf.MemoryReservation
+	}
+	if userConf.KernelMemory == 0 {
+		userConf.KernelMemory = imageConf.KernelMemory
+	}
+	if userConf.MemorySwappiness == nil {
+		userConf.MemorySwappiness = imageConf.MemorySwappiness
+	}
 	if userConf.CpuShares == 0 {
 		userConf.CpuShares = imageConf.CpuShares
 	}
+	if userConf.CpuPeriod == 0 {
+		userConf.CpuPeriod = imageConf.CpuPeriod
+	}
+	if userConf.CpuQuota == 0 {
+		userConf.CpuQuota = imageConf.CpuQuota
+	}
 	if userConf.PortSpecs == nil || len(userConf.PortSpecs) == 0 {
 		userConf.PortSpecs = imageConf.PortSpecs
 	} else {
@@ -123,6 +148,27 @@ func MergeConfig(userConf, imageConf *Config) {
 	if userConf.Cmd == nil || len(userConf.Cmd) == 0 {
 		userConf.Cmd = imageConf.Cmd
 	}
+	if userConf.Healthcheck == nil {
+		userConf.Healthcheck = imageConf.Healthcheck
+	}
+	if userConf.StopSignal == "" {
+		userConf.StopSignal = imageConf.StopSignal
+	}
+	if userConf.StopTimeout == 0 {
+		userConf.StopTimeout = imageConf.StopTimeout
+	}
+	if userConf.Labels == nil || len(userConf.Labels) == 0 {
+		userConf.Labels = imageConf.Labels
+	} else {
+		for k, v := range imageConf.Labels {
+			if _, exists := userConf.Labels[k]; !exists {
+				userConf.Labels[k] = v
+			}
+		}
+	}
+	if userConf.Shell == nil || len(userConf.Shell) == 0 {
+		userConf.Shell = imageConf.Shell
+	}
 	if userConf.Dns == nil || len(userConf.Dns) == 0 {
 		userConf.Dns = imageConf.Dns
 	} else {
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The streams of a multiplexed stream
+type StdType byte
+
+const (
+	Stdin StdType = iota
+	Stdout
+	Stderr
+)
+
+// Each frame of a multiplexed stream starts with a header: the stream (1
+// byte), 3 bytes of 0 and the length of the frame (big endian uint32).
+const StdHeaderLen = 8
+
+// The biggest frame StdCopy reads
+const stdFrameMax = 1 << 20
+
+// StdWriter writes a stream in a multiplexed stream: each write is a frame.
+// The writers of the streams of a multiplexed stream can write
+// concurrently, as long as the writes of the writer they share are atomic
+// (e.g. a net.Conn).
+type StdWriter struct {
+	io.Writer
+	stream StdType
+}
+
+func NewStdWriter(w io.Writer, stream StdType) *StdWriter {
+	return &StdWriter{Writer: w, stream: stream}
+}
+
+func (w *StdWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// The header and the frame in one write
+	frame := make([]byte, StdHeaderLen+len(p))
+	frame[0] = byte(w.stream)
+	binary.BigEndian.PutUint32(frame[4:StdHeaderLen], uint32(len(p)))
+	copy(frame[StdHeaderLen:], p)
+	n, err := w.Writer.Write(frame)
+	n -= StdHeaderLen
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// StdCopy demultiplexes src, copying the frames of stdout to dstout and the
+// ones of stderr to dsterr, until the end of src. It returns the bytes
+// written.
+func StdCopy(dstout, dsterr io.Writer, src io.Reader) (int64, error) {
+	var written int64
+	header := make([]byte, StdHeaderLen)
+	var frame []byte
+	for {
+		if _, err := io.ReadFull(src, header); err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+		length := binary.BigEndian.Uint32(header[4:])
+		if length > stdFrameMax {
+			return written, fmt.Errorf("Invalid multiplexed stream: frame of %d bytes", length)
+		}
+		var dst io.Writer
+		switch StdType(header[0]) {
+		case Stdin, Stdout:
+			dst = dstout
+		case Stderr:
+			dst = dsterr
+		default:
+			return written, fmt.Errorf("Invalid multiplexed stream: unknown stream %d", header[0])
+		}
+		if cap(frame) < int(length) {
+			frame = make([]byte, length)
+		}
+		frame = frame[:length]
+		if _, err := io.ReadFull(src, frame); err != nil {
+			return written, err
+		}
+		n, err := dst.Write(frame)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
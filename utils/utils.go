@@ -401,26 +401,72 @@ func TruncateID(id string) string {
 	return id[:shortLen]
 }
 
-// Code c/c from io.Copy() modified to handle escape sequence
-func CopyEscapable(dst io.Writer, src io.ReadCloser) (written int64, err error) {
+// The key sequence which detaches from a container with a tty, unless
+// another one is given
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+// ParseDetachKeys parses a key sequence such as ctrl-p,ctrl-q: comma
+// separated keys, each one a character or ctrl- and a letter, @, [, \, ], ^
+// or _.
+func ParseDetachKeys(keys string) ([]byte, error) {
+	var sequence []byte
+	for _, key := range strings.Split(keys, ",") {
+		if len(key) == 1 {
+			sequence = append(sequence, key[0])
+			continue
+		}
+		if len(key) == len("ctrl-x") && strings.HasPrefix(key, "ctrl-") {
+			c := key[len(key)-1]
+			if c >= 'a' && c <= 'z' {
+				sequence = append(sequence, c-'a'+1)
+				continue
+			}
+			if c >= '@' && c <= '_' {
+				sequence = append(sequence, c-'@')
+				continue
+			}
+		}
+		return nil, fmt.Errorf("Bad parameter: invalid detach keys %s (e.g. %s)", keys, DefaultDetachKeys)
+	}
+	return sequence, nil
+}
+
+// Code c/c from io.Copy() modified to handle escape sequence: the copy
+// stops, and src is closed, when keys (DefaultDetachKeys if nil) are read.
+// The bytes of the beginning of the sequence are held back until the
+// sequence is broken.
+func CopyEscapable(dst io.Writer, src io.ReadCloser, keys []byte) (written int64, err error) {
+	if keys == nil {
+		keys, _ = ParseDetachKeys(DefaultDetachKeys)
+	}
 	buf := make([]byte, 32*1024)
+	out := make([]byte, 0, len(buf)+len(keys))
+	matched := 0 // The bytes of keys read last
 	for {
 		nr, er := src.Read(buf)
-		if nr > 0 {
-			// ---- Docker addition
-			// char 16 is C-p
-			if nr == 1 && buf[0] == 16 {
-				nr, er = src.Read(buf)
-				// char 17 is C-q
-				if nr == 1 && buf[0] == 17 {
-					if err := src.Close(); err != nil {
-						return 0, err
-					}
-					return 0, io.EOF
-				}
+		detached := false
+		out = out[:0]
+		// ---- Docker addition
+		for _, b := range buf[:nr] {
+			if b != keys[matched] && matched > 0 {
+				out = append(out, keys[:matched]...)
+				matched = 0
 			}
-			// ---- End of docker
-			nw, ew := dst.Write(buf[0:nr])
+			if b != keys[matched] {
+				out = append(out, b)
+				continue
+			}
+			if matched++; matched == len(keys) {
+				detached = true
+				break
+			}
+		}
+		if er == io.EOF && !detached {
+			out = append(out, keys[:matched]...)
+		}
+		// ---- End of docker
+		if len(out) > 0 {
+			nw, ew := dst.Write(out)
 			if nw > 0 {
 				written += int64(nw)
 			}
@@ -428,11 +474,17 @@ func CopyEscapable(dst io.Writer, src io.ReadCloser) (written int64, err error)
 				err = ew
 				break
 			}
-			if nr != nw {
+			if len(out) != nw {
 				err = io.ErrShortWrite
 				break
 			}
 		}
+		if detached {
+			if err := src.Close(); err != nil {
+				return written, err
+			}
+			return written, io.EOF
+		}
 		if er == io.EOF {
 			break
 		}
@@ -576,6 +628,49 @@ func GetKernelVersion() (*KernelVersionInfo, error) {
 	}, nil
 }
 
+// FollowSymlinkInScope resolves the symlinks of link, a path under root, as
+// if root was /: the absolute ones and the .. never leave root
+func FollowSymlinkInScope(link, root string) (string, error) {
+	root = filepath.Clean(root)
+	rel, err := filepath.Rel(root, filepath.Clean(link))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not under %s", link, root)
+	}
+	resolved := ""
+	pending := strings.Split(rel, "/")
+	for links := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir("/" + resolved)[1:]
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && fi.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("Too many symlinks in %s", link)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
 // FIXME: this is deprecated by CopyWithTar in archive.go
 func CopyDirectory(source, dest string) error {
 	if output, err := exec.Command("cp", "-ra", source, dest).CombinedOutput(); err != nil {
@@ -625,6 +720,21 @@ type JSONMessage struct {
 	From         string     `json:"from,omitempty"`
 	Time         int64      `json:"time,omitempty"`
 	Error        *JSONError `json:"errorDetail,omitempty"`
+
+	// The output of a build, and the record of each of its steps when it's
+	// done
+	Stream string         `json:"stream,omitempty"`
+	Step   *JSONBuildStep `json:"step,omitempty"`
+}
+
+// The record of a step of a build: the instruction, whether its layer was
+// cached, how many seconds it took and the image it made
+type JSONBuildStep struct {
+	Index       int     `json:"index"`
+	Instruction string  `json:"instruction"`
+	Cached      bool    `json:"cached"`
+	Duration    float64 `json:"duration"`
+	Image       string  `json:"image,omitempty"`
 }
 
 func (e *JSONError) Error() string {
@@ -645,6 +755,15 @@ func (jm *JSONMessage) Display(out io.Writer) error {
 		}
 		return jm.Error
 	}
+	// The records of the steps of builds are for the programs reading the
+	// stream, the output tells the same
+	if jm.Step != nil {
+		return nil
+	}
+	if jm.Stream != "" {
+		_, err := fmt.Fprint(out, jm.Stream)
+		return err
+	}
 	fmt.Fprintf(out, "%c[2K\r", 27)
 	if jm.Time != 0 {
 		fmt.Fprintf(out, "[%s] ", time.Unix(jm.Time, 0))
@@ -746,6 +865,31 @@ func (sf *StreamFormatter) FormatProgress(id, action, progress string) []byte {
 	return []byte(action + " " + progress + "\r")
 }
 
+func (sf *StreamFormatter) FormatStream(str string) []byte {
+	sf.used = true
+	if sf.json {
+		b, err := json.Marshal(&JSONMessage{Stream: str})
+		if err != nil {
+			return sf.FormatError(err)
+		}
+		return b
+	}
+	return []byte(str)
+}
+
+// The record of a step of a build, nothing without JSON
+func (sf *StreamFormatter) FormatBuildStep(step *JSONBuildStep) []byte {
+	if !sf.json {
+		return nil
+	}
+	sf.used = true
+	b, err := json.Marshal(&JSONMessage{Step: step})
+	if err != nil {
+		return sf.FormatError(err)
+	}
+	return b
+}
+
 func (sf *StreamFormatter) Used() bool {
 	return sf.used
 }
@@ -787,6 +931,43 @@ func CheckLocalDns(resolvConf []byte) bool {
 	return false
 }
 
+// GetNameservers returns the nameservers listed in a resolv.conf
+func GetNameservers(resolvConf []byte) []string {
+	nameservers := []string{}
+	for _, line := range strings.Split(string(resolvConf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
+		}
+	}
+	return nameservers
+}
+
+// GetSearchDomains returns the search domains of a resolv.conf: the last
+// search or domain line wins
+func GetSearchDomains(resolvConf []byte) []string {
+	domains := []string{}
+	for _, line := range strings.Split(string(resolvConf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && (fields[0] == "search" || fields[0] == "domain") {
+			domains = fields[1:]
+		}
+	}
+	return domains
+}
+
+// GetOptions returns the options listed in a resolv.conf
+func GetOptions(resolvConf []byte) []string {
+	options := []string{}
+	for _, line := range strings.Split(string(resolvConf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "options" {
+			options = append(options, fields[1:]...)
+		}
+	}
+	return options
+}
+
 func ParseHost(host string, port int, addr string) string {
 	if strings.HasPrefix(addr, "unix://") {
 		return addr
@@ -832,6 +1013,10 @@ func GetReleaseVersion() string {
 // The tag can be confusing because of a port in a repository name.
 //     Ex: localhost.localdomain:5000/samalba/hipache:latest
 func ParseRepositoryTag(repos string) (string, string) {
+	// repo@sha256:... refers to the image by the digest of its manifest
+	if n := strings.Index(repos, "@"); n >= 0 {
+		return repos[:n], repos[n+1:]
+	}
 	n := strings.LastIndex(repos, ":")
 	if n < 0 {
 		return repos, ""
@@ -842,6 +1027,19 @@ func ParseRepositoryTag(repos string) (string, string) {
 	return repos, ""
 }
 
+// IsDigest returns whether ref is the digest of a content, sha256:<hex>
+func IsDigest(ref string) bool {
+	if !strings.HasPrefix(ref, "sha256:") || len(ref) != len("sha256:")+64 {
+		return false
+	}
+	for _, c := range ref[len("sha256:"):] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 // UserLookup check if the given username or uid is present in /etc/passwd
 // and returns the user struct.
 // If the username is not found, an error is returned.
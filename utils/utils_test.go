@@ -5,6 +5,8 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -302,6 +304,24 @@ func TestParseRepositoryTag(t *testing.T) {
 	if repo, tag := ParseRepositoryTag("url:5000/repo:tag"); repo != "url:5000/repo" || tag != "tag" {
 		t.Errorf("Expected repo: '%s' and tag: '%s', got '%s' and '%s'", "url:5000/repo", "tag", repo, tag)
 	}
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	if repo, tag := ParseRepositoryTag("url:5000/repo@" + digest); repo != "url:5000/repo" || tag != digest {
+		t.Errorf("Expected repo: '%s' and tag: '%s', got '%s' and '%s'", "url:5000/repo", digest, repo, tag)
+	}
+}
+
+func TestIsDigest(t *testing.T) {
+	for ref, expected := range map[string]bool{
+		"sha256:" + strings.Repeat("ab", 32): true,
+		"sha256:" + strings.Repeat("AB", 32): false,
+		"sha256:" + strings.Repeat("ab", 31): false,
+		"md5:" + strings.Repeat("ab", 32):    false,
+		"latest":                             false,
+	} {
+		if IsDigest(ref) != expected {
+			t.Errorf("IsDigest(%s): expected %v", ref, expected)
+		}
+	}
 }
 
 func TestGetResolvConf(t *testing.T) {
@@ -337,3 +357,190 @@ search dotcloud.net`: true,
 		}
 	}
 }
+
+func TestGetSearchDomainsAndOptions(t *testing.T) {
+	resolv := []byte(`domain dotcloud.net
+search corp.example.com example.com
+nameserver 10.0.2.3
+options ndots:2
+options timeout:1 rotate
+`)
+	if domains := GetSearchDomains(resolv); len(domains) != 2 || domains[0] != "corp.example.com" || domains[1] != "example.com" {
+		t.Fatalf("Wrong search domains: %v", domains)
+	}
+	if options := GetOptions(resolv); len(options) != 3 || options[0] != "ndots:2" || options[2] != "rotate" {
+		t.Fatalf("Wrong options: %v", options)
+	}
+	if domains, options := GetSearchDomains([]byte("nameserver 10.0.2.3")), GetOptions(nil); len(domains) != 0 || len(options) != 0 {
+		t.Fatalf("Expected no search domain nor option, got %v and %v", domains, options)
+	}
+}
+
+func TestGetNameservers(t *testing.T) {
+	for resolv, result := range map[string][]string{`# Dynamic
+nameserver 10.0.2.3
+search dotcloud.net`: {"10.0.2.3"},
+		`nameserver 10.0.2.3
+# nameserver 10.0.2.4
+nameserver	127.0.0.1
+`: {"10.0.2.3", "127.0.0.1"},
+		`search dotcloud.net`: {},
+		``:                    {},
+	} {
+		nameservers := GetNameservers([]byte(resolv))
+		if len(nameservers) != len(result) {
+			t.Fatalf("Wrong nameservers for {%s}: %v instead of %v", resolv, nameservers, result)
+		}
+		for i := range result {
+			if nameservers[i] != result[i] {
+				t.Fatalf("Wrong nameservers for {%s}: %v instead of %v", resolv, nameservers, result)
+			}
+		}
+	}
+}
+
+func TestStdCopy(t *testing.T) {
+	multiplexed := &bytes.Buffer{}
+	stdout := NewStdWriter(multiplexed, Stdout)
+	stderr := NewStdWriter(multiplexed, Stderr)
+	stdout.Write([]byte("hello "))
+	stderr.Write([]byte("error\n"))
+	stdout.Write([]byte("world\n"))
+	if header := multiplexed.Bytes()[:StdHeaderLen]; !bytes.Equal(header, []byte{1, 0, 0, 0, 0, 0, 0, 6}) {
+		t.Fatalf("Wrong header: %v", header)
+	}
+
+	outBuf, errBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	written, err := StdCopy(outBuf, errBuf, multiplexed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 18 {
+		t.Fatalf("Expected 18 bytes written, got %d", written)
+	}
+	if outBuf.String() != "hello world\n" {
+		t.Fatalf("Wrong stdout: %q", outBuf.String())
+	}
+	if errBuf.String() != "error\n" {
+		t.Fatalf("Wrong stderr: %q", errBuf.String())
+	}
+
+	// A truncated frame
+	if _, err := StdCopy(outBuf, errBuf, bytes.NewReader([]byte{1, 0, 0, 0, 0, 0, 0, 6, 'a'})); err == nil {
+		t.Fatal("Expected an error for a truncated frame")
+	}
+	// An unknown stream
+	if _, err := StdCopy(outBuf, errBuf, bytes.NewReader([]byte{5, 0, 0, 0, 0, 0, 0, 1, 'a'})); err == nil {
+		t.Fatal("Expected an error for an unknown stream")
+	}
+}
+
+func TestParseDetachKeys(t *testing.T) {
+	for keys, expected := range map[string][]byte{
+		"ctrl-p,ctrl-q": {16, 17},
+		"ctrl-@,a":      {0, 'a'},
+		"ctrl-[,ctrl-_": {27, 31},
+	} {
+		sequence, err := ParseDetachKeys(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sequence, expected) {
+			t.Fatalf("Wrong sequence for %s: %v instead of %v", keys, sequence, expected)
+		}
+	}
+	for _, keys := range []string{"", "ctrl-", "ctrl-1", "ab", "ctrl-p,"} {
+		if _, err := ParseDetachKeys(keys); err == nil {
+			t.Fatalf("Expected an error for %q", keys)
+		}
+	}
+}
+
+func TestCopyEscapable(t *testing.T) {
+	keys, err := ParseDetachKeys("ctrl-x,ctrl-y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The beginning of the sequence is written once it's broken, and the
+	// copy stops at the sequence
+	dst := &bytes.Buffer{}
+	src := ioutil.NopCloser(strings.NewReader("hello\x18world\x18\x18\x19ignored"))
+	if _, err := CopyEscapable(dst, src, keys); err != io.EOF {
+		t.Fatalf("Expected io.EOF when detaching, got %v", err)
+	}
+	if dst.String() != "hello\x18world\x18" {
+		t.Fatalf("Wrong copy: %q", dst.String())
+	}
+
+	// The default sequence no longer detaches
+	dst.Reset()
+	src = ioutil.NopCloser(strings.NewReader("a\x10\x11b\x18"))
+	if _, err := CopyEscapable(dst, src, keys); err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != "a\x10\x11b\x18" {
+		t.Fatalf("Wrong copy: %q", dst.String())
+	}
+}
+
+func TestDisplayBuildStream(t *testing.T) {
+	sf := NewStreamFormatter(true)
+	in := bytes.NewBuffer(nil)
+	in.Write(sf.FormatStream("Step 1 : FROM busybox\n"))
+	in.Write(sf.FormatBuildStep(&JSONBuildStep{Index: 1, Instruction: "FROM busybox", Duration: 0.5, Image: "abc"}))
+	in.Write(sf.FormatStream(" ---> abc\n"))
+
+	out := bytes.NewBuffer(nil)
+	if err := DisplayJSONMessagesStream(in, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Step 1 : FROM busybox\n ---> abc\n" {
+		t.Fatalf("Unexpected output: %q", out.String())
+	}
+
+	if NewStreamFormatter(false).FormatBuildStep(&JSONBuildStep{Index: 1}) != nil {
+		t.Fatalf("The records of the steps should only be in the JSON stream")
+	}
+}
+
+func TestFollowSymlinkInScope(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"abs":      "/etc",
+		"rel":      "../../../etc",
+		"etc/self": ".",
+		"loop":     "loop",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, expected := range map[string]string{
+		"abs/shadow":          "etc/shadow",
+		"rel/shadow":          "etc/shadow",
+		"etc/self/self/x":     "etc/x",
+		"abs/../etc/self/x":   "etc/x",
+		"nosuchdir/../abs/..": "",
+	} {
+		resolved, err := FollowSymlinkInScope(filepath.Join(root, "/", link), root)
+		if err != nil {
+			t.Fatalf("%s: %s", link, err)
+		}
+		if resolved != filepath.Join(root, expected) {
+			t.Fatalf("Expected %s to resolve to %s, %s found", link, filepath.Join(root, expected), resolved)
+		}
+	}
+	if _, err := FollowSymlinkInScope(filepath.Join(root, "loop"), root); err == nil {
+		t.Fatal("Expected a symlink loop to fail")
+	}
+	if _, err := FollowSymlinkInScope("/etc", root); err == nil {
+		t.Fatal("Expected a path out of root to fail")
+	}
+}
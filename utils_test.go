@@ -192,6 +192,16 @@ func TestCompareConfig(t *testing.T) {
 	if CompareConfig(&config1, &config5) {
 		t.Fatalf("CompareConfig should return false, Volumes are different")
 	}
+	config6 := config1
+	config6.Labels = map[string]string{"version": "1"}
+	if CompareConfig(&config1, &config6) {
+		t.Fatalf("CompareConfig should return false, Labels are different")
+	}
+	config7 := config6
+	config7.Labels = map[string]string{"version": "2"}
+	if CompareConfig(&config6, &config7) {
+		t.Fatalf("CompareConfig should return false, the values of the Labels are different")
+	}
 	if !CompareConfig(&config1, &config1) {
 		t.Fatalf("CompareConfig should return true")
 	}
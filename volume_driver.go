@@ -0,0 +1,110 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The driver of the named volumes which don't set one
+const DefaultVolumeDriver = "local"
+
+// A VolumeDriver stores the named volumes. The runtime only deals with this
+// interface so external storage (NFS, Ceph, EBS...) can back the volumes,
+// with RegisterVolumeDriver. The containers mount the path the driver
+// returns.
+type VolumeDriver interface {
+	// Create the volume name, options are driver specific.
+	Create(name string, options map[string]string) error
+	// Make the volume name available on the host for the container id,
+	// and return its path. Several containers can mount the same volume.
+	Mount(name, id string) (string, error)
+	// The container id doesn't use the volume name anymore.
+	Unmount(name, id string) error
+	// Remove the volume name and its data, no container uses it.
+	Remove(name string) error
+	// The path of the volume name on the host, empty if it isn't
+	// available without being mounted.
+	Path(name string) (string, error)
+}
+
+// The init functions of the volume drivers get the directory of the named
+// volumes: the driver can keep what it needs for the volume name in
+// <root>/<name>/data.
+var volumeDrivers = make(map[string]func(root string) (VolumeDriver, error))
+
+// Make a volume driver available under the given name, the init function is
+// called the first time a volume uses it.
+func RegisterVolumeDriver(name string, init func(root string) (VolumeDriver, error)) {
+	if _, exists := volumeDrivers[name]; exists {
+		panic(fmt.Sprintf("Volume driver %s registered twice", name))
+	}
+	volumeDrivers[name] = init
+}
+
+func validateVolumeDriver(name string) error {
+	if _, exists := volumeDrivers[name]; name == "" || exists {
+		return nil
+	}
+	names := make([]string, 0, len(volumeDrivers))
+	for name := range volumeDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("Bad parameter: invalid volume driver %s (%s)", name, strings.Join(names, ", "))
+}
+
+func newVolumeDriver(name, root string) (VolumeDriver, error) {
+	if err := validateVolumeDriver(name); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = DefaultVolumeDriver
+	}
+	return volumeDrivers[name](root)
+}
+
+func init() {
+	RegisterVolumeDriver("local", func(root string) (VolumeDriver, error) {
+		return &localVolumeDriver{root: root}, nil
+	})
+}
+
+// The default driver: each volume is a directory of the host, in the
+// directory of the named volumes.
+type localVolumeDriver struct {
+	root string
+}
+
+func (driver *localVolumeDriver) path(name string) string {
+	return filepath.Join(driver.root, name, "data")
+}
+
+func (driver *localVolumeDriver) Create(name string, options map[string]string) error {
+	for option := range options {
+		return fmt.Errorf("Bad parameter: the local volume driver has no option %s", option)
+	}
+	return os.MkdirAll(driver.path(name), 0755)
+}
+
+func (driver *localVolumeDriver) Mount(name, id string) (string, error) {
+	// Created again if it was removed behind the back of docker
+	if err := os.MkdirAll(driver.path(name), 0755); err != nil {
+		return "", err
+	}
+	return driver.path(name), nil
+}
+
+func (driver *localVolumeDriver) Unmount(name, id string) error {
+	return nil
+}
+
+func (driver *localVolumeDriver) Remove(name string) error {
+	return os.RemoveAll(driver.path(name))
+}
+
+func (driver *localVolumeDriver) Path(name string) (string, error) {
+	return driver.path(name), nil
+}
@@ -0,0 +1,448 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var validVolumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// The volumes created with a name, by docker volume create or by -v
+// name:/path, each one in <root>/<name>: its json, and what its volume driver
+// keeps in it. Unlike the volumes docker creates for the containers, they are
+// only removed with docker volume rm.
+type VolumeStore struct {
+	sync.Mutex
+	root    string
+	Volumes map[string]*VolumeConfig
+}
+
+type VolumeConfig struct {
+	Name    string
+	Driver  string            // local if empty
+	Options map[string]string `json:",omitempty"` // The options of the driver
+	Created time.Time
+}
+
+func NewVolumeStore(root string) (*VolumeStore, error) {
+	abspath, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abspath, 0700); err != nil {
+		return nil, err
+	}
+	store := &VolumeStore{
+		root:    abspath,
+		Volumes: make(map[string]*VolumeConfig),
+	}
+	dirs, err := ioutil.ReadDir(abspath)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		config := &VolumeConfig{}
+		jsonData, err := ioutil.ReadFile(filepath.Join(abspath, dir.Name(), "json"))
+		if err == nil {
+			err = json.Unmarshal(jsonData, config)
+		}
+		if err != nil {
+			log.Printf("WARNING: Unable to load the volume %s: %s", dir.Name(), err)
+			continue
+		}
+		if config.Driver == "" {
+			config.Driver = DefaultVolumeDriver
+		}
+		store.Volumes[config.Name] = config
+	}
+	return store, nil
+}
+
+func (store *VolumeStore) get(name string) *VolumeConfig {
+	store.Lock()
+	defer store.Unlock()
+	return store.Volumes[name]
+}
+
+// Remember the volume of config. If it exists, it's returned unless
+// exclusive.
+func (store *VolumeStore) add(config *VolumeConfig, exclusive bool) (*VolumeConfig, bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	if existing := store.Volumes[config.Name]; existing != nil {
+		if exclusive {
+			return nil, false, fmt.Errorf("Conflict: volume %s already exists", config.Name)
+		}
+		return existing, false, nil
+	}
+	jsonData, err := json.Marshal(config)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Join(store.root, config.Name), 0700); err != nil {
+		return nil, false, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(store.root, config.Name, "json"), jsonData, 0600); err != nil {
+		os.RemoveAll(filepath.Join(store.root, config.Name))
+		return nil, false, err
+	}
+	store.Volumes[config.Name] = config
+	return config, true, nil
+}
+
+func (store *VolumeStore) remove(name string) error {
+	store.Lock()
+	defer store.Unlock()
+	if err := os.RemoveAll(filepath.Join(store.root, name)); err != nil {
+		return err
+	}
+	delete(store.Volumes, name)
+	return nil
+}
+
+// The instance of the volume driver name, it's created the first time a
+// volume uses it
+func (runtime *Runtime) loadVolumeDriver(name string) (VolumeDriver, error) {
+	if name == "" {
+		name = DefaultVolumeDriver
+	}
+	runtime.volumeDriversLock.Lock()
+	defer runtime.volumeDriversLock.Unlock()
+	if driver, exists := runtime.volumeDrivers[name]; exists {
+		return driver, nil
+	}
+	driver, err := newVolumeDriver(name, runtime.namedVolumes.root)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.volumeDrivers == nil {
+		runtime.volumeDrivers = make(map[string]VolumeDriver)
+	}
+	runtime.volumeDrivers[name] = driver
+	return driver, nil
+}
+
+// Create the volume of config with its driver, unless it exists and isn't
+// exclusive. The existing volume is returned.
+func (runtime *Runtime) createVolume(config *VolumeConfig, exclusive bool) (*VolumeConfig, error) {
+	if !validVolumeName.MatchString(config.Name) {
+		return nil, fmt.Errorf("Bad parameter: invalid volume name %q", config.Name)
+	}
+	if img, err := runtime.volumes.Get(config.Name); err == nil && img.ID == config.Name {
+		return nil, fmt.Errorf("Conflict: volume %s already exists", config.Name)
+	}
+	if config.Driver == "" {
+		config.Driver = DefaultVolumeDriver
+	}
+	driver, err := runtime.loadVolumeDriver(config.Driver)
+	if err != nil {
+		return nil, err
+	}
+	config, created, err := runtime.namedVolumes.add(config, exclusive)
+	if err != nil || !created {
+		return config, err
+	}
+	if err := driver.Create(config.Name, config.Options); err != nil {
+		if err := runtime.namedVolumes.remove(config.Name); err != nil {
+			log.Printf("WARNING: Unable to remove the volume %s: %s", config.Name, err)
+		}
+		return nil, err
+	}
+	// The root of the containers owns the local volumes, with -userns-remap
+	if runtime.idMappings != nil && config.Driver == "local" {
+		if err := runtime.idMappings.chownRoot(filepath.Join(runtime.namedVolumes.root, config.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Create the named volume name with the volume driver driverName (local if
+// empty), with a random name if empty
+func (runtime *Runtime) CreateVolume(name, driverName string, options map[string]string) (*APIVolume, error) {
+	if name == "" {
+		name = GenerateID()
+	}
+	config := &VolumeConfig{Name: name, Driver: driverName, Options: options, Created: time.Now()}
+	if _, err := runtime.createVolume(config, true); err != nil {
+		return nil, err
+	}
+	return runtime.VolumeInfo(name, false)
+}
+
+// Mount the named volume of -v name:/path for the container id, created with
+// the volume driver driverName if it doesn't exist yet, and return its path
+func (runtime *Runtime) mountVolume(name, driverName, id string) (string, error) {
+	config, err := runtime.createVolume(&VolumeConfig{Name: name, Driver: driverName, Created: time.Now()}, false)
+	if err != nil {
+		return "", err
+	}
+	if driverName != "" && driverName != config.Driver {
+		return "", fmt.Errorf("Conflict: volume %s uses the volume driver %s, not %s", name, config.Driver, driverName)
+	}
+	driver, err := runtime.loadVolumeDriver(config.Driver)
+	if err != nil {
+		return "", err
+	}
+	return driver.Mount(name, id)
+}
+
+// Unmount the named volumes mounted for the container, once it stopped: the
+// ones of its binds too, even where it has no volume
+func (runtime *Runtime) unmountVolumes(container *Container) {
+	for _, name := range container.MountedVolumes {
+		runtime.unmountVolume(name, container.ID)
+	}
+	container.MountedVolumes = nil
+}
+
+// Unmount the named volume mounted for the container id
+func (runtime *Runtime) unmountVolume(name, id string) {
+	config := runtime.namedVolumes.get(name)
+	if config == nil {
+		return
+	}
+	driver, err := runtime.loadVolumeDriver(config.Driver)
+	if err == nil {
+		err = driver.Unmount(name, id)
+	}
+	if err != nil {
+		log.Printf("WARNING: Unable to unmount the volume %s of %s: %s", name, id, err)
+	}
+}
+
+// The volume name: a named volume, or one docker created for a container,
+// named by its ID. With size, the usage of its data is computed.
+func (runtime *Runtime) VolumeInfo(name string, size bool) (*APIVolume, error) {
+	info := &APIVolume{Name: name}
+	if config := runtime.namedVolumes.get(name); config != nil {
+		driver, err := runtime.loadVolumeDriver(config.Driver)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mountpoint, err = driver.Path(name); err != nil {
+			return nil, err
+		}
+		info.Driver = config.Driver
+		info.Created = config.Created.Unix()
+		info.Containers = runtime.namedVolumeContainers(name)
+	} else if img, err := runtime.volumes.Get(name); err == nil {
+		mountpoint, err := runtime.volumes.driver.Get(img.ID)
+		if err != nil {
+			return nil, err
+		}
+		info.Name = img.ID
+		info.Mountpoint = mountpoint
+		info.Driver = DefaultVolumeDriver
+		info.Created = img.Created.Unix()
+		info.Anonymous = true
+		info.Containers = runtime.volumeContainers(func(container *Container, volPath, srcPath string) bool {
+			return filepath.Clean(srcPath) == mountpoint
+		})
+	} else {
+		return nil, fmt.Errorf("No such volume: %s", name)
+	}
+	if size && info.Mountpoint != "" {
+		info.Size = dirSize(info.Mountpoint)
+	}
+	return info, nil
+}
+
+// All the volumes, the named ones first, sorted by name
+func (runtime *Runtime) VolumeList() ([]APIVolume, error) {
+	names := []string{}
+	runtime.namedVolumes.Lock()
+	for name := range runtime.namedVolumes.Volumes {
+		names = append(names, name)
+	}
+	runtime.namedVolumes.Unlock()
+	sort.Strings(names)
+	anonymous := []string{}
+	if err := runtime.volumes.WalkAll(func(img *Image) {
+		anonymous = append(anonymous, img.ID)
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(anonymous)
+
+	volumes := []APIVolume{}
+	for _, name := range append(names, anonymous...) {
+		info, err := runtime.VolumeInfo(name, false)
+		if err != nil {
+			// Removed in the meantime
+			continue
+		}
+		volumes = append(volumes, *info)
+	}
+	return volumes, nil
+}
+
+// Remove the volume name, it must not be used by any container.
+func (runtime *Runtime) DeleteVolume(name string) error {
+	info, err := runtime.VolumeInfo(name, false)
+	if err != nil {
+		return err
+	}
+	if len(info.Containers) > 0 {
+		return fmt.Errorf("Conflict: volume %s is used by container %s", name, info.Containers[0])
+	}
+	if info.Anonymous {
+		return runtime.volumes.Delete(info.Name)
+	}
+	driver, err := runtime.loadVolumeDriver(info.Driver)
+	if err != nil {
+		return err
+	}
+	if err := driver.Remove(info.Name); err != nil {
+		return err
+	}
+	return runtime.namedVolumes.remove(info.Name)
+}
+
+// Remove the volumes no container uses, and return their names and the
+// bytes of their data. A volume a container started to use in the meantime
+// is kept.
+func (runtime *Runtime) PruneVolumes() (*APIVolumesPrune, error) {
+	volumes, err := runtime.VolumeList()
+	if err != nil {
+		return nil, err
+	}
+	pruned := &APIVolumesPrune{VolumesDeleted: []string{}}
+	for _, volume := range volumes {
+		if len(volume.Containers) > 0 {
+			continue
+		}
+		var size int64
+		if volume.Mountpoint != "" {
+			size = dirSize(volume.Mountpoint)
+		}
+		if err := runtime.DeleteVolume(volume.Name); err != nil {
+			log.Printf("WARNING: Unable to remove the volume %s: %s", volume.Name, err)
+			continue
+		}
+		pruned.VolumesDeleted = append(pruned.VolumesDeleted, volume.Name)
+		pruned.SpaceReclaimed += size
+	}
+	return pruned, nil
+}
+
+// VolumeFilters select the volumes by dangling (true for the ones no
+// container uses, false for the others), by driver and by name (or the
+// start of the name). Like the EventFilters, the values of a filter are
+// alternatives and the filters must all match.
+type VolumeFilters map[string][]string
+
+// Parse the filters query parameter of /volumes/json, a JSON object such
+// as: {"dangling":["true"],"driver":["local"]}
+func parseVolumeFilters(value string) (VolumeFilters, error) {
+	filters := VolumeFilters{}
+	if value == "" {
+		return filters, nil
+	}
+	if err := json.Unmarshal([]byte(value), &filters); err != nil {
+		return nil, fmt.Errorf("Bad parameter: invalid filters %s: %s", value, err)
+	}
+	for name, values := range filters {
+		switch name {
+		case "dangling":
+			for _, value := range values {
+				if _, err := strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("Bad parameter: invalid dangling filter %s (true or false)", value)
+				}
+			}
+		case "driver", "name":
+		default:
+			return nil, fmt.Errorf("Bad parameter: invalid filter %s (dangling, driver or name)", name)
+		}
+	}
+	return filters, nil
+}
+
+func (filters VolumeFilters) match(volume *APIVolume) bool {
+	for name, values := range filters {
+		matched := false
+		for _, value := range values {
+			switch name {
+			case "dangling":
+				dangling, _ := strconv.ParseBool(value)
+				matched = dangling == (len(volume.Containers) == 0)
+			case "driver":
+				matched = volume.Driver == value
+			case "name":
+				matched = strings.HasPrefix(volume.Name, value)
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// The IDs of the containers using the named volume name: the ones it's
+// mounted in, and the ones their binds mount it in when they start, even
+// on a path which isn't one of their volumes
+func (runtime *Runtime) namedVolumeContainers(name string) []string {
+	ids := []string{}
+	for _, container := range runtime.List() {
+		used := false
+		for _, volume := range container.NamedVolumes {
+			if volume == name {
+				used = true
+				break
+			}
+		}
+		if !used {
+			hostConfig, _ := container.ReadHostConfig()
+			for _, bind := range hostConfig.Binds {
+				if strings.SplitN(bind, ":", 2)[0] == name {
+					used = true
+					break
+				}
+			}
+		}
+		if used {
+			ids = append(ids, container.ID)
+		}
+	}
+	return ids
+}
+
+// The IDs of the containers with a volume matching
+func (runtime *Runtime) volumeContainers(matching func(container *Container, volPath, srcPath string) bool) []string {
+	ids := []string{}
+	for _, container := range runtime.List() {
+		for volPath, srcPath := range container.Volumes {
+			if matching(container, volPath, srcPath) {
+				ids = append(ids, container.ID)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// The bytes of the files under root
+func dirSize(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(path string, fileInfo os.FileInfo, err error) error {
+		if err == nil {
+			size += fileInfo.Size()
+		}
+		return nil
+	})
+	return size
+}